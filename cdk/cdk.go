@@ -1,20 +1,38 @@
 package main
 
 import (
+	"log"
+	"os"
+	"path/filepath"
+
 	"github.com/KyleBrandon/scriptor/cdk/stacks"
 	"github.com/aws/jsii-runtime-go"
 )
 
+// Memory, timeouts and concurrency of every lambda
+const TUNING_FILE = "tuning.json"
+
 func main() {
 	defer jsii.Close()
 
+	tuning, err := stacks.LoadTuning(TUNING_FILE)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	cfg := stacks.NewCdkScriptorConfig()
-	cfg.NewResourcesStack("ScriptorResourcesStack")
-	cfg.NewWebhookHandlerStack("ScriptorWebhookProcessing")
-	cfg.NewWebHookRegisterStack("ScriptorWebHookReRegisterStack")
-	cfg.NewDocumentWorkflowStack("ScriptorDocumentWorkflow")
-	cfg.NewEmailIngestStack("ScriptorEmailIngestStack")
-	cfg.NewSQSHandlerStack("ScrptorSQSHandlerStack")
-
-	cfg.App.Synth(nil)
+	cfg.Tuning = tuning
+	cfg.NewScriptorStacks()
+
+	assembly := cfg.App.Synth(nil)
+
+	// keep a summary of the tuning applied with the synthesized templates
+	err = os.WriteFile(
+		filepath.Join(*assembly.Directory(), "tuning-summary.txt"),
+		[]byte(tuning.Summary()),
+		0o644,
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
 }
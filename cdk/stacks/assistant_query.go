@@ -0,0 +1,76 @@
+package stacks
+
+import (
+	"github.com/aws/aws-cdk-go/awscdk/v2"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awsapigateway"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awslambda"
+	"github.com/aws/jsii-runtime-go"
+)
+
+// Register the assistant query lambda on the API Gateway. The route is
+// called by an LLM assistant with its own API key, so the key is only good
+// for this route and is throttled harder than the rest of the API. The
+// lambda can only read documents.
+func (cfg *CdkScriptorConfig) addAssistantQueryRoute(
+	stack awscdk.Stack,
+	apiGateway awsapigateway.RestApi,
+) {
+	queryLambda := cfg.newFunction(
+		stack,
+		"scriptorAssistantQueryLambda",
+		&awslambda.FunctionProps{
+			Runtime: awslambda.Runtime_PROVIDED_AL2023(),
+			Code: awslambda.AssetCode_FromAsset(
+				jsii.String("../bin/assistant_query.zip"),
+				nil,
+			), // Path to compiled Go binary
+			Handler: jsii.String("main"),
+		},
+	)
+
+	cfg.documentTable.GrantReadData(queryLambda)
+	cfg.documentProcessingStageTable.GrantReadData(queryLambda)
+	cfg.documentBucket.GrantRead(queryLambda, nil)
+
+	integration := awsapigateway.NewLambdaIntegration(queryLambda, nil)
+
+	assistant := apiGateway.Root().AddResource(jsii.String("assistant"), nil)
+	queryRoute := assistant.AddResource(jsii.String("query"), nil)
+	queryRoute.AddMethod(
+		jsii.String("POST"),
+		integration,
+		&awsapigateway.MethodOptions{
+			ApiKeyRequired: jsii.Bool(true),
+		},
+	)
+
+	apiKey := awsapigateway.NewApiKey(
+		stack,
+		jsii.String("scriptorAssistantApiKey"),
+		&awsapigateway.ApiKeyProps{
+			ApiKeyName:  jsii.String("assistant"),
+			Description: jsii.String("Read-only key for the assistant query route"),
+		},
+	)
+
+	usagePlan := apiGateway.AddUsagePlan(
+		jsii.String("scriptorAssistantUsagePlan"),
+		&awsapigateway.UsagePlanProps{
+			Name: jsii.String("assistant"),
+			Throttle: &awsapigateway.ThrottleSettings{
+				RateLimit:  jsii.Number(1),
+				BurstLimit: jsii.Number(5),
+			},
+			Quota: &awsapigateway.QuotaSettings{
+				Limit:  jsii.Number(500),
+				Period: awsapigateway.Period_DAY,
+			},
+		},
+	)
+
+	usagePlan.AddApiKey(apiKey, nil)
+	usagePlan.AddApiStage(&awsapigateway.UsagePlanPerApiStage{
+		Api:   apiGateway,
+		Stage: apiGateway.DeploymentStage(),
+	})
+}
@@ -8,6 +8,7 @@ import (
 	"github.com/aws/aws-cdk-go/awscdk/v2/awss3"
 	"github.com/aws/aws-cdk-go/awscdk/v2/awss3notifications"
 	"github.com/aws/aws-cdk-go/awscdk/v2/awssecretsmanager"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awssns"
 	"github.com/aws/aws-cdk-go/awscdk/v2/awssqs"
 	"github.com/aws/jsii-runtime-go"
 )
@@ -59,6 +60,9 @@ func (cfg *CdkScriptorConfig) initializeWatchChannelLockTable(
 				Type: awsdynamodb.AttributeType_STRING,
 			},
 			BillingMode: awsdynamodb.BillingMode_PAY_PER_REQUEST,
+
+			// the locks of replaced channels are removed once they expire
+			TimeToLiveAttribute: jsii.String("expires_at"),
 		},
 	)
 }
@@ -91,11 +95,16 @@ func (cfg *CdkScriptorConfig) initializeWatchChannelTable(stack awscdk.Stack) {
 		},
 	)
 
-	// Add a GSI to query by ChannelID
+	// Add a GSI to query the channels expiring before a time. Every channel
+	// has the same partition, so they are all in order of expiry.
 	cfg.watchChannelTable.AddGlobalSecondaryIndex(
 		&awsdynamodb.GlobalSecondaryIndexProps{
-			IndexName: jsii.String("ExpiresAtIndex"),
+			IndexName: jsii.String("ExpiryIndex"),
 			PartitionKey: &awsdynamodb.Attribute{
+				Name: jsii.String("expiry_partition"),
+				Type: awsdynamodb.AttributeType_STRING,
+			},
+			SortKey: &awsdynamodb.Attribute{
 				Name: jsii.String("expires_at"),
 				Type: awsdynamodb.AttributeType_NUMBER,
 			},
@@ -115,7 +124,9 @@ func (cfg *CdkScriptorConfig) initializeDocumentTable(stack awscdk.Stack) {
 				Name: jsii.String("id"),
 				Type: awsdynamodb.AttributeType_STRING,
 			},
-			BillingMode: awsdynamodb.BillingMode_PAY_PER_REQUEST,
+			// only set on completed documents when RETENTION_DAYS is
+			TimeToLiveAttribute: jsii.String(database.DOCUMENT_TTL_ATTRIBUTE),
+			BillingMode:         awsdynamodb.BillingMode_PAY_PER_REQUEST,
 		},
 	)
 
@@ -142,6 +153,34 @@ func (cfg *CdkScriptorConfig) initializeDocumentTable(stack awscdk.Stack) {
 		},
 	)
 
+	// Add a GSI to find documents with the same content
+	cfg.documentTable.AddGlobalSecondaryIndex(
+		&awsdynamodb.GlobalSecondaryIndexProps{
+			IndexName: jsii.String("ContentHashIndex"),
+			PartitionKey: &awsdynamodb.Attribute{
+				Name: jsii.String("content_hash"),
+				Type: awsdynamodb.AttributeType_STRING,
+			},
+			ProjectionType: awsdynamodb.ProjectionType_ALL,
+		},
+	)
+
+	// Add a GSI to find the documents in progress or in error, oldest first
+	cfg.documentTable.AddGlobalSecondaryIndex(
+		&awsdynamodb.GlobalSecondaryIndexProps{
+			IndexName: jsii.String("StatusIndex"),
+			PartitionKey: &awsdynamodb.Attribute{
+				Name: jsii.String("status"),
+				Type: awsdynamodb.AttributeType_STRING,
+			},
+			SortKey: &awsdynamodb.Attribute{
+				Name: jsii.String("created_time"),
+				Type: awsdynamodb.AttributeType_STRING,
+			},
+			ProjectionType: awsdynamodb.ProjectionType_ALL,
+		},
+	)
+
 	// register the DocumentProcessingStage table
 	cfg.documentProcessingStageTable = awsdynamodb.NewTable(
 		stack,
@@ -156,16 +195,76 @@ func (cfg *CdkScriptorConfig) initializeDocumentTable(stack awscdk.Stack) {
 				Name: jsii.String("stage"),
 				Type: awsdynamodb.AttributeType_STRING,
 			},
+			TimeToLiveAttribute: jsii.String(database.DOCUMENT_TTL_ATTRIBUTE),
+			BillingMode:         awsdynamodb.BillingMode_PAY_PER_REQUEST,
+		},
+	)
+
+}
+
+// The redacted webhook requests are only kept for a few days, DynamoDB
+// removes them once expires_at passes
+func (cfg *CdkScriptorConfig) initializeWebhookCaptureTable(stack awscdk.Stack) {
+	cfg.webhookCaptureTable = awsdynamodb.NewTable(
+		stack,
+		jsii.String("WebhookCaptureTable"),
+		&awsdynamodb.TableProps{
+			TableName: jsii.String(database.WEBHOOK_CAPTURE_TABLE),
+			PartitionKey: &awsdynamodb.Attribute{
+				Name: jsii.String("channel_id"),
+				Type: awsdynamodb.AttributeType_STRING,
+			},
+			SortKey: &awsdynamodb.Attribute{
+				Name: jsii.String("captured_at"),
+				Type: awsdynamodb.AttributeType_STRING,
+			},
+			TimeToLiveAttribute: jsii.String("expires_at"),
+			BillingMode:         awsdynamodb.BillingMode_PAY_PER_REQUEST,
+		},
+	)
+}
+
+// The notifications moved to the dead-letter queue, kept so they can be sent
+// back to the main queue
+func (cfg *CdkScriptorConfig) initializeFailedNotificationTable(stack awscdk.Stack) {
+	cfg.failedNotificationTable = awsdynamodb.NewTable(
+		stack,
+		jsii.String("FailedNotificationTable"),
+		&awsdynamodb.TableProps{
+			TableName: jsii.String(database.FAILED_NOTIFICATION_TABLE),
+			PartitionKey: &awsdynamodb.Attribute{
+				Name: jsii.String("message_id"),
+				Type: awsdynamodb.AttributeType_STRING,
+			},
 			BillingMode: awsdynamodb.BillingMode_PAY_PER_REQUEST,
 		},
 	)
+}
 
+// What happened to each notification from the webhook through the workflows
+// it started
+func (cfg *CdkScriptorConfig) initializeNotificationHistoryTable(stack awscdk.Stack) {
+	cfg.notificationHistoryTable = awsdynamodb.NewTable(
+		stack,
+		jsii.String("NotificationHistoryTable"),
+		&awsdynamodb.TableProps{
+			TableName: jsii.String(database.NOTIFICATION_HISTORY_TABLE),
+			PartitionKey: &awsdynamodb.Attribute{
+				Name: jsii.String("notification_id"),
+				Type: awsdynamodb.AttributeType_STRING,
+			},
+			BillingMode: awsdynamodb.BillingMode_PAY_PER_REQUEST,
+		},
+	)
 }
 
 func (cfg *CdkScriptorConfig) initializeDynamoDB(stack awscdk.Stack) {
 	cfg.initializeWatchChannelLockTable(stack)
 	cfg.initializeWatchChannelTable(stack)
 	cfg.initializeDocumentTable(stack)
+	cfg.initializeWebhookCaptureTable(stack)
+	cfg.initializeFailedNotificationTable(stack)
+	cfg.initializeNotificationHistoryTable(stack)
 }
 
 func (cfg *CdkScriptorConfig) initializeS3Buckets(stack awscdk.Stack) {
@@ -208,7 +307,7 @@ func (cfg *CdkScriptorConfig) initializeS3Buckets(stack awscdk.Stack) {
 
 func (cfg *CdkScriptorConfig) initializeSQS(stack awscdk.Stack) {
 
-	dlq := awssqs.NewQueue(
+	cfg.documentDLQ = awssqs.NewQueue(
 		stack,
 		jsii.String("scriptorDocumentDLQ"),
 		&awssqs.QueueProps{
@@ -225,7 +324,7 @@ func (cfg *CdkScriptorConfig) initializeSQS(stack awscdk.Stack) {
 			RetentionPeriod:        awscdk.Duration_Days(jsii.Number(4)),
 			VisibilityTimeout:      awscdk.Duration_Minutes(jsii.Number(5)),
 			DeadLetterQueue: &awssqs.DeadLetterQueue{
-				Queue:           dlq,
+				Queue:           cfg.documentDLQ,
 				MaxReceiveCount: jsii.Number(5),
 			},
 		},
@@ -255,6 +354,18 @@ func (cfg *CdkScriptorConfig) initializeSQS(stack awscdk.Stack) {
 	)
 }
 
+// Alerts for the failures that need someone to look at them. Subscribe to the
+// topic to receive them.
+func (cfg *CdkScriptorConfig) initializeSNS(stack awscdk.Stack) {
+	cfg.alertTopic = awssns.NewTopic(
+		stack,
+		jsii.String("scriptorAlertTopic"),
+		&awssns.TopicProps{
+			TopicName: jsii.String("ScriptorAlerts"),
+		},
+	)
+}
+
 func (cfg *CdkScriptorConfig) NewResourcesStack(id string) awscdk.Stack {
 	stack := awscdk.NewStack(cfg.App, &id, &cfg.Props.StackProps)
 
@@ -262,6 +373,7 @@ func (cfg *CdkScriptorConfig) NewResourcesStack(id string) awscdk.Stack {
 	cfg.initializeDynamoDB(stack)
 	cfg.initializeSQS(stack)
 	cfg.initializeS3Buckets(stack)
+	cfg.initializeSNS(stack)
 
 	return stack
 
@@ -0,0 +1,84 @@
+package stacks
+
+import (
+	"github.com/aws/aws-cdk-go/awscdk/v2"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awsapigateway"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awslambda"
+	"github.com/aws/jsii-runtime-go"
+)
+
+// Register the lambda that adds, lists and removes the watched folders on
+// the API Gateway. The routes are for admins and need their own API key, so
+// the assistant's key can't change which folders are watched.
+func (cfg *CdkScriptorConfig) addChannelAdminRoutes(
+	stack awscdk.Stack,
+	apiGateway awsapigateway.RestApi,
+) {
+	adminLambda := cfg.newFunction(
+		stack,
+		"scriptorChannelAdminLambda",
+		&awslambda.FunctionProps{
+			Runtime: awslambda.Runtime_PROVIDED_AL2023(),
+			Code: awslambda.AssetCode_FromAsset(
+				jsii.String("../bin/channel_admin.zip"),
+				nil,
+			), // Path to compiled Go binary
+			Handler: jsii.String("main"),
+			Environment: &map[string]*string{
+				"SQS_QUEUE_URL": jsii.String(*cfg.documentQueue.QueueUrl()),
+			},
+		},
+	)
+
+	cfg.GoogleServiceKeySecret.GrantRead(adminLambda, nil)
+	cfg.watchChannelTable.GrantReadWriteData(adminLambda)
+	cfg.watchChannelLockTable.GrantReadWriteData(adminLambda)
+	cfg.documentQueue.GrantSendMessages(adminLambda)
+
+	integration := awsapigateway.NewLambdaIntegration(adminLambda, nil)
+	options := &awsapigateway.MethodOptions{
+		ApiKeyRequired: jsii.Bool(true),
+	}
+
+	channels := apiGateway.Root().AddResource(jsii.String("channels"), nil)
+	channels.AddMethod(jsii.String("GET"), integration, options)
+	channels.AddMethod(jsii.String("POST"), integration, options)
+
+	channel := channels.AddResource(jsii.String("{folderID}"), nil)
+	channel.AddMethod(jsii.String("DELETE"), integration, options)
+
+	pause := channel.AddResource(jsii.String("pause"), nil)
+	pause.AddMethod(jsii.String("POST"), integration, options)
+
+	resume := channel.AddResource(jsii.String("resume"), nil)
+	resume.AddMethod(jsii.String("POST"), integration, options)
+
+	backfill := channel.AddResource(jsii.String("backfill"), nil)
+	backfill.AddMethod(jsii.String("POST"), integration, options)
+
+	apiKey := awsapigateway.NewApiKey(
+		stack,
+		jsii.String("scriptorChannelAdminApiKey"),
+		&awsapigateway.ApiKeyProps{
+			ApiKeyName:  jsii.String("channel-admin"),
+			Description: jsii.String("Key for the routes that manage the watched folders"),
+		},
+	)
+
+	usagePlan := apiGateway.AddUsagePlan(
+		jsii.String("scriptorChannelAdminUsagePlan"),
+		&awsapigateway.UsagePlanProps{
+			Name: jsii.String("channel-admin"),
+			Throttle: &awsapigateway.ThrottleSettings{
+				RateLimit:  jsii.Number(1),
+				BurstLimit: jsii.Number(5),
+			},
+		},
+	)
+
+	usagePlan.AddApiKey(apiKey, nil)
+	usagePlan.AddApiStage(&awsapigateway.UsagePlanPerApiStage{
+		Api:   apiGateway,
+		Stage: apiGateway.DeploymentStage(),
+	})
+}
@@ -0,0 +1,35 @@
+package stacks
+
+import (
+	"fmt"
+
+	"github.com/KyleBrandon/scriptor/pkg/metrics"
+	"github.com/aws/aws-cdk-go/awscdk/v2"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awscloudwatch"
+	"github.com/aws/jsii-runtime-go"
+)
+
+// Name of the CloudWatch dashboard of the metrics Scriptor emits
+const DASHBOARD_NAME = "Scriptor"
+
+// NewDashboardStack deploys the dashboard generated from the metrics
+// registry, so a new metric gets a graph without editing the dashboard.
+func (cfg *CdkScriptorConfig) NewDashboardStack(id string) awscdk.Stack {
+	stack := awscdk.NewStack(cfg.App, &id, &cfg.Props.StackProps)
+
+	body, err := metrics.DashboardBody(*awscdk.Aws_REGION())
+	if err != nil {
+		panic(fmt.Sprintf("failed to generate the dashboard: %v", err))
+	}
+
+	awscloudwatch.NewCfnDashboard(
+		stack,
+		jsii.String("scriptorDashboard"),
+		&awscloudwatch.CfnDashboardProps{
+			DashboardName: jsii.String(DASHBOARD_NAME),
+			DashboardBody: jsii.String(body),
+		},
+	)
+
+	return stack
+}
@@ -0,0 +1,66 @@
+package stacks
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/KyleBrandon/scriptor/pkg/metrics"
+	"github.com/aws/aws-cdk-go/awscdk/v2/assertions"
+	"github.com/aws/jsii-runtime-go"
+)
+
+func TestDashboardHasEveryMetric(t *testing.T) {
+	// the jsii runtime keeps the folder it was started in, which has to be
+	// the cdk folder for the stacks that reference the lambda assets
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(".."); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	cfg := NewCdkScriptorConfig()
+	stack := cfg.NewDashboardStack("ScriptorDashboardStack")
+
+	template := assertions.Template_FromStack(stack, nil)
+	dashboards := template.FindResources(jsii.String("AWS::CloudWatch::Dashboard"), nil)
+	if len(*dashboards) != 1 {
+		t.Fatalf("unexpected dashboards: %d", len(*dashboards))
+	}
+
+	for _, resource := range *dashboards {
+		props := (*resource)["Properties"].(map[string]any)
+		if props["DashboardName"] != DASHBOARD_NAME {
+			t.Fatalf("unexpected dashboard name: %v", props["DashboardName"])
+		}
+
+		body := bodyText(props["DashboardBody"])
+		for _, metric := range metrics.Registered() {
+			if !strings.Contains(body, `"title":"`+string(metric.Name)+`"`) {
+				t.Errorf("the dashboard has no widget for %s", metric.Name)
+			}
+		}
+	}
+}
+
+// The region is filled in when the stack is deployed, which splits the body
+// into the parts of an Fn::Join. Only the literal parts are kept.
+func bodyText(body any) string {
+	if text, ok := body.(string); ok {
+		return text
+	}
+
+	join := body.(map[string]any)["Fn::Join"].([]any)
+
+	var b strings.Builder
+	for _, part := range join[1].([]any) {
+		if text, ok := part.(string); ok {
+			b.WriteString(text)
+		}
+	}
+
+	return b.String()
+}
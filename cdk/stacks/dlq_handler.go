@@ -0,0 +1,48 @@
+package stacks
+
+import (
+	"github.com/aws/aws-cdk-go/awscdk/v2"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awslambda"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awslambdaeventsources"
+	"github.com/aws/jsii-runtime-go"
+)
+
+// Record the notifications that land in the dead-letter queue and alert on
+// them
+func (cfg *CdkScriptorConfig) NewDLQHandlerStack(id string) awscdk.Stack {
+	stack := awscdk.NewStack(cfg.App, &id, &cfg.Props.StackProps)
+
+	dlqLambda := cfg.newFunction(
+		stack,
+		"scriptorDLQHandlerLambda",
+		&awslambda.FunctionProps{
+			Runtime: awslambda.Runtime_PROVIDED_AL2023(),
+			Code: awslambda.AssetCode_FromAsset(
+				jsii.String("../bin/dlq_handler.zip"),
+				nil,
+			), // Path to compiled Go binary
+			Handler: jsii.String("main"),
+			Environment: &map[string]*string{
+				"ALERT_TOPIC_ARN": jsii.String(*cfg.alertTopic.TopicArn()),
+			},
+		},
+	)
+
+	// setup an event source for the dead-letter queue
+	eventSource := awslambdaeventsources.NewSqsEventSource(
+		cfg.documentDLQ,
+		&awslambdaeventsources.SqsEventSourceProps{
+			BatchSize:               jsii.Number(1),
+			ReportBatchItemFailures: jsii.Bool(true),
+		},
+	)
+	dlqLambda.AddEventSource(eventSource)
+
+	// grant the lambda r/w permissions to the failed notification table
+	cfg.failedNotificationTable.GrantReadWriteData(dlqLambda)
+
+	// grant the lambda permission to publish the alerts
+	cfg.alertTopic.GrantPublish(dlqLambda)
+
+	return stack
+}
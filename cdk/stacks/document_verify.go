@@ -0,0 +1,42 @@
+package stacks
+
+import (
+	"github.com/aws/aws-cdk-go/awscdk/v2"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awsapigateway"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awslambda"
+	"github.com/aws/jsii-runtime-go"
+)
+
+// Register the document verification lambda on the API Gateway
+func (cfg *CdkScriptorConfig) addDocumentVerifyRoute(
+	stack awscdk.Stack,
+	document awsapigateway.IResource,
+) {
+	verifyLambda := cfg.newFunction(
+		stack,
+		"scriptorDocumentVerifyLambda",
+		&awslambda.FunctionProps{
+			Runtime: awslambda.Runtime_PROVIDED_AL2023(),
+			Code: awslambda.AssetCode_FromAsset(
+				jsii.String("../bin/document_verify.zip"),
+				nil,
+			), // Path to compiled Go binary
+			Handler: jsii.String("main"),
+		},
+	)
+
+	cfg.documentTable.GrantReadData(verifyLambda)
+	cfg.documentProcessingStageTable.GrantReadData(verifyLambda)
+	cfg.documentBucket.GrantRead(verifyLambda, nil)
+
+	integration := awsapigateway.NewLambdaIntegration(verifyLambda, nil)
+
+	verifyRoute := document.AddResource(jsii.String("verify"), nil)
+	verifyRoute.AddMethod(
+		jsii.String("POST"),
+		integration,
+		&awsapigateway.MethodOptions{
+			AuthorizationType: awsapigateway.AuthorizationType_IAM,
+		},
+	)
+}
@@ -19,12 +19,12 @@ func (cfg *CdkScriptorConfig) NewDocumentWorkflowStack(id string) awscdk.Stack {
 
 func (cfg *CdkScriptorConfig) configureDownloadLambda(
 	stack awscdk.Stack,
-) awslambda.Function {
+) awslambda.IFunction {
 
 	// Define Lambda functions for workflow steps
-	downloadLambda := awslambda.NewFunction(
+	downloadLambda := cfg.newFunction(
 		stack,
-		jsii.String("scriptorDownloadLambda"),
+		"scriptorDownloadLambda",
 		&awslambda.FunctionProps{
 			Runtime: awslambda.Runtime_PROVIDED_AL2023(),
 			Code: awslambda.AssetCode_FromAsset(
@@ -32,7 +32,9 @@ func (cfg *CdkScriptorConfig) configureDownloadLambda(
 				nil,
 			), // Path to compiled Go binary
 			Handler: jsii.String("main"),
-			Timeout: awscdk.Duration_Minutes(jsii.Number(5)),
+			Environment: &map[string]*string{
+				"MAX_DOCUMENT_SIZE_MB": jsii.String("200"),
+			},
 		},
 	)
 
@@ -48,16 +50,20 @@ func (cfg *CdkScriptorConfig) configureDownloadLambda(
 	// grant the lambda read/write permissions to the S3 staging bucket
 	cfg.documentBucket.GrantReadWrite(downloadLambda, nil)
 
+	// grant the lambda r/w permissions to the watch channel lock table to
+	// give back the execution of a document that ends here
+	cfg.watchChannelLockTable.GrantReadWriteData(downloadLambda)
+
 	return downloadLambda
 
 }
 
 func (cfg *CdkScriptorConfig) configureMathpixLambda(
 	stack awscdk.Stack,
-) awslambda.Function {
-	mathpixLambda := awslambda.NewFunction(
+) awslambda.IFunction {
+	mathpixLambda := cfg.newFunction(
 		stack,
-		jsii.String("scriptorMathpixProcess"),
+		"scriptorMathpixProcess",
 		&awslambda.FunctionProps{
 			Runtime: awslambda.Runtime_PROVIDED_AL2023(),
 			Code: awslambda.AssetCode_FromAsset(
@@ -65,7 +71,10 @@ func (cfg *CdkScriptorConfig) configureMathpixLambda(
 				nil,
 			),
 			Handler: jsii.String("main"),
-			Timeout: awscdk.Duration_Minutes(jsii.Number(5)),
+			Environment: &map[string]*string{
+				"SPLIT_ON_SEPARATORS":   jsii.String("true"),
+				"SEPARATOR_BLANK_PAGES": jsii.String("true"),
+			},
 		},
 	)
 
@@ -86,10 +95,10 @@ func (cfg *CdkScriptorConfig) configureMathpixLambda(
 
 func (cfg *CdkScriptorConfig) configureOpenAILambda(
 	stack awscdk.Stack,
-) awslambda.Function {
-	openAILambda := awslambda.NewFunction(
+) awslambda.IFunction {
+	openAILambda := cfg.newFunction(
 		stack,
-		jsii.String("scriptorOpenAIProcess"),
+		"scriptorOpenAIProcess",
 		&awslambda.FunctionProps{
 			Runtime: awslambda.Runtime_PROVIDED_AL2023(),
 			Code: awslambda.AssetCode_FromAsset(
@@ -97,7 +106,12 @@ func (cfg *CdkScriptorConfig) configureOpenAILambda(
 				nil,
 			),
 			Handler: jsii.String("main"),
-			Timeout: awscdk.Duration_Minutes(jsii.Number(5)),
+			Environment: &map[string]*string{
+				"TABLE_POLICY":             jsii.String("split"),
+				"TABLE_MAX_COLUMNS":        jsii.String("9"),
+				"TABLE_CHUNK_SIZE":         jsii.String("4"),
+				"TABLE_TRANSPOSE_MAX_ROWS": jsii.String("3"),
+			},
 		},
 	)
 
@@ -107,6 +121,9 @@ func (cfg *CdkScriptorConfig) configureOpenAILambda(
 	// grant the lambda read/write permissions to the S3 staging bucket
 	cfg.documentBucket.GrantReadWrite(openAILambda, nil)
 
+	// grant the lambda read permissions to the document table
+	cfg.documentTable.GrantReadData(openAILambda)
+
 	// grant the lambda r/w permissions to the document table
 	cfg.documentProcessingStageTable.GrantReadWriteData(openAILambda)
 
@@ -115,10 +132,10 @@ func (cfg *CdkScriptorConfig) configureOpenAILambda(
 
 func (cfg *CdkScriptorConfig) configureUploadLambda(
 	stack awscdk.Stack,
-) awslambda.Function {
-	uploadLambda := awslambda.NewFunction(
+) awslambda.IFunction {
+	uploadLambda := cfg.newFunction(
 		stack,
-		jsii.String("scriptorUploadLambda"),
+		"scriptorUploadLambda",
 		&awslambda.FunctionProps{
 			Runtime: awslambda.Runtime_PROVIDED_AL2023(),
 			Code: awslambda.AssetCode_FromAsset(
@@ -126,7 +143,9 @@ func (cfg *CdkScriptorConfig) configureUploadLambda(
 				nil,
 			),
 			Handler: jsii.String("main"),
-			Timeout: awscdk.Duration_Minutes(jsii.Number(5)),
+			Environment: &map[string]*string{
+				"NOTE_SPLIT_MAX_BYTES": jsii.String("524288"),
+			},
 		},
 	)
 	// grant the lambda read/write permissions to the S3 staging bucket
@@ -139,18 +158,106 @@ func (cfg *CdkScriptorConfig) configureUploadLambda(
 	cfg.GoogleServiceKeySecret.GrantRead(uploadLambda, nil)
 	// grant lambda r/w permissions to the default Google Drive folders
 	cfg.DefaultFoldersSecret.GrantRead(uploadLambda, nil)
+	// grant the lambda read permissions to the watch channel folders
+	cfg.watchChannelTable.GrantReadData(uploadLambda)
+	// grant the lambda r/w permissions to the watch channel execution counts
+	cfg.watchChannelLockTable.GrantReadWriteData(uploadLambda)
 
 	return uploadLambda
 }
 
+func (cfg *CdkScriptorConfig) configureFailureLambda(
+	stack awscdk.Stack,
+) awslambda.IFunction {
+	failureLambda := cfg.newFunction(
+		stack,
+		"scriptorFailureLambda",
+		&awslambda.FunctionProps{
+			Runtime: awslambda.Runtime_PROVIDED_AL2023(),
+			Code: awslambda.AssetCode_FromAsset(
+				jsii.String("../bin/workflow_failure.zip"),
+				nil,
+			),
+			Handler: jsii.String("main"),
+		},
+	)
+	// grant the lambda r/w permissions to the document table to clear the
+	// execution slot of the document
+	cfg.documentTable.GrantReadWriteData(failureLambda)
+	// grant the lambda read permissions to the document stage table
+	cfg.documentProcessingStageTable.GrantReadData(failureLambda)
+	// grant the lambda read permissions to the watch channel folders
+	cfg.watchChannelTable.GrantReadData(failureLambda)
+	// grant the lambda r/w permissions to the watch channel execution counts
+	cfg.watchChannelLockTable.GrantReadWriteData(failureLambda)
+	// grant lambda read permissions to Google Drive API key
+	cfg.GoogleServiceKeySecret.GrantRead(failureLambda, nil)
+
+	return failureLambda
+}
+
+// Chain the stages after Mathpix. A scan that was split into several
+// documents runs the OpenAI and upload stages for each of them before the
+// upload of the scan saves and archives the original.
+func (cfg *CdkScriptorConfig) afterMathpix(
+	stack awscdk.Stack,
+	suffix string,
+	openAILambda awslambda.IFunction,
+	uploadLambda awslambda.IFunction,
+	taskTimeout awsstepfunctions.Timeout,
+	single awsstepfunctions.IChainable,
+) awsstepfunctions.IChainable {
+	newTask := func(id string, function awslambda.IFunction) awsstepfunctionstasks.LambdaInvoke {
+		return awsstepfunctionstasks.NewLambdaInvoke(
+			stack,
+			jsii.String(id+suffix),
+			&awsstepfunctionstasks.LambdaInvokeProps{
+				LambdaFunction: function,
+				TaskTimeout:    taskTimeout,
+				OutputPath:     jsii.String("$.Payload"),
+			},
+		)
+	}
+
+	processChildren := awsstepfunctions.NewMap(
+		stack,
+		jsii.String("ProcessChildren"+suffix),
+		&awsstepfunctions.MapProps{
+			ItemsPath:      awsstepfunctions.JsonPath_StringAt(jsii.String("$.children")),
+			MaxConcurrency: jsii.Number(2),
+			ResultPath:     awsstepfunctions.JsonPath_DISCARD(),
+		},
+	)
+	processChildren.ItemProcessor(
+		newTask("OpenAIChildTask", openAILambda).
+			Next(newTask("UploadChildTask", uploadLambda)),
+		nil,
+	)
+
+	return awsstepfunctions.NewChoice(
+		stack,
+		jsii.String("SplitCheck"+suffix),
+		nil,
+	).
+		When(
+			awsstepfunctions.Condition_IsPresent(jsii.String("$.children")),
+			processChildren.Next(newTask("UploadScanTask", uploadLambda)),
+			nil,
+		).
+		Otherwise(single)
+}
+
 func (cfg *CdkScriptorConfig) configureStateMachine(stack awscdk.Stack) {
 	downloadLambda := cfg.configureDownloadLambda(stack)
 	mathpixLambda := cfg.configureMathpixLambda(stack)
 	openAILambda := cfg.configureOpenAILambda(stack)
 	uploadLambda := cfg.configureUploadLambda(stack)
+	failureLambda := cfg.configureFailureLambda(stack)
 
 	taskTimeout := awsstepfunctions.Timeout_Duration(
-		awscdk.Duration_Minutes(jsii.Number(3)),
+		awscdk.Duration_Seconds(
+			jsii.Number(cfg.Tuning.Workflow.TaskTimeoutSeconds),
+		),
 	)
 
 	downloadTask := awsstepfunctionstasks.NewLambdaInvoke(
@@ -238,38 +345,208 @@ func (cfg *CdkScriptorConfig) configureStateMachine(stack awscdk.Stack) {
 		},
 	)
 
+	// documents over the size limit are left in place and not processed
+	documentTooLarge := awsstepfunctions.NewFail(
+		stack,
+		jsii.String("DocumentTooLarge"),
+		&awsstepfunctions.FailProps{
+			Cause: jsii.String("Document exceeds the maximum size"),
+			Error: jsii.String(types.DOCUMENT_ERROR_TOO_LARGE),
+		},
+	)
+
+	downloadTask.AddCatch(documentTooLarge, &awsstepfunctions.CatchProps{
+		Errors: jsii.Strings(types.DOCUMENT_ERROR_TOO_LARGE),
+	})
+
+	// a downloaded document with the same content as one still being
+	// processed checks on it again without downloading again
+	duplicateCheckTask := awsstepfunctionstasks.NewLambdaInvoke(
+		stack,
+		jsii.String("DuplicateCheckTask"),
+		&awsstepfunctionstasks.LambdaInvokeProps{
+			LambdaFunction: downloadLambda,
+			TaskTimeout:    taskTimeout,
+			OutputPath:     jsii.String("$.Payload"),
+		},
+	)
+
+	// wait for a document with the same content to finish so its note can
+	// be reused, about 5 minutes in total
+	duplicateCheckTask.AddRetry(&awsstepfunctions.RetryProps{
+		Errors:      jsii.Strings(types.DOCUMENT_ERROR_DUPLICATE_PENDING),
+		Interval:    awscdk.Duration_Seconds(jsii.Number(20)),
+		BackoffRate: jsii.Number(2),
+		MaxAttempts: jsii.Number(4),
+	})
+
+	// documents with the same content as one already processed are uploaded
+	// with the note of the original
+	uploadDuplicateTask := awsstepfunctionstasks.NewLambdaInvoke(
+		stack,
+		jsii.String("UploadDuplicateTask"),
+		&awsstepfunctionstasks.LambdaInvokeProps{
+			LambdaFunction: uploadLambda,
+			TaskTimeout:    taskTimeout,
+			OutputPath:     jsii.String("$.Payload"),
+		},
+	)
+
+	// documents removed from Drive before the download have nothing left to
+	// process, the workflow ends without failing
+	sourceCheck := awsstepfunctions.NewChoice(
+		stack,
+		jsii.String("SourceCheck"),
+		nil,
+	)
+
+	sourceMissing := awsstepfunctions.NewSucceed(
+		stack,
+		jsii.String("SourceMissing"),
+		&awsstepfunctions.SucceedProps{
+			Comment: jsii.String("Document was removed before it was downloaded"),
+		},
+	)
+
+	sourceMissingCondition := awsstepfunctions.Condition_And(
+		awsstepfunctions.Condition_IsPresent(jsii.String("$.status")),
+		awsstepfunctions.Condition_StringEquals(
+			jsii.String("$.status"),
+			jsii.String(types.DOCUMENT_STATUS_SOURCE_MISSING),
+		),
+	)
+
+	duplicateCondition := awsstepfunctions.Condition_And(
+		awsstepfunctions.Condition_IsPresent(jsii.String("$.status")),
+		awsstepfunctions.Condition_StringEquals(
+			jsii.String("$.status"),
+			jsii.String(types.DOCUMENT_STATUS_DUPLICATE),
+		),
+	)
+
+	duplicatePendingCondition := awsstepfunctions.Condition_And(
+		awsstepfunctions.Condition_IsPresent(jsii.String("$.status")),
+		awsstepfunctions.Condition_StringEquals(
+			jsii.String("$.status"),
+			jsii.String(types.DOCUMENT_STATUS_DUPLICATE_PENDING),
+		),
+	)
+
+	processFromNew := mathpixTaskFromNew.Next(
+		cfg.afterMathpix(
+			stack,
+			"FromNew",
+			openAILambda,
+			uploadLambda,
+			taskTimeout,
+			openAITaskFromNew.Next(uploadTaskFromNew),
+		),
+	)
+
+	// the original either finished, and its note is reused, or failed, and
+	// the document is processed on its own
+	duplicateCheck := awsstepfunctions.NewChoice(
+		stack,
+		jsii.String("DuplicateCheck"),
+		nil,
+	).
+		When(duplicateCondition, uploadDuplicateTask, nil).
+		Otherwise(processFromNew)
+
 	workflowDefinition := stageSelector.
 		When(
 			awsstepfunctions.Condition_StringEquals(
 				jsii.String("$.stage"),
-				jsii.String(types.DOCUMENT_STAGE_NEW),
+				jsii.String(string(types.DOCUMENT_STAGE_NEW)),
+			),
+			downloadTask.Next(
+				sourceCheck.
+					When(sourceMissingCondition, sourceMissing, nil).
+					When(duplicateCondition, uploadDuplicateTask, nil).
+					When(
+						duplicatePendingCondition,
+						duplicateCheckTask.Next(duplicateCheck),
+						nil,
+					).
+					Otherwise(processFromNew),
 			),
-			downloadTask.Next(mathpixTaskFromNew).
-				Next(openAITaskFromNew).
-				Next(uploadTaskFromNew),
 			nil,
 		).
 		When(
 			awsstepfunctions.Condition_StringEquals(
 				jsii.String("$.stage"),
-				jsii.String(types.DOCUMENT_STAGE_DOWNLOAD),
+				jsii.String(string(types.DOCUMENT_STAGE_DOWNLOAD)),
+			),
+			mathpixTaskFromDownloaded.Next(
+				cfg.afterMathpix(
+					stack,
+					"FromDownloaded",
+					openAILambda,
+					uploadLambda,
+					taskTimeout,
+					openAITaskFromDownloaded.Next(uploadTaskFromDownloaded),
+				),
 			),
-			mathpixTaskFromDownloaded.Next(openAITaskFromDownloaded).
-				Next(uploadTaskFromDownloaded),
 			nil,
 		).
 		Otherwise(invalidStage)
 
+	// a failure anywhere in the workflow comments on the original before
+	// the execution fails
+	failureTask := awsstepfunctionstasks.NewLambdaInvoke(
+		stack,
+		jsii.String("FailureTask"),
+		&awsstepfunctionstasks.LambdaInvokeProps{
+			LambdaFunction: failureLambda,
+			TaskTimeout:    taskTimeout,
+			ResultPath:     awsstepfunctions.JsonPath_DISCARD(),
+		},
+	)
+
+	workflowFailed := awsstepfunctions.NewFail(
+		stack,
+		jsii.String("WorkflowFailed"),
+		&awsstepfunctions.FailProps{
+			ErrorPath: jsii.String("$.error.Error"),
+			CausePath: jsii.String("$.error.Cause"),
+		},
+	)
+
+	workflow := awsstepfunctions.NewParallel(
+		stack,
+		jsii.String("Workflow"),
+		nil,
+	).Branch(workflowDefinition)
+
+	// a newer revision of the file replaced the document, the workflow of
+	// the newer revision publishes it so this one ends without failing
+	superseded := awsstepfunctions.NewSucceed(
+		stack,
+		jsii.String("Superseded"),
+		&awsstepfunctions.SucceedProps{
+			Comment: jsii.String("Document was replaced by a newer revision"),
+		},
+	)
+
+	workflow.AddCatch(superseded, &awsstepfunctions.CatchProps{
+		Errors:     jsii.Strings(types.DOCUMENT_ERROR_SUPERSEDED),
+		ResultPath: awsstepfunctions.JsonPath_DISCARD(),
+	})
+
+	workflow.AddCatch(failureTask.Next(workflowFailed), &awsstepfunctions.CatchProps{
+		ResultPath: jsii.String("$.error"),
+	})
+
 	// Create Step Functions state machine
 	cfg.stateMachine = awsstepfunctions.NewStateMachine(
 		stack,
 		jsii.String("FileProcessingStateMachine"),
 		&awsstepfunctions.StateMachineProps{
 			DefinitionBody: awsstepfunctions.DefinitionBody_FromChainable(
-				workflowDefinition,
+				workflow,
 			),
-			Timeout: awscdk.Duration_Minutes(
-				jsii.Number(15),
+			Timeout: awscdk.Duration_Seconds(
+				jsii.Number(cfg.Tuning.Workflow.TimeoutSeconds),
 			), // Workflow timeout
 		},
 	)
@@ -10,9 +10,9 @@ import (
 func (cfg *CdkScriptorConfig) NewEmailIngestStack(id string) awscdk.Stack {
 	stack := awscdk.NewStack(cfg.App, &id, &cfg.Props.StackProps)
 
-	emailLambda := awslambda.NewFunction(
+	emailLambda := cfg.newFunction(
 		stack,
-		jsii.String("scriptorEmailIngestLambda"),
+		"scriptorEmailIngestLambda",
 		&awslambda.FunctionProps{
 			Runtime: awslambda.Runtime_PROVIDED_AL2023(),
 			Code: awslambda.AssetCode_FromAsset(
@@ -20,7 +20,6 @@ func (cfg *CdkScriptorConfig) NewEmailIngestStack(id string) awscdk.Stack {
 				nil,
 			),
 			Handler: jsii.String("main"),
-			Timeout: awscdk.Duration_Minutes(jsii.Number(5)),
 			Environment: &map[string]*string{
 				"STATE_MACHINE_ARN": jsii.String(
 					*cfg.stateMachine.StateMachineArn(),
@@ -43,6 +42,7 @@ func (cfg *CdkScriptorConfig) NewEmailIngestStack(id string) awscdk.Stack {
 	cfg.documentTable.GrantReadWriteData(emailLambda)
 	cfg.documentProcessingStageTable.GrantReadWriteData(emailLambda)
 	cfg.stateMachine.GrantStartExecution(emailLambda)
+	cfg.stateMachine.GrantRead(emailLambda)
 
 	return stack
 }
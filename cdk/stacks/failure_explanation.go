@@ -0,0 +1,44 @@
+package stacks
+
+import (
+	"github.com/aws/aws-cdk-go/awscdk/v2"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awsapigateway"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awslambda"
+	"github.com/aws/jsii-runtime-go"
+)
+
+// Register the failure explanation lambda on the API Gateway
+func (cfg *CdkScriptorConfig) addFailureExplanationRoute(
+	stack awscdk.Stack,
+	document awsapigateway.IResource,
+) {
+	explanationLambda := cfg.newFunction(
+		stack,
+		"scriptorFailureExplanationLambda",
+		&awslambda.FunctionProps{
+			Runtime: awslambda.Runtime_PROVIDED_AL2023(),
+			Code: awslambda.AssetCode_FromAsset(
+				jsii.String("../bin/failure_explanation.zip"),
+				nil,
+			), // Path to compiled Go binary
+			Handler: jsii.String("main"),
+		},
+	)
+
+	cfg.documentTable.GrantReadData(explanationLambda)
+	cfg.documentProcessingStageTable.GrantReadData(explanationLambda)
+
+	integration := awsapigateway.NewLambdaIntegration(explanationLambda, nil)
+
+	explanationRoute := document.AddResource(
+		jsii.String("failure-explanation"),
+		nil,
+	)
+	explanationRoute.AddMethod(
+		jsii.String("GET"),
+		integration,
+		&awsapigateway.MethodOptions{
+			AuthorizationType: awsapigateway.AuthorizationType_IAM,
+		},
+	)
+}
@@ -0,0 +1,47 @@
+package stacks
+
+import (
+	"github.com/aws/aws-cdk-go/awscdk/v2"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awsapigateway"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awslambda"
+	"github.com/aws/jsii-runtime-go"
+)
+
+// Register the lambda that sends failed notifications back to the document
+// queue on the API Gateway. The route is for admins, so it is IAM
+// authorized. The lambda can also be invoked directly.
+func (cfg *CdkScriptorConfig) addNotificationRedriveRoute(
+	stack awscdk.Stack,
+	apiGateway awsapigateway.RestApi,
+) {
+	redriveLambda := cfg.newFunction(
+		stack,
+		"scriptorNotificationRedriveLambda",
+		&awslambda.FunctionProps{
+			Runtime: awslambda.Runtime_PROVIDED_AL2023(),
+			Code: awslambda.AssetCode_FromAsset(
+				jsii.String("../bin/notification_redrive.zip"),
+				nil,
+			), // Path to compiled Go binary
+			Handler: jsii.String("main"),
+			Environment: &map[string]*string{
+				"SQS_QUEUE_URL": jsii.String(*cfg.documentQueue.QueueUrl()),
+			},
+		},
+	)
+
+	cfg.failedNotificationTable.GrantReadWriteData(redriveLambda)
+	cfg.documentQueue.GrantSendMessages(redriveLambda)
+
+	integration := awsapigateway.NewLambdaIntegration(redriveLambda, nil)
+
+	notifications := apiGateway.Root().AddResource(jsii.String("notifications"), nil)
+	redriveRoute := notifications.AddResource(jsii.String("redrive"), nil)
+	redriveRoute.AddMethod(
+		jsii.String("POST"),
+		integration,
+		&awsapigateway.MethodOptions{
+			AuthorizationType: awsapigateway.AuthorizationType_IAM,
+		},
+	)
+}
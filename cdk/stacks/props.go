@@ -5,6 +5,7 @@ import (
 	"github.com/aws/aws-cdk-go/awscdk/v2/awsdynamodb"
 	"github.com/aws/aws-cdk-go/awscdk/v2/awss3"
 	"github.com/aws/aws-cdk-go/awscdk/v2/awssecretsmanager"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awssns"
 	"github.com/aws/aws-cdk-go/awscdk/v2/awssqs"
 	"github.com/aws/aws-cdk-go/awscdk/v2/awsstepfunctions"
 )
@@ -20,6 +21,9 @@ type CdkScriptorConfig struct {
 	Props      *CdkStackProps
 	WebhookURL string
 
+	// Memory, timeouts and concurrency of the lambdas
+	Tuning *Tuning
+
 	GoogleServiceKeySecret       awssecretsmanager.ISecret
 	DefaultFoldersSecret         awssecretsmanager.ISecret
 	MathpixSecrets               awssecretsmanager.ISecret
@@ -28,11 +32,16 @@ type CdkScriptorConfig struct {
 	watchChannelLockTable        awsdynamodb.Table
 	documentTable                awsdynamodb.Table
 	documentProcessingStageTable awsdynamodb.Table
+	webhookCaptureTable          awsdynamodb.Table
+	failedNotificationTable      awsdynamodb.Table
+	notificationHistoryTable     awsdynamodb.Table
 	documentBucket               awss3.Bucket
 	rawEmailBucket               awss3.Bucket
 	documentQueue                awssqs.Queue
+	documentDLQ                  awssqs.Queue
 	rawEmailQueue                awssqs.Queue
 	stateMachine                 awsstepfunctions.StateMachine
+	alertTopic                   awssns.Topic
 }
 
 func NewCdkScriptorConfig() *CdkScriptorConfig {
@@ -49,6 +58,18 @@ func NewCdkScriptorConfig() *CdkScriptorConfig {
 	return cfg
 }
 
+// NewScriptorStacks adds every scriptor stack to the app
+func (cfg *CdkScriptorConfig) NewScriptorStacks() {
+	cfg.NewResourcesStack("ScriptorResourcesStack")
+	cfg.NewWebhookHandlerStack("ScriptorWebhookProcessing")
+	cfg.NewWebHookRegisterStack("ScriptorWebHookReRegisterStack")
+	cfg.NewDocumentWorkflowStack("ScriptorDocumentWorkflow")
+	cfg.NewEmailIngestStack("ScriptorEmailIngestStack")
+	cfg.NewSQSHandlerStack("ScrptorSQSHandlerStack")
+	cfg.NewDLQHandlerStack("ScriptorDLQHandlerStack")
+	cfg.NewDashboardStack("ScriptorDashboardStack")
+}
+
 // env determines the AWS environment (account+region) in which our stack is to
 // be deployed. For more information see: https://docs.aws.amazon.com/cdk/latest/guide/environments.html
 func env() *awscdk.Environment {
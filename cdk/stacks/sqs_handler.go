@@ -10,9 +10,9 @@ import (
 func (cfg *CdkScriptorConfig) NewSQSHandlerStack(id string) awscdk.Stack {
 	stack := awscdk.NewStack(cfg.App, &id, &cfg.Props.StackProps)
 	// Define Lambda functions for workflow steps
-	sqsLambda := awslambda.NewFunction(
+	sqsLambda := cfg.newFunction(
 		stack,
-		jsii.String("scriptorSQSHandlerLambda"),
+		"scriptorSQSHandlerLambda",
 		&awslambda.FunctionProps{
 			Runtime: awslambda.Runtime_PROVIDED_AL2023(),
 			Code: awslambda.AssetCode_FromAsset(
@@ -20,11 +20,11 @@ func (cfg *CdkScriptorConfig) NewSQSHandlerStack(id string) awscdk.Stack {
 				nil,
 			), // Path to compiled Go binary
 			Handler: jsii.String("main"),
-			Timeout: awscdk.Duration_Minutes(jsii.Number(5)),
 			Environment: &map[string]*string{
 				"STATE_MACHINE_ARN": jsii.String(
 					*cfg.stateMachine.StateMachineArn(),
 				),
+				"SQS_QUEUE_URL": jsii.String(*cfg.documentQueue.QueueUrl()),
 			},
 		},
 	)
@@ -33,24 +33,43 @@ func (cfg *CdkScriptorConfig) NewSQSHandlerStack(id string) awscdk.Stack {
 	eventSource := awslambdaeventsources.NewSqsEventSource(
 		cfg.documentQueue,
 		&awslambdaeventsources.SqsEventSourceProps{
-			BatchSize: jsii.Number(1),
+			BatchSize:               jsii.Number(1),
+			ReportBatchItemFailures: jsii.Bool(true),
 		},
 	)
 
 	// associate the SQS event source with the download lambda
 	sqsLambda.AddEventSource(eventSource)
 
+	// grant the lambda permission to send the documents it defers back to
+	// the queue
+	cfg.documentQueue.GrantSendMessages(sqsLambda)
+
 	// grant the lambda permission to read the Google Drive secret
 	cfg.GoogleServiceKeySecret.GrantRead(sqsLambda, nil)
 
 	// grant the lambda permission to start the state machine
 	cfg.stateMachine.GrantStartExecution(sqsLambda)
 
+	// grant the lambda permission to look up prior executions by name
+	cfg.stateMachine.GrantRead(sqsLambda)
+
+	// grant the lambda permission to stop the execution of a document a
+	// newer revision replaced
+	cfg.stateMachine.GrantExecution(sqsLambda, jsii.String("states:StopExecution"))
+
+	// grant the lambda r/w permissions to the watch channel table to flag
+	// channels whose folders feed back into each other
+	cfg.watchChannelTable.GrantReadWriteData(sqsLambda)
+
 	// grant the lambda r/w permissions to the watch channel lock table
 	cfg.watchChannelLockTable.GrantReadWriteData(sqsLambda)
 
 	// grant the lambda r/w permissions to the document table
 	cfg.documentTable.GrantReadWriteData(sqsLambda)
 
+	// grant the lambda r/w permissions to update the notification history
+	cfg.notificationHistoryTable.GrantReadWriteData(sqsLambda)
+
 	return stack
 }
@@ -0,0 +1,44 @@
+package stacks
+
+import (
+	"github.com/aws/aws-cdk-go/awscdk/v2"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awsapigateway"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awslambda"
+	"github.com/aws/jsii-runtime-go"
+)
+
+// Register the template preview lambda on the API Gateway. The route only
+// reads documents but still requires IAM auth since it exposes their content.
+func (cfg *CdkScriptorConfig) addTemplatePreviewRoute(
+	stack awscdk.Stack,
+	apiGateway awsapigateway.RestApi,
+) {
+	previewLambda := cfg.newFunction(
+		stack,
+		"scriptorTemplatePreviewLambda",
+		&awslambda.FunctionProps{
+			Runtime: awslambda.Runtime_PROVIDED_AL2023(),
+			Code: awslambda.AssetCode_FromAsset(
+				jsii.String("../bin/template_preview.zip"),
+				nil,
+			), // Path to compiled Go binary
+			Handler: jsii.String("main"),
+		},
+	)
+
+	cfg.documentTable.GrantReadData(previewLambda)
+	cfg.documentProcessingStageTable.GrantReadData(previewLambda)
+	cfg.documentBucket.GrantRead(previewLambda, nil)
+
+	integration := awsapigateway.NewLambdaIntegration(previewLambda, nil)
+
+	templates := apiGateway.Root().AddResource(jsii.String("templates"), nil)
+	previewRoute := templates.AddResource(jsii.String("preview"), nil)
+	previewRoute.AddMethod(
+		jsii.String("POST"),
+		integration,
+		&awsapigateway.MethodOptions{
+			AuthorizationType: awsapigateway.AuthorizationType_IAM,
+		},
+	)
+}
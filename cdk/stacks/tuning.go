@@ -0,0 +1,288 @@
+package stacks
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/aws/aws-cdk-go/awscdk/v2"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awslambda"
+	"github.com/aws/constructs-go/constructs/v10"
+	"github.com/aws/jsii-runtime-go"
+)
+
+const (
+	// Lambda limits, with memory kept to 64 MB steps
+	MIN_MEMORY_MB            = 128
+	MAX_MEMORY_MB            = 10240
+	MEMORY_STEP_MB           = 64
+	MIN_EPHEMERAL_STORAGE_MB = 512
+	MAX_EPHEMERAL_STORAGE_MB = 10240
+	MAX_TIMEOUT_SECONDS      = 900
+
+	// Alias created for functions with provisioned concurrency
+	PROVISIONED_ALIAS = "live"
+)
+
+// The functions run as tasks of the document workflow
+var workflowFunctions = []string{
+	"scriptorDownloadLambda",
+	"scriptorMathpixProcess",
+	"scriptorOpenAIProcess",
+	"scriptorUploadLambda",
+	"scriptorFailureLambda",
+}
+
+type (
+	// FunctionTuning is the sizing of a single lambda. Reason records why
+	// the values were picked.
+	FunctionTuning struct {
+		MemoryMB               int    `json:"memory_mb"`
+		TimeoutSeconds         int    `json:"timeout_seconds"`
+		EphemeralStorageMB     int    `json:"ephemeral_storage_mb"`
+		ReservedConcurrency    *int   `json:"reserved_concurrency,omitempty"`
+		ProvisionedConcurrency int    `json:"provisioned_concurrency,omitempty"`
+		Reason                 string `json:"reason,omitempty"`
+	}
+
+	// WorkflowTuning is the timeouts of the document workflow
+	WorkflowTuning struct {
+		TaskTimeoutSeconds int `json:"task_timeout_seconds"`
+		TimeoutSeconds     int `json:"timeout_seconds"`
+	}
+
+	// Tuning is the sizing of every scriptor lambda, keyed by the construct
+	// ID of the function.
+	Tuning struct {
+		Workflow  WorkflowTuning            `json:"workflow"`
+		Functions map[string]FunctionTuning `json:"functions"`
+	}
+)
+
+// LoadTuning reads and validates the tuning file.
+func LoadTuning(path string) (*Tuning, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var tuning Tuning
+	decoder := json.NewDecoder(file)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&tuning); err != nil {
+		return nil, fmt.Errorf("invalid tuning file %s: %w", path, err)
+	}
+
+	if err := tuning.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid tuning file %s: %w", path, err)
+	}
+
+	return &tuning, nil
+}
+
+// Validate checks every value is within the Lambda limits and the workflow
+// functions don't time out before the workflow task does.
+func (t *Tuning) Validate() error {
+	errs := make([]error, 0)
+
+	if t.Workflow.TaskTimeoutSeconds <= 0 {
+		errs = append(errs, fmt.Errorf("workflow task timeout must be positive"))
+	}
+
+	if t.Workflow.TimeoutSeconds < t.Workflow.TaskTimeoutSeconds {
+		errs = append(
+			errs,
+			fmt.Errorf(
+				"workflow timeout %ds is shorter than the task timeout %ds",
+				t.Workflow.TimeoutSeconds,
+				t.Workflow.TaskTimeoutSeconds,
+			),
+		)
+	}
+
+	for _, name := range t.names() {
+		for _, err := range t.Functions[name].validate() {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+		}
+	}
+
+	// The task timeout is what stops a slow stage, so the lambda has to
+	// outlast it for the workflow retries and catches to see the timeout.
+	for _, name := range workflowFunctions {
+		f, ok := t.Functions[name]
+		if !ok {
+			errs = append(errs, fmt.Errorf("%s: missing from the tuning file", name))
+			continue
+		}
+
+		if f.TimeoutSeconds < t.Workflow.TaskTimeoutSeconds {
+			errs = append(
+				errs,
+				fmt.Errorf(
+					"%s: timeout %ds is shorter than the workflow task timeout %ds",
+					name,
+					f.TimeoutSeconds,
+					t.Workflow.TaskTimeoutSeconds,
+				),
+			)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func (f FunctionTuning) validate() []error {
+	errs := make([]error, 0)
+
+	if f.MemoryMB < MIN_MEMORY_MB || f.MemoryMB > MAX_MEMORY_MB {
+		errs = append(
+			errs,
+			fmt.Errorf("memory %d MB must be between %d and %d", f.MemoryMB, MIN_MEMORY_MB, MAX_MEMORY_MB),
+		)
+	} else if f.MemoryMB%MEMORY_STEP_MB != 0 {
+		errs = append(
+			errs,
+			fmt.Errorf("memory %d MB must be a multiple of %d", f.MemoryMB, MEMORY_STEP_MB),
+		)
+	}
+
+	if f.TimeoutSeconds <= 0 || f.TimeoutSeconds > MAX_TIMEOUT_SECONDS {
+		errs = append(
+			errs,
+			fmt.Errorf("timeout %ds must be between 1 and %d", f.TimeoutSeconds, MAX_TIMEOUT_SECONDS),
+		)
+	}
+
+	if f.EphemeralStorageMB < MIN_EPHEMERAL_STORAGE_MB ||
+		f.EphemeralStorageMB > MAX_EPHEMERAL_STORAGE_MB {
+		errs = append(
+			errs,
+			fmt.Errorf(
+				"ephemeral storage %d MB must be between %d and %d",
+				f.EphemeralStorageMB,
+				MIN_EPHEMERAL_STORAGE_MB,
+				MAX_EPHEMERAL_STORAGE_MB,
+			),
+		)
+	}
+
+	// reserving 0 would stop the function from running at all
+	if f.ReservedConcurrency != nil && *f.ReservedConcurrency <= 0 {
+		errs = append(errs, fmt.Errorf("reserved concurrency must be positive"))
+	}
+
+	if f.ProvisionedConcurrency < 0 {
+		errs = append(errs, fmt.Errorf("provisioned concurrency can't be negative"))
+	}
+
+	if f.ReservedConcurrency != nil &&
+		f.ProvisionedConcurrency > *f.ReservedConcurrency {
+		errs = append(
+			errs,
+			fmt.Errorf(
+				"provisioned concurrency %d is more than the reserved concurrency %d",
+				f.ProvisionedConcurrency,
+				*f.ReservedConcurrency,
+			),
+		)
+	}
+
+	return errs
+}
+
+// The function names in order
+func (t *Tuning) names() []string {
+	names := make([]string, 0, len(t.Functions))
+	for name := range t.Functions {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	return names
+}
+
+// Summary lists the values applied to each function.
+func (t *Tuning) Summary() string {
+	var b strings.Builder
+
+	fmt.Fprintf(
+		&b,
+		"Workflow: task timeout %ds, timeout %ds\n\n",
+		t.Workflow.TaskTimeoutSeconds,
+		t.Workflow.TimeoutSeconds,
+	)
+	fmt.Fprintf(
+		&b,
+		"%-34s %8s %8s %10s %9s %12s\n",
+		"Function",
+		"Memory",
+		"Timeout",
+		"Ephemeral",
+		"Reserved",
+		"Provisioned",
+	)
+
+	for _, name := range t.names() {
+		f := t.Functions[name]
+
+		reserved := "-"
+		if f.ReservedConcurrency != nil {
+			reserved = fmt.Sprint(*f.ReservedConcurrency)
+		}
+
+		fmt.Fprintf(
+			&b,
+			"%-34s %8s %8s %10s %9s %12d\n",
+			name,
+			fmt.Sprintf("%dMB", f.MemoryMB),
+			fmt.Sprintf("%ds", f.TimeoutSeconds),
+			fmt.Sprintf("%dMB", f.EphemeralStorageMB),
+			reserved,
+			f.ProvisionedConcurrency,
+		)
+	}
+
+	return b.String()
+}
+
+// Create a lambda sized by the tuning file. Functions with provisioned
+// concurrency are returned as an alias so the callers invoke the provisioned
+// version.
+func (cfg *CdkScriptorConfig) newFunction(
+	scope constructs.Construct,
+	id string,
+	props *awslambda.FunctionProps,
+) awslambda.IFunction {
+	tuning, ok := cfg.Tuning.Functions[id]
+	if !ok {
+		panic(fmt.Sprintf("%s is missing from the tuning file", id))
+	}
+
+	props.MemorySize = jsii.Number(tuning.MemoryMB)
+	props.Timeout = awscdk.Duration_Seconds(jsii.Number(tuning.TimeoutSeconds))
+	props.EphemeralStorageSize = awscdk.Size_Mebibytes(
+		jsii.Number(tuning.EphemeralStorageMB),
+	)
+	if tuning.ReservedConcurrency != nil {
+		props.ReservedConcurrentExecutions = jsii.Number(*tuning.ReservedConcurrency)
+	}
+
+	function := awslambda.NewFunction(scope, jsii.String(id), props)
+	if tuning.ProvisionedConcurrency == 0 {
+		return function
+	}
+
+	return awslambda.NewAlias(
+		scope,
+		jsii.String(id+"Alias"),
+		&awslambda.AliasProps{
+			AliasName:                       jsii.String(PROVISIONED_ALIAS),
+			Version:                         function.CurrentVersion(),
+			ProvisionedConcurrentExecutions: jsii.Number(tuning.ProvisionedConcurrency),
+		},
+	)
+}
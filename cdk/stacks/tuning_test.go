@@ -0,0 +1,242 @@
+package stacks
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-cdk-go/awscdk/v2"
+	"github.com/aws/aws-cdk-go/awscdk/v2/assertions"
+	"github.com/aws/jsii-runtime-go"
+)
+
+func validTuning() *Tuning {
+	tuning := &Tuning{
+		Workflow: WorkflowTuning{
+			TaskTimeoutSeconds: 180,
+			TimeoutSeconds:     900,
+		},
+		Functions: map[string]FunctionTuning{},
+	}
+
+	for _, name := range workflowFunctions {
+		tuning.Functions[name] = FunctionTuning{
+			MemoryMB:           128,
+			TimeoutSeconds:     300,
+			EphemeralStorageMB: 512,
+		}
+	}
+
+	return tuning
+}
+
+func TestTuningValidate(t *testing.T) {
+	reserved := func(n int) *int { return &n }
+
+	tests := []struct {
+		name    string
+		update  func(tuning *Tuning)
+		wantErr string
+	}{
+		{
+			name:   "valid",
+			update: func(tuning *Tuning) {},
+		},
+		{
+			name: "memory not a 64 MB step",
+			update: func(tuning *Tuning) {
+				f := tuning.Functions["scriptorMathpixProcess"]
+				f.MemoryMB = 1000
+				tuning.Functions["scriptorMathpixProcess"] = f
+			},
+			wantErr: "must be a multiple of 64",
+		},
+		{
+			name: "memory over the limit",
+			update: func(tuning *Tuning) {
+				f := tuning.Functions["scriptorMathpixProcess"]
+				f.MemoryMB = 10304
+				tuning.Functions["scriptorMathpixProcess"] = f
+			},
+			wantErr: "must be between 128 and 10240",
+		},
+		{
+			name: "timeout over the limit",
+			update: func(tuning *Tuning) {
+				tuning.Functions["scriptorAssistantQueryLambda"] = FunctionTuning{
+					MemoryMB:           128,
+					TimeoutSeconds:     901,
+					EphemeralStorageMB: 512,
+				}
+			},
+			wantErr: "scriptorAssistantQueryLambda: timeout 901s",
+		},
+		{
+			name: "ephemeral storage under the limit",
+			update: func(tuning *Tuning) {
+				f := tuning.Functions["scriptorDownloadLambda"]
+				f.EphemeralStorageMB = 256
+				tuning.Functions["scriptorDownloadLambda"] = f
+			},
+			wantErr: "ephemeral storage 256 MB",
+		},
+		{
+			name: "workflow function times out before the task",
+			update: func(tuning *Tuning) {
+				f := tuning.Functions["scriptorOpenAIProcess"]
+				f.TimeoutSeconds = 120
+				tuning.Functions["scriptorOpenAIProcess"] = f
+			},
+			wantErr: "shorter than the workflow task timeout",
+		},
+		{
+			name: "task timeout longer than the workflow",
+			update: func(tuning *Tuning) {
+				tuning.Workflow.TimeoutSeconds = 60
+			},
+			wantErr: "workflow timeout 60s is shorter",
+		},
+		{
+			name: "workflow function missing",
+			update: func(tuning *Tuning) {
+				delete(tuning.Functions, "scriptorUploadLambda")
+			},
+			wantErr: "scriptorUploadLambda: missing",
+		},
+		{
+			name: "reserved concurrency of zero",
+			update: func(tuning *Tuning) {
+				f := tuning.Functions["scriptorUploadLambda"]
+				f.ReservedConcurrency = reserved(0)
+				tuning.Functions["scriptorUploadLambda"] = f
+			},
+			wantErr: "reserved concurrency must be positive",
+		},
+		{
+			name: "provisioned more than reserved",
+			update: func(tuning *Tuning) {
+				f := tuning.Functions["scriptorUploadLambda"]
+				f.ReservedConcurrency = reserved(2)
+				f.ProvisionedConcurrency = 3
+				tuning.Functions["scriptorUploadLambda"] = f
+			},
+			wantErr: "provisioned concurrency 3 is more than the reserved concurrency 2",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			tuning := validTuning()
+			tc.update(tuning)
+
+			err := tuning.Validate()
+			if tc.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Fatalf("expected an error containing %q, got %v", tc.wantErr, err)
+			}
+		})
+	}
+}
+
+// Every scriptor lambda in the synthesized stacks has to be sized by the
+// tuning file, so a value changed in one of the stacks alone fails here.
+func TestFunctionsMatchTuning(t *testing.T) {
+	// the stacks reference the lambda assets relative to the cdk folder
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(".."); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	assets, _ := filepath.Glob("../bin/*.zip")
+	if len(assets) == 0 {
+		t.Skip("the lambdas have not been built, run make first")
+	}
+
+	tuning, err := LoadTuning("tuning.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := NewCdkScriptorConfig()
+	cfg.Tuning = tuning
+	cfg.NewScriptorStacks()
+
+	seen := map[string]bool{}
+	for _, child := range *cfg.App.Node().Children() {
+		if !*awscdk.Stack_IsStack(child) {
+			continue
+		}
+
+		template := assertions.Template_FromStack(awscdk.Stack_Of(child), nil)
+		functions := template.FindResources(jsii.String("AWS::Lambda::Function"), nil)
+
+		for logicalID, resource := range *functions {
+			if !strings.HasPrefix(logicalID, "scriptor") {
+				continue
+			}
+
+			// top level constructs get an 8 character hash appended
+			name := logicalID[:len(logicalID)-8]
+			seen[name] = true
+
+			want, ok := tuning.Functions[name]
+			if !ok {
+				t.Errorf("%s is missing from the tuning file", name)
+				continue
+			}
+
+			props := (*resource)["Properties"].(map[string]any)
+			checkNumber(t, name, "MemorySize", props["MemorySize"], want.MemoryMB)
+			checkNumber(t, name, "Timeout", props["Timeout"], want.TimeoutSeconds)
+
+			storage, _ := props["EphemeralStorage"].(map[string]any)
+			checkNumber(t, name, "EphemeralStorage", storage["Size"], want.EphemeralStorageMB)
+
+			if want.ReservedConcurrency != nil {
+				checkNumber(
+					t,
+					name,
+					"ReservedConcurrentExecutions",
+					props["ReservedConcurrentExecutions"],
+					*want.ReservedConcurrency,
+				)
+			} else if _, ok := props["ReservedConcurrentExecutions"]; ok {
+				t.Errorf("%s has reserved concurrency the tuning file doesn't set", name)
+			}
+		}
+
+		aliases := template.FindResources(jsii.String("AWS::Lambda::Alias"), nil)
+		for logicalID := range *aliases {
+			name := strings.TrimSuffix(logicalID[:len(logicalID)-8], "Alias")
+			if tuning.Functions[name].ProvisionedConcurrency == 0 {
+				t.Errorf("%s has an alias without provisioned concurrency", name)
+			}
+		}
+	}
+
+	for name := range tuning.Functions {
+		if !seen[name] {
+			t.Errorf("%s is in the tuning file but isn't deployed", name)
+		}
+	}
+}
+
+func checkNumber(t *testing.T, name, property string, got any, want int) {
+	t.Helper()
+
+	value, ok := got.(float64)
+	if !ok || int(value) != want {
+		t.Errorf("%s has %s %v, the tuning file has %d", name, property, got, want)
+	}
+}
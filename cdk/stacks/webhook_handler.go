@@ -13,9 +13,9 @@ func (cfg *CdkScriptorConfig) NewWebhookHandlerStack(id string) awscdk.Stack {
 	stack := awscdk.NewStack(cfg.App, &id, &cfg.Props.StackProps)
 
 	// Define Lambda functions for workflow steps
-	webhookLambda := awslambda.NewFunction(
+	webhookLambda := cfg.newFunction(
 		stack,
-		jsii.String("scriptorWebhookHandlerLambda"),
+		"scriptorWebhookHandlerLambda",
 		&awslambda.FunctionProps{
 			Runtime: awslambda.Runtime_PROVIDED_AL2023(),
 			Code: awslambda.AssetCode_FromAsset(
@@ -23,9 +23,10 @@ func (cfg *CdkScriptorConfig) NewWebhookHandlerStack(id string) awscdk.Stack {
 				nil,
 			), // Path to compiled Go binary
 			Handler: jsii.String("main"),
-			Timeout: awscdk.Duration_Minutes(jsii.Number(5)),
 			Environment: &map[string]*string{
-				"SQS_QUEUE_URL": jsii.String(*cfg.documentQueue.QueueUrl()),
+				"SQS_QUEUE_URL":                 jsii.String(*cfg.documentQueue.QueueUrl()),
+				"WEBHOOK_CAPTURE":               jsii.String("true"),
+				"NOTIFICATION_DEBOUNCE_SECONDS": jsii.String("10"),
 			},
 		},
 	)
@@ -33,6 +34,16 @@ func (cfg *CdkScriptorConfig) NewWebhookHandlerStack(id string) awscdk.Stack {
 	// grant the lambda read permissions to the watch channel table
 	cfg.watchChannelTable.GrantReadData(webhookLambda)
 
+	// grant the lambda write permissions to the watch channel lock table to
+	// mark a notification of the channel as pending
+	cfg.watchChannelLockTable.GrantWriteData(webhookLambda)
+
+	// grant the lambda write permissions to capture the requests
+	cfg.webhookCaptureTable.GrantWriteData(webhookLambda)
+
+	// grant the lambda write permissions to start the notification history
+	cfg.notificationHistoryTable.GrantWriteData(webhookLambda)
+
 	// create an integration for our API Gateway
 	integration := awsapigateway.NewLambdaIntegration(webhookLambda, nil)
 
@@ -43,7 +54,7 @@ func (cfg *CdkScriptorConfig) NewWebhookHandlerStack(id string) awscdk.Stack {
 		&awsapigateway.RestApiProps{
 			DefaultCorsPreflightOptions: &awsapigateway.CorsOptions{
 				AllowHeaders: jsii.Strings("Content-Type", "Authorization"),
-				AllowMethods: jsii.Strings("POST", "PUT"),
+				AllowMethods: jsii.Strings("GET", "POST", "PUT", "DELETE"),
 				AllowOrigins: jsii.Strings("*"),
 			},
 			DeployOptions: &awsapigateway.StageOptions{
@@ -64,6 +75,27 @@ func (cfg *CdkScriptorConfig) NewWebhookHandlerStack(id string) awscdk.Stack {
 
 	cfg.documentQueue.GrantSendMessages(webhookLambda)
 
+	// Register the route for previewing note templates
+	cfg.addTemplatePreviewRoute(stack, apiGateway)
+
+	documents := apiGateway.Root().AddResource(jsii.String("documents"), nil)
+	document := documents.AddResource(jsii.String("{id}"), nil)
+
+	// Register the route for explaining document failures
+	cfg.addFailureExplanationRoute(stack, document)
+
+	// Register the route for verifying published notes
+	cfg.addDocumentVerifyRoute(stack, document)
+
+	// Register the read-only route for the assistant
+	cfg.addAssistantQueryRoute(stack, apiGateway)
+
+	// Register the route for sending failed notifications back to the queue
+	cfg.addNotificationRedriveRoute(stack, apiGateway)
+
+	// Register the routes for managing the watched folders
+	cfg.addChannelAdminRoutes(stack, apiGateway)
+
 	// save the webhook URL for later use
 	cfg.WebhookURL = fmt.Sprintf("%swebhook/google-drive", *apiGateway.Url())
 
@@ -12,9 +12,9 @@ import (
 func (cfg *CdkScriptorConfig) NewWebHookRegisterStack(id string) awscdk.Stack {
 	stack := awscdk.NewStack(cfg.App, &id, &cfg.Props.StackProps)
 
-	myFunction := awslambda.NewFunction(
+	myFunction := cfg.newFunction(
 		stack,
-		jsii.String("scriptorWebhookRegisterLambda"),
+		"scriptorWebhookRegisterLambda",
 		&awslambda.FunctionProps{
 			Runtime: awslambda.Runtime_PROVIDED_AL2023(),
 			Code: awslambda.AssetCode_FromAsset(
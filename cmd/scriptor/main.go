@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/KyleBrandon/scriptor/pkg/attest"
+	"github.com/KyleBrandon/scriptor/pkg/audit"
+	"github.com/KyleBrandon/scriptor/pkg/database"
+	"github.com/KyleBrandon/scriptor/pkg/types"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+const usage = `usage: scriptor <command> [flags]
+
+commands:
+  verify --file note.md              check a published note against its scriptor_hash
+  webhooks tail --channel <id>       show the recent webhook requests of a channel
+  audit [--repair] [--delete-orphans] check the stage rows against the objects in S3
+`
+
+const (
+	// Captures shown by webhooks tail unless --limit is set
+	DEFAULT_TAIL_LIMIT = 20
+
+	// Captures read from the table at a time
+	TAIL_PAGE_SIZE = 25
+)
+
+var (
+	// Opens the store of the webhook captures
+	newCaptureStore = database.NewWebhookCaptureStore
+
+	// Builds the auditor over the document store and the staging bucket
+	newAuditor = func(ctx context.Context, options audit.Options) (*audit.Auditor, error) {
+		store, err := database.NewDocumentStore(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		awsCfg, err := config.LoadDefaultConfig(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		return audit.NewAuditor(store, s3.NewFromConfig(awsCfg), options), nil
+	}
+
+	// Where the confirmation to delete orphans is read from
+	stdin io.Reader = os.Stdin
+)
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+func run(args []string, stdout, stderr io.Writer) int {
+	if len(args) == 0 {
+		fmt.Fprint(stderr, usage)
+		return 2
+	}
+
+	switch args[0] {
+	case "verify":
+		return verify(args[1:], stdout, stderr)
+	case "webhooks":
+		return webhooks(args[1:], stdout, stderr)
+	case "audit":
+		return auditArtifacts(args[1:], stdout, stderr)
+	default:
+		fmt.Fprintf(stderr, "unknown command %q\n\n%s", args[0], usage)
+		return 2
+	}
+}
+
+// Verify a note from the vault against the hash recorded when it was
+// published. The rest of the chain is only available through the API.
+func verify(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("verify", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	file := flags.String("file", "", "path of the note to verify")
+
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	if *file == "" {
+		fmt.Fprintln(stderr, "verify: --file is required")
+		return 2
+	}
+
+	note, err := os.ReadFile(*file)
+	if err != nil {
+		fmt.Fprintf(stderr, "verify: %v\n", err)
+		return 1
+	}
+
+	actual, err := attest.VerifyNote(note)
+	switch {
+	case errors.Is(err, attest.ErrNoteHashMissing):
+		fmt.Fprintf(stderr, "%s: %v\n", *file, err)
+		return 1
+	case errors.Is(err, attest.ErrNoteHashMismatch):
+		recorded, _ := attest.RecordedHash(note)
+		fmt.Fprintf(
+			stderr,
+			"%s: mismatch at the final link, the note was changed after it was published\n  recorded: %s\n  computed: %s\n",
+			*file,
+			recorded,
+			actual,
+		)
+		return 1
+	case err != nil:
+		fmt.Fprintf(stderr, "%s: %v\n", *file, err)
+		return 1
+	}
+
+	fmt.Fprintf(stdout, "%s: verified %s\n", *file, actual)
+	return 0
+}
+
+func webhooks(args []string, stdout, stderr io.Writer) int {
+	if len(args) == 0 || args[0] != "tail" {
+		fmt.Fprintf(stderr, "webhooks: unknown command\n\n%s", usage)
+		return 2
+	}
+
+	return tail(args[1:], stdout, stderr)
+}
+
+// Print the most recent webhook requests captured for a channel, newest
+// first. Requests without a channel ID are under the "unknown" channel.
+func tail(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("webhooks tail", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	channelID := flags.String("channel", "", "ID of the watch channel")
+	limit := flags.Int("limit", DEFAULT_TAIL_LIMIT, "number of requests to show")
+
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	if *channelID == "" {
+		fmt.Fprintln(stderr, "webhooks tail: --channel is required")
+		return 2
+	}
+
+	if *limit <= 0 {
+		fmt.Fprintln(stderr, "webhooks tail: --limit must be positive")
+		return 2
+	}
+
+	ctx := context.Background()
+
+	store, err := newCaptureStore(ctx)
+	if err != nil {
+		fmt.Fprintf(stderr, "webhooks tail: %v\n", err)
+		return 1
+	}
+
+	captures, err := recentCaptures(ctx, store, *channelID, *limit)
+	if err != nil {
+		fmt.Fprintf(stderr, "webhooks tail: %v\n", err)
+		return 1
+	}
+
+	if len(captures) == 0 {
+		fmt.Fprintf(stdout, "no webhook requests captured for %s\n", *channelID)
+		return 0
+	}
+
+	printCaptures(stdout, captures)
+	return 0
+}
+
+// Read pages of captures until there are enough or there are no more
+func recentCaptures(
+	ctx context.Context,
+	store database.WebhookCaptureStore,
+	channelID string,
+	limit int,
+) ([]*types.WebhookCapture, error) {
+	captures := make([]*types.WebhookCapture, 0, limit)
+	cursor := ""
+
+	for {
+		pageSize := min(TAIL_PAGE_SIZE, limit-len(captures))
+
+		page, next, err := store.ListWebhookCaptures(ctx, channelID, int32(pageSize), cursor)
+		if err != nil {
+			return nil, err
+		}
+
+		captures = append(captures, page...)
+		if next == "" || len(captures) >= limit {
+			break
+		}
+
+		cursor = next
+	}
+
+	return captures[:min(len(captures), limit)], nil
+}
+
+func printCaptures(stdout io.Writer, captures []*types.WebhookCapture) {
+	w := tabwriter.NewWriter(stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "CAPTURED\tSTATE\tMESSAGE\tRESOURCE\tFOLDER\tOUTCOME\tDECISION")
+
+	for _, c := range captures {
+		fmt.Fprintf(
+			w,
+			"%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			c.CapturedAt,
+			orDash(c.ResourceState),
+			orDash(c.MessageNumber),
+			orDash(c.ResourceID),
+			orDash(c.FolderID),
+			c.Outcome,
+			c.Decision,
+		)
+	}
+
+	w.Flush()
+}
+
+func orDash(value string) string {
+	if value == "" {
+		return "-"
+	}
+
+	return value
+}
+
+// Check the stage rows against the objects in the staging bucket. Repair
+// flags the stages whose artifact is missing, and deleting orphans asks for
+// confirmation after the dry run unless --yes is passed.
+func auditArtifacts(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("audit", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	repair := flags.Bool("repair", false, "flag the stages whose artifact is missing")
+	deleteOrphans := flags.Bool("delete-orphans", false, "delete orphaned objects, requires --repair")
+	minAge := flags.Duration("min-orphan-age", audit.DEFAULT_MIN_ORPHAN_AGE, "only delete orphans at least this old")
+	yes := flags.Bool("yes", false, "delete without asking for confirmation")
+
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	if *deleteOrphans && !*repair {
+		fmt.Fprintln(stderr, "audit: --delete-orphans requires --repair")
+		return 2
+	}
+
+	if *minAge < 24*time.Hour {
+		fmt.Fprintln(stderr, "audit: --min-orphan-age must be at least 24h")
+		return 2
+	}
+
+	ctx := context.Background()
+
+	auditor, err := newAuditor(ctx, audit.Options{
+		Bucket:       types.S3_BUCKET_NAME,
+		Repair:       *repair,
+		MinOrphanAge: *minAge,
+	})
+	if err != nil {
+		fmt.Fprintf(stderr, "audit: %v\n", err)
+		return 1
+	}
+
+	report, err := auditor.Audit(ctx)
+	if err != nil {
+		fmt.Fprintf(stderr, "audit: %v\n", err)
+		return 1
+	}
+
+	report.Print(stdout)
+
+	if !*deleteOrphans || report.DeletableOrphans == 0 {
+		return 0
+	}
+
+	if !*yes && !confirm(stdout, fmt.Sprintf(
+		"delete %d orphaned objects older than %s? [y/N] ",
+		report.DeletableOrphans,
+		*minAge,
+	)) {
+		fmt.Fprintln(stdout, "nothing deleted")
+		return 0
+	}
+
+	err = auditor.DeleteOrphans(ctx, report)
+	fmt.Fprintf(
+		stdout,
+		"deleted %d orphaned objects (%d bytes)\n",
+		report.OrphansDeleted,
+		report.OrphanedBytesFreed,
+	)
+	if err != nil {
+		fmt.Fprintf(stderr, "audit: %v\n", err)
+		return 1
+	}
+
+	return 0
+}
+
+func confirm(stdout io.Writer, prompt string) bool {
+	fmt.Fprint(stdout, prompt)
+
+	answer, _ := bufio.NewReader(stdin).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+
+	return answer == "y" || answer == "yes"
+}
@@ -0,0 +1,419 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/KyleBrandon/scriptor/pkg/attest"
+	"github.com/KyleBrandon/scriptor/pkg/audit"
+	"github.com/KyleBrandon/scriptor/pkg/database"
+	"github.com/KyleBrandon/scriptor/pkg/types"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+func TestVerify(t *testing.T) {
+	note, _ := attest.Stamp([]byte("---\nid: \"scan\"\n---\n\n# Contract\n\nSigned.\n"))
+
+	tests := []struct {
+		name       string
+		content    string
+		args       func(path string) []string
+		wantCode   int
+		wantOutput string
+	}{
+		{
+			name:       "verified",
+			content:    string(note),
+			args:       func(path string) []string { return []string{"verify", "--file", path} },
+			wantOutput: "verified",
+		},
+		{
+			name:       "edited after publication",
+			content:    strings.Replace(string(note), "Signed.", "Not signed.", 1),
+			args:       func(path string) []string { return []string{"verify", "--file", path} },
+			wantCode:   1,
+			wantOutput: "mismatch at the final link",
+		},
+		{
+			name:       "not stamped",
+			content:    "# Contract\n",
+			args:       func(path string) []string { return []string{"verify", "--file", path} },
+			wantCode:   1,
+			wantOutput: "no scriptor_hash",
+		},
+		{
+			name:       "missing file flag",
+			args:       func(path string) []string { return []string{"verify"} },
+			wantCode:   2,
+			wantOutput: "--file is required",
+		},
+		{
+			name:       "unknown command",
+			args:       func(path string) []string { return []string{"sign"} },
+			wantCode:   2,
+			wantOutput: "unknown command",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "note.md")
+			if err := os.WriteFile(path, []byte(tc.content), 0o600); err != nil {
+				t.Fatalf("failed to write the note: %v", err)
+			}
+
+			var stdout, stderr bytes.Buffer
+			code := run(tc.args(path), &stdout, &stderr)
+
+			if code != tc.wantCode {
+				t.Fatalf("unexpected exit code: got %d want %d\n%s", code, tc.wantCode, stderr.String())
+			}
+
+			output := stdout.String() + stderr.String()
+			if !strings.Contains(output, tc.wantOutput) {
+				t.Fatalf("expected output to contain %q, got %q", tc.wantOutput, output)
+			}
+		})
+	}
+}
+
+// Pages through the captures of channel-1, newest first, like the table
+type fakeCaptureStore struct {
+	database.WebhookCaptureStore
+	captures []*types.WebhookCapture
+	queries  []string
+	err      error
+}
+
+func newFakeCaptureStore(count int) *fakeCaptureStore {
+	store := &fakeCaptureStore{}
+	for i := count; i > 0; i-- {
+		store.captures = append(store.captures, &types.WebhookCapture{
+			ChannelID:     "channel-1",
+			CapturedAt:    fmt.Sprintf("2026-10-17T09:%02d:00.000000000Z", i),
+			ResourceState: "add",
+			MessageNumber: strconv.Itoa(i),
+			Outcome:       "valid",
+			Decision:      "queued",
+		})
+	}
+
+	return store
+}
+
+func (s *fakeCaptureStore) ListWebhookCaptures(
+	ctx context.Context,
+	channelID string,
+	limit int32,
+	cursor string,
+) ([]*types.WebhookCapture, string, error) {
+	s.queries = append(s.queries, fmt.Sprintf("%s %d %q", channelID, limit, cursor))
+	if s.err != nil {
+		return nil, "", s.err
+	}
+
+	if channelID != "channel-1" {
+		return nil, "", nil
+	}
+
+	start := 0
+	if cursor != "" {
+		start = slices.IndexFunc(s.captures, func(c *types.WebhookCapture) bool {
+			return c.CapturedAt == cursor
+		}) + 1
+	}
+
+	end := min(start+int(limit), len(s.captures))
+
+	next := ""
+	if end < len(s.captures) {
+		next = s.captures[end-1].CapturedAt
+	}
+
+	return s.captures[start:end], next, nil
+}
+
+func TestRecentCaptures(t *testing.T) {
+	tests := []struct {
+		name        string
+		count       int
+		limit       int
+		wantCount   int
+		wantQueries []string
+	}{
+		{
+			name:        "one page",
+			count:       3,
+			limit:       20,
+			wantCount:   3,
+			wantQueries: []string{`channel-1 20 ""`},
+		},
+		{
+			name:      "several pages",
+			count:     60,
+			limit:     55,
+			wantCount: 55,
+			wantQueries: []string{
+				`channel-1 25 ""`,
+				`channel-1 25 "2026-10-17T09:36:00.000000000Z"`,
+				`channel-1 5 "2026-10-17T09:11:00.000000000Z"`,
+			},
+		},
+		{
+			name:      "fewer than the limit",
+			count:     30,
+			limit:     50,
+			wantCount: 30,
+			wantQueries: []string{
+				`channel-1 25 ""`,
+				`channel-1 25 "2026-10-17T09:06:00.000000000Z"`,
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			store := newFakeCaptureStore(tc.count)
+
+			got, err := recentCaptures(context.Background(), store, "channel-1", tc.limit)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if len(got) != tc.wantCount || got[0].MessageNumber != strconv.Itoa(tc.count) {
+				t.Fatalf("unexpected captures: %d starting at %s", len(got), got[0].MessageNumber)
+			}
+
+			if !slices.Equal(store.queries, tc.wantQueries) {
+				t.Fatalf("unexpected queries:\ngot  %q\nwant %q", store.queries, tc.wantQueries)
+			}
+		})
+	}
+}
+
+func TestWebhooksTail(t *testing.T) {
+	tests := []struct {
+		name       string
+		args       []string
+		storeErr   error
+		wantCode   int
+		wantOutput []string
+	}{
+		{
+			name:       "tail",
+			args:       []string{"webhooks", "tail", "--channel", "channel-1", "--limit", "2"},
+			wantOutput: []string{"CAPTURED", "2026-10-17T09:03:00.000000000Z", "queued"},
+		},
+		{
+			name:       "nothing captured",
+			args:       []string{"webhooks", "tail", "--channel", "channel-2"},
+			wantOutput: []string{"no webhook requests captured for channel-2"},
+		},
+		{
+			name:       "missing channel flag",
+			args:       []string{"webhooks", "tail"},
+			wantCode:   2,
+			wantOutput: []string{"--channel is required"},
+		},
+		{
+			name:       "unknown subcommand",
+			args:       []string{"webhooks", "head"},
+			wantCode:   2,
+			wantOutput: []string{"webhooks: unknown command"},
+		},
+		{
+			name:       "query fails",
+			args:       []string{"webhooks", "tail", "--channel", "channel-1"},
+			storeErr:   errors.New("access denied"),
+			wantCode:   1,
+			wantOutput: []string{"access denied"},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			store := newFakeCaptureStore(3)
+			store.err = tc.storeErr
+
+			newCaptureStore = func(ctx context.Context) (database.WebhookCaptureStore, error) {
+				return store, nil
+			}
+
+			var stdout, stderr bytes.Buffer
+			code := run(tc.args, &stdout, &stderr)
+
+			if code != tc.wantCode {
+				t.Fatalf("unexpected exit code: got %d want %d\n%s", code, tc.wantCode, stderr.String())
+			}
+
+			output := stdout.String() + stderr.String()
+			for _, want := range tc.wantOutput {
+				if !strings.Contains(output, want) {
+					t.Fatalf("expected output to contain %q, got %q", want, output)
+				}
+			}
+
+			// the oldest capture is past the limit
+			if tc.name == "tail" && strings.Contains(output, "09:01:00") {
+				t.Fatalf("output past the limit: %q", output)
+			}
+		})
+	}
+}
+
+// One document whose Mathpix output is gone and an orphan from a failed run
+type fakeAuditStore struct {
+	flagged int
+}
+
+func (s *fakeAuditStore) ScanDocumentStages(
+	ctx context.Context,
+	fn func(stages []*types.DocumentProcessingStage) error,
+) error {
+	return fn([]*types.DocumentProcessingStage{
+		{ID: "doc-1", Stage: types.DOCUMENT_STAGE_DOWNLOAD, S3Key: "downloaded/scan-1.pdf"},
+		{ID: "doc-1", Stage: types.DOCUMENT_STAGE_MATHPIX, S3Key: "mathpix/scan-2.md"},
+	})
+}
+
+func (s *fakeAuditStore) MarkStageArtifactMissing(ctx context.Context, id string, stage types.Stage) error {
+	s.flagged++
+	return nil
+}
+
+type fakeAuditBucket struct {
+	deleted []string
+}
+
+func (f *fakeAuditBucket) HeadObject(
+	ctx context.Context,
+	params *s3.HeadObjectInput,
+	optFns ...func(*s3.Options),
+) (*s3.HeadObjectOutput, error) {
+	if *params.Key != "downloaded/scan-1.pdf" {
+		return nil, &s3types.NotFound{}
+	}
+
+	return &s3.HeadObjectOutput{}, nil
+}
+
+func (f *fakeAuditBucket) ListObjectsV2(
+	ctx context.Context,
+	params *s3.ListObjectsV2Input,
+	optFns ...func(*s3.Options),
+) (*s3.ListObjectsV2Output, error) {
+	old := aws.Time(time.Now().Add(-90 * 24 * time.Hour))
+
+	return &s3.ListObjectsV2Output{Contents: []s3types.Object{
+		{Key: aws.String("downloaded/failed-1.pdf"), Size: aws.Int64(200), LastModified: old},
+		{Key: aws.String("downloaded/scan-1.pdf"), Size: aws.Int64(100), LastModified: old},
+	}}, nil
+}
+
+func (f *fakeAuditBucket) DeleteObject(
+	ctx context.Context,
+	params *s3.DeleteObjectInput,
+	optFns ...func(*s3.Options),
+) (*s3.DeleteObjectOutput, error) {
+	f.deleted = append(f.deleted, *params.Key)
+	return &s3.DeleteObjectOutput{}, nil
+}
+
+func TestAudit(t *testing.T) {
+	tests := []struct {
+		name        string
+		args        []string
+		answer      string
+		wantCode    int
+		wantFlagged int
+		wantDeleted int
+		wantOutput  []string
+	}{
+		{
+			name:       "report",
+			args:       []string{"audit"},
+			wantOutput: []string{"dangling stages:    1", "orphaned objects:   1 (200 bytes"},
+		},
+		{
+			name:        "repair",
+			args:        []string{"audit", "--repair"},
+			wantFlagged: 1,
+			wantOutput:  []string{"(1 flagged)"},
+		},
+		{
+			name:        "delete confirmed",
+			args:        []string{"audit", "--repair", "--delete-orphans"},
+			answer:      "y\n",
+			wantFlagged: 1,
+			wantDeleted: 1,
+			wantOutput:  []string{"delete 1 orphaned objects older than 720h0m0s?", "deleted 1 orphaned objects (200 bytes)"},
+		},
+		{
+			name:        "delete declined",
+			args:        []string{"audit", "--repair", "--delete-orphans"},
+			answer:      "\n",
+			wantFlagged: 1,
+			wantOutput:  []string{"nothing deleted"},
+		},
+		{
+			name:        "delete without asking",
+			args:        []string{"audit", "--repair", "--delete-orphans", "--yes"},
+			wantFlagged: 1,
+			wantDeleted: 1,
+			wantOutput:  []string{"deleted 1 orphaned objects"},
+		},
+		{
+			name:       "delete without repair",
+			args:       []string{"audit", "--delete-orphans"},
+			wantCode:   2,
+			wantOutput: []string{"--delete-orphans requires --repair"},
+		},
+		{
+			name:       "safety age too short",
+			args:       []string{"audit", "--repair", "--delete-orphans", "--min-orphan-age", "1h"},
+			wantCode:   2,
+			wantOutput: []string{"--min-orphan-age must be at least 24h"},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			store := &fakeAuditStore{}
+			bucket := &fakeAuditBucket{}
+
+			newAuditor = func(ctx context.Context, options audit.Options) (*audit.Auditor, error) {
+				return audit.NewAuditor(store, bucket, options), nil
+			}
+			stdin = strings.NewReader(tc.answer)
+
+			var stdout, stderr bytes.Buffer
+			code := run(tc.args, &stdout, &stderr)
+
+			if code != tc.wantCode {
+				t.Fatalf("unexpected exit code: got %d want %d\n%s", code, tc.wantCode, stderr.String())
+			}
+
+			output := stdout.String() + stderr.String()
+			for _, want := range tc.wantOutput {
+				if !strings.Contains(output, want) {
+					t.Fatalf("expected output to contain %q, got %q", want, output)
+				}
+			}
+
+			if store.flagged != tc.wantFlagged || len(bucket.deleted) != tc.wantDeleted {
+				t.Fatalf("unexpected repair: flagged %d deleted %v", store.flagged, bucket.deleted)
+			}
+		})
+	}
+}
@@ -0,0 +1,513 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/KyleBrandon/scriptor/lambdas/util"
+	"github.com/KyleBrandon/scriptor/pkg/database"
+	"github.com/KyleBrandon/scriptor/pkg/types"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+const (
+	OPERATION_SEARCH           = "search"
+	OPERATION_STATUS           = "status"
+	OPERATION_LIST_RECENT      = "list_recent"
+	OPERATION_GET_NOTE_EXCERPT = "get_note_excerpt"
+
+	// Limits on what is returned so the responses stay small enough to
+	// hand to an assistant
+	DEFAULT_RESULTS    = 10
+	MAX_RESULTS        = 25
+	MAX_EXCERPT_LENGTH = 2000
+	MAX_RESPONSE_BYTES = 8192
+
+	// How far back list_recent and search look for documents
+	DEFAULT_RECENT_DAYS = 7
+	MAX_RECENT_DAYS     = 30
+	SEARCH_DAYS         = 90
+)
+
+var (
+	ErrUnknownOperation  = errors.New("unknown operation")
+	ErrMissingDocumentID = errors.New("missing document_id")
+	ErrMissingQuery      = errors.New("missing query")
+)
+
+type (
+	// S3 access needed by the lambda
+	objectGetter interface {
+		GetObject(
+			ctx context.Context,
+			params *s3.GetObjectInput,
+			optFns ...func(*s3.Options),
+		) (*s3.GetObjectOutput, error)
+	}
+
+	handlerConfig struct {
+		store    database.DocumentStore
+		s3Client objectGetter
+	}
+
+	queryParameters struct {
+		DocumentID string `json:"document_id"`
+		Query      string `json:"query"`
+		Limit      int    `json:"limit"`
+		Days       int    `json:"days"`
+	}
+
+	queryRequest struct {
+		Operation  string          `json:"operation"`
+		Parameters queryParameters `json:"parameters"`
+	}
+
+	// The fields of a document the assistant is allowed to see. Download
+	// URLs, email addresses and storage keys are left out.
+	assistantDocument struct {
+		ID          string      `json:"id"`
+		Name        string      `json:"name"`
+		Source      string      `json:"source"`
+		CreatedTime time.Time   `json:"created_time"`
+		Status      string      `json:"status,omitempty"`
+		Stage       types.Stage `json:"stage,omitempty"`
+		StageStatus string      `json:"stage_status,omitempty"`
+		ErrorCode   string      `json:"error_code,omitempty"`
+		Attempt     int         `json:"attempt,omitempty"`
+	}
+
+	queryResponse struct {
+		Operation string              `json:"operation"`
+		Documents []assistantDocument `json:"documents,omitempty"`
+		Excerpt   string              `json:"excerpt,omitempty"`
+		Truncated bool                `json:"truncated"`
+	}
+
+	operationHandler func(
+		cfg *handlerConfig,
+		ctx context.Context,
+		params queryParameters,
+	) (*queryResponse, error)
+)
+
+var (
+	initOnce sync.Once
+	cfg      *handlerConfig
+
+	operations = map[string]operationHandler{
+		OPERATION_SEARCH:           (*handlerConfig).search,
+		OPERATION_STATUS:           (*handlerConfig).status,
+		OPERATION_LIST_RECENT:      (*handlerConfig).listRecent,
+		OPERATION_GET_NOTE_EXCERPT: (*handlerConfig).noteExcerpt,
+	}
+)
+
+// Load all the inital configuration settings for the lambda
+func loadConfiguration(ctx context.Context) (*handlerConfig, error) {
+
+	cfg = &handlerConfig{}
+
+	var err error
+
+	cfg.store, err = database.NewDocumentStore(ctx)
+	if err != nil {
+		slog.Error("Failed to configure the DynamoDB client", "error", err)
+		return nil, err
+	}
+
+	awsCfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		slog.Error("Failed to load the AWS config", "error", err)
+		return nil, err
+	}
+
+	cfg.s3Client = s3.NewFromConfig(awsCfg)
+
+	return cfg, nil
+}
+
+// Ensure that the configuration settings are only loaded once
+func initLambda(ctx context.Context) error {
+	var err error
+	initOnce.Do(func() {
+		slog.Debug(">>initLambda")
+		defer slog.Debug("<<initLambda")
+
+		cfg, err = loadConfiguration(ctx)
+	})
+
+	return err
+}
+
+// Copy the allowed fields of the document
+func projectDocument(document *types.Document) assistantDocument {
+	return assistantDocument{
+		ID:          document.ID,
+		Name:        document.Name,
+		Source:      document.SourceType,
+		CreatedTime: document.CreatedTime,
+		Status:      document.Status,
+	}
+}
+
+// Clamp the number of results requested
+func resultLimit(limit int) int {
+	if limit <= 0 {
+		return DEFAULT_RESULTS
+	}
+
+	return min(limit, MAX_RESULTS)
+}
+
+// Cut the text to at most length bytes without splitting a character
+func truncateText(text string, length int) (string, bool) {
+	if len(text) <= length {
+		return text, false
+	}
+
+	text = text[:length]
+	for len(text) > 0 && !utf8.ValidString(text) {
+		text = text[:len(text)-1]
+	}
+
+	return text, true
+}
+
+// Drop documents from the end of the response, then shorten the excerpt,
+// until the response fits in MAX_RESPONSE_BYTES.
+func capResponse(response *queryResponse) ([]byte, error) {
+	for {
+		body, err := json.Marshal(response)
+		if err != nil {
+			return nil, err
+		}
+
+		over := len(body) - MAX_RESPONSE_BYTES
+		if over <= 0 {
+			return body, nil
+		}
+
+		response.Truncated = true
+
+		switch {
+		case len(response.Documents) > 0:
+			response.Documents = response.Documents[:len(response.Documents)-1]
+
+		case response.Excerpt != "":
+			// escaping can make the excerpt longer in the JSON than it is
+			// in the note so cut at least a character each time
+			response.Excerpt, _ = truncateText(
+				response.Excerpt,
+				max(len(response.Excerpt)-over, 0),
+			)
+
+		default:
+			return nil, fmt.Errorf("response is larger than %d bytes", MAX_RESPONSE_BYTES)
+		}
+	}
+}
+
+// Add the latest stage the document reached to the projection
+func (cfg *handlerConfig) withProgress(
+	ctx context.Context,
+	document assistantDocument,
+) (assistantDocument, error) {
+	for _, stageName := range types.WorkflowStages() {
+		stage, err := cfg.store.GetDocumentStage(ctx, document.ID, stageName)
+		if errors.Is(err, database.ErrStageNotFound) {
+			break
+		}
+		if err != nil {
+			return document, err
+		}
+
+		if stage.StageStatus == "" {
+			break
+		}
+
+		document.Stage = stage.Stage
+		document.StageStatus = stage.StageStatus
+		document.ErrorCode = stage.ErrorCode
+		document.Attempt = stage.Attempt
+	}
+
+	return document, nil
+}
+
+// Documents created in the last number of days, newest first
+func (cfg *handlerConfig) recentDocuments(
+	ctx context.Context,
+	days int,
+) ([]*types.Document, error) {
+	since := time.Now().UTC().AddDate(0, 0, -days)
+
+	documents, err := cfg.store.ListDocuments(ctx, since)
+	if err != nil {
+		return nil, err
+	}
+
+	slices.SortFunc(documents, func(a, b *types.Document) int {
+		return b.CreatedTime.Compare(a.CreatedTime)
+	})
+
+	return documents, nil
+}
+
+// Build the response from the documents, up to the limit
+func (cfg *handlerConfig) documentList(
+	ctx context.Context,
+	operation string,
+	documents []*types.Document,
+	limit int,
+) (*queryResponse, error) {
+	response := &queryResponse{
+		Operation: operation,
+		Documents: make([]assistantDocument, 0, limit),
+	}
+
+	for _, document := range documents {
+		if len(response.Documents) == limit {
+			response.Truncated = true
+			break
+		}
+
+		projected, err := cfg.withProgress(ctx, projectDocument(document))
+		if err != nil {
+			return nil, err
+		}
+
+		response.Documents = append(response.Documents, projected)
+	}
+
+	return response, nil
+}
+
+// Documents whose name contains every word of the query. There is no search
+// index over the notes yet so only the names of recent documents are matched.
+func (cfg *handlerConfig) search(
+	ctx context.Context,
+	params queryParameters,
+) (*queryResponse, error) {
+	terms := strings.Fields(strings.ToLower(params.Query))
+	if len(terms) == 0 {
+		return nil, ErrMissingQuery
+	}
+
+	documents, err := cfg.recentDocuments(ctx, SEARCH_DAYS)
+	if err != nil {
+		return nil, err
+	}
+
+	matches := slices.DeleteFunc(documents, func(document *types.Document) bool {
+		name := strings.ToLower(document.Name)
+		for _, term := range terms {
+			if !strings.Contains(name, term) {
+				return true
+			}
+		}
+
+		return false
+	})
+
+	return cfg.documentList(
+		ctx,
+		OPERATION_SEARCH,
+		matches,
+		resultLimit(params.Limit),
+	)
+}
+
+// The document along with the latest stage it reached
+func (cfg *handlerConfig) status(
+	ctx context.Context,
+	params queryParameters,
+) (*queryResponse, error) {
+	document, err := cfg.getDocument(ctx, params.DocumentID)
+	if err != nil {
+		return nil, err
+	}
+
+	return cfg.documentList(
+		ctx,
+		OPERATION_STATUS,
+		[]*types.Document{document},
+		1,
+	)
+}
+
+// The documents created in the last days, newest first
+func (cfg *handlerConfig) listRecent(
+	ctx context.Context,
+	params queryParameters,
+) (*queryResponse, error) {
+	days := params.Days
+	if days <= 0 {
+		days = DEFAULT_RECENT_DAYS
+	}
+
+	documents, err := cfg.recentDocuments(ctx, min(days, MAX_RECENT_DAYS))
+	if err != nil {
+		return nil, err
+	}
+
+	return cfg.documentList(
+		ctx,
+		OPERATION_LIST_RECENT,
+		documents,
+		resultLimit(params.Limit),
+	)
+}
+
+// The start of the cleaned up Markdown for the document. Only one byte past
+// the excerpt is read to tell if the note was cut short.
+func (cfg *handlerConfig) noteExcerpt(
+	ctx context.Context,
+	params queryParameters,
+) (*queryResponse, error) {
+	document, err := cfg.getDocument(ctx, params.DocumentID)
+	if err != nil {
+		return nil, err
+	}
+
+	response := &queryResponse{
+		Operation: OPERATION_GET_NOTE_EXCERPT,
+		Documents: []assistantDocument{projectDocument(document)},
+	}
+
+	stage, err := cfg.store.GetDocumentStage(
+		ctx,
+		document.ID,
+		types.DOCUMENT_STAGE_OPENAI,
+	)
+	if errors.Is(err, database.ErrStageNotFound) {
+		return response, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if stage.S3Key == "" {
+		return response, nil
+	}
+
+	resp, err := cfg.s3Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(types.S3_BUCKET_NAME),
+		Key:    aws.String(stage.S3Key),
+		Range:  aws.String(fmt.Sprintf("bytes=0-%d", MAX_EXCERPT_LENGTH)),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	content, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	response.Excerpt, response.Truncated = truncateText(
+		string(content),
+		MAX_EXCERPT_LENGTH,
+	)
+
+	return response, nil
+}
+
+func (cfg *handlerConfig) getDocument(
+	ctx context.Context,
+	documentID string,
+) (*types.Document, error) {
+	if documentID == "" {
+		return nil, ErrMissingDocumentID
+	}
+
+	return cfg.store.GetDocument(ctx, documentID)
+}
+
+// Run the requested operation and cap the size of the result
+func (cfg *handlerConfig) dispatch(
+	ctx context.Context,
+	request queryRequest,
+) ([]byte, error) {
+	handler, ok := operations[request.Operation]
+	if !ok {
+		return nil, ErrUnknownOperation
+	}
+
+	response, err := handler(cfg, ctx, request.Parameters)
+	if err != nil {
+		return nil, err
+	}
+
+	return capResponse(response)
+}
+
+// Map the errors the caller can fix to a response code
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrUnknownOperation),
+		errors.Is(err, ErrMissingDocumentID),
+		errors.Is(err, ErrMissingQuery):
+		return http.StatusBadRequest
+
+	case errors.Is(err, database.ErrDocumentNotFound):
+		return http.StatusNotFound
+	}
+
+	return http.StatusInternalServerError
+}
+
+func process(
+	ctx context.Context,
+	request events.APIGatewayProxyRequest,
+) (events.APIGatewayProxyResponse, error) {
+	slog.Debug(">>process")
+	defer slog.Debug("<<process")
+
+	if err := initLambda(ctx); err != nil {
+		slog.Error("Failed to initialize the lambda", "error", err)
+		return util.BuildGatewayResponse(
+			err.Error(),
+			http.StatusInternalServerError,
+		)
+	}
+
+	var query queryRequest
+	if err := json.Unmarshal([]byte(request.Body), &query); err != nil {
+		return util.BuildGatewayResponse(
+			"invalid request body",
+			http.StatusBadRequest,
+		)
+	}
+
+	body, err := cfg.dispatch(ctx, query)
+	if err != nil {
+		slog.Error("Failed to run the assistant query", "operation", query.Operation, "error", err)
+
+		return util.BuildGatewayResponse(err.Error(), errorStatus(err))
+	}
+
+	return util.BuildGatewayResponse(string(body), http.StatusOK)
+}
+
+func main() {
+	slog.Debug(">>main")
+	defer slog.Debug("<<main")
+
+	lambda.Start(process)
+}
@@ -0,0 +1,418 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/KyleBrandon/scriptor/pkg/database"
+	"github.com/KyleBrandon/scriptor/pkg/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+type fakeStore struct {
+	database.DocumentStore
+	documents []*types.Document
+	stages    map[string]*types.DocumentProcessingStage
+}
+
+func (f *fakeStore) GetDocument(
+	ctx context.Context,
+	id string,
+) (*types.Document, error) {
+	for _, document := range f.documents {
+		if document.ID == id {
+			return document, nil
+		}
+	}
+
+	return nil, database.ErrDocumentNotFound
+}
+
+func (f *fakeStore) ListDocuments(
+	ctx context.Context,
+	since time.Time,
+) ([]*types.Document, error) {
+	documents := make([]*types.Document, 0, len(f.documents))
+	for _, document := range f.documents {
+		if !document.CreatedTime.Before(since) {
+			documents = append(documents, document)
+		}
+	}
+
+	return documents, nil
+}
+
+func (f *fakeStore) GetDocumentStage(
+	ctx context.Context,
+	id string,
+	stage types.Stage,
+) (*types.DocumentProcessingStage, error) {
+	if s, ok := f.stages[id+"/"+string(stage)]; ok {
+		return s, nil
+	}
+
+	return &types.DocumentProcessingStage{}, nil
+}
+
+type fakeS3 struct {
+	content string
+	ranges  []string
+}
+
+func (f *fakeS3) GetObject(
+	ctx context.Context,
+	params *s3.GetObjectInput,
+	optFns ...func(*s3.Options),
+) (*s3.GetObjectOutput, error) {
+	f.ranges = append(f.ranges, *params.Range)
+
+	// serve the range the same way S3 does
+	var start, end int
+	if _, err := fmt.Sscanf(*params.Range, "bytes=%d-%d", &start, &end); err != nil {
+		return nil, err
+	}
+
+	content := f.content
+	if end+1 < len(content) {
+		content = content[:end+1]
+	}
+
+	return &s3.GetObjectOutput{
+		Body: io.NopCloser(strings.NewReader(content[start:])),
+	}, nil
+}
+
+func testConfig() (*handlerConfig, *fakeS3) {
+	now := time.Now().UTC()
+
+	store := &fakeStore{
+		documents: []*types.Document{
+			{
+				ID:            "kitchen",
+				Name:          "Kitchen Renovation Quote.pdf",
+				SourceType:    types.DOCUMENT_SOURCE_KINDLE_EMAIL,
+				CreatedTime:   now.Add(-24 * time.Hour),
+				DownloadURL:   "https://example.com/signed",
+				Sender:        "someone@example.com",
+				Recipient:     "scan@example.com",
+				RawEmailS3Key: "emails/raw",
+			},
+			{
+				ID:          "garden",
+				Name:        "Garden plan.pdf",
+				SourceType:  types.DOCUMENT_SOURCE_GOOGLE_DRIVE,
+				CreatedTime: now.Add(-2 * time.Hour),
+			},
+			{
+				ID:          "old-kitchen",
+				Name:        "Kitchen sketch.pdf",
+				SourceType:  types.DOCUMENT_SOURCE_GOOGLE_DRIVE,
+				CreatedTime: now.AddDate(0, 0, -120),
+			},
+		},
+		stages: map[string]*types.DocumentProcessingStage{
+			"kitchen/" + string(types.DOCUMENT_STAGE_DOWNLOAD): {
+				Stage:       types.DOCUMENT_STAGE_DOWNLOAD,
+				StageStatus: types.DOCUMENT_STATUS_COMPLETE,
+				S3Key:       "kitchen/downloaded/quote.pdf",
+			},
+			"kitchen/" + string(types.DOCUMENT_STAGE_MATHPIX): {
+				Stage:       types.DOCUMENT_STAGE_MATHPIX,
+				StageStatus: types.DOCUMENT_STATUS_COMPLETE,
+			},
+			"kitchen/" + string(types.DOCUMENT_STAGE_OPENAI): {
+				Stage:       types.DOCUMENT_STAGE_OPENAI,
+				StageStatus: types.DOCUMENT_STATUS_ERROR,
+				ErrorCode:   "RateLimited",
+				S3Key:       "kitchen/openai/quote.md",
+				Attempt:     2,
+			},
+		},
+	}
+
+	objects := &fakeS3{}
+
+	return &handlerConfig{store: store, s3Client: objects}, objects
+}
+
+func decodeResponse(t *testing.T, body []byte) queryResponse {
+	t.Helper()
+
+	var response queryResponse
+	if err := json.Unmarshal(body, &response); err != nil {
+		t.Fatalf("failed to decode the response: %v", err)
+	}
+
+	return response
+}
+
+func TestDispatch(t *testing.T) {
+	tests := []struct {
+		name        string
+		request     queryRequest
+		wantErr     error
+		wantIDs     []string
+		wantStage   types.Stage
+		wantAttempt int
+		wantExcerpt bool
+	}{
+		{
+			name: "search matches every word of the name",
+			request: queryRequest{
+				Operation:  OPERATION_SEARCH,
+				Parameters: queryParameters{Query: "kitchen RENOVATION"},
+			},
+			wantIDs: []string{"kitchen"},
+		},
+		{
+			name: "search needs a query",
+			request: queryRequest{
+				Operation: OPERATION_SEARCH,
+			},
+			wantErr: ErrMissingQuery,
+		},
+		{
+			name: "status reports the latest stage",
+			request: queryRequest{
+				Operation:  OPERATION_STATUS,
+				Parameters: queryParameters{DocumentID: "kitchen"},
+			},
+			wantIDs:     []string{"kitchen"},
+			wantStage:   types.DOCUMENT_STAGE_OPENAI,
+			wantAttempt: 2,
+		},
+		{
+			name: "status of a missing document",
+			request: queryRequest{
+				Operation:  OPERATION_STATUS,
+				Parameters: queryParameters{DocumentID: "nope"},
+			},
+			wantErr: database.ErrDocumentNotFound,
+		},
+		{
+			name: "list recent is newest first",
+			request: queryRequest{
+				Operation: OPERATION_LIST_RECENT,
+			},
+			wantIDs: []string{"garden", "kitchen"},
+		},
+		{
+			name: "list recent honors the limit",
+			request: queryRequest{
+				Operation:  OPERATION_LIST_RECENT,
+				Parameters: queryParameters{Limit: 1},
+			},
+			wantIDs: []string{"garden"},
+		},
+		{
+			name: "note excerpt",
+			request: queryRequest{
+				Operation:  OPERATION_GET_NOTE_EXCERPT,
+				Parameters: queryParameters{DocumentID: "kitchen"},
+			},
+			wantIDs:     []string{"kitchen"},
+			wantExcerpt: true,
+		},
+		{
+			name: "note excerpt needs a document",
+			request: queryRequest{
+				Operation: OPERATION_GET_NOTE_EXCERPT,
+			},
+			wantErr: ErrMissingDocumentID,
+		},
+		{
+			name: "unknown operation",
+			request: queryRequest{
+				Operation: "reprocess",
+			},
+			wantErr: ErrUnknownOperation,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg, objects := testConfig()
+			objects.content = "# Kitchen\n\nQuote for the cabinets.\n"
+
+			body, err := cfg.dispatch(context.Background(), tc.request)
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("unexpected error: got %v want %v", err, tc.wantErr)
+			}
+
+			if tc.wantErr != nil {
+				return
+			}
+
+			response := decodeResponse(t, body)
+			if response.Operation != tc.request.Operation {
+				t.Fatalf("unexpected operation: %q", response.Operation)
+			}
+
+			ids := make([]string, 0, len(response.Documents))
+			for _, document := range response.Documents {
+				ids = append(ids, document.ID)
+			}
+
+			if strings.Join(ids, ",") != strings.Join(tc.wantIDs, ",") {
+				t.Fatalf("unexpected documents: got %v want %v", ids, tc.wantIDs)
+			}
+
+			if tc.wantStage != "" && response.Documents[0].Stage != tc.wantStage {
+				t.Fatalf("unexpected stage: got %q want %q", response.Documents[0].Stage, tc.wantStage)
+			}
+
+			if tc.wantAttempt != 0 && response.Documents[0].Attempt != tc.wantAttempt {
+				t.Fatalf("unexpected attempt: got %d want %d", response.Documents[0].Attempt, tc.wantAttempt)
+			}
+
+			if tc.wantExcerpt != (response.Excerpt == objects.content) {
+				t.Fatalf("unexpected excerpt: %q", response.Excerpt)
+			}
+		})
+	}
+}
+
+func TestNoteExcerptTruncated(t *testing.T) {
+	cfg, objects := testConfig()
+
+	// a multi-byte character straddles the excerpt length
+	objects.content = strings.Repeat("a", MAX_EXCERPT_LENGTH-1) + "é and more"
+
+	body, err := cfg.dispatch(context.Background(), queryRequest{
+		Operation:  OPERATION_GET_NOTE_EXCERPT,
+		Parameters: queryParameters{DocumentID: "kitchen"},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	response := decodeResponse(t, body)
+	if !response.Truncated {
+		t.Fatalf("expected the excerpt to be truncated")
+	}
+
+	if response.Excerpt != strings.Repeat("a", MAX_EXCERPT_LENGTH-1) {
+		t.Fatalf("unexpected excerpt of %d bytes", len(response.Excerpt))
+	}
+
+	if objects.ranges[0] != "bytes=0-2000" {
+		t.Fatalf("unexpected range: %q", objects.ranges[0])
+	}
+}
+
+func TestCapResponse(t *testing.T) {
+	documents := make([]assistantDocument, MAX_RESULTS)
+	for i := range documents {
+		documents[i] = assistantDocument{
+			ID:   strings.Repeat("d", 36),
+			Name: strings.Repeat("n", 400),
+		}
+	}
+
+	tests := []struct {
+		name          string
+		response      queryResponse
+		wantTruncated bool
+		wantDocuments int
+	}{
+		{
+			name: "fits",
+			response: queryResponse{
+				Operation: OPERATION_LIST_RECENT,
+				Documents: documents[:2],
+			},
+			wantDocuments: 2,
+		},
+		{
+			name: "drops documents",
+			response: queryResponse{
+				Operation: OPERATION_LIST_RECENT,
+				Documents: documents,
+			},
+			wantTruncated: true,
+			wantDocuments: 16,
+		},
+		{
+			name: "shortens an escaped excerpt",
+			response: queryResponse{
+				Operation: OPERATION_GET_NOTE_EXCERPT,
+				Excerpt:   strings.Repeat("<", MAX_RESPONSE_BYTES/2),
+			},
+			wantTruncated: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			response := tc.response
+			response.Documents = append([]assistantDocument{}, tc.response.Documents...)
+
+			body, err := capResponse(&response)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if len(body) > MAX_RESPONSE_BYTES {
+				t.Fatalf("response is %d bytes", len(body))
+			}
+
+			got := decodeResponse(t, body)
+			if got.Truncated != tc.wantTruncated {
+				t.Fatalf("unexpected truncated: got %v want %v", got.Truncated, tc.wantTruncated)
+			}
+
+			if len(got.Documents) != tc.wantDocuments {
+				t.Fatalf("unexpected documents: got %d want %d", len(got.Documents), tc.wantDocuments)
+			}
+		})
+	}
+}
+
+func TestProjectionAllowlist(t *testing.T) {
+	cfg, _ := testConfig()
+
+	body, err := cfg.dispatch(context.Background(), queryRequest{
+		Operation:  OPERATION_STATUS,
+		Parameters: queryParameters{DocumentID: "kitchen"},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var response struct {
+		Documents []map[string]any `json:"documents"`
+	}
+	if err := json.Unmarshal(body, &response); err != nil {
+		t.Fatalf("failed to decode the response: %v", err)
+	}
+
+	allowed := map[string]bool{
+		"id":           true,
+		"name":         true,
+		"source":       true,
+		"created_time": true,
+		"status":       true,
+		"stage":        true,
+		"stage_status": true,
+		"error_code":   true,
+		"attempt":      true,
+	}
+
+	for field := range response.Documents[0] {
+		if !allowed[field] {
+			t.Fatalf("field %q is not allowed", field)
+		}
+	}
+
+	for _, leaked := range []string{"https://", "@example.com", "emails/raw", "kitchen/"} {
+		if strings.Contains(string(body), leaked) {
+			t.Fatalf("response leaks %q: %s", leaked, body)
+		}
+	}
+}
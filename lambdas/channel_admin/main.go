@@ -0,0 +1,665 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/KyleBrandon/scriptor/lambdas/util"
+	"github.com/KyleBrandon/scriptor/pkg/database"
+	"github.com/KyleBrandon/scriptor/pkg/errorsmap"
+	"github.com/KyleBrandon/scriptor/pkg/google"
+	"github.com/KyleBrandon/scriptor/pkg/notes"
+	"github.com/KyleBrandon/scriptor/pkg/retry"
+	"github.com/KyleBrandon/scriptor/pkg/types"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/google/uuid"
+)
+
+const (
+	// Attempts to stop the channel of a folder that is removed
+	STOP_ATTEMPTS = 3
+
+	// The routes of the lambda on the API Gateway
+	RESOURCE_CHANNELS = "/channels"
+	RESOURCE_CHANNEL  = "/channels/{folderID}"
+	RESOURCE_PAUSE    = "/channels/{folderID}/pause"
+	RESOURCE_RESUME   = "/channels/{folderID}/resume"
+	RESOURCE_BACKFILL = "/channels/{folderID}/backfill"
+
+	// Codes of the errors that aren't in errorsmap
+	CODE_INVALID_REQUEST = "invalid_request"
+	CODE_NOT_FOUND       = "not_found"
+	CODE_CHANNEL_PAUSED  = "channel_paused"
+)
+
+type (
+	// The Drive calls the lambda makes
+	watchService interface {
+		ValidateWatchChannelFolders(ctx context.Context, wc *types.WatchChannel) error
+		ValidateFolderLocations(ctx context.Context, wc *types.WatchChannel, recursive bool) error
+		CreateWatchChannel(ctx context.Context, wc *types.WatchChannel) (string, error)
+		StopWatchChannel(ctx context.Context, channelID, resourceID string) error
+		GetChangesStartToken(ctx context.Context, driveID string) (string, error)
+	}
+
+	// The SQS client used to queue the notifications of a resumed or
+	// backfilled channel
+	messageSender interface {
+		SendMessage(
+			ctx context.Context,
+			params *sqs.SendMessageInput,
+			optFns ...func(*sqs.Options),
+		) (*sqs.SendMessageOutput, error)
+	}
+
+	handlerConfig struct {
+		store     database.WatchChannelStore
+		dc        watchService
+		sqsClient messageSender
+		queueURL  string
+	}
+
+	// The folder to watch, the folders it publishes to and the options of
+	// the watch channel
+	addChannelRequest struct {
+		FolderID                string            `json:"folder_id"`
+		DriveID                 string            `json:"drive_id"`
+		Recursive               bool              `json:"recursive"`
+		ArchiveFolderID         string            `json:"archive_folder_id"`
+		DestinationFolderIDs    []string          `json:"destination_folder_ids"`
+		PublishGoogleDoc        bool              `json:"publish_google_doc"`
+		SkipMarkdown            bool              `json:"skip_markdown"`
+		FilenameTemplate        string            `json:"filename_template"`
+		DateFolders             bool              `json:"date_folders"`
+		PostComments            bool              `json:"post_comments"`
+		ArchiveMode             string            `json:"archive_mode"`
+		Routes                  map[string]string `json:"routes"`
+		AllowedMimeTypes        []string          `json:"allowed_mime_types"`
+		MaxConcurrentExecutions int               `json:"max_concurrent_executions"`
+	}
+
+	// A watched folder as it is listed
+	channelSummary struct {
+		FolderID             string    `json:"folder_id"`
+		ArchiveFolderID      string    `json:"archive_folder_id"`
+		DestinationFolderIDs []string  `json:"destination_folder_ids"`
+		ChannelID            string    `json:"channel_id"`
+		ExpiresAt            time.Time `json:"expires_at"`
+		Expired              bool      `json:"expired"`
+		Paused               bool      `json:"paused"`
+
+		// When the changes of the channel were last checked for a
+		// notification, empty when they never were
+		LastNotificationAt string `json:"last_notification_at,omitempty"`
+
+		// Earlier channels of the folder that are still to be stopped
+		PendingStops int `json:"pending_stops"`
+	}
+
+	listChannelsResponse struct {
+		Channels []channelSummary `json:"channels"`
+	}
+)
+
+var (
+	initOnce sync.Once
+	cfg      *handlerConfig
+
+	stopRetryPolicy = retry.Policy{
+		MaxAttempts:    STOP_ATTEMPTS,
+		InitialBackoff: 500 * time.Millisecond,
+		MaxBackoff:     2 * time.Second,
+		Retryable:      google.IsRetryableError,
+	}
+)
+
+// Load all the inital configuration settings for the lambda
+func loadConfiguration(ctx context.Context) (*handlerConfig, error) {
+
+	cfg = &handlerConfig{}
+
+	var err error
+
+	cfg.store, err = database.NewWatchChannelStore(ctx)
+	if err != nil {
+		slog.Error("Failed to configure the DynamoDB client", "error", err)
+		return nil, err
+	}
+
+	awsCfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		slog.Error("Failed to load the AWS config", "error", err)
+		return nil, err
+	}
+
+	cfg.queueURL = os.Getenv("SQS_QUEUE_URL")
+	if cfg.queueURL == "" {
+		slog.Error("Failed to get the SQS queue URL")
+		return nil, fmt.Errorf("SQS_QUEUE_URL is not set")
+	}
+
+	cfg.sqsClient = sqs.NewFromConfig(awsCfg)
+
+	cfg.dc, err = google.NewGoogleDrive(ctx)
+	if err != nil {
+		slog.Error(
+			"Failed to initialize the Google Drive service context",
+			"error",
+			err,
+		)
+		return nil, err
+	}
+
+	// the default is used by every channel without a template of its own
+	err = notes.ValidateFilename(util.FilenameTemplate(&types.WatchChannel{}))
+	if err != nil {
+		slog.Error("Invalid FILENAME_TEMPLATE", "error", err)
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+// Ensure that the configuration settings are only loaded once
+func initLambda(ctx context.Context) error {
+	var err error
+	initOnce.Do(func() {
+		slog.Debug(">>initLambda")
+		defer slog.Debug("<<initLambda")
+
+		cfg, err = loadConfiguration(ctx)
+	})
+
+	return err
+}
+
+// The webhook is on the same API as the admin routes, so its URL is made
+// from the request instead of being passed to the lambda
+func webhookURL(request events.APIGatewayProxyRequest) string {
+	return fmt.Sprintf(
+		"https://%s/%s/webhook/google-drive",
+		request.RequestContext.DomainName,
+		request.RequestContext.Stage,
+	)
+}
+
+// Answer with the code errorsmap has for the error
+func errorResponse(err error, status int) (events.APIGatewayProxyResponse, error) {
+	return util.BuildGatewayErrorResponse(errorsmap.Classify(err), err.Error(), status)
+}
+
+func jsonResponse(value any, status int) (events.APIGatewayProxyResponse, error) {
+	body, err := json.Marshal(value)
+	if err != nil {
+		return errorResponse(err, http.StatusInternalServerError)
+	}
+
+	response, err := util.BuildGatewayResponse(string(body), status)
+	response.Headers = map[string]string{"Content-Type": "application/json"}
+
+	return response, err
+}
+
+func summarize(wc *types.WatchChannel, lock *types.WatchChannelLock, now time.Time) channelSummary {
+	summary := channelSummary{
+		FolderID:             wc.FolderID,
+		ArchiveFolderID:      wc.ArchiveFolderID,
+		DestinationFolderIDs: wc.Destinations(),
+		ChannelID:            wc.ChannelID,
+		Paused:               wc.Paused,
+		PendingStops:         len(wc.PendingStops),
+	}
+
+	if wc.ExpiresAt > 0 {
+		summary.ExpiresAt = time.UnixMilli(wc.ExpiresAt).UTC()
+		summary.Expired = !summary.ExpiresAt.After(now)
+	}
+
+	// locks written before the timestamps were standardized are in another
+	// format, they are reported the same way
+	if lock != nil {
+		summary.LastNotificationAt = lock.UpdatedAt
+		if updatedAt, err := database.ParseTimestamp(lock.UpdatedAt); err == nil {
+			summary.LastNotificationAt = updatedAt.Format(time.RFC3339Nano)
+		}
+	}
+
+	return summary
+}
+
+// List the watched folders with when their channels expire and when they
+// last had a notification
+func (cfg *handlerConfig) listChannels(ctx context.Context) (events.APIGatewayProxyResponse, error) {
+	watchChannels, err := cfg.store.GetWatchChannels(ctx)
+	if err != nil {
+		slog.Error("Failed to get the watch channels", "error", err)
+		return errorResponse(err, http.StatusInternalServerError)
+	}
+
+	locks, err := cfg.store.ListWatchChannelLocks(ctx)
+	if err != nil {
+		slog.Error("Failed to get the watch channel locks", "error", err)
+		return errorResponse(err, http.StatusInternalServerError)
+	}
+
+	lockOf := make(map[string]*types.WatchChannelLock, len(locks))
+	for _, lock := range locks {
+		lockOf[lock.ChannelID] = lock
+	}
+
+	now := time.Now().UTC()
+	response := listChannelsResponse{
+		Channels: make([]channelSummary, 0, len(watchChannels)),
+	}
+	for _, wc := range watchChannels {
+		response.Channels = append(response.Channels, summarize(wc, lockOf[wc.ChannelID], now))
+	}
+
+	return jsonResponse(response, http.StatusOK)
+}
+
+// Make the watch channel of the request, rejecting the options the register
+// lambda would reject
+func newWatchChannel(req addChannelRequest) (*types.WatchChannel, error) {
+	if req.FolderID == "" {
+		return nil, errors.New("folder_id is required")
+	}
+
+	wc := &types.WatchChannel{
+		FolderID:                req.FolderID,
+		DriveID:                 req.DriveID,
+		Recursive:               req.Recursive,
+		ArchiveFolderID:         req.ArchiveFolderID,
+		DestinationFolderIDs:    req.DestinationFolderIDs,
+		PublishGoogleDoc:        req.PublishGoogleDoc,
+		SkipMarkdown:            req.SkipMarkdown,
+		FilenameTemplate:        req.FilenameTemplate,
+		DateFolders:             req.DateFolders,
+		PostComments:            req.PostComments,
+		ArchiveMode:             req.ArchiveMode,
+		Routes:                  req.Routes,
+		AllowedMimeTypes:        req.AllowedMimeTypes,
+		MaxConcurrentExecutions: req.MaxConcurrentExecutions,
+	}
+
+	// the first destination is kept in the single folder field as well
+	// for readers of the old records
+	if len(wc.DestinationFolderIDs) > 0 {
+		wc.DestinationFolderID = wc.DestinationFolderIDs[0]
+	}
+
+	if err := notes.ValidateFilename(util.FilenameTemplate(wc)); err != nil {
+		return nil, err
+	}
+
+	if _, err := types.ParseArchiveMode(wc.ArchiveMode); err != nil {
+		return nil, err
+	}
+
+	if wc.MaxConcurrentExecutions < 0 {
+		return nil, errors.New("max_concurrent_executions can't be negative")
+	}
+
+	return wc, nil
+}
+
+// Watch a new folder. The channel is saved before it is created so the sync
+// notification Google sends right away can be verified, and is removed
+// again when Drive fails to create it.
+func (cfg *handlerConfig) addChannel(
+	ctx context.Context,
+	request events.APIGatewayProxyRequest,
+) (events.APIGatewayProxyResponse, error) {
+	var req addChannelRequest
+	if err := json.Unmarshal([]byte(request.Body), &req); err != nil {
+		return util.BuildGatewayErrorResponse(
+			CODE_INVALID_REQUEST,
+			"invalid watch channel request",
+			http.StatusBadRequest,
+		)
+	}
+
+	wc, err := newWatchChannel(req)
+	if err != nil {
+		return util.BuildGatewayErrorResponse(CODE_INVALID_REQUEST, err.Error(), http.StatusBadRequest)
+	}
+
+	err = cfg.dc.ValidateFolderLocations(ctx, wc, wc.Recursive)
+	if errors.Is(err, google.ErrFolderLoop) {
+		return errorResponse(err, http.StatusBadRequest)
+	}
+	if err != nil {
+		return errorResponse(err, http.StatusBadGateway)
+	}
+
+	err = cfg.dc.ValidateWatchChannelFolders(ctx, wc)
+	if errors.Is(err, google.ErrFolderNotFound) || errors.Is(err, google.ErrFolderNotWritable) {
+		return errorResponse(err, http.StatusBadRequest)
+	}
+	if err != nil {
+		return errorResponse(err, http.StatusBadGateway)
+	}
+
+	token, err := util.NewChannelToken()
+	if err != nil {
+		return errorResponse(err, http.StatusInternalServerError)
+	}
+
+	now := time.Now().UTC()
+	util.SetChannelIdentity(wc, token, webhookURL(request), now)
+
+	err = cfg.store.InsertWatchChannel(ctx, wc)
+	if errors.Is(err, database.ErrWatchChannelExists) {
+		return errorResponse(err, http.StatusConflict)
+	}
+	if err != nil {
+		slog.Error("Failed to save the watch channel", "folderID", wc.FolderID, "error", err)
+		return errorResponse(err, http.StatusInternalServerError)
+	}
+
+	resourceID, err := cfg.dc.CreateWatchChannel(ctx, wc)
+	if err != nil {
+		slog.Error(
+			"Failed to create the watch channel",
+			"folderID",
+			wc.FolderID,
+			"channelID",
+			wc.ChannelID,
+			"error",
+			err,
+		)
+
+		// the folder can be added again once Drive is back
+		deleteErr := cfg.store.DeleteWatchChannel(ctx, wc.FolderID)
+		if deleteErr != nil {
+			slog.Error("Failed to remove the watch channel", "folderID", wc.FolderID, "error", deleteErr)
+		}
+
+		return errorResponse(err, http.StatusBadGateway)
+	}
+
+	wc.ResourceID = resourceID
+	err = cfg.store.UpdateWatchChannel(ctx, wc)
+	if err != nil {
+		slog.Error("Failed to save the resource ID of the watch channel", "folderID", wc.FolderID, "error", err)
+		return errorResponse(err, http.StatusInternalServerError)
+	}
+
+	startToken, err := cfg.dc.GetChangesStartToken(ctx, wc.DriveID)
+	if err == nil {
+		err = cfg.store.CreateWatchChannelLock(ctx, wc.ChannelID, startToken)
+	}
+	if err != nil {
+		slog.Error("Failed to create the watch channel lock", "channelID", wc.ChannelID, "error", err)
+		return errorResponse(err, http.StatusInternalServerError)
+	}
+
+	slog.Info("Watching a new folder", "folderID", wc.FolderID, "channelID", wc.ChannelID)
+
+	return jsonResponse(summarize(wc, nil, now), http.StatusCreated)
+}
+
+// Stop the channel, retrying transient failures
+func (cfg *handlerConfig) stopChannel(ctx context.Context, channelID, resourceID string) error {
+	return retry.Do(ctx, stopRetryPolicy, "StopWatchChannel", func() error {
+		return cfg.dc.StopWatchChannel(ctx, channelID, resourceID)
+	})
+}
+
+// Stop watching the folder. The rows are only removed once its channel is
+// stopped, so a failed request can be sent again. The earlier channels that
+// failed to stop are tried once more and otherwise left to expire.
+func (cfg *handlerConfig) removeChannel(
+	ctx context.Context,
+	folderID string,
+) (events.APIGatewayProxyResponse, error) {
+	wc, err := cfg.store.GetWatchChannel(ctx, folderID)
+	if err != nil {
+		return errorResponse(err, http.StatusInternalServerError)
+	}
+
+	if wc.FolderID == "" {
+		return errorResponse(database.ErrWatchChannelNotFound, http.StatusNotFound)
+	}
+
+	if wc.ChannelID != "" && wc.ResourceID != "" {
+		err = cfg.stopChannel(ctx, wc.ChannelID, wc.ResourceID)
+		if err != nil {
+			slog.Error(
+				"Failed to stop the watch channel",
+				"folderID",
+				folderID,
+				"channelID",
+				wc.ChannelID,
+				"error",
+				err,
+			)
+			return errorResponse(err, http.StatusBadGateway)
+		}
+	}
+
+	for _, stop := range wc.PendingStops {
+		err = cfg.stopChannel(ctx, stop.ChannelID, stop.ResourceID)
+		if err != nil {
+			slog.Warn(
+				"Failed to stop an earlier channel of the folder, it stops when it expires",
+				"folderID",
+				folderID,
+				"channelID",
+				stop.ChannelID,
+				"error",
+				err,
+			)
+		}
+	}
+
+	if wc.ChannelID != "" {
+		err = cfg.store.DeleteWatchChannelLock(ctx, wc.ChannelID)
+		if err != nil {
+			return errorResponse(err, http.StatusInternalServerError)
+		}
+	}
+
+	err = cfg.store.DeleteWatchChannel(ctx, folderID)
+	if errors.Is(err, database.ErrWatchChannelNotFound) {
+		return errorResponse(err, http.StatusNotFound)
+	}
+	if err != nil {
+		return errorResponse(err, http.StatusInternalServerError)
+	}
+
+	slog.Info("Stopped watching the folder", "folderID", folderID, "channelID", wc.ChannelID)
+
+	return events.APIGatewayProxyResponse{StatusCode: http.StatusNoContent}, nil
+}
+
+// Queue a notification of the kind for the channel, like the webhook does
+func (cfg *handlerConfig) queueNotification(
+	ctx context.Context,
+	wc *types.WatchChannel,
+	kind string,
+) error {
+	notificationID, err := uuid.NewRandom()
+	if err != nil {
+		return err
+	}
+
+	message := types.ChannelNotification{
+		NotificationID: notificationID.String(),
+		ChannelID:      wc.ChannelID,
+		FolderID:       wc.FolderID,
+		DriveID:        wc.DriveID,
+		Recursive:      wc.Recursive,
+		Kind:           kind,
+	}
+
+	body, err := json.Marshal(&message)
+	if err != nil {
+		return err
+	}
+
+	trace := util.Trace{NotificationID: message.NotificationID, ChannelID: message.ChannelID}
+	_, err = cfg.sqsClient.SendMessage(ctx, &sqs.SendMessageInput{
+		QueueUrl:          aws.String(cfg.queueURL),
+		MessageBody:       aws.String(string(body)),
+		MessageAttributes: trace.MessageAttributes(),
+	})
+
+	return err
+}
+
+// Pause or resume the notifications of the folder. The channel keeps
+// running in Drive while it is paused and is renewed as usual. Its changes
+// token doesn't move on, so once it is resumed the changes since it was
+// paused are queried.
+func (cfg *handlerConfig) setPaused(
+	ctx context.Context,
+	folderID string,
+	paused bool,
+) (events.APIGatewayProxyResponse, error) {
+	err := cfg.store.SetWatchChannelPaused(ctx, folderID, paused)
+	if errors.Is(err, database.ErrWatchChannelNotFound) {
+		return errorResponse(err, http.StatusNotFound)
+	}
+	if err != nil {
+		return errorResponse(err, http.StatusInternalServerError)
+	}
+
+	wc, err := cfg.store.GetWatchChannel(ctx, folderID)
+	if err != nil {
+		return errorResponse(err, http.StatusInternalServerError)
+	}
+
+	slog.Info("Set whether the folder is paused", "folderID", folderID, "paused", paused)
+
+	// the channel is resumed either way, the changes are also queried on
+	// its next notification. Queuing them now processes the files added
+	// while it was paused without waiting for the next change in the
+	// folder.
+	if !paused && wc.ChannelID != "" {
+		err = cfg.queueNotification(ctx, wc, types.NOTIFICATION_KIND_CHANGES)
+		if err != nil {
+			slog.Error(
+				"Failed to queue the changes of the resumed channel",
+				"folderID",
+				folderID,
+				"channelID",
+				wc.ChannelID,
+				"error",
+				err,
+			)
+		}
+	}
+
+	return jsonResponse(summarize(wc, nil, time.Now().UTC()), http.StatusOK)
+}
+
+// Queue a baseline notification for the channel, so every file in its
+// folder is processed like the files found when it was registered. It finds
+// the files that were missed while the channel was broken or its changes
+// token was lost. Files that were already processed are skipped.
+func (cfg *handlerConfig) backfill(
+	ctx context.Context,
+	folderID string,
+) (events.APIGatewayProxyResponse, error) {
+	wc, err := cfg.store.GetWatchChannel(ctx, folderID)
+	if err != nil {
+		return errorResponse(err, http.StatusInternalServerError)
+	}
+
+	if wc.FolderID == "" {
+		return errorResponse(database.ErrWatchChannelNotFound, http.StatusNotFound)
+	}
+
+	// the SQS handler drops the notifications of a paused channel
+	if wc.Paused {
+		return util.BuildGatewayErrorResponse(
+			CODE_CHANNEL_PAUSED,
+			"the folder is paused, resume it before it is backfilled",
+			http.StatusConflict,
+		)
+	}
+
+	if wc.ChannelID == "" {
+		return util.BuildGatewayErrorResponse(
+			CODE_INVALID_REQUEST,
+			"the folder has no channel yet",
+			http.StatusConflict,
+		)
+	}
+
+	err = cfg.queueNotification(ctx, wc, types.NOTIFICATION_KIND_BASELINE)
+	if err != nil {
+		slog.Error(
+			"Failed to queue the backfill of the channel",
+			"folderID",
+			folderID,
+			"channelID",
+			wc.ChannelID,
+			"error",
+			err,
+		)
+		return errorResponse(err, http.StatusInternalServerError)
+	}
+
+	slog.Info("Queued the backfill of the folder", "folderID", folderID, "channelID", wc.ChannelID)
+
+	return jsonResponse(summarize(wc, nil, time.Now().UTC()), http.StatusAccepted)
+}
+
+func process(
+	ctx context.Context,
+	request events.APIGatewayProxyRequest,
+) (events.APIGatewayProxyResponse, error) {
+	slog.Debug(">>process")
+	defer slog.Debug("<<process")
+
+	if err := initLambda(ctx); err != nil {
+		slog.Error("Failed to initialize the lambda", "error", err)
+		return errorResponse(err, http.StatusInternalServerError)
+	}
+
+	switch {
+	case request.Resource == RESOURCE_CHANNELS && request.HTTPMethod == http.MethodGet:
+		return cfg.listChannels(ctx)
+
+	case request.Resource == RESOURCE_CHANNELS && request.HTTPMethod == http.MethodPost:
+		return cfg.addChannel(ctx, request)
+
+	case request.Resource == RESOURCE_CHANNEL && request.HTTPMethod == http.MethodDelete:
+		return cfg.removeChannel(ctx, request.PathParameters["folderID"])
+
+	case request.Resource == RESOURCE_PAUSE && request.HTTPMethod == http.MethodPost:
+		return cfg.setPaused(ctx, request.PathParameters["folderID"], true)
+
+	case request.Resource == RESOURCE_RESUME && request.HTTPMethod == http.MethodPost:
+		return cfg.setPaused(ctx, request.PathParameters["folderID"], false)
+
+	case request.Resource == RESOURCE_BACKFILL && request.HTTPMethod == http.MethodPost:
+		return cfg.backfill(ctx, request.PathParameters["folderID"])
+	}
+
+	return util.BuildGatewayErrorResponse(
+		CODE_NOT_FOUND,
+		fmt.Sprintf("no route for %s %s", request.HTTPMethod, request.Resource),
+		http.StatusNotFound,
+	)
+}
+
+func main() {
+	slog.Debug(">>main")
+	defer slog.Debug("<<main")
+
+	lambda.Start(process)
+}
@@ -0,0 +1,651 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/KyleBrandon/scriptor/lambdas/util"
+	"github.com/KyleBrandon/scriptor/pkg/database"
+	"github.com/KyleBrandon/scriptor/pkg/errorsmap"
+	"github.com/KyleBrandon/scriptor/pkg/google"
+	"github.com/KyleBrandon/scriptor/pkg/retry"
+	"github.com/KyleBrandon/scriptor/pkg/types"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"google.golang.org/api/googleapi"
+)
+
+// The watch channels keyed by folder, and their locks keyed by channel
+type fakeStore struct {
+	database.WatchChannelStore
+	channels map[string]*types.WatchChannel
+	locks    map[string]*types.WatchChannelLock
+}
+
+func (s *fakeStore) GetWatchChannels(ctx context.Context) ([]*types.WatchChannel, error) {
+	wcs := make([]*types.WatchChannel, 0, len(s.channels))
+	for _, folderID := range slices.Sorted(maps.Keys(s.channels)) {
+		wcs = append(wcs, s.channels[folderID])
+	}
+
+	return wcs, nil
+}
+
+func (s *fakeStore) GetWatchChannel(ctx context.Context, folderID string) (*types.WatchChannel, error) {
+	if wc, ok := s.channels[folderID]; ok {
+		return wc, nil
+	}
+
+	return &types.WatchChannel{}, nil
+}
+
+func (s *fakeStore) InsertWatchChannel(ctx context.Context, wc *types.WatchChannel) error {
+	if _, ok := s.channels[wc.FolderID]; ok {
+		return database.ErrWatchChannelExists
+	}
+
+	copied := *wc
+	s.channels[wc.FolderID] = &copied
+	return nil
+}
+
+func (s *fakeStore) UpdateWatchChannel(ctx context.Context, wc *types.WatchChannel) error {
+	copied := *wc
+	s.channels[wc.FolderID] = &copied
+	return nil
+}
+
+func (s *fakeStore) DeleteWatchChannel(ctx context.Context, folderID string) error {
+	if _, ok := s.channels[folderID]; !ok {
+		return database.ErrWatchChannelNotFound
+	}
+
+	delete(s.channels, folderID)
+	return nil
+}
+
+func (s *fakeStore) SetWatchChannelPaused(ctx context.Context, folderID string, paused bool) error {
+	wc, ok := s.channels[folderID]
+	if !ok {
+		return database.ErrWatchChannelNotFound
+	}
+
+	wc.Paused = paused
+	return nil
+}
+
+func (s *fakeStore) ListWatchChannelLocks(ctx context.Context) ([]*types.WatchChannelLock, error) {
+	locks := make([]*types.WatchChannelLock, 0, len(s.locks))
+	for _, lock := range s.locks {
+		locks = append(locks, lock)
+	}
+
+	return locks, nil
+}
+
+func (s *fakeStore) CreateWatchChannelLock(ctx context.Context, channelID, startToken string) error {
+	s.locks[channelID] = &types.WatchChannelLock{ChannelID: channelID, ChangesStartToken: startToken}
+	return nil
+}
+
+func (s *fakeStore) DeleteWatchChannelLock(ctx context.Context, channelID string) error {
+	delete(s.locks, channelID)
+	return nil
+}
+
+// The folders in Drive, and the channels created and stopped. The channels
+// in stopErrs fail to stop every time they are tried.
+type fakeDrive struct {
+	folders   map[string]bool
+	createErr error
+	stopErrs  map[string]error
+	watched   []string
+	stopped   []string
+}
+
+func (d *fakeDrive) ValidateWatchChannelFolders(ctx context.Context, wc *types.WatchChannel) error {
+	folders := append([]string{wc.FolderID, wc.ArchiveFolderID}, wc.Destinations()...)
+	for _, id := range folders {
+		if id != "" && !d.folders[id] {
+			return fmt.Errorf("%w: %s", google.ErrFolderNotFound, id)
+		}
+	}
+
+	return nil
+}
+
+func (d *fakeDrive) ValidateFolderLocations(
+	ctx context.Context,
+	wc *types.WatchChannel,
+	recursive bool,
+) error {
+	if slices.Contains(wc.Destinations(), wc.FolderID) || wc.ArchiveFolderID == wc.FolderID {
+		return google.ErrFolderLoop
+	}
+
+	return nil
+}
+
+func (d *fakeDrive) CreateWatchChannel(ctx context.Context, wc *types.WatchChannel) (string, error) {
+	if d.createErr != nil {
+		return "", d.createErr
+	}
+
+	d.watched = append(d.watched, wc.FolderID)
+	return "resource-" + wc.FolderID, nil
+}
+
+func (d *fakeDrive) StopWatchChannel(ctx context.Context, channelID, resourceID string) error {
+	d.stopped = append(d.stopped, channelID)
+	return d.stopErrs[channelID]
+}
+
+func (d *fakeDrive) GetChangesStartToken(ctx context.Context, driveID string) (string, error) {
+	return "start-new", nil
+}
+
+type fakeSender struct {
+	messages []types.ChannelNotification
+}
+
+func (s *fakeSender) SendMessage(
+	ctx context.Context,
+	params *sqs.SendMessageInput,
+	optFns ...func(*sqs.Options),
+) (*sqs.SendMessageOutput, error) {
+	var message types.ChannelNotification
+	if err := json.Unmarshal([]byte(*params.MessageBody), &message); err != nil {
+		return nil, err
+	}
+
+	s.messages = append(s.messages, message)
+	return &sqs.SendMessageOutput{}, nil
+}
+
+func newFakes() (*fakeStore, *fakeDrive) {
+	store := &fakeStore{
+		channels: map[string]*types.WatchChannel{},
+		locks:    map[string]*types.WatchChannelLock{},
+	}
+	drive := &fakeDrive{
+		folders: map[string]bool{"folder-1": true, "archive-1": true, "dest-1": true},
+	}
+
+	return store, drive
+}
+
+// The error code of the response, empty when it isn't an error
+func responseCode(t *testing.T, response events.APIGatewayProxyResponse) string {
+	t.Helper()
+
+	var body struct {
+		Code string `json:"code"`
+	}
+	json.Unmarshal([]byte(response.Body), &body)
+
+	return body.Code
+}
+
+func TestProcessAddsChannels(t *testing.T) {
+	// skip loading the configuration
+	initOnce.Do(func() {})
+
+	unavailable := &googleapi.Error{Code: http.StatusServiceUnavailable}
+
+	tests := []struct {
+		name      string
+		body      string
+		existing  bool
+		createErr error
+
+		wantStatus  int
+		wantCode    string
+		wantChannel bool
+	}{
+		{
+			name:        "new folder",
+			body:        `{"folder_id": "folder-1", "drive_id": "drive-1", "archive_folder_id": "archive-1", "destination_folder_ids": ["dest-1"], "publish_google_doc": true}`,
+			wantStatus:  http.StatusCreated,
+			wantChannel: true,
+		},
+		{
+			name:       "not JSON",
+			body:       `folder-1`,
+			wantStatus: http.StatusBadRequest,
+			wantCode:   CODE_INVALID_REQUEST,
+		},
+		{
+			name:       "no folder",
+			body:       `{"archive_folder_id": "archive-1"}`,
+			wantStatus: http.StatusBadRequest,
+			wantCode:   CODE_INVALID_REQUEST,
+		},
+		{
+			name:       "unknown archive mode",
+			body:       `{"folder_id": "folder-1", "archive_mode": "shred"}`,
+			wantStatus: http.StatusBadRequest,
+			wantCode:   CODE_INVALID_REQUEST,
+		},
+		{
+			name:       "destination is the watch folder",
+			body:       `{"folder_id": "folder-1", "destination_folder_ids": ["folder-1"]}`,
+			wantStatus: http.StatusBadRequest,
+			wantCode:   errorsmap.CODE_FOLDER_LOOP,
+		},
+		{
+			name:       "folder not in Drive",
+			body:       `{"folder_id": "folder-1", "destination_folder_ids": ["dest-missing"]}`,
+			wantStatus: http.StatusBadRequest,
+			wantCode:   errorsmap.CODE_FOLDER_NOT_FOUND,
+		},
+		{
+			name:        "folder already watched",
+			body:        `{"folder_id": "folder-1"}`,
+			existing:    true,
+			wantStatus:  http.StatusConflict,
+			wantCode:    errorsmap.CODE_WATCH_CHANNEL_EXISTS,
+			wantChannel: true,
+		},
+		{
+			// the channel is removed again so the folder can be added later
+			name:       "Drive fails to create the channel",
+			body:       `{"folder_id": "folder-1"}`,
+			createErr:  unavailable,
+			wantStatus: http.StatusBadGateway,
+			wantCode:   errorsmap.CODE_DRIVE_UNAVAILABLE,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			store, drive := newFakes()
+			drive.createErr = tc.createErr
+			if tc.existing {
+				store.channels["folder-1"] = &types.WatchChannel{FolderID: "folder-1", ChannelID: "channel-old"}
+			}
+			cfg = &handlerConfig{store: store, dc: drive}
+
+			response, err := process(context.Background(), events.APIGatewayProxyRequest{
+				Resource:   RESOURCE_CHANNELS,
+				HTTPMethod: http.MethodPost,
+				Body:       tc.body,
+				RequestContext: events.APIGatewayProxyRequestContext{
+					DomainName: "api.example.com",
+					Stage:      "prod",
+				},
+			})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if response.StatusCode != tc.wantStatus || responseCode(t, response) != tc.wantCode {
+				t.Fatalf("unexpected response: %d %s", response.StatusCode, response.Body)
+			}
+
+			wc, ok := store.channels["folder-1"]
+			if ok != tc.wantChannel {
+				t.Fatalf("unexpected channels: %v", store.channels)
+			}
+
+			if tc.wantStatus != http.StatusCreated {
+				return
+			}
+
+			// the channel is registered right away, and the webhook is on
+			// the same API
+			if !slices.Equal(drive.watched, []string{"folder-1"}) {
+				t.Fatalf("unexpected folders watched: %v", drive.watched)
+			}
+
+			if wc.ChannelID == "" || wc.ResourceID != "resource-folder-1" || wc.Token == "" ||
+				wc.WebhookUrl != "https://api.example.com/prod/webhook/google-drive" ||
+				wc.DestinationFolderID != "dest-1" || !wc.PublishGoogleDoc || wc.DriveID != "drive-1" {
+				t.Fatalf("unexpected channel: %+v", wc)
+			}
+
+			expiresIn := time.Until(time.UnixMilli(wc.ExpiresAt))
+			if expiresIn < util.WATCH_CHANNEL_LIFETIME-time.Minute {
+				t.Fatalf("unexpected expiry: %v", expiresIn)
+			}
+
+			if store.locks[wc.ChannelID] == nil || store.locks[wc.ChannelID].ChangesStartToken != "start-new" {
+				t.Fatalf("unexpected locks: %v", store.locks)
+			}
+
+			var summary channelSummary
+			if err := json.Unmarshal([]byte(response.Body), &summary); err != nil {
+				t.Fatalf("unexpected body: %s", response.Body)
+			}
+			if summary.ChannelID != wc.ChannelID || summary.Expired {
+				t.Fatalf("unexpected summary: %+v", summary)
+			}
+		})
+	}
+}
+
+func TestProcessListsChannels(t *testing.T) {
+	// skip loading the configuration
+	initOnce.Do(func() {})
+
+	now := time.Now().UTC()
+
+	store, drive := newFakes()
+	store.channels["folder-1"] = &types.WatchChannel{
+		FolderID:            "folder-1",
+		DestinationFolderID: "dest-1",
+		ChannelID:           "channel-1",
+		ExpiresAt:           now.Add(time.Hour).UnixMilli(),
+		PendingStops:        []types.PendingStop{{ChannelID: "channel-older"}},
+	}
+	store.channels["folder-2"] = &types.WatchChannel{
+		FolderID:  "folder-2",
+		ChannelID: "channel-2",
+		ExpiresAt: now.Add(-time.Hour).UnixMilli(),
+	}
+	store.locks["channel-1"] = &types.WatchChannelLock{ChannelID: "channel-1", UpdatedAt: "2026-10-17 08:00:00 +0000 UTC"}
+	cfg = &handlerConfig{store: store, dc: drive}
+
+	response, err := process(context.Background(), events.APIGatewayProxyRequest{
+		Resource:   RESOURCE_CHANNELS,
+		HTTPMethod: http.MethodGet,
+	})
+	if err != nil || response.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected response: %d %s %v", response.StatusCode, response.Body, err)
+	}
+
+	var list listChannelsResponse
+	if err := json.Unmarshal([]byte(response.Body), &list); err != nil {
+		t.Fatalf("unexpected body: %s", response.Body)
+	}
+
+	if len(list.Channels) != 2 {
+		t.Fatalf("unexpected channels: %+v", list.Channels)
+	}
+
+	first, second := list.Channels[0], list.Channels[1]
+	if first.FolderID != "folder-1" || first.Expired || first.PendingStops != 1 ||
+		first.LastNotificationAt != "2026-10-17T08:00:00Z" ||
+		!slices.Equal(first.DestinationFolderIDs, []string{"dest-1"}) {
+		t.Fatalf("unexpected channel: %+v", first)
+	}
+
+	if second.FolderID != "folder-2" || !second.Expired || second.LastNotificationAt != "" {
+		t.Fatalf("unexpected channel: %+v", second)
+	}
+}
+
+func TestProcessRemovesChannels(t *testing.T) {
+	// skip loading the configuration
+	initOnce.Do(func() {})
+
+	// retry without waiting
+	defer func(policy retry.Policy) { stopRetryPolicy = policy }(stopRetryPolicy)
+	stopRetryPolicy.InitialBackoff = time.Millisecond
+	stopRetryPolicy.MaxBackoff = time.Millisecond
+
+	forbidden := &googleapi.Error{Code: http.StatusForbidden}
+
+	tests := []struct {
+		name     string
+		folderID string
+		stopErrs map[string]error
+
+		wantStatus  int
+		wantStopped []string
+		wantRemoved bool
+	}{
+		{
+			name:        "watched folder",
+			folderID:    "folder-1",
+			wantStatus:  http.StatusNoContent,
+			wantStopped: []string{"channel-1", "channel-older"},
+			wantRemoved: true,
+		},
+		{
+			// the earlier channel stops when it expires
+			name:        "earlier channel fails to stop",
+			folderID:    "folder-1",
+			stopErrs:    map[string]error{"channel-older": forbidden},
+			wantStatus:  http.StatusNoContent,
+			wantStopped: []string{"channel-1", "channel-older"},
+			wantRemoved: true,
+		},
+		{
+			// kept so the request can be sent again
+			name:        "channel fails to stop",
+			folderID:    "folder-1",
+			stopErrs:    map[string]error{"channel-1": forbidden},
+			wantStatus:  http.StatusBadGateway,
+			wantStopped: []string{"channel-1"},
+		},
+		{
+			name:       "folder not watched",
+			folderID:   "folder-2",
+			wantStatus: http.StatusNotFound,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			store, drive := newFakes()
+			drive.stopErrs = tc.stopErrs
+			store.channels["folder-1"] = &types.WatchChannel{
+				FolderID:   "folder-1",
+				ChannelID:  "channel-1",
+				ResourceID: "resource-1",
+				PendingStops: []types.PendingStop{
+					{ChannelID: "channel-older", ResourceID: "resource-older"},
+				},
+			}
+			store.locks["channel-1"] = &types.WatchChannelLock{ChannelID: "channel-1"}
+			cfg = &handlerConfig{store: store, dc: drive}
+
+			response, err := process(context.Background(), events.APIGatewayProxyRequest{
+				Resource:       RESOURCE_CHANNEL,
+				HTTPMethod:     http.MethodDelete,
+				PathParameters: map[string]string{"folderID": tc.folderID},
+			})
+			if err != nil || response.StatusCode != tc.wantStatus {
+				t.Fatalf("unexpected response: %d %s %v", response.StatusCode, response.Body, err)
+			}
+
+			if !slices.Equal(drive.stopped, tc.wantStopped) {
+				t.Fatalf("unexpected channels stopped: %v", drive.stopped)
+			}
+
+			_, kept := store.channels["folder-1"]
+			_, lockKept := store.locks["channel-1"]
+			if kept == tc.wantRemoved || lockKept == tc.wantRemoved {
+				t.Fatalf("unexpected rows: channels %v locks %v", store.channels, store.locks)
+			}
+		})
+	}
+}
+
+func TestProcessUnknownRoute(t *testing.T) {
+	// skip loading the configuration
+	initOnce.Do(func() {})
+
+	store, drive := newFakes()
+	cfg = &handlerConfig{store: store, dc: drive}
+
+	response, err := process(context.Background(), events.APIGatewayProxyRequest{
+		Resource:   RESOURCE_CHANNEL,
+		HTTPMethod: http.MethodGet,
+	})
+	if err != nil || response.StatusCode != http.StatusNotFound || responseCode(t, response) != CODE_NOT_FOUND {
+		t.Fatalf("unexpected response: %d %s %v", response.StatusCode, response.Body, err)
+	}
+}
+
+func TestProcessPausesChannels(t *testing.T) {
+	// skip loading the configuration
+	initOnce.Do(func() {})
+
+	tests := []struct {
+		name     string
+		resource string
+		folderID string
+		paused   bool
+
+		wantStatus int
+		wantPaused bool
+		wantQueued bool
+	}{
+		{
+			name:       "pause",
+			resource:   RESOURCE_PAUSE,
+			folderID:   "folder-1",
+			wantStatus: http.StatusOK,
+			wantPaused: true,
+		},
+		{
+			// the changes made while it was paused are queried right away
+			name:       "resume",
+			resource:   RESOURCE_RESUME,
+			folderID:   "folder-1",
+			paused:     true,
+			wantStatus: http.StatusOK,
+			wantQueued: true,
+		},
+		{
+			name:       "folder not watched",
+			resource:   RESOURCE_PAUSE,
+			folderID:   "folder-2",
+			wantStatus: http.StatusNotFound,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			store, drive := newFakes()
+			store.channels["folder-1"] = &types.WatchChannel{
+				FolderID:  "folder-1",
+				ChannelID: "channel-1",
+				DriveID:   "drive-1",
+				Paused:    tc.paused,
+			}
+			sender := &fakeSender{}
+			cfg = &handlerConfig{store: store, dc: drive, sqsClient: sender, queueURL: "queue"}
+
+			response, err := process(context.Background(), events.APIGatewayProxyRequest{
+				Resource:       tc.resource,
+				HTTPMethod:     http.MethodPost,
+				PathParameters: map[string]string{"folderID": tc.folderID},
+			})
+			if err != nil || response.StatusCode != tc.wantStatus {
+				t.Fatalf("unexpected response: %d %s %v", response.StatusCode, response.Body, err)
+			}
+
+			// the channel itself keeps running
+			if store.channels["folder-1"].Paused != tc.wantPaused || len(drive.stopped) != 0 {
+				t.Fatalf("unexpected channel: %+v stopped %v", store.channels["folder-1"], drive.stopped)
+			}
+
+			if !tc.wantQueued {
+				if len(sender.messages) != 0 {
+					t.Fatalf("unexpected messages: %+v", sender.messages)
+				}
+				return
+			}
+
+			if len(sender.messages) != 1 || sender.messages[0].ChannelID != "channel-1" ||
+				sender.messages[0].FolderID != "folder-1" || sender.messages[0].DriveID != "drive-1" ||
+				sender.messages[0].Kind != types.NOTIFICATION_KIND_CHANGES ||
+				sender.messages[0].NotificationID == "" {
+				t.Fatalf("unexpected messages: %+v", sender.messages)
+			}
+		})
+	}
+}
+
+func TestProcessBackfillsChannels(t *testing.T) {
+	// skip loading the configuration
+	initOnce.Do(func() {})
+
+	tests := []struct {
+		name      string
+		folderID  string
+		paused    bool
+		channelID string
+
+		wantStatus int
+		wantCode   string
+		wantQueued bool
+	}{
+		{
+			name:       "backfill",
+			folderID:   "folder-1",
+			channelID:  "channel-1",
+			wantStatus: http.StatusAccepted,
+			wantQueued: true,
+		},
+		{
+			// the notification would be dropped
+			name:       "paused",
+			folderID:   "folder-1",
+			channelID:  "channel-1",
+			paused:     true,
+			wantStatus: http.StatusConflict,
+			wantCode:   CODE_CHANNEL_PAUSED,
+		},
+		{
+			name:       "no channel yet",
+			folderID:   "folder-1",
+			wantStatus: http.StatusConflict,
+			wantCode:   CODE_INVALID_REQUEST,
+		},
+		{
+			name:       "folder not watched",
+			folderID:   "folder-2",
+			channelID:  "channel-1",
+			wantStatus: http.StatusNotFound,
+			wantCode:   errorsmap.CODE_WATCH_CHANNEL_NOT_FOUND,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			store, drive := newFakes()
+			store.channels["folder-1"] = &types.WatchChannel{
+				FolderID:  "folder-1",
+				ChannelID: tc.channelID,
+				DriveID:   "drive-1",
+				Recursive: true,
+				Paused:    tc.paused,
+			}
+			sender := &fakeSender{}
+			cfg = &handlerConfig{store: store, dc: drive, sqsClient: sender, queueURL: "queue"}
+
+			response, err := process(context.Background(), events.APIGatewayProxyRequest{
+				Resource:       RESOURCE_BACKFILL,
+				HTTPMethod:     http.MethodPost,
+				PathParameters: map[string]string{"folderID": tc.folderID},
+			})
+			if err != nil || response.StatusCode != tc.wantStatus || responseCode(t, response) != tc.wantCode {
+				t.Fatalf("unexpected response: %d %s %v", response.StatusCode, response.Body, err)
+			}
+
+			if !tc.wantQueued {
+				if len(sender.messages) != 0 {
+					t.Fatalf("unexpected messages: %+v", sender.messages)
+				}
+				return
+			}
+
+			if len(sender.messages) != 1 || sender.messages[0].ChannelID != "channel-1" ||
+				sender.messages[0].FolderID != "folder-1" || sender.messages[0].DriveID != "drive-1" ||
+				!sender.messages[0].Recursive ||
+				sender.messages[0].Kind != types.NOTIFICATION_KIND_BASELINE ||
+				sender.messages[0].NotificationID == "" {
+				t.Fatalf("unexpected messages: %+v", sender.messages)
+			}
+		})
+	}
+}
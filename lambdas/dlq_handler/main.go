@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/KyleBrandon/scriptor/pkg/database"
+	"github.com/KyleBrandon/scriptor/pkg/types"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+)
+
+// SNS subjects are limited to 100 characters
+const ALERT_SUBJECT = "Scriptor notification moved to the dead-letter queue"
+
+type (
+	// The part of SNS used to alert that a notification failed
+	alertPublisher interface {
+		Publish(
+			ctx context.Context,
+			params *sns.PublishInput,
+			optFns ...func(*sns.Options),
+		) (*sns.PublishOutput, error)
+	}
+
+	handlerConfig struct {
+		store     database.FailedNotificationStore
+		snsClient alertPublisher
+		topicARN  string
+	}
+)
+
+var (
+	initOnce sync.Once
+	cfg      *handlerConfig
+)
+
+// Load all the inital configuration settings for the lambda
+func loadConfiguration(ctx context.Context) (*handlerConfig, error) {
+
+	cfg = &handlerConfig{}
+
+	var err error
+
+	cfg.store, err = database.NewFailedNotificationStore(ctx)
+	if err != nil {
+		slog.Error("Failed to configure the DynamoDB client", "error", err)
+		return nil, err
+	}
+
+	awsCfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		slog.Error("Failed to load the AWS config", "error", err)
+		return nil, err
+	}
+
+	cfg.topicARN = os.Getenv("ALERT_TOPIC_ARN")
+	if cfg.topicARN == "" {
+		slog.Error("Failed to get the alert topic ARN")
+		return nil, fmt.Errorf("ALERT_TOPIC_ARN is not set")
+	}
+
+	cfg.snsClient = sns.NewFromConfig(awsCfg)
+
+	return cfg, nil
+}
+
+// Ensure that the configuration settings are only loaded once
+func initLambda(ctx context.Context) error {
+	var err error
+	initOnce.Do(func() {
+		slog.Debug(">>initLambda")
+		defer slog.Debug("<<initLambda")
+
+		cfg, err = loadConfiguration(ctx)
+	})
+
+	return err
+}
+
+// SQS reports its timestamps as milliseconds since the epoch. Missing or
+// malformed timestamps are left zero.
+func parseTimestamp(value string) time.Time {
+	millis, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+
+	return time.UnixMilli(millis).UTC()
+}
+
+// Build the record of a message from the dead-letter queue. A body that
+// isn't a channel notification is still recorded, with the reason it
+// couldn't be read, so it can be looked at and sent back.
+func failedNotification(
+	message events.SQSMessage,
+	failedAt time.Time,
+) *types.FailedNotification {
+	failed := &types.FailedNotification{
+		MessageID:       message.MessageId,
+		Body:            message.Body,
+		SentAt:          parseTimestamp(message.Attributes["SentTimestamp"]),
+		FirstReceivedAt: parseTimestamp(message.Attributes["ApproximateFirstReceiveTimestamp"]),
+		SourceQueueARN:  message.Attributes["DeadLetterQueueSourceArn"],
+		FailedAt:        failedAt,
+	}
+
+	failed.ReceiveCount, _ = strconv.Atoi(message.Attributes["ApproximateReceiveCount"])
+
+	for name, attribute := range message.MessageAttributes {
+		if attribute.StringValue == nil {
+			continue
+		}
+
+		if failed.Attributes == nil {
+			failed.Attributes = make(map[string]string)
+		}
+		failed.Attributes[name] = *attribute.StringValue
+	}
+
+	var notification types.ChannelNotification
+	if err := json.Unmarshal([]byte(message.Body), &notification); err != nil {
+		failed.ParseError = err.Error()
+		return failed
+	}
+
+	failed.NotificationID = notification.NotificationID
+	failed.ChannelID = notification.ChannelID
+	failed.FolderID = notification.FolderID
+	failed.DocumentID = notification.DocumentID
+
+	return failed
+}
+
+// The alert sent for a failed notification, with what is needed to find it
+// and send it back to the main queue.
+func alertMessage(failed *types.FailedNotification) string {
+	var b strings.Builder
+
+	fmt.Fprintf(
+		&b,
+		"A notification failed %d times and was moved to the dead-letter queue.\n\n",
+		failed.ReceiveCount,
+	)
+	fmt.Fprintf(&b, "Message ID: %s\n", failed.MessageID)
+
+	if failed.ParseError != "" {
+		fmt.Fprintf(&b, "The message is not a channel notification: %s\n", failed.ParseError)
+	} else {
+		fmt.Fprintf(&b, "Channel: %s\n", failed.ChannelID)
+		fmt.Fprintf(&b, "Folder: %s\n", failed.FolderID)
+		if failed.DocumentID != "" {
+			fmt.Fprintf(&b, "Document: %s\n", failed.DocumentID)
+		}
+	}
+
+	if !failed.SentAt.IsZero() {
+		fmt.Fprintf(&b, "First queued: %s\n", failed.SentAt.Format(time.RFC3339))
+	}
+	fmt.Fprintf(&b, "Failed: %s\n", failed.FailedAt.Format(time.RFC3339))
+
+	fmt.Fprintf(
+		&b,
+		"\nTo try it again, POST {\"message_ids\": [%q]} to /notifications/redrive.\n",
+		failed.MessageID,
+	)
+
+	return b.String()
+}
+
+// Record the notification and alert that it failed. A message delivered
+// again is only alerted on when the earlier delivery didn't get to send the
+// alert.
+func (cfg *handlerConfig) recordFailure(
+	ctx context.Context,
+	message events.SQSMessage,
+) error {
+	failed := failedNotification(message, time.Now().UTC())
+
+	slog.Warn(
+		"Notification moved to the dead-letter queue",
+		"messageID",
+		failed.MessageID,
+		"channelID",
+		failed.ChannelID,
+		"folderID",
+		failed.FolderID,
+		"receiveCount",
+		failed.ReceiveCount,
+	)
+
+	err := cfg.store.InsertFailedNotification(ctx, failed)
+	if errors.Is(err, database.ErrFailedNotificationExists) {
+		failed, err = cfg.store.GetFailedNotification(ctx, message.MessageId)
+	}
+	if err != nil {
+		slog.Error(
+			"Failed to record the failed notification",
+			"messageID",
+			message.MessageId,
+			"error",
+			err,
+		)
+		return err
+	}
+
+	if !failed.AlertedAt.IsZero() {
+		slog.Info(
+			"Failed notification was already alerted on",
+			"messageID",
+			failed.MessageID,
+			"alertedAt",
+			failed.AlertedAt,
+		)
+		return nil
+	}
+
+	_, err = cfg.snsClient.Publish(ctx, &sns.PublishInput{
+		TopicArn: aws.String(cfg.topicARN),
+		Subject:  aws.String(ALERT_SUBJECT),
+		Message:  aws.String(alertMessage(failed)),
+	})
+	if err != nil {
+		slog.Error(
+			"Failed to publish the alert for the failed notification",
+			"messageID",
+			failed.MessageID,
+			"error",
+			err,
+		)
+		return err
+	}
+
+	failed.AlertedAt = time.Now().UTC()
+
+	return cfg.store.UpdateFailedNotification(ctx, failed)
+}
+
+func process(ctx context.Context, sqsEvent events.SQSEvent) (events.SQSEventResponse, error) {
+	slog.Debug(">>process")
+	defer slog.Debug("<<process")
+
+	response := events.SQSEventResponse{
+		BatchItemFailures: make([]events.SQSBatchItemFailure, 0),
+	}
+
+	if err := initLambda(ctx); err != nil {
+		slog.Error("Failed to initialize the lambda", "error", err)
+		return response, err
+	}
+
+	for _, message := range sqsEvent.Records {
+		if err := cfg.recordFailure(ctx, message); err != nil {
+			response.BatchItemFailures = append(
+				response.BatchItemFailures,
+				events.SQSBatchItemFailure{ItemIdentifier: message.MessageId},
+			)
+		}
+	}
+
+	return response, nil
+}
+
+func main() {
+	slog.Debug(">>main")
+	defer slog.Debug("<<main")
+
+	lambda.Start(process)
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+
+	"github.com/KyleBrandon/scriptor/pkg/database"
+	"github.com/KyleBrandon/scriptor/pkg/types"
+)
+
+func TestFailedNotification(t *testing.T) {
+	failedAt := time.Date(2026, 3, 12, 9, 0, 0, 0, time.UTC)
+	sentAt := time.Date(2026, 3, 12, 8, 0, 0, 0, time.UTC)
+
+	attributes := map[string]string{
+		"SentTimestamp":                    "1773302400000",
+		"ApproximateFirstReceiveTimestamp": "1773302401000",
+		"ApproximateReceiveCount":          "6",
+		"DeadLetterQueueSourceArn":         "arn:aws:sqs:us-east-1:123456789012:ScriptorDocumentQueue",
+	}
+
+	tests := []struct {
+		name    string
+		message events.SQSMessage
+		want    *types.FailedNotification
+	}{
+		{
+			name: "channel notification",
+			message: events.SQSMessage{
+				MessageId:  "message-1",
+				Body:       `{"notification_id":"n-1","channel_id":"channel-1","folder_id":"folder-1"}`,
+				Attributes: attributes,
+				MessageAttributes: map[string]events.SQSMessageAttribute{
+					"source":  {StringValue: aws.String("webhook"), DataType: "String"},
+					"payload": {BinaryValue: []byte{1}, DataType: "Binary"},
+				},
+			},
+			want: &types.FailedNotification{
+				MessageID:       "message-1",
+				NotificationID:  "n-1",
+				ChannelID:       "channel-1",
+				FolderID:        "folder-1",
+				Body:            `{"notification_id":"n-1","channel_id":"channel-1","folder_id":"folder-1"}`,
+				SentAt:          sentAt,
+				FirstReceivedAt: sentAt.Add(time.Second),
+				ReceiveCount:    6,
+				SourceQueueARN:  "arn:aws:sqs:us-east-1:123456789012:ScriptorDocumentQueue",
+				Attributes:      map[string]string{"source": "webhook"},
+				FailedAt:        failedAt,
+			},
+		},
+		{
+			name: "deferred start",
+			message: events.SQSMessage{
+				MessageId: "message-2",
+				Body:      `{"channel_id":"channel-1","folder_id":"folder-1","document_id":"doc-1"}`,
+			},
+			want: &types.FailedNotification{
+				MessageID:  "message-2",
+				ChannelID:  "channel-1",
+				FolderID:   "folder-1",
+				DocumentID: "doc-1",
+				Body:       `{"channel_id":"channel-1","folder_id":"folder-1","document_id":"doc-1"}`,
+				FailedAt:   failedAt,
+			},
+		},
+		{
+			name: "not a notification",
+			message: events.SQSMessage{
+				MessageId: "message-3",
+				Body:      "not json",
+			},
+			want: &types.FailedNotification{
+				MessageID:  "message-3",
+				Body:       "not json",
+				ParseError: "invalid character 'o' in literal null (expecting 'u')",
+				FailedAt:   failedAt,
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got := failedNotification(tc.message, failedAt)
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("unexpected record:\ngot  %+v\nwant %+v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestAlertMessage(t *testing.T) {
+	failed := &types.FailedNotification{
+		MessageID:    "message-1",
+		ChannelID:    "channel-1",
+		FolderID:     "folder-1",
+		ReceiveCount: 6,
+		SentAt:       time.Date(2026, 3, 12, 8, 0, 0, 0, time.UTC),
+		FailedAt:     time.Date(2026, 3, 12, 9, 0, 0, 0, time.UTC),
+	}
+
+	want := `A notification failed 6 times and was moved to the dead-letter queue.
+
+Message ID: message-1
+Channel: channel-1
+Folder: folder-1
+First queued: 2026-03-12T08:00:00Z
+Failed: 2026-03-12T09:00:00Z
+
+To try it again, POST {"message_ids": ["message-1"]} to /notifications/redrive.
+`
+	if got := alertMessage(failed); got != want {
+		t.Fatalf("unexpected message:\ngot  %q\nwant %q", got, want)
+	}
+}
+
+type fakeStore struct {
+	database.FailedNotificationStore
+	records map[string]*types.FailedNotification
+}
+
+func (s *fakeStore) InsertFailedNotification(
+	ctx context.Context,
+	notification *types.FailedNotification,
+) error {
+	if _, ok := s.records[notification.MessageID]; ok {
+		return database.ErrFailedNotificationExists
+	}
+
+	s.records[notification.MessageID] = notification
+	return nil
+}
+
+func (s *fakeStore) GetFailedNotification(
+	ctx context.Context,
+	messageID string,
+) (*types.FailedNotification, error) {
+	if record, ok := s.records[messageID]; ok {
+		return record, nil
+	}
+
+	return &types.FailedNotification{}, nil
+}
+
+func (s *fakeStore) UpdateFailedNotification(
+	ctx context.Context,
+	notification *types.FailedNotification,
+) error {
+	s.records[notification.MessageID] = notification
+	return nil
+}
+
+type fakePublisher struct {
+	messages []string
+	err      error
+}
+
+func (p *fakePublisher) Publish(
+	ctx context.Context,
+	params *sns.PublishInput,
+	optFns ...func(*sns.Options),
+) (*sns.PublishOutput, error) {
+	if p.err != nil {
+		return nil, p.err
+	}
+
+	p.messages = append(p.messages, *params.Message)
+	return &sns.PublishOutput{}, nil
+}
+
+func TestProcessRecordsAndAlerts(t *testing.T) {
+	// skip loading the AWS configuration
+	initOnce.Do(func() {})
+
+	message := events.SQSMessage{
+		MessageId: "message-1",
+		Body:      `{"channel_id":"channel-1","folder_id":"folder-1"}`,
+	}
+	failedAt := time.Date(2026, 3, 12, 9, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name       string
+		recorded   bool
+		alertedAt  time.Time
+		publishErr error
+
+		wantFailed  bool
+		wantAlerts  int
+		wantAlerted bool
+	}{
+		{
+			name:        "new failure",
+			wantAlerts:  1,
+			wantAlerted: true,
+		},
+		{
+			name:        "delivered again after the alert",
+			recorded:    true,
+			alertedAt:   failedAt,
+			wantAlerted: true,
+		},
+		{
+			name:        "delivered again before the alert",
+			recorded:    true,
+			wantAlerts:  1,
+			wantAlerted: true,
+		},
+		{
+			name:       "alert fails",
+			publishErr: errors.New("throttled"),
+			wantFailed: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			store := &fakeStore{records: map[string]*types.FailedNotification{}}
+			if tc.recorded {
+				recorded := failedNotification(message, failedAt)
+				recorded.AlertedAt = tc.alertedAt
+				store.records[recorded.MessageID] = recorded
+			}
+
+			publisher := &fakePublisher{err: tc.publishErr}
+			cfg = &handlerConfig{store: store, snsClient: publisher, topicARN: "topic"}
+
+			response, err := process(
+				context.Background(),
+				events.SQSEvent{Records: []events.SQSMessage{message}},
+			)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if failed := len(response.BatchItemFailures) == 1; failed != tc.wantFailed {
+				t.Fatalf("unexpected failures: %+v", response.BatchItemFailures)
+			}
+
+			if len(publisher.messages) != tc.wantAlerts {
+				t.Fatalf("unexpected alerts: %q", publisher.messages)
+			}
+			for _, alert := range publisher.messages {
+				if !strings.Contains(alert, "Channel: channel-1") {
+					t.Fatalf("unexpected alert: %q", alert)
+				}
+			}
+
+			record := store.records["message-1"]
+			if alerted := !record.AlertedAt.IsZero(); alerted != tc.wantAlerted {
+				t.Fatalf("unexpected alerted at: %v", record.AlertedAt)
+			}
+		})
+	}
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+
+	"github.com/KyleBrandon/scriptor/lambdas/util"
+	"github.com/KyleBrandon/scriptor/pkg/attest"
+	"github.com/KyleBrandon/scriptor/pkg/database"
+	"github.com/KyleBrandon/scriptor/pkg/types"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+type (
+	handlerConfig struct {
+		store    database.DocumentStore
+		s3Client objectReader
+	}
+
+	// The part of the S3 client used to read the artifacts
+	objectReader interface {
+		GetObject(
+			ctx context.Context,
+			params *s3.GetObjectInput,
+			optFns ...func(*s3.Options),
+		) (*s3.GetObjectOutput, error)
+	}
+
+	// The note from the vault can be sent to verify it as well. Without it
+	// the final link is checked against the published note the pipeline
+	// kept in the final prefix.
+	verifyRequest struct {
+		Note *string `json:"note"`
+	}
+
+	linkMismatch struct {
+		Stage    types.Stage `json:"stage"`
+		Expected string      `json:"expected"`
+		Actual   string      `json:"actual"`
+		Reason   string      `json:"reason"`
+	}
+
+	verifyResponse struct {
+		DocumentID string                  `json:"document_id"`
+		Verified   bool                    `json:"verified"`
+		Mismatch   *linkMismatch           `json:"mismatch,omitempty"`
+		Links      []types.AttestationLink `json:"links"`
+	}
+)
+
+var (
+	initOnce sync.Once
+	cfg      *handlerConfig
+)
+
+// Load all the inital configuration settings for the lambda
+func loadConfiguration(ctx context.Context) (*handlerConfig, error) {
+
+	cfg = &handlerConfig{}
+
+	var err error
+
+	cfg.store, err = database.NewDocumentStore(ctx)
+	if err != nil {
+		slog.Error("Failed to configure the DynamoDB client", "error", err)
+		return nil, err
+	}
+
+	awsCfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		slog.Error("Failed to load the AWS config", "error", err)
+		return nil, err
+	}
+
+	cfg.s3Client = s3.NewFromConfig(awsCfg)
+
+	return cfg, nil
+}
+
+// Ensure that the configuration settings are only loaded once
+func initLambda(ctx context.Context) error {
+	var err error
+	initOnce.Do(func() {
+		slog.Debug(">>initLambda")
+		defer slog.Debug("<<initLambda")
+
+		cfg, err = loadConfiguration(ctx)
+	})
+
+	return err
+}
+
+// Read the artifact a stage saved to S3
+func (cfg *handlerConfig) readStage(
+	ctx context.Context,
+	documentID string,
+	stageName types.Stage,
+) ([]byte, error) {
+	stage, err := cfg.store.GetDocumentStage(ctx, documentID, stageName)
+	if errors.Is(err, database.ErrStageNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return cfg.readObject(ctx, stage.S3Key)
+}
+
+// Read the object with the key, nil when there is no key
+func (cfg *handlerConfig) readObject(ctx context.Context, key string) ([]byte, error) {
+	if key == "" {
+		return nil, nil
+	}
+
+	resp, err := cfg.s3Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(types.S3_BUCKET_NAME),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	return io.ReadAll(resp.Body)
+}
+
+// Recompute the artifact hashes for the stages in the chain. The published
+// note is hashed from the note that was sent, or from the copy of the
+// published note kept in the final prefix.
+func (cfg *handlerConfig) recomputeArtifacts(
+	ctx context.Context,
+	document *types.Document,
+	note []byte,
+) ([]attest.Artifact, error) {
+	artifacts := make([]attest.Artifact, 0, len(document.Attestation))
+
+	for _, link := range document.Attestation {
+		if link.Stage == types.DOCUMENT_STAGE_UPLOAD {
+			if note == nil {
+				var err error
+				note, err = cfg.readObject(ctx, document.FinalS3Key)
+				if err != nil {
+					return nil, err
+				}
+			}
+
+			if note != nil {
+				artifacts = append(artifacts, attest.Artifact{
+					Stage: link.Stage,
+					Hash:  attest.NoteHash(note),
+				})
+			}
+			continue
+		}
+
+		content, err := cfg.readStage(ctx, document.ID, link.Stage)
+		if err != nil {
+			return nil, err
+		}
+
+		if content == nil {
+			continue
+		}
+
+		hash, err := attest.ArtifactHash(bytes.NewReader(content))
+		if err != nil {
+			return nil, err
+		}
+
+		artifacts = append(artifacts, attest.Artifact{
+			Stage: link.Stage,
+			Hash:  hash,
+		})
+	}
+
+	return artifacts, nil
+}
+
+// Compare the recomputed artifacts with the chain recorded for the document
+func buildVerification(
+	documentID string,
+	links []types.AttestationLink,
+	artifacts []attest.Artifact,
+) verifyResponse {
+	response := verifyResponse{
+		DocumentID: documentID,
+		Links:      links,
+	}
+
+	err := attest.VerifyChain(links, artifacts)
+	if err == nil {
+		response.Verified = true
+		return response
+	}
+
+	var linkErr *attest.LinkError
+	if errors.As(err, &linkErr) {
+		response.Mismatch = &linkMismatch{
+			Stage:    linkErr.Stage,
+			Expected: linkErr.Expected,
+			Actual:   linkErr.Actual,
+			Reason:   linkErr.Reason,
+		}
+	}
+
+	return response
+}
+
+func process(
+	ctx context.Context,
+	request events.APIGatewayProxyRequest,
+) (events.APIGatewayProxyResponse, error) {
+	slog.Debug(">>process")
+	defer slog.Debug("<<process")
+
+	if err := initLambda(ctx); err != nil {
+		slog.Error("Failed to initialize the lambda", "error", err)
+		return util.BuildGatewayResponse(
+			err.Error(),
+			http.StatusInternalServerError,
+		)
+	}
+
+	documentID := request.PathParameters["id"]
+	if documentID == "" {
+		return util.BuildGatewayResponse(
+			"missing document id",
+			http.StatusBadRequest,
+		)
+	}
+
+	var verify verifyRequest
+	if request.Body != "" {
+		if err := json.Unmarshal([]byte(request.Body), &verify); err != nil {
+			return util.BuildGatewayResponse(
+				"invalid request body",
+				http.StatusBadRequest,
+			)
+		}
+	}
+
+	document, err := cfg.store.GetDocument(ctx, documentID)
+	if errors.Is(err, database.ErrDocumentNotFound) {
+		return util.BuildGatewayResponse(
+			"document not found",
+			http.StatusNotFound,
+		)
+	}
+	if err != nil {
+		return util.BuildGatewayResponse(
+			err.Error(),
+			http.StatusInternalServerError,
+		)
+	}
+
+	var note []byte
+	if verify.Note != nil {
+		note = []byte(*verify.Note)
+	}
+
+	artifacts, err := cfg.recomputeArtifacts(ctx, document, note)
+	if err != nil {
+		slog.Error(
+			"Failed to recompute the artifact hashes",
+			"id",
+			document.ID,
+			"error",
+			err,
+		)
+		return util.BuildGatewayResponse(
+			err.Error(),
+			http.StatusInternalServerError,
+		)
+	}
+
+	response := buildVerification(document.ID, document.Attestation, artifacts)
+
+	body, err := json.Marshal(response)
+	if err != nil {
+		return util.BuildGatewayResponse(
+			err.Error(),
+			http.StatusInternalServerError,
+		)
+	}
+
+	return util.BuildGatewayResponse(string(body), http.StatusOK)
+}
+
+func main() {
+	slog.Debug(">>main")
+	defer slog.Debug("<<main")
+
+	lambda.Start(process)
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/KyleBrandon/scriptor/pkg/attest"
+	"github.com/KyleBrandon/scriptor/pkg/database"
+	"github.com/KyleBrandon/scriptor/pkg/types"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// A document table with one document and the stages it went through
+type fakeStore struct {
+	database.DocumentStore
+	document *types.Document
+	stages   map[types.Stage]*types.DocumentProcessingStage
+}
+
+func (s *fakeStore) GetDocument(ctx context.Context, id string) (*types.Document, error) {
+	if s.document.ID != id {
+		return nil, database.ErrDocumentNotFound
+	}
+
+	return s.document, nil
+}
+
+func (s *fakeStore) GetDocumentStage(
+	ctx context.Context,
+	id string,
+	stage types.Stage,
+) (*types.DocumentProcessingStage, error) {
+	docStage, ok := s.stages[stage]
+	if !ok {
+		return nil, database.ErrStageNotFound
+	}
+
+	return docStage, nil
+}
+
+// Serves the artifacts from memory
+type fakeS3 struct {
+	objects map[string]string
+}
+
+func (f *fakeS3) GetObject(
+	ctx context.Context,
+	params *s3.GetObjectInput,
+	optFns ...func(*s3.Options),
+) (*s3.GetObjectOutput, error) {
+	content, ok := f.objects[*params.Key]
+	if !ok {
+		return nil, fmt.Errorf("no such key: %s", *params.Key)
+	}
+
+	return &s3.GetObjectOutput{Body: io.NopCloser(strings.NewReader(content))}, nil
+}
+
+func TestBuildVerification(t *testing.T) {
+	artifacts := []attest.Artifact{
+		{Stage: types.DOCUMENT_STAGE_DOWNLOAD, Hash: "original"},
+		{Stage: types.DOCUMENT_STAGE_MATHPIX, Hash: "mathpix"},
+		{Stage: types.DOCUMENT_STAGE_OPENAI, Hash: "openai"},
+		{Stage: types.DOCUMENT_STAGE_UPLOAD, Hash: "final"},
+	}
+	links := attest.BuildChain(artifacts)
+
+	edited := append([]attest.Artifact{}, artifacts...)
+	edited[3].Hash = "edited"
+
+	tests := []struct {
+		name         string
+		links        []types.AttestationLink
+		artifacts    []attest.Artifact
+		wantVerified bool
+		wantStage    types.Stage
+		wantActual   string
+	}{
+		{
+			name:         "verified",
+			links:        links,
+			artifacts:    artifacts,
+			wantVerified: true,
+		},
+		{
+			name:       "note edited",
+			links:      links,
+			artifacts:  edited,
+			wantStage:  types.DOCUMENT_STAGE_UPLOAD,
+			wantActual: "edited",
+		},
+		{
+			name:      "not attested",
+			artifacts: artifacts,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got := buildVerification("doc-1", tc.links, tc.artifacts)
+
+			if got.Verified != tc.wantVerified {
+				t.Fatalf("unexpected verified: got %v want %v", got.Verified, tc.wantVerified)
+			}
+
+			if tc.wantVerified {
+				if got.Mismatch != nil {
+					t.Fatalf("unexpected mismatch: %+v", got.Mismatch)
+				}
+				return
+			}
+
+			if got.Mismatch == nil {
+				t.Fatalf("expected a mismatch")
+			}
+
+			if got.Mismatch.Stage != tc.wantStage {
+				t.Fatalf("unexpected stage: got %q want %q", got.Mismatch.Stage, tc.wantStage)
+			}
+
+			if got.Mismatch.Actual != tc.wantActual {
+				t.Fatalf("unexpected actual hash: got %q want %q", got.Mismatch.Actual, tc.wantActual)
+			}
+		})
+	}
+}
+
+// Without a note in the request, the note the pipeline published is checked
+func TestProcessChecksPublishedNote(t *testing.T) {
+	// skip loading the AWS configuration
+	initOnce.Do(func() {})
+
+	original := "%PDF"
+	cleaned := "# Agenda\n\n<!-- scriptor:attachment -->\n"
+	published, noteHash := attest.Stamp([]byte("# Agenda\n\n[scan.pdf](https://drive.google.com/file/d/file)\n"))
+
+	hash := func(content string) string {
+		h, err := attest.ArtifactHash(bytes.NewReader([]byte(content)))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return h
+	}
+	links := attest.BuildChain([]attest.Artifact{
+		{Stage: types.DOCUMENT_STAGE_DOWNLOAD, Hash: hash(original)},
+		{Stage: types.DOCUMENT_STAGE_OPENAI, Hash: hash(cleaned)},
+		{Stage: types.DOCUMENT_STAGE_UPLOAD, Hash: noteHash},
+	})
+
+	tests := []struct {
+		name         string
+		final        string
+		wantVerified bool
+	}{
+		{name: "published note", final: string(published), wantVerified: true},
+		{name: "published note changed", final: strings.Replace(string(published), "Agenda", "Minutes", 1)},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg = &handlerConfig{
+				store: &fakeStore{
+					document: &types.Document{
+						ID:          "doc-1",
+						Attestation: links,
+						FinalS3Key:  "final/doc-1/scan.md",
+					},
+					stages: map[types.Stage]*types.DocumentProcessingStage{
+						types.DOCUMENT_STAGE_DOWNLOAD: {S3Key: "download/scan.pdf"},
+						types.DOCUMENT_STAGE_OPENAI:   {S3Key: "openai/scan.md"},
+					},
+				},
+				s3Client: &fakeS3{objects: map[string]string{
+					"download/scan.pdf":   original,
+					"openai/scan.md":      cleaned,
+					"final/doc-1/scan.md": tc.final,
+				}},
+			}
+
+			response, err := process(context.Background(), events.APIGatewayProxyRequest{
+				PathParameters: map[string]string{"id": "doc-1"},
+			})
+			if err != nil || response.StatusCode != http.StatusOK {
+				t.Fatalf("unexpected response: %v %+v", err, response)
+			}
+
+			var got verifyResponse
+			if err := json.Unmarshal([]byte(response.Body), &got); err != nil {
+				t.Fatalf("unexpected body %q: %v", response.Body, err)
+			}
+
+			if got.Verified != tc.wantVerified {
+				t.Fatalf("unexpected verification: %+v", got)
+			}
+
+			if !tc.wantVerified && (got.Mismatch == nil || got.Mismatch.Stage != types.DOCUMENT_STAGE_UPLOAD) {
+				t.Fatalf("unexpected mismatch: %+v", got.Mismatch)
+			}
+		})
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"context"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html"
 	"io"
@@ -210,17 +211,35 @@ func (cfg *handlerConfig) handleS3Record(
 		return err
 	}
 
+	// Kindle documents aren't found on a watch channel
 	input, err := util.BuildStepInput(
-		notificationID,
+		util.Trace{NotificationID: notificationID},
 		document.ID,
 		types.DOCUMENT_STAGE_DOWNLOAD,
+
+		nil,
+	)
+	if err != nil {
+		return err
+	}
+
+	executionName, err := util.ResolveExecutionName(
+		ctx,
+		cfg.sfnClient,
+		cfg.stateMachineARN,
+		document,
 	)
+	if errors.Is(err, util.ErrExecutionInProgress) {
+		slog.Warn("Execution for the document is already running", "documentID", document.ID)
+		return nil
+	}
 	if err != nil {
 		return err
 	}
 
 	_, err = cfg.sfnClient.StartExecution(ctx, &sfn.StartExecutionInput{
 		StateMachineArn: aws.String(cfg.stateMachineARN),
+		Name:            aws.String(executionName),
 		Input:           aws.String(input),
 	})
 	if err != nil {
@@ -523,19 +542,16 @@ func (cfg *handlerConfig) saveDownloadedStage(
 	stage *types.DocumentProcessingStage,
 	pdfBytes []byte,
 ) error {
-	documentName := util.GetNamePart(document.Name)
-	stage.StageFileName = fmt.Sprintf(
-		"%s-%d.pdf",
-		documentName,
-		time.Now().UTC().Unix(),
-	)
+	documentName := util.DocumentBaseName(document)
+	stage.StageFileName = util.StageFileName(documentName, ".pdf")
 	stage.S3Key = fmt.Sprintf("%s/%s", stage.Stage, stage.StageFileName)
+	stage.ContentType = types.CONTENT_TYPE_PDF
 
 	_, err := cfg.s3Client.PutObject(ctx, &s3.PutObjectInput{
 		Bucket:        aws.String(types.S3_BUCKET_NAME),
 		Key:           aws.String(stage.S3Key),
 		Body:          bytes.NewReader(pdfBytes),
-		ContentType:   aws.String("application/pdf"),
+		ContentType:   aws.String(stage.ContentType),
 		ContentLength: aws.Int64(int64(len(pdfBytes))),
 	})
 	if err != nil {
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/KyleBrandon/scriptor/lambdas/util"
+	"github.com/KyleBrandon/scriptor/pkg/database"
+	"github.com/KyleBrandon/scriptor/pkg/errorsmap"
+	"github.com/KyleBrandon/scriptor/pkg/types"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+)
+
+type (
+	handlerConfig struct {
+		store database.DocumentStore
+	}
+
+	failureExplanation struct {
+		DocumentID string      `json:"document_id"`
+		Stage      types.Stage `json:"stage"`
+		Status     string      `json:"status"`
+		FailedAt   time.Time   `json:"failed_at"`
+		Attempt    int         `json:"attempt,omitempty"`
+		errorsmap.Explanation
+	}
+)
+
+var (
+	initOnce sync.Once
+	cfg      *handlerConfig
+)
+
+// Load all the inital configuration settings for the lambda
+func loadConfiguration(ctx context.Context) (*handlerConfig, error) {
+
+	cfg = &handlerConfig{}
+
+	var err error
+
+	cfg.store, err = database.NewDocumentStore(ctx)
+	if err != nil {
+		slog.Error("Failed to configure the DynamoDB client", "error", err)
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+// Ensure that the configuration settings are only loaded once
+func initLambda(ctx context.Context) error {
+	var err error
+	initOnce.Do(func() {
+		slog.Debug(">>initLambda")
+		defer slog.Debug("<<initLambda")
+
+		cfg, err = loadConfiguration(ctx)
+	})
+
+	return err
+}
+
+// Explain the first stage of the document that failed. Stages that failed
+// before error codes were recorded fall back to the generic explanation with
+// the stored reason as the technical details.
+func explainFailure(
+	documentID string,
+	stages []*types.DocumentProcessingStage,
+) (*failureExplanation, bool) {
+	for _, stage := range stages {
+		if stage.StageStatus != types.DOCUMENT_STATUS_ERROR &&
+			stage.StageStatus != types.DOCUMENT_STATUS_SOURCE_MISSING {
+			continue
+		}
+
+		return &failureExplanation{
+			DocumentID:  documentID,
+			Stage:       stage.Stage,
+			Status:      stage.StageStatus,
+			FailedAt:    stage.CompletedAt,
+			Attempt:     stage.Attempt,
+			Explanation: errorsmap.ExplainCode(stage.ErrorCode, stage.ErrorReason),
+		}, true
+	}
+
+	return nil, false
+}
+
+func process(
+	ctx context.Context,
+	request events.APIGatewayProxyRequest,
+) (events.APIGatewayProxyResponse, error) {
+	slog.Debug(">>process")
+	defer slog.Debug("<<process")
+
+	if err := initLambda(ctx); err != nil {
+		slog.Error("Failed to initialize the lambda", "error", err)
+		return util.BuildGatewayResponse(
+			err.Error(),
+			http.StatusInternalServerError,
+		)
+	}
+
+	documentID := request.PathParameters["id"]
+	if documentID == "" {
+		return util.BuildGatewayResponse(
+			"missing document id",
+			http.StatusBadRequest,
+		)
+	}
+
+	document, err := cfg.store.GetDocument(ctx, documentID)
+	if errors.Is(err, database.ErrDocumentNotFound) {
+		return util.BuildGatewayResponse(
+			"document not found",
+			http.StatusNotFound,
+		)
+	}
+	if err != nil {
+		return util.BuildGatewayResponse(
+			err.Error(),
+			http.StatusInternalServerError,
+		)
+	}
+
+	workflowStages := types.WorkflowStages()
+	stages := make([]*types.DocumentProcessingStage, 0, len(workflowStages))
+	for _, stageName := range workflowStages {
+		// the stages the document didn't get to have no record
+		stage, err := cfg.store.GetDocumentStage(ctx, document.ID, stageName)
+		if err != nil && !errors.Is(err, database.ErrStageNotFound) {
+			return util.BuildGatewayResponse(
+				err.Error(),
+				http.StatusInternalServerError,
+			)
+		}
+
+		stages = append(stages, stage)
+	}
+
+	explanation, ok := explainFailure(document.ID, stages)
+	if !ok {
+		return util.BuildGatewayResponse(
+			"document has not failed",
+			http.StatusNotFound,
+		)
+	}
+
+	body, err := json.Marshal(explanation)
+	if err != nil {
+		return util.BuildGatewayResponse(
+			err.Error(),
+			http.StatusInternalServerError,
+		)
+	}
+
+	return util.BuildGatewayResponse(string(body), http.StatusOK)
+}
+
+func main() {
+	slog.Debug(">>main")
+	defer slog.Debug("<<main")
+
+	lambda.Start(process)
+}
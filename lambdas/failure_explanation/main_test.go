@@ -0,0 +1,112 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/KyleBrandon/scriptor/pkg/errorsmap"
+	"github.com/KyleBrandon/scriptor/pkg/types"
+)
+
+func TestExplainFailure(t *testing.T) {
+	failedAt := time.Date(2026, 3, 11, 23, 30, 0, 0, time.UTC)
+
+	tests := []struct {
+		name        string
+		stages      []*types.DocumentProcessingStage
+		wantOK      bool
+		wantStage   types.Stage
+		wantCode    string
+		wantDetails string
+		wantAttempt int
+	}{
+		{
+			name: "no failed stage",
+			stages: []*types.DocumentProcessingStage{
+				{Stage: types.DOCUMENT_STAGE_DOWNLOAD, StageStatus: types.DOCUMENT_STATUS_COMPLETE},
+				{Stage: types.DOCUMENT_STAGE_MATHPIX, StageStatus: types.DOCUMENT_STATUS_INPROGRESS},
+			},
+		},
+		{
+			name: "classified failure",
+			stages: []*types.DocumentProcessingStage{
+				{
+					Stage:       types.DOCUMENT_STAGE_DOWNLOAD,
+					StageStatus: types.DOCUMENT_STATUS_ERROR,
+					CompletedAt: failedAt,
+					ErrorCode:   errorsmap.CODE_DRIVE_ACCESS_DENIED,
+					ErrorReason: "googleapi: Error 403: forbidden",
+					Attempt:     3,
+				},
+			},
+			wantOK:      true,
+			wantStage:   types.DOCUMENT_STAGE_DOWNLOAD,
+			wantCode:    errorsmap.CODE_DRIVE_ACCESS_DENIED,
+			wantDetails: "googleapi: Error 403: forbidden",
+			wantAttempt: 3,
+		},
+		{
+			name: "source missing",
+			stages: []*types.DocumentProcessingStage{
+				{
+					Stage:       types.DOCUMENT_STAGE_DOWNLOAD,
+					StageStatus: types.DOCUMENT_STATUS_SOURCE_MISSING,
+					ErrorCode:   errorsmap.CODE_SOURCE_MISSING,
+					ErrorReason: "googleapi: Error 404: File not found",
+				},
+			},
+			wantOK:      true,
+			wantStage:   types.DOCUMENT_STAGE_DOWNLOAD,
+			wantCode:    errorsmap.CODE_SOURCE_MISSING,
+			wantDetails: "googleapi: Error 404: File not found",
+		},
+		{
+			name: "failure recorded before error codes",
+			stages: []*types.DocumentProcessingStage{
+				{Stage: types.DOCUMENT_STAGE_DOWNLOAD, StageStatus: types.DOCUMENT_STATUS_COMPLETE},
+				{
+					Stage:       types.DOCUMENT_STAGE_MATHPIX,
+					StageStatus: types.DOCUMENT_STATUS_ERROR,
+					ErrorReason: "request failed with status_code=500",
+				},
+			},
+			wantOK:      true,
+			wantStage:   types.DOCUMENT_STAGE_MATHPIX,
+			wantCode:    errorsmap.CODE_UNKNOWN,
+			wantDetails: "request failed with status_code=500",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, ok := explainFailure("doc-1", tc.stages)
+			if ok != tc.wantOK {
+				t.Fatalf("unexpected result: got %v want %v", ok, tc.wantOK)
+			}
+
+			if !ok {
+				return
+			}
+
+			if got.Stage != tc.wantStage {
+				t.Fatalf("unexpected stage: got %q want %q", got.Stage, tc.wantStage)
+			}
+
+			if got.Code != tc.wantCode {
+				t.Fatalf("unexpected code: got %q want %q", got.Code, tc.wantCode)
+			}
+
+			if got.TechnicalDetails != tc.wantDetails {
+				t.Fatalf("unexpected details: got %q want %q", got.TechnicalDetails, tc.wantDetails)
+			}
+
+			if got.Attempt != tc.wantAttempt {
+				t.Fatalf("unexpected attempt: got %d want %d", got.Attempt, tc.wantAttempt)
+			}
+
+			if got.Summary == "" || got.Remediation == "" {
+				t.Fatalf("explanation is missing guidance: %+v", got.Explanation)
+			}
+		})
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/KyleBrandon/scriptor/lambdas/util"
+	"github.com/KyleBrandon/scriptor/pkg/database"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+)
+
+// What happened to each notification of a redrive request
+const (
+	REDRIVE_STATUS_SENT      = "redriven"
+	REDRIVE_STATUS_NOT_FOUND = "not_found"
+	REDRIVE_STATUS_FAILED    = "failed"
+)
+
+type (
+	// The SQS client used to send the notifications back to the main queue
+	messageSender interface {
+		SendMessage(
+			ctx context.Context,
+			params *sqs.SendMessageInput,
+			optFns ...func(*sqs.Options),
+		) (*sqs.SendMessageOutput, error)
+	}
+
+	handlerConfig struct {
+		store     database.FailedNotificationStore
+		sqsClient messageSender
+		queueURL  string
+	}
+
+	redriveRequest struct {
+		MessageIDs []string `json:"message_ids"`
+	}
+
+	redriveResult struct {
+		MessageID string `json:"message_id"`
+		Status    string `json:"status"`
+		Error     string `json:"error,omitempty"`
+	}
+
+	redriveResponse struct {
+		Results []redriveResult `json:"results"`
+	}
+)
+
+var (
+	initOnce sync.Once
+	cfg      *handlerConfig
+)
+
+// Load all the inital configuration settings for the lambda
+func loadConfiguration(ctx context.Context) (*handlerConfig, error) {
+
+	cfg = &handlerConfig{}
+
+	var err error
+
+	cfg.store, err = database.NewFailedNotificationStore(ctx)
+	if err != nil {
+		slog.Error("Failed to configure the DynamoDB client", "error", err)
+		return nil, err
+	}
+
+	awsCfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		slog.Error("Failed to load the AWS config", "error", err)
+		return nil, err
+	}
+
+	cfg.queueURL = os.Getenv("SQS_QUEUE_URL")
+	if cfg.queueURL == "" {
+		slog.Error("Failed to get the SQS queue URL")
+		return nil, fmt.Errorf("SQS_QUEUE_URL is not set")
+	}
+
+	cfg.sqsClient = sqs.NewFromConfig(awsCfg)
+
+	return cfg, nil
+}
+
+// Ensure that the configuration settings are only loaded once
+func initLambda(ctx context.Context) error {
+	var err error
+	initOnce.Do(func() {
+		slog.Debug(">>initLambda")
+		defer slog.Debug("<<initLambda")
+
+		cfg, err = loadConfiguration(ctx)
+	})
+
+	return err
+}
+
+// Send the failed notification back to the main queue as it was first
+// queued, and record when it was sent. A notification can be sent back more
+// than once.
+func (cfg *handlerConfig) redrive(ctx context.Context, messageID string) redriveResult {
+	result := redriveResult{MessageID: messageID}
+
+	failed, err := cfg.store.GetFailedNotification(ctx, messageID)
+	if err != nil {
+		result.Status = REDRIVE_STATUS_FAILED
+		result.Error = err.Error()
+		return result
+	}
+
+	if failed.MessageID == "" {
+		result.Status = REDRIVE_STATUS_NOT_FOUND
+		return result
+	}
+
+	// keep the trace of the webhook request that first queued it
+	trace := util.Trace{
+		NotificationID: failed.Attributes[util.ATTRIBUTE_NOTIFICATION_ID],
+		ChannelID:      failed.Attributes[util.ATTRIBUTE_CHANNEL_ID],
+		RequestID:      failed.Attributes[util.ATTRIBUTE_REQUEST_ID],
+	}
+
+	_, err = cfg.sqsClient.SendMessage(ctx, &sqs.SendMessageInput{
+		QueueUrl:          aws.String(cfg.queueURL),
+		MessageBody:       aws.String(failed.Body),
+		MessageAttributes: trace.MessageAttributes(),
+	})
+	if err != nil {
+		slog.Error(
+			"Failed to send the notification back to the queue",
+			"messageID",
+			messageID,
+			"error",
+			err,
+		)
+		result.Status = REDRIVE_STATUS_FAILED
+		result.Error = err.Error()
+		return result
+	}
+
+	slog.Info(
+		"Sent the failed notification back to the queue",
+		"messageID",
+		messageID,
+		"channelID",
+		failed.ChannelID,
+		"folderID",
+		failed.FolderID,
+	)
+
+	// the notification was sent, so a failure to record it is only logged
+	failed.RedrivenAt = time.Now().UTC()
+	failed.RedriveCount++
+	err = cfg.store.UpdateFailedNotification(ctx, failed)
+	if err != nil {
+		slog.Warn(
+			"Failed to record the redrive of the notification",
+			"messageID",
+			messageID,
+			"error",
+			err,
+		)
+	}
+
+	result.Status = REDRIVE_STATUS_SENT
+	return result
+}
+
+func process(
+	ctx context.Context,
+	request events.APIGatewayProxyRequest,
+) (events.APIGatewayProxyResponse, error) {
+	slog.Debug(">>process")
+	defer slog.Debug("<<process")
+
+	if err := initLambda(ctx); err != nil {
+		slog.Error("Failed to initialize the lambda", "error", err)
+		return util.BuildGatewayResponse(
+			err.Error(),
+			http.StatusInternalServerError,
+		)
+	}
+
+	var redriveReq redriveRequest
+	err := json.Unmarshal([]byte(request.Body), &redriveReq)
+	if err != nil || len(redriveReq.MessageIDs) == 0 {
+		return util.BuildGatewayResponse(
+			"invalid redrive request",
+			http.StatusBadRequest,
+		)
+	}
+
+	response := redriveResponse{
+		Results: make([]redriveResult, 0, len(redriveReq.MessageIDs)),
+	}
+	for _, messageID := range redriveReq.MessageIDs {
+		response.Results = append(response.Results, cfg.redrive(ctx, messageID))
+	}
+
+	body, err := json.Marshal(response)
+	if err != nil {
+		return util.BuildGatewayResponse(
+			err.Error(),
+			http.StatusInternalServerError,
+		)
+	}
+
+	return util.BuildGatewayResponse(string(body), http.StatusOK)
+}
+
+func main() {
+	slog.Debug(">>main")
+	defer slog.Debug("<<main")
+
+	lambda.Start(process)
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	sqstypes "github.com/aws/aws-sdk-go-v2/service/sqs/types"
+
+	"github.com/KyleBrandon/scriptor/lambdas/util"
+	"github.com/KyleBrandon/scriptor/pkg/database"
+	"github.com/KyleBrandon/scriptor/pkg/types"
+)
+
+type fakeStore struct {
+	database.FailedNotificationStore
+	records map[string]*types.FailedNotification
+}
+
+func (s *fakeStore) GetFailedNotification(
+	ctx context.Context,
+	messageID string,
+) (*types.FailedNotification, error) {
+	if record, ok := s.records[messageID]; ok {
+		return record, nil
+	}
+
+	return &types.FailedNotification{}, nil
+}
+
+func (s *fakeStore) UpdateFailedNotification(
+	ctx context.Context,
+	notification *types.FailedNotification,
+) error {
+	s.records[notification.MessageID] = notification
+	return nil
+}
+
+type fakeSender struct {
+	bodies     []string
+	attributes []map[string]sqstypes.MessageAttributeValue
+	fail       map[string]bool
+}
+
+func (s *fakeSender) SendMessage(
+	ctx context.Context,
+	params *sqs.SendMessageInput,
+	optFns ...func(*sqs.Options),
+) (*sqs.SendMessageOutput, error) {
+	if s.fail[*params.MessageBody] {
+		return nil, errors.New("queue unavailable")
+	}
+
+	s.bodies = append(s.bodies, *params.MessageBody)
+	s.attributes = append(s.attributes, params.MessageAttributes)
+	return &sqs.SendMessageOutput{}, nil
+}
+
+func TestProcessRedrivesNotifications(t *testing.T) {
+	// skip loading the AWS configuration
+	initOnce.Do(func() {})
+
+	tests := []struct {
+		name string
+		body string
+
+		wantStatus  int
+		wantResults []redriveResult
+		wantBodies  []string
+	}{
+		{
+			name:       "redriven",
+			body:       `{"message_ids":["message-1","message-2"]}`,
+			wantStatus: http.StatusOK,
+			wantResults: []redriveResult{
+				{MessageID: "message-1", Status: REDRIVE_STATUS_SENT},
+				{MessageID: "message-2", Status: REDRIVE_STATUS_SENT},
+			},
+			wantBodies: []string{`{"channel_id":"channel-1"}`, `{"channel_id":"channel-2"}`},
+		},
+		{
+			name:       "not recorded",
+			body:       `{"message_ids":["message-1","missing"]}`,
+			wantStatus: http.StatusOK,
+			wantResults: []redriveResult{
+				{MessageID: "message-1", Status: REDRIVE_STATUS_SENT},
+				{MessageID: "missing", Status: REDRIVE_STATUS_NOT_FOUND},
+			},
+			wantBodies: []string{`{"channel_id":"channel-1"}`},
+		},
+		{
+			// the rest are still sent back
+			name:       "send fails",
+			body:       `{"message_ids":["broken","message-1"]}`,
+			wantStatus: http.StatusOK,
+			wantResults: []redriveResult{
+				{MessageID: "broken", Status: REDRIVE_STATUS_FAILED, Error: "queue unavailable"},
+				{MessageID: "message-1", Status: REDRIVE_STATUS_SENT},
+			},
+			wantBodies: []string{`{"channel_id":"channel-1"}`},
+		},
+		{
+			name:       "no messages",
+			body:       `{"message_ids":[]}`,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "not json",
+			body:       "message-1",
+			wantStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			store := &fakeStore{records: map[string]*types.FailedNotification{
+				"message-1": {
+					MessageID:  "message-1",
+					Body:       `{"channel_id":"channel-1"}`,
+					Attributes: map[string]string{util.ATTRIBUTE_REQUEST_ID: "request-1"},
+				},
+				"message-2": {MessageID: "message-2", Body: `{"channel_id":"channel-2"}`},
+				"broken":    {MessageID: "broken", Body: "broken"},
+			}}
+			sender := &fakeSender{fail: map[string]bool{"broken": true}}
+			cfg = &handlerConfig{store: store, sqsClient: sender, queueURL: "queue"}
+
+			response, err := process(
+				context.Background(),
+				events.APIGatewayProxyRequest{Body: tc.body},
+			)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if response.StatusCode != tc.wantStatus {
+				t.Fatalf("unexpected status: got %d want %d", response.StatusCode, tc.wantStatus)
+			}
+
+			if !reflect.DeepEqual(sender.bodies, tc.wantBodies) {
+				t.Fatalf("unexpected messages: got %q want %q", sender.bodies, tc.wantBodies)
+			}
+
+			// the redriven message-1 keeps the request that queued it
+			for i, body := range sender.bodies {
+				requestID, ok := sender.attributes[i][util.ATTRIBUTE_REQUEST_ID]
+				if body == `{"channel_id":"channel-1"}` && (!ok || *requestID.StringValue != "request-1") {
+					t.Fatalf("unexpected attributes: %+v", sender.attributes[i])
+				}
+			}
+
+			if tc.wantStatus != http.StatusOK {
+				return
+			}
+
+			var got redriveResponse
+			if err := json.Unmarshal([]byte(response.Body), &got); err != nil {
+				t.Fatalf("response is not JSON: %v", err)
+			}
+
+			if !reflect.DeepEqual(got.Results, tc.wantResults) {
+				t.Fatalf("unexpected results:\ngot  %+v\nwant %+v", got.Results, tc.wantResults)
+			}
+
+			// only the notifications sent back are recorded as redriven
+			for _, result := range got.Results {
+				record, ok := store.records[result.MessageID]
+				if !ok {
+					continue
+				}
+
+				redriven := record.RedriveCount == 1 && !record.RedrivenAt.IsZero()
+				if redriven != (result.Status == REDRIVE_STATUS_SENT) {
+					t.Fatalf("unexpected redrive record for %s: %+v", result.MessageID, record)
+				}
+			}
+		})
+	}
+}
@@ -3,28 +3,93 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
 	"os"
+	"strconv"
 	"sync"
+	"time"
 
 	"github.com/KyleBrandon/scriptor/lambdas/util"
 	"github.com/KyleBrandon/scriptor/pkg/database"
 	"github.com/KyleBrandon/scriptor/pkg/google"
+	"github.com/KyleBrandon/scriptor/pkg/metrics"
+	"github.com/KyleBrandon/scriptor/pkg/sidecar"
 	"github.com/KyleBrandon/scriptor/pkg/types"
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/sfn"
+	sfntypes "github.com/aws/aws-sdk-go-v2/service/sfn/types"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"golang.org/x/sync/errgroup"
+)
+
+const (
+	// Documents of a notification that are processed at the same time,
+	// unless DOCUMENT_CONCURRENCY is set
+	DEFAULT_DOCUMENT_CONCURRENCY = 5
+
+	// Seconds a document held back by the execution limit of its channel
+	// waits before it is tried again
+	DEFERRED_START_DELAY_SECONDS = 60
+)
+
+type (
+	// The part of the Drive service used to find the files that changed and
+	// the sidecars of the documents
+	changeSource interface {
+		QueryChanges(
+			ctx context.Context,
+			folderID, driveID, startToken string,
+			recursive bool,
+		) (*types.DocumentChanges, error)
+		ListFolder(ctx context.Context, folderID, driveID string, recursive bool) (*types.DocumentChanges, error)
+		FindSidecar(ctx context.Context, folderID, documentName string) (*types.SidecarFile, error)
+		ReadSidecar(ctx context.Context, id string) (string, error)
+		FindDocument(ctx context.Context, folderID, name string) (*types.Document, error)
+	}
+
+	// The SQS client used to queue the documents held back by the execution
+	// limit of their channel
+	messageSender interface {
+		SendMessage(
+			ctx context.Context,
+			params *sqs.SendMessageInput,
+			optFns ...func(*sqs.Options),
+		) (*sqs.SendMessageOutput, error)
+	}
+
+	// The part of the Step Functions client used to start the workflow, and
+	// stop the workflow of a document a newer revision replaced
+	workflowStarter interface {
+		util.ExecutionStopper
+		StartExecution(
+			ctx context.Context,
+			params *sfn.StartExecutionInput,
+			optFns ...func(*sfn.Options),
+		) (*sfn.StartExecutionOutput, error)
+	}
 )
 
 type handlerConfig struct {
 	store           database.WatchChannelStore
 	docStore        database.DocumentStore
-	dc              *google.GoogleDriveContext
+	history         database.NotificationHistoryStore
+	dc              changeSource
 	stateMachineARN string
-	sfnClient       *sfn.Client
+	sfnClient       workflowStarter
+	sqsClient       messageSender
+	queueURL        string
+
+	// check the app properties of the Drive file when the document table
+	// has no record of it
+	dedupeWithProperties bool
+
+	// documents of a notification processed at the same time
+	documentConcurrency int
 }
 
 var (
@@ -40,20 +105,27 @@ func loadConfiguration(ctx context.Context) (*handlerConfig, error) {
 	var err error
 	cfg.store, err = database.NewWatchChannelStore(ctx)
 	if err != nil {
-		slog.Error("Failed to configure the DynamoDB client", "error", err)
+		slog.ErrorContext(ctx, "Failed to configure the DynamoDB client", "error", err)
 		return nil, err
 	}
 
 	cfg.docStore, err = database.NewDocumentStore(ctx)
 	if err != nil {
-		slog.Error("Failed to configure the DynamoDB client", "error", err)
+		slog.ErrorContext(ctx, "Failed to configure the DynamoDB client", "error", err)
+		return nil, err
+	}
+
+	cfg.history, err = database.NewNotificationHistoryStore(ctx)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to configure the DynamoDB client", "error", err)
 		return nil, err
 	}
 
 	cfg.dc, err = google.NewGoogleDrive(ctx)
 	if err != nil {
 		//
-		slog.Error(
+		slog.ErrorContext(
+			ctx,
 			"Failed to initialize the Google Drive service context",
 			"error",
 			err,
@@ -63,18 +135,37 @@ func loadConfiguration(ctx context.Context) (*handlerConfig, error) {
 
 	awsCfg, err := config.LoadDefaultConfig(ctx)
 	if err != nil {
-		slog.Error("Failed to load the AWS config", "error", err)
+		slog.ErrorContext(ctx, "Failed to load the AWS config", "error", err)
 		return nil, err
 	}
 
 	cfg.stateMachineARN = os.Getenv("STATE_MACHINE_ARN")
 	if cfg.stateMachineARN == "" {
-		slog.Error("Failed to get the state machine ARN")
+		slog.ErrorContext(ctx, "Failed to get the state machine ARN")
+		return nil, err
+	}
+
+	cfg.dedupeWithProperties, err = parseDedupeWithProperties(os.Getenv)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to read the dedupe settings", "error", err)
+		return nil, err
+	}
+
+	cfg.documentConcurrency, err = parseDocumentConcurrency(os.Getenv)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to read the document concurrency", "error", err)
 		return nil, err
 	}
 
+	cfg.queueURL = os.Getenv("SQS_QUEUE_URL")
+	if cfg.queueURL == "" {
+		slog.ErrorContext(ctx, "Failed to get the SQS queue URL")
+		return nil, fmt.Errorf("SQS_QUEUE_URL is not set")
+	}
+
 	// Create a Step Function Client to start the state machine later
 	cfg.sfnClient = sfn.NewFromConfig(awsCfg)
+	cfg.sqsClient = sqs.NewFromConfig(awsCfg)
 	return cfg, nil
 }
 
@@ -91,151 +182,1444 @@ func initLambda(ctx context.Context) error {
 	return err
 }
 
-func process(ctx context.Context, sqsEvent events.SQSEvent) error {
-	slog.Debug(">>process")
-	defer slog.Debug("<<process")
+// Files saved by Scriptor should never show up in a watch folder. When they
+// do the channel's folders are feeding back into each other, so flag the
+// channel for the admin to fix. The files themselves were already skipped.
+func (cfg *handlerConfig) flagFeedbackLoop(
+	ctx context.Context,
+	notification types.ChannelNotification,
+	outputCount int,
+) {
+	slog.ErrorContext(
+		ctx,
+		"Files saved by Scriptor were found in the watch folder, check the folder configuration of the channel",
+		"channelID",
+		notification.ChannelID,
+		"folderID",
+		notification.FolderID,
+		"count",
+		outputCount,
+	)
 
-	if err := initLambda(ctx); err != nil {
-		slog.Error("Failed to initialize the lambda", "error", err)
-		return err
+	metrics.Record(metrics.FEEDBACK_LOOPS_DETECTED, 1, nil)
+	metrics.Record(
+		metrics.FILES_SKIPPED,
+		float64(outputCount),
+		map[string]string{metrics.DIMENSION_REASON: metrics.REASON_SCRIPTOR_OUTPUT},
+	)
+
+	wc, err := cfg.store.GetWatchChannelByID(ctx, notification.ChannelID)
+	if err != nil {
+		slog.ErrorContext(
+			ctx,
+			"Failed to find the watch channel to flag",
+			"channelID",
+			notification.ChannelID,
+			"error",
+			err,
+		)
+		return
 	}
 
-	// loop through any SQS events
-	for _, message := range sqsEvent.Records {
-		// get the channel that triggered the event
-		var eventData types.ChannelNotification
-		if err := json.Unmarshal([]byte(message.Body), &eventData); err != nil {
-			return fmt.Errorf("failed to unmarshal SQS message: %v", err)
-		}
+	wc.LoopDetectedAt = time.Now().UTC().UnixMilli()
 
-		// Acquire the changes lock on the channel
-		startToken, err := cfg.store.AcquireChangesToken(
+	err = cfg.store.UpdateWatchChannel(ctx, wc)
+	if err != nil {
+		slog.ErrorContext(
 			ctx,
-			eventData.ChannelID,
+			"Failed to flag the watch channel",
+			"channelID",
+			notification.ChannelID,
+			"error",
+			err,
 		)
-		if err != nil {
-			slog.Error(
-				"Failed to acquire the watch channel changes lock",
-				"error",
-				err,
+	}
+}
+
+// Only the types of files the channel processes start a workflow, the rest
+// are logged and left in the watch folder.
+func (cfg *handlerConfig) allowedDocuments(
+	ctx context.Context,
+	notification types.ChannelNotification,
+	documents []*types.Document,
+) ([]*types.Document, error) {
+	if len(documents) == 0 {
+		return documents, nil
+	}
+
+	wc, err := cfg.store.GetWatchChannelByID(ctx, notification.ChannelID)
+	if err != nil {
+		slog.ErrorContext(
+			ctx,
+			"Failed to find the watch channel to check the file types",
+			"channelID",
+			notification.ChannelID,
+			"error",
+			err,
+		)
+		return nil, err
+	}
+
+	allowed := make([]*types.Document, 0, len(documents))
+	for _, document := range documents {
+		if !wc.AllowsMimeType(document.MimeType) {
+			slog.InfoContext(
+				ctx,
+				"Skipping a file type the channel doesn't process",
+				"channelID",
+				notification.ChannelID,
+				"id",
+				document.GoogleID,
+				"name",
+				document.Name,
+				"mimeType",
+				document.MimeType,
 			)
-			return err
+			metrics.Record(
+				metrics.FILES_SKIPPED,
+				1,
+				map[string]string{metrics.DIMENSION_REASON: metrics.REASON_MIME_TYPE},
+			)
+			continue
 		}
 
-		// Query the files that have changed and get the next changes start token
-		changes, err := cfg.dc.QueryChanges(eventData.FolderID, startToken)
-		if err != nil {
-			slog.Error("Call to QueryFiles failed", "error", err)
+		allowed = append(allowed, document)
+	}
+
+	return allowed, nil
+}
+
+// A file is processed again when Drive reports a different revision than the
+// one it was processed at. When either side has no revision, like documents
+// processed before revisions were recorded, the file is processed again only
+// if it was modified after the version processed.
+func isNewRevision(existing, current *types.Document) bool {
+	if existing.HeadRevisionID != "" && current.HeadRevisionID != "" {
+		return existing.HeadRevisionID != current.HeadRevisionID
+	}
+
+	return current.ModifiedTime.After(existing.ModifiedTime)
+}
+
+// DEDUPE_WITH_DRIVE_PROPERTIES turns on the app property check, it is off by
+// default.
+func parseDedupeWithProperties(getenv func(string) string) (bool, error) {
+	setting := getenv("DEDUPE_WITH_DRIVE_PROPERTIES")
+	if setting == "" {
+		return false, nil
+	}
+
+	enabled, err := strconv.ParseBool(setting)
+	if err != nil {
+		return false, fmt.Errorf("invalid DEDUPE_WITH_DRIVE_PROPERTIES: %w", err)
+	}
+
+	return enabled, nil
+}
+
+// DOCUMENT_CONCURRENCY sets how many documents of a notification are
+// processed at the same time.
+func parseDocumentConcurrency(getenv func(string) string) (int, error) {
+	setting := getenv("DOCUMENT_CONCURRENCY")
+	if setting == "" {
+		return DEFAULT_DOCUMENT_CONCURRENCY, nil
+	}
+
+	concurrency, err := strconv.Atoi(setting)
+	if err != nil || concurrency < 1 {
+		return 0, fmt.Errorf("invalid DOCUMENT_CONCURRENCY: %s", setting)
+	}
+
+	return concurrency, nil
+}
+
+// The document the Drive file was tagged with when it was processed, nil
+// when the file was never tagged
+func taggedDocument(document *types.Document) *types.Document {
+	if document.TaggedDocumentID == "" {
+		return nil
+	}
+
+	return &types.Document{
+		ID:             document.TaggedDocumentID,
+		HeadRevisionID: document.TaggedRevisionID,
+	}
+}
+
+// Find the document the file was processed as. The app properties of the
+// file are only checked when the table has no record of it.
+func processedDocument(ctx context.Context, document *types.Document) (*types.Document, error) {
+	existing, err := cfg.docStore.GetDocumentByGoogleID(ctx, document.GoogleID)
+	if !errors.Is(err, database.ErrDocumentNotFound) || !cfg.dedupeWithProperties {
+		return existing, err
+	}
+
+	tagged := taggedDocument(document)
+	if tagged == nil {
+		return nil, err
+	}
+
+	slog.InfoContext(
+		ctx,
+		"Document found from the Drive app properties",
+		"id",
+		tagged.ID,
+		"googleID",
+		document.GoogleID,
+	)
+
+	return tagged, nil
+}
+
+// Read the directives of the sidecar, logging the lines that were skipped
+func (cfg *handlerConfig) readDirectives(
+	ctx context.Context,
+	file *types.SidecarFile,
+) (*types.DocumentDirectives, error) {
+	content, err := cfg.dc.ReadSidecar(ctx, file.GoogleID)
+	if err != nil {
+		return nil, err
+	}
+
+	directives, warnings := sidecar.Parse(content)
+	for _, warning := range warnings {
+		slog.WarnContext(
+			ctx,
+			"Ignoring a line of the sidecar",
+			"name",
+			file.Name,
+			"warning",
+			warning,
+		)
+	}
+
+	return directives, nil
+}
+
+// Attach the directives of the sidecar to the document. Without a sidecar
+// from the batch the folder is checked for one, a document without a
+// sidecar is left alone.
+func (cfg *handlerConfig) attachSidecar(
+	ctx context.Context,
+	document *types.Document,
+	folderID string,
+	file *types.SidecarFile,
+) error {
+	if file == nil {
+		var err error
+		file, err = cfg.dc.FindSidecar(ctx, folderID, document.Name)
+		if err != nil || file == nil {
 			return err
 		}
+	}
+
+	directives, err := cfg.readDirectives(ctx, file)
+	if err != nil {
+		return err
+	}
+
+	document.Directives = directives
+	document.Sidecar = file
+
+	slog.InfoContext(
+		ctx,
+		"Found the sidecar of the document",
+		"name",
+		document.Name,
+		"sidecar",
+		file.Name,
+		"directives",
+		directives,
+	)
+
+	return nil
+}
+
+// Documents that won't run any more stages
+func isFinished(document *types.Document) bool {
+	switch document.Status {
+	case types.DOCUMENT_STATUS_COMPLETE,
+		types.DOCUMENT_STATUS_ERROR,
+		types.DOCUMENT_STATUS_SOURCE_MISSING,
+		types.DOCUMENT_STATUS_SUPERSEDED,
+		types.DOCUMENT_STATUS_DELETED:
+		return true
+	}
+
+	return false
+}
+
+// A document still being processed when a newer revision of its file is
+// found. Documents only known from the app properties of the file were
+// processed and have no record to update.
+func isInFlight(existing *types.Document) bool {
+	return existing.GoogleID != "" && !isFinished(existing)
+}
+
+// Mark the in flight document as replaced by the newer revision and stop its
+// workflow. The stages still running check the marker and end early.
+func (cfg *handlerConfig) supersede(
+	ctx context.Context,
+	existing, document *types.Document,
+) error {
+	err := cfg.docStore.SupersedeDocument(ctx, existing.ID, document.ID)
+	if err != nil {
+		return err
+	}
 
-		// Update the start token so we pick up any new changes next time
-		err = cfg.store.ReleaseChangesToken(
+	stopped, err := util.StopActiveExecution(
+		ctx,
+		cfg.sfnClient,
+		cfg.stateMachineARN,
+		existing,
+		types.DOCUMENT_ERROR_SUPERSEDED,
+		fmt.Sprintf("superseded by %s", document.ID),
+	)
+	if err != nil {
+		return err
+	}
+
+	// the stopped execution never reaches a terminal step to give its
+	// slot back
+	err = util.ReleaseExecutionSlot(ctx, cfg.docStore, cfg.store, existing)
+	if err != nil {
+		return err
+	}
+
+	slog.InfoContext(
+		ctx,
+		"Superseded the document being processed by the newer revision",
+		"id",
+		existing.ID,
+		"newerID",
+		document.ID,
+		"execution",
+		stopped,
+	)
+
+	metrics.Record(metrics.DOCUMENTS_SUPERSEDED, 1, nil)
+
+	return nil
+}
+
+// Apply a sidecar that changed after its document was found. A held
+// document is started once the sidecar no longer holds it, and a document
+// that is still being processed gets the directives for the stages it
+// hasn't run yet. The sidecar of a document that wasn't found yet is
+// picked up with the document.
+func (cfg *handlerConfig) pairLateSidecar(
+	ctx context.Context,
+	notificationID string,
+	file *types.SidecarFile,
+) error {
+	documentName := sidecar.DocumentName(file.Name)
+
+	current, err := cfg.dc.FindDocument(ctx, file.FolderID, documentName)
+	if err != nil {
+		return err
+	}
+
+	if current == nil {
+		slog.InfoContext(
 			ctx,
-			eventData.ChannelID,
-			changes.NextStartToken,
+			"The document of the sidecar is not in the folder",
+			"name",
+			file.Name,
+			"document",
+			documentName,
 		)
-		if err != nil {
-			slog.Error(
-				"Failed to release the watch channel changes lock",
-				"error",
-				err,
-			)
-		}
+		return nil
+	}
 
-		// Check if there are documents to process
-		if len(changes.Documents) == 0 {
-			return nil
-		}
+	document, err := cfg.docStore.GetDocumentByGoogleID(ctx, current.GoogleID)
+	if errors.Is(err, database.ErrDocumentNotFound) {
+		slog.InfoContext(
+			ctx,
+			"The document of the sidecar hasn't been found yet",
+			"name",
+			file.Name,
+			"googleID",
+			current.GoogleID,
+		)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
 
-		slog.Info(
-			"Found documents to process",
-			"count",
-			len(changes.Documents),
-			"folderID",
-			eventData.FolderID,
-			"documents",
-			changes.Documents,
+	if isFinished(document) {
+		slog.WarnContext(
+			ctx,
+			"The sidecar changed after its document was processed",
+			"id",
+			document.ID,
+			"name",
+			file.Name,
+			"status",
+			document.Status,
 		)
+		return nil
+	}
+
+	document.Directives, err = cfg.readDirectives(ctx, file)
+	if err != nil {
+		return err
+	}
+	document.Sidecar = file
+
+	// only the sidecar is saved, the stages may have moved the document on
+	// since it was read
+	err = cfg.docStore.UpdateDocumentFields(ctx, document.ID, &types.DocumentUpdate{
+		Directives: document.Directives,
+		Sidecar:    document.Sidecar,
+	})
+	if err != nil {
+		return err
+	}
 
-		// Start the state machine for each document discovered
-		for _, document := range changes.Documents {
-			slog.Info(
-				"Processing document from queue",
+	if document.Status != types.DOCUMENT_STATUS_HELD || document.Directives.Hold {
+		if document.Status != types.DOCUMENT_STATUS_HELD && document.Directives.Hold {
+			slog.WarnContext(
+				ctx,
+				"The document is already being processed and can't be held",
+				"id",
+				document.ID,
 				"name",
-				document.Name,
-				"notificationID",
-				eventData.NotificationID,
+				file.Name,
 			)
+		}
 
-			// Check if we have already processed this document
-			_, err = cfg.docStore.GetDocumentByGoogleID(ctx, document.GoogleID)
-			if err == nil {
-				// The document exists, ignore it
-				slog.Warn(
-					"Document already processed",
-					"id",
-					document.ID,
-					"googleID",
-					document.GoogleID,
-					"name",
-					document.Name,
-				)
-				continue
-			}
+		// the stages read the directives from the document when they run
+		return nil
+	}
 
-			// Save the Google Drive document information
-			err = cfg.docStore.InsertDocument(ctx, document)
-			if err != nil {
-				slog.Error(
-					"Failed to save the document metadata",
-					"docName",
-					document.Name,
-					"error",
-					err,
-				)
-				return err
-			}
+	executionName, err := util.ResolveExecutionName(
+		ctx,
+		cfg.sfnClient,
+		cfg.stateMachineARN,
+		document,
+	)
+	if errors.Is(err, util.ErrExecutionInProgress) {
+		slog.WarnContext(
+			ctx,
+			"Execution for the released document is already running",
+			"id",
+			document.ID,
+		)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
 
-			// TODO: this should be a different step type as it's the Google document ID not ours
-			input, err := util.BuildStepInput(
-				eventData.NotificationID,
-				document.ID,
-				types.DOCUMENT_STAGE_NEW,
-			)
-			if err != nil {
-				slog.Error(
-					"Failed to build the stage input for the next stage",
-					"docName",
-					document.Name,
-					"error",
-					err,
-				)
-				return err
-			}
+	released, err := cfg.docStore.ReleaseHeldDocument(ctx, document.ID)
+	if err != nil {
+		return err
+	}
 
-			// start the state machine
-			_, err = cfg.sfnClient.StartExecution(ctx, &sfn.StartExecutionInput{
-				StateMachineArn: &cfg.stateMachineARN,
-				Input:           aws.String(input),
-			})
-			if err != nil {
-				slog.Error(
-					"Failed to start the stage machine for the document",
-					"docName",
-					document.Name,
-					"error",
-					err,
-				)
-				return err
-			}
-		}
+	// another notification released it, or it was superseded or deleted
+	if !released {
+		slog.InfoContext(ctx, "The document is no longer held", "id", document.ID)
+		return nil
+	}
+	document.Status = types.DOCUMENT_STATUS_PENDING
+
+	slog.InfoContext(ctx, "Releasing the held document", "id", document.ID, "name", document.Name)
 
+	return cfg.startOrDefer(ctx, notificationID, document, executionName)
+}
+
+// A document saved for its revision that no stage picked up yet, because
+// its start failed after it was saved or the execution limit deferred it.
+// Documents only known from the app properties of the file have no record.
+func isUnstarted(document *types.Document) bool {
+	if document.GoogleID == "" || document.CurrentStage != "" {
+		return false
 	}
-	return nil
+
+	return document.Status == "" || document.Status == types.DOCUMENT_STATUS_PENDING
 }
 
-func main() {
+// Start the workflow of a document saved for its revision that was never
+// started. A start that did go through is found by its execution name, so
+// the workflow isn't run twice.
+func (cfg *handlerConfig) startSaved(
+	ctx context.Context,
+	notificationID string,
+	document *types.Document,
+) error {
+	executionName, err := util.ResolveExecutionName(
+		ctx,
+		cfg.sfnClient,
+		cfg.stateMachineARN,
+		document,
+	)
+	if errors.Is(err, util.ErrExecutionInProgress) {
+		slog.WarnContext(ctx, "Execution for the saved document is already running", "id", document.ID)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	slog.InfoContext(
+		ctx,
+		"Starting the document saved without a workflow",
+		"id",
+		document.ID,
+		"name",
+		document.Name,
+	)
+
+	return cfg.startOrDefer(ctx, notificationID, document, executionName)
+}
+
+// Another notification, or an earlier delivery of this one, saved the
+// revision first. The saved document is started when that start never
+// happened.
+func (cfg *handlerConfig) startSavedRevision(
+	ctx context.Context,
+	notificationID string,
+	document *types.Document,
+) error {
+	saved, err := cfg.docStore.GetDocument(ctx, document.ID)
+	if err != nil && !errors.Is(err, database.ErrDocumentNotFound) {
+		return err
+	}
+
+	if err != nil || !isUnstarted(saved) {
+		slog.WarnContext(
+			ctx,
+			"Document was already saved for the revision",
+			"id",
+			document.ID,
+			"name",
+			document.Name,
+			"revision",
+			document.HeadRevisionID,
+		)
+		return nil
+	}
+
+	return cfg.startSaved(ctx, notificationID, saved)
+}
+
+// Start the workflow for the document under the execution name
+func (cfg *handlerConfig) startWorkflow(
+	ctx context.Context,
+	notificationID string,
+	document *types.Document,
+	executionName string,
+) error {
+	input, err := util.BuildStepInput(
+		util.Trace{
+			NotificationID: notificationID,
+			ChannelID:      document.ChannelID,
+			RequestID:      util.TraceFromContext(ctx).RequestID,
+		},
+		document.ID,
+		types.DOCUMENT_STAGE_NEW,
+
+		nil,
+	)
+	if err != nil {
+		slog.ErrorContext(
+			ctx,
+			"Failed to build the stage input for the next stage",
+			"docName",
+			document.Name,
+			"error",
+			err,
+		)
+		return err
+	}
+
+	// start the state machine
+	_, err = cfg.sfnClient.StartExecution(ctx, &sfn.StartExecutionInput{
+		StateMachineArn: &cfg.stateMachineARN,
+		Name:            aws.String(executionName),
+		Input:           aws.String(input),
+	})
+
+	// the name is taken by an execution of the same revision, so the
+	// document is already being processed
+	var exists *sfntypes.ExecutionAlreadyExists
+	if errors.As(err, &exists) {
+		slog.WarnContext(
+			ctx,
+			"Execution for the document was already started",
+			"id",
+			document.ID,
+			"execution",
+			executionName,
+		)
+		return nil
+	}
+	if err != nil {
+		slog.ErrorContext(
+			ctx,
+			"Failed to start the stage machine for the document",
+			"docName",
+			document.Name,
+			"error",
+			err,
+		)
+		return err
+	}
+
+	metrics.Record(metrics.WORKFLOWS_STARTED, 1, nil)
+
+	cfg.recordExecution(ctx, notificationID, executionName)
+
+	return nil
+}
+
+// Add the execution to the history of the notification that found the
+// document. The workflow was started, so a failure is only logged.
+func (cfg *handlerConfig) recordExecution(
+	ctx context.Context,
+	notificationID, executionName string,
+) {
+	// notifications queued before the history was kept have no ID
+	if notificationID == "" {
+		return
+	}
+
+	err := cfg.history.RecordNotificationExecution(ctx, notificationID, executionName)
+	if err != nil {
+		slog.WarnContext(
+			ctx,
+			"Failed to record the execution in the notification history",
+			"notificationID",
+			notificationID,
+			"execution",
+			executionName,
+			"error",
+			err,
+		)
+	}
+}
+
+// Record what processing the notification found and why it failed, if it
+// did. The history is only for tracing, so a failure is only logged.
+func (cfg *handlerConfig) recordProcessed(
+	ctx context.Context,
+	notificationID string,
+	documents []*types.Document,
+	processErr error,
+) {
+	if notificationID == "" {
+		return
+	}
+
+	documentIDs := make([]string, 0, len(documents))
+	for _, document := range documents {
+		documentIDs = append(documentIDs, document.ID)
+	}
+
+	reason := ""
+	if processErr != nil {
+		reason = processErr.Error()
+	}
+
+	err := cfg.history.RecordNotificationProcessed(ctx, notificationID, documentIDs, reason)
+	if err != nil {
+		slog.WarnContext(
+			ctx,
+			"Failed to record the processing in the notification history",
+			"notificationID",
+			notificationID,
+			"error",
+			err,
+		)
+	}
+}
+
+// Start the workflow of the document unless its channel is already running
+// as many executions as it allows. A document past the limit is left
+// pending and queued again to start later.
+func (cfg *handlerConfig) startOrDefer(
+	ctx context.Context,
+	notificationID string,
+	document *types.Document,
+	executionName string,
+) error {
+	wc, err := cfg.store.GetWatchChannelByID(ctx, document.ChannelID)
+	if err != nil {
+		slog.ErrorContext(
+			ctx,
+			"Failed to find the watch channel of the document",
+			"id",
+			document.ID,
+			"channelID",
+			document.ChannelID,
+			"error",
+			err,
+		)
+		return err
+	}
+
+	if wc.MaxConcurrentExecutions <= 0 {
+		return cfg.startWorkflow(ctx, notificationID, document, executionName)
+	}
+
+	acquired, err := util.AcquireExecutionSlot(
+		ctx,
+		cfg.docStore,
+		cfg.store,
+		document,
+		wc.MaxConcurrentExecutions,
+	)
+	if err != nil {
+		slog.ErrorContext(
+			ctx,
+			"Failed to count the execution of the document",
+			"id",
+			document.ID,
+			"error",
+			err,
+		)
+		return err
+	}
+
+	if !acquired {
+		return cfg.deferStart(ctx, notificationID, document)
+	}
+
+	err = cfg.startWorkflow(ctx, notificationID, document, executionName)
+	if err != nil {
+		releaseErr := util.ReleaseExecutionSlot(ctx, cfg.docStore, cfg.store, document)
+		return errors.Join(err, releaseErr)
+	}
+
+	return nil
+}
+
+// Leave the document pending and queue it to be started after a delay
+func (cfg *handlerConfig) deferStart(
+	ctx context.Context,
+	notificationID string,
+	document *types.Document,
+) error {
+	err := cfg.docStore.UpdateDocumentStatus(ctx, document.ID, "", types.DOCUMENT_STATUS_PENDING)
+	if err != nil {
+		return err
+	}
+
+	body, err := json.Marshal(&types.ChannelNotification{
+		NotificationID: notificationID,
+		ChannelID:      document.ChannelID,
+		FolderID:       document.GoogleFolderID,
+		DocumentID:     document.ID,
+	})
+	if err != nil {
+		return err
+	}
+
+	// the deferred start keeps the trace of the webhook request
+	trace := util.Trace{
+		NotificationID: notificationID,
+		ChannelID:      document.ChannelID,
+		RequestID:      util.TraceFromContext(ctx).RequestID,
+	}
+
+	_, err = cfg.sqsClient.SendMessage(ctx, &sqs.SendMessageInput{
+		QueueUrl:          &cfg.queueURL,
+		MessageBody:       aws.String(string(body)),
+		DelaySeconds:      DEFERRED_START_DELAY_SECONDS,
+		MessageAttributes: trace.MessageAttributes(),
+	})
+	if err != nil {
+		slog.ErrorContext(
+			ctx,
+			"Failed to queue the document held back by the execution limit",
+			"id",
+			document.ID,
+			"error",
+			err,
+		)
+		return err
+	}
+
+	slog.InfoContext(
+		ctx,
+		"The channel is running as many executions as it allows, the document will be tried again",
+		"id",
+		document.ID,
+		"channelID",
+		document.ChannelID,
+		"delaySeconds",
+		DEFERRED_START_DELAY_SECONDS,
+	)
+
+	return nil
+}
+
+// Try again to start a document the execution limit held back. Documents
+// that are no longer pending, like ones a newer revision replaced, are
+// left alone.
+func (cfg *handlerConfig) startDeferred(
+	ctx context.Context,
+	notification types.ChannelNotification,
+) error {
+	document, err := cfg.docStore.GetDocument(ctx, notification.DocumentID)
+	if errors.Is(err, database.ErrDocumentNotFound) {
+		slog.WarnContext(ctx, "The deferred document no longer exists", "id", notification.DocumentID)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if document.Status != types.DOCUMENT_STATUS_PENDING {
+		slog.InfoContext(
+			ctx,
+			"The deferred document is no longer waiting to start",
+			"id",
+			document.ID,
+			"status",
+			document.Status,
+		)
+		return nil
+	}
+
+	executionName, err := util.ResolveExecutionName(
+		ctx,
+		cfg.sfnClient,
+		cfg.stateMachineARN,
+		document,
+	)
+	if errors.Is(err, util.ErrExecutionInProgress) {
+		slog.WarnContext(ctx, "Execution for the deferred document is already running", "id", document.ID)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	return cfg.startOrDefer(ctx, notification.NotificationID, document, executionName)
+}
+
+// Release the changes lock of the channel, moving the start token on when
+// one is given. A failed release is only logged, the lock lease runs out on
+// its own.
+func (cfg *handlerConfig) releaseChangesToken(
+	ctx context.Context,
+	channelID, nextStartToken string,
+) {
+	err := cfg.store.ReleaseChangesToken(ctx, channelID, nextStartToken)
+	if err != nil {
+		slog.ErrorContext(
+			ctx,
+			"Failed to release the watch channel changes lock",
+			"channelID",
+			channelID,
+			"error",
+			err,
+		)
+		return
+	}
+
+	if nextStartToken == "" {
+		slog.WarnContext(
+			ctx,
+			"Released the watch channel changes lock without advancing the token",
+			"channelID",
+			channelID,
+		)
+	}
+}
+
+// Start the workflow for the documents that changed in the folder of the
+// notification
+func processNotification(ctx context.Context, message events.SQSMessage) (err error) {
+	// get the channel that triggered the event
+	var eventData types.ChannelNotification
+	if err := json.Unmarshal([]byte(message.Body), &eventData); err != nil {
+		return fmt.Errorf("failed to unmarshal SQS message: %v", err)
+	}
+
+	if eventData.DocumentID != "" {
+		return cfg.startDeferred(ctx, eventData)
+	}
+
+	// the documents found are only known once the changes are filtered
+	var found []*types.Document
+	defer func() {
+		cfg.recordProcessed(ctx, eventData.NotificationID, found, err)
+	}()
+
+	// a notification queued before the channel was paused is dropped like
+	// the webhook drops them, the changes lock isn't taken so the token
+	// doesn't move on
+	if cfg.channelPaused(ctx, eventData.ChannelID) {
+		cfg.clearPendingNotification(ctx, eventData.ChannelID)
+		return nil
+	}
+
+	if eventData.Kind == types.NOTIFICATION_KIND_BASELINE {
+		found, err = cfg.scanFolder(ctx, eventData)
+		return err
+	}
+
+	// Acquire the changes lock on the channel
+	startToken, err := cfg.store.AcquireChangesToken(
+		ctx,
+		eventData.ChannelID,
+	)
+	// the notification is delivered again once the other one is done
+	if errors.Is(err, database.ErrWatchChannelLockHeld) {
+		slog.WarnContext(
+			ctx,
+			"The changes of the channel are being queried by another notification",
+			"channelID",
+			eventData.ChannelID,
+		)
+		return err
+	}
+	if err != nil {
+		slog.ErrorContext(
+			ctx,
+			"Failed to acquire the watch channel changes lock",
+			"error",
+			err,
+		)
+		return err
+	}
+
+	// Release the lock on every path. The start token only moves on when
+	// the changes were all handled, otherwise they are queried again.
+	var changes *types.DocumentChanges
+	defer func() {
+		nextStartToken := ""
+		if err == nil {
+			nextStartToken = changes.NextStartToken
+		}
+
+		cfg.releaseChangesToken(ctx, eventData.ChannelID, nextStartToken)
+	}()
+
+	// the changes are queried from here on, so requests the webhook gets
+	// now can queue the next notification
+	cfg.clearPendingNotification(ctx, eventData.ChannelID)
+
+	// Query the files that have changed and get the next changes start token
+	changes, err = cfg.dc.QueryChanges(
+		ctx,
+		eventData.FolderID,
+		eventData.DriveID,
+		startToken,
+		eventData.Recursive,
+	)
+	if err != nil {
+		slog.ErrorContext(ctx, "Call to QueryFiles failed", "error", err)
+		return err
+	}
+
+	found, err = cfg.processChanges(ctx, eventData, changes)
+	return err
+}
+
+// Whether the channel is paused. The notification is processed when the
+// channel can't be read, as it was before channels could be paused.
+func (cfg *handlerConfig) channelPaused(ctx context.Context, channelID string) bool {
+	wc, err := cfg.store.GetWatchChannelByID(ctx, channelID)
+	if err != nil {
+		slog.WarnContext(
+			ctx,
+			"Failed to check whether the watch channel is paused",
+			"channelID",
+			channelID,
+			"error",
+			err,
+		)
+		return false
+	}
+
+	if wc.Paused {
+		slog.InfoContext(
+			ctx,
+			"Dropping the notification of a paused channel",
+			"channelID",
+			channelID,
+			"folderID",
+			wc.FolderID,
+		)
+	}
+
+	return wc.Paused
+}
+
+// Clear the flag the webhook set when it queued the notification. A failure
+// is only logged, the flag expires on its own.
+func (cfg *handlerConfig) clearPendingNotification(ctx context.Context, channelID string) {
+	err := cfg.store.ClearNotificationPending(ctx, channelID)
+	if err != nil {
+		slog.WarnContext(
+			ctx,
+			"Failed to clear the pending notification of the channel",
+			"channelID",
+			channelID,
+			"error",
+			err,
+		)
+	}
+}
+
+// Process every file in the watch folder of a channel that was just
+// registered, so the files added before it was watched aren't missed, or of
+// a channel that is backfilled after its notifications were missed. The
+// changes token isn't used, so the lock of the channel isn't taken. Files
+// that were already processed are skipped like any other change.
+func (cfg *handlerConfig) scanFolder(
+	ctx context.Context,
+	notification types.ChannelNotification,
+) ([]*types.Document, error) {
+	contents, err := cfg.dc.ListFolder(
+		ctx,
+		notification.FolderID,
+		notification.DriveID,
+		notification.Recursive,
+	)
+	if err != nil {
+		slog.ErrorContext(
+			ctx,
+			"Failed to list the watch folder",
+			"channelID",
+			notification.ChannelID,
+			"folderID",
+			notification.FolderID,
+			"error",
+			err,
+		)
+		return nil, err
+	}
+
+	slog.InfoContext(
+		ctx,
+		"Scanning the watch folder of the channel",
+		"channelID",
+		notification.ChannelID,
+		"folderID",
+		notification.FolderID,
+		"files",
+		len(contents.Documents)+len(contents.Sidecars),
+	)
+
+	return cfg.processChanges(ctx, notification, contents)
+}
+
+// Mark the documents of the files that were trashed or removed as deleted,
+// so the record of a file that is gone isn't left pending or complete. Files
+// that were never recorded, like the ones Scriptor saved, are skipped, as are
+// documents a newer revision already replaced.
+func (cfg *handlerConfig) markRemoved(ctx context.Context, googleIDs []string) error {
+	for _, googleID := range googleIDs {
+		existing, err := cfg.docStore.GetDocumentByGoogleID(ctx, googleID)
+		if errors.Is(err, database.ErrDocumentNotFound) {
+			continue
+		}
+		if err != nil {
+			slog.ErrorContext(
+				ctx,
+				"Failed to find the document of the removed file",
+				"googleID",
+				googleID,
+				"error",
+				err,
+			)
+			return err
+		}
+
+		if existing.Status == types.DOCUMENT_STATUS_DELETED ||
+			existing.Status == types.DOCUMENT_STATUS_SUPERSEDED {
+			continue
+		}
+
+		err = cfg.docStore.UpdateDocumentStatus(ctx, existing.ID, "", types.DOCUMENT_STATUS_DELETED)
+		if err != nil {
+			slog.ErrorContext(
+				ctx,
+				"Failed to mark the document of the removed file as deleted",
+				"id",
+				existing.ID,
+				"googleID",
+				googleID,
+				"error",
+				err,
+			)
+			return err
+		}
+
+		slog.InfoContext(
+			ctx,
+			"Marked the document of the removed file as deleted",
+			"id",
+			existing.ID,
+			"googleID",
+			googleID,
+			"previousStatus",
+			existing.Status,
+		)
+	}
+
+	return nil
+}
+
+// Start the workflows of the documents of the changes and apply their
+// sidecars. The documents the channel allows are returned, along with any
+// that failed to start.
+func (cfg *handlerConfig) processChanges(
+	ctx context.Context,
+	eventData types.ChannelNotification,
+	changes *types.DocumentChanges,
+) ([]*types.Document, error) {
+	if changes.OutputsSkipped > 0 {
+		cfg.flagFeedbackLoop(ctx, eventData, changes.OutputsSkipped)
+	}
+
+	err := cfg.markRemoved(ctx, changes.Removed)
+	if err != nil {
+		return nil, err
+	}
+
+	documents, err := cfg.allowedDocuments(ctx, eventData, changes.Documents)
+	if err != nil {
+		return nil, err
+	}
+
+	// Drive also notifies for changes that aren't new files, like the files
+	// the workflow writes or ones that were trashed
+	if len(documents) == 0 && len(changes.Sidecars) == 0 {
+		slog.InfoContext(
+			ctx,
+			"Notification had no documents to process",
+			"channelID",
+			eventData.ChannelID,
+			"folderID",
+			eventData.FolderID,
+			"notificationID",
+			eventData.NotificationID,
+			"resourceState",
+			eventData.ResourceState,
+			"removed",
+			len(changes.Removed),
+		)
+		return documents, nil
+	}
+
+	sidecars := make(map[string]*types.SidecarFile)
+	for _, file := range changes.Sidecars {
+		sidecars[sidecar.DocumentName(file.Name)] = file
+	}
+
+	if len(documents) > 0 {
+		slog.InfoContext(
+			ctx,
+			"Found documents to process",
+			"count",
+			len(documents),
+			"folderID",
+			eventData.FolderID,
+			"documents",
+			documents,
+		)
+	}
+
+	// Each document is looked up, saved and started on its own, a few at
+	// a time. The sidecars of the batch are paired with their documents
+	// first so each one is only applied once.
+	paired := make([]*types.SidecarFile, len(documents))
+	for i, document := range documents {
+		paired[i] = sidecars[document.Name]
+		delete(sidecars, document.Name)
+	}
+
+	err = cfg.startDocuments(ctx, eventData, documents, paired)
+	if err != nil {
+		return documents, err
+	}
+
+	// the documents of the sidecars left were in an earlier batch
+	for _, file := range sidecars {
+		err = cfg.pairLateSidecar(ctx, eventData.NotificationID, file)
+		if err != nil {
+			slog.ErrorContext(
+				ctx,
+				"Failed to apply the sidecar to its document",
+				"name",
+				file.Name,
+				"error",
+				err,
+			)
+			return documents, err
+		}
+	}
+
+	return documents, nil
+}
+
+// Start the workflows of the documents through a pool of at most
+// documentConcurrency workers. Every document is attempted, the documents
+// that failed are returned together so the notification is tried again.
+// On the retry the documents already saved for their revision are skipped,
+// unless their workflow was never started.
+func (cfg *handlerConfig) startDocuments(
+	ctx context.Context,
+	notification types.ChannelNotification,
+	documents []*types.Document,
+	sidecars []*types.SidecarFile,
+) error {
+	limit := cfg.documentConcurrency
+	if limit < 1 {
+		limit = DEFAULT_DOCUMENT_CONCURRENCY
+	}
+
+	var group errgroup.Group
+	group.SetLimit(limit)
+
+	failures := make([]error, len(documents))
+	for i, document := range documents {
+		group.Go(func() error {
+			err := cfg.processDocument(ctx, notification, document, sidecars[i])
+			if err != nil {
+				failures[i] = fmt.Errorf("document %s: %w", document.Name, err)
+			}
+
+			return nil
+		})
+	}
+
+	group.Wait()
+
+	return errors.Join(failures...)
+}
+
+// Look the document up, save it and start its workflow. Documents that were
+// already processed, or are being processed by another notification, are
+// skipped.
+func (cfg *handlerConfig) processDocument(
+	ctx context.Context,
+	notification types.ChannelNotification,
+	document *types.Document,
+	file *types.SidecarFile,
+) error {
+	slog.InfoContext(
+		ctx,
+		"Processing document from queue",
+		"name",
+		document.Name,
+		"notificationID",
+		notification.NotificationID,
+	)
+
+	// Remember the channel the document was found on so the output
+	// goes to the folders configured for it. The file can have other
+	// parents besides the watch folder, or be in a folder below it when
+	// the channel is recursive, so its sidecar is looked for where it
+	// was found.
+	foundInFolderID := document.GoogleFolderID
+	if foundInFolderID == "" {
+		foundInFolderID = notification.FolderID
+	}
+	document.ChannelID = notification.ChannelID
+	document.GoogleFolderID = notification.FolderID
+
+	// Check if we have already processed this revision of the document
+	existing, err := processedDocument(ctx, document)
+	if err == nil {
+		// the start can have failed after the revision was saved
+		if !isNewRevision(existing, document) && isUnstarted(existing) {
+			return cfg.startSaved(ctx, notification.NotificationID, existing)
+		}
+
+		if !isNewRevision(existing, document) {
+			// The document exists, ignore it
+			slog.WarnContext(
+				ctx,
+				"Document already processed",
+				"id",
+				existing.ID,
+				"googleID",
+				document.GoogleID,
+				"name",
+				document.Name,
+			)
+			return nil
+		}
+
+		// The file changed since it was processed, process it again
+		// as a new version of the document
+		document.Version = max(existing.Version, 1) + 1
+		document.PreviousVersionID = existing.ID
+
+		slog.InfoContext(
+			ctx,
+			"Document changed since it was processed",
+			"previousID",
+			existing.ID,
+			"googleID",
+			document.GoogleID,
+			"revision",
+			document.HeadRevisionID,
+			"version",
+			document.Version,
+		)
+
+		if isInFlight(existing) {
+			err = cfg.supersede(ctx, existing, document)
+			if err != nil {
+				slog.ErrorContext(
+					ctx,
+					"Failed to supersede the document being processed",
+					"id",
+					existing.ID,
+					"error",
+					err,
+				)
+				return err
+			}
+		}
+	}
+
+	// the sidecar can be in the same batch or already in the folder
+	err = cfg.attachSidecar(ctx, document, foundInFolderID, file)
+	if err != nil {
+		slog.ErrorContext(
+			ctx,
+			"Failed to read the sidecar of the document",
+			"docName",
+			document.Name,
+			"error",
+			err,
+		)
+		return err
+	}
+
+	// name the execution after the document so it can be found later,
+	// before saving it so a skipped start doesn't record the version
+	executionName, err := util.ResolveExecutionName(
+		ctx,
+		cfg.sfnClient,
+		cfg.stateMachineARN,
+		document,
+	)
+	if errors.Is(err, util.ErrExecutionInProgress) {
+		slog.WarnContext(
+			ctx,
+			"Execution for the document is already running",
+			"id",
+			document.ID,
+			"name",
+			document.Name,
+		)
+		return nil
+	}
+	if err != nil {
+		slog.ErrorContext(
+			ctx,
+			"Failed to resolve the execution name for the document",
+			"docName",
+			document.Name,
+			"error",
+			err,
+		)
+		return err
+	}
+
+	held := document.Directives != nil && document.Directives.Hold
+	if held {
+		document.Status = types.DOCUMENT_STATUS_HELD
+	}
+
+	// Save the Google Drive document information along with its pending
+	// download stage. The ID follows the revision, so when another
+	// notification already saved it that one starts the workflow.
+	err = cfg.docStore.InsertDocumentWithStage(
+		ctx,
+		document,
+		&types.DocumentProcessingStage{
+			ID:               document.ID,
+			Stage:            types.DOCUMENT_STAGE_DOWNLOAD,
+			StageStatus:      types.DOCUMENT_STATUS_PENDING,
+			OriginalFileName: document.Name,
+		},
+	)
+	if errors.Is(err, database.ErrDocumentExists) {
+		return cfg.startSavedRevision(ctx, notification.NotificationID, document)
+	}
+	if err != nil {
+		slog.ErrorContext(
+			ctx,
+			"Failed to save the document metadata",
+			"docName",
+			document.Name,
+			"error",
+			err,
+		)
+		return err
+	}
+
+	if held {
+		slog.InfoContext(
+			ctx,
+			"Holding the document until its sidecar releases it",
+			"id",
+			document.ID,
+			"name",
+			document.Name,
+		)
+		return nil
+	}
+
+	return cfg.startOrDefer(ctx, notification.NotificationID, document, executionName)
+}
+
+// Each message is processed on its own. The messages that failed are
+// reported back so SQS only delivers those again, instead of the whole
+// batch.
+func process(ctx context.Context, sqsEvent events.SQSEvent) (events.SQSEventResponse, error) {
+	slog.Debug(">>process")
+	defer slog.Debug("<<process")
+
+	response := events.SQSEventResponse{
+		BatchItemFailures: make([]events.SQSBatchItemFailure, 0),
+	}
+
+	if err := initLambda(ctx); err != nil {
+		slog.ErrorContext(ctx, "Failed to initialize the lambda", "error", err)
+		return response, err
+	}
+
+	for _, message := range sqsEvent.Records {
+		// every log line of the message carries the trace of the webhook
+		// request that queued it
+		ctx := util.WithTrace(ctx, util.TraceFromMessage(message))
+
+		if err := processNotification(ctx, message); err != nil {
+			slog.ErrorContext(
+				ctx,
+				"Failed to process the SQS message",
+				"messageID",
+				message.MessageId,
+				"error",
+				err,
+			)
+			response.BatchItemFailures = append(
+				response.BatchItemFailures,
+				events.SQSBatchItemFailure{ItemIdentifier: message.MessageId},
+			)
+		}
+	}
+
+	metrics.Record(metrics.FAILED_MESSAGES, float64(len(response.BatchItemFailures)), nil)
+
+	return response, nil
+}
+
+func main() {
+	slog.SetDefault(slog.New(util.NewTraceHandler(slog.NewTextHandler(os.Stderr, nil))))
+
 	slog.Debug(">>main")
 	defer slog.Debug("<<main")
 
@@ -0,0 +1,1924 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/service/sfn"
+	sfntypes "github.com/aws/aws-sdk-go-v2/service/sfn/types"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	sqstypes "github.com/aws/aws-sdk-go-v2/service/sqs/types"
+
+	"github.com/KyleBrandon/scriptor/lambdas/util"
+	"github.com/KyleBrandon/scriptor/pkg/database"
+	"github.com/KyleBrandon/scriptor/pkg/types"
+)
+
+func TestIsNewRevision(t *testing.T) {
+	processed := time.Date(2026, 3, 11, 23, 30, 0, 0, time.UTC)
+
+	tests := []struct {
+		name     string
+		existing string
+		current  string
+		modified time.Time
+		want     bool
+	}{
+		{
+			name:     "same revision",
+			existing: "rev-1",
+			current:  "rev-1",
+		},
+		{
+			name:     "file edited",
+			existing: "rev-1",
+			current:  "rev-2",
+			want:     true,
+		},
+		{
+			name:    "processed before revisions were recorded",
+			current: "rev-2",
+		},
+		{
+			name:     "revision not reported",
+			existing: "rev-1",
+			modified: processed,
+		},
+		{
+			name:     "same revision modified later",
+			existing: "rev-1",
+			current:  "rev-1",
+			modified: processed.Add(time.Hour),
+		},
+		{
+			name:     "modified without revisions",
+			modified: processed.Add(time.Hour),
+			want:     true,
+		},
+		{
+			name:     "revision not reported and modified",
+			existing: "rev-1",
+			modified: processed.Add(time.Hour),
+			want:     true,
+		},
+		{
+			name:     "unmodified without revisions",
+			modified: processed,
+		},
+		{
+			name:     "modified before the version processed",
+			modified: processed.Add(-time.Hour),
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got := isNewRevision(
+				&types.Document{HeadRevisionID: tc.existing, ModifiedTime: processed},
+				&types.Document{HeadRevisionID: tc.current, ModifiedTime: tc.modified},
+			)
+			if got != tc.want {
+				t.Fatalf("unexpected result: got %v want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+// A document table that only knows the documents by Google ID, recording
+// the documents superseded. The IDs in taken were saved by another writer.
+type fakeDocumentStore struct {
+	database.DocumentStore
+	mu         sync.Mutex
+	byGoogleID map[string]*types.Document
+	superseded map[string]string
+	taken      map[string]bool
+	slots      map[string]bool
+	statuses   map[string]string
+	stages     map[string]*types.DocumentProcessingStage
+}
+
+func (s *fakeDocumentStore) GetDocumentByGoogleID(
+	ctx context.Context,
+	googleFileID string,
+) (*types.Document, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	document, ok := s.byGoogleID[googleFileID]
+	if !ok {
+		return nil, database.ErrDocumentNotFound
+	}
+
+	return document, nil
+}
+
+func (s *fakeDocumentStore) InsertDocument(ctx context.Context, document *types.Document) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.taken[document.ID] {
+		return database.ErrDocumentExists
+	}
+
+	s.byGoogleID[document.GoogleID] = document
+	return nil
+}
+
+// The stage is only kept when the document is
+func (s *fakeDocumentStore) InsertDocumentWithStage(
+	ctx context.Context,
+	document *types.Document,
+	stage *types.DocumentProcessingStage,
+) error {
+	if err := s.InsertDocument(ctx, document); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.stages == nil {
+		s.stages = make(map[string]*types.DocumentProcessingStage)
+	}
+	s.stages[document.ID] = stage
+	return nil
+}
+
+// Only the fields of the update are saved on the document
+func (s *fakeDocumentStore) UpdateDocumentFields(
+	ctx context.Context,
+	id string,
+	update *types.DocumentUpdate,
+) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, document := range s.byGoogleID {
+		if document.ID == id {
+			document.Directives = update.Directives
+			document.Sidecar = update.Sidecar
+			return nil
+		}
+	}
+
+	return database.ErrDocumentNotFound
+}
+
+func (s *fakeDocumentStore) ReleaseHeldDocument(ctx context.Context, id string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, document := range s.byGoogleID {
+		if document.ID == id && document.Status == types.DOCUMENT_STATUS_HELD {
+			document.Status = types.DOCUMENT_STATUS_PENDING
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+func (s *fakeDocumentStore) GetDocument(ctx context.Context, id string) (*types.Document, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, document := range s.byGoogleID {
+		if document.ID == id {
+			return document, nil
+		}
+	}
+
+	return nil, database.ErrDocumentNotFound
+}
+
+func (s *fakeDocumentStore) UpdateDocumentStatus(ctx context.Context, id string, stage types.Stage, status string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.statuses == nil {
+		s.statuses = make(map[string]string)
+	}
+
+	s.statuses[id] = status
+	return nil
+}
+
+func (s *fakeDocumentStore) HoldExecutionSlot(ctx context.Context, id string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.slots == nil {
+		s.slots = make(map[string]bool)
+	}
+
+	if s.slots[id] {
+		return false, nil
+	}
+
+	s.slots[id] = true
+	return true, nil
+}
+
+func (s *fakeDocumentStore) ReleaseExecutionSlot(ctx context.Context, id string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.slots[id] {
+		return false, nil
+	}
+
+	delete(s.slots, id)
+	return true, nil
+}
+
+func (s *fakeDocumentStore) SupersedeDocument(ctx context.Context, id, newerID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.superseded == nil {
+		s.superseded = make(map[string]string)
+	}
+
+	s.superseded[id] = newerID
+	return nil
+}
+
+func TestParseDocumentConcurrency(t *testing.T) {
+	tests := []struct {
+		name    string
+		setting string
+		want    int
+		wantErr bool
+	}{
+		{name: "default", want: DEFAULT_DOCUMENT_CONCURRENCY},
+		{name: "set", setting: "10", want: 10},
+		{name: "zero", setting: "0", wantErr: true},
+		{name: "not a number", setting: "many", wantErr: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := parseDocumentConcurrency(func(string) string { return tc.setting })
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if got != tc.want {
+				t.Fatalf("unexpected concurrency: got %d want %d", got, tc.want)
+			}
+		})
+	}
+}
+
+// Every document of the notification is attempted, and no more than the
+// configured number are processed at the same time
+func TestStartDocumentsIsBounded(t *testing.T) {
+	initOnce.Do(func() {})
+
+	store := &blockingStore{
+		fakeDocumentStore: fakeDocumentStore{byGoogleID: map[string]*types.Document{}},
+		entered:           make(chan struct{}),
+		release:           make(chan struct{}),
+	}
+	starter := &fakeStarter{
+		rejected:   map[string]bool{"doc-2": true},
+		executions: map[string]sfntypes.ExecutionStatus{},
+	}
+	cfg = &handlerConfig{
+		store:    &fakeChannelStore{},
+		docStore: store,
+		dc:       &fakeChanges{},
+		history:  &fakeHistoryStore{},
+
+		sfnClient:           starter,
+		documentConcurrency: 2,
+	}
+
+	documents := make([]*types.Document, 0, 6)
+	for i := range 6 {
+		id := fmt.Sprintf("doc-%d", i)
+		documents = append(documents, &types.Document{ID: id, GoogleID: id, Name: id + ".pdf"})
+	}
+
+	done := make(chan error)
+	go func() {
+		done <- cfg.startDocuments(
+			context.Background(),
+			types.ChannelNotification{ChannelID: "channel-1", FolderID: "watch"},
+			documents,
+			make([]*types.SidecarFile, len(documents)),
+		)
+	}()
+
+	// let the documents through one at a time once the pool is full
+	for range documents {
+		<-store.entered
+		store.release <- struct{}{}
+	}
+
+	err := <-done
+	if err == nil || !strings.Contains(err.Error(), "doc-2.pdf") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if store.peak > cfg.documentConcurrency {
+		t.Fatalf("too many documents at once: %d", store.peak)
+	}
+
+	slices.Sort(starter.started)
+	want := []string{"doc-0", "doc-1", "doc-3", "doc-4", "doc-5"}
+	if !slices.Equal(starter.started, want) {
+		t.Fatalf("unexpected documents started: got %v want %v", starter.started, want)
+	}
+}
+
+// A document table that holds each insert until it is released, recording
+// the most inserts waiting at once
+type blockingStore struct {
+	fakeDocumentStore
+	entered chan struct{}
+	release chan struct{}
+	active  atomic.Int32
+	peak    int
+}
+
+func (s *blockingStore) InsertDocument(ctx context.Context, document *types.Document) error {
+	active := int(s.active.Add(1))
+	defer s.active.Add(-1)
+
+	s.mu.Lock()
+	s.peak = max(s.peak, active)
+	s.mu.Unlock()
+
+	s.entered <- struct{}{}
+	<-s.release
+
+	return s.fakeDocumentStore.InsertDocument(ctx, document)
+}
+
+func (s *blockingStore) InsertDocumentWithStage(
+	ctx context.Context,
+	document *types.Document,
+	stage *types.DocumentProcessingStage,
+) error {
+	return s.InsertDocument(ctx, document)
+}
+
+func TestProcessedDocument(t *testing.T) {
+	// skip loading the AWS configuration
+	initOnce.Do(func() {})
+
+	store := &fakeDocumentStore{byGoogleID: map[string]*types.Document{
+		"recorded": {ID: "doc-1", HeadRevisionID: "rev-1"},
+	}}
+
+	tests := []struct {
+		name     string
+		dedupe   bool
+		document *types.Document
+		wantID   string
+		wantErr  error
+	}{
+		{
+			name:     "recorded in the table",
+			document: &types.Document{GoogleID: "recorded", TaggedDocumentID: "doc-9"},
+			wantID:   "doc-1",
+		},
+		{
+			name:     "tag ignored when the check is off",
+			document: &types.Document{GoogleID: "tagged", TaggedDocumentID: "doc-2"},
+			wantErr:  database.ErrDocumentNotFound,
+		},
+		{
+			name:     "tag used when the table misses",
+			dedupe:   true,
+			document: &types.Document{GoogleID: "tagged", TaggedDocumentID: "doc-2"},
+			wantID:   "doc-2",
+		},
+		{
+			name:     "untagged file",
+			dedupe:   true,
+			document: &types.Document{GoogleID: "new"},
+			wantErr:  database.ErrDocumentNotFound,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg = &handlerConfig{docStore: store, dedupeWithProperties: tc.dedupe}
+
+			existing, err := processedDocument(context.Background(), tc.document)
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("unexpected error: got %v want %v", err, tc.wantErr)
+			}
+
+			if tc.wantErr == nil && existing.ID != tc.wantID {
+				t.Fatalf("unexpected document: got %q want %q", existing.ID, tc.wantID)
+			}
+		})
+	}
+}
+
+func TestTaggedDocumentRevision(t *testing.T) {
+	tagged := taggedDocument(&types.Document{
+		GoogleID:         "file-1",
+		HeadRevisionID:   "rev-2",
+		TaggedDocumentID: "doc-1",
+		TaggedRevisionID: "rev-1",
+	})
+
+	// a file edited since it was tagged is processed again
+	if !isNewRevision(tagged, &types.Document{HeadRevisionID: "rev-2"}) {
+		t.Fatalf("expected the edited file to be a new revision")
+	}
+}
+
+// A channel table that hands out the changes token of every channel unless
+// it is locked, recording the start tokens it was released with
+type fakeChannelStore struct {
+	database.WatchChannelStore
+	mu       sync.Mutex
+	locked   bool
+	tokens   []string
+	channel  *types.WatchChannel
+	active   int
+	cleared  int
+	acquired int
+}
+
+func (s *fakeChannelStore) ClearNotificationPending(ctx context.Context, channelID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.cleared++
+	return nil
+}
+
+func (s *fakeChannelStore) GetWatchChannelByID(
+	ctx context.Context,
+	channelID string,
+) (*types.WatchChannel, error) {
+	if s.channel == nil {
+		return &types.WatchChannel{ChannelID: channelID}, nil
+	}
+
+	return s.channel, nil
+}
+
+func (s *fakeChannelStore) IncrementActiveExecutions(
+	ctx context.Context,
+	channelID string,
+	limit int,
+) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.active >= limit {
+		return database.ErrExecutionLimitReached
+	}
+
+	s.active++
+	return nil
+}
+
+func (s *fakeChannelStore) DecrementActiveExecutions(ctx context.Context, channelID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.active = max(s.active-1, 0)
+	return nil
+}
+
+// The messages queued again
+type fakeSender struct {
+	messages []*sqs.SendMessageInput
+}
+
+func (f *fakeSender) SendMessage(
+	ctx context.Context,
+	params *sqs.SendMessageInput,
+	optFns ...func(*sqs.Options),
+) (*sqs.SendMessageOutput, error) {
+	f.messages = append(f.messages, params)
+	return &sqs.SendMessageOutput{}, nil
+}
+
+func (s *fakeChannelStore) AcquireChangesToken(
+	ctx context.Context,
+	channelID string,
+) (string, error) {
+	s.acquired++
+	if s.locked {
+		return "", database.ErrWatchChannelLockHeld
+	}
+
+	return "token", nil
+}
+
+func (s *fakeChannelStore) ReleaseChangesToken(
+	ctx context.Context,
+	channelID, newStartToken string,
+) error {
+	s.tokens = append(s.tokens, newStartToken)
+	return nil
+}
+
+// Drive changes that fail for the folders listed. The documents and
+// sidecars are reported as changed, the files and folderSidecars are only
+// found by name, and the listing is every file in the folder.
+type fakeChanges struct {
+	failing map[string]bool
+	queried []string
+	listed  []string
+
+	listing []*types.Document
+
+	documents      []*types.Document
+	sidecars       []*types.SidecarFile
+	removed        []string
+	files          map[string]*types.Document
+	folderSidecars map[string]*types.SidecarFile
+	contents       map[string]string
+}
+
+func (c *fakeChanges) QueryChanges(
+	ctx context.Context,
+	folderID, driveID, startToken string,
+	recursive bool,
+) (*types.DocumentChanges, error) {
+	c.queried = append(c.queried, folderID)
+	if c.failing[folderID] {
+		return nil, errors.New("drive unavailable")
+	}
+
+	return &types.DocumentChanges{
+		Documents:      c.documents,
+		Sidecars:       c.sidecars,
+		Removed:        c.removed,
+		NextStartToken: "next",
+	}, nil
+}
+
+func (c *fakeChanges) ListFolder(
+	ctx context.Context,
+	folderID, driveID string,
+	recursive bool,
+) (*types.DocumentChanges, error) {
+	c.listed = append(c.listed, folderID)
+	if c.failing[folderID] {
+		return nil, errors.New("drive unavailable")
+	}
+
+	return &types.DocumentChanges{Documents: c.listing}, nil
+}
+
+func (c *fakeChanges) FindSidecar(
+	ctx context.Context,
+	folderID, documentName string,
+) (*types.SidecarFile, error) {
+	file := c.folderSidecars[documentName]
+	if file == nil || file.FolderID != folderID {
+		return nil, nil
+	}
+
+	return file, nil
+}
+
+func (c *fakeChanges) ReadSidecar(ctx context.Context, id string) (string, error) {
+	return c.contents[id], nil
+}
+
+func (c *fakeChanges) FindDocument(
+	ctx context.Context,
+	folderID, name string,
+) (*types.Document, error) {
+	return c.files[name], nil
+}
+
+func TestProcessReportsFailedMessages(t *testing.T) {
+	// skip loading the AWS configuration
+	initOnce.Do(func() {})
+
+	store := &fakeChannelStore{}
+	changes := &fakeChanges{failing: map[string]bool{"folder-1": true}}
+	cfg = &handlerConfig{store: store, dc: changes}
+
+	event := events.SQSEvent{Records: []events.SQSMessage{
+		{MessageId: "message-1", Body: `{"channel_id":"channel-1","folder_id":"folder-1"}`},
+		{MessageId: "message-2", Body: `{"channel_id":"channel-2","folder_id":"folder-2"}`},
+	}}
+
+	response, err := process(context.Background(), event)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	want := []events.SQSBatchItemFailure{{ItemIdentifier: "message-1"}}
+	if !slices.Equal(response.BatchItemFailures, want) {
+		t.Fatalf("unexpected failures: got %v want %v", response.BatchItemFailures, want)
+	}
+
+	// the failure doesn't stop the rest of the batch
+	if !slices.Equal(changes.queried, []string{"folder-1", "folder-2"}) {
+		t.Fatalf("unexpected folders queried: %v", changes.queried)
+	}
+}
+
+// A state machine with the executions listed by name that records the
+// documents started and the executions stopped, or fails to start them.
+// The names in raced are started by someone else once they were looked up,
+// and the documents in rejected fail to start.
+type fakeStarter struct {
+	mu         sync.Mutex
+	failing    bool
+	raced      map[string]bool
+	rejected   map[string]bool
+	executions map[string]sfntypes.ExecutionStatus
+	started    []string
+	stopped    []string
+	steps      []types.DocumentStep
+}
+
+// The name is the last part of the execution ARN
+func executionName(arn *string) string {
+	return (*arn)[strings.LastIndex(*arn, ":")+1:]
+}
+
+func (f *fakeStarter) DescribeExecution(
+	ctx context.Context,
+	params *sfn.DescribeExecutionInput,
+	optFns ...func(*sfn.Options),
+) (*sfn.DescribeExecutionOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	status, ok := f.executions[executionName(params.ExecutionArn)]
+	if !ok {
+		return nil, &sfntypes.ExecutionDoesNotExist{}
+	}
+
+	return &sfn.DescribeExecutionOutput{Status: status}, nil
+}
+
+func (f *fakeStarter) StopExecution(
+	ctx context.Context,
+	params *sfn.StopExecutionInput,
+	optFns ...func(*sfn.Options),
+) (*sfn.StopExecutionOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	name := executionName(params.ExecutionArn)
+	f.executions[name] = sfntypes.ExecutionStatusAborted
+	f.stopped = append(f.stopped, name)
+
+	return &sfn.StopExecutionOutput{}, nil
+}
+
+func (f *fakeStarter) StartExecution(
+	ctx context.Context,
+	params *sfn.StartExecutionInput,
+	optFns ...func(*sfn.Options),
+) (*sfn.StartExecutionOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var step types.DocumentStep
+	if err := json.Unmarshal([]byte(*params.Input), &step); err != nil {
+		return nil, err
+	}
+
+	if f.failing || f.rejected[step.DocumentID] {
+		return nil, errors.New("state machine unavailable")
+	}
+
+	if f.raced[*params.Name] {
+		return nil, &sfntypes.ExecutionAlreadyExists{}
+	}
+
+	f.started = append(f.started, step.DocumentID)
+	f.steps = append(f.steps, step)
+	return &sfn.StartExecutionOutput{}, nil
+}
+
+func TestProcessNotification(t *testing.T) {
+	// skip loading the AWS configuration
+	initOnce.Do(func() {})
+
+	scan := func() *types.Document {
+		return &types.Document{
+			ID:             "doc-1",
+			GoogleID:       "file-1",
+			Name:           "scan.pdf",
+			MimeType:       types.CONTENT_TYPE_PDF,
+			HeadRevisionID: "rev-1",
+		}
+	}
+	revision := func() *types.Document {
+		return &types.Document{
+			ID:             "doc-2",
+			GoogleID:       "file-1",
+			Name:           "scan.pdf",
+			MimeType:       types.CONTENT_TYPE_PDF,
+			HeadRevisionID: "rev-2",
+		}
+	}
+	execution := util.BuildExecutionName(scan())
+	processed := time.Date(2026, 3, 11, 23, 30, 0, 0, time.UTC)
+	unversioned := func(id string, modified time.Time) *types.Document {
+		return &types.Document{
+			ID:           id,
+			GoogleID:     "file-1",
+			Name:         "scan.pdf",
+			MimeType:     types.CONTENT_TYPE_PDF,
+			Status:       types.DOCUMENT_STATUS_COMPLETE,
+			ModifiedTime: modified,
+		}
+	}
+	file := func(id, name, mimeType string) *types.Document {
+		return &types.Document{ID: id, GoogleID: id, Name: name, MimeType: mimeType}
+	}
+	mixed := func() []*types.Document {
+		return []*types.Document{
+			file("doc-3", "notes.docx", "application/vnd.openxmlformats-officedocument.wordprocessingml.document"),
+			file("doc-4", "photo.heic", types.CONTENT_TYPE_HEIC),
+			file("doc-5", "budget", "application/vnd.google-apps.spreadsheet"),
+			file("doc-6", "scan.tiff", types.CONTENT_TYPE_TIFF),
+			file("doc-7", "~scan.pdf.tmp", "application/octet-stream"),
+		}
+	}
+
+	tests := []struct {
+		name       string
+		documents  []*types.Document
+		recorded   *types.Document
+		pending    bool
+		executions map[string]sfntypes.ExecutionStatus
+		channel    *types.WatchChannel
+		taken      map[string]bool
+		raced      map[string]bool
+		rejected   map[string]bool
+		locked     bool
+		queryFails bool
+		failing    bool
+
+		wantErr        bool
+		wantStarts     []string
+		wantTokens     []string
+		wantSuperseded map[string]string
+		wantStopped    []string
+
+		// started when the notification is delivered again
+		wantRetryStarts []string
+	}{
+		{
+			name:       "no documents",
+			wantTokens: []string{"next"},
+		},
+		{
+			name:       "new document",
+			documents:  []*types.Document{scan()},
+			wantStarts: []string{"doc-1"},
+			wantTokens: []string{"next"},
+		},
+		{
+			name:       "unsupported file types",
+			documents:  mixed(),
+			wantStarts: []string{"doc-4", "doc-6"},
+			wantTokens: []string{"next"},
+		},
+		{
+			name:       "file types allowed by the channel",
+			documents:  mixed(),
+			channel:    &types.WatchChannel{AllowedMimeTypes: []string{"application/octet-stream", "image/*"}},
+			wantStarts: []string{"doc-4", "doc-6", "doc-7"},
+			wantTokens: []string{"next"},
+		},
+		{
+			name:       "only unsupported file types",
+			documents:  []*types.Document{file("doc-3", "notes.txt", "text/plain")},
+			wantTokens: []string{"next"},
+		},
+		{
+			name:      "document already processed",
+			documents: []*types.Document{scan()},
+			recorded: &types.Document{
+				ID:             "doc-1",
+				GoogleID:       "file-1",
+				HeadRevisionID: "rev-1",
+				Status:         types.DOCUMENT_STATUS_COMPLETE,
+				CurrentStage:   types.DOCUMENT_STAGE_UPLOAD,
+			},
+			wantTokens: []string{"next"},
+		},
+		{
+			// the start failed after the revision was saved
+			name:       "revision saved without its workflow",
+			documents:  []*types.Document{scan()},
+			recorded:   scan(),
+			pending:    true,
+			wantStarts: []string{"doc-1"},
+			wantTokens: []string{"next"},
+		},
+		{
+			name:      "saved revision whose workflow is running",
+			documents: []*types.Document{scan()},
+			recorded:  scan(),
+			pending:   true,
+			executions: map[string]sfntypes.ExecutionStatus{
+				execution: sfntypes.ExecutionStatusRunning,
+			},
+			wantTokens: []string{"next"},
+		},
+		{
+			name:      "new revision while the document is processed",
+			documents: []*types.Document{revision()},
+			recorded:  scan(),
+			executions: map[string]sfntypes.ExecutionStatus{
+				execution: sfntypes.ExecutionStatusRunning,
+			},
+			wantStarts:     []string{"doc-2"},
+			wantTokens:     []string{"next"},
+			wantSuperseded: map[string]string{"doc-1": "doc-2"},
+			wantStopped:    []string{execution},
+		},
+		{
+			name:           "new revision of a held document",
+			documents:      []*types.Document{revision()},
+			recorded:       &types.Document{ID: "doc-1", GoogleID: "file-1", HeadRevisionID: "rev-1", Status: types.DOCUMENT_STATUS_HELD},
+			wantStarts:     []string{"doc-2"},
+			wantTokens:     []string{"next"},
+			wantSuperseded: map[string]string{"doc-1": "doc-2"},
+		},
+		{
+			name:      "new revision after the document was processed",
+			documents: []*types.Document{revision()},
+			recorded:  &types.Document{ID: "doc-1", GoogleID: "file-1", HeadRevisionID: "rev-1", Status: types.DOCUMENT_STATUS_COMPLETE},
+			executions: map[string]sfntypes.ExecutionStatus{
+				execution: sfntypes.ExecutionStatusSucceeded,
+			},
+			wantStarts: []string{"doc-2"},
+			wantTokens: []string{"next"},
+		},
+		{
+			name:       "unmodified file without revisions",
+			documents:  []*types.Document{unversioned("doc-2", processed)},
+			recorded:   unversioned("doc-1", processed),
+			wantTokens: []string{"next"},
+		},
+		{
+			name:       "modified file without revisions",
+			documents:  []*types.Document{unversioned("doc-2", processed.Add(time.Hour))},
+			recorded:   unversioned("doc-1", processed),
+			wantStarts: []string{"doc-2"},
+			wantTokens: []string{"next"},
+		},
+		{
+			name:       "revision saved by another notification",
+			documents:  []*types.Document{scan()},
+			taken:      map[string]bool{"doc-1": true},
+			wantTokens: []string{"next"},
+		},
+		{
+			name:       "revision started by another notification",
+			documents:  []*types.Document{scan()},
+			raced:      map[string]bool{execution: true},
+			wantTokens: []string{"next"},
+		},
+		{
+			name:            "state machine fails to start",
+			documents:       []*types.Document{scan()},
+			failing:         true,
+			wantErr:         true,
+			wantTokens:      []string{""},
+			wantRetryStarts: []string{"doc-1"},
+		},
+		{
+			name: "documents that fail don't stop the rest",
+			documents: []*types.Document{
+				file("doc-3", "first.pdf", types.CONTENT_TYPE_PDF),
+				file("doc-4", "second.pdf", types.CONTENT_TYPE_PDF),
+				file("doc-5", "third.pdf", types.CONTENT_TYPE_PDF),
+				file("doc-6", "fourth.pdf", types.CONTENT_TYPE_PDF),
+			},
+			rejected:   map[string]bool{"doc-4": true, "doc-6": true},
+			wantErr:    true,
+			wantStarts: []string{"doc-3", "doc-5"},
+			wantTokens: []string{""},
+		},
+		{
+			name:       "changes fail to query",
+			documents:  []*types.Document{scan()},
+			queryFails: true,
+			wantErr:    true,
+			wantTokens: []string{""},
+		},
+		{
+			name:    "channel locked by another notification",
+			locked:  true,
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			store := &fakeDocumentStore{
+				byGoogleID: map[string]*types.Document{},
+				taken:      tc.taken,
+			}
+			if tc.recorded != nil {
+				store.byGoogleID["file-1"] = tc.recorded
+			}
+
+			// the recorded revision was saved with its download pending
+			if tc.pending {
+				store.stages = map[string]*types.DocumentProcessingStage{
+					tc.recorded.ID: {
+						ID:          tc.recorded.ID,
+						Stage:       types.DOCUMENT_STAGE_DOWNLOAD,
+						StageStatus: types.DOCUMENT_STATUS_PENDING,
+					},
+				}
+			}
+
+			if tc.executions == nil {
+				tc.executions = make(map[string]sfntypes.ExecutionStatus)
+			}
+
+			channels := &fakeChannelStore{locked: tc.locked, channel: tc.channel}
+			starter := &fakeStarter{
+				failing:    tc.failing,
+				raced:      tc.raced,
+				rejected:   tc.rejected,
+				executions: tc.executions,
+			}
+			cfg = &handlerConfig{
+				store:    channels,
+				docStore: store,
+				dc: &fakeChanges{
+					documents: tc.documents,
+					failing:   map[string]bool{"watch": tc.queryFails},
+				},
+				history: &fakeHistoryStore{},
+
+				sfnClient: starter,
+			}
+
+			message := events.SQSMessage{
+				MessageId: "message-1",
+				Body:      `{"channel_id":"channel-1","folder_id":"watch"}`,
+			}
+
+			err := processNotification(context.Background(), message)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			// the documents are started in any order
+			slices.Sort(starter.started)
+			if !slices.Equal(starter.started, tc.wantStarts) {
+				t.Fatalf("unexpected documents started: got %v want %v", starter.started, tc.wantStarts)
+			}
+
+			// each document started was saved with its download pending
+			for _, id := range starter.started {
+				stage := store.stages[id]
+				if stage == nil ||
+					stage.Stage != types.DOCUMENT_STAGE_DOWNLOAD ||
+					stage.StageStatus != types.DOCUMENT_STATUS_PENDING {
+					t.Fatalf("unexpected stage saved for %s: %+v", id, stage)
+				}
+			}
+
+			// the lock is released on every path once it was acquired, the
+			// token only moves on when the changes were handled
+			if !slices.Equal(channels.tokens, tc.wantTokens) {
+				t.Fatalf("unexpected tokens released: got %q want %q", channels.tokens, tc.wantTokens)
+			}
+
+			// the webhook can queue the next notification once the lock is
+			// taken
+			if channels.cleared != len(tc.wantTokens) {
+				t.Fatalf("unexpected pending notifications cleared: %d", channels.cleared)
+			}
+
+			if !reflect.DeepEqual(store.superseded, tc.wantSuperseded) {
+				t.Fatalf("unexpected documents superseded: got %v want %v", store.superseded, tc.wantSuperseded)
+			}
+
+			if !slices.Equal(starter.stopped, tc.wantStopped) {
+				t.Fatalf("unexpected executions stopped: got %v want %v", starter.stopped, tc.wantStopped)
+			}
+
+			if tc.wantRetryStarts == nil {
+				return
+			}
+
+			// the documents saved by the failed delivery are started by
+			// the next one
+			starter.failing = false
+			err = processNotification(context.Background(), message)
+			if err != nil {
+				t.Fatalf("unexpected error on the retry: %v", err)
+			}
+
+			slices.Sort(starter.started)
+			if !slices.Equal(starter.started, tc.wantRetryStarts) {
+				t.Fatalf("unexpected documents started on the retry: got %v want %v", starter.started, tc.wantRetryStarts)
+			}
+		})
+	}
+}
+
+// The history of each notification, updated by the workers at the same time
+type fakeHistoryStore struct {
+	database.NotificationHistoryStore
+	mu         sync.Mutex
+	documents  []string
+	reasons    []string
+	executions []string
+}
+
+func (s *fakeHistoryStore) RecordNotificationProcessed(
+	ctx context.Context,
+	notificationID string,
+	documentIDs []string,
+	reason string,
+) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.documents = append(s.documents, documentIDs...)
+	s.reasons = append(s.reasons, reason)
+	return nil
+}
+
+func (s *fakeHistoryStore) RecordNotificationExecution(
+	ctx context.Context,
+	notificationID, executionName string,
+) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.executions = append(s.executions, executionName)
+	return nil
+}
+
+func TestProcessRecordsHistory(t *testing.T) {
+	// skip loading the AWS configuration
+	initOnce.Do(func() {})
+
+	scan := &types.Document{
+		ID:       "doc-1",
+		GoogleID: "file-1",
+		Name:     "scan.pdf",
+		MimeType: types.CONTENT_TYPE_PDF,
+	}
+	notes := &types.Document{
+		ID:       "doc-2",
+		GoogleID: "file-2",
+		Name:     "notes.txt",
+		MimeType: "text/plain",
+	}
+
+	tests := []struct {
+		name       string
+		body       string
+		locked     bool
+		queryFails bool
+		failing    bool
+
+		wantDocuments  []string
+		wantFailed     bool
+		wantExecutions []string
+		wantRecorded   bool
+	}{
+		{
+			// unsupported files aren't counted as found
+			name:           "documents started",
+			body:           `{"notification_id":"n-1","channel_id":"channel-1","folder_id":"watch"}`,
+			wantDocuments:  []string{"doc-1"},
+			wantExecutions: []string{util.BuildExecutionName(scan)},
+			wantRecorded:   true,
+		},
+		{
+			name:          "state machine fails to start",
+			body:          `{"notification_id":"n-1","channel_id":"channel-1","folder_id":"watch"}`,
+			failing:       true,
+			wantDocuments: []string{"doc-1"},
+			wantFailed:    true,
+			wantRecorded:  true,
+		},
+		{
+			name:         "changes fail to query",
+			body:         `{"notification_id":"n-1","channel_id":"channel-1","folder_id":"watch"}`,
+			queryFails:   true,
+			wantFailed:   true,
+			wantRecorded: true,
+		},
+		{
+			name:         "channel locked by another notification",
+			body:         `{"notification_id":"n-1","channel_id":"channel-1","folder_id":"watch"}`,
+			locked:       true,
+			wantFailed:   true,
+			wantRecorded: true,
+		},
+		{
+			name: "queued without an ID",
+			body: `{"channel_id":"channel-1","folder_id":"watch"}`,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			history := &fakeHistoryStore{}
+			cfg = &handlerConfig{
+				store:    &fakeChannelStore{locked: tc.locked},
+				docStore: &fakeDocumentStore{byGoogleID: map[string]*types.Document{}},
+				history:  history,
+				dc: &fakeChanges{
+					documents: []*types.Document{scan, notes},
+					failing:   map[string]bool{"watch": tc.queryFails},
+				},
+				sfnClient: &fakeStarter{
+					failing:    tc.failing,
+					executions: map[string]sfntypes.ExecutionStatus{},
+				},
+			}
+
+			message := events.SQSMessage{MessageId: "message-1", Body: tc.body}
+			err := processNotification(context.Background(), message)
+			if (err != nil) != tc.wantFailed {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if recorded := len(history.reasons) == 1; recorded != tc.wantRecorded {
+				t.Fatalf("unexpected history: %q", history.reasons)
+			}
+			if tc.wantRecorded && (history.reasons[0] != "") != tc.wantFailed {
+				t.Fatalf("unexpected reason: %q", history.reasons[0])
+			}
+
+			if !slices.Equal(history.documents, tc.wantDocuments) {
+				t.Fatalf("unexpected documents: got %v want %v", history.documents, tc.wantDocuments)
+			}
+
+			if !slices.Equal(history.executions, tc.wantExecutions) {
+				t.Fatalf("unexpected executions: got %v want %v", history.executions, tc.wantExecutions)
+			}
+		})
+	}
+}
+
+func TestProcessMarksRemovedDocuments(t *testing.T) {
+	// skip loading the AWS configuration
+	initOnce.Do(func() {})
+
+	file := func(id, googleID, status string) *types.Document {
+		return &types.Document{
+			ID:             id,
+			GoogleID:       googleID,
+			Name:           googleID + ".pdf",
+			MimeType:       types.CONTENT_TYPE_PDF,
+			HeadRevisionID: "rev-1",
+			Status:         status,
+		}
+	}
+
+	// file-1 is new, file-2 and file-3 were recorded and then trashed or
+	// removed, file-4 was replaced by a newer revision before it was
+	// removed, and output-1 was never recorded
+	store := &fakeDocumentStore{byGoogleID: map[string]*types.Document{
+		"file-2": file("doc-2", "file-2", types.DOCUMENT_STATUS_COMPLETE),
+		"file-3": file("doc-3", "file-3", types.DOCUMENT_STATUS_PENDING),
+		"file-4": file("doc-4", "file-4", types.DOCUMENT_STATUS_SUPERSEDED),
+	}}
+	channels := &fakeChannelStore{}
+	starter := &fakeStarter{executions: map[string]sfntypes.ExecutionStatus{}}
+	cfg = &handlerConfig{
+		store:    channels,
+		docStore: store,
+		history:  &fakeHistoryStore{},
+		dc: &fakeChanges{
+			documents: []*types.Document{file("doc-1", "file-1", "")},
+			removed:   []string{"file-2", "file-3", "file-4", "output-1"},
+		},
+		sfnClient: starter,
+	}
+
+	message := events.SQSMessage{
+		MessageId: "message-1",
+		Body:      `{"notification_id":"n-1","channel_id":"channel-1","folder_id":"watch","resource_state":"trash"}`,
+	}
+
+	err := processNotification(context.Background(), message)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// only the added file is started
+	if !slices.Equal(starter.started, []string{"doc-1"}) {
+		t.Fatalf("unexpected documents started: %v", starter.started)
+	}
+
+	want := map[string]string{
+		"doc-2": types.DOCUMENT_STATUS_DELETED,
+		"doc-3": types.DOCUMENT_STATUS_DELETED,
+	}
+	if !maps.Equal(store.statuses, want) {
+		t.Fatalf("unexpected statuses: got %v want %v", store.statuses, want)
+	}
+
+	if !slices.Equal(channels.tokens, []string{"next"}) {
+		t.Fatalf("unexpected tokens released: %q", channels.tokens)
+	}
+}
+
+func TestProcessBaselineScan(t *testing.T) {
+	// skip loading the AWS configuration
+	initOnce.Do(func() {})
+
+	file := func(id, googleID string) *types.Document {
+		return &types.Document{
+			ID:             id,
+			GoogleID:       googleID,
+			Name:           googleID + ".pdf",
+			MimeType:       types.CONTENT_TYPE_PDF,
+			HeadRevisionID: "rev-1",
+		}
+	}
+
+	tests := []struct {
+		name       string
+		locked     bool
+		listFails  bool
+		wantErr    bool
+		wantStarts []string
+	}{
+		{
+			// the file processed before the channel was registered again
+			// is skipped
+			name:       "files in the folder",
+			wantStarts: []string{"doc-2"},
+		},
+		{
+			// the changes token isn't used, so the lock isn't needed
+			name:       "channel locked by another notification",
+			locked:     true,
+			wantStarts: []string{"doc-2"},
+		},
+		{
+			name:      "folder fails to list",
+			listFails: true,
+			wantErr:   true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			processed := file("doc-1", "file-1")
+			processed.Status = types.DOCUMENT_STATUS_COMPLETE
+
+			store := &fakeDocumentStore{
+				byGoogleID: map[string]*types.Document{"file-1": processed},
+			}
+			channels := &fakeChannelStore{locked: tc.locked}
+			changes := &fakeChanges{
+				listing: []*types.Document{file("doc-1", "file-1"), file("doc-2", "file-2")},
+				failing: map[string]bool{"watch": tc.listFails},
+			}
+			starter := &fakeStarter{executions: map[string]sfntypes.ExecutionStatus{}}
+			history := &fakeHistoryStore{}
+			cfg = &handlerConfig{
+				store:     channels,
+				docStore:  store,
+				history:   history,
+				dc:        changes,
+				sfnClient: starter,
+			}
+
+			message := events.SQSMessage{
+				MessageId: "message-1",
+				Body:      `{"notification_id":"n-1","channel_id":"channel-1","folder_id":"watch","kind":"baseline"}`,
+			}
+
+			err := processNotification(context.Background(), message)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if !slices.Equal(starter.started, tc.wantStarts) {
+				t.Fatalf("unexpected documents started: got %v want %v", starter.started, tc.wantStarts)
+			}
+
+			// only the folder is listed, the changes and their token are
+			// left for the next change notification
+			if !slices.Equal(changes.listed, []string{"watch"}) || len(changes.queried) != 0 ||
+				len(channels.tokens) != 0 {
+				t.Fatalf("unexpected queries: listed %v queried %v tokens %v", changes.listed, changes.queried, channels.tokens)
+			}
+
+			if len(history.reasons) != 1 || (history.reasons[0] != "") != tc.wantErr {
+				t.Fatalf("unexpected history: %q", history.reasons)
+			}
+		})
+	}
+}
+
+func TestProcessThrottlesExecutions(t *testing.T) {
+	// skip loading the AWS configuration
+	initOnce.Do(func() {})
+
+	tests := []struct {
+		name    string
+		active  int
+		failing bool
+
+		wantErr      bool
+		wantStarts   []string
+		wantActive   int
+		wantSlot     bool
+		wantDeferred bool
+	}{
+		{
+			name:       "below the limit",
+			active:     1,
+			wantStarts: []string{"doc-1"},
+			wantActive: 2,
+			wantSlot:   true,
+		},
+		{
+			name:         "at the limit",
+			active:       2,
+			wantActive:   2,
+			wantDeferred: true,
+		},
+		{
+			// the slot is given back so the retry can take it
+			name:       "state machine fails to start",
+			failing:    true,
+			wantErr:    true,
+			wantActive: 0,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			store := &fakeDocumentStore{byGoogleID: map[string]*types.Document{}}
+			channels := &fakeChannelStore{
+				channel: &types.WatchChannel{ChannelID: "channel-1", MaxConcurrentExecutions: 2},
+				active:  tc.active,
+			}
+			starter := &fakeStarter{
+				failing:    tc.failing,
+				executions: map[string]sfntypes.ExecutionStatus{},
+			}
+			sender := &fakeSender{}
+			cfg = &handlerConfig{
+				store:    channels,
+				docStore: store,
+				dc: &fakeChanges{documents: []*types.Document{{
+					ID:       "doc-1",
+					GoogleID: "file-1",
+					Name:     "scan.pdf",
+					MimeType: types.CONTENT_TYPE_PDF,
+				}}},
+				history: &fakeHistoryStore{},
+
+				sfnClient: starter,
+				sqsClient: sender,
+				queueURL:  "queue",
+			}
+
+			message := events.SQSMessage{
+				MessageId: "message-1",
+				Body:      `{"notification_id":"n-1","channel_id":"channel-1","folder_id":"watch"}`,
+			}
+
+			err := processNotification(context.Background(), message)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if !slices.Equal(starter.started, tc.wantStarts) {
+				t.Fatalf("unexpected documents started: got %v want %v", starter.started, tc.wantStarts)
+			}
+
+			if channels.active != tc.wantActive {
+				t.Fatalf("unexpected executions counted: got %d want %d", channels.active, tc.wantActive)
+			}
+
+			if store.slots["doc-1"] != tc.wantSlot {
+				t.Fatalf("unexpected slot: got %v want %v", store.slots["doc-1"], tc.wantSlot)
+			}
+
+			if !tc.wantDeferred {
+				if len(sender.messages) != 0 {
+					t.Fatalf("unexpected messages queued: %d", len(sender.messages))
+				}
+				return
+			}
+
+			if store.statuses["doc-1"] != types.DOCUMENT_STATUS_PENDING {
+				t.Fatalf("unexpected status: %q", store.statuses["doc-1"])
+			}
+
+			if len(sender.messages) != 1 || sender.messages[0].DelaySeconds != DEFERRED_START_DELAY_SECONDS {
+				t.Fatalf("unexpected messages queued: %+v", sender.messages)
+			}
+
+			var deferred types.ChannelNotification
+			json.Unmarshal([]byte(*sender.messages[0].MessageBody), &deferred)
+			want := types.ChannelNotification{
+				NotificationID: "n-1",
+				ChannelID:      "channel-1",
+				FolderID:       "watch",
+				DocumentID:     "doc-1",
+			}
+			if deferred != want {
+				t.Fatalf("unexpected message: got %+v want %+v", deferred, want)
+			}
+
+			// the deferred start is traced like the notification was
+			trace := util.TraceFromMessage(events.SQSMessage{
+				MessageAttributes: sqsAttributes(sender.messages[0].MessageAttributes),
+			})
+			if trace.NotificationID != "n-1" || trace.ChannelID != "channel-1" {
+				t.Fatalf("unexpected trace: %+v", trace)
+			}
+		})
+	}
+}
+
+// The attributes of a queued message as the SQS event delivers them
+func sqsAttributes(
+	attributes map[string]sqstypes.MessageAttributeValue,
+) map[string]events.SQSMessageAttribute {
+	delivered := make(map[string]events.SQSMessageAttribute)
+	for name, value := range attributes {
+		delivered[name] = events.SQSMessageAttribute{
+			DataType:    *value.DataType,
+			StringValue: value.StringValue,
+		}
+	}
+
+	return delivered
+}
+
+func TestProcessTracesRequests(t *testing.T) {
+	// skip loading the AWS configuration
+	initOnce.Do(func() {})
+
+	// capture the log lines written while the message is processed
+	var logs bytes.Buffer
+	defaultLogger := slog.Default()
+	slog.SetDefault(slog.New(util.NewTraceHandler(slog.NewTextHandler(&logs, nil))))
+	defer slog.SetDefault(defaultLogger)
+
+	starter := &fakeStarter{executions: map[string]sfntypes.ExecutionStatus{}}
+	cfg = &handlerConfig{
+		store:    &fakeChannelStore{},
+		docStore: &fakeDocumentStore{byGoogleID: map[string]*types.Document{}},
+		dc: &fakeChanges{documents: []*types.Document{{
+			ID:       "doc-1",
+			GoogleID: "file-1",
+			Name:     "scan.pdf",
+			MimeType: types.CONTENT_TYPE_PDF,
+		}}},
+		history:   &fakeHistoryStore{},
+		sfnClient: starter,
+	}
+
+	trace := util.Trace{
+		NotificationID: "n-1",
+		ChannelID:      "channel-1",
+		RequestID:      "request-1",
+	}
+	event := events.SQSEvent{Records: []events.SQSMessage{{
+		MessageId:         "message-1",
+		Body:              `{"notification_id":"n-1","channel_id":"channel-1","folder_id":"watch"}`,
+		MessageAttributes: sqsAttributes(trace.MessageAttributes()),
+	}}}
+
+	response, err := process(context.Background(), event)
+	if err != nil || len(response.BatchItemFailures) != 0 {
+		t.Fatalf("unexpected response: %+v %v", response, err)
+	}
+
+	if len(starter.steps) != 1 {
+		t.Fatalf("unexpected executions: %+v", starter.steps)
+	}
+
+	step := starter.steps[0]
+	if step.NotificationID != "n-1" || step.ChannelID != "channel-1" || step.RequestID != "request-1" {
+		t.Fatalf("unexpected execution input: %+v", step)
+	}
+
+	lines := strings.Split(strings.TrimSpace(logs.String()), "\n")
+	for _, line := range lines {
+		if !strings.Contains(line, "requestID=request-1") || !strings.Contains(line, "notificationID=n-1") {
+			t.Fatalf("log line without the trace: %s", line)
+		}
+	}
+}
+
+func TestStartDeferred(t *testing.T) {
+	// skip loading the AWS configuration
+	initOnce.Do(func() {})
+
+	tests := []struct {
+		name   string
+		status string
+		active int
+
+		wantStarts   []string
+		wantDeferred int
+	}{
+		{
+			name:       "a slot is free",
+			status:     types.DOCUMENT_STATUS_PENDING,
+			active:     1,
+			wantStarts: []string{"doc-1"},
+		},
+		{
+			name:         "still at the limit",
+			status:       types.DOCUMENT_STATUS_PENDING,
+			active:       2,
+			wantDeferred: 1,
+		},
+		{
+			name:   "replaced while it waited",
+			status: types.DOCUMENT_STATUS_SUPERSEDED,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			store := &fakeDocumentStore{byGoogleID: map[string]*types.Document{
+				"file-1": {
+					ID:             "doc-1",
+					GoogleID:       "file-1",
+					ChannelID:      "channel-1",
+					GoogleFolderID: "watch",
+					Name:           "scan.pdf",
+					Status:         tc.status,
+				},
+			}}
+			channels := &fakeChannelStore{
+				channel: &types.WatchChannel{ChannelID: "channel-1", MaxConcurrentExecutions: 2},
+				active:  tc.active,
+			}
+			starter := &fakeStarter{executions: map[string]sfntypes.ExecutionStatus{}}
+			sender := &fakeSender{}
+			cfg = &handlerConfig{
+				store:    channels,
+				docStore: store,
+				history:  &fakeHistoryStore{},
+
+				sfnClient: starter,
+				sqsClient: sender,
+			}
+
+			// the changes of the channel aren't queried for a deferred start
+			message := events.SQSMessage{
+				MessageId: "message-1",
+				Body:      `{"channel_id":"channel-1","folder_id":"watch","document_id":"doc-1"}`,
+			}
+
+			err := processNotification(context.Background(), message)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if !slices.Equal(starter.started, tc.wantStarts) {
+				t.Fatalf("unexpected documents started: got %v want %v", starter.started, tc.wantStarts)
+			}
+
+			if len(sender.messages) != tc.wantDeferred {
+				t.Fatalf("unexpected messages queued: %d", len(sender.messages))
+			}
+
+			if channels.tokens != nil {
+				t.Fatalf("the changes lock was taken: %v", channels.tokens)
+			}
+		})
+	}
+}
+
+func TestSupersedeGivesBackTheSlot(t *testing.T) {
+	existing := &types.Document{ID: "doc-1", GoogleID: "file-1", ChannelID: "channel-1"}
+	store := &fakeDocumentStore{
+		byGoogleID: map[string]*types.Document{"file-1": existing},
+		slots:      map[string]bool{"doc-1": true},
+	}
+	channels := &fakeChannelStore{active: 1}
+	cfg = &handlerConfig{
+		store:    channels,
+		docStore: store,
+		history:  &fakeHistoryStore{},
+
+		sfnClient: &fakeStarter{executions: map[string]sfntypes.ExecutionStatus{}},
+	}
+
+	err := cfg.supersede(context.Background(), existing, &types.Document{ID: "doc-2"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if channels.active != 0 || store.slots["doc-1"] {
+		t.Fatalf("the slot wasn't given back: %d counted", channels.active)
+	}
+}
+
+func TestProcessPairsSidecars(t *testing.T) {
+	// skip loading the AWS configuration
+	initOnce.Do(func() {})
+
+	scan := func() *types.Document {
+		return &types.Document{
+			ID:       "doc-1",
+			GoogleID: "file-1",
+			Name:     "scan.pdf",
+			MimeType: types.CONTENT_TYPE_PDF,
+		}
+	}
+	sidecarFile := &types.SidecarFile{
+		GoogleID: "sidecar-1",
+		Name:     "scan.pdf.scriptor.txt",
+		FolderID: "watch",
+	}
+
+	tests := []struct {
+		name     string
+		changes  *fakeChanges
+		recorded *types.Document
+		content  string
+
+		wantStarted    []string
+		wantStatus     string
+		wantDirectives *types.DocumentDirectives
+	}{
+		{
+			name: "sidecar in the same batch",
+			changes: &fakeChanges{
+				documents: []*types.Document{scan()},
+				sidecars:  []*types.SidecarFile{sidecarFile},
+			},
+			content:        "language: es\nroute: project-x\n",
+			wantStarted:    []string{"doc-1"},
+			wantDirectives: &types.DocumentDirectives{Language: "es", Route: "project-x"},
+		},
+		{
+			name: "sidecar already in the folder",
+			changes: &fakeChanges{
+				documents:      []*types.Document{scan()},
+				folderSidecars: map[string]*types.SidecarFile{"scan.pdf": sidecarFile},
+			},
+			content:        "title: Week 3\n",
+			wantStarted:    []string{"doc-1"},
+			wantDirectives: &types.DocumentDirectives{Title: "Week 3"},
+		},
+		{
+			name:        "no sidecar",
+			changes:     &fakeChanges{documents: []*types.Document{scan()}},
+			wantStarted: []string{"doc-1"},
+		},
+		{
+			// the sidecar is looked for in the folder the document was
+			// found in, below the watch folder
+			name: "sidecar in another folder than the document",
+			changes: &fakeChanges{
+				documents: []*types.Document{func() *types.Document {
+					document := scan()
+					document.GoogleFolderID = "2026-01"
+					return document
+				}()},
+				folderSidecars: map[string]*types.SidecarFile{"scan.pdf": sidecarFile},
+			},
+			content:     "title: Week 3\n",
+			wantStarted: []string{"doc-1"},
+		},
+		{
+			name: "held document is saved but not started",
+			changes: &fakeChanges{
+				documents: []*types.Document{scan()},
+				sidecars:  []*types.SidecarFile{sidecarFile},
+			},
+			content:        "hold: true\n",
+			wantStatus:     types.DOCUMENT_STATUS_HELD,
+			wantDirectives: &types.DocumentDirectives{Hold: true},
+		},
+		{
+			name: "later sidecar releases the held document",
+			changes: &fakeChanges{
+				sidecars: []*types.SidecarFile{sidecarFile},
+				files:    map[string]*types.Document{"scan.pdf": scan()},
+			},
+			recorded: &types.Document{
+				ID:         "doc-1",
+				GoogleID:   "file-1",
+				Name:       "scan.pdf",
+				Status:     types.DOCUMENT_STATUS_HELD,
+				Directives: &types.DocumentDirectives{Hold: true},
+			},
+			content:        "hold: false\npipeline: no-cleanup\n",
+			wantStarted:    []string{"doc-1"},
+			wantStatus:     types.DOCUMENT_STATUS_PENDING,
+			wantDirectives: &types.DocumentDirectives{Pipeline: types.PIPELINE_NO_CLEANUP},
+		},
+		{
+			name: "later sidecar still holds the document",
+			changes: &fakeChanges{
+				sidecars: []*types.SidecarFile{sidecarFile},
+				files:    map[string]*types.Document{"scan.pdf": scan()},
+			},
+			recorded: &types.Document{
+				ID:       "doc-1",
+				GoogleID: "file-1",
+				Name:     "scan.pdf",
+				Status:   types.DOCUMENT_STATUS_HELD,
+			},
+			content:        "hold: yes\ntags: a\n",
+			wantStatus:     types.DOCUMENT_STATUS_HELD,
+			wantDirectives: &types.DocumentDirectives{Hold: true, Tags: []string{"a"}},
+		},
+		{
+			name: "later sidecar reaches a document being processed",
+			changes: &fakeChanges{
+				sidecars: []*types.SidecarFile{sidecarFile},
+				files:    map[string]*types.Document{"scan.pdf": scan()},
+			},
+			recorded:       &types.Document{ID: "doc-1", GoogleID: "file-1", Name: "scan.pdf"},
+			content:        "tags: receipts\n",
+			wantDirectives: &types.DocumentDirectives{Tags: []string{"receipts"}},
+		},
+		{
+			// the status the stages recorded is left alone
+			name: "later sidecar reaches a document in a stage",
+			changes: &fakeChanges{
+				sidecars: []*types.SidecarFile{sidecarFile},
+				files:    map[string]*types.Document{"scan.pdf": scan()},
+			},
+			recorded: &types.Document{
+				ID:           "doc-1",
+				GoogleID:     "file-1",
+				Name:         "scan.pdf",
+				Status:       types.DOCUMENT_STATUS_INPROGRESS,
+				CurrentStage: types.DOCUMENT_STAGE_MATHPIX,
+			},
+			content:        "tags: receipts\n",
+			wantStatus:     types.DOCUMENT_STATUS_INPROGRESS,
+			wantDirectives: &types.DocumentDirectives{Tags: []string{"receipts"}},
+		},
+		{
+			name: "later sidecar of a processed document",
+			changes: &fakeChanges{
+				sidecars: []*types.SidecarFile{sidecarFile},
+				files:    map[string]*types.Document{"scan.pdf": scan()},
+			},
+			recorded: &types.Document{
+				ID:       "doc-1",
+				GoogleID: "file-1",
+				Name:     "scan.pdf",
+				Status:   types.DOCUMENT_STATUS_COMPLETE,
+			},
+			content:    "tags: receipts\n",
+			wantStatus: types.DOCUMENT_STATUS_COMPLETE,
+		},
+		{
+			name: "sidecar before its document",
+			changes: &fakeChanges{
+				sidecars: []*types.SidecarFile{sidecarFile},
+			},
+			content: "tags: receipts\n",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.changes.contents = map[string]string{"sidecar-1": tc.content}
+
+			store := &fakeDocumentStore{byGoogleID: map[string]*types.Document{}}
+			if tc.recorded != nil {
+				store.byGoogleID["file-1"] = tc.recorded
+			}
+
+			starter := &fakeStarter{}
+			cfg = &handlerConfig{
+				store:    &fakeChannelStore{},
+				docStore: store,
+				dc:       tc.changes,
+				history:  &fakeHistoryStore{},
+
+				sfnClient: starter,
+			}
+
+			event := events.SQSEvent{Records: []events.SQSMessage{
+				{MessageId: "message-1", Body: `{"channel_id":"channel-1","folder_id":"watch"}`},
+			}}
+
+			response, err := process(context.Background(), event)
+			if err != nil || len(response.BatchItemFailures) > 0 {
+				t.Fatalf("unexpected failure: %v %v", err, response.BatchItemFailures)
+			}
+
+			if !slices.Equal(starter.started, tc.wantStarted) {
+				t.Fatalf("unexpected documents started: got %v want %v", starter.started, tc.wantStarted)
+			}
+
+			document, ok := store.byGoogleID["file-1"]
+			if !ok {
+				if tc.wantDirectives != nil {
+					t.Fatalf("the document was not recorded")
+				}
+				return
+			}
+
+			if document.Status != tc.wantStatus {
+				t.Fatalf("unexpected status: got %q want %q", document.Status, tc.wantStatus)
+			}
+
+			// the output goes to the folders of the watch folder
+			if tc.recorded == nil && document.GoogleFolderID != "watch" {
+				t.Fatalf("unexpected folder: %q", document.GoogleFolderID)
+			}
+
+			if !reflect.DeepEqual(document.Directives, tc.wantDirectives) {
+				t.Fatalf("unexpected directives: got %+v want %+v", document.Directives, tc.wantDirectives)
+			}
+
+			if tc.wantDirectives != nil && !reflect.DeepEqual(document.Sidecar, sidecarFile) {
+				t.Fatalf("unexpected sidecar: %+v", document.Sidecar)
+			}
+		})
+	}
+}
+
+func TestProcessDropsPausedChannels(t *testing.T) {
+	// skip loading the AWS configuration
+	initOnce.Do(func() {})
+
+	tests := []struct {
+		name string
+		kind string
+	}{
+		{name: "changes", kind: types.NOTIFICATION_KIND_CHANGES},
+		{name: "baseline", kind: types.NOTIFICATION_KIND_BASELINE},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			channels := &fakeChannelStore{
+				channel: &types.WatchChannel{ChannelID: "channel-1", FolderID: "watch", Paused: true},
+			}
+			changes := &fakeChanges{
+				documents: []*types.Document{{ID: "doc-1", GoogleID: "file-1", MimeType: types.CONTENT_TYPE_PDF}},
+				listing:   []*types.Document{{ID: "doc-1", GoogleID: "file-1", MimeType: types.CONTENT_TYPE_PDF}},
+			}
+			starter := &fakeStarter{executions: map[string]sfntypes.ExecutionStatus{}}
+			cfg = &handlerConfig{
+				store:     channels,
+				docStore:  &fakeDocumentStore{byGoogleID: map[string]*types.Document{}},
+				history:   &fakeHistoryStore{},
+				dc:        changes,
+				sfnClient: starter,
+			}
+
+			message := events.SQSMessage{
+				MessageId: "message-1",
+				Body: fmt.Sprintf(
+					`{"notification_id":"n-1","channel_id":"channel-1","folder_id":"watch","kind":%q}`,
+					tc.kind,
+				),
+			}
+
+			if err := processNotification(context.Background(), message); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			// the lock isn't taken and the token isn't moved on, so the
+			// changes are found once the channel is resumed
+			if channels.acquired != 0 || len(channels.tokens) != 0 {
+				t.Fatalf("unexpected lock: acquired %d tokens %v", channels.acquired, channels.tokens)
+			}
+
+			if len(changes.queried) != 0 || len(changes.listed) != 0 || len(starter.started) != 0 {
+				t.Fatalf("unexpected processing: queried %v listed %v started %v",
+					changes.queried, changes.listed, starter.started)
+			}
+		})
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+
+	"github.com/KyleBrandon/scriptor/lambdas/util"
+	"github.com/KyleBrandon/scriptor/pkg/database"
+	"github.com/KyleBrandon/scriptor/pkg/notes"
+	"github.com/KyleBrandon/scriptor/pkg/types"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// Number of bytes of the cleaned up Markdown included in the preview
+const EXCERPT_LENGTH = 1024
+
+type (
+	handlerConfig struct {
+		store    database.DocumentStore
+		s3Client *s3.Client
+	}
+
+	previewRequest struct {
+		DocumentID string `json:"document_id"`
+		notes.Templates
+	}
+
+	previewResponse struct {
+		Header string   `json:"header"`
+		Footer string   `json:"footer"`
+		Note   string   `json:"note"`
+		Errors []string `json:"errors"`
+	}
+)
+
+var (
+	initOnce sync.Once
+	cfg      *handlerConfig
+)
+
+// Load all the inital configuration settings for the lambda
+func loadConfiguration(ctx context.Context) (*handlerConfig, error) {
+
+	cfg = &handlerConfig{}
+
+	var err error
+
+	cfg.store, err = database.NewDocumentStore(ctx)
+	if err != nil {
+		slog.Error("Failed to configure the DynamoDB client", "error", err)
+		return nil, err
+	}
+
+	awsCfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		slog.Error("Failed to load the AWS config", "error", err)
+		return nil, err
+	}
+
+	cfg.s3Client = s3.NewFromConfig(awsCfg)
+
+	return cfg, nil
+}
+
+// Ensure that the configuration settings are only loaded once
+func initLambda(ctx context.Context) error {
+	var err error
+	initOnce.Do(func() {
+		slog.Debug(">>initLambda")
+		defer slog.Debug("<<initLambda")
+
+		cfg, err = loadConfiguration(ctx)
+	})
+
+	return err
+}
+
+// Read the start of the cleaned up Markdown for the document, if the
+// document made it that far.
+func (cfg *handlerConfig) readExcerpt(
+	ctx context.Context,
+	documentID string,
+) (string, error) {
+	stage, err := cfg.store.GetDocumentStage(
+		ctx,
+		documentID,
+		types.DOCUMENT_STAGE_OPENAI,
+	)
+	if errors.Is(err, database.ErrStageNotFound) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if stage.S3Key == "" {
+		return "", nil
+	}
+
+	resp, err := cfg.s3Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(types.S3_BUCKET_NAME),
+		Key:    aws.String(stage.S3Key),
+		Range:  aws.String(fmt.Sprintf("bytes=0-%d", EXCERPT_LENGTH-1)),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	defer resp.Body.Close()
+
+	content, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	return string(content), nil
+}
+
+// Render the candidate templates for the document the same way the pipeline
+// does. Templates missing from the request use the defaults.
+func buildPreview(
+	document *types.Document,
+	templates notes.Templates,
+	excerpt string,
+) previewResponse {
+	defaults := notes.DefaultTemplates()
+	if templates.Header == "" {
+		templates.Header = defaults.Header
+	}
+	if templates.Footer == "" {
+		templates.Footer = defaults.Footer
+	}
+
+	response := previewResponse{
+		Errors: make([]string, 0),
+	}
+
+	for _, err := range notes.Validate(templates) {
+		response.Errors = append(response.Errors, err.Error())
+	}
+
+	if len(response.Errors) != 0 {
+		return response
+	}
+
+	note, err := notes.Render(
+		templates,
+		notes.NewFields(document.ID, util.DocumentBaseName(document), document.Name),
+	)
+	if err != nil {
+		response.Errors = append(response.Errors, err.Error())
+		return response
+	}
+
+	if err := notes.ValidateFrontMatter(note.Header); err != nil {
+		response.Errors = append(response.Errors, err.Error())
+	}
+
+	// the pipeline only knows the link to the original when it uploads the
+	// note, preview the link to the original in Drive
+	link := notes.AttachmentOptions{Style: notes.ATTACHMENT_LINK_DRIVE}.Link(
+		document.Name,
+		document.GoogleID,
+	)
+
+	response.Header = note.Header
+	response.Footer = string(notes.ResolveAttachment([]byte(note.Footer), link))
+	response.Note = string(notes.ResolveAttachment([]byte(note.Compose(excerpt)), link))
+
+	return response
+}
+
+func process(
+	ctx context.Context,
+	request events.APIGatewayProxyRequest,
+) (events.APIGatewayProxyResponse, error) {
+	slog.Debug(">>process")
+	defer slog.Debug("<<process")
+
+	if err := initLambda(ctx); err != nil {
+		slog.Error("Failed to initialize the lambda", "error", err)
+		return util.BuildGatewayResponse(
+			err.Error(),
+			http.StatusInternalServerError,
+		)
+	}
+
+	var previewReq previewRequest
+	err := json.Unmarshal([]byte(request.Body), &previewReq)
+	if err != nil || previewReq.DocumentID == "" {
+		return util.BuildGatewayResponse(
+			"invalid preview request",
+			http.StatusBadRequest,
+		)
+	}
+
+	document, err := cfg.store.GetDocument(ctx, previewReq.DocumentID)
+	if errors.Is(err, database.ErrDocumentNotFound) {
+		return util.BuildGatewayResponse(
+			"document not found",
+			http.StatusNotFound,
+		)
+	}
+	if err != nil {
+		return util.BuildGatewayResponse(
+			err.Error(),
+			http.StatusInternalServerError,
+		)
+	}
+
+	excerpt, err := cfg.readExcerpt(ctx, document.ID)
+	if err != nil {
+		// the preview is still useful without the document content
+		slog.Warn(
+			"Failed to read the cleaned up Markdown for the preview",
+			"id",
+			document.ID,
+			"error",
+			err,
+		)
+	}
+
+	response := buildPreview(document, previewReq.Templates, excerpt)
+
+	body, err := json.Marshal(response)
+	if err != nil {
+		return util.BuildGatewayResponse(
+			err.Error(),
+			http.StatusInternalServerError,
+		)
+	}
+
+	return util.BuildGatewayResponse(string(body), http.StatusOK)
+}
+
+func main() {
+	slog.Debug(">>main")
+	defer slog.Debug("<<main")
+
+	lambda.Start(process)
+}
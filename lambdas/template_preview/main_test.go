@@ -0,0 +1,96 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/KyleBrandon/scriptor/pkg/notes"
+	"github.com/KyleBrandon/scriptor/pkg/types"
+)
+
+func TestBuildPreview(t *testing.T) {
+	document := &types.Document{
+		ID:       "doc-1",
+		Name:     "journal.pdf",
+		GoogleID: "file-1",
+	}
+
+	tests := []struct {
+		name       string
+		document   *types.Document
+		templates  notes.Templates
+		wantErrors int
+		wantHeader string
+		wantFooter string
+	}{
+		{
+			name:       "defaults",
+			document:   document,
+			wantHeader: `id: "journal"`,
+			wantFooter: "[journal.pdf](https://drive.google.com/file/d/file-1)",
+		},
+		{
+			name:     "custom templates",
+			document: document,
+			templates: notes.Templates{
+				Header: "---\ntitle: {{.Name}}\nsource: {{.DocumentID}}\n---\n",
+				Footer: "from {{.OriginalFileName}}",
+			},
+			wantHeader: "source: doc-1",
+			wantFooter: "from journal.pdf",
+		},
+		{
+			name:     "unknown placeholder",
+			document: document,
+			templates: notes.Templates{
+				Header: "# {{.Title}}",
+			},
+			wantErrors: 1,
+		},
+		{
+			name:     "syntax error",
+			document: document,
+			templates: notes.Templates{
+				Footer: "{{.Name",
+			},
+			wantErrors: 1,
+		},
+		{
+			name:     "invalid front matter",
+			document: document,
+			templates: notes.Templates{
+				Header: "---\ntags: [unclosed\n---\n",
+			},
+			wantErrors: 1,
+			wantHeader: "tags: [unclosed",
+		},
+		{
+			name:       "document missing optional fields",
+			document:   &types.Document{ID: "doc-2"},
+			wantHeader: `id: "scan-doc-2"`,
+			wantFooter: "![[]]",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got := buildPreview(tc.document, tc.templates, "excerpt")
+
+			if len(got.Errors) != tc.wantErrors {
+				t.Fatalf("unexpected errors: got %v want %d", got.Errors, tc.wantErrors)
+			}
+
+			if !strings.Contains(got.Header, tc.wantHeader) {
+				t.Fatalf("unexpected header: got %q want %q", got.Header, tc.wantHeader)
+			}
+
+			if got.Footer != tc.wantFooter && tc.wantFooter != "" {
+				t.Fatalf("unexpected footer: got %q want %q", got.Footer, tc.wantFooter)
+			}
+
+			if got.Header != "" && !strings.Contains(got.Note, "excerpt") {
+				t.Fatalf("note is missing the excerpt: %q", got.Note)
+			}
+		})
+	}
+}
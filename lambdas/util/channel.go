@@ -0,0 +1,36 @@
+package util
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+
+	"github.com/KyleBrandon/scriptor/pkg/types"
+	"github.com/google/uuid"
+)
+
+// How long a watch channel lasts once it is registered, the register lambda
+// renews it from then on
+const WATCH_CHANNEL_LIFETIME = 48 * time.Hour
+
+// NewChannelToken makes the token Google sends back with every notification
+// of a channel, so the webhook can tell its requests from ones sent by
+// anyone else
+func NewChannelToken() (string, error) {
+	token := make([]byte, 32)
+	if _, err := rand.Read(token); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(token), nil
+}
+
+// SetChannelIdentity gives the channel a new ID, token, expiry and webhook
+// URL. The register and channel admin lambdas both make channels through it,
+// Drive is only told about them when the channel is created.
+func SetChannelIdentity(wc *types.WatchChannel, token, webhookURL string, now time.Time) {
+	wc.ChannelID = uuid.New().String()
+	wc.ExpiresAt = now.Add(WATCH_CHANNEL_LIFETIME).UnixMilli()
+	wc.WebhookUrl = webhookURL
+	wc.Token = token
+}
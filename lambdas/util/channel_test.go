@@ -0,0 +1,43 @@
+package util
+
+import (
+	"testing"
+	"time"
+
+	"github.com/KyleBrandon/scriptor/pkg/types"
+)
+
+func TestSetChannelIdentity(t *testing.T) {
+	now := time.Date(2026, 10, 17, 8, 0, 0, 0, time.UTC)
+
+	wc := &types.WatchChannel{ChannelID: "channel-old", FolderID: "folder-1"}
+	SetChannelIdentity(wc, "token-1", "https://example.com/webhook", now)
+
+	if wc.ChannelID == "" || wc.ChannelID == "channel-old" {
+		t.Fatalf("unexpected channel ID: %q", wc.ChannelID)
+	}
+
+	if wc.ExpiresAt != now.Add(WATCH_CHANNEL_LIFETIME).UnixMilli() {
+		t.Fatalf("unexpected expiry: %d", wc.ExpiresAt)
+	}
+
+	if wc.WebhookUrl != "https://example.com/webhook" || wc.Token != "token-1" {
+		t.Fatalf("unexpected channel: %+v", wc)
+	}
+}
+
+func TestNewChannelToken(t *testing.T) {
+	first, err := NewChannelToken()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	second, err := NewChannelToken()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(first) != 64 || first == second {
+		t.Fatalf("unexpected tokens: %q %q", first, second)
+	}
+}
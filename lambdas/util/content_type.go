@@ -0,0 +1,62 @@
+package util
+
+import (
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"github.com/KyleBrandon/scriptor/pkg/types"
+)
+
+// Number of leading bytes needed to sniff the content type of a file
+const CONTENT_SNIFF_LENGTH = 512
+
+var contentTypeExtensions = map[string]string{
+	types.CONTENT_TYPE_PDF:      ".pdf",
+	types.CONTENT_TYPE_MARKDOWN: ".md",
+	types.CONTENT_TYPE_TEXT:     ".txt",
+	types.CONTENT_TYPE_PNG:      ".png",
+	types.CONTENT_TYPE_JPEG:     ".jpg",
+}
+
+// DetectContentType sniffs the media type from the first bytes of a file.
+// Sniffing can't tell plain text formats apart, so for text the file name is
+// used to recognize markdown.
+func DetectContentType(header []byte, fileName string) string {
+	contentType := http.DetectContentType(header)
+
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return contentType
+	}
+
+	if mediaType == types.CONTENT_TYPE_TEXT {
+		switch strings.ToLower(filepath.Ext(fileName)) {
+		case ".md", ".markdown":
+			return types.CONTENT_TYPE_MARKDOWN
+		}
+	}
+
+	return mediaType
+}
+
+// ExtensionForContentType returns the file extension to use for a content
+// type, falling back to the extension of the file name for unknown types.
+func ExtensionForContentType(contentType, fileName string) string {
+	if ext, ok := contentTypeExtensions[contentType]; ok {
+		return ext
+	}
+
+	return filepath.Ext(fileName)
+}
+
+// StageContentType returns the recorded content type of a stage file. Stages
+// recorded before the content type was stored only ever held PDFs.
+func StageContentType(stage *types.DocumentProcessingStage) string {
+	if stage.ContentType == "" {
+		return types.CONTENT_TYPE_PDF
+	}
+
+	return stage.ContentType
+}
@@ -0,0 +1,87 @@
+package util
+
+import (
+	"testing"
+
+	"github.com/KyleBrandon/scriptor/pkg/types"
+)
+
+func TestDetectContentType(t *testing.T) {
+	tests := []struct {
+		name     string
+		header   []byte
+		fileName string
+		want     string
+		wantExt  string
+	}{
+		{
+			name:     "pdf",
+			header:   []byte("%PDF-1.7\n%\xe2\xe3\xcf\xd3\n1 0 obj"),
+			fileName: "scan.pdf",
+			want:     types.CONTENT_TYPE_PDF,
+			wantExt:  ".pdf",
+		},
+		{
+			name:     "pdf without extension",
+			header:   []byte("%PDF-1.4\n"),
+			fileName: "scan",
+			want:     types.CONTENT_TYPE_PDF,
+			wantExt:  ".pdf",
+		},
+		{
+			name:     "png",
+			header:   []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR"),
+			fileName: "whiteboard.png",
+			want:     types.CONTENT_TYPE_PNG,
+			wantExt:  ".png",
+		},
+		{
+			name:     "markdown",
+			header:   []byte("# Heading\n\nSome *text*.\n"),
+			fileName: "notes.md",
+			want:     types.CONTENT_TYPE_MARKDOWN,
+			wantExt:  ".md",
+		},
+		{
+			name:     "plain text",
+			header:   []byte("just some text\n"),
+			fileName: "notes.txt",
+			want:     types.CONTENT_TYPE_TEXT,
+			wantExt:  ".txt",
+		},
+		{
+			name:     "empty file",
+			header:   []byte{},
+			fileName: "empty.md",
+			want:     types.CONTENT_TYPE_MARKDOWN,
+			wantExt:  ".md",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got := DetectContentType(tc.header, tc.fileName)
+			if got != tc.want {
+				t.Fatalf("unexpected content type: got %q want %q", got, tc.want)
+			}
+
+			if ext := ExtensionForContentType(got, tc.fileName); ext != tc.wantExt {
+				t.Fatalf("unexpected extension: got %q want %q", ext, tc.wantExt)
+			}
+		})
+	}
+}
+
+func TestExtensionForUnknownContentTypeUsesFileName(t *testing.T) {
+	got := ExtensionForContentType("application/octet-stream", "archive.tar")
+	if got != ".tar" {
+		t.Fatalf("unexpected extension: got %q want %q", got, ".tar")
+	}
+}
+
+func TestStageContentTypeDefaultsToPDF(t *testing.T) {
+	stage := &types.DocumentProcessingStage{}
+	if got := StageContentType(stage); got != types.CONTENT_TYPE_PDF {
+		t.Fatalf("unexpected content type: got %q want %q", got, types.CONTENT_TYPE_PDF)
+	}
+}
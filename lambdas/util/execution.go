@@ -0,0 +1,300 @@
+package util
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/KyleBrandon/scriptor/pkg/types"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sfn"
+	sfntypes "github.com/aws/aws-sdk-go-v2/service/sfn/types"
+)
+
+const (
+	// Step Functions limits execution names to 80 characters
+	MAX_EXECUTION_NAME_LENGTH = 80
+
+	// Number of hex characters of the source hash kept in the name
+	executionNameHashLength = 8
+
+	// Room reserved at the end of the name for a collision suffix (-NN)
+	executionNameSuffixLength = 3
+
+	// Number of suffixed names tried before giving up
+	maxExecutionNameAttempts = 99
+
+	// Used when nothing usable is left of the file name after sanitizing
+	defaultExecutionName = "document"
+)
+
+// ErrExecutionInProgress is returned when an execution for the document is
+// still running, meaning this start would be a duplicate.
+var ErrExecutionInProgress = errors.New("execution already in progress")
+
+type (
+	// ExecutionDescriber is the part of the Step Functions client used to
+	// look up prior executions by name.
+	ExecutionDescriber interface {
+		DescribeExecution(
+			ctx context.Context,
+			params *sfn.DescribeExecutionInput,
+			optFns ...func(*sfn.Options),
+		) (*sfn.DescribeExecutionOutput, error)
+	}
+
+	// ExecutionStopper is the part of the Step Functions client used to stop
+	// the execution of a document that was replaced.
+	ExecutionStopper interface {
+		ExecutionDescriber
+		StopExecution(
+			ctx context.Context,
+			params *sfn.StopExecutionInput,
+			optFns ...func(*sfn.Options),
+		) (*sfn.StopExecutionOutput, error)
+	}
+
+	executionState int
+)
+
+const (
+	executionNotFound executionState = iota
+	executionActive
+	executionFinished
+)
+
+// BuildExecutionName creates a human readable execution name for a document
+// in the form <name>-<yyyymmdd>-<hash>. The hash is taken from the Google ID
+// and revision, or the modified time when Drive reports no revision (the
+// source key for other sources), so that documents with the same name on the
+// same day don't share an execution name while every start of the same
+// revision gets the same one. Step Functions rejects a name it has seen in
+// the last 90 days, so two starts of the revision racing each other run the
+// pipeline once. ResolveExecutionName starts from this name and moves on to
+// a suffixed one when the earlier execution has finished, which processes
+// the revision again. The execution input carries the document ID under
+// "id" for lookups that need the exact document.
+func BuildExecutionName(document *types.Document) string {
+	var sourceID string
+	switch {
+	case document.GoogleID == "":
+		sourceID = document.SourceKey
+	case document.HeadRevisionID != "":
+		sourceID = document.GoogleID + "@" + document.HeadRevisionID
+	case !document.ModifiedTime.IsZero():
+		sourceID = document.GoogleID + "@" +
+			document.ModifiedTime.UTC().Format(time.RFC3339Nano)
+	default:
+		sourceID = document.GoogleID
+	}
+
+	createdTime := document.CreatedTime
+	if createdTime.IsZero() {
+		createdTime = time.Now()
+	}
+
+	hash := sha256.Sum256([]byte(sourceID))
+	suffix := fmt.Sprintf(
+		"-%s-%s",
+		createdTime.UTC().Format("20060102"),
+		hex.EncodeToString(hash[:])[:executionNameHashLength],
+	)
+
+	name := sanitizeExecutionName(DocumentBaseName(document))
+	maxNameLength := MAX_EXECUTION_NAME_LENGTH - len(suffix) -
+		executionNameSuffixLength
+	if len(name) > maxNameLength {
+		name = strings.TrimRight(name[:maxNameLength], "-_")
+	}
+
+	if name == "" {
+		name = defaultExecutionName
+	}
+
+	return name + suffix
+}
+
+// Execution names may only safely contain ASCII letters, digits, '-' and '_'.
+// Everything else, including non-ASCII characters, collapses into a single '-'.
+func sanitizeExecutionName(name string) string {
+	var builder strings.Builder
+	lastDash := false
+
+	for _, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9',
+			r == '_':
+			builder.WriteRune(r)
+			lastDash = false
+		default:
+			if !lastDash {
+				builder.WriteRune('-')
+				lastDash = true
+			}
+		}
+	}
+
+	return strings.Trim(builder.String(), "-_")
+}
+
+func suffixExecutionName(base string, attempt int) string {
+	if attempt == 0 {
+		return base
+	}
+
+	return fmt.Sprintf("%s-%d", base, attempt+1)
+}
+
+// chooseExecutionName walks the suffixed variants of the base name. A name
+// that is unknown to Step Functions can be used; execution names are only
+// reserved for 90 days so an old name eventually becomes free again. A
+// finished execution means the document is being processed again and gets
+// the next suffix, while an active one means this start is a duplicate.
+func chooseExecutionName(
+	base string,
+	lookup func(name string) (executionState, error),
+) (string, error) {
+	for attempt := range maxExecutionNameAttempts {
+		name := suffixExecutionName(base, attempt)
+
+		state, err := lookup(name)
+		if err != nil {
+			return "", err
+		}
+
+		switch state {
+		case executionNotFound:
+			return name, nil
+		case executionActive:
+			return "", ErrExecutionInProgress
+		}
+	}
+
+	return "", fmt.Errorf("no free execution name found for %s", base)
+}
+
+func executionARN(stateMachineARN, name string) string {
+	return fmt.Sprintf(
+		"%s:%s",
+		strings.Replace(stateMachineARN, ":stateMachine:", ":execution:", 1),
+		name,
+	)
+}
+
+// activeExecutionName walks the suffixed variants of the base name the same
+// way chooseExecutionName does and returns the one that is still running, or
+// an empty name when none is.
+func activeExecutionName(
+	base string,
+	lookup func(name string) (executionState, error),
+) (string, error) {
+	for attempt := range maxExecutionNameAttempts {
+		name := suffixExecutionName(base, attempt)
+
+		state, err := lookup(name)
+		if err != nil {
+			return "", err
+		}
+
+		switch state {
+		case executionNotFound:
+			return "", nil
+		case executionActive:
+			return name, nil
+		}
+	}
+
+	return "", nil
+}
+
+// Look the state of an execution up by name
+func executionLookup(
+	ctx context.Context,
+	client ExecutionDescriber,
+	stateMachineARN string,
+) func(name string) (executionState, error) {
+	return func(name string) (executionState, error) {
+		output, err := client.DescribeExecution(ctx, &sfn.DescribeExecutionInput{
+			ExecutionArn: aws.String(executionARN(stateMachineARN, name)),
+		})
+		if err != nil {
+			var notFound *sfntypes.ExecutionDoesNotExist
+			if errors.As(err, &notFound) {
+				return executionNotFound, nil
+			}
+
+			slog.Error(
+				"Failed to describe the execution",
+				"name",
+				name,
+				"error",
+				err,
+			)
+			return executionNotFound, err
+		}
+
+		switch output.Status {
+		case sfntypes.ExecutionStatusRunning,
+			sfntypes.ExecutionStatusPendingRedrive:
+			return executionActive, nil
+		}
+
+		return executionFinished, nil
+	}
+}
+
+// ResolveExecutionName returns the name to start the document's execution
+// with, or ErrExecutionInProgress if an execution for it is still running.
+func ResolveExecutionName(
+	ctx context.Context,
+	client ExecutionDescriber,
+	stateMachineARN string,
+	document *types.Document,
+) (string, error) {
+	return chooseExecutionName(
+		BuildExecutionName(document),
+		executionLookup(ctx, client, stateMachineARN),
+	)
+}
+
+// StopActiveExecution stops the execution of the document that is still
+// running, with the error the workflow reports for it. Returns the name of
+// the execution stopped, empty when none was running.
+func StopActiveExecution(
+	ctx context.Context,
+	client ExecutionStopper,
+	stateMachineARN string,
+	document *types.Document,
+	errorType, cause string,
+) (string, error) {
+	name, err := activeExecutionName(
+		BuildExecutionName(document),
+		executionLookup(ctx, client, stateMachineARN),
+	)
+	if err != nil || name == "" {
+		return "", err
+	}
+
+	_, err = client.StopExecution(ctx, &sfn.StopExecutionInput{
+		ExecutionArn: aws.String(executionARN(stateMachineARN, name)),
+		Error:        aws.String(errorType),
+		Cause:        aws.String(cause),
+	})
+	if err != nil {
+		slog.Error(
+			"Failed to stop the execution",
+			"name",
+			name,
+			"error",
+			err,
+		)
+		return "", err
+	}
+
+	return name, nil
+}
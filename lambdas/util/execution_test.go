@@ -0,0 +1,324 @@
+package util
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/KyleBrandon/scriptor/pkg/types"
+)
+
+var executionNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,80}$`)
+
+func TestBuildExecutionName(t *testing.T) {
+	createdTime := time.Date(2026, 3, 11, 23, 30, 0, 0, time.UTC)
+
+	tests := []struct {
+		name       string
+		document   types.Document
+		wantPrefix string
+	}{
+		{
+			name: "simple file name",
+			document: types.Document{
+				GoogleID:    "file-1",
+				Name:        "journal.pdf",
+				CreatedTime: createdTime,
+			},
+			wantPrefix: "journal-20260311-",
+		},
+		{
+			name: "spaces and punctuation collapse",
+			document: types.Document{
+				GoogleID:    "file-1",
+				Name:        "Meeting notes: Q1 (final).pdf",
+				CreatedTime: createdTime,
+			},
+			wantPrefix: "Meeting-notes-Q1-final-20260311-",
+		},
+		{
+			name: "unicode is replaced",
+			document: types.Document{
+				GoogleID:    "file-1",
+				Name:        "Café résumé.pdf",
+				CreatedTime: createdTime,
+			},
+			wantPrefix: "Caf-r-sum-20260311-",
+		},
+		{
+			name: "only unicode falls back to default",
+			document: types.Document{
+				GoogleID:    "file-1",
+				Name:        "日本語.pdf",
+				CreatedTime: createdTime,
+			},
+			wantPrefix: "document-20260311-",
+		},
+		{
+			name: "name that is only an extension uses the fallback",
+			document: types.Document{
+				ID:          "0c8f3a2e-41d5",
+				GoogleID:    "file-1",
+				Name:        ".pdf",
+				CreatedTime: createdTime,
+			},
+			wantPrefix: "scan-20260311-0c8f3a2e-20260311-",
+		},
+		{
+			name: "date uses UTC",
+			document: types.Document{
+				GoogleID:    "file-1",
+				Name:        "late.pdf",
+				CreatedTime: createdTime.In(time.FixedZone("PST", -8*60*60)),
+			},
+			wantPrefix: "late-20260311-",
+		},
+		{
+			name: "source key used without google id",
+			document: types.Document{
+				SourceKey:   "kindle_email:host/journal.pdf",
+				Name:        "journal.pdf",
+				CreatedTime: createdTime,
+			},
+			wantPrefix: "journal-20260311-",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got := BuildExecutionName(&tc.document)
+
+			if !strings.HasPrefix(got, tc.wantPrefix) {
+				t.Fatalf("unexpected name: got %q want prefix %q", got, tc.wantPrefix)
+			}
+
+			if !executionNamePattern.MatchString(got) {
+				t.Fatalf("name %q is not a valid execution name", got)
+			}
+		})
+	}
+}
+
+func TestBuildExecutionNameTruncatesLongNames(t *testing.T) {
+	document := &types.Document{
+		GoogleID:    "file-1",
+		Name:        strings.Repeat("a", 200) + ".pdf",
+		CreatedTime: time.Now().UTC(),
+	}
+
+	got := BuildExecutionName(document)
+
+	// leave room for the collision suffix
+	if len(got) > MAX_EXECUTION_NAME_LENGTH-executionNameSuffixLength {
+		t.Fatalf("name is too long: %d characters", len(got))
+	}
+
+	if !executionNamePattern.MatchString(suffixExecutionName(got, 98)) {
+		t.Fatalf("suffixed name is not a valid execution name")
+	}
+}
+
+func TestBuildExecutionNameDiffersBySource(t *testing.T) {
+	createdTime := time.Now().UTC()
+	first := BuildExecutionName(&types.Document{
+		GoogleID:    "file-1",
+		Name:        "scan.pdf",
+		CreatedTime: createdTime,
+	})
+	second := BuildExecutionName(&types.Document{
+		GoogleID:    "file-2",
+		Name:        "scan.pdf",
+		CreatedTime: createdTime,
+	})
+
+	if first == second {
+		t.Fatalf("expected different names for different files, got %q", first)
+	}
+}
+
+func TestBuildExecutionNameDiffersByRevision(t *testing.T) {
+	createdTime := time.Now().UTC()
+	revision := func(id string) *types.Document {
+		return &types.Document{
+			ID:             id,
+			GoogleID:       "file-1",
+			Name:           "scan.pdf",
+			CreatedTime:    createdTime,
+			HeadRevisionID: "rev-1",
+		}
+	}
+
+	// the same revision gets the same name whatever document it was saved as
+	first := BuildExecutionName(revision("doc-1"))
+	if again := BuildExecutionName(revision("doc-2")); again != first {
+		t.Fatalf("expected the same name for the same revision: got %q want %q", again, first)
+	}
+
+	next := revision("doc-3")
+	next.HeadRevisionID = "rev-2"
+	if second := BuildExecutionName(next); second == first {
+		t.Fatalf("expected different names for different revisions, got %q", first)
+	}
+}
+
+func TestChooseExecutionName(t *testing.T) {
+	lookupErr := errors.New("throttled")
+
+	tests := []struct {
+		name     string
+		existing map[string]executionState
+		err      error
+		want     string
+		wantErr  error
+	}{
+		{
+			name:     "unused name",
+			existing: map[string]executionState{},
+			want:     "base",
+		},
+		{
+			name: "running execution is a duplicate",
+			existing: map[string]executionState{
+				"base": executionActive,
+			},
+			wantErr: ErrExecutionInProgress,
+		},
+		{
+			name: "finished execution gets a suffix",
+			existing: map[string]executionState{
+				"base": executionFinished,
+			},
+			want: "base-2",
+		},
+		{
+			name: "running suffixed execution is a duplicate",
+			existing: map[string]executionState{
+				"base":   executionFinished,
+				"base-2": executionActive,
+			},
+			wantErr: ErrExecutionInProgress,
+		},
+		{
+			name: "several finished executions",
+			existing: map[string]executionState{
+				"base":   executionFinished,
+				"base-2": executionFinished,
+				"base-3": executionFinished,
+			},
+			want: "base-4",
+		},
+		{
+			// names are only reserved for 90 days, after which Step Functions
+			// no longer knows about the execution and the base name is free
+			name: "expired base name is reused",
+			existing: map[string]executionState{
+				"base-2": executionFinished,
+			},
+			want: "base",
+		},
+		{
+			name:    "lookup failure",
+			err:     lookupErr,
+			wantErr: lookupErr,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := chooseExecutionName(
+				"base",
+				func(name string) (executionState, error) {
+					if tc.err != nil {
+						return executionNotFound, tc.err
+					}
+					return tc.existing[name], nil
+				},
+			)
+
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("unexpected error: got %v want %v", err, tc.wantErr)
+			}
+
+			if got != tc.want {
+				t.Fatalf("unexpected name: got %q want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestChooseExecutionNameExhausted(t *testing.T) {
+	_, err := chooseExecutionName(
+		"base",
+		func(name string) (executionState, error) {
+			return executionFinished, nil
+		},
+	)
+	if err == nil {
+		t.Fatalf("expected an error when every name is taken")
+	}
+}
+
+func TestActiveExecutionName(t *testing.T) {
+	tests := []struct {
+		name     string
+		existing map[string]executionState
+		want     string
+	}{
+		{
+			name:     "no executions",
+			existing: map[string]executionState{},
+		},
+		{
+			name:     "running execution",
+			existing: map[string]executionState{"base": executionActive},
+			want:     "base",
+		},
+		{
+			name: "running suffixed execution",
+			existing: map[string]executionState{
+				"base":   executionFinished,
+				"base-2": executionActive,
+			},
+			want: "base-2",
+		},
+		{
+			name: "every execution finished",
+			existing: map[string]executionState{
+				"base":   executionFinished,
+				"base-2": executionFinished,
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := activeExecutionName(
+				"base",
+				func(name string) (executionState, error) {
+					return tc.existing[name], nil
+				},
+			)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if got != tc.want {
+				t.Fatalf("unexpected name: got %q want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestExecutionARN(t *testing.T) {
+	got := executionARN(
+		"arn:aws:states:us-east-1:123456789012:stateMachine:Processing",
+		"journal-20260311-abcd1234",
+	)
+	want := "arn:aws:states:us-east-1:123456789012:execution:Processing:journal-20260311-abcd1234"
+
+	if got != want {
+		t.Fatalf("unexpected arn: got %q want %q", got, want)
+	}
+}
@@ -0,0 +1,103 @@
+package util
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/KyleBrandon/scriptor/pkg/types"
+	"github.com/aws/aws-lambda-go/lambda/messages"
+)
+
+// StageFailedError is the error a workflow lambda fails with when its stage
+// fails. The Lambda runtime reports it to the workflow by the name of the
+// type, and its message is the JSON of the stage, the attempt and the
+// error, so the error handling states know which stage failed.
+type StageFailedError struct {
+	Stage   types.Stage
+	Attempt int
+	Err     error
+}
+
+// The message of a StageFailedError, which a Catch of the workflow passes on
+// as the cause
+type stageFailure struct {
+	Stage   types.Stage `json:"stage"`
+	Attempt int         `json:"attempt,omitempty"`
+	Message string      `json:"message"`
+}
+
+// The cause a Catch of the workflow gives for an error a lambda returned
+type lambdaCause struct {
+	ErrorMessage string `json:"errorMessage"`
+	ErrorType    string `json:"errorType"`
+}
+
+func (e *StageFailedError) Error() string {
+	message, err := json.Marshal(stageFailure{
+		Stage:   e.Stage,
+		Attempt: e.Attempt,
+		Message: e.Err.Error(),
+	})
+	if err != nil {
+		return e.Err.Error()
+	}
+
+	return string(message)
+}
+
+func (e *StageFailedError) Unwrap() error {
+	return e.Err
+}
+
+// StageError returns the error the lambda fails with when the stage failed.
+// The errors the workflow catches by name, like the superseded error, are
+// returned as they are.
+func StageError(stage *types.DocumentProcessingStage, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	var invokeErr messages.InvokeResponse_Error
+	if errors.As(err, &invokeErr) {
+		return err
+	}
+
+	return &StageFailedError{
+		Stage:   stage.Stage,
+		Attempt: stage.Attempt,
+		Err:     err,
+	}
+}
+
+// ReadStepError fills in the stage that failed and its attempt from the
+// error the workflow caught, and returns the message of the error. Errors
+// that didn't come from a stage, like a timeout, leave the stage empty.
+func ReadStepError(step *types.DocumentStep) string {
+	if step.Error == nil {
+		return ""
+	}
+
+	// the cause of a lambda error is JSON, the others are text
+	var cause lambdaCause
+	if err := json.Unmarshal([]byte(step.Error.Cause), &cause); err != nil {
+		if step.Error.Cause != "" {
+			return step.Error.Cause
+		}
+
+		return step.Error.Error
+	}
+
+	var failure stageFailure
+	if step.Error.Error == types.DOCUMENT_ERROR_STAGE_FAILED &&
+		json.Unmarshal([]byte(cause.ErrorMessage), &failure) == nil {
+		step.ErrorStage = failure.Stage
+		step.Attempt = failure.Attempt
+		return failure.Message
+	}
+
+	if cause.ErrorMessage != "" {
+		return cause.ErrorMessage
+	}
+
+	return step.Error.Error
+}
@@ -0,0 +1,137 @@
+package util
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/KyleBrandon/scriptor/pkg/types"
+	"github.com/aws/aws-lambda-go/lambda/messages"
+)
+
+func TestStageError(t *testing.T) {
+	// the runtime reports the error by the name of its type, which the
+	// workflow and ReadStepError match on
+	if name := reflect.TypeOf(&StageFailedError{}).Elem().Name(); name != types.DOCUMENT_ERROR_STAGE_FAILED {
+		t.Fatalf("unexpected error type name: %s", name)
+	}
+
+	stage := &types.DocumentProcessingStage{Stage: types.DOCUMENT_STAGE_OPENAI, Attempt: 2}
+	cause := errors.New("rate limited")
+
+	err := StageError(stage, cause)
+	var failure *StageFailedError
+	if !errors.As(err, &failure) || !errors.Is(err, cause) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	want := `{"stage":"openai","attempt":2,"message":"rate limited"}`
+	if err.Error() != want {
+		t.Fatalf("unexpected message:\ngot  %s\nwant %s", err.Error(), want)
+	}
+
+	// the errors the workflow catches by name keep their name
+	named := messages.InvokeResponse_Error{Type: "DocumentSuperseded", Message: "superseded"}
+	if err := StageError(stage, named); !reflect.DeepEqual(err, named) {
+		t.Fatalf("unexpected named error: %v", err)
+	}
+
+	if err := StageError(stage, nil); err != nil {
+		t.Fatalf("unexpected error for no failure: %v", err)
+	}
+}
+
+func TestReadStepError(t *testing.T) {
+	tests := []struct {
+		name        string
+		input       string
+		wantMessage string
+		wantStage   types.Stage
+		wantAttempt int
+	}{
+		{
+			// the input a Catch of the workflow gives the failure state
+			name:        "stage failed",
+			input:       `{"id":"doc-1","stage":"mathpix","error":{"Error":"StageFailedError","Cause":"{\"errorMessage\":\"{\\\"stage\\\":\\\"openai\\\",\\\"attempt\\\":2,\\\"message\\\":\\\"rate limited\\\"}\",\"errorType\":\"StageFailedError\"}"}}`,
+			wantMessage: "rate limited",
+			wantStage:   types.DOCUMENT_STAGE_OPENAI,
+			wantAttempt: 2,
+		},
+		{
+			name:        "lambda error",
+			input:       `{"id":"doc-1","stage":"mathpix","error":{"Error":"errorString","Cause":"{\"errorMessage\":\"out of memory\",\"errorType\":\"errorString\"}"}}`,
+			wantMessage: "out of memory",
+		},
+		{
+			name:        "timeout",
+			input:       `{"id":"doc-1","stage":"mathpix","error":{"Error":"States.Timeout","Cause":""}}`,
+			wantMessage: "States.Timeout",
+		},
+		{
+			name:        "text cause",
+			input:       `{"id":"doc-1","stage":"mathpix","error":{"Error":"States.TaskFailed","Cause":"the task failed"}}`,
+			wantMessage: "the task failed",
+		},
+		{
+			name:  "no error",
+			input: `{"id":"doc-1","stage":"mathpix"}`,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var step types.DocumentStep
+			if err := json.Unmarshal([]byte(tc.input), &step); err != nil {
+				t.Fatalf("failed to read the step: %v", err)
+			}
+
+			message := ReadStepError(&step)
+			if message != tc.wantMessage ||
+				step.ErrorStage != tc.wantStage ||
+				step.Attempt != tc.wantAttempt {
+				t.Fatalf(
+					"unexpected failure: got %q %s %d want %q %s %d",
+					message,
+					step.ErrorStage,
+					step.Attempt,
+					tc.wantMessage,
+					tc.wantStage,
+					tc.wantAttempt,
+				)
+			}
+
+			if err := ValidateStep(step); err != nil {
+				t.Fatalf("unexpected invalid step: %v", err)
+			}
+		})
+	}
+}
+
+func TestStageErrorRoundTrip(t *testing.T) {
+	stage := &types.DocumentProcessingStage{Stage: types.DOCUMENT_STAGE_UPLOAD, Attempt: 3}
+	err := StageError(stage, errors.New("quota exceeded"))
+
+	// the cause the runtime and the Catch build from the error
+	cause, _ := json.Marshal(messages.InvokeResponse_Error{
+		Message: err.Error(),
+		Type:    reflect.TypeOf(err).Elem().Name(),
+	})
+	input, _ := json.Marshal(map[string]any{
+		"id":    "doc-1",
+		"stage": types.DOCUMENT_STAGE_OPENAI,
+		"error": types.StepError{Error: types.DOCUMENT_ERROR_STAGE_FAILED, Cause: string(cause)},
+	})
+
+	var step types.DocumentStep
+	if err := json.Unmarshal(input, &step); err != nil {
+		t.Fatalf("failed to read the step: %v", err)
+	}
+
+	message := ReadStepError(&step)
+	if message != "quota exceeded" ||
+		step.ErrorStage != types.DOCUMENT_STAGE_UPLOAD ||
+		step.Attempt != 3 {
+		t.Fatalf("unexpected failure: %q %+v", message, step)
+	}
+}
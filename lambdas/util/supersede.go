@@ -0,0 +1,95 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"github.com/KyleBrandon/scriptor/pkg/types"
+	"github.com/aws/aws-lambda-go/lambda/messages"
+)
+
+// DocumentGetter is the part of the document table the stages read the
+// supersession marker from.
+type DocumentGetter interface {
+	GetDocument(ctx context.Context, id string) (*types.Document, error)
+}
+
+// SupersededError returns the error the workflow ends on when a newer
+// version replaced the document, nil when it wasn't.
+func SupersededError(document *types.Document) error {
+	if document.SupersededBy == "" {
+		return nil
+	}
+
+	slog.Info(
+		"Document was replaced by a newer version",
+		"id",
+		document.ID,
+		"supersededBy",
+		document.SupersededBy,
+	)
+
+	return messages.InvokeResponse_Error{
+		Type: types.DOCUMENT_ERROR_SUPERSEDED,
+		Message: fmt.Sprintf(
+			"%s: superseded by %s",
+			document.ID,
+			document.SupersededBy,
+		),
+	}
+}
+
+// CheckSuperseded reads the document again and returns the superseded error
+// when a newer version replaced it, or replaced the scan it was split from.
+// The stages check before each expensive call.
+func CheckSuperseded(
+	ctx context.Context,
+	store DocumentGetter,
+	documentID string,
+) error {
+	document, err := getDocument(ctx, store, documentID)
+	if err != nil {
+		return err
+	}
+
+	if err := SupersededError(document); err != nil || document.ParentID == "" {
+		return err
+	}
+
+	parent, err := getDocument(ctx, store, document.ParentID)
+	if err != nil {
+		return err
+	}
+
+	return SupersededError(parent)
+}
+
+func getDocument(
+	ctx context.Context,
+	store DocumentGetter,
+	documentID string,
+) (*types.Document, error) {
+	document, err := store.GetDocument(ctx, documentID)
+	if err != nil {
+		slog.Error(
+			"Failed to check whether the document was superseded",
+			"id",
+			documentID,
+			"error",
+			err,
+		)
+		return nil, err
+	}
+
+	return document, nil
+}
+
+// IsSuperseded reports whether the error is the superseded error.
+func IsSuperseded(err error) bool {
+	var invokeErr messages.InvokeResponse_Error
+
+	return errors.As(err, &invokeErr) &&
+		invokeErr.Type == types.DOCUMENT_ERROR_SUPERSEDED
+}
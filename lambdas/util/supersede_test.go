@@ -0,0 +1,73 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/KyleBrandon/scriptor/pkg/types"
+)
+
+// Documents by ID
+type fakeDocuments map[string]*types.Document
+
+func (f fakeDocuments) GetDocument(ctx context.Context, id string) (*types.Document, error) {
+	document, ok := f[id]
+	if !ok {
+		return nil, errors.New("document not found")
+	}
+
+	return document, nil
+}
+
+func TestCheckSuperseded(t *testing.T) {
+	tests := []struct {
+		name           string
+		documents      fakeDocuments
+		wantSuperseded bool
+		wantErr        bool
+	}{
+		{
+			name:      "current document",
+			documents: fakeDocuments{"doc-1": {ID: "doc-1"}},
+		},
+		{
+			name:           "replaced by a newer version",
+			documents:      fakeDocuments{"doc-1": {ID: "doc-1", SupersededBy: "doc-2"}},
+			wantSuperseded: true,
+		},
+		{
+			name: "split from a scan that was replaced",
+			documents: fakeDocuments{
+				"doc-1":  {ID: "doc-1", ParentID: "scan-1"},
+				"scan-1": {ID: "scan-1", SupersededBy: "scan-2"},
+			},
+			wantSuperseded: true,
+		},
+		{
+			name: "split from a current scan",
+			documents: fakeDocuments{
+				"doc-1":  {ID: "doc-1", ParentID: "scan-1"},
+				"scan-1": {ID: "scan-1"},
+			},
+		},
+		{
+			name:      "document missing",
+			documents: fakeDocuments{},
+			wantErr:   true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := CheckSuperseded(context.Background(), tc.documents, "doc-1")
+			if IsSuperseded(err) != tc.wantSuperseded {
+				t.Fatalf("unexpected superseded check: %v", err)
+			}
+
+			if (err != nil) != (tc.wantSuperseded || tc.wantErr) {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+}
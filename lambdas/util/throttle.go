@@ -0,0 +1,93 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+
+	"github.com/KyleBrandon/scriptor/pkg/database"
+	"github.com/KyleBrandon/scriptor/pkg/types"
+)
+
+type (
+	// ExecutionSlots is the part of the document table that marks the
+	// documents counted against the execution limit of their channel.
+	ExecutionSlots interface {
+		HoldExecutionSlot(ctx context.Context, id string) (bool, error)
+		ReleaseExecutionSlot(ctx context.Context, id string) (bool, error)
+	}
+
+	// ExecutionCounter is the part of the watch channel table that counts
+	// the executions running for each channel.
+	ExecutionCounter interface {
+		IncrementActiveExecutions(ctx context.Context, channelID string, limit int) error
+		DecrementActiveExecutions(ctx context.Context, channelID string) error
+	}
+)
+
+// AcquireExecutionSlot counts the document against the execution limit of
+// its channel. Returns false, with nothing counted, when the channel is
+// already running as many executions as it allows. A document counted by
+// an earlier attempt isn't counted again.
+func AcquireExecutionSlot(
+	ctx context.Context,
+	slots ExecutionSlots,
+	counter ExecutionCounter,
+	document *types.Document,
+	limit int,
+) (bool, error) {
+	// the document is marked first, so a mark without a count is the worst
+	// an interrupted attempt leaves behind
+	held, err := slots.HoldExecutionSlot(ctx, document.ID)
+	if err != nil || !held {
+		return err == nil, err
+	}
+
+	err = counter.IncrementActiveExecutions(ctx, document.ChannelID, limit)
+	if err == nil {
+		return true, nil
+	}
+
+	_, releaseErr := slots.ReleaseExecutionSlot(ctx, document.ID)
+	if releaseErr != nil {
+		slog.Error(
+			"Failed to clear the execution slot of the document",
+			"id",
+			document.ID,
+			"error",
+			releaseErr,
+		)
+		return false, errors.Join(err, releaseErr)
+	}
+
+	if errors.Is(err, database.ErrExecutionLimitReached) {
+		return false, nil
+	}
+
+	return false, err
+}
+
+// ReleaseExecutionSlot gives back the execution the document was counted
+// for when its workflow ends. Documents that were never counted, or were
+// already given back, are left alone.
+func ReleaseExecutionSlot(
+	ctx context.Context,
+	slots ExecutionSlots,
+	counter ExecutionCounter,
+	document *types.Document,
+) error {
+	released, err := slots.ReleaseExecutionSlot(ctx, document.ID)
+	if err != nil || !released {
+		return err
+	}
+
+	slog.Info(
+		"Giving back the execution of the document",
+		"id",
+		document.ID,
+		"channelID",
+		document.ChannelID,
+	)
+
+	return counter.DecrementActiveExecutions(ctx, document.ChannelID)
+}
@@ -0,0 +1,132 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/KyleBrandon/scriptor/pkg/database"
+	"github.com/KyleBrandon/scriptor/pkg/types"
+)
+
+// The documents marked as holding a slot, with the same conditions as the
+// table
+type fakeSlots map[string]bool
+
+func (f fakeSlots) HoldExecutionSlot(ctx context.Context, id string) (bool, error) {
+	if f[id] {
+		return false, nil
+	}
+
+	f[id] = true
+	return true, nil
+}
+
+func (f fakeSlots) ReleaseExecutionSlot(ctx context.Context, id string) (bool, error) {
+	if !f[id] {
+		return false, nil
+	}
+
+	delete(f, id)
+	return true, nil
+}
+
+// The executions counted for a channel, or a counter that fails
+type fakeCounter struct {
+	active  int
+	failing bool
+}
+
+func (f *fakeCounter) IncrementActiveExecutions(ctx context.Context, channelID string, limit int) error {
+	if f.failing {
+		return errors.New("table unavailable")
+	}
+
+	if f.active >= limit {
+		return database.ErrExecutionLimitReached
+	}
+
+	f.active++
+	return nil
+}
+
+func (f *fakeCounter) DecrementActiveExecutions(ctx context.Context, channelID string) error {
+	f.active = max(f.active-1, 0)
+	return nil
+}
+
+func TestAcquireExecutionSlot(t *testing.T) {
+	tests := []struct {
+		name    string
+		held    bool
+		active  int
+		failing bool
+
+		want       bool
+		wantErr    bool
+		wantActive int
+		wantHeld   bool
+	}{
+		{name: "below the limit", active: 1, want: true, wantActive: 2, wantHeld: true},
+		{name: "at the limit", active: 2, wantActive: 2},
+		{
+			// an earlier attempt already counted the document
+			name:       "already held",
+			held:       true,
+			active:     2,
+			want:       true,
+			wantActive: 2,
+			wantHeld:   true,
+		},
+		{name: "counter fails", failing: true, wantErr: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			slots := fakeSlots{"doc-1": tc.held}
+			counter := &fakeCounter{active: tc.active, failing: tc.failing}
+			document := &types.Document{ID: "doc-1", ChannelID: "channel-1"}
+
+			got, err := AcquireExecutionSlot(context.Background(), slots, counter, document, 2)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if got != tc.want {
+				t.Fatalf("unexpected result: got %v want %v", got, tc.want)
+			}
+
+			if counter.active != tc.wantActive {
+				t.Fatalf("unexpected count: got %d want %d", counter.active, tc.wantActive)
+			}
+
+			if slots["doc-1"] != tc.wantHeld {
+				t.Fatalf("unexpected mark: got %v want %v", slots["doc-1"], tc.wantHeld)
+			}
+		})
+	}
+}
+
+func TestReleaseExecutionSlotOnce(t *testing.T) {
+	slots := fakeSlots{"doc-1": true}
+	counter := &fakeCounter{active: 2}
+
+	document := &types.Document{ID: "doc-1", ChannelID: "channel-1"}
+	for range 2 {
+		err := ReleaseExecutionSlot(context.Background(), slots, counter, document)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	// a document that was never counted gives nothing back
+	other := &types.Document{ID: "doc-2", ChannelID: "channel-1"}
+	err := ReleaseExecutionSlot(context.Background(), slots, counter, other)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if counter.active != 1 {
+		t.Fatalf("unexpected count: got %d want 1", counter.active)
+	}
+}
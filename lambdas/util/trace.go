@@ -0,0 +1,138 @@
+package util
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+
+	"github.com/KyleBrandon/scriptor/pkg/types"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	sqstypes "github.com/aws/aws-sdk-go-v2/service/sqs/types"
+)
+
+// Names of the SQS message attributes that trace a notification from the
+// webhook request that queued it
+const (
+	ATTRIBUTE_NOTIFICATION_ID = "NotificationID"
+	ATTRIBUTE_CHANNEL_ID      = "ChannelID"
+	ATTRIBUTE_REQUEST_ID      = "RequestID"
+)
+
+// Trace identifies the webhook request and the notification a message or a
+// log line belongs to.
+type Trace struct {
+	NotificationID string
+	ChannelID      string
+
+	// The API Gateway request ID of the webhook request
+	RequestID string
+}
+
+type traceKey struct{}
+
+// MessageAttributes returns the SQS message attributes of the trace. Empty
+// values are left out, SQS rejects them.
+func (t Trace) MessageAttributes() map[string]sqstypes.MessageAttributeValue {
+	attributes := make(map[string]sqstypes.MessageAttributeValue)
+	for name, value := range t.values() {
+		if value == "" {
+			continue
+		}
+
+		attributes[name] = sqstypes.MessageAttributeValue{
+			DataType:    aws.String("String"),
+			StringValue: aws.String(value),
+		}
+	}
+
+	return attributes
+}
+
+func (t Trace) values() map[string]string {
+	return map[string]string{
+		ATTRIBUTE_NOTIFICATION_ID: t.NotificationID,
+		ATTRIBUTE_CHANNEL_ID:      t.ChannelID,
+		ATTRIBUTE_REQUEST_ID:      t.RequestID,
+	}
+}
+
+// TraceFromMessage reads the trace of a queued notification from its message
+// attributes. Messages queued before they had attributes fall back to the
+// IDs in the body.
+func TraceFromMessage(message events.SQSMessage) Trace {
+	attribute := func(name string) string {
+		value, ok := message.MessageAttributes[name]
+		if !ok || value.StringValue == nil {
+			return ""
+		}
+
+		return *value.StringValue
+	}
+
+	t := Trace{
+		NotificationID: attribute(ATTRIBUTE_NOTIFICATION_ID),
+		ChannelID:      attribute(ATTRIBUTE_CHANNEL_ID),
+		RequestID:      attribute(ATTRIBUTE_REQUEST_ID),
+	}
+
+	if t.NotificationID == "" || t.ChannelID == "" {
+		var notification types.ChannelNotification
+		if err := json.Unmarshal([]byte(message.Body), &notification); err == nil {
+			if t.NotificationID == "" {
+				t.NotificationID = notification.NotificationID
+			}
+			if t.ChannelID == "" {
+				t.ChannelID = notification.ChannelID
+			}
+		}
+	}
+
+	return t
+}
+
+// WithTrace returns a context that carries the trace to the log lines
+// written with it.
+func WithTrace(ctx context.Context, t Trace) context.Context {
+	return context.WithValue(ctx, traceKey{}, t)
+}
+
+// TraceFromContext returns the trace the context carries, or an empty one.
+func TraceFromContext(ctx context.Context) Trace {
+	t, _ := ctx.Value(traceKey{}).(Trace)
+	return t
+}
+
+// traceHandler adds the trace of the context to every record
+type traceHandler struct {
+	slog.Handler
+}
+
+// NewTraceHandler wraps the handler so the records logged with a context
+// from WithTrace include its notificationID, channelID and requestID.
+func NewTraceHandler(handler slog.Handler) slog.Handler {
+	return traceHandler{Handler: handler}
+}
+
+func (h traceHandler) Handle(ctx context.Context, record slog.Record) error {
+	t := TraceFromContext(ctx)
+	if t.NotificationID != "" {
+		record.AddAttrs(slog.String("notificationID", t.NotificationID))
+	}
+	if t.ChannelID != "" {
+		record.AddAttrs(slog.String("channelID", t.ChannelID))
+	}
+	if t.RequestID != "" {
+		record.AddAttrs(slog.String("requestID", t.RequestID))
+	}
+
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h traceHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return traceHandler{Handler: h.Handler.WithAttrs(attrs)}
+}
+
+func (h traceHandler) WithGroup(name string) slog.Handler {
+	return traceHandler{Handler: h.Handler.WithGroup(name)}
+}
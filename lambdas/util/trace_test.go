@@ -0,0 +1,128 @@
+package util
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// The attributes of a queued message as the SQS event delivers them
+func deliveredAttributes(t Trace) map[string]events.SQSMessageAttribute {
+	delivered := make(map[string]events.SQSMessageAttribute)
+	for name, value := range t.MessageAttributes() {
+		delivered[name] = events.SQSMessageAttribute{
+			DataType:    *value.DataType,
+			StringValue: value.StringValue,
+		}
+	}
+
+	return delivered
+}
+
+func TestTraceFromMessage(t *testing.T) {
+	body := `{"notification_id":"body-notification","channel_id":"body-channel","folder_id":"watch"}`
+
+	tests := []struct {
+		name    string
+		message events.SQSMessage
+		want    Trace
+	}{
+		{
+			name: "attributes",
+			message: events.SQSMessage{
+				Body: body,
+				MessageAttributes: deliveredAttributes(Trace{
+					NotificationID: "notification-1",
+					ChannelID:      "channel-1",
+					RequestID:      "request-1",
+				}),
+			},
+			want: Trace{
+				NotificationID: "notification-1",
+				ChannelID:      "channel-1",
+				RequestID:      "request-1",
+			},
+		},
+		{
+			// queued before the webhook set the attributes
+			name:    "body only",
+			message: events.SQSMessage{Body: body},
+			want: Trace{
+				NotificationID: "body-notification",
+				ChannelID:      "body-channel",
+			},
+		},
+		{
+			name: "without a request",
+			message: events.SQSMessage{
+				Body: body,
+				MessageAttributes: deliveredAttributes(Trace{
+					NotificationID: "notification-1",
+					ChannelID:      "channel-1",
+				}),
+			},
+			want: Trace{NotificationID: "notification-1", ChannelID: "channel-1"},
+		},
+		{
+			name:    "unreadable body",
+			message: events.SQSMessage{Body: "not json"},
+			want:    Trace{},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := TraceFromMessage(tc.message); got != tc.want {
+				t.Fatalf("unexpected trace: got %+v want %+v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestTraceMessageAttributesSkipsEmpty(t *testing.T) {
+	attributes := Trace{NotificationID: "notification-1"}.MessageAttributes()
+	if len(attributes) != 1 {
+		t.Fatalf("unexpected attributes: %+v", attributes)
+	}
+
+	if *attributes[ATTRIBUTE_NOTIFICATION_ID].StringValue != "notification-1" {
+		t.Fatalf("unexpected attribute: %+v", attributes[ATTRIBUTE_NOTIFICATION_ID])
+	}
+}
+
+func TestTraceHandler(t *testing.T) {
+	var logs bytes.Buffer
+	logger := slog.New(NewTraceHandler(slog.NewTextHandler(&logs, nil)))
+
+	ctx := WithTrace(context.Background(), Trace{
+		NotificationID: "notification-1",
+		ChannelID:      "channel-1",
+		RequestID:      "request-1",
+	})
+	logger.With("stage", "new").InfoContext(ctx, "traced")
+	logger.Info("untraced")
+
+	lines := strings.Split(strings.TrimSpace(logs.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("unexpected logs: %q", logs.String())
+	}
+
+	for _, want := range []string{
+		"stage=new",
+		"notificationID=notification-1",
+		"channelID=channel-1",
+		"requestID=request-1",
+	} {
+		if !strings.Contains(lines[0], want) {
+			t.Fatalf("traced line without %s: %s", want, lines[0])
+		}
+	}
+
+	if strings.Contains(lines[1], "ID=") {
+		t.Fatalf("untraced line with a trace: %s", lines[1])
+	}
+}
@@ -0,0 +1,88 @@
+package util
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"sync"
+	"time"
+)
+
+// Crockford's base32, which sorts in the same order as the values it encodes
+const crockfordAlphabet = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// NewULID returns a new ULID: 48 bits of Unix milliseconds followed by 80
+// random bits, as 26 characters that sort by the time they were made. Tests
+// replace it to get deterministic names.
+var NewULID = defaultULIDs.next
+
+var defaultULIDs = &ulidGenerator{now: time.Now}
+
+// Makes ULIDs that keep increasing within the same millisecond by adding one
+// to the random bits of the last ULID
+type ulidGenerator struct {
+	mu      sync.Mutex
+	now     func() time.Time
+	lastMs  uint64
+	entropy [10]byte
+}
+
+func (g *ulidGenerator) next() string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	ms := uint64(g.now().UnixMilli())
+	if ms <= g.lastMs && incrementEntropy(&g.entropy) {
+		// the clock stood still or went back, stay after the last ULID
+		ms = g.lastMs
+	} else {
+		if _, err := rand.Read(g.entropy[:]); err != nil {
+			panic("failed to read random bytes: " + err.Error())
+		}
+
+		// the random bits ran out within the millisecond, move to the next
+		ms = max(ms, g.lastMs+1)
+	}
+
+	g.lastMs = ms
+
+	return encodeULID(ms, g.entropy)
+}
+
+// Add one to the random bits, false when they overflow
+func incrementEntropy(entropy *[10]byte) bool {
+	for i := len(entropy) - 1; i >= 0; i-- {
+		entropy[i]++
+		if entropy[i] != 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+func encodeULID(ms uint64, entropy [10]byte) string {
+	var id [16]byte
+	binary.BigEndian.PutUint64(id[:8], ms<<16)
+	copy(id[6:], entropy[:])
+
+	// 128 bits in 26 characters of 5 bits, the first character has the
+	// top 3 bits
+	hi := binary.BigEndian.Uint64(id[:8])
+	lo := binary.BigEndian.Uint64(id[8:])
+
+	var out [26]byte
+	for i := 25; i >= 0; i-- {
+		out[i] = crockfordAlphabet[lo&0x1f]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+
+	return string(out[:])
+}
+
+// StageFileName names the file saved to S3 for a stage of the document. The
+// ULID keeps names from the same second apart. Older stages were named with
+// the Unix seconds instead, nothing depends on the part before the extension.
+func StageFileName(documentName, ext string) string {
+	return documentName + "-" + NewULID() + ext
+}
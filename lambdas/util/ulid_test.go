@@ -0,0 +1,132 @@
+package util
+
+import (
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestEncodeULID(t *testing.T) {
+	var maxEntropy [10]byte
+	for i := range maxEntropy {
+		maxEntropy[i] = 0xff
+	}
+
+	tests := []struct {
+		name    string
+		ms      uint64
+		entropy [10]byte
+		want    string
+	}{
+		{
+			name: "zero",
+			want: "00000000000000000000000000",
+		},
+		{
+			name: "one millisecond",
+			ms:   1,
+			want: "00000000010000000000000000",
+		},
+		{
+			name:    "largest",
+			ms:      1<<48 - 1,
+			entropy: maxEntropy,
+			want:    "7ZZZZZZZZZZZZZZZZZZZZZZZZZ",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got := encodeULID(tc.ms, tc.entropy)
+			if got != tc.want {
+				t.Fatalf("unexpected ULID: got %s want %s", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestULIDsIncreaseWhenTheClockStandsStill(t *testing.T) {
+	now := time.Date(2026, 3, 12, 8, 0, 0, 0, time.UTC)
+	g := &ulidGenerator{now: func() time.Time { return now }}
+
+	previous := g.next()
+	for range 1000 {
+		id := g.next()
+		if id <= previous {
+			t.Fatalf("ULID did not increase: %s after %s", id, previous)
+		}
+		previous = id
+	}
+
+	// a clock that goes back doesn't move the ULIDs back with it
+	now = now.Add(-time.Hour)
+	if id := g.next(); id <= previous {
+		t.Fatalf("ULID went back with the clock: %s after %s", id, previous)
+	}
+}
+
+func TestULIDsEntropyOverflowMovesToTheNextMillisecond(t *testing.T) {
+	now := time.UnixMilli(5)
+	g := &ulidGenerator{now: func() time.Time { return now }}
+
+	first := g.next()
+	for i := range g.entropy {
+		g.entropy[i] = 0xff
+	}
+
+	id := g.next()
+	if id <= first || g.lastMs != 6 {
+		t.Fatalf("unexpected ULID after the overflow: %s at %d", id, g.lastMs)
+	}
+}
+
+func TestNewULIDConcurrently(t *testing.T) {
+	const workers = 8
+	const perWorker = 1000
+
+	names := make([][]string, workers)
+
+	var wg sync.WaitGroup
+	for w := range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range perWorker {
+				names[w] = append(names[w], StageFileName("scan", ".pdf"))
+			}
+		}()
+	}
+	wg.Wait()
+
+	seen := make(map[string]bool, workers*perWorker)
+	for _, worker := range names {
+		// the names each worker made sort in the order they were made
+		if !slices.IsSorted(worker) {
+			t.Fatalf("names are not in lexical order")
+		}
+
+		for _, name := range worker {
+			if seen[name] {
+				t.Fatalf("duplicate name %s", name)
+			}
+			seen[name] = true
+
+			if !strings.HasPrefix(name, "scan-") || !strings.HasSuffix(name, ".pdf") ||
+				len(name) != len("scan-.pdf")+26 {
+				t.Fatalf("unexpected name %s", name)
+			}
+		}
+	}
+}
+
+func TestStageFileNameUsesTheULIDSeam(t *testing.T) {
+	t.Cleanup(func() { NewULID = defaultULIDs.next })
+	NewULID = func() string { return "01JP0000000000000000000000" }
+
+	got := StageFileName("scan", ".md")
+	if got != "scan-01JP0000000000000000000000.md" {
+		t.Fatalf("unexpected name: %s", got)
+	}
+}
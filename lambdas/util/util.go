@@ -3,10 +3,14 @@ package util
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log/slog"
+	"os"
 	"path/filepath"
 	"strings"
 
+	"github.com/KyleBrandon/scriptor/pkg/notes"
 	"github.com/KyleBrandon/scriptor/pkg/types"
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-sdk-go-v2/aws"
@@ -15,6 +19,9 @@ import (
 	"github.com/openai/openai-go/v3/option"
 )
 
+// Characters of the document ID kept in a fallback name
+const fallbackIDLength = 8
+
 func Assert[V comparable](got, expected V, message string) {
 	if expected != got {
 		panic(message)
@@ -31,12 +38,80 @@ func BuildGatewayResponse(
 	}, nil
 }
 
-func BuildStepInput(notificationID, documentID, stage string) (string, error) {
+// The body of an error response, the code is stable so the API Gateway logs
+// can be searched for it
+type gatewayError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// BuildGatewayErrorResponse builds a response with a JSON body holding the
+// error code and message, {"code": "...", "message": "..."}
+func BuildGatewayErrorResponse(
+	code, message string,
+	statusCode int,
+) (events.APIGatewayProxyResponse, error) {
+	// a struct of strings always marshals
+	body, _ := json.Marshal(&gatewayError{Code: code, Message: message})
+
+	return events.APIGatewayProxyResponse{
+		Headers:    map[string]string{"Content-Type": "application/json"},
+		Body:       string(body),
+		StatusCode: statusCode,
+	}, nil
+}
+
+// FilenameTemplate returns the template for the names of the files published
+// for the watch channel. Channels without their own use FILENAME_TEMPLATE, or
+// the original file name when that isn't set either.
+func FilenameTemplate(wc *types.WatchChannel) string {
+	if wc.FilenameTemplate != "" {
+		return wc.FilenameTemplate
+	}
+
+	if text := os.Getenv("FILENAME_TEMPLATE"); text != "" {
+		return text
+	}
+
+	return notes.DEFAULT_FILENAME_TEMPLATE
+}
+
+// StepFailure is the failure a step is built with for the states that
+// handle errors.
+type StepFailure struct {
+	Error   *types.StepError
+	Stage   types.Stage
+	Attempt int
+}
+
+// BuildStepInput builds the input the state machine is started with. The
+// trace identifies the notification that found the document, the document ID
+// is the ID of the document record, and the stage is the last one that
+// finished, which the workflow picks up after. The failure is nil unless the
+// step is for a state that handles errors.
+func BuildStepInput(
+	trace Trace,
+	documentID string,
+	stage types.Stage,
+	failure *StepFailure,
+) (string, error) {
 	// Start the state machine with the document id and stage
 	input := types.DocumentStep{
-		NotificationID: notificationID,
+		NotificationID: trace.NotificationID,
+		ChannelID:      trace.ChannelID,
 		DocumentID:     documentID,
 		Stage:          stage,
+		RequestID:      trace.RequestID,
+	}
+
+	if failure != nil {
+		input.Error = failure.Error
+		input.ErrorStage = failure.Stage
+		input.Attempt = failure.Attempt
+	}
+
+	if err := ValidateStep(input); err != nil {
+		return "", err
 	}
 
 	inputJSON, err := json.Marshal(input)
@@ -52,6 +127,27 @@ func BuildStepInput(notificationID, documentID, stage string) (string, error) {
 	return string(inputJSON), nil
 }
 
+// ValidateStep checks the input a stage of the workflow was started with, so
+// a malformed input fails with what is wrong with it instead of a missing
+// record.
+func ValidateStep(step types.DocumentStep) error {
+	if step.DocumentID == "" {
+		return errors.New("the step input has no document ID")
+	}
+
+	if _, err := types.ParseStage(string(step.Stage)); err != nil {
+		return fmt.Errorf("the step input for %s: %w", step.DocumentID, err)
+	}
+
+	if step.ErrorStage != "" {
+		if _, err := types.ParseStage(string(step.ErrorStage)); err != nil {
+			return fmt.Errorf("the error stage of the step input for %s: %w", step.DocumentID, err)
+		}
+	}
+
+	return nil
+}
+
 func GetNamePart(fullName string) string {
 
 	ext := filepath.Ext(fullName)
@@ -60,6 +156,39 @@ func GetNamePart(fullName string) string {
 	return nameWithoutExt
 }
 
+// SafeBaseName returns the name without its extension, with the characters
+// Drive or Obsidian won't accept replaced and its length limited. Drive allows
+// files named only ".pdf", or with no name at all, so the fallback is used
+// when nothing is left.
+func SafeBaseName(name, fallbackID string) string {
+	if base := notes.SanitizeFilename(GetNamePart(name)); base != "" {
+		return base
+	}
+
+	return fallbackID
+}
+
+// FallbackName is the deterministic name of a document without a usable
+// name, built from the date it was scanned and its ID.
+func FallbackName(document *types.Document) string {
+	id := notes.SanitizeFilename(document.ID)
+	if len(id) > fallbackIDLength {
+		id = id[:fallbackIDLength]
+	}
+
+	if document.CreatedTime.IsZero() {
+		return "scan-" + id
+	}
+
+	return fmt.Sprintf("scan-%s-%s", document.CreatedTime.UTC().Format("20060102"), id)
+}
+
+// DocumentBaseName is the safe base name of the document, used for its stage
+// files, notes and published files.
+func DocumentBaseName(document *types.Document) string {
+	return SafeBaseName(document.Name, FallbackName(document))
+}
+
 func getSecret(
 	ctx context.Context,
 	sm *secretsmanager.Client,
@@ -76,11 +205,50 @@ func getSecret(
 	return *result.SecretString, nil
 }
 
-// TODO: Make this into a generic
-func GetDefaultFolderLocations(
+// ParseFolderLocations reads the folders of the default locations secret.
+// The secret is either a list of folders or, as it was before folders could
+// be listed, a single one. Every folder must have an ID, and no folder can be
+// listed twice.
+func ParseFolderLocations(secret string) ([]*types.GoogleFolderDefaultLocations, error) {
+	var folderLocations []*types.GoogleFolderDefaultLocations
+
+	secret = strings.TrimSpace(secret)
+	if strings.HasPrefix(secret, "[") {
+		if err := json.Unmarshal([]byte(secret), &folderLocations); err != nil {
+			return nil, err
+		}
+	} else {
+		var single types.GoogleFolderDefaultLocations
+		if err := json.Unmarshal([]byte(secret), &single); err != nil {
+			return nil, err
+		}
+		folderLocations = append(folderLocations, &single)
+	}
+
+	if len(folderLocations) == 0 {
+		return nil, errors.New("no default folder locations are configured")
+	}
+
+	seen := make(map[string]bool, len(folderLocations))
+	for i, locations := range folderLocations {
+		if locations == nil || locations.FolderID == "" {
+			return nil, fmt.Errorf("default folder locations %d has no folder_id", i)
+		}
+
+		if seen[locations.FolderID] {
+			return nil, fmt.Errorf("folder %s is listed more than once", locations.FolderID)
+		}
+		seen[locations.FolderID] = true
+	}
+
+	return folderLocations, nil
+}
+
+// GetFolderLocations returns every folder of the default locations secret.
+func GetFolderLocations(
 	ctx context.Context,
 	awsCfg aws.Config,
-) (*types.GoogleFolderDefaultLocations, error) {
+) ([]*types.GoogleFolderDefaultLocations, error) {
 
 	sm := secretsmanager.NewFromConfig(awsCfg)
 
@@ -99,9 +267,7 @@ func GetDefaultFolderLocations(
 		return nil, err
 	}
 
-	var folderLocations types.GoogleFolderDefaultLocations
-
-	err = json.Unmarshal([]byte(folderInfo), &folderLocations)
+	folderLocations, err := ParseFolderLocations(folderInfo)
 	if err != nil {
 		slog.Error(
 			"Failed to unmarshal default Google folder locations from secret manager",
@@ -111,7 +277,21 @@ func GetDefaultFolderLocations(
 		return nil, err
 	}
 
-	return &folderLocations, nil
+	return folderLocations, nil
+}
+
+// GetDefaultFolderLocations returns the first folder of the default
+// locations secret, used for the folders a watch channel doesn't set.
+func GetDefaultFolderLocations(
+	ctx context.Context,
+	awsCfg aws.Config,
+) (*types.GoogleFolderDefaultLocations, error) {
+	folderLocations, err := GetFolderLocations(ctx, awsCfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return folderLocations[0], nil
 }
 
 func CreateOpenAIClient(
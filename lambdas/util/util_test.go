@@ -0,0 +1,405 @@
+package util
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/KyleBrandon/scriptor/pkg/notes"
+	"github.com/KyleBrandon/scriptor/pkg/types"
+)
+
+func TestSafeBaseName(t *testing.T) {
+	tests := []struct {
+		name     string
+		fileName string
+		want     string
+	}{
+		{
+			name:     "plain name",
+			fileName: "journal.pdf",
+			want:     "journal",
+		},
+		{
+			name:     "unsafe characters replaced",
+			fileName: "Meeting: Q1/Q2 [final].pdf",
+			want:     "Meeting Q1 Q2 final",
+		},
+		{
+			name:     "empty name",
+			fileName: "",
+			want:     "fallback",
+		},
+		{
+			name:     "only an extension",
+			fileName: ".pdf",
+			want:     "fallback",
+		},
+		{
+			name:     "only dots",
+			fileName: "...",
+			want:     "fallback",
+		},
+		{
+			name:     "only whitespace",
+			fileName: "  \t.pdf",
+			want:     "fallback",
+		},
+		{
+			name:     "only invalid characters",
+			fileName: `?*:<>|"\/.pdf`,
+			want:     "fallback",
+		},
+		{
+			name:     "control characters",
+			fileName: "scan\x00\x1f.pdf",
+			want:     "scan",
+		},
+		{
+			name:     "dots around the name",
+			fileName: "..scan..pdf",
+			want:     "scan",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got := SafeBaseName(tc.fileName, "fallback")
+			if got != tc.want {
+				t.Fatalf("unexpected name: got %q want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestSafeBaseNameTruncatesLongNames(t *testing.T) {
+	tests := []struct {
+		name     string
+		fileName string
+	}{
+		{
+			name:     "ascii",
+			fileName: strings.Repeat("a", 500) + ".pdf",
+		},
+		{
+			name:     "multibyte",
+			fileName: strings.Repeat("日本語", 200) + ".pdf",
+		},
+		{
+			name:     "invalid characters past the limit",
+			fileName: strings.Repeat("a", notes.MAX_FILENAME_LENGTH-1) + strings.Repeat("?", 50) + ".pdf",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got := SafeBaseName(tc.fileName, "fallback")
+
+			if got == "fallback" || got == "" {
+				t.Fatalf("unexpected fallback for %q", tc.fileName)
+			}
+
+			if utf8.RuneCountInString(got) > notes.MAX_FILENAME_LENGTH || !utf8.ValidString(got) {
+				t.Fatalf("name is not truncated: %d characters", utf8.RuneCountInString(got))
+			}
+
+			if strings.HasSuffix(got, " ") || strings.HasSuffix(got, ".") {
+				t.Fatalf("name ends in a space or dot: %q", got)
+			}
+
+			// the execution name of the document still fits
+			executionName := BuildExecutionName(&types.Document{
+				GoogleID:    "file-1",
+				Name:        tc.fileName,
+				CreatedTime: time.Now().UTC(),
+			})
+			if !executionNamePattern.MatchString(suffixExecutionName(executionName, 98)) {
+				t.Fatalf("execution name %q is not valid", executionName)
+			}
+		})
+	}
+}
+
+func TestFallbackName(t *testing.T) {
+	createdTime := time.Date(2026, 3, 11, 23, 30, 0, 0, time.FixedZone("PST", -8*60*60))
+
+	tests := []struct {
+		name     string
+		document types.Document
+		want     string
+	}{
+		{
+			name:     "scan date and short ID",
+			document: types.Document{ID: "0c8f3a2e-41d5-4b7a", CreatedTime: createdTime},
+			want:     "scan-20260312-0c8f3a2e",
+		},
+		{
+			name:     "no scan date",
+			document: types.Document{ID: "0c8f3a2e-41d5-4b7a"},
+			want:     "scan-0c8f3a2e",
+		},
+		{
+			name:     "short ID",
+			document: types.Document{ID: "doc-1", CreatedTime: createdTime},
+			want:     "scan-20260312-doc-1",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got := FallbackName(&tc.document)
+			if got != tc.want {
+				t.Fatalf("unexpected name: got %q want %q", got, tc.want)
+			}
+
+			// the same document always gets the same name
+			if again := FallbackName(&tc.document); again != got {
+				t.Fatalf("fallback name is not deterministic: %q then %q", got, again)
+			}
+		})
+	}
+}
+
+func TestDocumentBaseNameFeedsTheTemplates(t *testing.T) {
+	document := &types.Document{
+		ID:          "0c8f3a2e-41d5-4b7a",
+		Name:        ".pdf",
+		CreatedTime: time.Date(2026, 3, 12, 8, 0, 0, 0, time.UTC),
+	}
+
+	name := DocumentBaseName(document)
+
+	note, err := notes.Render(notes.DefaultTemplates(), notes.NewFields(document.ID, name, document.Name))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if !strings.Contains(note.Header, `id: "scan-20260312-0c8f3a2e"`) {
+		t.Fatalf("unexpected header: %q", note.Header)
+	}
+
+	fileName, err := notes.RenderFilename(
+		notes.DEFAULT_FILENAME_TEMPLATE,
+		notes.FilenameFields{OriginalName: name},
+	)
+	if err != nil || fileName != "scan-20260312-0c8f3a2e" {
+		t.Fatalf("unexpected file name %q: %v", fileName, err)
+	}
+
+	if got := StageFileName(name, ".md"); !strings.HasPrefix(got, "scan-20260312-0c8f3a2e-") {
+		t.Fatalf("unexpected stage file name %q", got)
+	}
+}
+
+func TestBuildStepInput(t *testing.T) {
+	tests := []struct {
+		name           string
+		notificationID string
+		channelID      string
+		requestID      string
+		documentID     string
+		stage          types.Stage
+		failure        *StepFailure
+		want           string
+		wantErr        bool
+	}{
+		{
+			name:           "drive document",
+			notificationID: "notification-1",
+			channelID:      "channel-1",
+			documentID:     "doc-1",
+			stage:          types.DOCUMENT_STAGE_NEW,
+			want:           `{"notification_id":"notification-1","channel_id":"channel-1","id":"doc-1","stage":"new","status":""}`,
+		},
+		{
+			name:           "traced drive document",
+			notificationID: "notification-1",
+			channelID:      "channel-1",
+			requestID:      "request-1",
+			documentID:     "doc-1",
+			stage:          types.DOCUMENT_STAGE_NEW,
+			want:           `{"notification_id":"notification-1","channel_id":"channel-1","id":"doc-1","stage":"new","status":"","request_id":"request-1"}`,
+		},
+		{
+			name:           "kindle document",
+			notificationID: "message-1",
+			documentID:     "doc-1",
+			stage:          types.DOCUMENT_STAGE_DOWNLOAD,
+			want:           `{"notification_id":"message-1","id":"doc-1","stage":"downloaded","status":""}`,
+		},
+		{
+			name:           "failed document",
+			notificationID: "notification-1",
+			documentID:     "doc-1",
+			stage:          types.DOCUMENT_STAGE_MATHPIX,
+			failure: &StepFailure{
+				Error:   &types.StepError{Error: "States.Timeout"},
+				Stage:   types.DOCUMENT_STAGE_OPENAI,
+				Attempt: 2,
+			},
+			want: `{"notification_id":"notification-1","id":"doc-1","stage":"mathpix","status":"","error":{"Error":"States.Timeout","Cause":""},"error_stage":"openai","attempt":2}`,
+		},
+		{
+			name:       "failed at an unknown stage",
+			documentID: "doc-1",
+			stage:      types.DOCUMENT_STAGE_MATHPIX,
+			failure:    &StepFailure{Stage: "chatgpt"},
+			wantErr:    true,
+		},
+		{name: "unknown stage", documentID: "doc-1", stage: "download", wantErr: true},
+		{name: "no stage", documentID: "doc-1", wantErr: true},
+		{name: "no document", stage: types.DOCUMENT_STAGE_NEW, wantErr: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			trace := Trace{
+				NotificationID: tc.notificationID,
+				ChannelID:      tc.channelID,
+				RequestID:      tc.requestID,
+			}
+			input, err := BuildStepInput(trace, tc.documentID, tc.stage, tc.failure)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if input != tc.want {
+				t.Fatalf("unexpected input:\ngot  %s\nwant %s", input, tc.want)
+			}
+
+			if tc.wantErr {
+				return
+			}
+
+			// the stages read the input back as a step
+			var step types.DocumentStep
+			if err := json.Unmarshal([]byte(input), &step); err != nil {
+				t.Fatalf("failed to read the step: %v", err)
+			}
+
+			want := types.DocumentStep{
+				NotificationID: tc.notificationID,
+				ChannelID:      tc.channelID,
+				DocumentID:     tc.documentID,
+				Stage:          tc.stage,
+				RequestID:      tc.requestID,
+			}
+			if tc.failure != nil {
+				want.Error = tc.failure.Error
+				want.ErrorStage = tc.failure.Stage
+				want.Attempt = tc.failure.Attempt
+			}
+			if !reflect.DeepEqual(step, want) {
+				t.Fatalf("unexpected step: got %+v want %+v", step, want)
+			}
+		})
+	}
+}
+
+func TestValidateStep(t *testing.T) {
+	tests := []struct {
+		name    string
+		step    types.DocumentStep
+		wantErr bool
+	}{
+		{name: "valid", step: types.DocumentStep{DocumentID: "doc-1", Stage: types.DOCUMENT_STAGE_MATHPIX}},
+		// the stage names were changed by hand in the execution input
+		{name: "unknown stage", step: types.DocumentStep{DocumentID: "doc-1", Stage: "chatgpt"}, wantErr: true},
+		{name: "no stage", step: types.DocumentStep{DocumentID: "doc-1"}, wantErr: true},
+		{name: "no document", step: types.DocumentStep{Stage: types.DOCUMENT_STAGE_MATHPIX}, wantErr: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := ValidateStep(tc.step)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestBuildGatewayErrorResponse(t *testing.T) {
+	response, err := BuildGatewayErrorResponse(
+		"unknown-channel",
+		`channel "channel-1" is not registered`,
+		http.StatusNotFound,
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	want := `{"code":"unknown-channel","message":"channel \"channel-1\" is not registered"}`
+	if response.StatusCode != http.StatusNotFound || response.Body != want ||
+		response.Headers["Content-Type"] != "application/json" {
+		t.Fatalf("unexpected response: %+v", response)
+	}
+}
+
+func TestParseFolderLocations(t *testing.T) {
+	tests := []struct {
+		name    string
+		secret  string
+		want    []string
+		wantErr bool
+	}{
+		{
+			// the secret as it was before folders could be listed
+			name:   "single folder",
+			secret: `{"folder_id": "folder-1", "archive_folder_id": "archive-1", "destination_folder_id": "dest-1"}`,
+			want:   []string{"folder-1"},
+		},
+		{
+			name: "list of folders",
+			secret: ` [
+				{"folder_id": "folder-1", "archive_folder_id": "archive-1", "destination_folder_id": "dest-1"},
+				{"folder_id": "folder-2", "archive_folder_id": "archive-2", "destination_folder_ids": ["dest-2", "dest-3"]}
+			]`,
+			want: []string{"folder-1", "folder-2"},
+		},
+		{name: "empty list", secret: `[]`, wantErr: true},
+		{name: "folder without an ID", secret: `[{"archive_folder_id": "archive-1"}]`, wantErr: true},
+		{name: "single folder without an ID", secret: `{}`, wantErr: true},
+		{name: "folder listed twice", secret: `[{"folder_id": "folder-1"}, {"folder_id": "folder-1"}]`, wantErr: true},
+		{name: "not JSON", secret: `folder-1`, wantErr: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := ParseFolderLocations(tc.secret)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			var folders []string
+			for _, locations := range got {
+				folders = append(folders, locations.FolderID)
+			}
+			if !reflect.DeepEqual(folders, tc.want) {
+				t.Fatalf("unexpected folders: got %v want %v", folders, tc.want)
+			}
+		})
+	}
+}
+
+func TestParseFolderLocationsKeepsFolders(t *testing.T) {
+	got, err := ParseFolderLocations(`[
+		{"folder_id": "folder-1", "archive_folder_id": "archive-1", "destination_folder_id": "dest-1"},
+		{"folder_id": "folder-2", "archive_folder_id": "archive-2", "destination_folder_ids": ["dest-2", "dest-3"]}
+	]`)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	want := []*types.GoogleFolderDefaultLocations{
+		{FolderID: "folder-1", ArchiveFolderID: "archive-1", DestFolderID: "dest-1"},
+		{FolderID: "folder-2", ArchiveFolderID: "archive-2", DestFolderIDs: []string{"dest-2", "dest-3"}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("unexpected folders:\ngot  %+v\nwant %+v", got, want)
+	}
+}
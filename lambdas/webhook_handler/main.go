@@ -2,12 +2,19 @@ package main
 
 import (
 	"context"
+	"crypto/subtle"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
+	"math/rand/v2"
 	"net/http"
+	"net/url"
 	"os"
+	"slices"
+	"strconv"
 	"sync"
+	"time"
 
 	"github.com/KyleBrandon/scriptor/lambdas/util"
 	"github.com/KyleBrandon/scriptor/pkg/database"
@@ -20,15 +27,111 @@ import (
 	"github.com/google/uuid"
 )
 
+const (
+	// Captures are kept for 72 hours unless WEBHOOK_CAPTURE_TTL_HOURS is set
+	DEFAULT_CAPTURE_TTL_HOURS = 72
+
+	// Percentage of the valid requests captured unless
+	// WEBHOOK_CAPTURE_SUCCESS_PERCENT is set. Invalid requests are always
+	// captured.
+	DEFAULT_CAPTURE_SUCCESS_PERCENT = 10
+
+	// Seconds a change notification waits in the queue unless
+	// NOTIFICATION_DEBOUNCE_SECONDS is set, the requests of the channel in
+	// that time are covered by it. 0 turns the debounce off.
+	DEFAULT_DEBOUNCE_SECONDS = 10
+
+	// SQS can't delay a message longer than 15 minutes
+	MAX_DEBOUNCE_SECONDS = 900
+
+	// How long a pending notification holds back the next one after its
+	// delay, in case the SQS handler never gets to clear it
+	PENDING_NOTIFICATION_TIMEOUT = 5 * time.Minute
+
+	// Fixed width so the captures of a channel sort by time
+	CAPTURE_TIME_FORMAT = "2006-01-02T15:04:05.000000000Z"
+
+	// Channel of captures for requests without a channel ID
+	UNKNOWN_CHANNEL = "unknown"
+
+	// Resource states of the notifications that are queued. Google sends a
+	// sync when the channel is created, an add for each new file, and an
+	// update, trash or remove when a file changes or goes away.
+	RESOURCE_STATE_ADD    = "add"
+	RESOURCE_STATE_SYNC   = "sync"
+	RESOURCE_STATE_UPDATE = "update"
+	RESOURCE_STATE_TRASH  = "trash"
+	RESOURCE_STATE_REMOVE = "remove"
+
+	// Outcome of validating a request
+	OUTCOME_VALID             = "valid"
+	OUTCOME_IGNORED_STATE     = "ignored-state"
+	OUTCOME_MALFORMED         = "malformed-request"
+	OUTCOME_UNKNOWN_CHANNEL   = "unknown-channel"
+	OUTCOME_EXPIRED_CHANNEL   = "expired-channel"
+	OUTCOME_LOOKUP_FAILED     = "lookup-failed"
+	OUTCOME_RESOURCE_MISMATCH = "resource-mismatch"
+	OUTCOME_TOKEN_MISMATCH    = "token-mismatch"
+
+	// Error codes of the failures that are not an outcome of validating
+	CODE_INTERNAL_ERROR = "internal-error"
+	CODE_QUEUE_FAILED   = "queue-failed"
+
+	// What was done with the request
+	DECISION_QUEUED       = "queued"
+	DECISION_QUEUE_FAILED = "queue-failed"
+	DECISION_REJECTED     = "rejected"
+	DECISION_DEBOUNCED    = "debounced"
+	DECISION_IGNORED      = "ignored"
+	DECISION_PAUSED       = "paused"
+)
+
+// The SQS client used to queue the notifications
+type messageSender interface {
+	SendMessage(
+		ctx context.Context,
+		params *sqs.SendMessageInput,
+		optFns ...func(*sqs.Options),
+	) (*sqs.SendMessageOutput, error)
+}
+
+// Whether requests are captured, for how long and how many of the valid ones
+type captureSettings struct {
+	enabled        bool
+	ttl            time.Duration
+	successPercent int
+}
+
 type handlerConfig struct {
 	store     database.WatchChannelStore
-	sqsClient *sqs.Client
+	sqsClient messageSender
 	queueURL  string
+
+	captures database.WebhookCaptureStore
+	capture  captureSettings
+
+	history database.NotificationHistoryStore
+
+	// how long a change notification waits in the queue for the rest of
+	// its burst
+	debounce time.Duration
 }
 
 var (
 	initOnce sync.Once
 	cfg      *handlerConfig
+
+	// generates the ID that traces a notification from the request to the
+	// workflows it starts
+	newNotificationID = uuid.NewRandom
+
+	queuedResourceStates = []string{
+		RESOURCE_STATE_ADD,
+		RESOURCE_STATE_SYNC,
+		RESOURCE_STATE_UPDATE,
+		RESOURCE_STATE_TRASH,
+		RESOURCE_STATE_REMOVE,
+	}
 )
 
 // Load all the inital configuration settings for the lambda
@@ -53,6 +156,32 @@ func loadConfiguration(ctx context.Context) (*handlerConfig, error) {
 		return nil, err
 	}
 
+	cfg.capture, err = parseCaptureSettings(os.Getenv)
+	if err != nil {
+		slog.Error("Failed to configure the webhook capture", "error", err)
+		return nil, err
+	}
+
+	if cfg.capture.enabled {
+		cfg.captures, err = database.NewWebhookCaptureStore(ctx)
+		if err != nil {
+			slog.Error("Failed to configure the webhook capture store", "error", err)
+			return nil, err
+		}
+	}
+
+	cfg.debounce, err = parseDebounce(os.Getenv)
+	if err != nil {
+		slog.Error("Failed to configure the notification debounce", "error", err)
+		return nil, err
+	}
+
+	cfg.history, err = database.NewNotificationHistoryStore(ctx)
+	if err != nil {
+		slog.Error("Failed to configure the notification history store", "error", err)
+		return nil, err
+	}
+
 	// Load the default AWS config
 	awsCfg, err := config.LoadDefaultConfig(ctx)
 	if err != nil {
@@ -66,6 +195,131 @@ func loadConfiguration(ctx context.Context) (*handlerConfig, error) {
 	return cfg, nil
 }
 
+// Read whether webhook requests are captured from the environment. Capture
+// is off unless WEBHOOK_CAPTURE is set.
+func parseCaptureSettings(getenv func(string) string) (captureSettings, error) {
+	settings := captureSettings{
+		ttl:            DEFAULT_CAPTURE_TTL_HOURS * time.Hour,
+		successPercent: DEFAULT_CAPTURE_SUCCESS_PERCENT,
+	}
+
+	if setting := getenv("WEBHOOK_CAPTURE"); setting != "" {
+		enabled, err := strconv.ParseBool(setting)
+		if err != nil {
+			return settings, fmt.Errorf("invalid WEBHOOK_CAPTURE: %w", err)
+		}
+
+		settings.enabled = enabled
+	}
+
+	if setting := getenv("WEBHOOK_CAPTURE_TTL_HOURS"); setting != "" {
+		hours, err := strconv.Atoi(setting)
+		if err != nil || hours <= 0 {
+			return settings, fmt.Errorf("invalid WEBHOOK_CAPTURE_TTL_HOURS: %s", setting)
+		}
+
+		settings.ttl = time.Duration(hours) * time.Hour
+	}
+
+	if setting := getenv("WEBHOOK_CAPTURE_SUCCESS_PERCENT"); setting != "" {
+		percent, err := strconv.Atoi(setting)
+		if err != nil || percent < 0 || percent > 100 {
+			return settings, fmt.Errorf(
+				"invalid WEBHOOK_CAPTURE_SUCCESS_PERCENT: %s",
+				setting,
+			)
+		}
+
+		settings.successPercent = percent
+	}
+
+	return settings, nil
+}
+
+// Read how long change notifications are debounced from the environment
+func parseDebounce(getenv func(string) string) (time.Duration, error) {
+	setting := getenv("NOTIFICATION_DEBOUNCE_SECONDS")
+	if setting == "" {
+		return DEFAULT_DEBOUNCE_SECONDS * time.Second, nil
+	}
+
+	seconds, err := strconv.Atoi(setting)
+	if err != nil || seconds < 0 || seconds > MAX_DEBOUNCE_SECONDS {
+		return 0, fmt.Errorf("invalid NOTIFICATION_DEBOUNCE_SECONDS: %s", setting)
+	}
+
+	return time.Duration(seconds) * time.Second, nil
+}
+
+// The time until which the notification queued now holds back the next
+// ones of its channel. The SQS handler clears it once it takes the changes
+// lock, so the timeout only matters when it never does.
+func pendingUntil(now time.Time, debounce time.Duration) time.Time {
+	return now.Add(debounce + PENDING_NOTIFICATION_TIMEOUT)
+}
+
+// Whether a change notification for the channel is already queued. Drive
+// sends a request for nearly every change, and the queued notification
+// queries all of them. A failure to check only queues the notification.
+func (cfg *handlerConfig) notificationPending(ctx context.Context, channelID string) bool {
+	if cfg.debounce == 0 {
+		return false
+	}
+
+	err := cfg.store.MarkNotificationPending(
+		ctx,
+		channelID,
+		pendingUntil(time.Now(), cfg.debounce),
+	)
+	if errors.Is(err, database.ErrNotificationPending) {
+		slog.Info(
+			"A notification for the channel is already pending",
+			"channelID",
+			channelID,
+		)
+		return true
+	}
+	if err != nil {
+		slog.Warn(
+			"Failed to check for a pending notification of the channel",
+			"channelID",
+			channelID,
+			"error",
+			err,
+		)
+	}
+
+	return false
+}
+
+// Let the next request of the channel be queued when this one wasn't
+func (cfg *handlerConfig) clearPending(ctx context.Context, channelID string) {
+	err := cfg.store.ClearNotificationPending(ctx, channelID)
+	if err != nil {
+		slog.Warn(
+			"Failed to clear the pending notification of the channel",
+			"channelID",
+			channelID,
+			"error",
+			err,
+		)
+	}
+}
+
+// Every invalid request is captured and a sample of the valid ones. The roll
+// is a number from 0 to 99.
+func (s captureSettings) sample(outcome string, roll int) bool {
+	if !s.enabled {
+		return false
+	}
+
+	if outcome != OUTCOME_VALID {
+		return true
+	}
+
+	return roll < s.successPercent
+}
+
 // Ensure that the configuration settings are only loaded once
 func initLambda(ctx context.Context) error {
 	var err error
@@ -79,17 +333,30 @@ func initLambda(ctx context.Context) error {
 	return err
 }
 
+// Find the watch channel of the request along with the outcome of validating
+// it. The channel is nil unless the request is valid.
 func queryWatchChannelForRequest(
 	ctx context.Context,
 	request events.APIGatewayProxyRequest,
-) (*types.WatchChannel, error) {
+) (*types.WatchChannel, string, error) {
 	resourceState := request.Headers["X-Goog-Resource-State"]
 	channelID := request.Headers["X-Goog-Channel-ID"]
 	resourceID := request.Headers["X-Goog-Resource-ID"]
 
-	// If we receive a 'sync' notification, ignore it for now.
-	// We could use this for initialzing the state of the vault?
-	if resourceState != "add" {
+	// Google always sends the channel and the state of the resource
+	if channelID == "" || resourceState == "" {
+		slog.Error(
+			"Webhook request is missing the channel headers",
+			"channelID",
+			channelID,
+			"resourceState",
+			resourceState,
+		)
+		return nil, OUTCOME_MALFORMED, fmt.Errorf("missing channel headers")
+	}
+
+	// the other states are for changes we don't process
+	if !slices.Contains(queuedResourceStates, resourceState) {
 		slog.Debug(
 			"Webhook received non-add resource state",
 			"channelID",
@@ -97,38 +364,195 @@ func queryWatchChannelForRequest(
 			"resourceState",
 			resourceState,
 		)
-		return nil, fmt.Errorf("invalid file notification")
+		return nil, OUTCOME_IGNORED_STATE, fmt.Errorf("resource state not processed")
 	}
 
 	// query the watch channel based on the channelID
 	wc, err := cfg.store.GetWatchChannelByID(ctx, channelID)
-	if err != nil {
+	if errors.Is(err, database.ErrWatchChannelNotFound) {
 		slog.Error(
 			"Failed to find a registration for the channel",
 			"channelID",
 			channelID,
+		)
+		return nil, OUTCOME_UNKNOWN_CHANNEL, fmt.Errorf("unknown channel")
+	} else if err != nil {
+		slog.Error(
+			"Failed to query the registration for the channel",
+			"channelID",
+			channelID,
 			"error",
 			err,
 		)
-		return nil, fmt.Errorf("invalid file notification")
+		return nil, OUTCOME_LOOKUP_FAILED, fmt.Errorf("failed to query the channel")
+	}
 
+	// a channel that expired without being renewed no longer exists in Drive
+	if wc.ExpiresAt > 0 && wc.ExpiresAt < time.Now().UTC().UnixMilli() {
+		slog.Error(
+			"Channel for the request has expired",
+			"channelID",
+			channelID,
+			"expiresAt",
+			wc.ExpiresAt,
+		)
+		return nil, OUTCOME_EXPIRED_CHANNEL, fmt.Errorf("expired channel")
 	}
 
-	// verify the resourceID
-	if resourceID != wc.ResourceID {
+	// verify the resourceID. The sync can arrive while the channel is being
+	// registered, before its resource ID is saved.
+	registering := resourceState == RESOURCE_STATE_SYNC && wc.ResourceID == ""
+	if resourceID != wc.ResourceID && !registering {
 		slog.Error(
 			"ResourceID for the channel is not valid",
 			"channelID",
 			channelID,
 			"resourceID",
 			resourceID,
+		)
+		return nil, OUTCOME_RESOURCE_MISMATCH, fmt.Errorf("unknown resource")
+	}
+
+	// verify the token the channel was registered with, channels registered
+	// before they had a token match an empty one until they are registered
+	// again
+	token := request.Headers["X-Goog-Channel-Token"]
+	if subtle.ConstantTimeCompare([]byte(token), []byte(wc.Token)) != 1 {
+		slog.Error(
+			"Token for the channel is not valid",
+			"channelID",
+			channelID,
+		)
+		return nil, OUTCOME_TOKEN_MISMATCH, fmt.Errorf("invalid channel token")
+	}
+
+	return wc, OUTCOME_VALID, nil
+}
+
+// The sync sent when a channel is created asks for the files already in the
+// folder, every other notification for the changes since the last one
+func notificationKind(resourceState string) string {
+	if resourceState == RESOURCE_STATE_SYNC {
+		return types.NOTIFICATION_KIND_BASELINE
+	}
+
+	return types.NOTIFICATION_KIND_CHANGES
+}
+
+// The status of the response to a request that wasn't queued. Requests that
+// don't belong to a registered channel are forbidden.
+func outcomeStatus(outcome string) int {
+	switch outcome {
+	case OUTCOME_IGNORED_STATE:
+		return http.StatusOK
+	case OUTCOME_MALFORMED:
+		return http.StatusBadRequest
+	case OUTCOME_TOKEN_MISMATCH:
+		return http.StatusForbidden
+	case OUTCOME_UNKNOWN_CHANNEL, OUTCOME_RESOURCE_MISMATCH:
+		return http.StatusNotFound
+	case OUTCOME_EXPIRED_CHANNEL:
+		return http.StatusGone
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// Build the capture of a request. Only the X-Goog-* headers that identify the
+// notification are copied, the body and the channel token never are. The
+// query of the resource URI is dropped as it can carry a page token.
+func newWebhookCapture(
+	request events.APIGatewayProxyRequest,
+	wc *types.WatchChannel,
+	outcome, decision string,
+	now time.Time,
+	ttl time.Duration,
+) *types.WebhookCapture {
+	capture := &types.WebhookCapture{
+		ChannelID:         request.Headers["X-Goog-Channel-ID"],
+		CapturedAt:        now.UTC().Format(CAPTURE_TIME_FORMAT),
+		ExpiresAt:         now.Add(ttl).Unix(),
+		ResourceState:     request.Headers["X-Goog-Resource-State"],
+		ResourceID:        request.Headers["X-Goog-Resource-ID"],
+		MessageNumber:     request.Headers["X-Goog-Message-Number"],
+		ChannelExpiration: request.Headers["X-Goog-Channel-Expiration"],
+		Changed:           request.Headers["X-Goog-Changed"],
+		Outcome:           outcome,
+		Decision:          decision,
+	}
+
+	if capture.ChannelID == "" {
+		capture.ChannelID = UNKNOWN_CHANNEL
+	}
+
+	if uri, err := url.Parse(request.Headers["X-Goog-Resource-URI"]); err == nil {
+		uri.RawQuery = ""
+		uri.User = nil
+		capture.ResourceURI = uri.String()
+	}
+
+	if wc != nil {
+		capture.FolderID = wc.FolderID
+	}
+
+	return capture
+}
+
+// Capture a sample of the requests. Failing to capture a request is only
+// logged, it never changes the response to Google.
+func (cfg *handlerConfig) captureRequest(
+	ctx context.Context,
+	request events.APIGatewayProxyRequest,
+	wc *types.WatchChannel,
+	outcome, decision string,
+) {
+	if cfg.captures == nil || !cfg.capture.sample(outcome, rand.IntN(100)) {
+		return
+	}
+
+	capture := newWebhookCapture(
+		request,
+		wc,
+		outcome,
+		decision,
+		time.Now(),
+		cfg.capture.ttl,
+	)
+
+	err := cfg.captures.InsertWebhookCapture(ctx, capture)
+	if err != nil {
+		slog.Warn(
+			"Failed to capture the webhook request",
+			"channelID",
+			capture.ChannelID,
 			"error",
 			err,
 		)
-		return nil, fmt.Errorf("invalid file notification")
 	}
+}
 
-	return wc, nil
+// Start the history of the notification before it is queued, so the SQS
+// handler always adds to it. Failing to record it is only logged, it never
+// changes the response to Google.
+func (cfg *handlerConfig) recordReceived(
+	ctx context.Context,
+	message types.ChannelNotification,
+) {
+	err := cfg.history.InsertNotificationHistory(ctx, &types.NotificationHistory{
+		NotificationID: message.NotificationID,
+		ChannelID:      message.ChannelID,
+		FolderID:       message.FolderID,
+		ReceivedAt:     time.Now().UTC(),
+	})
+	if err != nil {
+		slog.Warn(
+			"Failed to record the notification history",
+			"notificationID",
+			message.NotificationID,
+			"error",
+			err,
+		)
+	}
 }
 
 func process(
@@ -140,54 +564,146 @@ func process(
 
 	if err := initLambda(ctx); err != nil {
 		slog.Error("Failed to initialize the lambda", "error", err)
-		return util.BuildGatewayResponse(
+		return util.BuildGatewayErrorResponse(
+			CODE_INTERNAL_ERROR,
 			err.Error(),
 			http.StatusInternalServerError,
 		)
 	}
 
 	// Parse the folderID from the gateway request
-	wc, err := queryWatchChannelForRequest(ctx, request)
+	wc, outcome, err := queryWatchChannelForRequest(ctx, request)
+
+	decision := DECISION_REJECTED
+	switch {
+	case err == nil:
+		decision = DECISION_QUEUE_FAILED
+	case outcome == OUTCOME_IGNORED_STATE:
+		decision = DECISION_IGNORED
+	}
+
+	defer func() {
+		cfg.captureRequest(ctx, request, wc, outcome, decision)
+	}()
+
+	// only an internal failure is answered with a 5xx, Google retries those
+	// and stops sending for a channel it gets a 404 or 410 for
+	if outcome == OUTCOME_IGNORED_STATE {
+		return util.BuildGatewayResponse("Resource state not processed", http.StatusOK)
+	} else if err != nil {
+		return util.BuildGatewayErrorResponse(outcome, err.Error(), outcomeStatus(outcome))
+	}
+
+	// the notifications of a paused channel are dropped before anything
+	// is queued, so the changes lock isn't taken and its token doesn't
+	// move on until it is resumed
+	if wc.Paused {
+		slog.Info(
+			"Dropping the notification of a paused channel",
+			"channelID",
+			wc.ChannelID,
+			"folderID",
+			wc.FolderID,
+			"resourceState",
+			request.Headers["X-Goog-Resource-State"],
+		)
+		decision = DECISION_PAUSED
+		return util.BuildGatewayResponse("Channel paused", http.StatusOK)
+	}
+
+	// a notification that can't be traced isn't queued, Google retries
+	// the request
+	notificationID, err := newNotificationID()
 	if err != nil {
-		return util.BuildGatewayResponse(
-			err.Error(),
+		slog.Error(
+			"Failed to generate the notification ID",
+			"channelID",
+			wc.ChannelID,
+			"error",
+			err,
+		)
+		return util.BuildGatewayErrorResponse(
+			CODE_INTERNAL_ERROR,
+			"failed to generate the notification ID",
 			http.StatusInternalServerError,
 		)
 	}
 
 	message := types.ChannelNotification{
-		NotificationID: uuid.New().String(),
+		NotificationID: notificationID.String(),
 		ChannelID:      wc.ChannelID,
 		FolderID:       wc.FolderID,
+		DriveID:        wc.DriveID,
+		Recursive:      wc.Recursive,
+		Kind:           notificationKind(request.Headers["X-Goog-Resource-State"]),
+		ResourceState:  request.Headers["X-Goog-Resource-State"],
+	}
+
+	// a baseline scan lists the whole folder and is never held back
+	var delaySeconds int32
+	if message.Kind == types.NOTIFICATION_KIND_CHANGES {
+		if cfg.notificationPending(ctx, wc.ChannelID) {
+			decision = DECISION_DEBOUNCED
+			return util.BuildGatewayResponse("Notification already pending", http.StatusOK)
+		}
+
+		delaySeconds = int32(cfg.debounce.Seconds())
 	}
 
 	messageBody, err := json.Marshal(&message)
 	if err != nil {
-		return util.BuildGatewayResponse(
+		return util.BuildGatewayErrorResponse(
+			CODE_INTERNAL_ERROR,
 			err.Error(),
 			http.StatusInternalServerError,
 		)
 	}
 
+	cfg.recordReceived(ctx, message)
+
 	slog.Info(
 		"Sending SQS message",
 		"channeID",
 		wc.ChannelID,
 		"folderID",
 		wc.FolderID,
+		"notificationID",
+		message.NotificationID,
+		"requestID",
+		request.RequestContext.RequestID,
+		"kind",
+		message.Kind,
 	)
 
+	// the attributes trace the notification to this request without
+	// parsing the body
+	trace := util.Trace{
+		NotificationID: message.NotificationID,
+		ChannelID:      message.ChannelID,
+		RequestID:      request.RequestContext.RequestID,
+	}
+
 	_, err = cfg.sqsClient.SendMessage(ctx, &sqs.SendMessageInput{
-		QueueUrl:    &cfg.queueURL,
-		MessageBody: aws.String(string(messageBody)),
+		QueueUrl:          &cfg.queueURL,
+		MessageBody:       aws.String(string(messageBody)),
+		DelaySeconds:      delaySeconds,
+		MessageAttributes: trace.MessageAttributes(),
 	})
 	if err != nil {
-		return util.BuildGatewayResponse(
+		// nothing is pending, so the next request of the channel is queued
+		if delaySeconds > 0 {
+			cfg.clearPending(ctx, wc.ChannelID)
+		}
+
+		return util.BuildGatewayErrorResponse(
+			CODE_QUEUE_FAILED,
 			err.Error(),
 			http.StatusInternalServerError,
 		)
 	}
 
+	decision = DECISION_QUEUED
+
 	return util.BuildGatewayResponse("Processing new file", http.StatusOK)
 }
 
@@ -0,0 +1,904 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/KyleBrandon/scriptor/lambdas/util"
+	"github.com/KyleBrandon/scriptor/pkg/database"
+	"github.com/KyleBrandon/scriptor/pkg/types"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	sqstypes "github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/google/uuid"
+)
+
+// A notification for a file added to a watched folder, with the headers
+// Google sends that must not be captured
+var addRequest = events.APIGatewayProxyRequest{
+	Headers: map[string]string{
+		"X-Goog-Channel-ID":         "channel-1",
+		"X-Goog-Channel-Token":      "secret-token",
+		"X-Goog-Channel-Expiration": "Tue, 20 Oct 2026 10:00:00 GMT",
+		"X-Goog-Resource-State":     "add",
+		"X-Goog-Resource-ID":        "resource-1",
+		"X-Goog-Resource-URI":       "https://www.googleapis.com/drive/v3/changes?pageToken=42&key=abc",
+		"X-Goog-Message-Number":     "7",
+		"Authorization":             "Bearer secret-bearer",
+	},
+	Body: `{"secret":"body"}`,
+}
+
+func TestParseCaptureSettings(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		want    captureSettings
+		wantErr bool
+	}{
+		{
+			name: "defaults",
+			want: captureSettings{ttl: 72 * time.Hour, successPercent: 10},
+		},
+		{
+			name: "configured",
+			env: map[string]string{
+				"WEBHOOK_CAPTURE":                 "true",
+				"WEBHOOK_CAPTURE_TTL_HOURS":       "6",
+				"WEBHOOK_CAPTURE_SUCCESS_PERCENT": "100",
+			},
+			want: captureSettings{enabled: true, ttl: 6 * time.Hour, successPercent: 100},
+		},
+		{
+			name:    "invalid toggle",
+			env:     map[string]string{"WEBHOOK_CAPTURE": "sometimes"},
+			wantErr: true,
+		},
+		{
+			name:    "zero ttl",
+			env:     map[string]string{"WEBHOOK_CAPTURE_TTL_HOURS": "0"},
+			wantErr: true,
+		},
+		{
+			name:    "percent out of range",
+			env:     map[string]string{"WEBHOOK_CAPTURE_SUCCESS_PERCENT": "101"},
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := parseCaptureSettings(func(name string) string { return tc.env[name] })
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if got != tc.want {
+				t.Fatalf("unexpected settings: got %+v want %+v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestCaptureSample(t *testing.T) {
+	settings := captureSettings{enabled: true, successPercent: 25}
+
+	tests := []struct {
+		name     string
+		settings captureSettings
+		outcome  string
+		roll     int
+		want     bool
+	}{
+		{name: "failure always captured", settings: settings, outcome: OUTCOME_UNKNOWN_CHANNEL, roll: 99, want: true},
+		{name: "success in sample", settings: settings, outcome: OUTCOME_VALID, roll: 24, want: true},
+		{name: "success out of sample", settings: settings, outcome: OUTCOME_VALID, roll: 25},
+		{name: "no successes", settings: captureSettings{enabled: true}, outcome: OUTCOME_VALID},
+		{name: "disabled", settings: captureSettings{successPercent: 100}, outcome: OUTCOME_IGNORED_STATE},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tc.settings.sample(tc.outcome, tc.roll); got != tc.want {
+				t.Fatalf("unexpected sample: got %v want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestNewWebhookCapture(t *testing.T) {
+	now := time.Date(2026, 10, 17, 9, 30, 0, 5, time.UTC)
+	wc := &types.WatchChannel{FolderID: "folder-1"}
+
+	capture := newWebhookCapture(
+		addRequest,
+		wc,
+		OUTCOME_VALID,
+		DECISION_QUEUED,
+		now,
+		72*time.Hour,
+	)
+
+	want := types.WebhookCapture{
+		ChannelID:         "channel-1",
+		CapturedAt:        "2026-10-17T09:30:00.000000005Z",
+		ExpiresAt:         now.Add(72 * time.Hour).Unix(),
+		ResourceState:     "add",
+		ResourceID:        "resource-1",
+		ResourceURI:       "https://www.googleapis.com/drive/v3/changes",
+		MessageNumber:     "7",
+		ChannelExpiration: "Tue, 20 Oct 2026 10:00:00 GMT",
+		FolderID:          "folder-1",
+		Outcome:           OUTCOME_VALID,
+		Decision:          DECISION_QUEUED,
+	}
+	if *capture != want {
+		t.Fatalf("unexpected capture:\ngot  %+v\nwant %+v", *capture, want)
+	}
+
+	// nothing secret makes it into the record
+	encoded, _ := json.Marshal(capture)
+	for _, secret := range []string{"secret", "pageToken", "key=abc"} {
+		if strings.Contains(string(encoded), secret) {
+			t.Fatalf("capture contains %q: %s", secret, encoded)
+		}
+	}
+
+	// requests without a channel are captured under the unknown channel
+	unknown := newWebhookCapture(
+		events.APIGatewayProxyRequest{},
+		nil,
+		OUTCOME_IGNORED_STATE,
+		DECISION_REJECTED,
+		now,
+		time.Hour,
+	)
+	if unknown.ChannelID != UNKNOWN_CHANNEL || unknown.FolderID != "" {
+		t.Fatalf("unexpected capture of an empty request: %+v", unknown)
+	}
+}
+
+// Returns the watch channel that was registered for channel-1, without its
+// resource ID while it is registering
+type fakeWatchChannelStore struct {
+	database.WatchChannelStore
+	registering bool
+	paused      bool
+
+	// the channel expired, or querying it fails
+	expired   bool
+	lookupErr error
+
+	// a notification of the channel is already pending, or checking for
+	// one fails
+	pending    bool
+	pendingErr error
+	marked     []time.Time
+	cleared    int
+}
+
+func (s *fakeWatchChannelStore) MarkNotificationPending(
+	ctx context.Context,
+	channelID string,
+	until time.Time,
+) error {
+	if s.pendingErr != nil {
+		return s.pendingErr
+	}
+	if s.pending {
+		return database.ErrNotificationPending
+	}
+
+	s.marked = append(s.marked, until)
+	s.pending = true
+	return nil
+}
+
+func (s *fakeWatchChannelStore) ClearNotificationPending(ctx context.Context, channelID string) error {
+	s.cleared++
+	s.pending = false
+	return nil
+}
+
+func (s *fakeWatchChannelStore) GetWatchChannelByID(
+	ctx context.Context,
+	channelID string,
+) (*types.WatchChannel, error) {
+	if s.lookupErr != nil {
+		return nil, s.lookupErr
+	}
+	if channelID != "channel-1" {
+		return nil, database.ErrWatchChannelNotFound
+	}
+
+	wc := &types.WatchChannel{
+		ChannelID:  "channel-1",
+		ResourceID: "resource-1",
+		FolderID:   "folder-1",
+		Token:      "secret-token",
+	}
+	if s.registering {
+		wc.ResourceID = ""
+	}
+	if s.expired {
+		wc.ExpiresAt = time.Now().UTC().Add(-time.Hour).UnixMilli()
+	}
+	wc.Paused = s.paused
+
+	return wc, nil
+}
+
+type fakeCaptureStore struct {
+	database.WebhookCaptureStore
+	captures []*types.WebhookCapture
+	err      error
+}
+
+func (s *fakeCaptureStore) InsertWebhookCapture(
+	ctx context.Context,
+	capture *types.WebhookCapture,
+) error {
+	if s.err != nil {
+		return s.err
+	}
+
+	s.captures = append(s.captures, capture)
+	return nil
+}
+
+type fakeHistoryStore struct {
+	database.NotificationHistoryStore
+	inserted []*types.NotificationHistory
+}
+
+func (s *fakeHistoryStore) InsertNotificationHistory(
+	ctx context.Context,
+	history *types.NotificationHistory,
+) error {
+	s.inserted = append(s.inserted, history)
+	return nil
+}
+
+type fakeSender struct {
+	sent       int
+	messages   []types.ChannelNotification
+	delays     []int32
+	attributes []map[string]sqstypes.MessageAttributeValue
+	err        error
+}
+
+func (s *fakeSender) SendMessage(
+	ctx context.Context,
+	params *sqs.SendMessageInput,
+	optFns ...func(*sqs.Options),
+) (*sqs.SendMessageOutput, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+
+	s.sent++
+	s.delays = append(s.delays, params.DelaySeconds)
+	s.attributes = append(s.attributes, params.MessageAttributes)
+
+	var message types.ChannelNotification
+	if err := json.Unmarshal([]byte(*params.MessageBody), &message); err == nil {
+		s.messages = append(s.messages, message)
+	}
+
+	return &sqs.SendMessageOutput{}, nil
+}
+
+func TestProcessCapture(t *testing.T) {
+	// skip loading the AWS configuration
+	initOnce.Do(func() {})
+
+	unknown := events.APIGatewayProxyRequest{Headers: map[string]string{
+		"X-Goog-Channel-ID":     "channel-2",
+		"X-Goog-Resource-State": "add",
+	}}
+
+	// a request for a registered channel from someone who doesn't have its
+	// token
+	forged := func(token string) events.APIGatewayProxyRequest {
+		headers := map[string]string{}
+		for name, value := range addRequest.Headers {
+			headers[name] = value
+		}
+
+		headers["X-Goog-Channel-Token"] = token
+		return events.APIGatewayProxyRequest{Headers: headers}
+	}
+
+	tests := []struct {
+		name         string
+		request      events.APIGatewayProxyRequest
+		captureErr   error
+		wantStatus   int
+		wantDecision string
+	}{
+		{
+			name:         "queued",
+			request:      addRequest,
+			wantStatus:   http.StatusOK,
+			wantDecision: DECISION_QUEUED,
+		},
+		{
+			name:         "unknown channel",
+			request:      unknown,
+			wantStatus:   http.StatusNotFound,
+			wantDecision: DECISION_REJECTED,
+		},
+		{
+			name:         "wrong token",
+			request:      forged("guessed-token"),
+			wantStatus:   http.StatusForbidden,
+			wantDecision: DECISION_REJECTED,
+		},
+		{
+			name:         "missing token",
+			request:      forged(""),
+			wantStatus:   http.StatusForbidden,
+			wantDecision: DECISION_REJECTED,
+		},
+		{
+			name:       "capture fails",
+			request:    addRequest,
+			captureErr: errors.New("throttled"),
+			wantStatus: http.StatusOK,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			captures := &fakeCaptureStore{err: tc.captureErr}
+			sender := &fakeSender{}
+			history := &fakeHistoryStore{}
+
+			cfg = &handlerConfig{
+				store:     &fakeWatchChannelStore{},
+				sqsClient: sender,
+				captures:  captures,
+				history:   history,
+				capture: captureSettings{
+					enabled:        true,
+					ttl:            time.Hour,
+					successPercent: 100,
+				},
+			}
+
+			response, err := process(context.Background(), tc.request)
+			if err != nil || response.StatusCode != tc.wantStatus {
+				t.Fatalf("unexpected response: %d %v", response.StatusCode, err)
+			}
+
+			// only the notifications that were queued have a history
+			if len(history.inserted) != sender.sent {
+				t.Fatalf("unexpected history: %d inserted %d sent", len(history.inserted), sender.sent)
+			}
+
+			if tc.wantDecision == "" {
+				if len(captures.captures) != 0 || sender.sent != 1 {
+					t.Fatalf("unexpected result: captures %d sent %d", len(captures.captures), sender.sent)
+				}
+				return
+			}
+
+			if len(captures.captures) != 1 || captures.captures[0].Decision != tc.wantDecision {
+				t.Fatalf("unexpected captures: %+v", captures.captures)
+			}
+
+			// rejected requests never queue anything
+			if tc.wantDecision == DECISION_REJECTED && sender.sent != 0 {
+				t.Fatalf("rejected request was queued %d times", sender.sent)
+			}
+		})
+	}
+}
+
+func TestProcessQueuesNotifications(t *testing.T) {
+	// skip loading the AWS configuration
+	initOnce.Do(func() {})
+
+	// the notification of the add request with another resource state
+	withState := func(state string) events.APIGatewayProxyRequest {
+		headers := map[string]string{}
+		for name, value := range addRequest.Headers {
+			headers[name] = value
+		}
+
+		headers["X-Goog-Resource-State"] = state
+		return events.APIGatewayProxyRequest{Headers: headers}
+	}
+
+	tests := []struct {
+		name        string
+		request     events.APIGatewayProxyRequest
+		registering bool
+
+		wantStatus int
+		wantKind   string
+	}{
+		{
+			name:       "new file",
+			request:    addRequest,
+			wantStatus: http.StatusOK,
+			wantKind:   types.NOTIFICATION_KIND_CHANGES,
+		},
+		{
+			name:       "channel created",
+			request:    withState(RESOURCE_STATE_SYNC),
+			wantStatus: http.StatusOK,
+			wantKind:   types.NOTIFICATION_KIND_BASELINE,
+		},
+		{
+			name:        "channel created before its resource was saved",
+			request:     withState(RESOURCE_STATE_SYNC),
+			registering: true,
+			wantStatus:  http.StatusOK,
+			wantKind:    types.NOTIFICATION_KIND_BASELINE,
+		},
+		{
+			name:        "new file before the resource was saved",
+			request:     addRequest,
+			registering: true,
+			wantStatus:  http.StatusNotFound,
+		},
+		{
+			name:       "file changed",
+			request:    withState(RESOURCE_STATE_UPDATE),
+			wantStatus: http.StatusOK,
+			wantKind:   types.NOTIFICATION_KIND_CHANGES,
+		},
+		{
+			name:       "file trashed",
+			request:    withState(RESOURCE_STATE_TRASH),
+			wantStatus: http.StatusOK,
+			wantKind:   types.NOTIFICATION_KIND_CHANGES,
+		},
+		{
+			name:       "file removed",
+			request:    withState(RESOURCE_STATE_REMOVE),
+			wantStatus: http.StatusOK,
+			wantKind:   types.NOTIFICATION_KIND_CHANGES,
+		},
+		{
+			name:       "file restored",
+			request:    withState("untrash"),
+			wantStatus: http.StatusOK,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			sender := &fakeSender{}
+			cfg = &handlerConfig{
+				store:     &fakeWatchChannelStore{registering: tc.registering},
+				sqsClient: sender,
+				history:   &fakeHistoryStore{},
+			}
+
+			response, err := process(context.Background(), tc.request)
+			if err != nil || response.StatusCode != tc.wantStatus {
+				t.Fatalf("unexpected response: %d %v", response.StatusCode, err)
+			}
+
+			if tc.wantKind == "" {
+				if sender.sent != 0 {
+					t.Fatalf("unexpected messages: %+v", sender.messages)
+				}
+				return
+			}
+
+			// the state is carried along for the SQS handler to log
+			state := tc.request.Headers["X-Goog-Resource-State"]
+			if len(sender.messages) != 1 || sender.messages[0].Kind != tc.wantKind ||
+				sender.messages[0].ResourceState != state ||
+				sender.messages[0].FolderID != "folder-1" {
+				t.Fatalf("unexpected messages: %+v", sender.messages)
+			}
+		})
+	}
+}
+
+func TestProcessResponseClasses(t *testing.T) {
+	// skip loading the AWS configuration
+	initOnce.Do(func() {})
+
+	// the add request with its headers changed, an empty value removes one
+	withHeaders := func(changes map[string]string) events.APIGatewayProxyRequest {
+		headers := map[string]string{}
+		for name, value := range addRequest.Headers {
+			headers[name] = value
+		}
+
+		for name, value := range changes {
+			if value == "" {
+				delete(headers, name)
+				continue
+			}
+			headers[name] = value
+		}
+		return events.APIGatewayProxyRequest{Headers: headers}
+	}
+
+	tests := []struct {
+		name      string
+		request   events.APIGatewayProxyRequest
+		expired   bool
+		lookupErr error
+		sendErr   error
+
+		wantStatus int
+		wantCode   string
+	}{
+		{
+			name:       "queued",
+			request:    addRequest,
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "ignored state",
+			request:    withHeaders(map[string]string{"X-Goog-Resource-State": "untrash"}),
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "missing channel",
+			request:    withHeaders(map[string]string{"X-Goog-Channel-ID": ""}),
+			wantStatus: http.StatusBadRequest,
+			wantCode:   OUTCOME_MALFORMED,
+		},
+		{
+			name:       "missing resource state",
+			request:    withHeaders(map[string]string{"X-Goog-Resource-State": ""}),
+			wantStatus: http.StatusBadRequest,
+			wantCode:   OUTCOME_MALFORMED,
+		},
+		{
+			name:       "unknown channel",
+			request:    withHeaders(map[string]string{"X-Goog-Channel-ID": "channel-2"}),
+			wantStatus: http.StatusNotFound,
+			wantCode:   OUTCOME_UNKNOWN_CHANNEL,
+		},
+		{
+			name:       "mismatched resource",
+			request:    withHeaders(map[string]string{"X-Goog-Resource-ID": "resource-2"}),
+			wantStatus: http.StatusNotFound,
+			wantCode:   OUTCOME_RESOURCE_MISMATCH,
+		},
+		{
+			name:       "expired channel",
+			request:    addRequest,
+			expired:    true,
+			wantStatus: http.StatusGone,
+			wantCode:   OUTCOME_EXPIRED_CHANNEL,
+		},
+		{
+			name:       "wrong token",
+			request:    withHeaders(map[string]string{"X-Goog-Channel-Token": "guessed-token"}),
+			wantStatus: http.StatusForbidden,
+			wantCode:   OUTCOME_TOKEN_MISMATCH,
+		},
+		{
+			name:       "lookup fails",
+			request:    addRequest,
+			lookupErr:  errors.New("throttled"),
+			wantStatus: http.StatusInternalServerError,
+			wantCode:   OUTCOME_LOOKUP_FAILED,
+		},
+		{
+			name:       "queue fails",
+			request:    addRequest,
+			sendErr:    errors.New("throttled"),
+			wantStatus: http.StatusInternalServerError,
+			wantCode:   CODE_QUEUE_FAILED,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg = &handlerConfig{
+				store: &fakeWatchChannelStore{
+					expired:   tc.expired,
+					lookupErr: tc.lookupErr,
+				},
+				sqsClient: &fakeSender{err: tc.sendErr},
+				history:   &fakeHistoryStore{},
+			}
+
+			response, err := process(context.Background(), tc.request)
+			if err != nil || response.StatusCode != tc.wantStatus {
+				t.Fatalf("unexpected response: %d %v", response.StatusCode, err)
+			}
+
+			if tc.wantCode == "" {
+				return
+			}
+
+			// the errors are answered with a code the caller can act on
+			var body struct {
+				Code    string `json:"code"`
+				Message string `json:"message"`
+			}
+			if err := json.Unmarshal([]byte(response.Body), &body); err != nil {
+				t.Fatalf("unexpected body %q: %v", response.Body, err)
+			}
+			if body.Code != tc.wantCode || body.Message == "" {
+				t.Fatalf("unexpected error body: %+v", body)
+			}
+		})
+	}
+}
+
+func TestProcessTracesNotification(t *testing.T) {
+	// skip loading the AWS configuration
+	initOnce.Do(func() {})
+
+	sender := &fakeSender{}
+	cfg = &handlerConfig{
+		store:     &fakeWatchChannelStore{},
+		sqsClient: sender,
+		history:   &fakeHistoryStore{},
+	}
+
+	request := addRequest
+	request.RequestContext.RequestID = "request-1"
+
+	response, err := process(context.Background(), request)
+	if err != nil || response.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected response: %d %v", response.StatusCode, err)
+	}
+
+	if sender.sent != 1 {
+		t.Fatalf("unexpected messages: %+v", sender.messages)
+	}
+
+	attribute := func(name string) string {
+		value, ok := sender.attributes[0][name]
+		if !ok || value.StringValue == nil || *value.DataType != "String" {
+			t.Fatalf("missing attribute %s: %+v", name, sender.attributes[0])
+		}
+		return *value.StringValue
+	}
+
+	message := sender.messages[0]
+	if attribute(util.ATTRIBUTE_NOTIFICATION_ID) != message.NotificationID ||
+		attribute(util.ATTRIBUTE_CHANNEL_ID) != "channel-1" ||
+		attribute(util.ATTRIBUTE_REQUEST_ID) != "request-1" {
+		t.Fatalf("unexpected attributes: %+v", sender.attributes[0])
+	}
+}
+
+func TestProcessFailsWithoutNotificationID(t *testing.T) {
+	// skip loading the AWS configuration
+	initOnce.Do(func() {})
+
+	defer func(generate func() (uuid.UUID, error)) {
+		newNotificationID = generate
+	}(newNotificationID)
+	newNotificationID = func() (uuid.UUID, error) {
+		return uuid.Nil, errors.New("entropy unavailable")
+	}
+
+	sender := &fakeSender{}
+	history := &fakeHistoryStore{}
+	store := &fakeWatchChannelStore{}
+	cfg = &handlerConfig{store: store, sqsClient: sender, history: history}
+
+	response, err := process(context.Background(), addRequest)
+	if err != nil || response.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("unexpected response: %d %v", response.StatusCode, err)
+	}
+
+	if !strings.Contains(response.Body, CODE_INTERNAL_ERROR) {
+		t.Fatalf("unexpected body: %s", response.Body)
+	}
+
+	// nothing is queued or recorded, and nothing is left pending
+	if sender.sent != 0 || len(history.inserted) != 0 || len(store.marked) != 0 {
+		t.Fatalf("unexpected notification: %d sent %d recorded %d marked",
+			sender.sent, len(history.inserted), len(store.marked))
+	}
+}
+
+func TestParseDebounce(t *testing.T) {
+	tests := []struct {
+		name    string
+		setting string
+		want    time.Duration
+		wantErr bool
+	}{
+		{name: "default", want: DEFAULT_DEBOUNCE_SECONDS * time.Second},
+		{name: "configured", setting: "30", want: 30 * time.Second},
+		{name: "off", setting: "0", want: 0},
+		{name: "longer than SQS can delay", setting: "901", wantErr: true},
+		{name: "negative", setting: "-1", wantErr: true},
+		{name: "not a number", setting: "soon", wantErr: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := parseDebounce(func(name string) string {
+				if name == "NOTIFICATION_DEBOUNCE_SECONDS" {
+					return tc.setting
+				}
+				return ""
+			})
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if got != tc.want {
+				t.Fatalf("unexpected debounce: got %v want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestProcessDebouncesNotifications(t *testing.T) {
+	// skip loading the AWS configuration
+	initOnce.Do(func() {})
+
+	created := events.APIGatewayProxyRequest{Headers: map[string]string{}}
+	for name, value := range addRequest.Headers {
+		created.Headers[name] = value
+	}
+	created.Headers["X-Goog-Resource-State"] = RESOURCE_STATE_SYNC
+
+	tests := []struct {
+		name       string
+		requests   []events.APIGatewayProxyRequest
+		debounce   time.Duration
+		pendingErr error
+		sendErr    error
+
+		wantStatus  int
+		wantDelays  []int32
+		wantMarked  int
+		wantCleared int
+		wantDecided []string
+	}{
+		{
+			// a burst of requests queues one notification
+			name:        "burst of changes",
+			requests:    []events.APIGatewayProxyRequest{addRequest, addRequest, addRequest},
+			debounce:    10 * time.Second,
+			wantStatus:  http.StatusOK,
+			wantDelays:  []int32{10},
+			wantMarked:  1,
+			wantDecided: []string{DECISION_QUEUED, DECISION_DEBOUNCED, DECISION_DEBOUNCED},
+		},
+		{
+			name:        "debounce off",
+			requests:    []events.APIGatewayProxyRequest{addRequest, addRequest},
+			wantStatus:  http.StatusOK,
+			wantDelays:  []int32{0, 0},
+			wantDecided: []string{DECISION_QUEUED, DECISION_QUEUED},
+		},
+		{
+			// the scan of a new channel is never held back by a pending
+			// change notification
+			name:        "sync after a change",
+			requests:    []events.APIGatewayProxyRequest{addRequest, created},
+			debounce:    10 * time.Second,
+			wantStatus:  http.StatusOK,
+			wantDelays:  []int32{10, 0},
+			wantMarked:  1,
+			wantDecided: []string{DECISION_QUEUED, DECISION_QUEUED},
+		},
+		{
+			// the notification is queued when the flag can't be checked
+			name:        "pending check fails",
+			requests:    []events.APIGatewayProxyRequest{addRequest, addRequest},
+			debounce:    10 * time.Second,
+			pendingErr:  errors.New("throttled"),
+			wantStatus:  http.StatusOK,
+			wantDelays:  []int32{10, 10},
+			wantDecided: []string{DECISION_QUEUED, DECISION_QUEUED},
+		},
+		{
+			// nothing was queued, so the next request isn't held back
+			name:        "queue fails",
+			requests:    []events.APIGatewayProxyRequest{addRequest},
+			debounce:    10 * time.Second,
+			sendErr:     errors.New("queue unavailable"),
+			wantStatus:  http.StatusInternalServerError,
+			wantMarked:  1,
+			wantCleared: 1,
+			wantDecided: []string{DECISION_QUEUE_FAILED},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			store := &fakeWatchChannelStore{pendingErr: tc.pendingErr}
+			sender := &fakeSender{err: tc.sendErr}
+			captures := &fakeCaptureStore{}
+			cfg = &handlerConfig{
+				store:     store,
+				sqsClient: sender,
+				history:   &fakeHistoryStore{},
+				captures:  captures,
+				capture:   captureSettings{enabled: true, ttl: time.Hour, successPercent: 100},
+				debounce:  tc.debounce,
+			}
+
+			before := time.Now()
+			for _, request := range tc.requests {
+				response, err := process(context.Background(), request)
+				if err != nil || response.StatusCode != tc.wantStatus {
+					t.Fatalf("unexpected response: %d %v", response.StatusCode, err)
+				}
+			}
+
+			if !slices.Equal(sender.delays, tc.wantDelays) {
+				t.Fatalf("unexpected delays: got %v want %v", sender.delays, tc.wantDelays)
+			}
+
+			if len(store.marked) != tc.wantMarked || store.cleared != tc.wantCleared {
+				t.Fatalf("unexpected pending flag: marked %v cleared %d", store.marked, store.cleared)
+			}
+
+			// the flag outlives the delay of the notification
+			for _, until := range store.marked {
+				if until.Before(before.Add(tc.debounce + PENDING_NOTIFICATION_TIMEOUT)) {
+					t.Fatalf("pending flag expires too soon: %v", until)
+				}
+			}
+
+			decided := make([]string, 0, len(captures.captures))
+			for _, capture := range captures.captures {
+				decided = append(decided, capture.Decision)
+			}
+			if !slices.Equal(decided, tc.wantDecided) {
+				t.Fatalf("unexpected decisions: got %v want %v", decided, tc.wantDecided)
+			}
+		})
+	}
+}
+
+func TestProcessDropsPausedChannels(t *testing.T) {
+	// skip loading the AWS configuration
+	initOnce.Do(func() {})
+
+	store := &fakeWatchChannelStore{paused: true}
+	sender := &fakeSender{}
+	captures := &fakeCaptureStore{}
+	history := &fakeHistoryStore{}
+	cfg = &handlerConfig{
+		store:     store,
+		sqsClient: sender,
+		history:   history,
+		captures:  captures,
+		capture:   captureSettings{enabled: true, ttl: time.Hour, successPercent: 100},
+		debounce:  time.Minute,
+	}
+
+	response, err := process(context.Background(), addRequest)
+	if err != nil || response.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected response: %d %v", response.StatusCode, err)
+	}
+
+	// nothing is queued or marked pending, so the changes are still there
+	// when the channel is resumed
+	if sender.sent != 0 || len(store.marked) != 0 || len(history.inserted) != 0 {
+		t.Fatalf("unexpected notification: sent %d marked %v history %v",
+			sender.sent, store.marked, history.inserted)
+	}
+
+	if len(captures.captures) != 1 || captures.captures[0].Decision != DECISION_PAUSED {
+		t.Fatalf("unexpected captures: %+v", captures.captures)
+	}
+}
@@ -2,31 +2,75 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
 	"os"
+	"strconv"
 	"sync"
 	"time"
 
 	"github.com/KyleBrandon/scriptor/lambdas/util"
 	"github.com/KyleBrandon/scriptor/pkg/database"
 	"github.com/KyleBrandon/scriptor/pkg/google"
+	"github.com/KyleBrandon/scriptor/pkg/metrics"
+	"github.com/KyleBrandon/scriptor/pkg/notes"
+	"github.com/KyleBrandon/scriptor/pkg/retry"
 	"github.com/KyleBrandon/scriptor/pkg/types"
 	"github.com/aws/aws-lambda-go/lambda"
 	"github.com/aws/aws-sdk-go-v2/config"
-	"github.com/google/uuid"
 )
 
-type handlerConfig struct {
-	store           database.WatchChannelStore
-	dc              *google.GoogleDriveContext
-	webhookURL      string
-	folderLocations *types.GoogleFolderDefaultLocations
-}
+const (
+	// Channels with more time than this left are not registered again,
+	// unless RENEWAL_MARGIN_HOURS is set. It is longer than the 20 hours
+	// between runs so a channel is always renewed before it lapses.
+	DEFAULT_RENEWAL_MARGIN_HOURS = 24
+
+	// Attempts at stopping a channel on each run
+	STOP_ATTEMPTS = 3
+)
+
+type (
+	// The part of the Drive service used to validate, stop and create the
+	// watch channels
+	watchService interface {
+		ValidateWatchChannelFolders(ctx context.Context, wc *types.WatchChannel) error
+		ValidateFolderLocations(ctx context.Context, wc *types.WatchChannel, recursive bool) error
+		CreateWatchChannel(ctx context.Context, wc *types.WatchChannel) (string, error)
+		StopWatchChannel(ctx context.Context, channelID, resourceID string) error
+		GetChangesStartToken(ctx context.Context, driveID string) (string, error)
+	}
+
+	handlerConfig struct {
+		store           database.WatchChannelStore
+		dc              watchService
+		webhookURL      string
+		folderLocations []*types.GoogleFolderDefaultLocations
+
+		// channels with less time than this left are registered again
+		renewalMargin time.Duration
+	}
+
+	// The payload the lambda is invoked with. The scheduled event has no
+	// force field, so only the channels close to expiry are renewed.
+	registerEvent struct {
+		// Register every channel again, like after the webhook URL
+		// changed
+		Force bool `json:"force"`
+	}
+)
 
 var (
 	initOnce sync.Once
 	cfg      *handlerConfig
+
+	stopRetryPolicy = retry.Policy{
+		MaxAttempts:    STOP_ATTEMPTS,
+		InitialBackoff: 500 * time.Millisecond,
+		MaxBackoff:     2 * time.Second,
+		Retryable:      google.IsRetryableError,
+	}
 )
 
 // Load all the inital configuration settings for the lambda
@@ -49,6 +93,12 @@ func loadConfiguration(ctx context.Context) (*handlerConfig, error) {
 		)
 	}
 
+	cfg.renewalMargin, err = parseRenewalMargin(os.Getenv)
+	if err != nil {
+		slog.Error("Failed to configure the renewal margin", "error", err)
+		return nil, err
+	}
+
 	cfg.store, err = database.NewWatchChannelStore(ctx)
 	if err != nil {
 		slog.Error("Failed to configure the DynamoDB client", "error", err)
@@ -66,12 +116,19 @@ func loadConfiguration(ctx context.Context) (*handlerConfig, error) {
 		return nil, err
 	}
 
-	cfg.folderLocations, err = util.GetDefaultFolderLocations(ctx, awsCfg)
+	cfg.folderLocations, err = util.GetFolderLocations(ctx, awsCfg)
 	if err != nil {
 		slog.Error("Failed to get the default folder locations", "error", err)
 		return nil, err
 	}
 
+	// the default is used by every channel without a template of its own
+	err = notes.ValidateFilename(util.FilenameTemplate(&types.WatchChannel{}))
+	if err != nil {
+		slog.Error("Invalid FILENAME_TEMPLATE", "error", err)
+		return nil, err
+	}
+
 	return cfg, nil
 }
 
@@ -88,27 +145,257 @@ func initLambda(ctx context.Context) error {
 	return err
 }
 
+// Read how long before a channel expires it is registered again from the
+// environment
+func parseRenewalMargin(getenv func(string) string) (time.Duration, error) {
+	setting := getenv("RENEWAL_MARGIN_HOURS")
+	if setting == "" {
+		return DEFAULT_RENEWAL_MARGIN_HOURS * time.Hour, nil
+	}
+
+	hours, err := strconv.Atoi(setting)
+	if err != nil || hours < 0 || hours > int(util.WATCH_CHANNEL_LIFETIME/time.Hour) {
+		return 0, fmt.Errorf("invalid RENEWAL_MARGIN_HOURS: %s", setting)
+	}
+
+	return time.Duration(hours) * time.Hour, nil
+}
+
+// The channels registered again. ExpiryIndex gives the ones with less than
+// the margin left, new channels have no expiry so they are among them. A
+// forced renewal reads every channel, including the ones saved before the
+// index existed, which saves them into it.
+func (cfg *handlerConfig) channelsToRenew(
+	ctx context.Context,
+	now time.Time,
+	force bool,
+) ([]*types.WatchChannel, error) {
+	if force {
+		return cfg.store.GetWatchChannels(ctx)
+	}
+
+	return cfg.store.GetWatchChannelsExpiringBefore(ctx, now.Add(cfg.renewalMargin))
+}
+
 func (cfg *handlerConfig) initializeDefaultWatchChannels() ([]*types.WatchChannel, error) {
 	slog.Debug(">>seedWatchChannels")
 	defer slog.Debug("<<seedWatchChannels")
 
-	wcs := make([]*types.WatchChannel, 0)
+	wcs := make([]*types.WatchChannel, 0, len(cfg.folderLocations))
+
+	// Create a watch channel entry in the DB for each default folder. The
+	// first destination is kept in the single folder field as well for
+	// readers of the old records.
+	for _, locations := range cfg.folderLocations {
+		destinations := locations.Destinations()
+		wc := &types.WatchChannel{
+			FolderID:             locations.FolderID,
+			DriveID:              locations.DriveID,
+			ArchiveFolderID:      locations.ArchiveFolderID,
+			DestinationFolderIDs: destinations,
+			CreatedAt:            time.Now().UTC(),
+		}
 
-	// Create a watch channel entry in the DB
-	wcs = append(wcs, &types.WatchChannel{
-		FolderID:            cfg.folderLocations.FolderID,
-		ArchiveFolderID:     cfg.folderLocations.ArchiveFolderID,
-		DestinationFolderID: cfg.folderLocations.DestFolderID,
-		CreatedAt:           time.Now().UTC(),
-	})
+		if len(destinations) > 0 {
+			wc.DestinationFolderID = destinations[0]
+		}
+
+		wcs = append(wcs, wc)
+	}
 
 	return wcs, nil
 }
 
-func (cfg *handlerConfig) registerWatchChannel(ctx context.Context, wc *types.WatchChannel) error {
+// Stop the channel, retrying transient failures
+func (cfg *handlerConfig) stopChannel(ctx context.Context, channelID, resourceID string) error {
+	return retry.Do(ctx, stopRetryPolicy, "StopWatchChannel", func() error {
+		return cfg.dc.StopWatchChannel(ctx, channelID, resourceID)
+	})
+}
+
+// Try again to stop the earlier channels of the folder that failed to stop.
+// The ones that stop, or have expired, are dropped from the list, and the
+// rest record the attempt.
+func (cfg *handlerConfig) retryPendingStops(
+	ctx context.Context,
+	wc *types.WatchChannel,
+	now time.Time,
+) {
+	pending := make([]types.PendingStop, 0, len(wc.PendingStops))
+	for _, stop := range wc.PendingStops {
+		// Google stops sending the notifications once it expires
+		if stop.ExpiresAt > 0 && stop.ExpiresAt <= now.UnixMilli() {
+			slog.Info(
+				"The channel that failed to stop has expired",
+				"channelID",
+				stop.ChannelID,
+				"folderID",
+				wc.FolderID,
+			)
+			continue
+		}
+
+		err := cfg.stopChannel(ctx, stop.ChannelID, stop.ResourceID)
+		if err == nil {
+			slog.Info(
+				"Stopped the channel that failed to stop before",
+				"channelID",
+				stop.ChannelID,
+				"folderID",
+				wc.FolderID,
+				"attempts",
+				stop.Attempts+1,
+			)
+			continue
+		}
+
+		stop.Attempts++
+		stop.LastError = err.Error()
+		pending = append(pending, stop)
+	}
+
+	wc.PendingStops = pending
+}
+
+// Stop the channel the folder is watched with before it is registered
+// again. A channel that fails to stop is kept in the pending stops of the
+// folder so a later run tries again.
+func (cfg *handlerConfig) stopReplacedChannel(ctx context.Context, wc *types.WatchChannel) {
+	err := cfg.stopChannel(ctx, wc.ChannelID, wc.ResourceID)
+	if err == nil {
+		return
+	}
+
+	slog.Error(
+		"Failed to stop the watch channel, it will be stopped on the next run",
+		"channelID",
+		wc.ChannelID,
+		"folderID",
+		wc.FolderID,
+		"error",
+		err,
+	)
+
+	wc.PendingStops = append(wc.PendingStops, types.PendingStop{
+		ChannelID:  wc.ChannelID,
+		ResourceID: wc.ResourceID,
+		ExpiresAt:  wc.ExpiresAt,
+		Attempts:   1,
+		LastError:  err.Error(),
+	})
+}
+
+// Log the channels that are still sending notifications for a folder that
+// is watched by a newer channel, and emit how many there are
+func reportOrphanedChannels(wcs []*types.WatchChannel) {
+	orphaned := 0
+	for _, wc := range wcs {
+		for _, stop := range wc.PendingStops {
+			orphaned++
+			slog.Warn(
+				"Orphaned watch channel is still sending notifications",
+				"channelID",
+				stop.ChannelID,
+				"folderID",
+				wc.FolderID,
+				"attempts",
+				stop.Attempts,
+				"error",
+				stop.LastError,
+			)
+		}
+	}
+
+	if orphaned > 0 {
+		metrics.Record(metrics.ORPHANED_WATCH_CHANNELS, float64(orphaned), nil)
+	}
+}
+
+// Delete the locks of the channels that are no longer registered. Their
+// locks are only deleted when the channel is replaced, so a run that failed
+// part way leaves them behind. The channels not renewed by this run are
+// looked up, and a lock is only deleted when its channel isn't found. A
+// failure is only logged, the locks expire on their own.
+func (cfg *handlerConfig) removeStaleLocks(ctx context.Context, wcs []*types.WatchChannel) {
+	active := make(map[string]bool, len(wcs))
+	for _, wc := range wcs {
+		active[wc.ChannelID] = true
+	}
+
+	locks, err := cfg.store.ListWatchChannelLocks(ctx)
+	if err != nil {
+		slog.Error("Failed to list the watch channel locks", "error", err)
+		return
+	}
+
+	for _, lock := range locks {
+		if active[lock.ChannelID] {
+			continue
+		}
+
+		_, err = cfg.store.GetWatchChannelByID(ctx, lock.ChannelID)
+		if !errors.Is(err, database.ErrWatchChannelNotFound) {
+			if err != nil {
+				slog.Error(
+					"Failed to look up the channel of a watch channel lock",
+					"channelID",
+					lock.ChannelID,
+					"error",
+					err,
+				)
+			}
+			continue
+		}
+
+		err = cfg.store.DeleteWatchChannelLock(ctx, lock.ChannelID)
+		if err != nil {
+			slog.Error(
+				"Failed to delete the lock of a channel that is no longer registered",
+				"channelID",
+				lock.ChannelID,
+				"error",
+				err,
+			)
+			continue
+		}
+
+		slog.Info("Deleted the lock of a channel that is no longer registered", "channelID", lock.ChannelID)
+	}
+}
+
+// Register the channel with Drive. A channel of a folder that isn't in the
+// database yet is inserted, so a folder that another run registered in the
+// meantime isn't overwritten.
+func (cfg *handlerConfig) registerWatchChannel(
+	ctx context.Context,
+	wc *types.WatchChannel,
+	isNew bool,
+) error {
+
+	// Google sends the sync notification as soon as the channel is created,
+	// so the channel and its token are saved first for the webhook to find
+	wc.ResourceID = ""
+	var err error
+	if isNew {
+		err = cfg.store.InsertWatchChannel(ctx, wc)
+	} else {
+		err = cfg.store.UpdateWatchChannel(ctx, wc)
+	}
+	if err != nil {
+		slog.Error(
+			"Failed to save the watch channel before creating it",
+			"folderID",
+			wc.FolderID,
+			"channelID",
+			wc.ChannelID,
+			"error",
+			err,
+		)
+		return err
+	}
 
 	// create the channel
-	resourceID, err := cfg.dc.CreateWatchChannel(wc)
+	resourceID, err := cfg.dc.CreateWatchChannel(ctx, wc)
 	if err != nil {
 		slog.Error(
 			"Failed to create the watch channel",
@@ -157,8 +444,14 @@ func (cfg *handlerConfig) initializeWatchChannelLock(
 		return nil
 	}
 
+	// a lock that couldn't be read isn't replaced
+	if !errors.Is(err, database.ErrWatchChannelLockNotFound) {
+		slog.Error("Failed to get the watch channel lock", "channelID", wc.ChannelID, "error", err)
+		return err
+	}
+
 	if existingStartToken == "" {
-		existingStartToken, err = cfg.dc.GetChangesStartToken()
+		existingStartToken, err = cfg.dc.GetChangesStartToken(ctx, wc.DriveID)
 		if err != nil {
 			slog.Error(
 				"Failed to get a Google Drive changes start token",
@@ -169,8 +462,13 @@ func (cfg *handlerConfig) initializeWatchChannelLock(
 		}
 	}
 
-	// create the watch channel lock
+	// create the watch channel lock, one created since it was looked up
+	// is kept
 	err = cfg.store.CreateWatchChannelLock(ctx, wc.ChannelID, existingStartToken)
+	if errors.Is(err, database.ErrWatchChannelLockExists) {
+		slog.Info("Watch channel lock was created by another run, use it", "channelID", wc.ChannelID)
+		return nil
+	}
 	if err != nil {
 		slog.Error("Failed to save the changes token for the watch ")
 		return err
@@ -179,7 +477,7 @@ func (cfg *handlerConfig) initializeWatchChannelLock(
 	return nil
 }
 
-func process(ctx context.Context) error {
+func process(ctx context.Context, event registerEvent) error {
 	slog.Debug(">>registerWebhook")
 	defer slog.Debug("<<registerWebhook")
 
@@ -188,10 +486,11 @@ func process(ctx context.Context) error {
 		return err
 	}
 
-	watchChannels, err := cfg.store.GetWatchChannels(ctx)
+	now := time.Now().UTC()
+	watchChannels, err := cfg.channelsToRenew(ctx, now, event.Force)
 	if err != nil {
 		slog.Error(
-			"Failed to get the list of active watch channels",
+			"Failed to get the list of watch channels to renew",
 			"error",
 			err,
 		)
@@ -199,7 +498,22 @@ func process(ctx context.Context) error {
 	}
 
 	// if we have not existing watch channels, then initialize a default one
+	seeded := false
 	if len(watchChannels) == 0 {
+		exists, err := cfg.store.HasWatchChannels(ctx)
+		if err != nil {
+			slog.Error(
+				"Failed to check for existing watch channels",
+				"error",
+				err,
+			)
+			return err
+		}
+		seeded = !exists
+	}
+
+	raced := false
+	if seeded {
 		watchChannels, err = cfg.initializeDefaultWatchChannels()
 		if err != nil {
 			slog.Error(
@@ -215,11 +529,117 @@ func process(ctx context.Context) error {
 	for _, wc := range watchChannels {
 		existingToken := ""
 
+		// the earlier channels that failed to stop are tried first, the
+		// channel is saved right away so the ones that stopped aren't
+		// tried again whatever happens to it
+		if len(wc.PendingStops) > 0 {
+			cfg.retryPendingStops(ctx, wc, now)
+
+			err = cfg.store.UpdateWatchChannel(ctx, wc)
+			if err != nil {
+				slog.Error(
+					"Failed to save the pending stops of the watch channel",
+					"channelID",
+					wc.ChannelID,
+					"folderID",
+					wc.FolderID,
+					"error",
+					err,
+				)
+			}
+		}
+
+		// a mistyped folder ID would make a channel that never fires, and
+		// one that can't be written to would fail every document
+		err = cfg.dc.ValidateWatchChannelFolders(ctx, wc)
+		if err != nil {
+			slog.Error(
+				"Rejecting the folders of the watch channel",
+				"folderID",
+				wc.FolderID,
+				"error",
+				err,
+			)
+			continue
+		}
+
+		// changes are only picked up for files directly in the watch folder
+		// so nested destination folders can't feed back into it
+		err = cfg.dc.ValidateFolderLocations(ctx, wc, wc.Recursive)
+		if err != nil {
+			slog.Error(
+				"Rejecting the watch channel configuration",
+				"folderID",
+				wc.FolderID,
+				"error",
+				err,
+			)
+			continue
+		}
+
+		// the files are named when they are uploaded, so a template that
+		// can't be rendered is caught before any document is processed
+		err = notes.ValidateFilename(util.FilenameTemplate(wc))
+		if err != nil {
+			slog.Error(
+				"Rejecting the filename template of the watch channel",
+				"folderID",
+				wc.FolderID,
+				"template",
+				wc.FilenameTemplate,
+				"error",
+				err,
+			)
+			continue
+		}
+
+		_, err = types.ParseArchiveMode(wc.ArchiveMode)
+		if err != nil {
+			slog.Error(
+				"Rejecting the archive mode of the watch channel",
+				"folderID",
+				wc.FolderID,
+				"mode",
+				wc.ArchiveMode,
+				"error",
+				err,
+			)
+			continue
+		}
+
+		// the token of the new channel is made before the old one is stopped
+		token, err := util.NewChannelToken()
+		if err != nil {
+			slog.Error(
+				"Failed to make a token for the watch channel",
+				"folderID",
+				wc.FolderID,
+				"error",
+				err,
+			)
+			continue
+		}
+
 		// if we have an existing watch channel, stop it before creating a new one
 		if wc.ChannelID != "" {
-			cfg.dc.StopWatchChannel(wc.ChannelID, wc.ResourceID)
-
+			// the token of a lock that couldn't be read would be lost, so
+			// the channel is left as it is until the next run
 			existingLock, err := cfg.store.GetWatchChannelLock(ctx, wc.ChannelID)
+			if err != nil && !errors.Is(err, database.ErrWatchChannelLockNotFound) {
+				slog.Error(
+					"Failed to get the lock of the watch channel",
+					"folderID",
+					wc.FolderID,
+					"channelID",
+					wc.ChannelID,
+					"error",
+					err,
+				)
+				continue
+			}
+
+			cfg.stopReplacedChannel(ctx, wc)
+
 			if err == nil {
 				// save the existing token to represent the last time we processed changes
 				existingToken = existingLock.ChangesStartToken
@@ -230,12 +650,19 @@ func process(ctx context.Context) error {
 		}
 
 		// create a new channel
-		wc.ChannelID = uuid.New().String()
-		wc.ExpiresAt = time.Now().UTC().Add(48 * time.Hour).UnixMilli()
-		wc.WebhookUrl = cfg.webhookURL
+		util.SetChannelIdentity(wc, token, cfg.webhookURL, now)
 
 		// register the new channel
-		err = cfg.registerWatchChannel(ctx, wc)
+		err = cfg.registerWatchChannel(ctx, wc, seeded)
+		if errors.Is(err, database.ErrWatchChannelExists) {
+			slog.Warn(
+				"The watch folder was registered by another run, skipping it",
+				"folderID",
+				wc.FolderID,
+			)
+			raced = true
+			continue
+		}
 		if err != nil {
 			slog.Error(
 				"Failed to register the watch channel",
@@ -263,6 +690,14 @@ func process(ctx context.Context) error {
 		}
 	}
 
+	reportOrphanedChannels(watchChannels)
+
+	// the channels of the other run aren't known here, so its locks would
+	// look stale
+	if !raced {
+		cfg.removeStaleLocks(ctx, watchChannels)
+	}
+
 	return nil
 }
 
@@ -0,0 +1,729 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/KyleBrandon/scriptor/lambdas/util"
+	"github.com/KyleBrandon/scriptor/pkg/database"
+	"github.com/KyleBrandon/scriptor/pkg/google"
+	"github.com/KyleBrandon/scriptor/pkg/retry"
+	"github.com/KyleBrandon/scriptor/pkg/types"
+	"google.golang.org/api/googleapi"
+)
+
+// The watch channels and their locks, keyed by the channel ID
+type fakeStore struct {
+	database.WatchChannelStore
+	channels []*types.WatchChannel
+	locks    map[string]string
+	saved    []string
+
+	// The channels inserted, and the error inserting them fails with
+	inserted  []string
+	insertErr error
+
+	// the error reading a lock fails with
+	lockErr error
+}
+
+func (s *fakeStore) GetWatchChannels(ctx context.Context) ([]*types.WatchChannel, error) {
+	return s.channels, nil
+}
+
+func (s *fakeStore) GetWatchChannelsExpiringBefore(
+	ctx context.Context,
+	before time.Time,
+) ([]*types.WatchChannel, error) {
+	var wcs []*types.WatchChannel
+	for _, wc := range s.channels {
+		if wc.ExpiresAt < before.UnixMilli() {
+			wcs = append(wcs, wc)
+		}
+	}
+
+	return wcs, nil
+}
+
+func (s *fakeStore) HasWatchChannels(ctx context.Context) (bool, error) {
+	return len(s.channels) > 0, nil
+}
+
+func (s *fakeStore) GetWatchChannelByID(ctx context.Context, channelID string) (*types.WatchChannel, error) {
+	for _, wc := range s.channels {
+		if wc.ChannelID == channelID {
+			return wc, nil
+		}
+	}
+
+	return nil, database.ErrWatchChannelNotFound
+}
+
+func (s *fakeStore) UpdateWatchChannel(ctx context.Context, wc *types.WatchChannel) error {
+	s.saved = append(s.saved, wc.ChannelID)
+	return nil
+}
+
+func (s *fakeStore) InsertWatchChannel(ctx context.Context, wc *types.WatchChannel) error {
+	if s.insertErr != nil {
+		return s.insertErr
+	}
+
+	s.inserted = append(s.inserted, wc.ChannelID)
+	return nil
+}
+
+func (s *fakeStore) GetWatchChannelLock(
+	ctx context.Context,
+	channelID string,
+) (*types.WatchChannelLock, error) {
+	if s.lockErr != nil {
+		return nil, s.lockErr
+	}
+
+	token, ok := s.locks[channelID]
+	if !ok {
+		return nil, database.ErrWatchChannelLockNotFound
+	}
+
+	return &types.WatchChannelLock{ChannelID: channelID, ChangesStartToken: token}, nil
+}
+
+func (s *fakeStore) CreateWatchChannelLock(ctx context.Context, channelID, startToken string) error {
+	if _, ok := s.locks[channelID]; ok {
+		return database.ErrWatchChannelLockExists
+	}
+
+	s.locks[channelID] = startToken
+	return nil
+}
+
+func (s *fakeStore) ListWatchChannelLocks(ctx context.Context) ([]*types.WatchChannelLock, error) {
+	locks := make([]*types.WatchChannelLock, 0, len(s.locks))
+	for channelID, token := range s.locks {
+		locks = append(locks, &types.WatchChannelLock{ChannelID: channelID, ChangesStartToken: token})
+	}
+
+	return locks, nil
+}
+
+func (s *fakeStore) DeleteWatchChannelLock(ctx context.Context, channelID string) error {
+	delete(s.locks, channelID)
+	return nil
+}
+
+// Records the channels stopped and the folders watched. The channels in
+// stopErrs fail to stop every time they are tried, and the watch folders in
+// folderErrs fail the validation.
+type fakeDrive struct {
+	stopped    []string
+	watched    []string
+	stopErrs   map[string]error
+	folderErrs map[string]error
+}
+
+func (d *fakeDrive) ValidateWatchChannelFolders(ctx context.Context, wc *types.WatchChannel) error {
+	return d.folderErrs[wc.FolderID]
+}
+
+func (d *fakeDrive) ValidateFolderLocations(
+	ctx context.Context,
+	wc *types.WatchChannel,
+	recursive bool,
+) error {
+	return nil
+}
+
+func (d *fakeDrive) CreateWatchChannel(ctx context.Context, wc *types.WatchChannel) (string, error) {
+	d.watched = append(d.watched, wc.FolderID)
+	return "resource-new", nil
+}
+
+func (d *fakeDrive) StopWatchChannel(ctx context.Context, channelID, resourceID string) error {
+	d.stopped = append(d.stopped, channelID)
+	return d.stopErrs[channelID]
+}
+
+func (d *fakeDrive) GetChangesStartToken(ctx context.Context, driveID string) (string, error) {
+	return "start-new", nil
+}
+
+func TestParseRenewalMargin(t *testing.T) {
+	tests := []struct {
+		name    string
+		setting string
+		want    time.Duration
+		wantErr bool
+	}{
+		{name: "default", want: DEFAULT_RENEWAL_MARGIN_HOURS * time.Hour},
+		{name: "set", setting: "12", want: 12 * time.Hour},
+		{name: "always renew", setting: "48", want: 48 * time.Hour},
+		{name: "longer than a channel lasts", setting: "49", wantErr: true},
+		{name: "negative", setting: "-1", wantErr: true},
+		{name: "not a number", setting: "12h", wantErr: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := parseRenewalMargin(func(string) string { return tc.setting })
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if got != tc.want {
+				t.Fatalf("unexpected margin: got %v want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestInitializeWatchChannelLock(t *testing.T) {
+	tests := []struct {
+		name       string
+		locks      map[string]string
+		lockErr    error
+		startToken string
+
+		wantLocks map[string]string
+		wantErr   bool
+	}{
+		{
+			// the changes since it was last updated are picked up
+			name:      "existing lock",
+			locks:     map[string]string{"channel-1": "token-1"},
+			wantLocks: map[string]string{"channel-1": "token-1"},
+		},
+		{
+			name:       "token of the replaced channel",
+			locks:      map[string]string{},
+			startToken: "token-old",
+			wantLocks:  map[string]string{"channel-1": "token-old"},
+		},
+		{
+			name:      "new channel",
+			locks:     map[string]string{},
+			wantLocks: map[string]string{"channel-1": "start-new"},
+		},
+		{
+			// a lock that can't be read isn't replaced
+			name:      "lookup fails",
+			locks:     map[string]string{},
+			lockErr:   errors.New("throttled"),
+			wantLocks: map[string]string{},
+			wantErr:   true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			store := &fakeStore{locks: tc.locks, lockErr: tc.lockErr}
+			cfg := &handlerConfig{store: store, dc: &fakeDrive{}}
+
+			wc := &types.WatchChannel{FolderID: "folder-1", ChannelID: "channel-1"}
+			err := cfg.initializeWatchChannelLock(context.Background(), wc, tc.startToken)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if !maps.Equal(store.locks, tc.wantLocks) {
+				t.Fatalf("unexpected locks: %v", store.locks)
+			}
+		})
+	}
+}
+
+func TestProcessRenewsChannels(t *testing.T) {
+	// skip loading the configuration
+	initOnce.Do(func() {})
+
+	now := time.Now().UTC()
+
+	tests := []struct {
+		name      string
+		channelID string
+		expiresIn time.Duration
+		force     bool
+
+		wantRenewed bool
+	}{
+		{
+			name:      "far from expiry",
+			channelID: "channel-old",
+			expiresIn: 40 * time.Hour,
+		},
+		{
+			name:        "close to expiry",
+			channelID:   "channel-old",
+			expiresIn:   6 * time.Hour,
+			wantRenewed: true,
+		},
+		{
+			name:        "expired",
+			channelID:   "channel-old",
+			expiresIn:   -time.Hour,
+			wantRenewed: true,
+		},
+		{
+			name:        "forced",
+			channelID:   "channel-old",
+			expiresIn:   40 * time.Hour,
+			force:       true,
+			wantRenewed: true,
+		},
+		{
+			name:        "never registered",
+			wantRenewed: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			wc := &types.WatchChannel{
+				ChannelID:       tc.channelID,
+				ResourceID:      "resource-old",
+				FolderID:        "folder-1",
+				ExpiryPartition: database.WATCH_CHANNEL_EXPIRY_PARTITION,
+			}
+			if tc.channelID != "" {
+				wc.ExpiresAt = now.Add(tc.expiresIn).UnixMilli()
+			}
+			store := &fakeStore{
+				channels: []*types.WatchChannel{wc},
+				locks:    map[string]string{"channel-old": "start-old"},
+			}
+			drive := &fakeDrive{}
+			cfg = &handlerConfig{
+				store:         store,
+				dc:            drive,
+				webhookURL:    "https://example.com/webhook",
+				renewalMargin: 12 * time.Hour,
+			}
+
+			if err := process(context.Background(), registerEvent{Force: tc.force}); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if !tc.wantRenewed {
+				// the channel keeps running untouched
+				if len(drive.stopped) != 0 || len(drive.watched) != 0 || len(store.saved) != 0 {
+					t.Fatalf("unexpected renewal: stopped %v watched %v saved %v",
+						drive.stopped, drive.watched, store.saved)
+				}
+				if wc.ChannelID != "channel-old" || store.locks["channel-old"] != "start-old" {
+					t.Fatalf("unexpected channel: %+v locks %v", wc, store.locks)
+				}
+				return
+			}
+
+			if !slices.Equal(drive.watched, []string{"folder-1"}) {
+				t.Fatalf("unexpected folders watched: %v", drive.watched)
+			}
+
+			if wc.ChannelID == "" || wc.ChannelID == "channel-old" || wc.ResourceID != "resource-new" {
+				t.Fatalf("unexpected channel: %+v", wc)
+			}
+
+			expiresIn := time.UnixMilli(wc.ExpiresAt).Sub(now)
+			if expiresIn < util.WATCH_CHANNEL_LIFETIME-time.Minute {
+				t.Fatalf("unexpected expiry: %v", expiresIn)
+			}
+
+			// the old channel is stopped and its changes are picked up
+			// where it left off
+			wantStopped := []string{}
+			wantToken := "start-new"
+			if tc.channelID != "" {
+				wantStopped = []string{"channel-old"}
+				wantToken = "start-old"
+			}
+			if !slices.Equal(drive.stopped, wantStopped) {
+				t.Fatalf("unexpected channels stopped: %v", drive.stopped)
+			}
+
+			if _, ok := store.locks["channel-old"]; ok && tc.channelID != "" {
+				t.Fatalf("the old lock was kept: %v", store.locks)
+			}
+			if store.locks[wc.ChannelID] != wantToken {
+				t.Fatalf("unexpected lock: %v", store.locks)
+			}
+		})
+	}
+}
+
+func TestProcessStopsReplacedChannels(t *testing.T) {
+	// skip loading the configuration
+	initOnce.Do(func() {})
+
+	// retry without waiting
+	defer func(policy retry.Policy) { stopRetryPolicy = policy }(stopRetryPolicy)
+	stopRetryPolicy.InitialBackoff = time.Millisecond
+	stopRetryPolicy.MaxBackoff = time.Millisecond
+
+	now := time.Now().UTC()
+	unavailable := &googleapi.Error{Code: http.StatusServiceUnavailable}
+	forbidden := &googleapi.Error{Code: http.StatusForbidden}
+
+	pendingStop := func(channelID string, expiresIn time.Duration) types.PendingStop {
+		return types.PendingStop{
+			ChannelID:  channelID,
+			ResourceID: "resource-" + channelID,
+			ExpiresAt:  now.Add(expiresIn).UnixMilli(),
+			Attempts:   1,
+			LastError:  "backend error",
+		}
+	}
+
+	tests := []struct {
+		name      string
+		expiresIn time.Duration
+		pending   []types.PendingStop
+		stopErrs  map[string]error
+
+		wantStopped  []string
+		wantPending  []string
+		wantAttempts []int
+	}{
+		{
+			name:        "replaced channel stops",
+			expiresIn:   time.Hour,
+			wantStopped: []string{"channel-old"},
+		},
+		{
+			// retried, then kept for the next run
+			name:         "replaced channel stays unavailable",
+			expiresIn:    time.Hour,
+			stopErrs:     map[string]error{"channel-old": unavailable},
+			wantStopped:  []string{"channel-old", "channel-old", "channel-old"},
+			wantPending:  []string{"channel-old"},
+			wantAttempts: []int{1},
+		},
+		{
+			// not retried, it fails the same way again
+			name:         "replaced channel can't be stopped",
+			expiresIn:    time.Hour,
+			stopErrs:     map[string]error{"channel-old": forbidden},
+			wantStopped:  []string{"channel-old"},
+			wantPending:  []string{"channel-old"},
+			wantAttempts: []int{1},
+		},
+		{
+			// the pending stop is tried before the channel is replaced
+			name:        "pending stop succeeds",
+			expiresIn:   time.Hour,
+			pending:     []types.PendingStop{pendingStop("channel-older", 20*time.Hour)},
+			wantStopped: []string{"channel-older", "channel-old"},
+		},
+		{
+			name:         "pending stop fails again",
+			expiresIn:    time.Hour,
+			pending:      []types.PendingStop{pendingStop("channel-older", 20*time.Hour)},
+			stopErrs:     map[string]error{"channel-older": forbidden},
+			wantStopped:  []string{"channel-older", "channel-old"},
+			wantPending:  []string{"channel-older"},
+			wantAttempts: []int{2},
+		},
+		{
+			name:        "pending stop expired",
+			expiresIn:   time.Hour,
+			pending:     []types.PendingStop{pendingStop("channel-older", -time.Hour)},
+			wantStopped: []string{"channel-old"},
+		},
+		{
+			// the channel isn't read until it is close to expiry
+			name:         "pending stop of a channel far from expiry",
+			expiresIn:    40 * time.Hour,
+			pending:      []types.PendingStop{pendingStop("channel-older", 20*time.Hour)},
+			wantPending:  []string{"channel-older"},
+			wantAttempts: []int{1},
+		},
+		{
+			name:         "pending stop and replaced channel",
+			expiresIn:    time.Hour,
+			pending:      []types.PendingStop{pendingStop("channel-older", 20*time.Hour)},
+			stopErrs:     map[string]error{"channel-old": forbidden},
+			wantStopped:  []string{"channel-older", "channel-old"},
+			wantPending:  []string{"channel-old"},
+			wantAttempts: []int{1},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			wc := &types.WatchChannel{
+				ChannelID:    "channel-old",
+				ResourceID:   "resource-old",
+				FolderID:     "folder-1",
+				ExpiresAt:    now.Add(tc.expiresIn).UnixMilli(),
+				PendingStops: tc.pending,
+			}
+
+			store := &fakeStore{
+				channels: []*types.WatchChannel{wc},
+				locks:    map[string]string{"channel-old": "start-old"},
+			}
+			drive := &fakeDrive{stopErrs: tc.stopErrs}
+			cfg = &handlerConfig{
+				store:         store,
+				dc:            drive,
+				webhookURL:    "https://example.com/webhook",
+				renewalMargin: 12 * time.Hour,
+			}
+
+			if err := process(context.Background(), registerEvent{}); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if !slices.Equal(drive.stopped, tc.wantStopped) {
+				t.Fatalf("unexpected stops: got %v want %v", drive.stopped, tc.wantStopped)
+			}
+
+			var pending []string
+			var attempts []int
+			for _, stop := range wc.PendingStops {
+				pending = append(pending, stop.ChannelID)
+				attempts = append(attempts, stop.Attempts)
+				if stop.LastError == "" || stop.ResourceID == "" {
+					t.Fatalf("unexpected pending stop: %+v", stop)
+				}
+			}
+			if !slices.Equal(pending, tc.wantPending) || !slices.Equal(attempts, tc.wantAttempts) {
+				t.Fatalf("unexpected pending stops: %+v", wc.PendingStops)
+			}
+
+			// the pending stops are saved with the channel
+			if len(drive.stopped) > 0 && len(store.saved) == 0 {
+				t.Fatalf("the pending stops were not saved")
+			}
+		})
+	}
+}
+
+func TestProcessKeepsChannelWithUnreadableLock(t *testing.T) {
+	// skip loading the configuration
+	initOnce.Do(func() {})
+
+	wc := &types.WatchChannel{
+		ChannelID:  "channel-old",
+		ResourceID: "resource-old",
+		FolderID:   "folder-1",
+		ExpiresAt:  time.Now().UTC().Add(time.Hour).UnixMilli(),
+	}
+
+	store := &fakeStore{
+		channels: []*types.WatchChannel{wc},
+		locks:    map[string]string{"channel-old": "start-old"},
+		lockErr:  errors.New("throttled"),
+	}
+	drive := &fakeDrive{}
+	cfg = &handlerConfig{
+		store:         store,
+		dc:            drive,
+		webhookURL:    "https://example.com/webhook",
+		renewalMargin: 12 * time.Hour,
+	}
+
+	if err := process(context.Background(), registerEvent{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// the channel is renewed on the next run, with its token
+	if len(drive.stopped) > 0 || len(drive.watched) > 0 || len(store.saved) > 0 {
+		t.Fatalf("unexpected renewal: stopped %v watched %v saved %v", drive.stopped, drive.watched, store.saved)
+	}
+	if wc.ChannelID != "channel-old" || store.locks["channel-old"] != "start-old" {
+		t.Fatalf("unexpected channel: %+v locks %v", wc, store.locks)
+	}
+}
+
+func TestProcessRemovesStaleLocks(t *testing.T) {
+	// skip loading the configuration
+	initOnce.Do(func() {})
+
+	now := time.Now().UTC()
+
+	tests := []struct {
+		name      string
+		expiresIn time.Duration
+
+		wantLocks []string
+	}{
+		{
+			name:      "channel kept",
+			expiresIn: 40 * time.Hour,
+			wantLocks: []string{"channel-active", "channel-other"},
+		},
+		{
+			// the lock of the replaced channel goes with it, the new
+			// channel's is kept
+			name:      "channel replaced",
+			expiresIn: time.Hour,
+			wantLocks: []string{"channel-other"},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			wc := &types.WatchChannel{
+				ChannelID:  "channel-active",
+				ResourceID: "resource-active",
+				FolderID:   "folder-1",
+				ExpiresAt:  now.Add(tc.expiresIn).UnixMilli(),
+			}
+			other := &types.WatchChannel{
+				ChannelID:  "channel-other",
+				ResourceID: "resource-other",
+				FolderID:   "folder-2",
+				ExpiresAt:  now.Add(40 * time.Hour).UnixMilli(),
+			}
+
+			// locks left behind by runs that failed part way
+			store := &fakeStore{
+				channels: []*types.WatchChannel{wc, other},
+				locks: map[string]string{
+					"channel-active": "start-active",
+					"channel-other":  "start-other",
+					"channel-stale":  "start-stale",
+					"channel-older":  "start-older",
+				},
+			}
+			cfg = &handlerConfig{
+				store:         store,
+				dc:            &fakeDrive{},
+				webhookURL:    "https://example.com/webhook",
+				renewalMargin: 12 * time.Hour,
+			}
+
+			if err := process(context.Background(), registerEvent{}); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			wantLocks := tc.wantLocks
+			if wc.ChannelID != "channel-active" {
+				wantLocks = append(wantLocks, wc.ChannelID)
+			}
+
+			locks := slices.Sorted(maps.Keys(store.locks))
+			slices.Sort(wantLocks)
+			if !slices.Equal(locks, wantLocks) {
+				t.Fatalf("unexpected locks: got %v want %v", locks, wantLocks)
+			}
+		})
+	}
+}
+
+func TestProcessInsertsNewChannels(t *testing.T) {
+	// skip loading the configuration
+	initOnce.Do(func() {})
+
+	now := time.Now().UTC()
+
+	tests := []struct {
+		name            string
+		channels        []*types.WatchChannel
+		folderLocations []*types.GoogleFolderDefaultLocations
+		insertErr       error
+		folderErrs      map[string]error
+
+		wantInserted int
+		wantSaved    int
+		wantWatched  []string
+
+		// whether the lock of a channel that isn't known is kept
+		wantOtherLock bool
+	}{
+		{
+			// the default folder is inserted, then updated with the
+			// resource ID of the channel
+			name:            "no channels yet",
+			folderLocations: []*types.GoogleFolderDefaultLocations{{FolderID: "folder-default"}},
+			wantInserted:    1,
+			wantSaved:       1,
+			wantWatched:     []string{"folder-default"},
+		},
+		{
+			// a channel is seeded for each of the default folders
+			name: "several default folders",
+			folderLocations: []*types.GoogleFolderDefaultLocations{
+				{FolderID: "folder-default"},
+				{FolderID: "folder-other"},
+			},
+			wantInserted: 2,
+			wantSaved:    2,
+			wantWatched:  []string{"folder-default", "folder-other"},
+		},
+		{
+			name: "channel exists",
+			channels: []*types.WatchChannel{{
+				ChannelID:  "channel-old",
+				ResourceID: "resource-old",
+				FolderID:   "folder-1",
+				ExpiresAt:  now.Add(time.Hour).UnixMilli(),
+				CreatedAt:  now.Add(-util.WATCH_CHANNEL_LIFETIME),
+			}},
+			wantSaved:   2,
+			wantWatched: []string{"folder-1"},
+		},
+		{
+			// the folder with a mistyped ID isn't saved or watched
+			name: "default folder not in Drive",
+			folderLocations: []*types.GoogleFolderDefaultLocations{
+				{FolderID: "folder-missing"},
+				{FolderID: "folder-default"},
+			},
+			folderErrs: map[string]error{
+				"folder-missing": fmt.Errorf("invalid FolderID: %w", google.ErrFolderNotFound),
+			},
+			wantInserted: 1,
+			wantSaved:    1,
+			wantWatched:  []string{"folder-default"},
+		},
+		{
+			// another run registered the folder first, its channel and
+			// lock are left alone
+			name:            "inserted by another run",
+			folderLocations: []*types.GoogleFolderDefaultLocations{{FolderID: "folder-default"}},
+			insertErr:       database.ErrWatchChannelExists,
+			wantOtherLock:   true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			store := &fakeStore{
+				channels:  tc.channels,
+				locks:     map[string]string{"channel-other": "start-other"},
+				insertErr: tc.insertErr,
+			}
+			drive := &fakeDrive{folderErrs: tc.folderErrs}
+			cfg = &handlerConfig{
+				store:           store,
+				dc:              drive,
+				folderLocations: tc.folderLocations,
+				webhookURL:      "https://example.com/webhook",
+				renewalMargin:   12 * time.Hour,
+			}
+
+			if err := process(context.Background(), registerEvent{}); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if len(store.inserted) != tc.wantInserted || len(store.saved) != tc.wantSaved {
+				t.Fatalf("unexpected saves: inserted %v updated %v", store.inserted, store.saved)
+			}
+
+			if !slices.Equal(drive.watched, tc.wantWatched) {
+				t.Fatalf("unexpected folders watched: %v", drive.watched)
+			}
+
+			if _, ok := store.locks["channel-other"]; ok != tc.wantOtherLock {
+				t.Fatalf("unexpected locks: %v", store.locks)
+			}
+		})
+	}
+}
@@ -1,34 +1,162 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
 	"log/slog"
+	"os"
+	"strconv"
 	"sync"
 	"time"
 
 	"github.com/KyleBrandon/scriptor/lambdas/util"
 	"github.com/KyleBrandon/scriptor/pkg/database"
+	"github.com/KyleBrandon/scriptor/pkg/errorsmap"
 	"github.com/KyleBrandon/scriptor/pkg/google"
+	"github.com/KyleBrandon/scriptor/pkg/metrics"
+	"github.com/KyleBrandon/scriptor/pkg/retry"
 	"github.com/KyleBrandon/scriptor/pkg/types"
 	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-lambda-go/lambda/messages"
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 )
 
-type handlerConfig struct {
-	store    database.DocumentStore
-	dc       *google.GoogleDriveContext
-	s3Client *s3.Client
+const (
+	// Largest document accepted when MAX_DOCUMENT_SIZE_MB is not set
+	DEFAULT_MAX_DOCUMENT_SIZE_MB = 200
+
+	bytesPerMB = 1024 * 1024
+
+	// Number of times a download from Google Drive that was cut off part way
+	// through is attempted
+	DOWNLOAD_ATTEMPTS = 3
+
+	// How long to wait for a document with the same content to finish before
+	// processing the copy on its own. The workflow retries a pending
+	// duplicate for a little longer than this.
+	DUPLICATE_WAIT = 5 * time.Minute
+)
+
+const (
+	// How an earlier document with the same content can be used
+	originalUnusable = iota
+	originalReady
+	originalPending
+)
+
+type (
+	// The part of Google Drive used to download documents
+	documentReader interface {
+		GetReader(ctx context.Context, document *types.Document) (io.ReadCloser, error)
+	}
+
+	// The part of the S3 client used to store the stage file
+	objectPutter interface {
+		PutObject(
+			ctx context.Context,
+			params *s3.PutObjectInput,
+			optFns ...func(*s3.Options),
+		) (*s3.PutObjectOutput, error)
+	}
+
+	handlerConfig struct {
+		store           database.DocumentStore
+		counter         util.ExecutionCounter
+		dc              documentReader
+		s3Client        objectPutter
+		maxDocumentSize int64
+	}
+
+	// Keeps the first error hit while reading the download so a failure
+	// part way through the upload to S3 can be traced back to Drive.
+	downloadReader struct {
+		reader io.Reader
+		err    error
+	}
+
+	// Returned when the download from Drive fails part way through. The
+	// Drive client only retries getting the reader, so these start the
+	// download over.
+	downloadInterruptedError struct {
+		err error
+	}
+
+	// Returned when a document is over the configured size limit. The size is
+	// zero when Drive didn't report one and the limit was hit while reading.
+	documentTooLargeError struct {
+		size    int64
+		maxSize int64
+	}
+)
+
+func (e *documentTooLargeError) Error() string {
+	if e.size == 0 {
+		return fmt.Sprintf(
+			"document exceeds the maximum size of %s",
+			formatSize(e.maxSize),
+		)
+	}
+
+	return fmt.Sprintf(
+		"document is %s which exceeds the maximum size of %s",
+		formatSize(e.size),
+		formatSize(e.maxSize),
+	)
+}
+
+func formatSize(size int64) string {
+	return fmt.Sprintf("%.1f MB", float64(size)/bytesPerMB)
+}
+
+func (e *downloadInterruptedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *downloadInterruptedError) Unwrap() error {
+	return e.err
+}
+
+// Only a download cut off by a transient failure is started over, the errors
+// of getting the reader were already retried by the Drive client
+func isInterruptedDownload(err error) bool {
+	var interrupted *downloadInterruptedError
+	return errors.As(err, &interrupted) &&
+		google.IsRetryableError(interrupted.err)
 }
 
 var (
 	BucketName string = types.S3_BUCKET_NAME
 	initOnce   sync.Once
 	cfg        *handlerConfig
+
+	downloadRetryPolicy = retry.Policy{
+		MaxAttempts:    DOWNLOAD_ATTEMPTS,
+		InitialBackoff: time.Second,
+		MaxBackoff:     8 * time.Second,
+		Retryable:      isInterruptedDownload,
+	}
 )
 
+func (r *downloadReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	if err != nil && err != io.EOF {
+		if r.err == nil {
+			r.err = &downloadInterruptedError{err: err}
+		}
+		return n, r.err
+	}
+
+	return n, err
+}
+
 // Load all the inital configuration settings for the lambda
 func loadConfiguration(ctx context.Context) (*handlerConfig, error) {
 
@@ -48,6 +176,12 @@ func loadConfiguration(ctx context.Context) (*handlerConfig, error) {
 		return nil, err
 	}
 
+	cfg.counter, err = database.NewWatchChannelStore(ctx)
+	if err != nil {
+		slog.Error("Failed to configure the watch channel store", "error", err)
+		return nil, err
+	}
+
 	cfg.dc, err = google.NewGoogleDrive(ctx)
 	if err != nil {
 		//
@@ -61,9 +195,46 @@ func loadConfiguration(ctx context.Context) (*handlerConfig, error) {
 
 	cfg.s3Client = s3.NewFromConfig(awsCfg)
 
+	cfg.maxDocumentSize, err = parseMaxDocumentSize(
+		os.Getenv("MAX_DOCUMENT_SIZE_MB"),
+	)
+	if err != nil {
+		slog.Error("Invalid MAX_DOCUMENT_SIZE_MB", "error", err)
+		return nil, err
+	}
+
 	return cfg, nil
 }
 
+// Parse the maximum document size in MB, falling back to the default when it
+// isn't configured.
+func parseMaxDocumentSize(value string) (int64, error) {
+	if value == "" {
+		return DEFAULT_MAX_DOCUMENT_SIZE_MB * bytesPerMB, nil
+	}
+
+	sizeMB, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+
+	if sizeMB <= 0 {
+		return 0, fmt.Errorf("maximum document size must be positive: %d", sizeMB)
+	}
+
+	return sizeMB * bytesPerMB, nil
+}
+
+// Check the size Drive reported for the document against the limit. Documents
+// without a size are checked while they are read.
+func checkDocumentSize(size, maxSize int64) error {
+	if size > maxSize {
+		return &documentTooLargeError{size: size, maxSize: maxSize}
+	}
+
+	return nil
+}
+
 // Ensure that the configuration settings are only loaded once
 func initLambda(ctx context.Context) error {
 	var err error
@@ -77,6 +248,30 @@ func initLambda(ctx context.Context) error {
 	return err
 }
 
+// Drive does not report a size for exported Google documents, so in that case
+// the export is buffered to learn the length S3 needs for the upload. The
+// buffering stops once the export goes past the maximum size.
+func documentBody(
+	document *types.Document,
+	reader io.Reader,
+	maxSize int64,
+) (io.Reader, int64, error) {
+	if document.Size > 0 {
+		return reader, document.Size, nil
+	}
+
+	content, err := io.ReadAll(io.LimitReader(reader, maxSize+1))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if int64(len(content)) > maxSize {
+		return nil, 0, &documentTooLargeError{maxSize: maxSize}
+	}
+
+	return bytes.NewReader(content), int64(len(content)), nil
+}
+
 // TODO: doesn't feel right updating the stage in here
 func (cfg *handlerConfig) copyDocument(
 	ctx context.Context,
@@ -84,7 +279,7 @@ func (cfg *handlerConfig) copyDocument(
 	stage *types.DocumentProcessingStage,
 ) error {
 	// get a reader from Google Drive for the document
-	reader, err := cfg.dc.GetReader(document)
+	reader, err := cfg.dc.GetReader(ctx, document)
 	if err != nil {
 		slog.Error("Failed to get a reader for the document", "error", err)
 		return err
@@ -92,29 +287,65 @@ func (cfg *handlerConfig) copyDocument(
 
 	defer reader.Close()
 
+	download := &downloadReader{reader: reader}
+
+	// sniff the content type from the start of the stream without consuming it
+	bufferedReader := bufio.NewReaderSize(download, util.CONTENT_SNIFF_LENGTH)
+	header, err := bufferedReader.Peek(util.CONTENT_SNIFF_LENGTH)
+	if err != nil && err != io.EOF {
+		slog.Error(
+			"Failed to read the start of the document",
+			"docName",
+			document.Name,
+			"error",
+			err,
+		)
+		return err
+	}
+
+	stage.ContentType = util.DetectContentType(header, document.Name)
+
 	// get the name of the original document w/o extension
-	documentName := util.GetNamePart(document.Name)
+	documentName := util.DocumentBaseName(document)
 
 	// Save the original filename with the stage
 	stage.OriginalFileName = document.Name
 
-	// build the file name for the stage to have a timestamp
-	stage.StageFileName = fmt.Sprintf(
-		"%s-%d.pdf",
+	// build a unique file name for the stage
+	stage.StageFileName = util.StageFileName(
 		documentName,
-		time.Now().UTC().Unix(),
+		util.ExtensionForContentType(stage.ContentType, document.Name),
 	)
 
 	// construct the S3 Key for the file stage
 	stage.S3Key = fmt.Sprintf("%s/%s", stage.Stage, stage.StageFileName)
 
+	body, contentLength, err := documentBody(
+		document,
+		bufferedReader,
+		cfg.maxDocumentSize,
+	)
+	if err != nil {
+		slog.Error(
+			"Failed to read the document from Google Drive",
+			"docName",
+			document.Name,
+			"error",
+			err,
+		)
+		return err
+	}
+
+	// hash the content on the way to S3 to find copies of the document
+	hash := sha256.New()
+
 	// store the file for the stage
 	_, err = cfg.s3Client.PutObject(ctx, &s3.PutObjectInput{
 		Bucket:        aws.String(BucketName),
 		Key:           aws.String(stage.S3Key),
-		Body:          reader,
-		ContentType:   aws.String("application/pdf"),
-		ContentLength: aws.Int64(document.Size),
+		Body:          io.TeeReader(body, hash),
+		ContentType:   aws.String(stage.ContentType),
+		ContentLength: aws.Int64(contentLength),
 	})
 	if err != nil {
 		slog.Error(
@@ -124,9 +355,319 @@ func (cfg *handlerConfig) copyDocument(
 			"error",
 			err,
 		)
+
+		// report the Drive failure so it can be retried
+		if download.err != nil {
+			return download.err
+		}
+		return err
+	}
+
+	document.ContentHash = hex.EncodeToString(hash.Sum(nil))
+
+	return nil
+}
+
+// Copy the document, starting the download over when the connection drops
+// part way through the document. Getting the reader is retried by the Drive
+// client and isn't retried again here.
+func (cfg *handlerConfig) downloadDocument(
+	ctx context.Context,
+	document *types.Document,
+	stage *types.DocumentProcessingStage,
+) error {
+	return retry.Do(ctx, downloadRetryPolicy, "DownloadDocument", func() error {
+		return cfg.copyDocument(ctx, document, stage)
+	})
+}
+
+// End the document's processing with a terminal status recorded on both the
+// stage and, through the stage, the document.
+func (cfg *handlerConfig) endDocument(
+	ctx context.Context,
+	document *types.Document,
+	stage *types.DocumentProcessingStage,
+	status, code, reason string,
+) error {
+	err := cfg.store.FailDocumentStage(ctx, stage, status, code, reason)
+	if err != nil {
+		slog.Error(
+			"Failed to update the processing stage as failed",
+			"docName",
+			document.Name,
+			"error",
+			err,
+		)
+		return err
+	}
+
+	// the workflow ends without reaching the upload or failure stages, so
+	// the execution it was counted for is given back here
+	err = util.ReleaseExecutionSlot(ctx, cfg.store, cfg.counter, document)
+	if err != nil {
+		slog.Error(
+			"Failed to give back the execution of the document",
+			"docName",
+			document.Name,
+			"channelID",
+			document.ChannelID,
+			"error",
+			err,
+		)
+		return err
+	}
+
+	return nil
+}
+
+// Mark the document in error with the reason and return an error the workflow
+// recognizes so the rest of the stages are skipped. The source document is
+// left in place since it is only archived by the upload stage.
+func (cfg *handlerConfig) rejectDocument(
+	ctx context.Context,
+	document *types.Document,
+	stage *types.DocumentProcessingStage,
+	reason error,
+) error {
+	slog.Warn(
+		"Document is too large to process",
+		"docName",
+		document.Name,
+		"reason",
+		reason,
+	)
+
+	err := cfg.endDocument(
+		ctx,
+		document,
+		stage,
+		types.DOCUMENT_STATUS_ERROR,
+		errorsmap.CODE_DOCUMENT_TOO_LARGE,
+		reason.Error(),
+	)
+	if err != nil {
+		return err
+	}
+
+	return messages.InvokeResponse_Error{
+		Type:    types.DOCUMENT_ERROR_TOO_LARGE,
+		Message: fmt.Sprintf("%s: %s", document.Name, reason),
+	}
+}
+
+// Decide whether the note of an earlier document with the same content can
+// be reused. A document still being processed is waited on for a while
+// since copies are usually uploaded moments apart.
+func originalState(
+	downloaded *types.DocumentProcessingStage,
+	note *types.DocumentProcessingStage,
+	now time.Time,
+) int {
+	if note.StageStatus == types.DOCUMENT_STATUS_COMPLETE && note.S3Key != "" {
+		return originalReady
+	}
+
+	if downloaded.StageStatus == types.DOCUMENT_STATUS_ERROR ||
+		note.StageStatus == types.DOCUMENT_STATUS_ERROR {
+		return originalUnusable
+	}
+
+	if now.Sub(downloaded.StartedAt) < DUPLICATE_WAIT {
+		return originalPending
+	}
+
+	return originalUnusable
+}
+
+// Find an earlier document with the same content. The content hash is
+// recorded after it is looked up so that later copies find this document.
+func (cfg *handlerConfig) findOriginal(
+	ctx context.Context,
+	document *types.Document,
+) (*types.Document, error) {
+	original, err := cfg.store.GetDocumentByContentHash(ctx, document.ContentHash)
+	if err != nil && !errors.Is(err, database.ErrDocumentNotFound) {
+		return nil, err
+	}
+
+	err = cfg.store.UpdateDocumentContentHash(
+		ctx,
+		document.ID,
+		document.ContentHash,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if original == nil || original.ID == document.ID {
+		return nil, nil
+	}
+
+	return original, nil
+}
+
+// Return the note of the original when it can be reused, nil when it can't.
+// An original still being processed is reported with a DuplicatePending
+// error, which the workflow retries.
+func (cfg *handlerConfig) originalNote(
+	ctx context.Context,
+	document *types.Document,
+	original *types.Document,
+) (*types.DocumentProcessingStage, error) {
+	downloaded, err := cfg.store.GetDocumentStage(
+		ctx,
+		original.ID,
+		types.DOCUMENT_STAGE_DOWNLOAD,
+	)
+	if err != nil && !errors.Is(err, database.ErrStageNotFound) {
+		return nil, err
+	}
+
+	// the stages the original didn't get to yet have no record
+	note, err := cfg.store.GetDocumentStage(
+		ctx,
+		original.ID,
+		types.DOCUMENT_STAGE_OPENAI,
+	)
+	if err != nil && !errors.Is(err, database.ErrStageNotFound) {
+		return nil, err
+	}
+
+	switch originalState(downloaded, note, time.Now().UTC()) {
+	case originalReady:
+		return note, nil
+	case originalPending:
+		return nil, messages.InvokeResponse_Error{
+			Type: types.DOCUMENT_ERROR_DUPLICATE_PENDING,
+			Message: fmt.Sprintf(
+				"%s: waiting for %s with the same content to finish",
+				document.Name,
+				original.Name,
+			),
+		}
+	}
+
+	return nil, nil
+}
+
+// Reuse the note of the original when it is ready. The step is the one to
+// continue the workflow with.
+func (cfg *handlerConfig) dedupeDocument(
+	ctx context.Context,
+	ret types.DocumentStep,
+	document *types.Document,
+	original *types.Document,
+) (types.DocumentStep, error) {
+	note, err := cfg.originalNote(ctx, document, original)
+	if err != nil {
+		return types.DocumentStep{}, err
+	}
+
+	if note == nil {
+		ret.Stage = types.DOCUMENT_STAGE_DOWNLOAD
+		ret.Status = types.DOCUMENT_STATUS_COMPLETE
+		return ret, nil
+	}
+
+	err = cfg.reuseOriginal(ctx, document, original, note)
+	if err != nil {
+		slog.Error(
+			"Failed to reuse the note of the original document",
+			"docName",
+			document.Name,
+			"originalID",
+			original.ID,
+			"error",
+			err,
+		)
+		return types.DocumentStep{}, err
+	}
+
+	ret.Stage = types.DOCUMENT_STAGE_OPENAI
+	ret.Status = types.DOCUMENT_STATUS_DUPLICATE
+	return ret, nil
+}
+
+// Check again on the original a downloaded document is waiting on. The
+// workflow retries the check while the original is still being processed,
+// the document isn't downloaded again.
+func (cfg *handlerConfig) awaitOriginal(
+	ctx context.Context,
+	event types.DocumentStep,
+) (types.DocumentStep, error) {
+	document, err := cfg.store.GetDocument(ctx, event.DocumentID)
+	if err != nil {
+		return types.DocumentStep{}, err
+	}
+
+	// a newer revision of the file replaced the document while it waited
+	if err := util.SupersededError(document); err != nil {
+		return types.DocumentStep{}, err
+	}
+
+	original, err := cfg.store.GetDocument(ctx, event.DuplicateOf)
+	if err != nil {
+		return types.DocumentStep{}, err
+	}
+
+	ret := event
+	ret.DuplicateOf = ""
+
+	ret, err = cfg.dedupeDocument(ctx, ret, document, original)
+
+	var pending messages.InvokeResponse_Error
+	if errors.As(err, &pending) {
+		slog.Info("Waiting on a document with the same content", "reason", pending.Message)
+	}
+
+	return ret, err
+}
+
+// Reuse the note of the original for the document. The document gets its own
+// cleanup stage pointing at the note of the original so the upload stage can
+// publish it under the document's name.
+func (cfg *handlerConfig) reuseOriginal(
+	ctx context.Context,
+	document *types.Document,
+	original *types.Document,
+	note *types.DocumentProcessingStage,
+) error {
+	slog.Info(
+		"Document has the same content as one already processed",
+		"docName",
+		document.Name,
+		"originalID",
+		original.ID,
+		"originalName",
+		original.Name,
+	)
+
+	stage, err := cfg.store.StartDocumentStage(
+		ctx,
+		document.ID,
+		types.DOCUMENT_STAGE_OPENAI,
+		document.Name,
+	)
+	if err != nil {
 		return err
 	}
 
+	stage.StageFileName = note.StageFileName
+	stage.S3Key = note.S3Key
+	stage.ContentType = note.ContentType
+
+	err = cfg.store.CompleteDocumentStage(ctx, stage)
+	if err != nil {
+		return err
+	}
+
+	err = cfg.store.MarkDocumentDuplicate(ctx, document.ID, original.ID)
+	if err != nil {
+		return err
+	}
+
+	metrics.Record(metrics.DUPLICATE_DOCUMENTS, 1, nil)
+
 	return nil
 }
 
@@ -139,6 +680,12 @@ func process(
 
 	ret := types.DocumentStep{}
 
+	// a malformed input fails here rather than as a missing stage
+	if err := util.ValidateStep(event); err != nil {
+		slog.Error("Invalid step input", "error", err)
+		return ret, err
+	}
+
 	var err error
 
 	if err := initLambda(ctx); err != nil {
@@ -146,6 +693,19 @@ func process(
 		return ret, err
 	}
 
+	// a downloaded document waiting on its original is checked again
+	if event.Stage == types.DOCUMENT_STAGE_DOWNLOAD &&
+		event.Status == types.DOCUMENT_STATUS_DUPLICATE_PENDING &&
+		event.DuplicateOf != "" {
+		return cfg.awaitOriginal(ctx, event)
+	}
+
+	// documents from Drive enter the workflow here, only their pending
+	// download stage was recorded so there is no earlier stage to read
+	if event.Stage != types.DOCUMENT_STAGE_NEW {
+		return ret, fmt.Errorf("the download can't start after the %q stage", event.Stage)
+	}
+
 	// Query the document from Google Drive
 	document, err := cfg.store.GetDocument(ctx, event.DocumentID)
 	if err != nil {
@@ -159,8 +719,13 @@ func process(
 		return ret, err
 	}
 
-	// create the download stage entry
-	stage, err := cfg.store.StartDocumentStage(
+	// a newer revision of the file replaced the document before it started
+	if err := util.SupersededError(document); err != nil {
+		return ret, err
+	}
+
+	// start the download stage saved with the document
+	stage, err := cfg.store.StartPendingDocumentStage(
 		ctx,
 		document.ID,
 		types.DOCUMENT_STAGE_DOWNLOAD,
@@ -177,10 +742,69 @@ func process(
 		return ret, err
 	}
 
-	// copy the original document to S3
-	err = cfg.copyDocument(ctx, document, stage)
+	// reject documents over the size limit before anything is downloaded
+	err = checkDocumentSize(document.Size, cfg.maxDocumentSize)
+	if err == nil {
+		// copy the original document to S3
+		err = cfg.downloadDocument(ctx, document, stage)
+	}
+
+	var tooLarge *documentTooLargeError
+	if errors.As(err, &tooLarge) {
+		return ret, cfg.rejectDocument(ctx, document, stage, tooLarge)
+	}
+
+	ret.NotificationID = event.NotificationID
+	ret.ChannelID = event.ChannelID
+	ret.DocumentID = document.ID
+	ret.Stage = types.DOCUMENT_STAGE_DOWNLOAD
+
+	// the file was deleted or moved before we got to it, there is nothing
+	// to retry so end the workflow without failing it
+	if google.IsNotFoundError(err) {
+		slog.Warn(
+			"Document is no longer in Google Drive",
+			"docName",
+			document.Name,
+			"googleID",
+			document.GoogleID,
+		)
+
+		err = cfg.endDocument(
+			ctx,
+			document,
+			stage,
+			types.DOCUMENT_STATUS_SOURCE_MISSING,
+			errorsmap.CODE_SOURCE_MISSING,
+			err.Error(),
+		)
+		if err != nil {
+			return types.DocumentStep{}, err
+		}
+
+		ret.Status = types.DOCUMENT_STATUS_SOURCE_MISSING
+		return ret, nil
+	}
+
 	if err != nil {
-		return ret, err
+		// record why the stage failed so it can be explained later
+		failErr := cfg.store.FailDocumentStage(
+			ctx,
+			stage,
+			types.DOCUMENT_STATUS_ERROR,
+			errorsmap.Classify(err),
+			err.Error(),
+		)
+		if failErr != nil {
+			slog.Error(
+				"Failed to update the processing stage as failed",
+				"docName",
+				document.Name,
+				"error",
+				failErr,
+			)
+		}
+		return types.DocumentStep{}, util.StageError(stage, err)
 	}
 
 	err = cfg.store.CompleteDocumentStage(ctx, stage)
@@ -192,12 +816,52 @@ func process(
 			"error",
 			err,
 		)
-		return ret, err
+		return types.DocumentStep{}, err
 	}
 
-	ret.NotificationID = event.NotificationID
-	ret.DocumentID = document.ID
-	ret.Stage = types.DOCUMENT_STAGE_DOWNLOAD
+	// skip the OCR and clean up when the same content was already processed
+	original, err := cfg.findOriginal(ctx, document)
+	if err != nil {
+		slog.Error(
+			"Failed to check for a document with the same content",
+			"docName",
+			document.Name,
+			"error",
+			err,
+		)
+		return types.DocumentStep{}, err
+	}
+
+	if original != nil {
+		dedupe, err := cfg.dedupeDocument(ctx, ret, document, original)
+
+		// the download is done, the workflow waits on the original in a
+		// step of its own so the document isn't downloaded again
+		var pending messages.InvokeResponse_Error
+		if errors.As(err, &pending) {
+			slog.Info("Waiting on a document with the same content", "reason", pending.Message)
+
+			ret.Status = types.DOCUMENT_STATUS_DUPLICATE_PENDING
+			ret.DuplicateOf = original.ID
+			return ret, nil
+		}
+		if err != nil {
+			slog.Error(
+				"Failed to check the document with the same content",
+				"docName",
+				document.Name,
+				"originalID",
+				original.ID,
+				"error",
+				err,
+			)
+			return types.DocumentStep{}, err
+		}
+
+		return dedupe, nil
+	}
+
+	ret.Status = types.DOCUMENT_STATUS_COMPLETE
 
 	return ret, nil
 }
@@ -0,0 +1,989 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/KyleBrandon/scriptor/lambdas/util"
+	"github.com/KyleBrandon/scriptor/pkg/database"
+	"github.com/KyleBrandon/scriptor/pkg/errorsmap"
+	"github.com/KyleBrandon/scriptor/pkg/google"
+	"github.com/KyleBrandon/scriptor/pkg/google/googletest"
+	"github.com/KyleBrandon/scriptor/pkg/types"
+	"github.com/aws/aws-lambda-go/lambda/messages"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/googleapi"
+)
+
+func TestParseMaxDocumentSize(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    int64
+		wantErr bool
+	}{
+		{name: "default", value: "", want: DEFAULT_MAX_DOCUMENT_SIZE_MB * bytesPerMB},
+		{name: "configured", value: "50", want: 50 * bytesPerMB},
+		{name: "not a number", value: "big", wantErr: true},
+		{name: "zero", value: "0", wantErr: true},
+		{name: "negative", value: "-1", wantErr: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := parseMaxDocumentSize(tc.value)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("unexpected error: got %v want error %v", err, tc.wantErr)
+			}
+
+			if got != tc.want {
+				t.Fatalf("unexpected size: got %d want %d", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestCheckDocumentSize(t *testing.T) {
+	maxSize := int64(200 * bytesPerMB)
+
+	tests := []struct {
+		name    string
+		size    int64
+		wantErr bool
+	}{
+		{name: "unknown size", size: 0},
+		{name: "below the limit", size: maxSize - 1},
+		{name: "at the limit", size: maxSize},
+		{name: "one byte over the limit", size: maxSize + 1, wantErr: true},
+		{name: "far over the limit", size: 1536 * bytesPerMB, wantErr: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := checkDocumentSize(tc.size, maxSize)
+
+			var tooLarge *documentTooLargeError
+			if errors.As(err, &tooLarge) != tc.wantErr {
+				t.Fatalf("unexpected error: got %v want error %v", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestDocumentTooLargeReason(t *testing.T) {
+	err := checkDocumentSize(1536*bytesPerMB, 200*bytesPerMB)
+
+	want := "document is 1536.0 MB which exceeds the maximum size of 200.0 MB"
+	if err.Error() != want {
+		t.Fatalf("unexpected reason: got %q want %q", err.Error(), want)
+	}
+}
+
+func TestDocumentBodyLimitsUnknownSize(t *testing.T) {
+	maxSize := int64(16)
+
+	tests := []struct {
+		name    string
+		length  int
+		wantErr bool
+	}{
+		{name: "below the limit", length: 15},
+		{name: "at the limit", length: 16},
+		{name: "over the limit", length: 17, wantErr: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			content := bytes.Repeat([]byte("a"), tc.length)
+
+			body, length, err := documentBody(
+				&types.Document{},
+				bytes.NewReader(content),
+				maxSize,
+			)
+
+			var tooLarge *documentTooLargeError
+			if errors.As(err, &tooLarge) != tc.wantErr {
+				t.Fatalf("unexpected error: got %v want error %v", err, tc.wantErr)
+			}
+
+			if tc.wantErr {
+				return
+			}
+
+			if length != int64(tc.length) {
+				t.Fatalf("unexpected length: got %d want %d", length, tc.length)
+			}
+
+			got, _ := io.ReadAll(body)
+			if !bytes.Equal(got, content) {
+				t.Fatalf("unexpected body: got %q", got)
+			}
+		})
+	}
+}
+
+type (
+	// Returns the next reader or error for each download attempt
+	fakeDrive struct {
+		attempts []func() (io.ReadCloser, error)
+		calls    int
+	}
+
+	fakePutter struct {
+		content       []byte
+		contentLength int64
+		contentType   string
+	}
+
+	// Fails part way through the document like a reset connection
+	failingReader struct {
+		content []byte
+		err     error
+	}
+)
+
+func (d *fakeDrive) GetReader(ctx context.Context, document *types.Document) (io.ReadCloser, error) {
+	attempt := d.attempts[d.calls]
+	d.calls++
+	return attempt()
+}
+
+func (p *fakePutter) PutObject(
+	ctx context.Context,
+	params *s3.PutObjectInput,
+	optFns ...func(*s3.Options),
+) (*s3.PutObjectOutput, error) {
+	content, err := io.ReadAll(params.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send the request body: %w", err)
+	}
+
+	p.content = content
+	p.contentLength = aws.ToInt64(params.ContentLength)
+	p.contentType = aws.ToString(params.ContentType)
+	return &s3.PutObjectOutput{}, nil
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	if len(r.content) == 0 {
+		return 0, r.err
+	}
+
+	n := copy(p, r.content)
+	r.content = r.content[n:]
+	return n, nil
+}
+
+func TestDownloadDocumentRetries(t *testing.T) {
+	downloadRetryPolicy.InitialBackoff = 0
+	downloadRetryPolicy.MaxBackoff = 0
+
+	content := []byte("%PDF-1.7\n" + strings.Repeat("a", 4096))
+
+	succeed := func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(content)), nil
+	}
+	apiError := func(code int) func() (io.ReadCloser, error) {
+		return func() (io.ReadCloser, error) {
+			return nil, &googleapi.Error{Code: code}
+		}
+	}
+	resetMidStream := func() (io.ReadCloser, error) {
+		return io.NopCloser(&failingReader{
+			content: content[:1024],
+			err:     syscall.ECONNRESET,
+		}), nil
+	}
+
+	tests := []struct {
+		name      string
+		attempts  []func() (io.ReadCloser, error)
+		wantErr   bool
+		wantCalls int
+	}{
+		{
+			name:      "first attempt succeeds",
+			attempts:  []func() (io.ReadCloser, error){succeed},
+			wantCalls: 1,
+		},
+		{
+			// the Drive client already retried getting the reader
+			name: "server error is not retried again",
+			attempts: []func() (io.ReadCloser, error){
+				apiError(http.StatusInternalServerError),
+				succeed,
+			},
+			wantErr:   true,
+			wantCalls: 1,
+		},
+		{
+			name: "rate limit is not retried again",
+			attempts: []func() (io.ReadCloser, error){
+				apiError(http.StatusTooManyRequests),
+				succeed,
+			},
+			wantErr:   true,
+			wantCalls: 1,
+		},
+		{
+			name: "reset mid-stream restarts the download",
+			attempts: []func() (io.ReadCloser, error){
+				resetMidStream,
+				succeed,
+			},
+			wantCalls: 2,
+		},
+		{
+			name: "forbidden is not retried",
+			attempts: []func() (io.ReadCloser, error){
+				apiError(http.StatusForbidden),
+			},
+			wantErr:   true,
+			wantCalls: 1,
+		},
+		{
+			name: "not found is not retried",
+			attempts: []func() (io.ReadCloser, error){
+				apiError(http.StatusNotFound),
+			},
+			wantErr:   true,
+			wantCalls: 1,
+		},
+		{
+			name: "gives up after the last attempt",
+			attempts: []func() (io.ReadCloser, error){
+				resetMidStream,
+				resetMidStream,
+				resetMidStream,
+			},
+			wantErr:   true,
+			wantCalls: DOWNLOAD_ATTEMPTS,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			drive := &fakeDrive{attempts: tc.attempts}
+			putter := &fakePutter{}
+			cfg := &handlerConfig{
+				dc:              drive,
+				s3Client:        putter,
+				maxDocumentSize: DEFAULT_MAX_DOCUMENT_SIZE_MB * bytesPerMB,
+			}
+
+			err := cfg.downloadDocument(
+				context.Background(),
+				&types.Document{
+					GoogleID: "file-1",
+					Name:     "scan.pdf",
+					Size:     int64(len(content)),
+				},
+				&types.DocumentProcessingStage{Stage: types.DOCUMENT_STAGE_DOWNLOAD},
+			)
+
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("unexpected error: got %v want error %v", err, tc.wantErr)
+			}
+
+			if drive.calls != tc.wantCalls {
+				t.Fatalf("unexpected attempts: got %d want %d", drive.calls, tc.wantCalls)
+			}
+
+			if !tc.wantErr && !bytes.Equal(putter.content, content) {
+				t.Fatalf("stored content doesn't match the document")
+			}
+		})
+	}
+}
+
+func TestCopyDocumentFromDrive(t *testing.T) {
+	pdf := []byte("%PDF-1.7\n" + strings.Repeat("a", 64))
+
+	tests := []struct {
+		name     string
+		file     *drive.File
+		document *types.Document
+		maxSize  int64
+
+		wantCall   string
+		wantExport string
+		wantErr    bool
+	}{
+		{
+			name:     "uploaded PDF is downloaded",
+			file:     &drive.File{Id: "file-1", Name: "scan.pdf", MimeType: types.CONTENT_TYPE_PDF},
+			document: &types.Document{GoogleID: "file-1", Name: "scan.pdf", MimeType: types.CONTENT_TYPE_PDF, Size: int64(len(pdf))},
+			wantCall: "Files.Download file-1",
+		},
+		{
+			// Drive reports no size for a Google Doc, the export is
+			// buffered to learn its length
+			name:       "Google Doc is exported as a PDF",
+			file:       &drive.File{Id: "file-1", Name: "notes", MimeType: types.CONTENT_TYPE_GOOGLE_DOC},
+			document:   &types.Document{GoogleID: "file-1", Name: "notes", MimeType: types.CONTENT_TYPE_GOOGLE_DOC},
+			wantCall:   "Files.Export file-1",
+			wantExport: google.GOOGLE_EXPORT_MIME_TYPE,
+		},
+		{
+			name:       "export larger than the maximum size",
+			file:       &drive.File{Id: "file-1", Name: "notes", MimeType: types.CONTENT_TYPE_GOOGLE_DOC},
+			document:   &types.Document{GoogleID: "file-1", Name: "notes", MimeType: types.CONTENT_TYPE_GOOGLE_DOC},
+			maxSize:    int64(len(pdf)) - 1,
+			wantCall:   "Files.Export file-1",
+			wantExport: google.GOOGLE_EXPORT_MIME_TYPE,
+			wantErr:    true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			fake := googletest.NewDrive()
+			fake.AddFile(tc.file, pdf)
+
+			if tc.maxSize == 0 {
+				tc.maxSize = DEFAULT_MAX_DOCUMENT_SIZE_MB * bytesPerMB
+			}
+
+			putter := &fakePutter{}
+			cfg := &handlerConfig{
+				dc:              google.NewGoogleDriveFromAPI(fake.API()),
+				s3Client:        putter,
+				maxDocumentSize: tc.maxSize,
+			}
+
+			stage := &types.DocumentProcessingStage{Stage: types.DOCUMENT_STAGE_DOWNLOAD}
+			err := cfg.copyDocument(context.Background(), tc.document, stage)
+
+			var tooLarge *documentTooLargeError
+			if errors.As(err, &tooLarge) != tc.wantErr {
+				t.Fatalf("unexpected error: got %v want error %v", err, tc.wantErr)
+			}
+
+			if !slices.Equal(fake.Calls, []string{tc.wantCall}) {
+				t.Fatalf("unexpected Drive calls: %v", fake.Calls)
+			}
+
+			if fake.Exports["file-1"] != tc.wantExport {
+				t.Fatalf("unexpected export: got %q want %q", fake.Exports["file-1"], tc.wantExport)
+			}
+
+			if tc.wantErr {
+				return
+			}
+
+			if !bytes.Equal(putter.content, pdf) || putter.contentLength != int64(len(pdf)) {
+				t.Fatalf("unexpected body of %d bytes: %q", putter.contentLength, putter.content)
+			}
+
+			if putter.contentType != types.CONTENT_TYPE_PDF ||
+				stage.ContentType != types.CONTENT_TYPE_PDF ||
+				!strings.HasSuffix(stage.S3Key, ".pdf") {
+				t.Fatalf("unexpected stage: %+v", stage)
+			}
+		})
+	}
+}
+
+// Records the status changes made by the download stage
+type fakeStore struct {
+	database.DocumentStore
+
+	document       *types.Document
+	stages         map[types.Stage]*types.DocumentProcessingStage
+	documentStatus string
+	contentHash    string
+	duplicateOf    string
+
+	// earlier document with the same content
+	original       *types.Document
+	originalStages map[types.Stage]*types.DocumentProcessingStage
+
+	// the document was counted against the execution limit of its channel
+	held bool
+}
+
+func (s *fakeStore) GetDocument(ctx context.Context, id string) (*types.Document, error) {
+	if s.original != nil && id == s.original.ID {
+		return s.original, nil
+	}
+
+	return s.document, nil
+}
+
+func (s *fakeStore) GetDocumentByContentHash(
+	ctx context.Context,
+	contentHash string,
+) (*types.Document, error) {
+	if s.original == nil {
+		return nil, database.ErrDocumentNotFound
+	}
+
+	return s.original, nil
+}
+
+func (s *fakeStore) GetDocumentStage(
+	ctx context.Context,
+	id string,
+	stage types.Stage,
+) (*types.DocumentProcessingStage, error) {
+	if docStage, ok := s.originalStages[stage]; ok && id == s.original.ID {
+		return docStage, nil
+	}
+
+	return &types.DocumentProcessingStage{}, nil
+}
+
+func (s *fakeStore) StartDocumentStage(
+	ctx context.Context,
+	id string,
+	stage types.Stage,
+	originalFileName string,
+) (*types.DocumentProcessingStage, error) {
+	if s.stages == nil {
+		s.stages = make(map[types.Stage]*types.DocumentProcessingStage)
+	}
+
+	s.stages[stage] = &types.DocumentProcessingStage{
+		ID:          id,
+		Stage:       stage,
+		StageStatus: types.DOCUMENT_STATUS_INPROGRESS,
+	}
+	return s.stages[stage], nil
+}
+
+func (s *fakeStore) StartPendingDocumentStage(
+	ctx context.Context,
+	id string,
+	stage types.Stage,
+	originalFileName string,
+) (*types.DocumentProcessingStage, error) {
+	return s.StartDocumentStage(ctx, id, stage, originalFileName)
+}
+
+func (s *fakeStore) CompleteDocumentStage(
+	ctx context.Context,
+	stage *types.DocumentProcessingStage,
+) error {
+	stage.StageStatus = types.DOCUMENT_STATUS_COMPLETE
+	return nil
+}
+
+func (s *fakeStore) FailDocumentStage(
+	ctx context.Context,
+	stage *types.DocumentProcessingStage,
+	status string,
+	code string,
+	reason string,
+) error {
+	stage.StageStatus = status
+	stage.ErrorCode = code
+	stage.ErrorReason = reason
+
+	// the store rolls the status of the stage up to the document
+	s.documentStatus = status
+	return nil
+}
+
+func (s *fakeStore) UpdateDocumentContentHash(
+	ctx context.Context,
+	id string,
+	contentHash string,
+) error {
+	s.contentHash = contentHash
+	return nil
+}
+
+func (s *fakeStore) MarkDocumentDuplicate(
+	ctx context.Context,
+	id string,
+	originalID string,
+) error {
+	s.duplicateOf = originalID
+	return nil
+}
+
+func (s *fakeStore) ReleaseExecutionSlot(ctx context.Context, id string) (bool, error) {
+	held := s.held
+	s.held = false
+	return held, nil
+}
+
+type fakeCounter struct {
+	util.ExecutionCounter
+	released []string
+}
+
+func (c *fakeCounter) DecrementActiveExecutions(ctx context.Context, channelID string) error {
+	c.released = append(c.released, channelID)
+	return nil
+}
+
+func TestProcessDocumentStatus(t *testing.T) {
+	// skip loading the AWS configuration
+	initOnce.Do(func() {})
+
+	downloadRetryPolicy.InitialBackoff = 0
+	downloadRetryPolicy.MaxBackoff = 0
+
+	tests := []struct {
+		name               string
+		size               int64
+		attempt            func() (io.ReadCloser, error)
+		wantErr            bool
+		wantStatus         string
+		wantStageStatus    string
+		wantCode           string
+		wantDocumentStatus string
+		wantReleased       bool
+	}{
+		{
+			name: "downloaded",
+			size: 9,
+			attempt: func() (io.ReadCloser, error) {
+				return io.NopCloser(strings.NewReader("%PDF-1.7\n")), nil
+			},
+			wantStatus:      types.DOCUMENT_STATUS_COMPLETE,
+			wantStageStatus: types.DOCUMENT_STATUS_COMPLETE,
+		},
+		{
+			name: "deleted from drive",
+			size: 9,
+			attempt: func() (io.ReadCloser, error) {
+				return nil, &googleapi.Error{Code: http.StatusNotFound}
+			},
+			wantStatus:         types.DOCUMENT_STATUS_SOURCE_MISSING,
+			wantStageStatus:    types.DOCUMENT_STATUS_SOURCE_MISSING,
+			wantCode:           errorsmap.CODE_SOURCE_MISSING,
+			wantDocumentStatus: types.DOCUMENT_STATUS_SOURCE_MISSING,
+			wantReleased:       true,
+		},
+		{
+			name: "access denied",
+			size: 9,
+			attempt: func() (io.ReadCloser, error) {
+				return nil, &googleapi.Error{Code: http.StatusForbidden}
+			},
+			wantErr:            true,
+			wantStageStatus:    types.DOCUMENT_STATUS_ERROR,
+			wantDocumentStatus: types.DOCUMENT_STATUS_ERROR,
+			wantCode:           errorsmap.CODE_DRIVE_ACCESS_DENIED,
+		},
+		{
+			name:               "too large",
+			size:               DEFAULT_MAX_DOCUMENT_SIZE_MB*bytesPerMB + 1,
+			wantErr:            true,
+			wantStageStatus:    types.DOCUMENT_STATUS_ERROR,
+			wantCode:           errorsmap.CODE_DOCUMENT_TOO_LARGE,
+			wantDocumentStatus: types.DOCUMENT_STATUS_ERROR,
+			wantReleased:       true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			store := &fakeStore{
+				document: &types.Document{
+					ID:        "doc-1",
+					GoogleID:  "file-1",
+					Name:      "scan.pdf",
+					Size:      tc.size,
+					ChannelID: "channel-1",
+				},
+				held: true,
+			}
+			counter := &fakeCounter{}
+			cfg = &handlerConfig{
+				store:           store,
+				counter:         counter,
+				dc:              &fakeDrive{attempts: []func() (io.ReadCloser, error){tc.attempt}},
+				s3Client:        &fakePutter{},
+				maxDocumentSize: DEFAULT_MAX_DOCUMENT_SIZE_MB * bytesPerMB,
+			}
+
+			got, err := process(context.Background(), types.DocumentStep{
+				ChannelID:  "channel-1",
+				DocumentID: "doc-1",
+				Stage:      types.DOCUMENT_STAGE_NEW,
+			})
+
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("unexpected error: got %v want error %v", err, tc.wantErr)
+			}
+
+			if got.Status != tc.wantStatus {
+				t.Fatalf("unexpected step status: got %q want %q", got.Status, tc.wantStatus)
+			}
+
+			// the channel is passed along to the next stage
+			if !tc.wantErr && got.ChannelID != "channel-1" {
+				t.Fatalf("unexpected channel: %q", got.ChannelID)
+			}
+
+			stage := store.stages[types.DOCUMENT_STAGE_DOWNLOAD]
+			if stage.StageStatus != tc.wantStageStatus {
+				t.Fatalf("unexpected stage status: got %q want %q", stage.StageStatus, tc.wantStageStatus)
+			}
+
+			if stage.ErrorCode != tc.wantCode {
+				t.Fatalf("unexpected error code: got %q want %q", stage.ErrorCode, tc.wantCode)
+			}
+
+			if store.documentStatus != tc.wantDocumentStatus {
+				t.Fatalf("unexpected document status: got %q want %q", store.documentStatus, tc.wantDocumentStatus)
+			}
+
+			// the workflow ends here, so the execution is given back
+			if released := len(counter.released) == 1; released != tc.wantReleased {
+				t.Fatalf("unexpected release: got %q want released %v", counter.released, tc.wantReleased)
+			}
+		})
+	}
+}
+
+func TestProcessOnlyStartsNewDocuments(t *testing.T) {
+	// skip loading the AWS configuration
+	initOnce.Do(func() {})
+
+	store := &fakeStore{document: &types.Document{ID: "doc-1", Name: "scan.pdf"}}
+	cfg = &handlerConfig{store: store, dc: &fakeDrive{}, s3Client: &fakePutter{}}
+
+	_, err := process(context.Background(), types.DocumentStep{
+		DocumentID: "doc-1",
+		Stage:      types.DOCUMENT_STAGE_DOWNLOAD,
+	})
+	if err == nil {
+		t.Fatal("expected an error for a document that was already downloaded")
+	}
+
+	if len(store.stages) != 0 {
+		t.Fatalf("unexpected stages started: %v", store.stages)
+	}
+}
+
+func TestOriginalState(t *testing.T) {
+	now := time.Date(2026, 3, 11, 23, 30, 0, 0, time.UTC)
+
+	tests := []struct {
+		name       string
+		downloaded types.DocumentProcessingStage
+		note       types.DocumentProcessingStage
+		want       int
+	}{
+		{
+			name: "note is ready",
+			downloaded: types.DocumentProcessingStage{
+				StageStatus: types.DOCUMENT_STATUS_COMPLETE,
+				StartedAt:   now.Add(-time.Hour),
+			},
+			note: types.DocumentProcessingStage{
+				StageStatus: types.DOCUMENT_STATUS_COMPLETE,
+				S3Key:       "openai/scan-1.md",
+			},
+			want: originalReady,
+		},
+		{
+			name: "still processing",
+			downloaded: types.DocumentProcessingStage{
+				StageStatus: types.DOCUMENT_STATUS_COMPLETE,
+				StartedAt:   now.Add(-time.Minute),
+			},
+			note: types.DocumentProcessingStage{
+				StageStatus: types.DOCUMENT_STATUS_INPROGRESS,
+			},
+			want: originalPending,
+		},
+		{
+			name: "still downloading",
+			downloaded: types.DocumentProcessingStage{
+				StageStatus: types.DOCUMENT_STATUS_INPROGRESS,
+				StartedAt:   now.Add(-time.Second),
+			},
+			want: originalPending,
+		},
+		{
+			name: "waited long enough",
+			downloaded: types.DocumentProcessingStage{
+				StageStatus: types.DOCUMENT_STATUS_COMPLETE,
+				StartedAt:   now.Add(-DUPLICATE_WAIT),
+			},
+			note: types.DocumentProcessingStage{
+				StageStatus: types.DOCUMENT_STATUS_INPROGRESS,
+			},
+			want: originalUnusable,
+		},
+		{
+			name: "original failed",
+			downloaded: types.DocumentProcessingStage{
+				StageStatus: types.DOCUMENT_STATUS_COMPLETE,
+				StartedAt:   now.Add(-time.Minute),
+			},
+			note: types.DocumentProcessingStage{
+				StageStatus: types.DOCUMENT_STATUS_ERROR,
+			},
+			want: originalUnusable,
+		},
+		{
+			name: "original download failed",
+			downloaded: types.DocumentProcessingStage{
+				StageStatus: types.DOCUMENT_STATUS_ERROR,
+				StartedAt:   now.Add(-time.Minute),
+			},
+			want: originalUnusable,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got := originalState(&tc.downloaded, &tc.note, now)
+			if got != tc.want {
+				t.Fatalf("unexpected state: got %d want %d", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestProcessDuplicateContent(t *testing.T) {
+	initOnce.Do(func() {})
+
+	content := "%PDF-1.7\n"
+	hash := sha256.Sum256([]byte(content))
+
+	tests := []struct {
+		name        string
+		noteStage   *types.DocumentProcessingStage
+		wantErrType string
+		wantStage   types.Stage
+		wantStatus  string
+		wantDupOf   string
+		wantWaitOn  string
+	}{
+		{
+			name: "note of the original is reused",
+			noteStage: &types.DocumentProcessingStage{
+				StageStatus:   types.DOCUMENT_STATUS_COMPLETE,
+				StageFileName: "scan-1.md",
+				S3Key:         "openai/scan-1.md",
+			},
+			wantStage:  types.DOCUMENT_STAGE_OPENAI,
+			wantStatus: types.DOCUMENT_STATUS_DUPLICATE,
+			wantDupOf:  "doc-1",
+		},
+		{
+			name: "original is still processing",
+			noteStage: &types.DocumentProcessingStage{
+				StageStatus: types.DOCUMENT_STATUS_INPROGRESS,
+			},
+			wantStage:  types.DOCUMENT_STAGE_DOWNLOAD,
+			wantStatus: types.DOCUMENT_STATUS_DUPLICATE_PENDING,
+			wantWaitOn: "doc-1",
+		},
+		{
+			name: "original failed",
+			noteStage: &types.DocumentProcessingStage{
+				StageStatus: types.DOCUMENT_STATUS_ERROR,
+			},
+			wantStage:  types.DOCUMENT_STAGE_DOWNLOAD,
+			wantStatus: types.DOCUMENT_STATUS_COMPLETE,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			store := &fakeStore{
+				document: &types.Document{
+					ID:       "doc-2",
+					GoogleID: "file-2",
+					Name:     "scan (1).pdf",
+					Size:     int64(len(content)),
+				},
+				original: &types.Document{
+					ID:   "doc-1",
+					Name: "scan.pdf",
+				},
+				originalStages: map[types.Stage]*types.DocumentProcessingStage{
+					types.DOCUMENT_STAGE_DOWNLOAD: {
+						StageStatus: types.DOCUMENT_STATUS_COMPLETE,
+						StartedAt:   time.Now().UTC(),
+					},
+					types.DOCUMENT_STAGE_OPENAI: tc.noteStage,
+				},
+			}
+			cfg = &handlerConfig{
+				store: store,
+				dc: &fakeDrive{attempts: []func() (io.ReadCloser, error){
+					func() (io.ReadCloser, error) {
+						return io.NopCloser(strings.NewReader(content)), nil
+					},
+				}},
+				s3Client:        &fakePutter{},
+				maxDocumentSize: DEFAULT_MAX_DOCUMENT_SIZE_MB * bytesPerMB,
+			}
+
+			got, err := process(context.Background(), types.DocumentStep{
+				DocumentID: "doc-2",
+				Stage:      types.DOCUMENT_STAGE_NEW,
+			})
+
+			if store.contentHash != hex.EncodeToString(hash[:]) {
+				t.Fatalf("unexpected content hash: %q", store.contentHash)
+			}
+
+			if tc.wantErrType != "" {
+				var invokeErr messages.InvokeResponse_Error
+				if !errors.As(err, &invokeErr) || invokeErr.Type != tc.wantErrType {
+					t.Fatalf("unexpected error: got %v want %s", err, tc.wantErrType)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if got.Stage != tc.wantStage || got.Status != tc.wantStatus {
+				t.Fatalf(
+					"unexpected step: got %s/%s want %s/%s",
+					got.Stage,
+					got.Status,
+					tc.wantStage,
+					tc.wantStatus,
+				)
+			}
+
+			if got.DuplicateOf != tc.wantWaitOn {
+				t.Fatalf("unexpected original waited on: got %q want %q", got.DuplicateOf, tc.wantWaitOn)
+			}
+
+			if store.duplicateOf != tc.wantDupOf {
+				t.Fatalf("unexpected duplicate of: got %q want %q", store.duplicateOf, tc.wantDupOf)
+			}
+
+			if tc.wantDupOf != "" {
+				note := store.stages[types.DOCUMENT_STAGE_OPENAI]
+				if note.S3Key != tc.noteStage.S3Key ||
+					note.StageStatus != types.DOCUMENT_STATUS_COMPLETE {
+					t.Fatalf("unexpected note stage: %+v", note)
+				}
+			}
+		})
+	}
+}
+
+func TestProcessAwaitsOriginal(t *testing.T) {
+	initOnce.Do(func() {})
+
+	tests := []struct {
+		name        string
+		noteStage   *types.DocumentProcessingStage
+		wantErrType string
+		wantStage   types.Stage
+		wantStatus  string
+		wantDupOf   string
+	}{
+		{
+			name: "original is still processing",
+			noteStage: &types.DocumentProcessingStage{
+				StageStatus: types.DOCUMENT_STATUS_INPROGRESS,
+			},
+			wantErrType: types.DOCUMENT_ERROR_DUPLICATE_PENDING,
+		},
+		{
+			name: "original finished",
+			noteStage: &types.DocumentProcessingStage{
+				StageStatus:   types.DOCUMENT_STATUS_COMPLETE,
+				StageFileName: "scan-1.md",
+				S3Key:         "openai/scan-1.md",
+			},
+			wantStage:  types.DOCUMENT_STAGE_OPENAI,
+			wantStatus: types.DOCUMENT_STATUS_DUPLICATE,
+			wantDupOf:  "doc-1",
+		},
+		{
+			name: "original failed",
+			noteStage: &types.DocumentProcessingStage{
+				StageStatus: types.DOCUMENT_STATUS_ERROR,
+			},
+			wantStage:  types.DOCUMENT_STAGE_DOWNLOAD,
+			wantStatus: types.DOCUMENT_STATUS_COMPLETE,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			store := &fakeStore{
+				document: &types.Document{
+					ID:       "doc-2",
+					GoogleID: "file-2",
+					Name:     "scan (1).pdf",
+				},
+				original: &types.Document{
+					ID:   "doc-1",
+					Name: "scan.pdf",
+				},
+				originalStages: map[types.Stage]*types.DocumentProcessingStage{
+					types.DOCUMENT_STAGE_DOWNLOAD: {
+						StageStatus: types.DOCUMENT_STATUS_COMPLETE,
+						StartedAt:   time.Now().UTC(),
+					},
+					types.DOCUMENT_STAGE_OPENAI: tc.noteStage,
+				},
+			}
+			drive := &fakeDrive{}
+			putter := &fakePutter{}
+			cfg = &handlerConfig{store: store, dc: drive, s3Client: putter}
+
+			got, err := process(context.Background(), types.DocumentStep{
+				DocumentID:  "doc-2",
+				Stage:       types.DOCUMENT_STAGE_DOWNLOAD,
+				Status:      types.DOCUMENT_STATUS_DUPLICATE_PENDING,
+				DuplicateOf: "doc-1",
+			})
+
+			// the check never downloads the document again
+			if drive.calls != 0 || putter.content != nil || store.contentHash != "" {
+				t.Fatalf("unexpected download: %d calls", drive.calls)
+			}
+
+			if tc.wantErrType != "" {
+				var invokeErr messages.InvokeResponse_Error
+				if !errors.As(err, &invokeErr) || invokeErr.Type != tc.wantErrType {
+					t.Fatalf("unexpected error: got %v want %s", err, tc.wantErrType)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if got.Stage != tc.wantStage || got.Status != tc.wantStatus || got.DuplicateOf != "" {
+				t.Fatalf(
+					"unexpected step: got %s/%s/%q want %s/%s",
+					got.Stage,
+					got.Status,
+					got.DuplicateOf,
+					tc.wantStage,
+					tc.wantStatus,
+				)
+			}
+
+			if store.duplicateOf != tc.wantDupOf {
+				t.Fatalf("unexpected duplicate of: got %q want %q", store.duplicateOf, tc.wantDupOf)
+			}
+		})
+	}
+}
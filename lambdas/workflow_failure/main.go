@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+
+	"github.com/KyleBrandon/scriptor/lambdas/util"
+	"github.com/KyleBrandon/scriptor/pkg/database"
+	"github.com/KyleBrandon/scriptor/pkg/errorsmap"
+	"github.com/KyleBrandon/scriptor/pkg/google"
+	"github.com/KyleBrandon/scriptor/pkg/types"
+	"github.com/aws/aws-lambda-go/lambda"
+)
+
+type (
+	// The part of Google Drive used to comment on the original
+	documentCommenter interface {
+		AddComment(ctx context.Context, fileID, text string) error
+	}
+
+	handlerConfig struct {
+		store   database.DocumentStore
+		wcStore database.WatchChannelStore
+		dc      documentCommenter
+	}
+)
+
+var (
+	initOnce sync.Once
+	cfg      *handlerConfig
+)
+
+// Used for failures that no stage recorded, like a stage that timed out
+const WORKFLOW_STAGE = "workflow"
+
+// Load all the inital configuration settings for the lambda
+func loadConfiguration(ctx context.Context) (*handlerConfig, error) {
+
+	cfg = &handlerConfig{}
+
+	var err error
+
+	cfg.store, err = database.NewDocumentStore(ctx)
+	if err != nil {
+		slog.Error("Failed to configure the DynamoDB client", "error", err)
+		return nil, err
+	}
+
+	cfg.wcStore, err = database.NewWatchChannelStore(ctx)
+	if err != nil {
+		slog.Error("Failed to configure the watch channel store", "error", err)
+		return nil, err
+	}
+
+	cfg.dc, err = google.NewGoogleDrive(ctx)
+	if err != nil {
+		slog.Error(
+			"Failed to initialize the Google Drive service context",
+			"error",
+			err,
+		)
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+// Ensure that the configuration settings are only loaded once
+func initLambda(ctx context.Context) error {
+	var err error
+	initOnce.Do(func() {
+		slog.Debug(">>initLambda")
+		defer slog.Debug("<<initLambda")
+
+		cfg, err = loadConfiguration(ctx)
+	})
+
+	return err
+}
+
+// The stage that failed and why. The first stage that recorded an error is
+// used, with the summary of its error code when it has one. Failures that no
+// stage recorded use the stage the step failed at, or the workflow when the
+// step doesn't know, with the message of the error the workflow caught.
+func failedStage(
+	stages []*types.DocumentProcessingStage,
+	step types.DocumentStep,
+	message string,
+) (string, string) {
+	for _, stage := range stages {
+		if stage.StageStatus != types.DOCUMENT_STATUS_ERROR {
+			continue
+		}
+
+		reason := stage.ErrorReason
+		if stage.ErrorCode != "" {
+			reason = errorsmap.ExplainCode(stage.ErrorCode, stage.ErrorReason).Summary
+		}
+
+		return string(stage.Stage), reason
+	}
+
+	if step.ErrorStage != "" {
+		return string(step.ErrorStage), message
+	}
+
+	return WORKFLOW_STAGE, message
+}
+
+// Get the watch channel of the document, nil when the document didn't come
+// from one
+func (cfg *handlerConfig) documentChannel(
+	ctx context.Context,
+	document *types.Document,
+) (*types.WatchChannel, error) {
+	if document.ChannelID == "" || document.GoogleFolderID == "" {
+		return nil, nil
+	}
+
+	wc, err := cfg.wcStore.GetWatchChannel(ctx, document.GoogleFolderID)
+	if err != nil || wc.FolderID == "" {
+		return nil, err
+	}
+
+	return wc, nil
+}
+
+// Comment on the original of the document that the workflow failed to
+// process. Only documents from channels that post comments are commented on.
+// The workflow fails either way, so a comment that can't be added is only
+// logged.
+func process(ctx context.Context, event types.DocumentStep) error {
+	slog.Debug(">>process")
+	defer slog.Debug("<<process")
+
+	if err := initLambda(ctx); err != nil {
+		slog.Error("Failed to initialize the lambda", "error", err)
+		return err
+	}
+
+	message := util.ReadStepError(&event)
+	slog.Warn(
+		"Document failed to process",
+		"id",
+		event.DocumentID,
+		"stage",
+		event.ErrorStage,
+		"attempt",
+		event.Attempt,
+		"error",
+		message,
+	)
+
+	document, err := cfg.store.GetDocument(ctx, event.DocumentID)
+	if err != nil {
+		slog.Error(
+			"Failed to get the document that failed",
+			"id",
+			event.DocumentID,
+			"error",
+			err,
+		)
+		return err
+	}
+
+	// the workflow ends here, so the execution it was counted for is free
+	err = util.ReleaseExecutionSlot(ctx, cfg.store, cfg.wcStore, document)
+	if err != nil {
+		slog.Error(
+			"Failed to give back the execution of the document",
+			"id",
+			document.ID,
+			"channelID",
+			document.ChannelID,
+			"error",
+			err,
+		)
+		return err
+	}
+
+	if document.SourceType != types.DOCUMENT_SOURCE_GOOGLE_DRIVE ||
+		document.GoogleID == "" {
+		return nil
+	}
+
+	wc, err := cfg.documentChannel(ctx, document)
+	if err != nil {
+		slog.Error(
+			"Failed to get the watch channel of the document",
+			"id",
+			document.ID,
+			"folderID",
+			document.GoogleFolderID,
+			"error",
+			err,
+		)
+		return err
+	}
+
+	if wc == nil || !wc.PostComments {
+		return nil
+	}
+
+	workflowStages := types.WorkflowStages()
+	stages := make([]*types.DocumentProcessingStage, 0, len(workflowStages))
+	for _, stageName := range workflowStages {
+		// the stages the document didn't get to have no record
+		stage, err := cfg.store.GetDocumentStage(ctx, document.ID, stageName)
+		if err != nil && !errors.Is(err, database.ErrStageNotFound) {
+			slog.Error(
+				"Failed to get the document stage",
+				"id",
+				document.ID,
+				"stage",
+				stageName,
+				"error",
+				err,
+			)
+			return err
+		}
+
+		stages = append(stages, stage)
+	}
+
+	stage, reason := failedStage(stages, event, message)
+
+	err = cfg.dc.AddComment(ctx, document.GoogleID, google.FailedComment(stage, reason))
+	if err != nil {
+		slog.Warn(
+			"Failed to comment on the original",
+			"id",
+			document.ID,
+			"googleID",
+			document.GoogleID,
+			"error",
+			err,
+		)
+	}
+
+	return nil
+}
+
+func main() {
+	slog.Debug(">>main")
+	defer slog.Debug("<<main")
+
+	lambda.Start(process)
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"testing"
+
+	"github.com/KyleBrandon/scriptor/pkg/database"
+	"github.com/KyleBrandon/scriptor/pkg/errorsmap"
+	"github.com/KyleBrandon/scriptor/pkg/types"
+)
+
+func TestFailedStage(t *testing.T) {
+	tests := []struct {
+		name       string
+		stages     []*types.DocumentProcessingStage
+		step       types.DocumentStep
+		message    string
+		wantStage  string
+		wantReason string
+	}{
+		{
+			name: "classified failure",
+			stages: []*types.DocumentProcessingStage{
+				{Stage: types.DOCUMENT_STAGE_DOWNLOAD, StageStatus: types.DOCUMENT_STATUS_COMPLETE},
+				{
+					Stage:       types.DOCUMENT_STAGE_MATHPIX,
+					StageStatus: types.DOCUMENT_STATUS_ERROR,
+					ErrorCode:   errorsmap.CODE_DOCUMENT_TOO_LARGE,
+					ErrorReason: "document is 300MB",
+				},
+			},
+			wantStage:  string(types.DOCUMENT_STAGE_MATHPIX),
+			wantReason: "The document is larger than Scriptor is configured to process.",
+		},
+		{
+			name: "failure without a code",
+			stages: []*types.DocumentProcessingStage{
+				{
+					Stage:       types.DOCUMENT_STAGE_OPENAI,
+					StageStatus: types.DOCUMENT_STATUS_ERROR,
+					ErrorReason: "rate limited",
+				},
+			},
+			wantStage:  string(types.DOCUMENT_STAGE_OPENAI),
+			wantReason: "rate limited",
+		},
+		{
+			name: "no stage recorded the failure",
+			stages: []*types.DocumentProcessingStage{
+				{Stage: types.DOCUMENT_STAGE_DOWNLOAD, StageStatus: types.DOCUMENT_STATUS_COMPLETE},
+				{Stage: types.DOCUMENT_STAGE_MATHPIX, StageStatus: types.DOCUMENT_STATUS_INPROGRESS},
+			},
+			message:    "States.Timeout",
+			wantStage:  WORKFLOW_STAGE,
+			wantReason: "States.Timeout",
+		},
+		{
+			// the stage failed before it could record the error
+			name: "step knows the failed stage",
+			stages: []*types.DocumentProcessingStage{
+				{Stage: types.DOCUMENT_STAGE_DOWNLOAD, StageStatus: types.DOCUMENT_STATUS_COMPLETE},
+			},
+			step:       types.DocumentStep{ErrorStage: types.DOCUMENT_STAGE_MATHPIX, Attempt: 2},
+			message:    "connection reset",
+			wantStage:  string(types.DOCUMENT_STAGE_MATHPIX),
+			wantReason: "connection reset",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			stage, reason := failedStage(tc.stages, tc.step, tc.message)
+			if stage != tc.wantStage || reason != tc.wantReason {
+				t.Fatalf(
+					"unexpected failure: got %s %q want %s %q",
+					stage,
+					reason,
+					tc.wantStage,
+					tc.wantReason,
+				)
+			}
+		})
+	}
+}
+
+type fakeStore struct {
+	database.DocumentStore
+	document *types.Document
+	stages   map[types.Stage]*types.DocumentProcessingStage
+	held     bool
+}
+
+func (s *fakeStore) GetDocument(ctx context.Context, id string) (*types.Document, error) {
+	return s.document, nil
+}
+
+func (s *fakeStore) GetDocumentStage(
+	ctx context.Context,
+	id string,
+	stage types.Stage,
+) (*types.DocumentProcessingStage, error) {
+	if docStage, ok := s.stages[stage]; ok {
+		return docStage, nil
+	}
+
+	return &types.DocumentProcessingStage{}, nil
+}
+
+func (s *fakeStore) ReleaseExecutionSlot(ctx context.Context, id string) (bool, error) {
+	held := s.held
+	s.held = false
+	return held, nil
+}
+
+type fakeChannels struct {
+	database.WatchChannelStore
+	channel  *types.WatchChannel
+	released []string
+}
+
+func (c *fakeChannels) GetWatchChannel(
+	ctx context.Context,
+	folderID string,
+) (*types.WatchChannel, error) {
+	return c.channel, nil
+}
+
+func (c *fakeChannels) DecrementActiveExecutions(ctx context.Context, channelID string) error {
+	c.released = append(c.released, channelID)
+	return nil
+}
+
+type fakeDrive struct {
+	comments []string
+}
+
+func (d *fakeDrive) AddComment(ctx context.Context, fileID, text string) error {
+	d.comments = append(d.comments, fileID+": "+text)
+	return nil
+}
+
+func TestProcessCommentsOnTheOriginal(t *testing.T) {
+	// skip loading the AWS configuration
+	initOnce.Do(func() {})
+
+	tests := []struct {
+		name         string
+		postComments bool
+		channelID    string
+		want         []string
+	}{
+		{
+			name:      "comments are off",
+			channelID: "channel-1",
+		},
+		{
+			name:         "comments are on",
+			postComments: true,
+			channelID:    "channel-1",
+			want:         []string{"file: Processing failed at mathpix: request failed"},
+		},
+		{
+			name:         "document not from a channel",
+			postComments: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			drive := &fakeDrive{}
+
+			cfg = &handlerConfig{
+				store: &fakeStore{
+					document: &types.Document{
+						ID:             "doc-1",
+						SourceType:     types.DOCUMENT_SOURCE_GOOGLE_DRIVE,
+						GoogleID:       "file",
+						GoogleFolderID: "watch",
+						ChannelID:      tc.channelID,
+					},
+					stages: map[types.Stage]*types.DocumentProcessingStage{
+						types.DOCUMENT_STAGE_MATHPIX: {
+							Stage:       types.DOCUMENT_STAGE_MATHPIX,
+							StageStatus: types.DOCUMENT_STATUS_ERROR,
+							ErrorReason: "request failed",
+						},
+					},
+				},
+				wcStore: &fakeChannels{channel: &types.WatchChannel{
+					FolderID:     "watch",
+					PostComments: tc.postComments,
+				}},
+				dc: drive,
+			}
+
+			event := types.DocumentStep{
+				DocumentID: "doc-1",
+				Error:      &types.StepError{Error: "States.TaskFailed"},
+			}
+			if err := process(context.Background(), event); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if !slices.Equal(drive.comments, tc.want) {
+				t.Fatalf("unexpected comments: got %q want %q", drive.comments, tc.want)
+			}
+		})
+	}
+}
+
+func TestProcessGivesBackTheExecution(t *testing.T) {
+	// skip loading the AWS configuration
+	initOnce.Do(func() {})
+
+	tests := []struct {
+		name string
+		held bool
+		want []string
+	}{
+		{name: "counted", held: true, want: []string{"channel-1"}},
+		{name: "not counted"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			channels := &fakeChannels{channel: &types.WatchChannel{FolderID: "watch"}}
+			cfg = &handlerConfig{
+				store: &fakeStore{
+					document: &types.Document{
+						ID:             "doc-1",
+						SourceType:     types.DOCUMENT_SOURCE_GOOGLE_DRIVE,
+						GoogleID:       "file",
+						GoogleFolderID: "watch",
+						ChannelID:      "channel-1",
+					},
+					held: tc.held,
+				},
+				wcStore: channels,
+				dc:      &fakeDrive{},
+			}
+
+			event := types.DocumentStep{
+				DocumentID: "doc-1",
+				Error:      &types.StepError{Error: "States.TaskFailed"},
+			}
+			if err := process(context.Background(), event); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if !slices.Equal(channels.released, tc.want) {
+				t.Fatalf("unexpected releases: got %q want %q", channels.released, tc.want)
+			}
+		})
+	}
+}
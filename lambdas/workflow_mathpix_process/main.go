@@ -4,16 +4,25 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"mime/multipart"
 	"net/http"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/KyleBrandon/scriptor/lambdas/util"
 	"github.com/KyleBrandon/scriptor/pkg/database"
+	"github.com/KyleBrandon/scriptor/pkg/errorsmap"
+	"github.com/KyleBrandon/scriptor/pkg/pages"
 	"github.com/KyleBrandon/scriptor/pkg/types"
 	"github.com/aws/aws-lambda-go/lambda"
 	"github.com/aws/aws-sdk-go-v2/aws"
@@ -48,24 +57,44 @@ type (
 		PdfMarkdown string `json:"pdf_md,omitempty"`
 	}
 
+	// LinesResponse is the text of each line of the PDF by page
+	LinesResponse struct {
+		Pages []struct {
+			Page  int `json:"page"`
+			Lines []struct {
+				Text string `json:"text"`
+			} `json:"lines"`
+		} `json:"pages"`
+	}
+
 	handlerConfig struct {
-		store         database.DocumentStore
-		s3Client      *s3.Client
-		mathpixAppID  string
-		mathpixAppKey string
+		store             database.DocumentStore
+		s3Client          *s3.Client
+		mathpixAppID      string
+		mathpixAppKey     string
+		splitOnSeparators bool
+		separatorRules    pages.SeparatorRules
+
+		// Mathpix PDF endpoint and how long to wait between polls
+		apiURL       string
+		pollInterval time.Duration
 	}
 )
 
 var (
-	BucketName string = types.S3_BUCKET_NAME
-	initOnce   sync.Once
-	cfg        *handlerConfig
+	BucketName   string = types.S3_BUCKET_NAME
+	initOnce     sync.Once
+	cfg          *handlerConfig
+	quoteEscaper = strings.NewReplacer("\\", "\\\\", `"`, "\\\"")
 )
 
 // Load all the inital configuration settings for the lambda
 func loadConfiguration(ctx context.Context) (*handlerConfig, error) {
 
-	cfg = &handlerConfig{}
+	cfg = &handlerConfig{
+		apiURL:       MathpixPdfApiURL,
+		pollInterval: MathpixPollInterval * time.Second,
+	}
 
 	var err error
 
@@ -97,9 +126,62 @@ func loadConfiguration(ctx context.Context) (*handlerConfig, error) {
 	cfg.mathpixAppID = mathpixSecrets.AppID
 	cfg.mathpixAppKey = mathpixSecrets.AppKey
 
+	cfg.splitOnSeparators, cfg.separatorRules, err = parseSeparatorRules(os.Getenv)
+	if err != nil {
+		slog.Error("Invalid separator page rules", "error", err)
+		return nil, err
+	}
+
 	return cfg, nil
 }
 
+// Read whether scans are split at separator pages, and the rules for the
+// separator pages, from the environment. Anything that isn't configured uses
+// the defaults.
+func parseSeparatorRules(
+	getenv func(string) string,
+) (bool, pages.SeparatorRules, error) {
+	rules := pages.DefaultSeparatorRules()
+
+	enabled := false
+	for name, value := range map[string]*bool{
+		"SPLIT_ON_SEPARATORS":   &enabled,
+		"SEPARATOR_BLANK_PAGES": &rules.BlankPages,
+	} {
+		setting := getenv(name)
+		if setting == "" {
+			continue
+		}
+
+		parsed, err := strconv.ParseBool(setting)
+		if err != nil {
+			return false, rules, fmt.Errorf("invalid %s: %w", name, err)
+		}
+
+		*value = parsed
+	}
+
+	if setting := getenv("SEPARATOR_BLANK_MAX_CHARS"); setting != "" {
+		parsed, err := strconv.Atoi(setting)
+		if err != nil || parsed < 0 {
+			return false, rules, fmt.Errorf("invalid SEPARATOR_BLANK_MAX_CHARS: %s", setting)
+		}
+
+		rules.BlankMaxChars = parsed
+	}
+
+	if setting := getenv("SEPARATOR_MARKER_PATTERN"); setting != "" {
+		marker, err := regexp.Compile(setting)
+		if err != nil {
+			return false, rules, fmt.Errorf("invalid SEPARATOR_MARKER_PATTERN: %w", err)
+		}
+
+		rules.Marker = marker
+	}
+
+	return enabled, rules, nil
+}
+
 // Ensure that the configuration settings are only loaded once
 func initLambda(ctx context.Context) error {
 	var err error
@@ -159,9 +241,14 @@ func (cfg *handlerConfig) newRequest(
 	return req, nil
 }
 
-// PollForResults polls Mathpix API for PDF processing status
-func (cfg *handlerConfig) pollForResults(pdfID string) error {
-	pollURL := fmt.Sprintf("%s/%s", MathpixPdfApiURL, pdfID)
+// PollForResults polls Mathpix API for PDF processing status. Polling stops
+// with the superseded error once a newer version replaces the document.
+func (cfg *handlerConfig) pollForResults(
+	ctx context.Context,
+	documentID string,
+	pdfID string,
+) error {
+	pollURL := fmt.Sprintf("%s/%s", cfg.apiURL, pdfID)
 
 	// TODO: This would run forever
 	for {
@@ -209,13 +296,40 @@ func (cfg *handlerConfig) pollForResults(pdfID string) error {
 			return fmt.Errorf("mathpix PDF processing failed")
 		}
 
+		// the conversion of a replaced document is abandoned
+		if err := util.CheckSuperseded(ctx, cfg.store, documentID); err != nil {
+			return err
+		}
+
 		// Wait before polling again
-		time.Sleep(MathpixPollInterval * time.Second)
+		time.Sleep(cfg.pollInterval)
+	}
+}
+
+// Delete the conversion of a document that was replaced so Mathpix stops
+// working on it. The document ends either way, a failure is only logged.
+func (cfg *handlerConfig) abandonConversion(pdfID string) {
+	req, err := cfg.newRequest("DELETE", fmt.Sprintf("%s/%s", cfg.apiURL, pdfID), nil)
+	if err == nil {
+		_, err = cfg.doRequestAndReadAll(req)
+	}
+
+	if err != nil {
+		slog.Warn(
+			"Failed to abandon the Mathpix conversion",
+			"pdfID",
+			pdfID,
+			"error",
+			err,
+		)
+		return
 	}
+
+	slog.Info("Abandoned the Mathpix conversion", "pdfID", pdfID)
 }
 
 func (cfg *handlerConfig) queryConversionResults(pdfID string) ([]byte, error) {
-	resultsURL := fmt.Sprintf("%s/%s.md", MathpixPdfApiURL, pdfID)
+	resultsURL := fmt.Sprintf("%s/%s.md", cfg.apiURL, pdfID)
 
 	req, err := cfg.newRequest("GET", resultsURL, nil)
 	if err != nil {
@@ -240,9 +354,191 @@ func (cfg *handlerConfig) queryConversionResults(pdfID string) ([]byte, error) {
 	return body, nil
 }
 
+// Query the text of each page of the converted PDF
+func (cfg *handlerConfig) queryPages(pdfID string) ([]pages.Page, error) {
+	linesURL := fmt.Sprintf("%s/%s.lines.json", cfg.apiURL, pdfID)
+
+	req, err := cfg.newRequest("GET", linesURL, nil)
+	if err != nil {
+		slog.Error(
+			"Failed to create GET request for the mathpix document lines",
+			"error",
+			err,
+		)
+		return nil, err
+	}
+
+	body, err := cfg.doRequestAndReadAll(req)
+	if err != nil {
+		slog.Error(
+			"Failed to send GET request for the mathpix document lines",
+			"error",
+			err,
+		)
+		return nil, err
+	}
+
+	return parsePages(body)
+}
+
+func parsePages(body []byte) ([]pages.Page, error) {
+	var linesResp LinesResponse
+	err := json.Unmarshal(body, &linesResp)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal the mathpix document lines: %w", err)
+	}
+
+	ret := make([]pages.Page, 0, len(linesResp.Pages))
+	for _, p := range linesResp.Pages {
+		page := pages.Page{Number: p.Page, Lines: make([]string, 0, len(p.Lines))}
+		for _, line := range p.Lines {
+			page.Lines = append(page.Lines, line.Text)
+		}
+
+		ret = append(ret, page)
+	}
+
+	return ret, nil
+}
+
+// Save the Markdown for the stage to S3
+func (cfg *handlerConfig) saveMarkdown(
+	ctx context.Context,
+	stage *types.DocumentProcessingStage,
+	documentName string,
+	body []byte,
+) error {
+	stage.StageFileName = util.StageFileName(documentName, ".md")
+	stage.S3Key = fmt.Sprintf(
+		"%s/%s",
+		stage.Stage,
+		stage.StageFileName,
+	)
+	stage.ContentType = types.CONTENT_TYPE_MARKDOWN
+	_, err := cfg.s3Client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:        aws.String(BucketName),
+		Key:           aws.String(stage.S3Key),
+		Body:          bytes.NewReader(body),
+		ContentType:   aws.String(stage.ContentType),
+		ContentLength: aws.Int64(int64(len(body))),
+	})
+
+	return err
+}
+
+// Build a child document for each section of a scan. The IDs are derived
+// from the parent so a retry replaces the children of the earlier attempt.
+func childDocuments(parent *types.Document, sections []pages.Section) []*types.Document {
+	names := pages.SectionNames(util.DocumentBaseName(parent), sections)
+	ext := filepath.Ext(parent.Name)
+
+	children := make([]*types.Document, 0, len(sections))
+	for i, section := range sections {
+		children = append(children, &types.Document{
+			ID:             fmt.Sprintf("%s-%d", parent.ID, i+1),
+			SourceType:     parent.SourceType,
+			SourceKey:      fmt.Sprintf("%s#%d", parent.SourceKey, i+1),
+			GoogleFolderID: parent.GoogleFolderID,
+			ChannelID:      parent.ChannelID,
+			Name:           names[i] + ext,
+			MimeType:       types.CONTENT_TYPE_MARKDOWN,
+			CreatedTime:    parent.CreatedTime,
+			ModifiedTime:   parent.ModifiedTime,
+			ParentID:       parent.ID,
+			FirstPage:      section.FirstPage,
+			LastPage:       section.LastPage,
+		})
+	}
+
+	return children
+}
+
+// Split a scan of several documents at the separator pages into a child
+// document for each, with the Mathpix stage of the child holding its part of
+// the Markdown. Returns the steps to process the children, or none when the
+// scan is a single document.
+func (cfg *handlerConfig) splitDocument(
+	ctx context.Context,
+	event types.DocumentStep,
+	parent *types.Document,
+	pdfID string,
+	body []byte,
+) ([]types.DocumentStep, error) {
+	scanPages, err := cfg.queryPages(pdfID)
+	if err != nil {
+		return nil, err
+	}
+
+	sections := pages.Split(string(body), scanPages, cfg.separatorRules)
+	if len(sections) < 2 {
+		return nil, nil
+	}
+
+	children := childDocuments(parent, sections)
+	steps := make([]types.DocumentStep, 0, len(children))
+	childIDs := make([]string, 0, len(children))
+
+	for i, child := range children {
+		// a retry of the stage finds the children saved by the attempt before
+		err = cfg.store.InsertDocument(ctx, child)
+		if err != nil && !errors.Is(err, database.ErrDocumentExists) {
+			return nil, err
+		}
+
+		stage, err := cfg.store.StartDocumentStage(
+			ctx,
+			child.ID,
+			types.DOCUMENT_STAGE_MATHPIX,
+			child.Name,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		err = cfg.saveMarkdown(
+			ctx,
+			stage,
+			util.DocumentBaseName(child),
+			[]byte(sections[i].Markdown),
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		err = cfg.store.CompleteDocumentStage(ctx, stage)
+		if err != nil {
+			return nil, err
+		}
+
+		childIDs = append(childIDs, child.ID)
+		steps = append(steps, types.DocumentStep{
+			NotificationID: event.NotificationID,
+			ChannelID:      event.ChannelID,
+			DocumentID:     child.ID,
+			Stage:          types.DOCUMENT_STAGE_MATHPIX,
+		})
+	}
+
+	err = cfg.store.UpdateDocumentChildren(ctx, parent.ID, childIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	slog.Info(
+		"Split the scan at the separator pages",
+		"id",
+		parent.ID,
+		"children",
+		len(children),
+	)
+
+	return steps, nil
+}
+
 func (cfg *handlerConfig) sendDocumentToMathpix(
 	ctx context.Context,
 	prevStage *types.DocumentProcessingStage,
+	mathpixStage *types.DocumentProcessingStage,
 ) (string, error) {
 	// get the input file form S3
 	resp, err := cfg.s3Client.GetObject(ctx, &s3.GetObjectInput{
@@ -259,7 +555,17 @@ func (cfg *handlerConfig) sendDocumentToMathpix(
 	// Create multipart form data
 	body := &bytes.Buffer{}
 	writer := multipart.NewWriter(body)
-	part, err := writer.CreateFormFile("file", prevStage.StageFileName)
+	partHeader := make(textproto.MIMEHeader)
+	partHeader.Set(
+		"Content-Disposition",
+		fmt.Sprintf(
+			`form-data; name="file"; filename="%s"`,
+			quoteEscaper.Replace(prevStage.StageFileName),
+		),
+	)
+	partHeader.Set("Content-Type", util.StageContentType(prevStage))
+
+	part, err := writer.CreatePart(partHeader)
 	if err != nil {
 		slog.Error("Failed to create form file", "error", err)
 		return "", err
@@ -274,7 +580,7 @@ func (cfg *handlerConfig) sendDocumentToMathpix(
 	writer.Close()
 
 	// Create HTTP request
-	req, err := cfg.newRequest("POST", MathpixPdfApiURL, body)
+	req, err := cfg.newRequest("POST", cfg.apiURL, body)
 	if err != nil {
 		slog.Error(
 			"Failed to create POST request for mathpix API",
@@ -288,7 +594,9 @@ func (cfg *handlerConfig) sendDocumentToMathpix(
 	req.Header.Set("Content-Type", writer.FormDataContentType())
 
 	// send the request
+	sent := time.Now()
 	respBody, err := cfg.doRequestAndReadAll(req)
+	mathpixStage.ExternalMillis += time.Since(sent).Milliseconds()
 	if err != nil {
 		slog.Error("Failed to send mathpix request", "error", err)
 		return "", err
@@ -314,133 +622,206 @@ func (cfg *handlerConfig) sendDocumentToMathpix(
 	return uploadResp.PdfID, nil
 }
 
-func process(
+// Convert the PDF of the previous stage with Mathpix and save the Markdown on
+// the stage. Returns the steps of the children when the scan was split.
+func (cfg *handlerConfig) convertDocument(
 	ctx context.Context,
 	event types.DocumentStep,
-) (types.DocumentStep, error) {
-	slog.Debug(">>process")
-	defer slog.Debug("<<process")
+	prevStage *types.DocumentProcessingStage,
+	mathpixStage *types.DocumentProcessingStage,
+) ([]types.DocumentStep, error) {
+	// Upload PDF to Mathpix
+	pdfID, err := cfg.sendDocumentToMathpix(ctx, prevStage, mathpixStage)
+	if err != nil {
+		slog.Error(
+			"Error uploading PDF",
+			"docName",
+			prevStage.OriginalFileName,
+			"error",
+			err,
+		)
+		return nil, err
+	}
 
-	ret := types.DocumentStep{}
+	// Mathpix converts the PDF while it's polled, the wait is part of the
+	// time spent on Mathpix
+	converting := time.Now()
 
-	if err := initLambda(ctx); err != nil {
-		slog.Error("Failed to initialize the lambda", "error", err)
-		return ret, err
+	// Poll for results
+	err = cfg.pollForResults(ctx, event.DocumentID, pdfID)
+	if util.IsSuperseded(err) {
+		cfg.abandonConversion(pdfID)
+		return nil, err
 	}
-
-	var err error
-	// query the previous stage information
-	prevStage, err := cfg.store.GetDocumentStage(
-		ctx,
-		event.DocumentID,
-		event.Stage,
-	)
 	if err != nil {
 		slog.Error(
-			"Failed to get the previous stage information",
-			"id",
-			event.DocumentID,
-			"stage",
-			event.Stage,
+			"Error getting results",
+			"docName",
+			prevStage.OriginalFileName,
 			"error",
 			err,
 		)
-		return ret, err
+		return nil, err
 	}
 
-	// create the mathpix stage entry
-	mathpixStage, err := cfg.store.StartDocumentStage(
-		ctx,
-		event.DocumentID,
-		types.DOCUMENT_STAGE_MATHPIX,
-		prevStage.OriginalFileName,
-	)
+	body, err := cfg.queryConversionResults(pdfID)
 	if err != nil {
 		slog.Error(
-			"Failed to start the Mathpix document processing stage",
+			"Failed to query conversion results",
 			"docName",
 			prevStage.OriginalFileName,
 			"error",
 			err,
 		)
-		return ret, err
+		return nil, err
 	}
+	mathpixStage.ExternalMillis += time.Since(converting).Milliseconds()
 
-	// Upload PDF to Mathpix
-	pdfID, err := cfg.sendDocumentToMathpix(ctx, prevStage)
+	document, err := cfg.store.GetDocument(ctx, event.DocumentID)
 	if err != nil {
 		slog.Error(
-			"Error uploading PDF",
-			"docName",
-			prevStage.OriginalFileName,
+			"Failed to get the document information",
+			"id",
+			event.DocumentID,
 			"error",
 			err,
 		)
-		return ret, err
+		return nil, err
 	}
 
-	// Poll for results
-	err = cfg.pollForResults(pdfID)
+	// Save mathpix markdown to S3
+	err = cfg.saveMarkdown(ctx, mathpixStage, util.DocumentBaseName(document), body)
 	if err != nil {
 		slog.Error(
-			"Error getting results",
+			"Failed to save the document in the S3 bucket",
 			"docName",
 			prevStage.OriginalFileName,
+			"key",
+			mathpixStage.S3Key,
 			"error",
 			err,
 		)
+		return nil, err
+	}
+
+	var children []types.DocumentStep
+	if cfg.splitOnSeparators {
+		children, err = cfg.splitDocument(ctx, event, document, pdfID, body)
+		if err != nil {
+			slog.Error(
+				"Failed to split the document at the separator pages",
+				"docName",
+				prevStage.OriginalFileName,
+				"error",
+				err,
+			)
+			return nil, err
+		}
+	}
+
+	return children, nil
+}
+
+// Record why the conversion failed on the stage, so it doesn't stay in
+// progress
+func (cfg *handlerConfig) failStage(
+	ctx context.Context,
+	stage *types.DocumentProcessingStage,
+	err error,
+) {
+	failErr := cfg.store.FailDocumentStage(
+		ctx,
+		stage,
+		types.DOCUMENT_STATUS_ERROR,
+		errorsmap.Classify(err),
+		err.Error(),
+	)
+	if failErr != nil {
+		slog.Error(
+			"Failed to update the processing stage as failed",
+			"id",
+			stage.ID,
+			"error",
+			failErr,
+		)
+	}
+}
+
+func process(
+	ctx context.Context,
+	event types.DocumentStep,
+) (types.DocumentStep, error) {
+	slog.Debug(">>process")
+	defer slog.Debug("<<process")
+
+	ret := types.DocumentStep{}
+
+	// a malformed input fails here rather than as a missing stage
+	if err := util.ValidateStep(event); err != nil {
+		slog.Error("Invalid step input", "error", err)
 		return ret, err
 	}
 
-	body, err := cfg.queryConversionResults(pdfID)
+	if err := initLambda(ctx); err != nil {
+		slog.Error("Failed to initialize the lambda", "error", err)
+		return ret, err
+	}
+
+	var err error
+	// query the previous stage information
+	prevStage, err := cfg.store.GetDocumentStage(
+		ctx,
+		event.DocumentID,
+		event.Stage,
+	)
 	if err != nil {
 		slog.Error(
-			"Failed to query conversion results",
-			"docName",
-			prevStage.OriginalFileName,
+			"Failed to get the previous stage information",
+			"id",
+			event.DocumentID,
+			"stage",
+			event.Stage,
 			"error",
 			err,
 		)
 		return ret, err
-
 	}
 
-	// Get the original document name w/o extension
-	documentName := util.GetNamePart(prevStage.OriginalFileName)
+	// nothing is sent to Mathpix for a document that was replaced
+	err = util.CheckSuperseded(ctx, cfg.store, event.DocumentID)
+	if err != nil {
+		return ret, err
+	}
 
-	// Save mathpix markdown to S3
-	mathpixStage.StageFileName = fmt.Sprintf(
-		"%s-%d.md",
-		documentName,
-		time.Now().UTC().Unix(),
-	)
-	mathpixStage.S3Key = fmt.Sprintf(
-		"%s/%s",
-		mathpixStage.Stage,
-		mathpixStage.StageFileName,
+	// create the mathpix stage entry
+	mathpixStage, err := cfg.store.StartDocumentStage(
+		ctx,
+		event.DocumentID,
+		types.DOCUMENT_STAGE_MATHPIX,
+		prevStage.OriginalFileName,
 	)
-	_, err = cfg.s3Client.PutObject(ctx, &s3.PutObjectInput{
-		Bucket:        aws.String(BucketName),
-		Key:           aws.String(mathpixStage.S3Key),
-		Body:          bytes.NewReader(body),
-		ContentType:   aws.String("text/markdown"),
-		ContentLength: aws.Int64(int64(len(body))),
-	})
 	if err != nil {
 		slog.Error(
-			"Failed to save the document in the S3 bucket",
+			"Failed to start the Mathpix document processing stage",
 			"docName",
 			prevStage.OriginalFileName,
-			"key",
-			mathpixStage.S3Key,
 			"error",
 			err,
 		)
 		return ret, err
 	}
 
-	// Update the stage to complete
+	ret.Children, err = cfg.convertDocument(ctx, event, prevStage, mathpixStage)
+	if err != nil {
+		// a superseded document didn't fail, the newer version is
+		// processed in its place
+		if !util.IsSuperseded(err) {
+			cfg.failStage(ctx, mathpixStage, err)
+		}
+		return ret, util.StageError(mathpixStage, err)
+	}
 
+	// Update the stage to complete
 	err = cfg.store.CompleteDocumentStage(ctx, mathpixStage)
 	if err != nil {
 		slog.Error(
@@ -455,6 +836,7 @@ func process(
 
 	// pass the step info to the next stage
 	ret.NotificationID = event.NotificationID
+	ret.ChannelID = event.ChannelID
 	ret.DocumentID = event.DocumentID
 	ret.Stage = types.DOCUMENT_STAGE_MATHPIX
 
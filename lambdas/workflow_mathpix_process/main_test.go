@@ -0,0 +1,452 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/KyleBrandon/scriptor/lambdas/util"
+	"github.com/KyleBrandon/scriptor/pkg/database"
+	"github.com/KyleBrandon/scriptor/pkg/errorsmap"
+	"github.com/KyleBrandon/scriptor/pkg/pages"
+	"github.com/KyleBrandon/scriptor/pkg/types"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+func TestParseSeparatorRules(t *testing.T) {
+	tests := []struct {
+		name        string
+		env         map[string]string
+		wantEnabled bool
+		wantBlank   bool
+		wantMax     int
+		wantMarker  string
+		wantErr     bool
+	}{
+		{
+			name:       "defaults",
+			env:        map[string]string{},
+			wantBlank:  true,
+			wantMax:    pages.DEFAULT_BLANK_MAX_CHARS,
+			wantMarker: pages.DEFAULT_MARKER_PATTERN,
+		},
+		{
+			name: "configured",
+			env: map[string]string{
+				"SPLIT_ON_SEPARATORS":       "true",
+				"SEPARATOR_BLANK_PAGES":     "false",
+				"SEPARATOR_BLANK_MAX_CHARS": "10",
+				"SEPARATOR_MARKER_PATTERN":  `^NEXT$`,
+			},
+			wantEnabled: true,
+			wantMax:     10,
+			wantMarker:  `^NEXT$`,
+		},
+		{
+			name:    "invalid flag",
+			env:     map[string]string{"SPLIT_ON_SEPARATORS": "sometimes"},
+			wantErr: true,
+		},
+		{
+			name:    "negative blank characters",
+			env:     map[string]string{"SEPARATOR_BLANK_MAX_CHARS": "-1"},
+			wantErr: true,
+		},
+		{
+			name:    "invalid marker",
+			env:     map[string]string{"SEPARATOR_MARKER_PATTERN": "(###"},
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			enabled, rules, err := parseSeparatorRules(func(name string) string {
+				return tc.env[name]
+			})
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if enabled != tc.wantEnabled ||
+				rules.BlankPages != tc.wantBlank ||
+				rules.BlankMaxChars != tc.wantMax ||
+				rules.Marker.String() != tc.wantMarker {
+				t.Fatalf(
+					"unexpected rules: enabled %v blank %v max %d marker %s",
+					enabled,
+					rules.BlankPages,
+					rules.BlankMaxChars,
+					rules.Marker,
+				)
+			}
+		})
+	}
+}
+
+func TestParsePages(t *testing.T) {
+	body := []byte(`{"pages": [
+		{"page": 1, "lines": [{"text": "# Hardware Store"}, {"text": "Tile 40"}]},
+		{"page": 2, "lines": []},
+		{"page": 3, "lines": [{"text": "\\#\\#\\#"}]}
+	]}`)
+
+	got, err := parsePages(body)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	want := []pages.Page{
+		{Number: 1, Lines: []string{"# Hardware Store", "Tile 40"}},
+		{Number: 2, Lines: []string{}},
+		{Number: 3, Lines: []string{`\#\#\#`}},
+	}
+
+	if len(got) != len(want) {
+		t.Fatalf("unexpected pages: got %+v want %+v", got, want)
+	}
+
+	for i := range want {
+		if got[i].Number != want[i].Number || !slices.Equal(got[i].Lines, want[i].Lines) {
+			t.Fatalf("unexpected page %d: got %+v want %+v", i, got[i], want[i])
+		}
+	}
+
+	if _, err := parsePages([]byte("not json")); err == nil {
+		t.Fatalf("expected an error for invalid lines")
+	}
+}
+
+func TestChildDocuments(t *testing.T) {
+	parent := &types.Document{
+		ID:             "scan",
+		SourceType:     types.DOCUMENT_SOURCE_GOOGLE_DRIVE,
+		SourceKey:      "google-drive:file",
+		GoogleID:       "file",
+		GoogleFolderID: "receipts",
+		ChannelID:      "channel",
+		Name:           "batch.pdf",
+		CreatedTime:    time.Date(2025, 3, 1, 0, 0, 0, 0, time.UTC),
+	}
+
+	sections := []pages.Section{
+		{Markdown: "# Hardware Store\nTile 40\n", FirstPage: 1, LastPage: 2},
+		{Markdown: "Soil 3\n", FirstPage: 4, LastPage: 4},
+	}
+
+	children := childDocuments(parent, sections)
+	if len(children) != 2 {
+		t.Fatalf("unexpected children: %+v", children)
+	}
+
+	want := []types.Document{
+		{
+			ID:             "scan-1",
+			SourceType:     parent.SourceType,
+			SourceKey:      "google-drive:file#1",
+			GoogleFolderID: "receipts",
+			ChannelID:      "channel",
+			Name:           "batch - Hardware Store.pdf",
+			MimeType:       types.CONTENT_TYPE_MARKDOWN,
+			CreatedTime:    parent.CreatedTime,
+			ParentID:       "scan",
+			FirstPage:      1,
+			LastPage:       2,
+		},
+		{
+			ID:             "scan-2",
+			SourceType:     parent.SourceType,
+			SourceKey:      "google-drive:file#2",
+			GoogleFolderID: "receipts",
+			ChannelID:      "channel",
+			Name:           "batch-2.pdf",
+			MimeType:       types.CONTENT_TYPE_MARKDOWN,
+			CreatedTime:    parent.CreatedTime,
+			ParentID:       "scan",
+			FirstPage:      4,
+			LastPage:       4,
+		},
+	}
+
+	for i, child := range children {
+		// the children are never archived, only the scan is
+		if child.GoogleID != "" {
+			t.Fatalf("child %d has the Drive file of the scan", i)
+		}
+
+		if child.ID != want[i].ID ||
+			child.SourceKey != want[i].SourceKey ||
+			child.GoogleFolderID != want[i].GoogleFolderID ||
+			child.ChannelID != want[i].ChannelID ||
+			child.Name != want[i].Name ||
+			child.MimeType != want[i].MimeType ||
+			!child.CreatedTime.Equal(want[i].CreatedTime) ||
+			child.ParentID != want[i].ParentID ||
+			child.FirstPage != want[i].FirstPage ||
+			child.LastPage != want[i].LastPage {
+			t.Fatalf("unexpected child %d: got %+v want %+v", i, *child, want[i])
+		}
+	}
+}
+
+// A document table where the document is superseded once it was read the
+// given number of times, never when the count is zero. The stages failed
+// are kept.
+type fakeStore struct {
+	database.DocumentStore
+	reads       int
+	supersedeAt int
+	parentID    string
+	failed      []*types.DocumentProcessingStage
+}
+
+func (s *fakeStore) GetDocumentStage(
+	ctx context.Context,
+	id string,
+	stage types.Stage,
+) (*types.DocumentProcessingStage, error) {
+	return &types.DocumentProcessingStage{
+		ID:               id,
+		Stage:            stage,
+		S3Key:            "download/" + id + ".pdf",
+		OriginalFileName: "scan.pdf",
+		StageFileName:    "scan.pdf",
+	}, nil
+}
+
+func (s *fakeStore) StartDocumentStage(
+	ctx context.Context,
+	id string,
+	stage types.Stage,
+	fileName string,
+) (*types.DocumentProcessingStage, error) {
+	return &types.DocumentProcessingStage{
+		ID:               id,
+		Stage:            stage,
+		StageStatus:      types.DOCUMENT_STATUS_INPROGRESS,
+		OriginalFileName: fileName,
+	}, nil
+}
+
+func (s *fakeStore) FailDocumentStage(
+	ctx context.Context,
+	stage *types.DocumentProcessingStage,
+	status, code, reason string,
+) error {
+	stage.StageStatus = status
+	stage.ErrorCode = code
+	stage.ErrorReason = reason
+	s.failed = append(s.failed, stage)
+
+	return nil
+}
+
+func (s *fakeStore) GetDocument(ctx context.Context, id string) (*types.Document, error) {
+	s.reads++
+
+	document := &types.Document{ID: id}
+	if id == "doc-1" {
+		document.ParentID = s.parentID
+	}
+
+	if s.supersedeAt > 0 && s.reads >= s.supersedeAt {
+		document.SupersededBy = "doc-2"
+	}
+
+	return document, nil
+}
+
+func TestPollForResultsStopsWhenSuperseded(t *testing.T) {
+	tests := []struct {
+		name        string
+		statuses    []string
+		supersedeAt int
+		parentID    string
+
+		wantSuperseded bool
+		wantPolls      int
+	}{
+		{
+			name:      "conversion completes",
+			statuses:  []string{"split", "processing", "completed"},
+			wantPolls: 3,
+		},
+		{
+			name:           "superseded while converting",
+			statuses:       []string{"split", "processing", "completed"},
+			supersedeAt:    2,
+			wantSuperseded: true,
+			wantPolls:      2,
+		},
+		{
+			name:        "superseded after the conversion completed",
+			statuses:    []string{"completed"},
+			supersedeAt: 1,
+			wantPolls:   1,
+		},
+		{
+			// the parent is read right after the child on each check
+			name:           "scan the document was split from superseded",
+			statuses:       []string{"processing", "processing", "completed"},
+			parentID:       "scan-1",
+			supersedeAt:    2,
+			wantSuperseded: true,
+			wantPolls:      1,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			polls := 0
+			deleted := make([]string, 0)
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method == http.MethodDelete {
+					deleted = append(deleted, r.URL.Path)
+					return
+				}
+
+				status := tc.statuses[min(polls, len(tc.statuses)-1)]
+				polls++
+				fmt.Fprintf(w, `{"status":%q}`, status)
+			}))
+			defer server.Close()
+
+			cfg = &handlerConfig{
+				store:        &fakeStore{supersedeAt: tc.supersedeAt, parentID: tc.parentID},
+				apiURL:       server.URL,
+				pollInterval: time.Millisecond,
+			}
+
+			err := cfg.pollForResults(context.Background(), "doc-1", "pdf-1")
+			if util.IsSuperseded(err) != tc.wantSuperseded {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !tc.wantSuperseded && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if polls != tc.wantPolls {
+				t.Fatalf("unexpected polls: got %d want %d", polls, tc.wantPolls)
+			}
+
+			if tc.wantSuperseded {
+				cfg.abandonConversion("pdf-1")
+				if !slices.Equal(deleted, []string{"/pdf-1"}) {
+					t.Fatalf("unexpected conversions abandoned: %v", deleted)
+				}
+			}
+		})
+	}
+}
+
+func TestProcessFailsStage(t *testing.T) {
+	tests := []struct {
+		name        string
+		upload      string
+		statuses    []string
+		supersedeAt int
+
+		wantFailed bool
+		wantReason string
+	}{
+		{
+			name:       "upload rejected",
+			upload:     `{"error":"invalid file"}`,
+			wantFailed: true,
+			wantReason: "mathpix error: invalid file, ErrorInfo.ID=, ErrorInfo.Message=",
+		},
+		{
+			name:       "conversion fails",
+			upload:     `{"pdf_id":"pdf-1"}`,
+			statuses:   []string{"processing", "error"},
+			wantFailed: true,
+			wantReason: "mathpix PDF processing failed",
+		},
+		{
+			// the document is read once before the stage is started
+			name:        "superseded while converting",
+			upload:      `{"pdf_id":"pdf-1"}`,
+			statuses:    []string{"processing", "processing"},
+			supersedeAt: 2,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			bucket := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte("%PDF-1.4"))
+			}))
+			defer bucket.Close()
+
+			polls := 0
+			mathpix := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch r.Method {
+				case http.MethodPost:
+					fmt.Fprint(w, tc.upload)
+				case http.MethodGet:
+					status := tc.statuses[min(polls, len(tc.statuses)-1)]
+					polls++
+					fmt.Fprintf(w, `{"status":%q}`, status)
+				}
+			}))
+			defer mathpix.Close()
+
+			store := &fakeStore{supersedeAt: tc.supersedeAt}
+			initOnce.Do(func() {})
+			cfg = &handlerConfig{
+				store: store,
+				s3Client: s3.New(s3.Options{
+					Region:           "us-east-1",
+					BaseEndpoint:     aws.String(bucket.URL),
+					Credentials:      aws.AnonymousCredentials{},
+					UsePathStyle:     true,
+					RetryMaxAttempts: 1,
+				}),
+				apiURL:       mathpix.URL,
+				pollInterval: time.Millisecond,
+			}
+
+			_, err := process(context.Background(), types.DocumentStep{
+				DocumentID: "doc-1",
+				Stage:      types.DOCUMENT_STAGE_DOWNLOAD,
+			})
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+
+			if !tc.wantFailed {
+				if !util.IsSuperseded(err) {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if len(store.failed) != 0 {
+					t.Fatalf("unexpected stages failed: %+v", store.failed)
+				}
+				return
+			}
+
+			if len(store.failed) != 1 {
+				t.Fatalf("unexpected stages failed: %+v", store.failed)
+			}
+
+			stage := store.failed[0]
+			if stage.Stage != types.DOCUMENT_STAGE_MATHPIX ||
+				stage.StageStatus != types.DOCUMENT_STATUS_ERROR ||
+				stage.ErrorCode != errorsmap.CODE_UNKNOWN ||
+				stage.ErrorReason != tc.wantReason {
+				t.Fatalf("unexpected failed stage: %+v", *stage)
+			}
+		})
+	}
+}
@@ -6,12 +6,17 @@ import (
 	"fmt"
 	"io"
 	"log/slog"
+	"os"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/KyleBrandon/scriptor/lambdas/util"
 	"github.com/KyleBrandon/scriptor/pkg/database"
+	"github.com/KyleBrandon/scriptor/pkg/errorsmap"
+	"github.com/KyleBrandon/scriptor/pkg/markdown"
+	"github.com/KyleBrandon/scriptor/pkg/notes"
 	"github.com/KyleBrandon/scriptor/pkg/types"
 	"github.com/aws/aws-lambda-go/lambda"
 	"github.com/aws/aws-sdk-go-v2/config"
@@ -26,6 +31,7 @@ type handlerConfig struct {
 	store        database.DocumentStore
 	s3Client     *s3.Client
 	openAIClient openai.Client
+	tableOptions markdown.TableOptions
 }
 
 type openAIUploadFile struct {
@@ -55,20 +61,12 @@ Do not add explanations, comments, or wrap the output in a code block. Return ON
 
 %s`
 
-	HEADER_TEMPLATE = `---
-id: "%s"
-aliases: []
-tags:
-  - reMarkable
----
+	// Prepended to the prompt for a document split from a scan of several
+	SPLIT_PROMPT = "The attached PDF is a scan of several documents. The Markdown below only covers pages %d to %d of the PDF, ignore the other pages.\n\n"
 
-People:
-Projects:
-Zettel:
-
-`
-
-	FOOTER_TEMPLATE = "![[attachments/%s]]"
+	// Prepended to the prompt when the sidecar of the document gives its
+	// language
+	LANGUAGE_PROMPT = "The document is written in %s. Correct it in that language and do not translate it.\n\n"
 )
 
 func newOpenAIUploadFile(
@@ -117,9 +115,68 @@ func loadConfiguration(ctx context.Context) (*handlerConfig, error) {
 		return nil, err
 	}
 
+	cfg.tableOptions, err = parseTableOptions(os.Getenv)
+	if err != nil {
+		slog.Error("Invalid table options", "error", err)
+		return nil, err
+	}
+
 	return cfg, nil
 }
 
+// The prompt to clean up the Markdown. A document split from a scan is told
+// which pages of the PDF it came from, and the language from the sidecar of
+// the document is passed on.
+func buildPrompt(content []byte, document *types.Document) string {
+	prompt := fmt.Sprintf(CHAT_PROMPT, content)
+	if document.ParentID != "" && document.FirstPage != 0 {
+		prompt = fmt.Sprintf(SPLIT_PROMPT, document.FirstPage, document.LastPage) + prompt
+	}
+
+	if document.Directives != nil && document.Directives.Language != "" {
+		prompt = fmt.Sprintf(LANGUAGE_PROMPT, document.Directives.Language) + prompt
+	}
+
+	return prompt
+}
+
+// The cleanup runs unless the sidecar of the document skips it
+func runsCleanup(document *types.Document) bool {
+	return document.Directives == nil ||
+		document.Directives.Pipeline != types.PIPELINE_NO_CLEANUP
+}
+
+// Read the options for wide tables from the environment, falling back to the
+// defaults for anything that isn't configured.
+func parseTableOptions(getenv func(string) string) (markdown.TableOptions, error) {
+	options := markdown.DefaultTableOptions()
+
+	if policy := getenv("TABLE_POLICY"); policy != "" {
+		options.Policy = policy
+	}
+
+	for name, value := range map[string]*int{
+		"TABLE_MAX_COLUMNS":        &options.MaxColumns,
+		"TABLE_MAX_WIDTH":          &options.MaxWidth,
+		"TABLE_CHUNK_SIZE":         &options.ChunkSize,
+		"TABLE_TRANSPOSE_MAX_ROWS": &options.TransposeMaxRows,
+	} {
+		setting := getenv(name)
+		if setting == "" {
+			continue
+		}
+
+		parsed, err := strconv.Atoi(setting)
+		if err != nil {
+			return options, fmt.Errorf("invalid %s: %w", name, err)
+		}
+
+		*value = parsed
+	}
+
+	return options, options.Validate()
+}
+
 // Ensure that the configuration settings are only loaded once
 func initLambda(ctx context.Context) error {
 	var err error
@@ -133,54 +190,35 @@ func initLambda(ctx context.Context) error {
 	return err
 }
 
-func process(
+// Have the LLM clean up the Markdown from Mathpix against the original PDF
+func cleanUp(
 	ctx context.Context,
-	event types.DocumentStep,
-) (types.DocumentStep, error) {
-	slog.Debug(">>process")
-	defer slog.Debug("<<process")
-
-	ret := types.DocumentStep{}
-
-	if err := initLambda(ctx); err != nil {
-		slog.Error("Failed to initialize the lambda", "error", err)
-		return ret, err
-	}
-
-	// query the previous stage information
-	prevStage, err := cfg.store.GetDocumentStage(
-		ctx,
-		event.DocumentID,
-		event.Stage,
-	)
-	if err != nil {
-		slog.Error(
-			"Failed to get the previous stage information",
-			"id",
-			event.DocumentID,
-			"stage",
-			event.Stage,
-			"error",
-			err,
-		)
-		return ret, err
+	document *types.Document,
+	prevStage *types.DocumentProcessingStage,
+	openAIStage *types.DocumentProcessingStage,
+	content []byte,
+) (string, error) {
+	// Documents split from a scan use the PDF of the scan
+	pdfDocumentID := document.ID
+	if document.ParentID != "" {
+		pdfDocumentID = document.ParentID
 	}
 
 	// Get the downloaded stage to retrieve the original PDF
 	downloadedStage, err := cfg.store.GetDocumentStage(
 		ctx,
-		event.DocumentID,
+		pdfDocumentID,
 		types.DOCUMENT_STAGE_DOWNLOAD,
 	)
 	if err != nil {
 		slog.Error(
 			"Failed to get the downloaded stage information",
 			"id",
-			event.DocumentID,
+			document.ID,
 			"error",
 			err,
 		)
-		return ret, err
+		return "", err
 	}
 
 	// Download the original PDF from S3
@@ -198,7 +236,7 @@ func process(
 			"error",
 			err,
 		)
-		return ret, err
+		return "", err
 	}
 	defer pdfResp.Body.Close()
 
@@ -211,33 +249,18 @@ func process(
 			"error",
 			err,
 		)
-		return ret, err
-	}
-
-	openAIStage, err := cfg.store.StartDocumentStage(
-		ctx,
-		event.DocumentID,
-		types.DOCUMENT_STAGE_OPENAI,
-		prevStage.OriginalFileName,
-	)
-	if err != nil {
-		slog.Error(
-			"Failed to save the document processing stage",
-			"docName",
-			prevStage.OriginalFileName,
-			"error",
-			err,
-		)
-		return ret, err
+		return "", err
 	}
 
+	// the upload and the response are the time spent on OpenAI
+	started := time.Now()
 	uploadedPDF, err := cfg.openAIClient.Files.New(
 		ctx,
 		openai.FileNewParams{
 			File: newOpenAIUploadFile(
 				pdfBytes,
 				downloadedStage.OriginalFileName,
-				"application/pdf",
+				util.StageContentType(downloadedStage),
 			),
 			Purpose: openai.FilePurposeUserData,
 		},
@@ -250,7 +273,7 @@ func process(
 			"error",
 			err,
 		)
-		return ret, err
+		return "", err
 	}
 
 	defer func() {
@@ -268,37 +291,8 @@ func process(
 		}
 	}()
 
-	resp, err := cfg.s3Client.GetObject(ctx, &s3.GetObjectInput{
-		Bucket: aws.String(types.S3_BUCKET_NAME),
-		Key:    aws.String(prevStage.S3Key),
-	})
-	if err != nil {
-		slog.Error(
-			"Failed to get the document from S3",
-			"docName",
-			prevStage.OriginalFileName,
-			"error",
-			err,
-		)
-		return ret, err
-	}
-
-	defer resp.Body.Close()
-
-	content, err := io.ReadAll(resp.Body)
-	if err != nil {
-		slog.Error(
-			"Failed to read the input document to clean up",
-			"docName",
-			prevStage.OriginalFileName,
-			"error",
-			err,
-		)
-		return ret, err
-	}
-
 	// Create a prompt for the LLM to clean up the Markdown
-	prompt := fmt.Sprintf(CHAT_PROMPT, content)
+	prompt := buildPrompt(content, document)
 
 	// Call the OpenAI Responses API with the original PDF and Markdown prompt.
 	openAIResp, err := cfg.openAIClient.Responses.New(
@@ -335,53 +329,141 @@ func process(
 			"error",
 			err,
 		)
-		return ret, err
+		return "", err
 	}
+	openAIStage.ExternalMillis += time.Since(started).Milliseconds()
 
 	// Get the cleaned-up text
 	buffer := openAIResp.OutputText()
 
 	// Safety check: remove markdown code block wrapping if present
-	cleanedMarkdown := strings.TrimPrefix(
+	return strings.TrimPrefix(
 		strings.TrimSuffix(string(buffer), "```"),
 		"```markdown",
+	), nil
+}
+
+// Clean up the Markdown of the previous stage and save it as a note on the
+// stage
+func (cfg *handlerConfig) cleanUpDocument(
+	ctx context.Context,
+	event types.DocumentStep,
+	document *types.Document,
+	prevStage *types.DocumentProcessingStage,
+	openAIStage *types.DocumentProcessingStage,
+) error {
+	resp, err := cfg.s3Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(types.S3_BUCKET_NAME),
+		Key:    aws.String(prevStage.S3Key),
+	})
+	if err != nil {
+		slog.Error(
+			"Failed to get the document from S3",
+			"docName",
+			prevStage.OriginalFileName,
+			"error",
+			err,
+		)
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	content, err := io.ReadAll(resp.Body)
+	if err != nil {
+		slog.Error(
+			"Failed to read the input document to clean up",
+			"docName",
+			prevStage.OriginalFileName,
+			"error",
+			err,
+		)
+		return err
+	}
+
+	var cleanedMarkdown string
+	if runsCleanup(document) {
+		// check again before paying for the cleanup
+		err = util.CheckSuperseded(ctx, cfg.store, event.DocumentID)
+		if err != nil {
+			return err
+		}
+
+		cleanedMarkdown, err = cleanUp(ctx, document, prevStage, openAIStage, content)
+		if err != nil {
+			return err
+		}
+	} else {
+		slog.Info(
+			"Skipping the cleanup as the sidecar asks",
+			"docName",
+			prevStage.OriginalFileName,
+		)
+		cleanedMarkdown = string(content)
+	}
+
+	// Rewrite the tables that are too wide to read in Obsidian
+	cleanedMarkdown, tableChanges := markdown.FormatTables(
+		cleanedMarkdown,
+		cfg.tableOptions,
 	)
+	for _, change := range tableChanges {
+		slog.Info(
+			"Reformatted a wide table",
+			"docName",
+			prevStage.OriginalFileName,
+			"line",
+			change.Line,
+			"columns",
+			change.Columns,
+			"rows",
+			change.Rows,
+			"transformation",
+			change.Transformation,
+		)
+	}
 
 	// TODO: This should be a configuration
 	// build the header and footer for the note
-	name := util.GetNamePart(prevStage.OriginalFileName)
-	header := fmt.Sprintf(
-		HEADER_TEMPLATE,
-		name,
+	note, err := notes.Render(
+		notes.DefaultTemplates(),
+		notes.NewFields(
+			event.DocumentID,
+			util.DocumentBaseName(document),
+			prevStage.OriginalFileName,
+		),
 	)
-	footer := fmt.Sprintf(FOOTER_TEMPLATE, prevStage.OriginalFileName)
+	if err != nil {
+		slog.Error(
+			"Failed to render the note templates",
+			"docName",
+			prevStage.OriginalFileName,
+			"error",
+			err,
+		)
+		return err
+	}
 
 	// We want to append a link to the original scanned PDF at the end of the note
-	output := fmt.Sprintf("%s\n\n%s\n\n%s", header, cleanedMarkdown, footer)
+	output := note.Compose(cleanedMarkdown)
 
 	// get the bytes for the markdown file
 	body := []byte(output)
 
-	// Get the original document name w/o extension
-	documentName := util.GetNamePart(prevStage.OriginalFileName)
-
-	openAIStage.StageFileName = fmt.Sprintf(
-		"%s-%d.md",
-		documentName,
-		time.Now().Unix(),
-	)
+	openAIStage.StageFileName = util.StageFileName(util.DocumentBaseName(document), ".md")
 	openAIStage.S3Key = fmt.Sprintf(
 		"%s/%s",
 		openAIStage.Stage,
 		openAIStage.StageFileName,
 	)
+	openAIStage.ContentType = types.CONTENT_TYPE_MARKDOWN
 
 	//
 	_, err = cfg.s3Client.PutObject(ctx, &s3.PutObjectInput{
 		Bucket:        aws.String(BucketName),
 		Key:           aws.String(openAIStage.S3Key),
 		Body:          bytes.NewReader(body),
-		ContentType:   aws.String("text/markdown"),
+		ContentType:   aws.String(openAIStage.ContentType),
 		ContentLength: aws.Int64(int64(len(body))),
 	})
 	if err != nil {
@@ -394,9 +476,120 @@ func process(
 			"error",
 			err,
 		)
+		return err
+	}
+
+	return nil
+}
+
+// Record why the cleanup failed on the stage, so it doesn't stay in progress
+func (cfg *handlerConfig) failStage(
+	ctx context.Context,
+	stage *types.DocumentProcessingStage,
+	err error,
+) {
+	failErr := cfg.store.FailDocumentStage(
+		ctx,
+		stage,
+		types.DOCUMENT_STATUS_ERROR,
+		errorsmap.Classify(err),
+		err.Error(),
+	)
+	if failErr != nil {
+		slog.Error(
+			"Failed to update the processing stage as failed",
+			"id",
+			stage.ID,
+			"error",
+			failErr,
+		)
+	}
+}
+
+func process(
+	ctx context.Context,
+	event types.DocumentStep,
+) (types.DocumentStep, error) {
+	slog.Debug(">>process")
+	defer slog.Debug("<<process")
+
+	ret := types.DocumentStep{}
+
+	// a malformed input fails here rather than as a missing stage
+	if err := util.ValidateStep(event); err != nil {
+		slog.Error("Invalid step input", "error", err)
+		return ret, err
+	}
+
+	if err := initLambda(ctx); err != nil {
+		slog.Error("Failed to initialize the lambda", "error", err)
+		return ret, err
+	}
+
+	// a newer revision replaced the document, or the scan it was split from
+	err := util.CheckSuperseded(ctx, cfg.store, event.DocumentID)
+	if err != nil {
+		return ret, err
+	}
+
+	// query the previous stage information
+	prevStage, err := cfg.store.GetDocumentStage(
+		ctx,
+		event.DocumentID,
+		event.Stage,
+	)
+	if err != nil {
+		slog.Error(
+			"Failed to get the previous stage information",
+			"id",
+			event.DocumentID,
+			"stage",
+			event.Stage,
+			"error",
+			err,
+		)
 		return ret, err
 	}
 
+	document, err := cfg.store.GetDocument(ctx, event.DocumentID)
+	if err != nil {
+		slog.Error(
+			"Failed to get the document information",
+			"id",
+			event.DocumentID,
+			"error",
+			err,
+		)
+		return ret, err
+	}
+
+	openAIStage, err := cfg.store.StartDocumentStage(
+		ctx,
+		event.DocumentID,
+		types.DOCUMENT_STAGE_OPENAI,
+		prevStage.OriginalFileName,
+	)
+	if err != nil {
+		slog.Error(
+			"Failed to save the document processing stage",
+			"docName",
+			prevStage.OriginalFileName,
+			"error",
+			err,
+		)
+		return ret, err
+	}
+
+	err = cfg.cleanUpDocument(ctx, event, document, prevStage, openAIStage)
+	if err != nil {
+		// a superseded document didn't fail, the newer version is
+		// processed in its place
+		if !util.IsSuperseded(err) {
+			cfg.failStage(ctx, openAIStage, err)
+		}
+		return ret, util.StageError(openAIStage, err)
+	}
+
 	// Update the stage to complete
 	err = cfg.store.CompleteDocumentStage(ctx, openAIStage)
 	if err != nil {
@@ -412,6 +605,7 @@ func process(
 
 	// read doc from bucket
 	ret.NotificationID = event.NotificationID
+	ret.ChannelID = event.ChannelID
 	ret.DocumentID = event.DocumentID
 	ret.Stage = types.DOCUMENT_STAGE_OPENAI
 
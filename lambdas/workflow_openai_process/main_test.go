@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/KyleBrandon/scriptor/lambdas/util"
+	"github.com/KyleBrandon/scriptor/pkg/database"
+	"github.com/KyleBrandon/scriptor/pkg/errorsmap"
+	"github.com/KyleBrandon/scriptor/pkg/types"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+func TestBuildPrompt(t *testing.T) {
+	content := []byte("# Notes")
+	prompt := fmt.Sprintf(CHAT_PROMPT, content)
+	split := fmt.Sprintf(SPLIT_PROMPT, 3, 5)
+	spanish := fmt.Sprintf(LANGUAGE_PROMPT, "Spanish")
+
+	tests := []struct {
+		name     string
+		document *types.Document
+		want     string
+	}{
+		{
+			name:     "whole document",
+			document: &types.Document{},
+			want:     prompt,
+		},
+		{
+			name:     "document split from a scan",
+			document: &types.Document{ParentID: "scan", FirstPage: 3, LastPage: 5},
+			want:     split + prompt,
+		},
+		{
+			name: "language from the sidecar",
+			document: &types.Document{
+				ParentID:   "scan",
+				FirstPage:  3,
+				LastPage:   5,
+				Directives: &types.DocumentDirectives{Language: "Spanish"},
+			},
+			want: spanish + split + prompt,
+		},
+		{
+			name:     "sidecar without a language",
+			document: &types.Document{Directives: &types.DocumentDirectives{Title: "Notes"}},
+			want:     prompt,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := buildPrompt(content, tc.document); got != tc.want {
+				t.Fatalf("unexpected prompt:\ngot  %q\nwant %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestRunsCleanup(t *testing.T) {
+	tests := []struct {
+		name       string
+		directives *types.DocumentDirectives
+		want       bool
+	}{
+		{name: "no sidecar", want: true},
+		{name: "full pipeline", directives: &types.DocumentDirectives{Pipeline: types.PIPELINE_FULL}, want: true},
+		{name: "sidecar without a pipeline", directives: &types.DocumentDirectives{Language: "fr"}, want: true},
+		{name: "cleanup skipped", directives: &types.DocumentDirectives{Pipeline: types.PIPELINE_NO_CLEANUP}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := runsCleanup(&types.Document{Directives: tc.directives}); got != tc.want {
+				t.Fatalf("unexpected result: got %v want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+// A document table holding one document that skips the cleanup, keeping the
+// stages failed
+type fakeStore struct {
+	database.DocumentStore
+	failed []*types.DocumentProcessingStage
+}
+
+func (s *fakeStore) GetDocument(ctx context.Context, id string) (*types.Document, error) {
+	return &types.Document{
+		ID:         id,
+		Name:       "notes.pdf",
+		Directives: &types.DocumentDirectives{Pipeline: types.PIPELINE_NO_CLEANUP},
+	}, nil
+}
+
+func (s *fakeStore) GetDocumentStage(
+	ctx context.Context,
+	id string,
+	stage types.Stage,
+) (*types.DocumentProcessingStage, error) {
+	return &types.DocumentProcessingStage{
+		ID:               id,
+		Stage:            stage,
+		S3Key:            "mathpix/" + id + ".md",
+		OriginalFileName: "notes.pdf",
+	}, nil
+}
+
+func (s *fakeStore) StartDocumentStage(
+	ctx context.Context,
+	id string,
+	stage types.Stage,
+	fileName string,
+) (*types.DocumentProcessingStage, error) {
+	return &types.DocumentProcessingStage{
+		ID:               id,
+		Stage:            stage,
+		StageStatus:      types.DOCUMENT_STATUS_INPROGRESS,
+		OriginalFileName: fileName,
+	}, nil
+}
+
+func (s *fakeStore) FailDocumentStage(
+	ctx context.Context,
+	stage *types.DocumentProcessingStage,
+	status, code, reason string,
+) error {
+	stage.StageStatus = status
+	stage.ErrorCode = code
+	stage.ErrorReason = reason
+	s.failed = append(s.failed, stage)
+
+	return nil
+}
+
+func TestProcessFailsStage(t *testing.T) {
+	tests := []struct {
+		name      string
+		getStatus int
+		putStatus int
+	}{
+		{name: "previous stage missing", getStatus: http.StatusNotFound, putStatus: http.StatusOK},
+		{name: "note not saved", getStatus: http.StatusOK, putStatus: http.StatusForbidden},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			bucket := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method == http.MethodPut {
+					w.WriteHeader(tc.putStatus)
+					return
+				}
+
+				w.WriteHeader(tc.getStatus)
+				if tc.getStatus == http.StatusOK {
+					w.Write([]byte("# Notes"))
+				}
+			}))
+			defer bucket.Close()
+
+			store := &fakeStore{}
+			initOnce.Do(func() {})
+			cfg = &handlerConfig{
+				store: store,
+				s3Client: s3.New(s3.Options{
+					Region:           "us-east-1",
+					BaseEndpoint:     aws.String(bucket.URL),
+					Credentials:      aws.AnonymousCredentials{},
+					UsePathStyle:     true,
+					RetryMaxAttempts: 1,
+				}),
+			}
+
+			_, err := process(context.Background(), types.DocumentStep{
+				DocumentID: "doc-1",
+				Stage:      types.DOCUMENT_STAGE_MATHPIX,
+			})
+			var failure *util.StageFailedError
+			if !errors.As(err, &failure) || failure.Stage != types.DOCUMENT_STAGE_OPENAI {
+				t.Fatalf("expected the openai stage to fail: %v", err)
+			}
+
+			if len(store.failed) != 1 {
+				t.Fatalf("unexpected stages failed: %+v", store.failed)
+			}
+
+			stage := store.failed[0]
+			if stage.Stage != types.DOCUMENT_STAGE_OPENAI ||
+				stage.StageStatus != types.DOCUMENT_STATUS_ERROR ||
+				stage.ErrorCode != errorsmap.CODE_UNKNOWN ||
+				stage.ErrorReason != failure.Err.Error() {
+				t.Fatalf("unexpected failed stage: %+v", *stage)
+			}
+		})
+	}
+}
+
+func TestProcessRejectsMalformedInput(t *testing.T) {
+	tests := []struct {
+		name string
+		step types.DocumentStep
+	}{
+		{name: "unknown stage", step: types.DocumentStep{DocumentID: "doc-1", Stage: "chatgpt"}},
+		{name: "no stage", step: types.DocumentStep{DocumentID: "doc-1"}},
+		{name: "no document", step: types.DocumentStep{Stage: types.DOCUMENT_STAGE_MATHPIX}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			// the input is rejected before the tables are read, any call to
+			// the store panics
+			initOnce.Do(func() {})
+			cfg = &handlerConfig{store: struct{ database.DocumentStore }{}}
+
+			if _, err := process(context.Background(), tc.step); err == nil {
+				t.Fatal("expected an error")
+			}
+		})
+	}
+}
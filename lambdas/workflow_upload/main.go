@@ -1,16 +1,30 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
+	"os"
 	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/KyleBrandon/scriptor/lambdas/util"
+	"github.com/KyleBrandon/scriptor/pkg/attest"
 	"github.com/KyleBrandon/scriptor/pkg/database"
+	"github.com/KyleBrandon/scriptor/pkg/errorsmap"
 	"github.com/KyleBrandon/scriptor/pkg/google"
+	"github.com/KyleBrandon/scriptor/pkg/markdown"
+	"github.com/KyleBrandon/scriptor/pkg/metrics"
+	"github.com/KyleBrandon/scriptor/pkg/notes"
 	"github.com/KyleBrandon/scriptor/pkg/types"
 	"github.com/aws/aws-lambda-go/lambda"
 	"github.com/aws/aws-sdk-go-v2/aws"
@@ -18,12 +32,113 @@ import (
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 )
 
-type handlerConfig struct {
-	store           database.DocumentStore
-	dc              *google.GoogleDriveContext
-	folderLocations *types.GoogleFolderDefaultLocations
-	s3Client        *s3.Client
-}
+type (
+	// The part of Google Drive used to publish the document
+	documentPublisher interface {
+		FileExists(ctx context.Context, documentID, fileName, folderID string) (bool, error)
+		SavedFileID(ctx context.Context, documentID, fileName, folderID string) (string, error)
+		SaveFile(
+			ctx context.Context,
+			documentID, fileName, folderID, contentType string,
+			reader io.Reader,
+		) error
+		SaveFileAs(
+			ctx context.Context,
+			documentID, fileName, folderID string,
+			sourceMimeType, targetMimeType string,
+			reader io.Reader,
+		) error
+		Archive(ctx context.Context, id string, archiveFolderID string) error
+		CopyFile(ctx context.Context, documentID, id, folderID string) error
+		SetAppProperties(ctx context.Context, id string, properties map[string]string) error
+		AddComment(ctx context.Context, fileID, text string) error
+		ReadSavedFile(ctx context.Context, documentID, fileName, folderID string) ([]byte, error)
+		TrashSavedFile(ctx context.Context, documentID, fileName, folderID string) error
+		TrashDocumentFiles(ctx context.Context, documentID, folderID string) error
+		EnsureFolderPath(ctx context.Context, parentID string, segments []string) (string, error)
+		ForgetFolderPaths()
+	}
+
+	// The part of the S3 client used to read the stage files and keep the
+	// final note
+	objectStore interface {
+		GetObject(
+			ctx context.Context,
+			params *s3.GetObjectInput,
+			optFns ...func(*s3.Options),
+		) (*s3.GetObjectOutput, error)
+		PutObject(
+			ctx context.Context,
+			params *s3.PutObjectInput,
+			optFns ...func(*s3.Options),
+		) (*s3.PutObjectOutput, error)
+	}
+
+	// What the upload publishes to each destination folder. Documents split
+	// from a scan have no original and the scan has no note of its own.
+	publication struct {
+		document      *types.Document
+		channel       *types.WatchChannel
+		originalStage *types.DocumentProcessingStage
+		noteStage     *types.DocumentProcessingStage
+		note          []byte
+		namer         fileNamer
+		formats       noteFormats
+
+		// The Markdown note as an index and its parts when it was too large
+		// to publish as one
+		split *noteSet
+
+		// Parts of earlier runs that the note set replaces
+		staleParts []stalePart
+
+		// Version before the document, its files are removed from the
+		// folders published to so the newer version takes their place
+		replaces string
+
+		// Folders this attempt saved files to
+		folders []string
+	}
+
+	// A note split into parts that link to each other, the index is
+	// published under the name of the note
+	noteSet struct {
+		index []byte
+		parts []notePart
+	}
+
+	notePart struct {
+		fileName string
+		content  []byte
+	}
+
+	// A part saved for the document by an earlier run
+	stalePart struct {
+		documentID string
+		fileName   string
+	}
+
+	// A Markdown note Drive stored differently than it was published, even
+	// after it was saved again
+	noteMismatchError struct {
+		fileName string
+		reason   string
+	}
+
+	handlerConfig struct {
+		store           database.DocumentStore
+		wcStore         database.WatchChannelStore
+		dc              documentPublisher
+		folderLocations *types.GoogleFolderDefaultLocations
+		s3Client        objectStore
+		attachment      notes.AttachmentOptions
+		splitOptions    markdown.SplitOptions
+	}
+)
+
+// Times a Markdown note is saved before a note Drive stored differently
+// fails the upload
+const NOTE_SAVE_ATTEMPTS = 2
 
 var (
 	BucketName string = types.S3_BUCKET_NAME
@@ -57,12 +172,32 @@ func loadConfiguration(ctx context.Context) (*handlerConfig, error) {
 
 	cfg.s3Client = s3.NewFromConfig(awsCfg)
 
+	// how the notes link to the original document
+	cfg.attachment.Style, err = notes.ParseAttachmentStyle(os.Getenv("ATTACHMENT_LINK"))
+	if err != nil {
+		slog.Error("Failed to read the attachment link style", "error", err)
+		return nil, err
+	}
+	cfg.attachment.Prefix = os.Getenv("ATTACHMENT_PREFIX")
+
+	cfg.splitOptions, err = parseSplitOptions(os.Getenv)
+	if err != nil {
+		slog.Error("Failed to read the note split options", "error", err)
+		return nil, err
+	}
+
 	cfg.store, err = database.NewDocumentStore(ctx)
 	if err != nil {
 		slog.Error("Failed to configure the DynamoDB client", "error", err)
 		return nil, err
 	}
 
+	cfg.wcStore, err = database.NewWatchChannelStore(ctx)
+	if err != nil {
+		slog.Error("Failed to configure the watch channel store", "error", err)
+		return nil, err
+	}
+
 	cfg.dc, err = google.NewGoogleDrive(ctx)
 	if err != nil {
 		//
@@ -77,6 +212,31 @@ func loadConfiguration(ctx context.Context) (*handlerConfig, error) {
 	return cfg, nil
 }
 
+// Read the limits for splitting large notes from the environment. Notes are
+// not split unless a limit is set.
+func parseSplitOptions(getenv func(string) string) (markdown.SplitOptions, error) {
+	var options markdown.SplitOptions
+
+	for name, value := range map[string]*int{
+		"NOTE_SPLIT_MAX_BYTES":    &options.MaxBytes,
+		"NOTE_SPLIT_MAX_HEADINGS": &options.MaxHeadings,
+	} {
+		setting := getenv(name)
+		if setting == "" {
+			continue
+		}
+
+		parsed, err := strconv.Atoi(setting)
+		if err != nil {
+			return options, fmt.Errorf("invalid %s: %w", name, err)
+		}
+
+		*value = parsed
+	}
+
+	return options, options.Validate()
+}
+
 // Ensure that the configuration settings are only loaded once
 func initLambda(ctx context.Context) error {
 	var err error
@@ -90,6 +250,120 @@ func initLambda(ctx context.Context) error {
 	return err
 }
 
+// Use the destination and archive folders of the watch channel, falling back
+// to the defaults for the folders the channel doesn't set. The destinations
+// of the channel replace all of the default destinations.
+func channelFolders(
+	defaults *types.GoogleFolderDefaultLocations,
+	wc *types.WatchChannel,
+) *types.GoogleFolderDefaultLocations {
+	folders := *defaults
+
+	if wc.FolderID != "" {
+		folders.FolderID = wc.FolderID
+	}
+
+	if destinations := wc.Destinations(); len(destinations) > 0 {
+		folders.DestFolderID = destinations[0]
+		folders.DestFolderIDs = destinations
+	}
+
+	if wc.ArchiveFolderID != "" {
+		folders.ArchiveFolderID = wc.ArchiveFolderID
+	}
+
+	return &folders
+}
+
+// Publish to the route the sidecar of the document names instead of the
+// destinations of the channel. A route the channel doesn't have keeps the
+// destinations of the channel.
+func routeFolders(
+	folders *types.GoogleFolderDefaultLocations,
+	wc *types.WatchChannel,
+	document *types.Document,
+) *types.GoogleFolderDefaultLocations {
+	if document.Directives == nil || document.Directives.Route == "" {
+		return folders
+	}
+
+	folderID := wc.Routes[document.Directives.Route]
+	if folderID == "" {
+		slog.Warn(
+			"The route of the sidecar isn't one of the routes of the channel",
+			"id",
+			document.ID,
+			"route",
+			document.Directives.Route,
+			"folderID",
+			wc.FolderID,
+		)
+		return folders
+	}
+
+	routed := *folders
+	routed.DestFolderID = folderID
+	routed.DestFolderIDs = []string{folderID}
+
+	return &routed
+}
+
+// The formats the note is published in
+type noteFormats struct {
+	markdown  bool
+	googleDoc bool
+}
+
+// Publish the note in the formats the watch channel asks for. The Markdown
+// note can only be skipped when a Google Doc is published in its place.
+func channelFormats(wc *types.WatchChannel) noteFormats {
+	return noteFormats{
+		markdown:  !wc.PublishGoogleDoc || !wc.SkipMarkdown,
+		googleDoc: wc.PublishGoogleDoc,
+	}
+}
+
+// Get the watch channel of the folder the document was found in. Documents
+// that didn't come from a watch channel get an empty channel so they use the
+// defaults.
+func (cfg *handlerConfig) resolveChannel(
+	ctx context.Context,
+	document *types.Document,
+) (*types.WatchChannel, error) {
+	if document.ChannelID == "" || document.GoogleFolderID == "" {
+		return &types.WatchChannel{}, nil
+	}
+
+	wc, err := cfg.wcStore.GetWatchChannel(ctx, document.GoogleFolderID)
+	if err != nil {
+		return nil, err
+	}
+
+	if wc.FolderID == "" {
+		slog.Warn(
+			"Watch channel for the document no longer exists, using the defaults",
+			"id",
+			document.ID,
+			"folderID",
+			document.GoogleFolderID,
+		)
+	}
+
+	return wc, nil
+}
+
+// The children of a split scan that haven't been published
+func pendingChildren(document *types.Document) []string {
+	pending := make([]string, 0)
+	for _, childID := range document.ChildIDs {
+		if !slices.Contains(document.ChildrenCompleted, childID) {
+			pending = append(pending, childID)
+		}
+	}
+
+	return pending
+}
+
 func (cfg *handlerConfig) getFileReaderForStage(
 	ctx context.Context,
 	s3FileKey string,
@@ -108,180 +382,1452 @@ func (cfg *handlerConfig) getFileReaderForStage(
 
 }
 
-func (cfg *handlerConfig) saveStageToFolder(
-	ctx context.Context,
-	docStage *types.DocumentProcessingStage,
-	folderID, baseName string,
-) error {
+// Names the files published for a document from the filename template
+type fileNamer struct {
+	template string
+	fields   notes.FilenameFields
+}
 
-	// Get a reader from the S3 file location
-	docReader, err := cfg.getFileReaderForStage(ctx, docStage.S3Key)
+// Build the namer for the document. The title is the one from the sidecar
+// of the document, or the first heading of the note, falling back to the
+// original name.
+func newFileNamer(template string, document *types.Document, note []byte) fileNamer {
+	created := document.CreatedTime
+	if created.IsZero() {
+		created = time.Now().UTC()
+	}
+
+	fields := notes.FilenameFields{
+		Date:         created.Format(notes.FILENAME_DATE_FORMAT),
+		OriginalName: util.DocumentBaseName(document),
+		Title:        notes.Title(string(note)),
+	}
+	if document.Directives != nil && document.Directives.Title != "" {
+		fields.Title = document.Directives.Title
+	}
+	if fields.Title == "" {
+		fields.Title = fields.OriginalName
+	}
+
+	return fileNamer{template: template, fields: fields}
+}
+
+// The name for a file of the stage without an extension
+func (n fileNamer) name(stage types.Stage) (string, error) {
+	fields := n.fields
+	fields.Stage = string(stage)
+
+	return notes.RenderFilename(n.template, fields)
+}
+
+// Stages append a ULID to file names for processing and we want to
+// save the file with the rendered name and the extension from the stage
+func (n fileNamer) stageFileName(docStage *types.DocumentProcessingStage) (string, error) {
+	name, err := n.name(docStage.Stage)
+	if err != nil {
+		return "", err
+	}
+
+	return name + filepath.Ext(docStage.StageFileName), nil
+}
+
+// Check whether an earlier attempt already saved the file for the document
+// so a retry doesn't save it twice
+func (cfg *handlerConfig) alreadySaved(
+	ctx context.Context,
+	documentID, fileName, folderID string,
+) (bool, error) {
+	exists, err := cfg.dc.FileExists(ctx, documentID, fileName, folderID)
 	if err != nil {
 		slog.Error(
-			"Failed to get file reader for the LLM processed document",
+			"Failed to check the destination folder for the file",
+			"id",
+			documentID,
+			"fileName",
+			fileName,
 			"error",
 			err,
 		)
-		return err
+		return false, err
 	}
 
-	defer docReader.Close()
+	if exists {
+		slog.Info(
+			"File was saved by an earlier attempt",
+			"id",
+			documentID,
+			"fileName",
+			fileName,
+		)
+	}
 
-	// Stages append a timestamp to file names for processing and we want to
-	// save the file with the original file name and the extension from the stage
-	fileName := fmt.Sprintf(
-		"%s%s",
-		baseName,
-		filepath.Ext(docStage.StageFileName),
-	)
+	return exists, nil
+}
 
-	// Save the file to the destination folder
-	err = cfg.dc.SaveFile(fileName, folderID, docReader)
+// Save the file from the stage to the folder and return the hash of the
+// artifact that was saved
+func (cfg *handlerConfig) saveStageToFolder(
+	ctx context.Context,
+	documentID string,
+	docStage *types.DocumentProcessingStage,
+	folderID string,
+	namer fileNamer,
+) (string, error) {
+	fileName, err := namer.stageFileName(docStage)
 	if err != nil {
 		slog.Error(
-			"Failed to save the original document file to the destination folder",
+			"Failed to name the file from the filename template",
+			"id",
+			documentID,
 			"error",
 			err,
 		)
-		return err
+		return "", err
 	}
 
-	return nil
-}
-
-func process(ctx context.Context, event types.DocumentStep) error {
-	slog.Debug(">>process")
-	defer slog.Debug("<<process")
+	exists, err := cfg.alreadySaved(ctx, documentID, fileName, folderID)
+	if err != nil {
+		return "", err
+	}
 
-	if err := initLambda(ctx); err != nil {
-		slog.Error("Failed to initialize the lambda", "error", err)
-		return err
+	if exists {
+		return cfg.hashStage(ctx, docStage)
 	}
 
-	// query the previous stage information
-	prevStage, err := cfg.store.GetDocumentStage(
-		ctx,
-		event.DocumentID,
-		event.Stage,
-	)
+	// Get a reader from the S3 file location
+	docReader, err := cfg.getFileReaderForStage(ctx, docStage.S3Key)
 	if err != nil {
 		slog.Error(
-			"Failed to get the previous stage information",
-			"id",
-			event.DocumentID,
-			"stage",
-			event.Stage,
+			"Failed to get file reader for the LLM processed document",
 			"error",
 			err,
 		)
-		return err
+		return "", err
 	}
 
-	// Start the document upload stage
-	uploadStage, err := cfg.store.StartDocumentStage(
+	defer docReader.Close()
+
+	// hash the artifact as it is streamed to Google Drive
+	hash := sha256.New()
+
+	// Save the file to the destination folder as the type it was recorded
+	// with, so Drive doesn't guess it
+	err = cfg.dc.SaveFile(
 		ctx,
-		event.DocumentID,
-		types.DOCUMENT_STAGE_UPLOAD,
-		prevStage.OriginalFileName,
+		documentID,
+		fileName,
+		folderID,
+		util.StageContentType(docStage),
+		io.TeeReader(docReader, hash),
 	)
 	if err != nil {
 		slog.Error(
-			"Failed to start the Mathpix document processing stage",
+			"Failed to save the original document file to the destination folder",
 			"error",
 			err,
 		)
-		return err
+		return "", err
 	}
 
-	// query the download stage information stage information to get the original file
-	downloadedStage, err := cfg.store.GetDocumentStage(
-		ctx,
-		event.DocumentID,
-		types.DOCUMENT_STAGE_DOWNLOAD,
-	)
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// The YYYY/MM folders for the document, by when it was created
+func dateFolderSegments(document *types.Document) []string {
+	created := document.CreatedTime
+	if created.IsZero() {
+		created = time.Now().UTC()
+	}
+
+	return []string{created.Format("2006"), created.Format("01")}
+}
+
+// The folder to publish the document to. A channel with date folders
+// publishes into the YYYY/MM folders below its destination folder, creating
+// them as needed.
+func (cfg *handlerConfig) publishFolder(
+	ctx context.Context,
+	document *types.Document,
+	wc *types.WatchChannel,
+	destFolderID string,
+) (string, error) {
+	if !wc.DateFolders {
+		return destFolderID, nil
+	}
+
+	return cfg.dc.EnsureFolderPath(ctx, destFolderID, dateFolderSegments(document))
+}
+
+// The link to the original the note was made from. The original keeps its
+// Drive ID when it's archived. The documents split from a scan link to the
+// original of the scan.
+func (cfg *handlerConfig) attachmentLink(
+	ctx context.Context,
+	document *types.Document,
+	downloadedStage *types.DocumentProcessingStage,
+	namer fileNamer,
+) (string, error) {
+	if document.ParentID != "" {
+		parent, err := cfg.store.GetDocument(ctx, document.ParentID)
+		if err != nil {
+			return "", err
+		}
+
+		parentDownload, err := cfg.store.GetDocumentStage(
+			ctx,
+			parent.ID,
+			types.DOCUMENT_STAGE_DOWNLOAD,
+		)
+		if err != nil {
+			return "", err
+		}
+
+		// the scan is named from the Markdown of the whole scan
+		parentScan, err := cfg.store.GetDocumentStage(
+			ctx,
+			parent.ID,
+			types.DOCUMENT_STAGE_MATHPIX,
+		)
+		if err != nil {
+			return "", err
+		}
+
+		scan, err := cfg.readStage(ctx, parentScan)
+		if err != nil {
+			return "", err
+		}
+
+		return cfg.attachmentLink(
+			ctx,
+			parent,
+			parentDownload,
+			newFileNamer(namer.template, parent, scan),
+		)
+	}
+
+	fileName, err := namer.stageFileName(downloadedStage)
+	if err != nil {
+		return "", err
+	}
+
+	driveFileID := ""
+	if document.SourceType == types.DOCUMENT_SOURCE_GOOGLE_DRIVE {
+		driveFileID = document.GoogleID
+	}
+
+	return cfg.attachment.Link(fileName, driveFileID), nil
+}
+
+// Save the note to the folder in each of the formats
+func (cfg *handlerConfig) publishNote(
+	ctx context.Context,
+	documentID string,
+	docStage *types.DocumentProcessingStage,
+	note []byte,
+	split *noteSet,
+	folderID string,
+	namer fileNamer,
+	formats noteFormats,
+) error {
+	fileName, err := namer.stageFileName(docStage)
 	if err != nil {
 		slog.Error(
-			"Failed to get the Document Downloaded Stage information",
+			"Failed to name the note from the filename template",
 			"id",
-			event.DocumentID,
+			documentID,
 			"error",
 			err,
 		)
 		return err
 	}
 
-	// get the document record from DynamoDB
-	document, err := cfg.store.GetDocument(ctx, event.DocumentID)
+	if formats.markdown {
+		files := []notePart{{fileName: fileName, content: note}}
+		if split != nil {
+			files = append([]notePart{{fileName: fileName, content: split.index}}, split.parts...)
+		}
+
+		for _, file := range files {
+			err = cfg.saveVerifiedNote(ctx, documentID, file.fileName, folderID, file.content)
+			if err != nil {
+				slog.Error(
+					"Failed to save the note to the destination folder",
+					"fileName",
+					file.fileName,
+					"error",
+					err,
+				)
+				return err
+			}
+		}
+	}
+
+	if formats.googleDoc {
+		// the front matter would show up as text in the Google Doc
+		err = cfg.saveNote(
+			ctx,
+			documentID,
+			strings.TrimSuffix(fileName, filepath.Ext(fileName)),
+			folderID,
+			types.CONTENT_TYPE_MARKDOWN,
+			types.CONTENT_TYPE_GOOGLE_DOC,
+			[]byte(notes.StripFrontMatter(string(note))),
+		)
+		if err != nil {
+			slog.Error(
+				"Failed to save the note as a Google Doc to the destination folder",
+				"error",
+				err,
+			)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// The Drive ID and the name of the note published to the destination
+// folder, the Markdown note or the Google Doc when it's the only format.
+// The note is published either way, so failing to find it is only logged
+// and leaves the ID empty.
+func (cfg *handlerConfig) publishedNote(
+	ctx context.Context,
+	pub *publication,
+	destFolderID string,
+) (string, string) {
+	fileName, err := pub.namer.stageFileName(pub.noteStage)
 	if err != nil {
-		slog.Error(
-			"Failed to get the document information to archive",
+		return "", ""
+	}
+
+	if !pub.formats.markdown {
+		fileName = strings.TrimSuffix(fileName, filepath.Ext(fileName))
+	}
+
+	folderID, err := cfg.publishFolder(ctx, pub.document, pub.channel, destFolderID)
+	if err != nil {
+		slog.Warn(
+			"Failed to find the folder the note was published to",
 			"id",
-			event.DocumentID,
+			pub.document.ID,
+			"folderID",
+			destFolderID,
 			"error",
 			err,
 		)
-		return err
+		return "", fileName
 	}
 
-	baseName := util.GetNamePart(document.Name)
-
-	// Save the original PDF file to the destination folder
-	err = cfg.saveStageToFolder(
-		ctx,
-		downloadedStage,
-		cfg.folderLocations.DestFolderID,
-		baseName,
-	)
+	fileID, err := cfg.dc.SavedFileID(ctx, pub.document.ID, fileName, folderID)
 	if err != nil {
-		slog.Error(
-			"Failed to save the original PDF to the destination folder",
+		slog.Warn(
+			"Failed to find the published note",
 			"id",
-			event.DocumentID,
-			"folderID",
-			cfg.folderLocations.FolderID,
+			pub.document.ID,
+			"fileName",
+			fileName,
 			"error",
 			err,
 		)
-		return err
 	}
 
-	// Save the output from the last stage to the destination folder
-	err = cfg.saveStageToFolder(
-		ctx,
-		prevStage,
-		cfg.folderLocations.DestFolderID,
-		baseName,
-	)
+	return fileID, fileName
+}
+
+// Publish the original and the note to the destination folder, or the date
+// folder below it. Returns the hash of the original, empty when there is none.
+func (cfg *handlerConfig) publishTo(
+	ctx context.Context,
+	pub *publication,
+	destFolderID string,
+) (string, error) {
+	folderID, err := cfg.publishFolder(ctx, pub.document, pub.channel, destFolderID)
 	if err != nil {
 		slog.Error(
-			"Failed to save the final output stage to the destination folder",
+			"Failed to find the date folder to publish to",
 			"id",
-			event.DocumentID,
-			"stage",
-			prevStage.Stage,
+			pub.document.ID,
 			"folderID",
-			cfg.folderLocations.FolderID,
+			destFolderID,
 			"error",
 			err,
 		)
-		return err
+		return "", err
 	}
 
-	if document.SourceType == types.DOCUMENT_SOURCE_GOOGLE_DRIVE &&
+	pub.folders = append(pub.folders, folderID)
+
+	var originalHash string
+	if pub.originalStage != nil {
+		originalHash, err = cfg.saveStageToFolder(
+			ctx,
+			pub.document.ID,
+			pub.originalStage,
+			folderID,
+			pub.namer,
+		)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	if pub.noteStage != nil {
+		err = cfg.publishNote(
+			ctx,
+			pub.document.ID,
+			pub.noteStage,
+			pub.note,
+			pub.split,
+			folderID,
+			pub.namer,
+			pub.formats,
+		)
+		if err != nil {
+			return "", err
+		}
+
+		// the parts of earlier runs are only removed once the new set is
+		// saved
+		for _, stale := range pub.staleParts {
+			err = cfg.dc.TrashSavedFile(ctx, stale.documentID, stale.fileName, folderID)
+			if err != nil {
+				slog.Error(
+					"Failed to remove a part of an earlier run",
+					"id",
+					stale.documentID,
+					"fileName",
+					stale.fileName,
+					"error",
+					err,
+				)
+				return "", err
+			}
+		}
+	}
+
+	// the newer version always wins over the one before it, whichever
+	// published first
+	if pub.replaces != "" {
+		err = cfg.dc.TrashDocumentFiles(ctx, pub.replaces, folderID)
+		if err != nil {
+			slog.Error(
+				"Failed to remove the files of the superseded version",
+				"id",
+				pub.replaces,
+				"folderID",
+				folderID,
+				"error",
+				err,
+			)
+			return "", err
+		}
+	}
+
+	return originalHash, nil
+}
+
+// The version before the document, whether the document superseded it or it
+// finished first. Empty when there is none or another version superseded it.
+func (cfg *handlerConfig) replacedVersion(
+	ctx context.Context,
+	document *types.Document,
+) (string, error) {
+	if document.PreviousVersionID == "" {
+		return "", nil
+	}
+
+	// the previous version may have expired from the table
+	previous, err := cfg.store.GetDocument(ctx, document.PreviousVersionID)
+	if errors.Is(err, database.ErrDocumentNotFound) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if previous.SupersededBy != "" && previous.SupersededBy != document.ID {
+		return "", nil
+	}
+
+	return previous.ID, nil
+}
+
+// End the upload of a document that was superseded. Whatever this attempt
+// already saved is removed so only the newer version is left.
+func (cfg *handlerConfig) withdraw(
+	ctx context.Context,
+	pub *publication,
+	superseded error,
+) error {
+	for _, folderID := range pub.folders {
+		err := cfg.dc.TrashDocumentFiles(ctx, pub.document.ID, folderID)
+		if err != nil {
+			slog.Error(
+				"Failed to remove the files of the superseded document",
+				"id",
+				pub.document.ID,
+				"folderID",
+				folderID,
+				"error",
+				err,
+			)
+		}
+	}
+
+	return superseded
+}
+
+// Archive the original the way the watch channel asks for. The original is
+// moved to the archive folder by default, channels can copy it there instead
+// or leave it alone. The sidecar of the document goes along with it. Returns
+// the Drive ID of the archived original, empty when it wasn't archived.
+func (cfg *handlerConfig) archiveOriginal(
+	ctx context.Context,
+	document *types.Document,
+	wc *types.WatchChannel,
+	archiveFolderID string,
+) (string, error) {
+	mode, err := types.ParseArchiveMode(wc.ArchiveMode)
+	if err != nil {
+		return "", err
+	}
+
+	if mode == types.ARCHIVE_MODE_NONE {
+		slog.Info("Leaving the original in place", "id", document.ID)
+		return "", nil
+	}
+
+	archivedID, err := cfg.archiveFile(
+		ctx,
+		document.ID,
+		document.GoogleID,
+		document.Name,
+		mode,
+		archiveFolderID,
+	)
+	if err != nil {
+		return "", err
+	}
+
+	// the sidecar is not the document, failing to archive it is only
+	// logged
+	if document.Sidecar != nil {
+		_, err = cfg.archiveFile(
+			ctx,
+			document.ID,
+			document.Sidecar.GoogleID,
+			document.Sidecar.Name,
+			mode,
+			archiveFolderID,
+		)
+		if err != nil {
+			slog.Warn(
+				"Failed to archive the sidecar of the document",
+				"id",
+				document.ID,
+				"sidecar",
+				document.Sidecar.Name,
+				"error",
+				err,
+			)
+		}
+	}
+
+	return archivedID, nil
+}
+
+// Move or copy the file to the archive folder. Returns the Drive ID of the
+// file in the archive folder, empty when it's gone.
+func (cfg *handlerConfig) archiveFile(
+	ctx context.Context,
+	documentID, fileID, fileName, mode, archiveFolderID string,
+) (string, error) {
+	if mode == types.ARCHIVE_MODE_COPY {
+		// the copy keeps the name of the file, a retry doesn't copy it
+		// again
+		copyID, err := cfg.dc.SavedFileID(ctx, documentID, fileName, archiveFolderID)
+		if err != nil || copyID != "" {
+			return copyID, err
+		}
+
+		err = cfg.dc.CopyFile(ctx, documentID, fileID, archiveFolderID)
+		if err != nil {
+			return "", err
+		}
+
+		// the copy is made, not knowing its ID doesn't undo it
+		copyID, err = cfg.dc.SavedFileID(ctx, documentID, fileName, archiveFolderID)
+		if err != nil {
+			slog.Warn(
+				"Failed to find the copy of the file in the archive folder",
+				"id",
+				documentID,
+				"fileName",
+				fileName,
+				"error",
+				err,
+			)
+		}
+
+		return copyID, nil
+	}
+
+	// the note is published, a file that is gone has nothing to archive
+	err := cfg.dc.Archive(ctx, fileID, archiveFolderID)
+	if errors.Is(err, google.ErrFileGone) {
+		slog.Warn(
+			"The file is gone, it isn't archived",
+			"id",
+			documentID,
+			"fileName",
+			fileName,
+			"error",
+			err,
+		)
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	// a moved file keeps its ID
+	return fileID, nil
+}
+
+// Comment on the original with a link to the first destination. The note is
+// already published, so a failure only logs a warning.
+func (cfg *handlerConfig) commentProcessed(
+	ctx context.Context,
+	document *types.Document,
+	folders *types.GoogleFolderDefaultLocations,
+) {
+	destinations := folders.Destinations()
+	if len(destinations) == 0 {
+		return
+	}
+
+	err := cfg.dc.AddComment(ctx, document.GoogleID, google.ProcessedComment(destinations[0]))
+	if err != nil {
+		slog.Warn(
+			"Failed to comment on the original",
+			"id",
+			document.ID,
+			"googleID",
+			document.GoogleID,
+			"error",
+			err,
+		)
+	}
+}
+
+// Split the note into an index and parts when it's over the limits, nil
+// when it's published as one note. The front matter of the note is kept on
+// the index, and each part links to the index and the parts around it.
+func splitNote(
+	note []byte,
+	fileName string,
+	options markdown.SplitOptions,
+) *noteSet {
+	frontMatter, body := notes.SplitFrontMatter(string(note))
+	if !options.NeedsSplit(body) {
+		return nil
+	}
+
+	parts := markdown.Split(body, options)
+	if len(parts) < 2 {
+		return nil
+	}
+
+	links := make([]notes.PartLink, 0, len(parts))
+	for i, part := range parts {
+		title := part.Title
+		if title == "" {
+			title = fmt.Sprintf("Part %d", i+1)
+		}
+
+		links = append(links, notes.PartLink{
+			FileName: notes.PartFileName(fileName, i+1, len(parts)),
+			Title:    title,
+		})
+	}
+
+	title := notes.Title(string(note))
+	if title == "" {
+		title = strings.TrimSuffix(fileName, filepath.Ext(fileName))
+	}
+
+	index := notes.RenderIndex(title, links)
+	if frontMatter != "" {
+		index = frontMatter + "\n\n" + index
+	}
+
+	set := &noteSet{parts: make([]notePart, 0, len(parts))}
+	set.index, _ = attest.Stamp([]byte(index))
+	for i, part := range parts {
+		content, _ := attest.Stamp([]byte(
+			notes.AddNavigation(part.Content, notes.PartLink{FileName: fileName}, links, i),
+		))
+
+		set.parts = append(set.parts, notePart{
+			fileName: links[i].FileName,
+			content:  content,
+		})
+	}
+
+	return set
+}
+
+// The names of the parts, nil when the note wasn't split
+func (set *noteSet) fileNames() []string {
+	if set == nil {
+		return nil
+	}
+
+	names := make([]string, 0, len(set.parts))
+	for _, part := range set.parts {
+		names = append(names, part.fileName)
+	}
+
+	return names
+}
+
+// The parts saved by earlier runs that the note set doesn't replace by name,
+// and every part of the version of the document before this one
+func (cfg *handlerConfig) staleParts(
+	ctx context.Context,
+	document *types.Document,
+	split *noteSet,
+) ([]stalePart, error) {
+	current := split.fileNames()
+
+	stale := make([]stalePart, 0)
+	for _, fileName := range document.NoteParts {
+		if !slices.Contains(current, fileName) {
+			stale = append(stale, stalePart{documentID: document.ID, fileName: fileName})
+		}
+	}
+
+	if document.PreviousVersionID == "" {
+		return stale, nil
+	}
+
+	previous, err := cfg.store.GetDocument(ctx, document.PreviousVersionID)
+	if errors.Is(err, database.ErrDocumentNotFound) {
+		return stale, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, fileName := range previous.NoteParts {
+		stale = append(stale, stalePart{documentID: previous.ID, fileName: fileName})
+	}
+
+	return stale, nil
+}
+
+// Save the note unless an earlier attempt already did
+func (cfg *handlerConfig) saveNote(
+	ctx context.Context,
+	documentID, fileName, folderID string,
+	sourceMimeType, targetMimeType string,
+	content []byte,
+) error {
+	exists, err := cfg.alreadySaved(ctx, documentID, fileName, folderID)
+	if err != nil || exists {
+		return err
+	}
+
+	return cfg.dc.SaveFileAs(
+		ctx,
+		documentID,
+		fileName,
+		folderID,
+		sourceMimeType,
+		targetMimeType,
+		bytes.NewReader(content),
+	)
+}
+
+func (e *noteMismatchError) Error() string {
+	return fmt.Sprintf("%s: %s", e.fileName, e.reason)
+}
+
+// Save the Markdown note and read it back from Drive, so a note that Drive
+// stored differently is never left published. A note that doesn't match is
+// trashed and saved again, and fails the upload when it still doesn't.
+func (cfg *handlerConfig) saveVerifiedNote(
+	ctx context.Context,
+	documentID, fileName, folderID string,
+	content []byte,
+) error {
+	for attempt := 1; ; attempt++ {
+		err := cfg.saveNote(ctx, documentID, fileName, folderID, types.CONTENT_TYPE_MARKDOWN, "", content)
+		if err != nil {
+			return err
+		}
+
+		reason, err := cfg.verifyNote(ctx, documentID, fileName, folderID, content)
+		if err != nil || reason == "" {
+			return err
+		}
+
+		slog.Warn(
+			"Published note doesn't match the note it was published from",
+			"id",
+			documentID,
+			"fileName",
+			fileName,
+			"attempt",
+			attempt,
+			"reason",
+			reason,
+		)
+
+		err = cfg.dc.TrashSavedFile(ctx, documentID, fileName, folderID)
+		if err != nil {
+			return err
+		}
+
+		if attempt == NOTE_SAVE_ATTEMPTS {
+			return &noteMismatchError{fileName: fileName, reason: reason}
+		}
+	}
+}
+
+// Compare the note Drive stored with the note it was published from. Returns
+// why they differ, empty when they match.
+func (cfg *handlerConfig) verifyNote(
+	ctx context.Context,
+	documentID, fileName, folderID string,
+	content []byte,
+) (string, error) {
+	published, err := cfg.dc.ReadSavedFile(ctx, documentID, fileName, folderID)
+	if err != nil {
+		slog.Error(
+			"Failed to read back the published note",
+			"id",
+			documentID,
+			"fileName",
+			fileName,
+			"error",
+			err,
+		)
+		return "", err
+	}
+
+	mismatch, err := notes.Compare(content, published)
+	if err != nil {
+		return err.Error(), nil
+	}
+
+	if mismatch != nil {
+		return mismatch.Summary(), nil
+	}
+
+	return "", nil
+}
+
+// Record why the upload failed on the stage, so it doesn't stay in progress
+// and a mismatch can be looked at later
+func (cfg *handlerConfig) failUpload(
+	ctx context.Context,
+	stage *types.DocumentProcessingStage,
+	err error,
+) {
+	code := errorsmap.Classify(err)
+
+	var mismatch *noteMismatchError
+	if errors.As(err, &mismatch) {
+		code = errorsmap.CODE_PUBLISHED_NOTE_MISMATCH
+	}
+
+	failErr := cfg.store.FailDocumentStage(
+		ctx,
+		stage,
+		types.DOCUMENT_STATUS_ERROR,
+		code,
+		err.Error(),
+	)
+	if failErr != nil {
+		slog.Error(
+			"Failed to update the processing stage as failed",
+			"id",
+			stage.ID,
+			"error",
+			failErr,
+		)
+	}
+}
+
+// Save the note as it was published to the final prefix of the bucket,
+// named like the published note, and return its key
+func (cfg *handlerConfig) saveFinal(
+	ctx context.Context,
+	pub *publication,
+) (string, error) {
+	fileName, err := pub.namer.stageFileName(pub.noteStage)
+	if err != nil {
+		return "", err
+	}
+
+	key := fmt.Sprintf("%s/%s/%s", types.S3_FINAL_PREFIX, pub.document.ID, fileName)
+	_, err = cfg.s3Client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(BucketName),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(pub.note),
+		ContentType: aws.String(types.CONTENT_TYPE_MARKDOWN),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return key, nil
+}
+
+// Read the file of the stage
+func (cfg *handlerConfig) readStage(
+	ctx context.Context,
+	docStage *types.DocumentProcessingStage,
+) ([]byte, error) {
+	docReader, err := cfg.getFileReaderForStage(ctx, docStage.S3Key)
+	if err != nil {
+		return nil, err
+	}
+
+	defer docReader.Close()
+
+	return io.ReadAll(docReader)
+}
+
+// Hash the artifact of a stage that isn't published
+func (cfg *handlerConfig) hashStage(
+	ctx context.Context,
+	docStage *types.DocumentProcessingStage,
+) (string, error) {
+	docReader, err := cfg.getFileReaderForStage(ctx, docStage.S3Key)
+	if err != nil {
+		return "", err
+	}
+
+	defer docReader.Close()
+
+	return attest.ArtifactHash(docReader)
+}
+
+func process(ctx context.Context, event types.DocumentStep) (err error) {
+	slog.Debug(">>process")
+	defer slog.Debug("<<process")
+
+	// a malformed input fails here rather than as a missing stage
+	if err := util.ValidateStep(event); err != nil {
+		slog.Error("Invalid step input", "error", err)
+		return err
+	}
+
+	if err := initLambda(ctx); err != nil {
+		slog.Error("Failed to initialize the lambda", "error", err)
+		return err
+	}
+
+	// a newer revision replaced the document, or the scan it was split from
+	err = util.CheckSuperseded(ctx, cfg.store, event.DocumentID)
+	if err != nil {
+		return err
+	}
+
+	// query the previous stage information
+	prevStage, err := cfg.store.GetDocumentStage(
+		ctx,
+		event.DocumentID,
+		event.Stage,
+	)
+	if err != nil {
+		slog.Error(
+			"Failed to get the previous stage information",
+			"id",
+			event.DocumentID,
+			"stage",
+			event.Stage,
+			"error",
+			err,
+		)
+		return err
+	}
+
+	// the destinations an earlier attempt finished publishing to
+	previousUpload, err := cfg.store.GetDocumentStage(
+		ctx,
+		event.DocumentID,
+		types.DOCUMENT_STAGE_UPLOAD,
+	)
+	if err != nil && !errors.Is(err, database.ErrStageNotFound) {
+		slog.Error(
+			"Failed to get the earlier upload stage information",
+			"id",
+			event.DocumentID,
+			"error",
+			err,
+		)
+		return err
+	}
+
+	// Start the document upload stage
+	uploadStage, err := cfg.store.StartDocumentStage(
+		ctx,
+		event.DocumentID,
+		types.DOCUMENT_STAGE_UPLOAD,
+		prevStage.OriginalFileName,
+	)
+	if err != nil {
+		slog.Error(
+			"Failed to start the Mathpix document processing stage",
+			"error",
+			err,
+		)
+		return err
+	}
+
+	// an upload that fails from here on is recorded on the stage, a
+	// superseded document didn't fail
+	defer func() {
+		if err != nil && !util.IsSuperseded(err) {
+			cfg.failUpload(ctx, uploadStage, err)
+		}
+		err = util.StageError(uploadStage, err)
+	}()
+
+	// starting the stage replaces its record, keep the finished destinations
+	uploadStage.CompletedDestinations = previousUpload.CompletedDestinations
+	err = cfg.store.CompleteStageDestinations(
+		ctx,
+		event.DocumentID,
+		types.DOCUMENT_STAGE_UPLOAD,
+		uploadStage.CompletedDestinations,
+	)
+	if err != nil {
+		return err
+	}
+
+	// query the download stage information stage information to get the original file
+	downloadedStage, err := cfg.store.GetDocumentStage(
+		ctx,
+		event.DocumentID,
+		types.DOCUMENT_STAGE_DOWNLOAD,
+	)
+	if err != nil {
+		slog.Error(
+			"Failed to get the Document Downloaded Stage information",
+			"id",
+			event.DocumentID,
+			"error",
+			err,
+		)
+		return err
+	}
+
+	// get the document record from DynamoDB
+	document, err := cfg.store.GetDocument(ctx, event.DocumentID)
+	if err != nil {
+		slog.Error(
+			"Failed to get the document information to archive",
+			"id",
+			event.DocumentID,
+			"error",
+			err,
+		)
+		return err
+	}
+
+	wc, err := cfg.resolveChannel(ctx, document)
+	if err != nil {
+		slog.Error(
+			"Failed to get the watch channel of the document",
+			"id",
+			event.DocumentID,
+			"folderID",
+			document.GoogleFolderID,
+			"error",
+			err,
+		)
+		return err
+	}
+
+	folders := routeFolders(channelFolders(cfg.folderLocations, wc), wc, document)
+
+	// the note is read up front as its title can be part of the file names
+	note, err := cfg.readStage(ctx, prevStage)
+	if err != nil {
+		slog.Error(
+			"Failed to read the note to publish",
+			"id",
+			event.DocumentID,
+			"key",
+			prevStage.S3Key,
+			"error",
+			err,
+		)
+		return err
+	}
+
+	namer := newFileNamer(util.FilenameTemplate(wc), document, note)
+
+	// A scan split into several documents publishes a note for each child
+	// and only saves and archives the original once they are all published.
+	// The children have no original of their own.
+	isParent := len(event.Children) > 0
+	isChild := document.ParentID != ""
+
+	if isParent {
+		if pending := pendingChildren(document); len(pending) > 0 {
+			slog.Error(
+				"The documents split from the scan haven't all been published",
+				"id",
+				event.DocumentID,
+				"pending",
+				pending,
+			)
+			return fmt.Errorf(
+				"%d child documents of %s are not complete",
+				len(pending),
+				document.ID,
+			)
+		}
+	}
+
+	pub := &publication{
+		document: document,
+		channel:  wc,
+		namer:    namer,
+		formats:  channelFormats(wc),
+	}
+
+	if !isChild {
+		pub.originalStage = downloadedStage
+	}
+
+	pub.replaces, err = cfg.replacedVersion(ctx, document)
+	if err != nil {
+		slog.Error(
+			"Failed to get the version before the document",
+			"id",
+			event.DocumentID,
+			"previousID",
+			document.PreviousVersionID,
+			"error",
+			err,
+		)
+		return err
+	}
+
+	var noteArtifactHash, noteHash string
+	if !isParent {
+		link, err := cfg.attachmentLink(ctx, document, downloadedStage, namer)
+		if err != nil {
+			slog.Error(
+				"Failed to build the link to the original document",
+				"id",
+				event.DocumentID,
+				"error",
+				err,
+			)
+			return err
+		}
+
+		noteArtifactHash, err = attest.ArtifactHash(bytes.NewReader(note))
+		if err != nil {
+			return err
+		}
+
+		// the published note differs from the stage artifact by the link to
+		// the original and the tags from the sidecar, which are covered by
+		// the hash of the note
+		resolved := notes.ResolveAttachment(note, link)
+		if document.Directives != nil && len(document.Directives.Tags) > 0 {
+			tagged, err := notes.AddTags(string(resolved), document.Directives.Tags)
+			if err != nil {
+				slog.Error(
+					"Failed to add the tags from the sidecar to the note",
+					"id",
+					event.DocumentID,
+					"error",
+					err,
+				)
+				return err
+			}
+			resolved = []byte(tagged)
+		}
+		pub.noteStage = prevStage
+		pub.note, noteHash = attest.Stamp(resolved)
+
+		// a note that's too large is published as an index and parts, the
+		// hash chain still covers the whole note
+		fileName, err := namer.stageFileName(prevStage)
+		if err != nil {
+			slog.Error(
+				"Failed to name the note from the filename template",
+				"id",
+				event.DocumentID,
+				"error",
+				err,
+			)
+			return err
+		}
+
+		pub.split = splitNote(resolved, fileName, cfg.splitOptions)
+
+		pub.staleParts, err = cfg.staleParts(ctx, document, pub.split)
+		if err != nil {
+			slog.Error(
+				"Failed to find the parts of earlier runs",
+				"id",
+				event.DocumentID,
+				"error",
+				err,
+			)
+			return err
+		}
+	}
+
+	// look the date folders up again in case they were moved since the
+	// last invocation
+	cfg.dc.ForgetFolderPaths()
+
+	var originalHash string
+	for _, destFolderID := range folders.Destinations() {
+		// destinations an earlier attempt finished are not published again
+		if slices.Contains(uploadStage.CompletedDestinations, destFolderID) {
+			slog.Info(
+				"Destination was published by an earlier attempt",
+				"id",
+				event.DocumentID,
+				"folderID",
+				destFolderID,
+			)
+			continue
+		}
+
+		// checked right before writing to Drive, a document superseded
+		// since it was read publishes nothing more
+		err = util.CheckSuperseded(ctx, cfg.store, event.DocumentID)
+		if util.IsSuperseded(err) {
+			return cfg.withdraw(ctx, pub, err)
+		}
+		if err != nil {
+			return err
+		}
+
+		hash, err := cfg.publishTo(ctx, pub, destFolderID)
+		if err != nil {
+			slog.Error(
+				"Failed to publish the document to the destination folder",
+				"id",
+				event.DocumentID,
+				"folderID",
+				destFolderID,
+				"error",
+				err,
+			)
+			return err
+		}
+
+		originalHash = hash
+
+		err = cfg.store.CompleteStageDestinations(
+			ctx,
+			document.ID,
+			types.DOCUMENT_STAGE_UPLOAD,
+			[]string{destFolderID},
+		)
+		if err != nil {
+			return err
+		}
+
+		uploadStage.CompletedDestinations = append(
+			uploadStage.CompletedDestinations,
+			destFolderID,
+		)
+	}
+
+	// superseded while publishing, the newer version may have published
+	// already so the files saved here are withdrawn before the original is
+	// archived
+	err = util.CheckSuperseded(ctx, cfg.store, event.DocumentID)
+	if util.IsSuperseded(err) {
+		return cfg.withdraw(ctx, pub, err)
+	}
+	if err != nil {
+		return err
+	}
+
+	artifacts := make([]attest.Artifact, 0)
+
+	if !isChild {
+		// every destination was published by an earlier attempt
+		if originalHash == "" {
+			originalHash, err = cfg.hashStage(ctx, downloadedStage)
+			if err != nil {
+				slog.Error(
+					"Failed to hash the original document",
+					"id",
+					event.DocumentID,
+					"key",
+					downloadedStage.S3Key,
+					"error",
+					err,
+				)
+				return err
+			}
+		}
+
+		artifacts = append(artifacts, attest.Artifact{
+			Stage: downloadedStage.Stage,
+			Hash:  originalHash,
+		})
+	}
+
+	if !isParent {
+		if destinations := folders.Destinations(); len(destinations) > 0 {
+			document.FinalDriveFileID, document.FinalFileName = cfg.publishedNote(
+				ctx,
+				pub,
+				destinations[0],
+			)
+		}
+
+		document.FinalS3Key, err = cfg.saveFinal(ctx, pub)
+		if err != nil {
+			slog.Error(
+				"Failed to keep the final note in S3",
+				"id",
+				event.DocumentID,
+				"key",
+				prevStage.S3Key,
+				"error",
+				err,
+			)
+			return err
+		}
+	}
+
+	if document.SourceType == types.DOCUMENT_SOURCE_GOOGLE_DRIVE &&
 		document.GoogleID != "" {
-		err = cfg.dc.Archive(document.GoogleID, cfg.folderLocations.ArchiveFolderID)
+		document.ArchivedDriveFileID, err = cfg.archiveOriginal(ctx, document, wc, folders.ArchiveFolderID)
 		if err != nil {
 			slog.Error(
 				"Failed to archive the document",
 				"id",
 				event.DocumentID,
 				"folderID",
-				cfg.folderLocations.ArchiveFolderID,
+				folders.ArchiveFolderID,
+				"mode",
+				wc.ArchiveMode,
+				"error",
+				err,
+			)
+			return err
+		}
+
+		// the tag only backs up the document table, the original is already
+		// archived so a failure is not worth retrying the upload for
+		err = cfg.dc.SetAppProperties(
+			ctx,
+			document.GoogleID,
+			google.ProcessedProperties(document, time.Now(), types.DOCUMENT_STATUS_COMPLETE),
+		)
+		if err != nil {
+			slog.Warn(
+				"Failed to tag the original with the document",
+				"id",
+				event.DocumentID,
+				"googleID",
+				document.GoogleID,
+				"error",
+				err,
+			)
+		}
+
+		if wc.PostComments {
+			cfg.commentProcessed(ctx, document, folders)
+		}
+	}
+
+	// The Mathpix output isn't published but is part of the hash chain
+	mathpixStage, err := cfg.store.GetDocumentStage(
+		ctx,
+		event.DocumentID,
+		types.DOCUMENT_STAGE_MATHPIX,
+	)
+	if err != nil && !errors.Is(err, database.ErrStageNotFound) {
+		slog.Error(
+			"Failed to get the Mathpix stage information",
+			"id",
+			event.DocumentID,
+			"error",
+			err,
+		)
+		return err
+	}
+
+	// duplicates reuse the note of the original and skip Mathpix
+	if mathpixStage.S3Key != "" {
+		mathpixHash, err := cfg.hashStage(ctx, mathpixStage)
+		if err != nil {
+			slog.Error(
+				"Failed to hash the Mathpix output",
+				"id",
+				event.DocumentID,
+				"key",
+				mathpixStage.S3Key,
 				"error",
 				err,
 			)
 			return err
 		}
+
+		artifacts = append(artifacts, attest.Artifact{
+			Stage: mathpixStage.Stage,
+			Hash:  mathpixHash,
+		})
+	}
+
+	// the notes of a split scan are attested by its children
+	if !isParent {
+		artifacts = append(
+			artifacts,
+			attest.Artifact{Stage: prevStage.Stage, Hash: noteArtifactHash},
+			attest.Artifact{Stage: types.DOCUMENT_STAGE_UPLOAD, Hash: noteHash},
+		)
+	}
+
+	// Record the hash chain so the published note can be verified later,
+	// along with where the final note is kept
+	document.Attestation = attest.BuildChain(artifacts)
+	document.NoteParts = pub.split.fileNames()
+	document.Status = types.DOCUMENT_STATUS_COMPLETE
+	document.CompletedAt = time.Now().UTC()
+
+	// only what the upload changed is saved, so the attributes other
+	// lambdas write in the meantime are kept
+	err = cfg.store.UpdateDocumentFields(ctx, document.ID, &types.DocumentUpdate{
+		Status:              &document.Status,
+		CompletedAt:         &document.CompletedAt,
+		FinalS3Key:          &document.FinalS3Key,
+		FinalDriveFileID:    &document.FinalDriveFileID,
+		FinalFileName:       &document.FinalFileName,
+		ArchivedDriveFileID: &document.ArchivedDriveFileID,
+		NoteParts:           &document.NoteParts,
+		Attestation:         &document.Attestation,
+	})
+	if err != nil {
+		slog.Error(
+			"Failed to record the published document",
+			"id",
+			event.DocumentID,
+			"error",
+			err,
+		)
+		return err
 	}
 
 	// Update the stage to complete
@@ -295,6 +1841,49 @@ func process(ctx context.Context, event types.DocumentStep) error {
 		return err
 	}
 
+	metrics.Record(metrics.NOTES_PUBLISHED, 1, nil)
+
+	// the note is published either way, so an execution that can't be given
+	// back is only logged
+	err = util.ReleaseExecutionSlot(ctx, cfg.store, cfg.wcStore, document)
+	if err != nil {
+		slog.Error(
+			"Failed to give back the execution of the document",
+			"id",
+			document.ID,
+			"channelID",
+			document.ChannelID,
+			"error",
+			err,
+		)
+	}
+
+	if isChild {
+		completed, err := cfg.store.CompleteChildDocument(ctx, document.ParentID, document.ID)
+		if err != nil {
+			slog.Error(
+				"Failed to record the child document as complete",
+				"id",
+				event.DocumentID,
+				"parentID",
+				document.ParentID,
+				"error",
+				err,
+			)
+			return err
+		}
+
+		slog.Info(
+			"Published a document split from a scan",
+			"id",
+			event.DocumentID,
+			"parentID",
+			document.ParentID,
+			"completed",
+			completed,
+		)
+	}
+
 	return nil
 }
 
@@ -0,0 +1,1744 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/KyleBrandon/scriptor/lambdas/util"
+	"github.com/KyleBrandon/scriptor/pkg/database"
+	"github.com/KyleBrandon/scriptor/pkg/errorsmap"
+	"github.com/KyleBrandon/scriptor/pkg/google"
+	"github.com/KyleBrandon/scriptor/pkg/markdown"
+	"github.com/KyleBrandon/scriptor/pkg/notes"
+	"github.com/KyleBrandon/scriptor/pkg/types"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+func TestChannelFolders(t *testing.T) {
+	defaults := &types.GoogleFolderDefaultLocations{
+		FolderID:        "watch",
+		ArchiveFolderID: "archive",
+		DestFolderID:    "destination",
+	}
+
+	tests := []struct {
+		name string
+		wc   *types.WatchChannel
+		want types.GoogleFolderDefaultLocations
+	}{
+		{
+			name: "channel folders",
+			wc: &types.WatchChannel{
+				FolderID:            "receipts",
+				ArchiveFolderID:     "receipts-archive",
+				DestinationFolderID: "receipts-notes",
+			},
+			want: types.GoogleFolderDefaultLocations{
+				FolderID:        "receipts",
+				ArchiveFolderID: "receipts-archive",
+				DestFolderID:    "receipts-notes",
+				DestFolderIDs:   []string{"receipts-notes"},
+			},
+		},
+		{
+			name: "channel with several destinations",
+			wc: &types.WatchChannel{
+				FolderID:             "receipts",
+				DestinationFolderID:  "receipts-notes",
+				DestinationFolderIDs: []string{"shared-notes", "personal-notes", "shared-notes"},
+			},
+			want: types.GoogleFolderDefaultLocations{
+				FolderID:        "receipts",
+				ArchiveFolderID: "archive",
+				DestFolderID:    "shared-notes",
+				DestFolderIDs:   []string{"shared-notes", "personal-notes"},
+			},
+		},
+		{
+			name: "channel without an archive folder",
+			wc: &types.WatchChannel{
+				FolderID:            "receipts",
+				DestinationFolderID: "receipts-notes",
+			},
+			want: types.GoogleFolderDefaultLocations{
+				FolderID:        "receipts",
+				ArchiveFolderID: "archive",
+				DestFolderID:    "receipts-notes",
+				DestFolderIDs:   []string{"receipts-notes"},
+			},
+		},
+		{
+			name: "channel no longer exists",
+			wc:   &types.WatchChannel{},
+			want: *defaults,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got := channelFolders(defaults, tc.wc)
+			if !reflect.DeepEqual(*got, tc.want) {
+				t.Fatalf("unexpected folders: got %+v want %+v", *got, tc.want)
+			}
+		})
+	}
+
+	if defaults.DestFolderID != "destination" {
+		t.Fatalf("the defaults were changed: %+v", defaults)
+	}
+}
+
+func TestChannelFormats(t *testing.T) {
+	tests := []struct {
+		name string
+		wc   *types.WatchChannel
+		want noteFormats
+	}{
+		{
+			name: "defaults",
+			wc:   &types.WatchChannel{},
+			want: noteFormats{markdown: true},
+		},
+		{
+			name: "google doc alongside the markdown",
+			wc:   &types.WatchChannel{PublishGoogleDoc: true},
+			want: noteFormats{markdown: true, googleDoc: true},
+		},
+		{
+			name: "google doc only",
+			wc:   &types.WatchChannel{PublishGoogleDoc: true, SkipMarkdown: true},
+			want: noteFormats{googleDoc: true},
+		},
+		{
+			name: "markdown is kept without a google doc",
+			wc:   &types.WatchChannel{SkipMarkdown: true},
+			want: noteFormats{markdown: true},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got := channelFormats(tc.wc)
+			if got != tc.want {
+				t.Fatalf("unexpected formats: got %+v want %+v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestPendingChildren(t *testing.T) {
+	tests := []struct {
+		name     string
+		document *types.Document
+		want     []string
+	}{
+		{
+			name:     "not split",
+			document: &types.Document{},
+			want:     []string{},
+		},
+		{
+			name: "some children published",
+			document: &types.Document{
+				ChildIDs:          []string{"scan-1", "scan-2", "scan-3"},
+				ChildrenCompleted: []string{"scan-2"},
+			},
+			want: []string{"scan-1", "scan-3"},
+		},
+		{
+			name: "all children published",
+			document: &types.Document{
+				ChildIDs:          []string{"scan-1", "scan-2"},
+				ChildrenCompleted: []string{"scan-2", "scan-1"},
+			},
+			want: []string{},
+		},
+		{
+			name: "children of an earlier split are ignored",
+			document: &types.Document{
+				ChildIDs:          []string{"scan-1"},
+				ChildrenCompleted: []string{"scan-1", "scan-2"},
+			},
+			want: []string{},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got := pendingChildren(tc.document)
+			if !slices.Equal(got, tc.want) {
+				t.Fatalf("unexpected pending children: got %v want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+// Stage records of a document that finished the OpenAI stage
+type fakeStore struct {
+	database.DocumentStore
+
+	document    *types.Document
+	parent      *types.Document
+	previous    *types.Document
+	stages      map[types.Stage]*types.DocumentProcessingStage
+	attestation []types.AttestationLink
+	updated     *types.Document
+
+	// the document is superseded once it was read this many times
+	reads       int
+	supersedeAt int
+
+	failed *types.DocumentProcessingStage
+
+	// the document was counted against the execution limit of its channel
+	held bool
+}
+
+func (s *fakeStore) GetDocument(ctx context.Context, id string) (*types.Document, error) {
+	if s.parent != nil && id == s.parent.ID {
+		return s.parent, nil
+	}
+
+	if s.previous != nil && id == s.previous.ID {
+		return s.previous, nil
+	}
+
+	s.reads++
+	if s.supersedeAt > 0 && s.reads >= s.supersedeAt {
+		s.document.SupersededBy = "doc-2"
+	}
+
+	return s.document, nil
+}
+
+func (s *fakeStore) GetDocumentStage(
+	ctx context.Context,
+	id string,
+	stage types.Stage,
+) (*types.DocumentProcessingStage, error) {
+	if docStage, ok := s.stages[stage]; ok {
+		copied := *docStage
+		copied.CompletedDestinations = slices.Clone(docStage.CompletedDestinations)
+		return &copied, nil
+	}
+
+	return &types.DocumentProcessingStage{}, nil
+}
+
+func (s *fakeStore) StartDocumentStage(
+	ctx context.Context,
+	id string,
+	stage types.Stage,
+	originalFileName string,
+) (*types.DocumentProcessingStage, error) {
+	// starting a stage replaces its record
+	s.stages[stage] = &types.DocumentProcessingStage{ID: id, Stage: stage}
+	return &types.DocumentProcessingStage{ID: id, Stage: stage}, nil
+}
+
+func (s *fakeStore) CompleteStageDestinations(
+	ctx context.Context,
+	id string,
+	stage types.Stage,
+	folderIDs []string,
+) error {
+	docStage := s.stages[stage]
+	for _, folderID := range folderIDs {
+		if !slices.Contains(docStage.CompletedDestinations, folderID) {
+			docStage.CompletedDestinations = append(docStage.CompletedDestinations, folderID)
+		}
+	}
+
+	return nil
+}
+
+func (s *fakeStore) CompleteDocumentStage(
+	ctx context.Context,
+	stage *types.DocumentProcessingStage,
+) error {
+	stage.StageStatus = types.DOCUMENT_STATUS_COMPLETE
+	return nil
+}
+
+func (s *fakeStore) FailDocumentStage(
+	ctx context.Context,
+	stage *types.DocumentProcessingStage,
+	status string,
+	code string,
+	reason string,
+) error {
+	stage.StageStatus = status
+	stage.ErrorCode = code
+	stage.ErrorReason = reason
+	s.failed = stage
+	return nil
+}
+
+// Only the fields set on the update are applied to the document
+func (s *fakeStore) UpdateDocumentFields(
+	ctx context.Context,
+	id string,
+	update *types.DocumentUpdate,
+) error {
+	av, err := attributevalue.MarshalMap(update)
+	if err != nil {
+		return err
+	}
+
+	updated := *s.document
+	if err := attributevalue.UnmarshalMap(av, &updated); err != nil {
+		return err
+	}
+
+	s.updated = &updated
+	s.attestation = updated.Attestation
+	return nil
+}
+
+func (s *fakeStore) ReleaseExecutionSlot(ctx context.Context, id string) (bool, error) {
+	held := s.held
+	s.held = false
+	return held, nil
+}
+
+// Serves the stage files from memory
+type fakeS3 struct {
+	objects map[string]string
+}
+
+func (f *fakeS3) GetObject(
+	ctx context.Context,
+	params *s3.GetObjectInput,
+	optFns ...func(*s3.Options),
+) (*s3.GetObjectOutput, error) {
+	content, ok := f.objects[*params.Key]
+	if !ok {
+		return nil, fmt.Errorf("no such key: %s", *params.Key)
+	}
+
+	return &s3.GetObjectOutput{Body: io.NopCloser(strings.NewReader(content))}, nil
+}
+
+func (f *fakeS3) PutObject(
+	ctx context.Context,
+	params *s3.PutObjectInput,
+	optFns ...func(*s3.Options),
+) (*s3.PutObjectOutput, error) {
+	content, err := io.ReadAll(params.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	f.objects[*params.Key] = string(content)
+	return &s3.PutObjectOutput{}, nil
+}
+
+// A Drive folder that fails the saves of the file names in failSaves once,
+// and every save to failFolder
+type fakeDrive struct {
+	saved      map[string]string
+	saves      []string
+	checked    []string
+	failSaves  map[string]bool
+	failFolder string
+	parents    []string
+	archives   int
+	moved      []string
+	properties map[string]string
+	trashed    []string
+	withdrawn  []string
+
+	// the document each file was saved for
+	savedBy map[string]string
+
+	// applied to the notes read back, for the first corruptReads reads
+	corrupt      func(content string) string
+	corruptReads int
+
+	// name of the original the copies are saved under, and whether it was
+	// deleted
+	originalName string
+	gone         bool
+	copies       int
+	comments     []string
+
+	// the content type each file was saved as
+	contentTypes map[string]string
+}
+
+func (d *fakeDrive) FileExists(
+	ctx context.Context,
+	documentID, fileName, folderID string) (bool, error,
+) {
+	d.checked = append(d.checked, folderID)
+	_, ok := d.saved[folderID+"/"+fileName]
+	return ok, nil
+}
+
+// The ID of a saved file is where it is in the fake
+func (d *fakeDrive) SavedFileID(
+	ctx context.Context,
+	documentID, fileName, folderID string) (string, error,
+) {
+	if _, ok := d.saved[folderID+"/"+fileName]; !ok {
+		return "", nil
+	}
+
+	return folderID + "/" + fileName, nil
+}
+
+func (d *fakeDrive) SaveFile(
+	ctx context.Context,
+	documentID, fileName, folderID, contentType string,
+	reader io.Reader,
+) error {
+	return d.SaveFileAs(ctx, documentID, fileName, folderID, contentType, "", reader)
+}
+
+func (d *fakeDrive) SaveFileAs(
+	ctx context.Context,
+	documentID, fileName, folderID string,
+	sourceMimeType, targetMimeType string,
+	reader io.Reader,
+) error {
+	if d.failSaves[fileName] {
+		delete(d.failSaves, fileName)
+		return errors.New("upload failed")
+	}
+
+	if folderID == d.failFolder {
+		return errors.New("upload failed")
+	}
+
+	content, err := io.ReadAll(reader)
+	if err != nil {
+		return err
+	}
+
+	if d.contentTypes == nil {
+		d.contentTypes = make(map[string]string)
+		d.savedBy = make(map[string]string)
+	}
+
+	d.saved[folderID+"/"+fileName] = string(content)
+	d.savedBy[folderID+"/"+fileName] = documentID
+	d.saves = append(d.saves, fileName)
+	d.contentTypes[fileName] = sourceMimeType
+	return nil
+}
+
+func (d *fakeDrive) Archive(ctx context.Context, id string, archiveFolderID string) error {
+	d.moved = append(d.moved, id)
+	if d.gone {
+		return fmt.Errorf("%w: %s", google.ErrFileGone, id)
+	}
+
+	if slices.Contains(d.parents, archiveFolderID) {
+		return nil
+	}
+
+	d.parents = []string{archiveFolderID}
+	d.archives++
+	return nil
+}
+
+func (d *fakeDrive) CopyFile(ctx context.Context, documentID, id, folderID string) error {
+	d.saved[folderID+"/"+d.originalName] = id
+	d.copies++
+	return nil
+}
+
+func (d *fakeDrive) SetAppProperties(
+	ctx context.Context,
+	id string,
+	properties map[string]string,
+) error {
+	d.properties = properties
+	return nil
+}
+
+func (d *fakeDrive) AddComment(ctx context.Context, fileID, text string) error {
+	d.comments = append(d.comments, fileID+": "+text)
+	return nil
+}
+
+func (d *fakeDrive) ReadSavedFile(
+	ctx context.Context,
+	documentID, fileName, folderID string) ([]byte, error,
+) {
+	content, ok := d.saved[folderID+"/"+fileName]
+	if !ok {
+		return nil, fmt.Errorf("no such file: %s", fileName)
+	}
+
+	if d.corruptReads > 0 {
+		d.corruptReads--
+		content = d.corrupt(content)
+	}
+
+	return []byte(content), nil
+}
+
+func (d *fakeDrive) TrashSavedFile(ctx context.Context, documentID, fileName, folderID string) error {
+	d.trashed = append(d.trashed, documentID+" "+folderID+"/"+fileName)
+	if d.savedBy[folderID+"/"+fileName] == documentID {
+		delete(d.saved, folderID+"/"+fileName)
+	}
+	return nil
+}
+
+func (d *fakeDrive) TrashDocumentFiles(ctx context.Context, documentID, folderID string) error {
+	d.withdrawn = append(d.withdrawn, documentID+" "+folderID)
+	return nil
+}
+
+func (d *fakeDrive) EnsureFolderPath(
+	ctx context.Context,
+	parentID string,
+	segments []string,
+) (string, error) {
+	return strings.Join(append([]string{parentID}, segments...), "/"), nil
+}
+
+func (d *fakeDrive) ForgetFolderPaths() {}
+
+func TestProcessRetryAfterPartialUpload(t *testing.T) {
+	// skip loading the AWS configuration
+	initOnce.Do(func() {})
+
+	store := &fakeStore{
+		document: &types.Document{
+			ID:         "doc-1",
+			SourceType: types.DOCUMENT_SOURCE_GOOGLE_DRIVE,
+			GoogleID:   "file",
+			Name:       "scan.pdf",
+		},
+		stages: map[types.Stage]*types.DocumentProcessingStage{
+			types.DOCUMENT_STAGE_DOWNLOAD: {
+				Stage:         types.DOCUMENT_STAGE_DOWNLOAD,
+				StageFileName: "scan-1.pdf",
+				S3Key:         "download/scan-1.pdf",
+			},
+			types.DOCUMENT_STAGE_MATHPIX: {
+				Stage:         types.DOCUMENT_STAGE_MATHPIX,
+				StageFileName: "scan-2.md",
+				S3Key:         "mathpix/scan-2.md",
+			},
+			types.DOCUMENT_STAGE_OPENAI: {
+				Stage:         types.DOCUMENT_STAGE_OPENAI,
+				StageFileName: "scan-3.md",
+				S3Key:         "openai/scan-3.md",
+			},
+		},
+	}
+
+	drive := &fakeDrive{
+		saved:     map[string]string{},
+		failSaves: map[string]bool{"scan.md": true},
+		parents:   []string{"watch"},
+	}
+
+	cfg = &handlerConfig{
+		store: store,
+		dc:    drive,
+		folderLocations: &types.GoogleFolderDefaultLocations{
+			FolderID:        "watch",
+			ArchiveFolderID: "archive",
+			DestFolderID:    "destination",
+		},
+		s3Client: &fakeS3{objects: map[string]string{
+			"download/scan-1.pdf": "%PDF",
+			"mathpix/scan-2.md":   "Tile 40",
+			"openai/scan-3.md":    "# Receipt\nTile 40\n\n" + notes.ATTACHMENT_PLACEHOLDER,
+		}},
+		attachment: notes.AttachmentOptions{Style: notes.ATTACHMENT_LINK_DRIVE},
+	}
+
+	event := types.DocumentStep{DocumentID: "doc-1", Stage: types.DOCUMENT_STAGE_OPENAI}
+
+	// the PDF is saved but the note fails, the scan is not archived
+	if err := process(context.Background(), event); err == nil {
+		t.Fatalf("expected the first attempt to fail")
+	}
+
+	if !slices.Equal(drive.saves, []string{"scan.pdf"}) || drive.archives != 0 {
+		t.Fatalf("unexpected first attempt: saves %v archives %d", drive.saves, drive.archives)
+	}
+
+	// the retry only saves the note before archiving
+	if err := process(context.Background(), event); err != nil {
+		t.Fatalf("unexpected error on the retry: %v", err)
+	}
+
+	if !slices.Equal(drive.saves, []string{"scan.pdf", "scan.md"}) || drive.archives != 1 {
+		t.Fatalf("unexpected retry: saves %v archives %d", drive.saves, drive.archives)
+	}
+
+	// Drive isn't left to guess what the files are
+	if drive.contentTypes["scan.pdf"] != types.CONTENT_TYPE_PDF ||
+		drive.contentTypes["scan.md"] != types.CONTENT_TYPE_MARKDOWN {
+		t.Fatalf("unexpected content types: %v", drive.contentTypes)
+	}
+
+	// the archived original is tagged with the document it was processed as
+	if drive.properties[google.SCRIPTOR_DOCUMENT_PROPERTY] != "doc-1" ||
+		drive.properties[google.SCRIPTOR_STATUS_PROPERTY] != types.DOCUMENT_STATUS_COMPLETE {
+		t.Fatalf("unexpected app properties: %v", drive.properties)
+	}
+
+	// the note links to the original, which keeps its ID when archived
+	if !strings.Contains(drive.saved["destination/scan.md"], "[scan.pdf](https://drive.google.com/file/d/file)") {
+		t.Fatalf("unexpected note: %q", drive.saved["destination/scan.md"])
+	}
+
+	first := store.attestation
+
+	// another run after everything succeeded saves and moves nothing
+	if err := process(context.Background(), event); err != nil {
+		t.Fatalf("unexpected error on the second retry: %v", err)
+	}
+
+	if len(drive.saves) != 2 || drive.archives != 1 {
+		t.Fatalf("unexpected second retry: saves %v archives %d", drive.saves, drive.archives)
+	}
+
+	// files skipped on a retry are still part of the hash chain
+	if len(first) != 4 || !slices.Equal(store.attestation, first) {
+		t.Fatalf("attestation changed on the retry: %+v %+v", first, store.attestation)
+	}
+}
+
+func TestProcessRecordsFinalNote(t *testing.T) {
+	// skip loading the AWS configuration
+	initOnce.Do(func() {})
+
+	document := &types.Document{
+		ID:         "doc-1",
+		SourceType: types.DOCUMENT_SOURCE_GOOGLE_DRIVE,
+		GoogleID:   "file",
+		Name:       "Meeting Notes.pdf",
+		Status:     types.DOCUMENT_STATUS_INPROGRESS,
+		ChannelID:  "channel-1",
+	}
+
+	store := &fakeStore{
+		document: document,
+		held:     true,
+		stages: map[types.Stage]*types.DocumentProcessingStage{
+			types.DOCUMENT_STAGE_DOWNLOAD: {
+				Stage:         types.DOCUMENT_STAGE_DOWNLOAD,
+				StageFileName: "Meeting Notes-01JP3K8Z6V0Q4M2W9T7R5X1B3A.pdf",
+				S3Key:         "download/Meeting Notes-01JP3K8Z6V0Q4M2W9T7R5X1B3A.pdf",
+			},
+			types.DOCUMENT_STAGE_MATHPIX: {
+				Stage:         types.DOCUMENT_STAGE_MATHPIX,
+				StageFileName: "Meeting Notes-01JP3K8Z6V0Q4M2W9T7R5X1B3B.md",
+				S3Key:         "mathpix/Meeting Notes-01JP3K8Z6V0Q4M2W9T7R5X1B3B.md",
+			},
+			types.DOCUMENT_STAGE_OPENAI: {
+				Stage:         types.DOCUMENT_STAGE_OPENAI,
+				StageFileName: "Meeting Notes-01JP3K8Z6V0Q4M2W9T7R5X1B3C.md",
+				S3Key:         "openai/Meeting Notes-01JP3K8Z6V0Q4M2W9T7R5X1B3C.md",
+			},
+		},
+	}
+
+	objects := &fakeS3{objects: map[string]string{
+		"download/Meeting Notes-01JP3K8Z6V0Q4M2W9T7R5X1B3A.pdf": "%PDF",
+		"mathpix/Meeting Notes-01JP3K8Z6V0Q4M2W9T7R5X1B3B.md":   "Agenda",
+		"openai/Meeting Notes-01JP3K8Z6V0Q4M2W9T7R5X1B3C.md":    "# Agenda\n\n" + notes.ATTACHMENT_PLACEHOLDER,
+	}}
+
+	channels := &fakeChannels{}
+	drive := &fakeDrive{saved: map[string]string{}, parents: []string{"watch"}}
+	cfg = &handlerConfig{
+		store:   store,
+		wcStore: channels,
+		dc:      drive,
+		folderLocations: &types.GoogleFolderDefaultLocations{
+			FolderID:        "watch",
+			ArchiveFolderID: "archive",
+			DestFolderID:    "destination",
+		},
+		s3Client:   objects,
+		attachment: notes.AttachmentOptions{Style: notes.ATTACHMENT_LINK_DRIVE},
+	}
+
+	event := types.DocumentStep{DocumentID: "doc-1", Stage: types.DOCUMENT_STAGE_OPENAI}
+	if err := process(context.Background(), event); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	final := store.updated
+	if final == nil {
+		t.Fatalf("the document was not updated")
+	}
+
+	if final.FinalS3Key != "final/doc-1/Meeting Notes.md" {
+		t.Fatalf("unexpected final key: %q", final.FinalS3Key)
+	}
+
+	if final.Status != types.DOCUMENT_STATUS_COMPLETE || final.CompletedAt.IsZero() {
+		t.Fatalf("unexpected completion: %q at %v", final.Status, final.CompletedAt)
+	}
+
+	if len(final.Attestation) != 4 {
+		t.Fatalf("unexpected attestation: %+v", final.Attestation)
+	}
+
+	// where the note and the original are, without knowing how they are
+	// named
+	if final.FinalFileName != "Meeting Notes.md" ||
+		final.FinalDriveFileID != "destination/Meeting Notes.md" ||
+		final.ArchivedDriveFileID != "file" {
+		t.Fatalf(
+			"unexpected location: note %q %q original %q",
+			final.FinalDriveFileID,
+			final.FinalFileName,
+			final.ArchivedDriveFileID,
+		)
+	}
+
+	// the final copy is the note that was published, with the link to the
+	// original and the hash stamp
+	want := drive.saved["destination/Meeting Notes.md"]
+	if got := objects.objects[final.FinalS3Key]; got != want ||
+		strings.Contains(got, notes.ATTACHMENT_PLACEHOLDER) {
+		t.Fatalf("unexpected final note: %q", got)
+	}
+
+	// the execution the document was counted for is given back
+	if !slices.Equal(channels.released, []string{"channel-1"}) {
+		t.Fatalf("unexpected releases: %q", channels.released)
+	}
+}
+
+func TestProcessRetriesFailedDestinations(t *testing.T) {
+	// skip loading the AWS configuration
+	initOnce.Do(func() {})
+
+	store := &fakeStore{
+		document: &types.Document{
+			ID:         "doc-1",
+			SourceType: types.DOCUMENT_SOURCE_GOOGLE_DRIVE,
+			GoogleID:   "file",
+			Name:       "scan.pdf",
+		},
+		stages: map[types.Stage]*types.DocumentProcessingStage{
+			types.DOCUMENT_STAGE_DOWNLOAD: {
+				Stage:         types.DOCUMENT_STAGE_DOWNLOAD,
+				StageFileName: "scan-1.pdf",
+				S3Key:         "download/scan-1.pdf",
+			},
+			types.DOCUMENT_STAGE_OPENAI: {
+				Stage:         types.DOCUMENT_STAGE_OPENAI,
+				StageFileName: "scan-3.md",
+				S3Key:         "openai/scan-3.md",
+			},
+		},
+	}
+
+	drive := &fakeDrive{
+		saved:      map[string]string{},
+		parents:    []string{"watch"},
+		failFolder: "personal",
+	}
+
+	cfg = &handlerConfig{
+		store: store,
+		dc:    drive,
+		folderLocations: &types.GoogleFolderDefaultLocations{
+			FolderID:        "watch",
+			ArchiveFolderID: "archive",
+			DestFolderIDs:   []string{"shared", "personal"},
+		},
+		s3Client: &fakeS3{objects: map[string]string{
+			"download/scan-1.pdf": "%PDF",
+			"openai/scan-3.md":    "# Receipt",
+		}},
+		attachment: notes.AttachmentOptions{Style: notes.ATTACHMENT_LINK_DRIVE},
+	}
+
+	event := types.DocumentStep{DocumentID: "doc-1", Stage: types.DOCUMENT_STAGE_OPENAI}
+
+	// the shared folder is published but the personal folder fails
+	err := process(context.Background(), event)
+	var failure *util.StageFailedError
+	if !errors.As(err, &failure) || failure.Stage != types.DOCUMENT_STAGE_UPLOAD {
+		t.Fatalf("expected the first attempt to fail: %v", err)
+	}
+
+	// the stage records why the attempt failed
+	if store.failed == nil ||
+		store.failed.StageStatus != types.DOCUMENT_STATUS_ERROR ||
+		store.failed.ErrorCode != errorsmap.CODE_UNKNOWN ||
+		store.failed.ErrorReason != failure.Err.Error() {
+		t.Fatalf("unexpected failed stage: %+v", store.failed)
+	}
+
+	upload := store.stages[types.DOCUMENT_STAGE_UPLOAD]
+	if !slices.Equal(upload.CompletedDestinations, []string{"shared"}) || drive.archives != 0 {
+		t.Fatalf(
+			"unexpected first attempt: destinations %v archives %d",
+			upload.CompletedDestinations,
+			drive.archives,
+		)
+	}
+
+	// the retry only publishes to the personal folder
+	drive.failFolder = ""
+	drive.checked = nil
+	if err := process(context.Background(), event); err != nil {
+		t.Fatalf("unexpected error on the retry: %v", err)
+	}
+
+	if slices.Contains(drive.checked, "shared") {
+		t.Fatalf("the retry published to the finished destination: %v", drive.checked)
+	}
+
+	for _, key := range []string{"shared/scan.pdf", "shared/scan.md", "personal/scan.pdf", "personal/scan.md"} {
+		if _, ok := drive.saved[key]; !ok {
+			t.Fatalf("%s was not published: %v", key, drive.saves)
+		}
+	}
+
+	upload = store.stages[types.DOCUMENT_STAGE_UPLOAD]
+	if !slices.Equal(upload.CompletedDestinations, []string{"shared", "personal"}) || drive.archives != 1 {
+		t.Fatalf(
+			"unexpected retry: destinations %v archives %d",
+			upload.CompletedDestinations,
+			drive.archives,
+		)
+	}
+
+	// the hash chain still covers the original and the note
+	if len(store.attestation) != 3 {
+		t.Fatalf("unexpected attestation: %+v", store.attestation)
+	}
+}
+
+type fakeChannels struct {
+	database.WatchChannelStore
+	channel  *types.WatchChannel
+	released []string
+}
+
+func (c *fakeChannels) GetWatchChannel(
+	ctx context.Context,
+	folderID string,
+) (*types.WatchChannel, error) {
+	return c.channel, nil
+}
+
+func (c *fakeChannels) DecrementActiveExecutions(ctx context.Context, channelID string) error {
+	c.released = append(c.released, channelID)
+	return nil
+}
+
+func TestProcessCommentsOnTheOriginal(t *testing.T) {
+	// skip loading the AWS configuration
+	initOnce.Do(func() {})
+
+	tests := []struct {
+		name         string
+		postComments bool
+		want         []string
+	}{
+		{
+			name: "comments are off",
+		},
+		{
+			name:         "comments are on",
+			postComments: true,
+			want:         []string{"file: Processed successfully → https://drive.google.com/drive/folders/shared"},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			store := &fakeStore{
+				document: &types.Document{
+					ID:             "doc-1",
+					SourceType:     types.DOCUMENT_SOURCE_GOOGLE_DRIVE,
+					GoogleID:       "file",
+					GoogleFolderID: "watch",
+					ChannelID:      "channel-1",
+					Name:           "scan.pdf",
+				},
+				stages: map[types.Stage]*types.DocumentProcessingStage{
+					types.DOCUMENT_STAGE_DOWNLOAD: {
+						Stage:         types.DOCUMENT_STAGE_DOWNLOAD,
+						StageFileName: "scan-1.pdf",
+						S3Key:         "download/scan-1.pdf",
+					},
+					types.DOCUMENT_STAGE_OPENAI: {
+						Stage:         types.DOCUMENT_STAGE_OPENAI,
+						StageFileName: "scan-3.md",
+						S3Key:         "openai/scan-3.md",
+					},
+				},
+			}
+
+			drive := &fakeDrive{saved: map[string]string{}, parents: []string{"watch"}}
+
+			cfg = &handlerConfig{
+				store: store,
+				dc:    drive,
+				wcStore: &fakeChannels{channel: &types.WatchChannel{
+					FolderID:             "watch",
+					DestinationFolderIDs: []string{"shared", "personal"},
+					PostComments:         tc.postComments,
+				}},
+				folderLocations: &types.GoogleFolderDefaultLocations{
+					FolderID:        "watch",
+					ArchiveFolderID: "archive",
+					DestFolderID:    "dest",
+				},
+				s3Client: &fakeS3{objects: map[string]string{
+					"download/scan-1.pdf": "%PDF",
+					"openai/scan-3.md":    "# Receipt",
+				}},
+				attachment: notes.AttachmentOptions{Style: notes.ATTACHMENT_LINK_DRIVE},
+			}
+
+			event := types.DocumentStep{DocumentID: "doc-1", Stage: types.DOCUMENT_STAGE_OPENAI}
+			if err := process(context.Background(), event); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if !slices.Equal(drive.comments, tc.want) {
+				t.Fatalf("unexpected comments: got %q want %q", drive.comments, tc.want)
+			}
+		})
+	}
+}
+
+func TestProcessArchiveModes(t *testing.T) {
+	// skip loading the AWS configuration
+	initOnce.Do(func() {})
+
+	tests := []struct {
+		name         string
+		mode         string
+		gone         bool
+		wantArchives int
+		wantCopies   int
+		wantArchived string
+		wantErr      bool
+	}{
+		{name: "default", mode: "", wantArchives: 1, wantArchived: "file"},
+		{name: "move", mode: types.ARCHIVE_MODE_MOVE, wantArchives: 1, wantArchived: "file"},
+		{name: "copy", mode: types.ARCHIVE_MODE_COPY, wantCopies: 1, wantArchived: "archive/scan.pdf"},
+		{name: "none", mode: types.ARCHIVE_MODE_NONE},
+		{name: "unknown", mode: "delete", wantErr: true},
+
+		// the note is published, there is nothing left to archive
+		{name: "original gone", mode: types.ARCHIVE_MODE_MOVE, gone: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			store := &fakeStore{
+				document: &types.Document{
+					ID:             "doc-1",
+					SourceType:     types.DOCUMENT_SOURCE_GOOGLE_DRIVE,
+					GoogleID:       "file",
+					GoogleFolderID: "watch",
+					ChannelID:      "channel-1",
+					Name:           "scan.pdf",
+				},
+				stages: map[types.Stage]*types.DocumentProcessingStage{
+					types.DOCUMENT_STAGE_DOWNLOAD: {
+						Stage:         types.DOCUMENT_STAGE_DOWNLOAD,
+						StageFileName: "scan-1.pdf",
+						S3Key:         "download/scan-1.pdf",
+					},
+					types.DOCUMENT_STAGE_OPENAI: {
+						Stage:         types.DOCUMENT_STAGE_OPENAI,
+						StageFileName: "scan-3.md",
+						S3Key:         "openai/scan-3.md",
+					},
+				},
+			}
+
+			drive := &fakeDrive{
+				saved:        map[string]string{},
+				parents:      []string{"watch"},
+				originalName: "scan.pdf",
+				gone:         tc.gone,
+			}
+
+			cfg = &handlerConfig{
+				store: store,
+				dc:    drive,
+				wcStore: &fakeChannels{channel: &types.WatchChannel{
+					FolderID:    "watch",
+					ArchiveMode: tc.mode,
+				}},
+				folderLocations: &types.GoogleFolderDefaultLocations{
+					FolderID:        "watch",
+					ArchiveFolderID: "archive",
+					DestFolderID:    "dest",
+				},
+				s3Client: &fakeS3{objects: map[string]string{
+					"download/scan-1.pdf": "%PDF",
+					"openai/scan-3.md":    "# Receipt",
+				}},
+				attachment: notes.AttachmentOptions{Style: notes.ATTACHMENT_LINK_DRIVE},
+			}
+
+			// the upload is run twice as a retry must not archive again
+			event := types.DocumentStep{DocumentID: "doc-1", Stage: types.DOCUMENT_STAGE_OPENAI}
+			for range 2 {
+				err := process(context.Background(), event)
+				if (err != nil) != tc.wantErr {
+					t.Fatalf("unexpected error: %v", err)
+				}
+			}
+
+			if drive.archives != tc.wantArchives || drive.copies != tc.wantCopies {
+				t.Fatalf(
+					"unexpected archive: got %d moves %d copies want %d moves %d copies",
+					drive.archives,
+					drive.copies,
+					tc.wantArchives,
+					tc.wantCopies,
+				)
+			}
+
+			// the original is tagged wherever it is left
+			if !tc.wantErr && drive.properties[google.SCRIPTOR_DOCUMENT_PROPERTY] != "doc-1" {
+				t.Fatalf("the original was not tagged: %v", drive.properties)
+			}
+
+			if !tc.wantErr && store.updated.ArchivedDriveFileID != tc.wantArchived {
+				t.Fatalf("unexpected archived original: %q", store.updated.ArchivedDriveFileID)
+			}
+		})
+	}
+}
+
+func TestProcessSplitsLargeNotes(t *testing.T) {
+	// skip loading the AWS configuration
+	initOnce.Do(func() {})
+
+	store := &fakeStore{
+		document: &types.Document{
+			ID:                "doc-1",
+			SourceType:        types.DOCUMENT_SOURCE_GOOGLE_DRIVE,
+			GoogleID:          "file",
+			Name:              "scan.pdf",
+			PreviousVersionID: "doc-0",
+
+			// an earlier run split the note into more parts
+			NoteParts: []string{
+				"scan - Part 1.md",
+				"scan - Part 2.md",
+				"scan - Part 3.md",
+				"scan - Part 4.md",
+			},
+		},
+		previous: &types.Document{
+			ID:        "doc-0",
+			NoteParts: []string{"scan - Part 1.md", "scan - Part 2.md"},
+		},
+		stages: map[types.Stage]*types.DocumentProcessingStage{
+			types.DOCUMENT_STAGE_DOWNLOAD: {
+				Stage:         types.DOCUMENT_STAGE_DOWNLOAD,
+				StageFileName: "scan-1.pdf",
+				S3Key:         "download/scan-1.pdf",
+			},
+			types.DOCUMENT_STAGE_OPENAI: {
+				Stage:         types.DOCUMENT_STAGE_OPENAI,
+				StageFileName: "scan-3.md",
+				S3Key:         "openai/scan-3.md",
+			},
+		},
+	}
+
+	drive := &fakeDrive{saved: map[string]string{}, parents: []string{"watch"}}
+
+	cfg = &handlerConfig{
+		store: store,
+		dc:    drive,
+		folderLocations: &types.GoogleFolderDefaultLocations{
+			FolderID:        "watch",
+			ArchiveFolderID: "archive",
+			DestFolderID:    "dest",
+		},
+		s3Client: &fakeS3{objects: map[string]string{
+			"download/scan-1.pdf": "%PDF",
+			"openai/scan-3.md": "---\nid: scan\n---\n\n" +
+				"# Limits\n\nFirst lecture.\n\n" +
+				"# Series\n\nSecond lecture.\n\n" +
+				"# Integrals\n\nThird lecture.\n\n" +
+				notes.ATTACHMENT_PLACEHOLDER,
+		}},
+		attachment:   notes.AttachmentOptions{Style: notes.ATTACHMENT_LINK_DRIVE},
+		splitOptions: markdown.SplitOptions{MaxHeadings: 1},
+	}
+
+	event := types.DocumentStep{DocumentID: "doc-1", Stage: types.DOCUMENT_STAGE_OPENAI}
+	if err := process(context.Background(), event); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// the index keeps the front matter and links to the parts in order
+	index := drive.saved["dest/scan.md"]
+	if !strings.HasPrefix(index, "---\nid: scan\n") ||
+		!strings.Contains(index, "1. [[scan - Part 1|Limits]]\n2. [[scan - Part 2|Series]]\n3. [[scan - Part 3|Integrals]]") {
+		t.Fatalf("unexpected index:\n%s", index)
+	}
+
+	middle := drive.saved["dest/scan - Part 2.md"]
+	navigation := "← [[scan - Part 1|Limits]] · [[scan|Contents]] · [[scan - Part 3|Integrals]] →"
+	if strings.Count(middle, navigation) != 2 || !strings.Contains(middle, "# Series") {
+		t.Fatalf("unexpected part:\n%s", middle)
+	}
+
+	// the link to the original stays at the end of the note
+	if !strings.Contains(drive.saved["dest/scan - Part 3.md"], "https://drive.google.com/file/d/file") {
+		t.Fatalf("the last part doesn't link to the original")
+	}
+
+	// the part of the earlier run and the parts of the previous version are
+	// replaced by the new set
+	wantTrashed := []string{
+		"doc-1 dest/scan - Part 4.md",
+		"doc-0 dest/scan - Part 1.md",
+		"doc-0 dest/scan - Part 2.md",
+	}
+	if !slices.Equal(drive.trashed, wantTrashed) {
+		t.Fatalf("unexpected parts trashed: got %v want %v", drive.trashed, wantTrashed)
+	}
+
+	wantParts := []string{"scan - Part 1.md", "scan - Part 2.md", "scan - Part 3.md"}
+	if !slices.Equal(store.updated.NoteParts, wantParts) {
+		t.Fatalf("unexpected parts recorded: %v", store.updated.NoteParts)
+	}
+}
+
+func TestSplitNoteWithinLimits(t *testing.T) {
+	note := []byte("# Notes\n\nshort\n")
+	if set := splitNote(note, "scan.md", markdown.SplitOptions{MaxBytes: 1024}); set != nil {
+		t.Fatalf("unexpected split: %+v", set)
+	}
+
+	if set := splitNote(note, "scan.md", markdown.SplitOptions{}); set != nil {
+		t.Fatalf("split without limits: %+v", set)
+	}
+}
+
+func TestFileNamer(t *testing.T) {
+	document := &types.Document{
+		Name:        "scan.pdf",
+		CreatedTime: time.Date(2026, 3, 14, 9, 30, 0, 0, time.UTC),
+	}
+	docStage := &types.DocumentProcessingStage{
+		Stage:         types.DOCUMENT_STAGE_OPENAI,
+		StageFileName: "scan-3.md",
+	}
+
+	tests := []struct {
+		name     string
+		template string
+		note     string
+		want     string
+	}{
+		{name: "default", template: notes.DEFAULT_FILENAME_TEMPLATE, note: "# Receipt\n", want: "scan.md"},
+		{name: "date and title", template: "{{.Date}} {{.Title}}", note: "# Receipt\n", want: "2026-03-14 Receipt.md"},
+		{name: "no heading", template: "{{.Title}}", note: "Tile 40\n", want: "scan.md"},
+		{name: "stage", template: "{{.OriginalName}}-{{.Stage}}", note: "", want: "scan-openai.md"},
+		{name: "unsafe title", template: "{{.Title}}", note: "# Invoice: 12/03\n", want: "Invoice 12 03.md"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			namer := newFileNamer(tc.template, document, []byte(tc.note))
+
+			got, err := namer.stageFileName(docStage)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if got != tc.want {
+				t.Fatalf("unexpected file name: got %q want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestSaveStageContentType(t *testing.T) {
+	tests := []struct {
+		name        string
+		fileName    string
+		contentType string
+		want        string
+	}{
+		// stages recorded before the content type only held PDFs
+		{name: "not recorded", fileName: "scan-1.pdf", want: types.CONTENT_TYPE_PDF},
+		{name: "image", fileName: "scan-1.png", contentType: types.CONTENT_TYPE_PNG, want: types.CONTENT_TYPE_PNG},
+		{
+			name:        "markdown",
+			fileName:    "scan-1.md",
+			contentType: types.CONTENT_TYPE_MARKDOWN,
+			want:        types.CONTENT_TYPE_MARKDOWN,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			drive := &fakeDrive{saved: map[string]string{}}
+			cfg := &handlerConfig{
+				dc:       drive,
+				s3Client: &fakeS3{objects: map[string]string{"download/" + tc.fileName: "content"}},
+			}
+
+			docStage := &types.DocumentProcessingStage{
+				Stage:         types.DOCUMENT_STAGE_DOWNLOAD,
+				StageFileName: tc.fileName,
+				S3Key:         "download/" + tc.fileName,
+				ContentType:   tc.contentType,
+			}
+			namer := newFileNamer(notes.DEFAULT_FILENAME_TEMPLATE, &types.Document{Name: "scan.pdf"}, nil)
+
+			_, err := cfg.saveStageToFolder(context.Background(), "doc-1", docStage, "dest", namer)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if len(drive.saves) != 1 || drive.contentTypes[drive.saves[0]] != tc.want {
+				t.Fatalf("unexpected saves %v as %v", drive.saves, drive.contentTypes)
+			}
+		})
+	}
+}
+
+func TestAttachmentLink(t *testing.T) {
+	// skip loading the AWS configuration
+	initOnce.Do(func() {})
+
+	scan := &types.Document{
+		ID:         "scan-1",
+		SourceType: types.DOCUMENT_SOURCE_GOOGLE_DRIVE,
+		GoogleID:   "file-1",
+		Name:       "scan.pdf",
+	}
+	kindle := &types.Document{
+		ID:         "kindle-1",
+		SourceType: types.DOCUMENT_SOURCE_KINDLE_EMAIL,
+		Name:       "book.pdf",
+	}
+	child := &types.Document{ID: "scan-1-2", ParentID: "scan-1", Name: "scan - Receipt.pdf"}
+
+	stages := map[types.Stage]*types.DocumentProcessingStage{
+		types.DOCUMENT_STAGE_DOWNLOAD: {
+			Stage:         types.DOCUMENT_STAGE_DOWNLOAD,
+			StageFileName: "scan-1.pdf",
+		},
+		types.DOCUMENT_STAGE_MATHPIX: {
+			Stage: types.DOCUMENT_STAGE_MATHPIX,
+			S3Key: "mathpix/scan-2.md",
+		},
+	}
+
+	tests := []struct {
+		name     string
+		document *types.Document
+		template string
+		options  notes.AttachmentOptions
+		want     string
+	}{
+		{
+			name:     "archived in drive",
+			document: scan,
+			template: notes.DEFAULT_FILENAME_TEMPLATE,
+			options:  notes.AttachmentOptions{Style: notes.ATTACHMENT_LINK_DRIVE},
+			want:     "[scan.pdf](https://drive.google.com/file/d/file-1)",
+		},
+		{
+			name:     "obsidian",
+			document: scan,
+			template: "{{.Title}}",
+			options:  notes.AttachmentOptions{Style: notes.ATTACHMENT_LINK_OBSIDIAN, Prefix: "attachments/"},
+			want:     "![[attachments/Receipts.pdf]]",
+		},
+		{
+			name:     "kindle",
+			document: kindle,
+			template: notes.DEFAULT_FILENAME_TEMPLATE,
+			options:  notes.AttachmentOptions{Style: notes.ATTACHMENT_LINK_DRIVE},
+			want:     "![[book.pdf]]",
+		},
+		{
+			name:     "split from a scan",
+			document: child,
+			template: "{{.Title}}",
+			options:  notes.AttachmentOptions{Style: notes.ATTACHMENT_LINK_OBSIDIAN},
+			want:     "![[Receipts.pdf]]",
+		},
+		{
+			name:     "split from a scan in drive",
+			document: child,
+			template: notes.DEFAULT_FILENAME_TEMPLATE,
+			options:  notes.AttachmentOptions{Style: notes.ATTACHMENT_LINK_DRIVE},
+			want:     "[scan.pdf](https://drive.google.com/file/d/file-1)",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg = &handlerConfig{
+				store:      &fakeStore{document: tc.document, parent: scan, stages: stages},
+				s3Client:   &fakeS3{objects: map[string]string{"mathpix/scan-2.md": "# Receipts\n"}},
+				attachment: tc.options,
+			}
+
+			// the title of the note of a scan is the title of the whole scan
+			namer := newFileNamer(tc.template, tc.document, []byte("# Receipts\n"))
+			if tc.document == child {
+				namer = newFileNamer(tc.template, tc.document, []byte("# Receipt\n"))
+			}
+
+			got, err := cfg.attachmentLink(context.Background(), tc.document, stages[types.DOCUMENT_STAGE_DOWNLOAD], namer)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if got != tc.want {
+				t.Fatalf("unexpected link: got %q want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestPublishFolder(t *testing.T) {
+	document := &types.Document{CreatedTime: time.Date(2026, 3, 14, 9, 30, 0, 0, time.UTC)}
+
+	tests := []struct {
+		name string
+		wc   *types.WatchChannel
+		want string
+	}{
+		{name: "flat", wc: &types.WatchChannel{}, want: "destination"},
+		{name: "date folders", wc: &types.WatchChannel{DateFolders: true}, want: "destination/2026/03"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg = &handlerConfig{dc: &fakeDrive{}}
+
+			got, err := cfg.publishFolder(context.Background(), document, tc.wc, "destination")
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if got != tc.want {
+				t.Fatalf("unexpected folder: got %q want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestRouteFolders(t *testing.T) {
+	folders := &types.GoogleFolderDefaultLocations{
+		ArchiveFolderID: "archive",
+		DestFolderID:    "shared",
+		DestFolderIDs:   []string{"shared", "personal"},
+	}
+	wc := &types.WatchChannel{Routes: map[string]string{"project-x": "project-x-notes"}}
+
+	tests := []struct {
+		name       string
+		directives *types.DocumentDirectives
+		want       []string
+	}{
+		{name: "no sidecar", want: []string{"shared", "personal"}},
+		{name: "no route", directives: &types.DocumentDirectives{Title: "Notes"}, want: []string{"shared", "personal"}},
+		{name: "route", directives: &types.DocumentDirectives{Route: "project-x"}, want: []string{"project-x-notes"}},
+		{name: "unknown route", directives: &types.DocumentDirectives{Route: "project-y"}, want: []string{"shared", "personal"}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got := routeFolders(folders, wc, &types.Document{Directives: tc.directives})
+			if !slices.Equal(got.Destinations(), tc.want) || got.ArchiveFolderID != "archive" {
+				t.Fatalf("unexpected folders: got %+v want %v", *got, tc.want)
+			}
+		})
+	}
+
+	if !slices.Equal(folders.Destinations(), []string{"shared", "personal"}) {
+		t.Fatalf("the folders were changed: %+v", folders)
+	}
+}
+
+func TestProcessAppliesSidecarDirectives(t *testing.T) {
+	// skip loading the AWS configuration
+	initOnce.Do(func() {})
+
+	store := &fakeStore{
+		document: &types.Document{
+			ID:             "doc-1",
+			SourceType:     types.DOCUMENT_SOURCE_GOOGLE_DRIVE,
+			GoogleID:       "file",
+			GoogleFolderID: "watch",
+			ChannelID:      "channel-1",
+			Name:           "scan.pdf",
+			Directives: &types.DocumentDirectives{
+				Route: "project-x",
+				Tags:  []string{"receipts"},
+				Title: "Trip to Madrid",
+			},
+			Sidecar: &types.SidecarFile{GoogleID: "sidecar", Name: "scan.pdf.scriptor.txt"},
+		},
+		stages: map[types.Stage]*types.DocumentProcessingStage{
+			types.DOCUMENT_STAGE_DOWNLOAD: {
+				Stage:         types.DOCUMENT_STAGE_DOWNLOAD,
+				StageFileName: "scan-1.pdf",
+				S3Key:         "download/scan-1.pdf",
+			},
+			types.DOCUMENT_STAGE_OPENAI: {
+				Stage:         types.DOCUMENT_STAGE_OPENAI,
+				StageFileName: "scan-3.md",
+				S3Key:         "openai/scan-3.md",
+			},
+		},
+	}
+
+	drive := &fakeDrive{saved: map[string]string{}, parents: []string{"watch"}}
+
+	cfg = &handlerConfig{
+		store: store,
+		dc:    drive,
+		wcStore: &fakeChannels{channel: &types.WatchChannel{
+			FolderID:             "watch",
+			DestinationFolderIDs: []string{"shared"},
+			FilenameTemplate:     "{{.Title}}",
+			Routes:               map[string]string{"project-x": "project-x-notes"},
+		}},
+		folderLocations: &types.GoogleFolderDefaultLocations{
+			FolderID:        "watch",
+			ArchiveFolderID: "archive",
+			DestFolderID:    "dest",
+		},
+		s3Client: &fakeS3{objects: map[string]string{
+			"download/scan-1.pdf": "%PDF",
+			"openai/scan-3.md":    "---\ntags:\n  - reMarkable\n---\n\n# Receipt\n",
+		}},
+		attachment: notes.AttachmentOptions{Style: notes.ATTACHMENT_LINK_DRIVE},
+	}
+
+	event := types.DocumentStep{DocumentID: "doc-1", Stage: types.DOCUMENT_STAGE_OPENAI}
+	if err := process(context.Background(), event); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// the route replaces the destinations of the channel and the title of
+	// the sidecar names the files
+	want := []string{"project-x-notes/Trip to Madrid.md", "project-x-notes/Trip to Madrid.pdf"}
+	got := slices.Sorted(maps.Keys(drive.saved))
+	if !slices.Equal(got, want) {
+		t.Fatalf("unexpected files: got %v want %v", got, want)
+	}
+
+	// the tags are added to the ones of the note
+	note := drive.saved["project-x-notes/Trip to Madrid.md"]
+	if !strings.Contains(note, "tags:\n  - reMarkable\n  - receipts\n") {
+		t.Fatalf("the tags were not added: %q", note)
+	}
+
+	// the sidecar is archived along with the original
+	if !slices.Equal(drive.moved, []string{"file", "sidecar"}) {
+		t.Fatalf("unexpected files archived: %v", drive.moved)
+	}
+}
+
+func TestProcessSupersededDocument(t *testing.T) {
+	// skip loading the AWS configuration
+	initOnce.Do(func() {})
+
+	// The document is read when the upload starts, for its record, right
+	// before each destination is published and once they are all published
+	tests := []struct {
+		name        string
+		supersedeAt int
+		previous    *types.Document
+
+		wantSuperseded bool
+		wantSaves      []string
+		wantWithdrawn  []string
+		wantArchived   bool
+	}{
+		{
+			name:         "not superseded",
+			wantSaves:    []string{"scan.pdf", "scan.md", "scan.pdf", "scan.md"},
+			wantArchived: true,
+		},
+		{
+			name:           "superseded before the upload started",
+			supersedeAt:    1,
+			wantSuperseded: true,
+		},
+		{
+			name:           "superseded before the first Drive write",
+			supersedeAt:    3,
+			wantSuperseded: true,
+		},
+		{
+			name:           "superseded between destinations",
+			supersedeAt:    4,
+			wantSuperseded: true,
+			wantSaves:      []string{"scan.pdf", "scan.md"},
+			wantWithdrawn:  []string{"doc-1 shared"},
+		},
+		{
+			name:           "superseded after publishing",
+			supersedeAt:    5,
+			wantSuperseded: true,
+			wantSaves:      []string{"scan.pdf", "scan.md", "scan.pdf", "scan.md"},
+			wantWithdrawn:  []string{"doc-1 shared", "doc-1 personal"},
+		},
+		{
+			name:          "newer version removes the files of the version it superseded",
+			previous:      &types.Document{ID: "doc-0", SupersededBy: "doc-1"},
+			wantSaves:     []string{"scan.pdf", "scan.md", "scan.pdf", "scan.md"},
+			wantWithdrawn: []string{"doc-0 shared", "doc-0 personal"},
+			wantArchived:  true,
+		},
+		{
+			name:          "newer version replaces the files of a version that finished",
+			previous:      &types.Document{ID: "doc-0", Status: types.DOCUMENT_STATUS_COMPLETE},
+			wantSaves:     []string{"scan.pdf", "scan.md", "scan.pdf", "scan.md"},
+			wantWithdrawn: []string{"doc-0 shared", "doc-0 personal"},
+			wantArchived:  true,
+		},
+		{
+			name:         "version superseded by another version",
+			previous:     &types.Document{ID: "doc-0", SupersededBy: "doc-2"},
+			wantSaves:    []string{"scan.pdf", "scan.md", "scan.pdf", "scan.md"},
+			wantArchived: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			document := &types.Document{
+				ID:         "doc-1",
+				SourceType: types.DOCUMENT_SOURCE_GOOGLE_DRIVE,
+				GoogleID:   "file",
+				Name:       "scan.pdf",
+			}
+			if tc.previous != nil {
+				document.PreviousVersionID = tc.previous.ID
+			}
+
+			store := &fakeStore{
+				document:    document,
+				previous:    tc.previous,
+				supersedeAt: tc.supersedeAt,
+				stages: map[types.Stage]*types.DocumentProcessingStage{
+					types.DOCUMENT_STAGE_DOWNLOAD: {
+						Stage:         types.DOCUMENT_STAGE_DOWNLOAD,
+						StageFileName: "scan-1.pdf",
+						S3Key:         "download/scan-1.pdf",
+					},
+					types.DOCUMENT_STAGE_OPENAI: {
+						Stage:         types.DOCUMENT_STAGE_OPENAI,
+						StageFileName: "scan-3.md",
+						S3Key:         "openai/scan-3.md",
+					},
+				},
+			}
+
+			drive := &fakeDrive{saved: map[string]string{}, parents: []string{"watch"}}
+
+			cfg = &handlerConfig{
+				store: store,
+				dc:    drive,
+				folderLocations: &types.GoogleFolderDefaultLocations{
+					FolderID:        "watch",
+					ArchiveFolderID: "archive",
+					DestFolderIDs:   []string{"shared", "personal"},
+				},
+				s3Client: &fakeS3{objects: map[string]string{
+					"download/scan-1.pdf": "%PDF",
+					"openai/scan-3.md":    "# Receipt",
+				}},
+				attachment: notes.AttachmentOptions{Style: notes.ATTACHMENT_LINK_DRIVE},
+			}
+
+			event := types.DocumentStep{DocumentID: "doc-1", Stage: types.DOCUMENT_STAGE_OPENAI}
+
+			err := process(context.Background(), event)
+			if util.IsSuperseded(err) != tc.wantSuperseded {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !tc.wantSuperseded && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if !slices.Equal(drive.saves, tc.wantSaves) {
+				t.Fatalf("unexpected saves: got %v want %v", drive.saves, tc.wantSaves)
+			}
+
+			if !slices.Equal(drive.withdrawn, tc.wantWithdrawn) {
+				t.Fatalf("unexpected files withdrawn: got %v want %v", drive.withdrawn, tc.wantWithdrawn)
+			}
+
+			// a superseded document leaves the original to the newer version
+			if (drive.archives == 1) != tc.wantArchived {
+				t.Fatalf("unexpected archives: %d", drive.archives)
+			}
+
+			if tc.wantSuperseded && store.updated != nil {
+				t.Fatalf("the superseded document was recorded as published: %+v", store.updated)
+			}
+
+			// a superseded document didn't fail
+			if store.failed != nil {
+				t.Fatalf("unexpected failed stage: %+v", store.failed)
+			}
+		})
+	}
+}
+
+func TestProcessVerifiesPublishedNote(t *testing.T) {
+	// skip loading the AWS configuration
+	initOnce.Do(func() {})
+
+	note := "# Café receipt\nTile 40\n"
+
+	tests := []struct {
+		name         string
+		corrupt      func(content string) string
+		corruptReads int
+
+		wantErr    bool
+		wantSaves  []string
+		wantReason string
+	}{
+		{
+			name:      "stored as published",
+			wantSaves: []string{"scan.pdf", "scan.md"},
+		},
+		{
+			name:         "line endings translated",
+			corrupt:      func(content string) string { return strings.ReplaceAll(content, "\n", "\r\n") },
+			corruptReads: 2,
+			wantSaves:    []string{"scan.pdf", "scan.md"},
+		},
+		{
+			name:         "charset mangled once",
+			corrupt:      func(content string) string { return strings.ReplaceAll(content, "é", "Ã©") },
+			corruptReads: 1,
+			wantSaves:    []string{"scan.pdf", "scan.md", "scan.md"},
+		},
+		{
+			name:         "truncated on every save",
+			corrupt:      func(content string) string { return content[:len(content)-1] },
+			corruptReads: 2,
+			wantErr:      true,
+			wantSaves:    []string{"scan.pdf", "scan.md", "scan.md"},
+			wantReason:   "scan.md: published note differs at offset",
+		},
+		{
+			name:         "not valid UTF-8",
+			corrupt:      func(content string) string { return strings.ReplaceAll(content, "é", "\xe9") },
+			corruptReads: 2,
+			wantErr:      true,
+			wantSaves:    []string{"scan.pdf", "scan.md", "scan.md"},
+			wantReason:   "scan.md: published note: content is not valid UTF-8",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			store := &fakeStore{
+				document: &types.Document{
+					ID:         "doc-1",
+					SourceType: types.DOCUMENT_SOURCE_GOOGLE_DRIVE,
+					GoogleID:   "file",
+					Name:       "scan.pdf",
+				},
+				stages: map[types.Stage]*types.DocumentProcessingStage{
+					types.DOCUMENT_STAGE_DOWNLOAD: {
+						Stage:         types.DOCUMENT_STAGE_DOWNLOAD,
+						StageFileName: "scan-1.pdf",
+						S3Key:         "download/scan-1.pdf",
+					},
+					types.DOCUMENT_STAGE_OPENAI: {
+						Stage:         types.DOCUMENT_STAGE_OPENAI,
+						StageFileName: "scan-3.md",
+						S3Key:         "openai/scan-3.md",
+					},
+				},
+			}
+
+			drive := &fakeDrive{
+				saved:        map[string]string{},
+				parents:      []string{"watch"},
+				corrupt:      tc.corrupt,
+				corruptReads: tc.corruptReads,
+			}
+
+			cfg = &handlerConfig{
+				store: store,
+				dc:    drive,
+				folderLocations: &types.GoogleFolderDefaultLocations{
+					FolderID:        "watch",
+					ArchiveFolderID: "archive",
+					DestFolderID:    "destination",
+				},
+				s3Client: &fakeS3{objects: map[string]string{
+					"download/scan-1.pdf": "%PDF",
+					"openai/scan-3.md":    note,
+				}},
+				attachment: notes.AttachmentOptions{Style: notes.ATTACHMENT_LINK_DRIVE},
+			}
+
+			event := types.DocumentStep{DocumentID: "doc-1", Stage: types.DOCUMENT_STAGE_OPENAI}
+
+			err := process(context.Background(), event)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if !slices.Equal(drive.saves, tc.wantSaves) {
+				t.Fatalf("unexpected saves: got %v want %v", drive.saves, tc.wantSaves)
+			}
+
+			if !tc.wantErr {
+				if store.failed != nil || drive.archives != 1 {
+					t.Fatalf("unexpected upload: failed %+v archives %d", store.failed, drive.archives)
+				}
+				return
+			}
+
+			// the note is never left unverified, the original stays put and
+			// the stage records why
+			if drive.archives != 0 {
+				t.Fatalf("the original was archived")
+			}
+
+			if _, ok := drive.saved["destination/scan.md"]; ok {
+				t.Fatalf("the mismatched note was left published: %v", drive.trashed)
+			}
+
+			if store.failed == nil ||
+				store.failed.ErrorCode != errorsmap.CODE_PUBLISHED_NOTE_MISMATCH ||
+				!strings.HasPrefix(store.failed.ErrorReason, tc.wantReason) {
+				t.Fatalf("unexpected failed stage: %+v", store.failed)
+			}
+		})
+	}
+}
@@ -0,0 +1,114 @@
+package attest
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+
+	"github.com/KyleBrandon/scriptor/pkg/types"
+)
+
+type (
+	// Artifact is the hash of the file a stage produced.
+	Artifact struct {
+		Stage types.Stage
+		Hash  string
+	}
+
+	// LinkError reports the first link of a chain that failed verification.
+	LinkError struct {
+		Stage    types.Stage
+		Expected string
+		Actual   string
+		Reason   string
+	}
+)
+
+func (e *LinkError) Error() string {
+	return fmt.Sprintf("%s link: %s", e.Stage, e.Reason)
+}
+
+// ArtifactHash returns the hex encoded SHA-256 of the artifact bytes.
+func ArtifactHash(r io.Reader) (string, error) {
+	hash := sha256.New()
+	if _, err := io.Copy(hash, r); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// BuildChain links the artifacts in the order they were produced. Each link
+// hashes the previous link, the stage name and the artifact hash, so a
+// change to any artifact or to the order of the stages changes every link
+// after it.
+func BuildChain(artifacts []Artifact) []types.AttestationLink {
+	links := make([]types.AttestationLink, 0, len(artifacts))
+
+	previous := ""
+	for _, artifact := range artifacts {
+		previous = linkHash(previous, artifact.Stage, artifact.Hash)
+		links = append(links, types.AttestationLink{
+			Stage:        artifact.Stage,
+			ArtifactHash: artifact.Hash,
+			ChainHash:    previous,
+		})
+	}
+
+	return links
+}
+
+// VerifyChain checks that the stored links are consistent with each other and
+// then compares each link with the recomputed artifact hashes. The first link
+// that doesn't match is returned as a *LinkError.
+func VerifyChain(links []types.AttestationLink, artifacts []Artifact) error {
+	if len(links) == 0 {
+		return &LinkError{Reason: "the document has no attestation"}
+	}
+
+	previous := ""
+	for _, link := range links {
+		previous = linkHash(previous, link.Stage, link.ArtifactHash)
+		if previous != link.ChainHash {
+			return &LinkError{
+				Stage:    link.Stage,
+				Expected: link.ChainHash,
+				Actual:   previous,
+				Reason:   "the stored chain hash does not follow from the links before it",
+			}
+		}
+	}
+
+	actual := make(map[types.Stage]string, len(artifacts))
+	for _, artifact := range artifacts {
+		actual[artifact.Stage] = artifact.Hash
+	}
+
+	for _, link := range links {
+		hash, ok := actual[link.Stage]
+		if !ok {
+			return &LinkError{
+				Stage:    link.Stage,
+				Expected: link.ArtifactHash,
+				Reason:   "the artifact is missing",
+			}
+		}
+
+		if hash != link.ArtifactHash {
+			return &LinkError{
+				Stage:    link.Stage,
+				Expected: link.ArtifactHash,
+				Actual:   hash,
+				Reason:   "the artifact has changed since it was published",
+			}
+		}
+	}
+
+	return nil
+}
+
+func linkHash(previous string, stage types.Stage, artifactHash string) string {
+	hash := sha256.Sum256([]byte(previous + "\n" + string(stage) + "\n" + artifactHash))
+	return hex.EncodeToString(hash[:])
+}
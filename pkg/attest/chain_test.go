@@ -0,0 +1,158 @@
+package attest
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/KyleBrandon/scriptor/pkg/types"
+)
+
+func testArtifacts() []Artifact {
+	return []Artifact{
+		{Stage: types.DOCUMENT_STAGE_DOWNLOAD, Hash: "original"},
+		{Stage: types.DOCUMENT_STAGE_MATHPIX, Hash: "mathpix"},
+		{Stage: types.DOCUMENT_STAGE_OPENAI, Hash: "openai"},
+		{Stage: types.DOCUMENT_STAGE_UPLOAD, Hash: "final"},
+	}
+}
+
+func TestArtifactHash(t *testing.T) {
+	hash, err := ArtifactHash(strings.NewReader("abc"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	want := "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"
+	if hash != want {
+		t.Fatalf("unexpected hash: got %s want %s", hash, want)
+	}
+}
+
+func TestBuildChain(t *testing.T) {
+	links := BuildChain(testArtifacts())
+
+	if len(links) != 4 {
+		t.Fatalf("unexpected number of links: %d", len(links))
+	}
+
+	seen := map[string]bool{}
+	for i, link := range links {
+		if link.ArtifactHash != testArtifacts()[i].Hash {
+			t.Fatalf("link %d has the wrong artifact hash %s", i, link.ArtifactHash)
+		}
+
+		if seen[link.ChainHash] {
+			t.Fatalf("link %d repeats a chain hash", i)
+		}
+		seen[link.ChainHash] = true
+	}
+
+	// a change to an early artifact changes every link after it
+	changed := testArtifacts()
+	changed[1].Hash = "edited"
+	relinked := BuildChain(changed)
+
+	if relinked[0].ChainHash != links[0].ChainHash {
+		t.Fatalf("the link before the change should not change")
+	}
+
+	for i := 1; i < len(links); i++ {
+		if relinked[i].ChainHash == links[i].ChainHash {
+			t.Fatalf("link %d did not change after an earlier artifact changed", i)
+		}
+	}
+
+	// so does the order of the stages
+	swapped := testArtifacts()
+	swapped[1], swapped[2] = swapped[2], swapped[1]
+	if BuildChain(swapped)[3].ChainHash == links[3].ChainHash {
+		t.Fatalf("reordering the stages did not change the final link")
+	}
+}
+
+func TestVerifyChain(t *testing.T) {
+	tests := []struct {
+		name      string
+		links     func() []types.AttestationLink
+		artifacts func() []Artifact
+		wantStage types.Stage
+		wantOK    bool
+	}{
+		{
+			name:      "verified",
+			links:     func() []types.AttestationLink { return BuildChain(testArtifacts()) },
+			artifacts: testArtifacts,
+			wantOK:    true,
+		},
+		{
+			name:  "note edited after publication",
+			links: func() []types.AttestationLink { return BuildChain(testArtifacts()) },
+			artifacts: func() []Artifact {
+				artifacts := testArtifacts()
+				artifacts[3].Hash = "edited"
+				return artifacts
+			},
+			wantStage: types.DOCUMENT_STAGE_UPLOAD,
+		},
+		{
+			name:  "intermediate artifact replaced",
+			links: func() []types.AttestationLink { return BuildChain(testArtifacts()) },
+			artifacts: func() []Artifact {
+				artifacts := testArtifacts()
+				artifacts[1].Hash = "edited"
+				return artifacts
+			},
+			wantStage: types.DOCUMENT_STAGE_MATHPIX,
+		},
+		{
+			name:  "artifact missing",
+			links: func() []types.AttestationLink { return BuildChain(testArtifacts()) },
+			artifacts: func() []Artifact {
+				return testArtifacts()[1:]
+			},
+			wantStage: types.DOCUMENT_STAGE_DOWNLOAD,
+		},
+		{
+			name: "stored artifact hash rewritten",
+			links: func() []types.AttestationLink {
+				links := BuildChain(testArtifacts())
+				links[2].ArtifactHash = "forged"
+				return links
+			},
+			artifacts: func() []Artifact {
+				artifacts := testArtifacts()
+				artifacts[2].Hash = "forged"
+				return artifacts
+			},
+			wantStage: types.DOCUMENT_STAGE_OPENAI,
+		},
+		{
+			name:      "no attestation",
+			links:     func() []types.AttestationLink { return nil },
+			artifacts: testArtifacts,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := VerifyChain(tc.links(), tc.artifacts())
+
+			if tc.wantOK {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+
+			var linkErr *LinkError
+			if !errors.As(err, &linkErr) {
+				t.Fatalf("expected a link error, got %v", err)
+			}
+
+			if linkErr.Stage != tc.wantStage {
+				t.Fatalf("unexpected stage: got %q want %q", linkErr.Stage, tc.wantStage)
+			}
+		})
+	}
+}
@@ -0,0 +1,147 @@
+package attest
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strings"
+)
+
+const (
+	// Front matter field holding the hash of the published note
+	HASH_FIELD = "scriptor_hash"
+
+	frontMatterDelimiter = "---"
+	byteOrderMark        = "\ufeff"
+)
+
+var (
+	ErrNoteHashMissing  = errors.New("note has no scriptor_hash in its front matter")
+	ErrNoteHashMismatch = errors.New("note does not match its scriptor_hash")
+)
+
+// Canonicalize returns the form of a note that its hash is computed over, so
+// that the hash survives the changes editors and sync tools make without
+// changing the content:
+//
+//  1. A leading UTF-8 byte order mark is removed.
+//  2. CRLF and lone CR line endings are converted to LF.
+//  3. If the note starts with a front matter block, a "---" line followed by
+//     lines up to the next "---" line, every line in the block starting with
+//     "scriptor_hash:" is removed. A block left empty is removed along with
+//     its delimiters.
+//  4. Trailing newlines are trimmed and exactly one LF is appended.
+//
+// Everything else, including trailing spaces on a line and blank lines
+// inside the note, is part of the hash.
+func Canonicalize(note []byte) []byte {
+	lines := normalizedLines(note)
+	if end := frontMatterEnd(lines); end > 0 {
+		kept := make([]string, 0, end+1)
+		for _, line := range lines[1:end] {
+			if !isHashField(line) {
+				kept = append(kept, line)
+			}
+		}
+
+		rest := lines[end+1:]
+		if len(kept) == 0 {
+			lines = rest
+		} else {
+			lines = append([]string{frontMatterDelimiter}, kept...)
+			lines = append(lines, frontMatterDelimiter)
+			lines = append(lines, rest...)
+		}
+	}
+
+	content := strings.TrimRight(strings.Join(lines, "\n"), "\n")
+
+	return []byte(content + "\n")
+}
+
+// NoteHash returns the hex encoded SHA-256 of the canonical form of the note.
+func NoteHash(note []byte) string {
+	hash := sha256.Sum256(Canonicalize(note))
+	return hex.EncodeToString(hash[:])
+}
+
+// Stamp returns the canonical form of the note with its hash recorded as the
+// last field of the front matter. A front matter block is added if the note
+// doesn't have one, and an existing hash is replaced.
+func Stamp(note []byte) ([]byte, string) {
+	hash := NoteHash(note)
+	field := HASH_FIELD + ": " + hash
+
+	lines := strings.Split(string(Canonicalize(note)), "\n")
+	if end := frontMatterEnd(lines); end > 0 {
+		stamped := make([]string, 0, len(lines)+1)
+		stamped = append(stamped, lines[:end]...)
+		stamped = append(stamped, field)
+		stamped = append(stamped, lines[end:]...)
+		lines = stamped
+	} else {
+		lines = append([]string{frontMatterDelimiter, field, frontMatterDelimiter}, lines...)
+	}
+
+	return []byte(strings.Join(lines, "\n")), hash
+}
+
+// RecordedHash returns the hash recorded in the front matter of the note.
+func RecordedHash(note []byte) (string, error) {
+	lines := normalizedLines(note)
+	end := frontMatterEnd(lines)
+	for _, line := range lines[1:max(end, 1)] {
+		if isHashField(line) {
+			value := strings.TrimSpace(strings.TrimPrefix(line, HASH_FIELD+":"))
+			return strings.Trim(value, `"'`), nil
+		}
+	}
+
+	return "", ErrNoteHashMissing
+}
+
+// VerifyNote checks the note against the hash recorded in its front matter
+// and returns the hash it computed.
+func VerifyNote(note []byte) (string, error) {
+	recorded, err := RecordedHash(note)
+	if err != nil {
+		return "", err
+	}
+
+	actual := NoteHash(note)
+	if actual != recorded {
+		return actual, ErrNoteHashMismatch
+	}
+
+	return actual, nil
+}
+
+// Split the note into lines after removing the byte order mark and
+// normalizing the line endings.
+func normalizedLines(note []byte) []string {
+	content := strings.TrimPrefix(string(note), byteOrderMark)
+	content = strings.ReplaceAll(content, "\r\n", "\n")
+	content = strings.ReplaceAll(content, "\r", "\n")
+
+	return strings.Split(content, "\n")
+}
+
+// Index of the closing delimiter of the front matter, or -1 if the note
+// doesn't start with a front matter block.
+func frontMatterEnd(lines []string) int {
+	if len(lines) == 0 || lines[0] != frontMatterDelimiter {
+		return -1
+	}
+
+	for i := 1; i < len(lines); i++ {
+		if lines[i] == frontMatterDelimiter {
+			return i
+		}
+	}
+
+	return -1
+}
+
+func isHashField(line string) bool {
+	return strings.HasPrefix(line, HASH_FIELD+":")
+}
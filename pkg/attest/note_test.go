@@ -0,0 +1,235 @@
+package attest
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+const publishedNote = `---
+id: "scan"
+aliases: []
+tags:
+  - reMarkable
+---
+
+People:
+Projects:
+Zettel:
+
+# Contract
+
+The parties agree to the terms below.
+
+![[attachments/scan.pdf]]`
+
+func TestCanonicalize(t *testing.T) {
+	tests := []struct {
+		name string
+		note string
+		want string
+	}{
+		{
+			name: "adds a trailing newline",
+			note: "# Title\nbody",
+			want: "# Title\nbody\n",
+		},
+		{
+			name: "collapses trailing newlines",
+			note: "# Title\nbody\n\n\n",
+			want: "# Title\nbody\n",
+		},
+		{
+			name: "empty note",
+			note: "",
+			want: "\n",
+		},
+		{
+			name: "converts CRLF line endings",
+			note: "# Title\r\nbody\r\n",
+			want: "# Title\nbody\n",
+		},
+		{
+			name: "converts lone CR line endings",
+			note: "# Title\rbody\r",
+			want: "# Title\nbody\n",
+		},
+		{
+			name: "removes the byte order mark",
+			note: "\ufeff# Title\n",
+			want: "# Title\n",
+		},
+		{
+			name: "keeps trailing spaces on a line",
+			note: "# Title  \nbody\t\n",
+			want: "# Title  \nbody\t\n",
+		},
+		{
+			name: "keeps blank lines inside the note",
+			note: "# Title\n\n\nbody\n",
+			want: "# Title\n\n\nbody\n",
+		},
+		{
+			name: "removes the hash field from the front matter",
+			note: "---\nid: scan\nscriptor_hash: abc\n---\nbody\n",
+			want: "---\nid: scan\n---\nbody\n",
+		},
+		{
+			name: "removes the hash field from anywhere in the front matter",
+			note: "---\nscriptor_hash: abc\nid: scan\n---\nbody\n",
+			want: "---\nid: scan\n---\nbody\n",
+		},
+		{
+			name: "removes a front matter block left empty",
+			note: "---\nscriptor_hash: abc\n---\nbody\n",
+			want: "body\n",
+		},
+		{
+			name: "keeps the hash field outside the front matter",
+			note: "body\nscriptor_hash: abc\n",
+			want: "body\nscriptor_hash: abc\n",
+		},
+		{
+			name: "keeps an indented hash field",
+			note: "---\nmeta:\n  scriptor_hash: abc\n---\nbody\n",
+			want: "---\nmeta:\n  scriptor_hash: abc\n---\nbody\n",
+		},
+		{
+			name: "ignores an unterminated front matter",
+			note: "---\nscriptor_hash: abc\nbody\n",
+			want: "---\nscriptor_hash: abc\nbody\n",
+		},
+		{
+			name: "front matter must start the note",
+			note: "\n---\nscriptor_hash: abc\n---\nbody\n",
+			want: "\n---\nscriptor_hash: abc\n---\nbody\n",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got := string(Canonicalize([]byte(tc.note)))
+			if got != tc.want {
+				t.Fatalf("unexpected canonical form:\ngot  %q\nwant %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestStamp(t *testing.T) {
+	tests := []struct {
+		name string
+		note string
+		want string
+	}{
+		{
+			name: "adds the field to the end of the front matter",
+			note: "---\nid: scan\n---\nbody",
+			want: "---\nid: scan\nscriptor_hash: %s\n---\nbody\n",
+		},
+		{
+			name: "adds a front matter block",
+			note: "body",
+			want: "---\nscriptor_hash: %s\n---\nbody\n",
+		},
+		{
+			name: "replaces an existing hash",
+			note: "---\nid: scan\nscriptor_hash: stale\n---\nbody",
+			want: "---\nid: scan\nscriptor_hash: %s\n---\nbody\n",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			stamped, hash := Stamp([]byte(tc.note))
+
+			want := strings.Replace(tc.want, "%s", hash, 1)
+			if string(stamped) != want {
+				t.Fatalf("unexpected stamped note:\ngot  %q\nwant %q", stamped, want)
+			}
+
+			if hash != NoteHash([]byte(tc.note)) {
+				t.Fatalf("stamped hash %s is not the hash of the note", hash)
+			}
+
+			if NoteHash(stamped) != hash {
+				t.Fatalf("stamping changed the hash of the note")
+			}
+		})
+	}
+}
+
+func TestVerifyNote(t *testing.T) {
+	stamped, hash := Stamp([]byte(publishedNote))
+	note := string(stamped)
+
+	tests := []struct {
+		name    string
+		note    string
+		wantErr error
+	}{
+		{
+			name: "unchanged",
+			note: note,
+		},
+		{
+			name: "line endings converted by a sync tool",
+			note: strings.ReplaceAll(note, "\n", "\r\n"),
+		},
+		{
+			name: "trailing newline removed by an editor",
+			note: strings.TrimRight(note, "\n"),
+		},
+		{
+			name: "trailing newlines added by an editor",
+			note: note + "\n\n",
+		},
+		{
+			name: "byte order mark added by an editor",
+			note: "\ufeff" + note,
+		},
+		{
+			name: "quoted hash",
+			note: strings.Replace(note, hash, `"`+hash+`"`, 1),
+		},
+		{
+			name:    "body edited after publication",
+			note:    strings.Replace(note, "agree to", "do not agree to", 1),
+			wantErr: ErrNoteHashMismatch,
+		},
+		{
+			name:    "trailing space added to a line",
+			note:    strings.Replace(note, "# Contract", "# Contract ", 1),
+			wantErr: ErrNoteHashMismatch,
+		},
+		{
+			name:    "front matter edited after publication",
+			note:    strings.Replace(note, "  - reMarkable", "  - reMarkable\n  - signed", 1),
+			wantErr: ErrNoteHashMismatch,
+		},
+		{
+			name:    "hash replaced",
+			note:    strings.Replace(note, hash, strings.Repeat("0", len(hash)), 1),
+			wantErr: ErrNoteHashMismatch,
+		},
+		{
+			name:    "hash removed",
+			note:    strings.Replace(note, "scriptor_hash: "+hash+"\n", "", 1),
+			wantErr: ErrNoteHashMissing,
+		},
+		{
+			name:    "never published",
+			note:    publishedNote,
+			wantErr: ErrNoteHashMissing,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := VerifyNote([]byte(tc.note))
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("unexpected error: got %v want %v", err, tc.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,314 @@
+package audit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/KyleBrandon/scriptor/pkg/types"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+const (
+	// Orphans younger than this are never deleted, they may belong to a
+	// stage that hasn't recorded its key yet
+	DEFAULT_MIN_ORPHAN_AGE = 30 * 24 * time.Hour
+
+	// Keys the referenced set is sized for, about 1.2MB at a 1% false
+	// positive rate. More keys only means more orphans are missed.
+	DEFAULT_EXPECTED_KEYS = 1_000_000
+	FALSE_POSITIVE_RATE   = 0.01
+
+	// Examples kept of each kind of inconsistency
+	MAX_EXAMPLES = 10
+)
+
+type (
+	// The part of the document store the audit reads and repairs
+	StageStore interface {
+		ScanDocumentStages(ctx context.Context, fn func(stages []*types.DocumentProcessingStage) error) error
+		MarkStageArtifactMissing(ctx context.Context, id string, stage types.Stage) error
+	}
+
+	// The part of the S3 client the audit uses
+	ObjectStore interface {
+		HeadObject(
+			ctx context.Context,
+			params *s3.HeadObjectInput,
+			optFns ...func(*s3.Options),
+		) (*s3.HeadObjectOutput, error)
+		ListObjectsV2(
+			ctx context.Context,
+			params *s3.ListObjectsV2Input,
+			optFns ...func(*s3.Options),
+		) (*s3.ListObjectsV2Output, error)
+		DeleteObject(
+			ctx context.Context,
+			params *s3.DeleteObjectInput,
+			optFns ...func(*s3.Options),
+		) (*s3.DeleteObjectOutput, error)
+	}
+
+	Options struct {
+		Bucket string
+
+		// Flag the stages whose artifact is missing
+		Repair bool
+
+		// Orphans must be at least this old to be deleted
+		MinOrphanAge time.Duration
+
+		ExpectedKeys int
+	}
+
+	// Report of the inconsistencies found
+	Report struct {
+		StagesChecked    int
+		DanglingStages   int
+		StagesFlagged    int
+		DanglingExamples []string
+
+		ObjectsChecked     int
+		OrphanedObjects    int
+		OrphanedBytes      int64
+		DeletableOrphans   int
+		OrphansDeleted     int
+		OrphanExamples     []string
+		OrphanedBytesFreed int64
+	}
+
+	// Auditor reconciles the stage rows with the objects in the bucket. The
+	// stages are checked a page at a time and their keys are added to a bloom
+	// filter, then the bucket is listed a page at a time and objects absent
+	// from the filter are orphans. Neither side is held in memory.
+	Auditor struct {
+		store      StageStore
+		objects    ObjectStore
+		options    Options
+		now        func() time.Time
+		referenced *BloomFilter
+	}
+)
+
+func NewAuditor(store StageStore, objects ObjectStore, options Options) *Auditor {
+	if options.MinOrphanAge <= 0 {
+		options.MinOrphanAge = DEFAULT_MIN_ORPHAN_AGE
+	}
+
+	if options.ExpectedKeys <= 0 {
+		options.ExpectedKeys = DEFAULT_EXPECTED_KEYS
+	}
+
+	return &Auditor{
+		store:   store,
+		objects: objects,
+		options: options,
+		now:     time.Now,
+	}
+}
+
+// Audit checks both sides and reports what it found. Nothing is deleted, the
+// stages are only flagged in repair mode.
+func (a *Auditor) Audit(ctx context.Context) (*Report, error) {
+	report := &Report{
+		DanglingExamples: make([]string, 0),
+		OrphanExamples:   make([]string, 0),
+	}
+
+	a.referenced = NewBloomFilter(a.options.ExpectedKeys, FALSE_POSITIVE_RATE)
+
+	err := a.store.ScanDocumentStages(ctx, func(stages []*types.DocumentProcessingStage) error {
+		for _, stage := range stages {
+			if err := a.checkStage(ctx, stage, report); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = a.listOrphans(ctx, func(object s3types.Object) error {
+		report.OrphanedObjects++
+		report.OrphanedBytes += aws.ToInt64(object.Size)
+		report.OrphanExamples = addExample(report.OrphanExamples, aws.ToString(object.Key))
+
+		if a.deletable(object) {
+			report.DeletableOrphans++
+		}
+
+		return nil
+	}, report)
+	if err != nil {
+		return nil, err
+	}
+
+	return report, nil
+}
+
+// DeleteOrphans deletes the orphans old enough to be safe, using the keys
+// referenced when Audit ran. Objects written since then are too young to be
+// deleted.
+func (a *Auditor) DeleteOrphans(ctx context.Context, report *Report) error {
+	if a.referenced == nil {
+		return errors.New("the audit has not run")
+	}
+
+	return a.listOrphans(ctx, func(object s3types.Object) error {
+		if !a.deletable(object) {
+			return nil
+		}
+
+		_, err := a.objects.DeleteObject(ctx, &s3.DeleteObjectInput{
+			Bucket: aws.String(a.options.Bucket),
+			Key:    object.Key,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to delete %s: %w", aws.ToString(object.Key), err)
+		}
+
+		slog.Info("Deleted orphaned object", "key", aws.ToString(object.Key))
+
+		report.OrphansDeleted++
+		report.OrphanedBytesFreed += aws.ToInt64(object.Size)
+		return nil
+	}, nil)
+}
+
+// Check that the artifact of the stage exists, flagging the stage in repair
+// mode when it doesn't
+func (a *Auditor) checkStage(
+	ctx context.Context,
+	stage *types.DocumentProcessingStage,
+	report *Report,
+) error {
+	if stage.S3Key == "" {
+		return nil
+	}
+
+	report.StagesChecked++
+	a.referenced.Add(stage.S3Key)
+
+	_, err := a.objects.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(a.options.Bucket),
+		Key:    aws.String(stage.S3Key),
+	})
+
+	var notFound *s3types.NotFound
+	switch {
+	case err == nil:
+		return nil
+	case !errors.As(err, &notFound):
+		return fmt.Errorf("failed to check %s: %w", stage.S3Key, err)
+	}
+
+	report.DanglingStages++
+	report.DanglingExamples = addExample(
+		report.DanglingExamples,
+		fmt.Sprintf("%s/%s -> %s", stage.ID, stage.Stage, stage.S3Key),
+	)
+
+	if !a.options.Repair || stage.ArtifactMissing {
+		return nil
+	}
+
+	err = a.store.MarkStageArtifactMissing(ctx, stage.ID, stage.Stage)
+	if err != nil {
+		return err
+	}
+
+	report.StagesFlagged++
+	return nil
+}
+
+// Call fn with every object of the bucket that no stage references
+func (a *Auditor) listOrphans(
+	ctx context.Context,
+	fn func(object s3types.Object) error,
+	report *Report,
+) error {
+	paginator := s3.NewListObjectsV2Paginator(a.objects, &s3.ListObjectsV2Input{
+		Bucket: aws.String(a.options.Bucket),
+	})
+
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to list the bucket: %w", err)
+		}
+
+		for _, object := range page.Contents {
+			if report != nil {
+				report.ObjectsChecked++
+			}
+
+			// the final notes are referenced by the documents, not the stages
+			key := aws.ToString(object.Key)
+			if strings.HasPrefix(key, types.S3_FINAL_PREFIX+"/") ||
+				a.referenced.MayContain(key) {
+				continue
+			}
+
+			if err := fn(object); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (a *Auditor) deletable(object s3types.Object) bool {
+	return object.LastModified != nil &&
+		a.now().Sub(*object.LastModified) >= a.options.MinOrphanAge
+}
+
+func addExample(examples []string, example string) []string {
+	if len(examples) >= MAX_EXAMPLES {
+		return examples
+	}
+
+	return append(examples, example)
+}
+
+// Print the report for a person to read
+func (r *Report) Print(w io.Writer) {
+	fmt.Fprintf(w, "stages checked:     %d\n", r.StagesChecked)
+	fmt.Fprintf(w, "dangling stages:    %d", r.DanglingStages)
+	if r.StagesFlagged > 0 {
+		fmt.Fprintf(w, " (%d flagged)", r.StagesFlagged)
+	}
+	fmt.Fprintln(w)
+	for _, example := range r.DanglingExamples {
+		fmt.Fprintf(w, "  %s\n", example)
+	}
+
+	fmt.Fprintf(w, "objects checked:    %d\n", r.ObjectsChecked)
+	fmt.Fprintf(
+		w,
+		"orphaned objects:   %d (%d bytes, %d old enough to delete)\n",
+		r.OrphanedObjects,
+		r.OrphanedBytes,
+		r.DeletableOrphans,
+	)
+	for _, example := range r.OrphanExamples {
+		fmt.Fprintf(w, "  %s\n", example)
+	}
+
+	if r.OrphansDeleted > 0 {
+		fmt.Fprintf(
+			w,
+			"orphans deleted:    %d (%d bytes)\n",
+			r.OrphansDeleted,
+			r.OrphanedBytesFreed,
+		)
+	}
+}
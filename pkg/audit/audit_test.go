@@ -0,0 +1,371 @@
+package audit
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/KyleBrandon/scriptor/pkg/types"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+var auditNow = time.Date(2026, 10, 17, 12, 0, 0, 0, time.UTC)
+
+// Returns the stages two at a time and records the flagged ones
+type fakeStageStore struct {
+	stages  []*types.DocumentProcessingStage
+	flagged []string
+}
+
+func (s *fakeStageStore) ScanDocumentStages(
+	ctx context.Context,
+	fn func(stages []*types.DocumentProcessingStage) error,
+) error {
+	for start := 0; start < len(s.stages); start += 2 {
+		if err := fn(s.stages[start:min(start+2, len(s.stages))]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *fakeStageStore) MarkStageArtifactMissing(ctx context.Context, id string, stage types.Stage) error {
+	s.flagged = append(s.flagged, id+"/"+string(stage))
+	return nil
+}
+
+type fakeObject struct {
+	size int64
+	age  time.Duration
+}
+
+// A bucket that lists two objects a page in key order like S3
+type fakeObjectStore struct {
+	objects map[string]fakeObject
+	deleted []string
+	headErr error
+}
+
+func (f *fakeObjectStore) HeadObject(
+	ctx context.Context,
+	params *s3.HeadObjectInput,
+	optFns ...func(*s3.Options),
+) (*s3.HeadObjectOutput, error) {
+	if f.headErr != nil {
+		return nil, f.headErr
+	}
+
+	if _, ok := f.objects[*params.Key]; !ok {
+		return nil, &s3types.NotFound{}
+	}
+
+	return &s3.HeadObjectOutput{}, nil
+}
+
+func (f *fakeObjectStore) ListObjectsV2(
+	ctx context.Context,
+	params *s3.ListObjectsV2Input,
+	optFns ...func(*s3.Options),
+) (*s3.ListObjectsV2Output, error) {
+	keys := make([]string, 0, len(f.objects))
+	for key := range f.objects {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	// the token is the last key listed so deletes don't shift the pages
+	start := 0
+	if params.ContinuationToken != nil {
+		start = sort.SearchStrings(keys, *params.ContinuationToken+"\x00")
+	}
+	end := min(start+2, len(keys))
+
+	out := &s3.ListObjectsV2Output{IsTruncated: aws.Bool(end < len(keys))}
+	if end < len(keys) {
+		out.NextContinuationToken = aws.String(keys[end-1])
+	}
+
+	for _, key := range keys[start:end] {
+		object := f.objects[key]
+		out.Contents = append(out.Contents, s3types.Object{
+			Key:          aws.String(key),
+			Size:         aws.Int64(object.size),
+			LastModified: aws.Time(auditNow.Add(-object.age)),
+		})
+	}
+
+	return out, nil
+}
+
+func (f *fakeObjectStore) DeleteObject(
+	ctx context.Context,
+	params *s3.DeleteObjectInput,
+	optFns ...func(*s3.Options),
+) (*s3.DeleteObjectOutput, error) {
+	f.deleted = append(f.deleted, *params.Key)
+	delete(f.objects, *params.Key)
+	return &s3.DeleteObjectOutput{}, nil
+}
+
+// A document whose Mathpix output was deleted by hand, one already flagged,
+// one still in progress, and objects left behind by failed runs
+func seededStores() (*fakeStageStore, *fakeObjectStore) {
+	store := &fakeStageStore{stages: []*types.DocumentProcessingStage{
+		{ID: "doc-1", Stage: types.DOCUMENT_STAGE_DOWNLOAD, S3Key: "downloaded/scan-1.pdf"},
+		{ID: "doc-1", Stage: types.DOCUMENT_STAGE_MATHPIX, S3Key: "mathpix/scan-2.md"},
+		{ID: "doc-1", Stage: types.DOCUMENT_STAGE_OPENAI, S3Key: "openai/scan-3.md"},
+		{ID: "doc-2", Stage: types.DOCUMENT_STAGE_DOWNLOAD, S3Key: "downloaded/old-1.pdf", ArtifactMissing: true},
+		{ID: "doc-3", Stage: types.DOCUMENT_STAGE_MATHPIX},
+		// duplicates share the note of the original
+		{ID: "doc-4", Stage: types.DOCUMENT_STAGE_OPENAI, S3Key: "openai/scan-3.md"},
+	}}
+
+	objects := &fakeObjectStore{objects: map[string]fakeObject{
+		"downloaded/scan-1.pdf":   {size: 100, age: 40 * 24 * time.Hour},
+		"openai/scan-3.md":        {size: 10, age: 40 * 24 * time.Hour},
+		"downloaded/failed-1.pdf": {size: 200, age: 60 * 24 * time.Hour},
+		"mathpix/failed-2.md":     {size: 20, age: 45 * 24 * time.Hour},
+		"mathpix/running-2.md":    {size: 5, age: time.Hour},
+	}}
+
+	return store, objects
+}
+
+func newTestAuditor(store StageStore, objects ObjectStore, options Options) *Auditor {
+	auditor := NewAuditor(store, objects, options)
+	auditor.now = func() time.Time { return auditNow }
+	return auditor
+}
+
+func TestAudit(t *testing.T) {
+	tests := []struct {
+		name        string
+		repair      bool
+		wantFlagged []string
+	}{
+		{name: "report only"},
+		{name: "repair", repair: true, wantFlagged: []string{"doc-1/mathpix"}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			store, objects := seededStores()
+			auditor := newTestAuditor(store, objects, Options{Bucket: "bucket", Repair: tc.repair})
+
+			report, err := auditor.Audit(context.Background())
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			want := Report{
+				StagesChecked:  5,
+				DanglingStages: 2,
+				StagesFlagged:  len(tc.wantFlagged),
+				DanglingExamples: []string{
+					"doc-1/mathpix -> mathpix/scan-2.md",
+					"doc-2/downloaded -> downloaded/old-1.pdf",
+				},
+				ObjectsChecked:   5,
+				OrphanedObjects:  3,
+				OrphanedBytes:    225,
+				DeletableOrphans: 2,
+				OrphanExamples: []string{
+					"downloaded/failed-1.pdf",
+					"mathpix/failed-2.md",
+					"mathpix/running-2.md",
+				},
+			}
+
+			if !equalReports(*report, want) {
+				t.Fatalf("unexpected report:\ngot  %+v\nwant %+v", *report, want)
+			}
+
+			// the already flagged stage is not flagged again
+			if !slices.Equal(store.flagged, tc.wantFlagged) {
+				t.Fatalf("unexpected flagged stages: got %v want %v", store.flagged, tc.wantFlagged)
+			}
+
+			if len(objects.deleted) != 0 {
+				t.Fatalf("the audit deleted objects: %v", objects.deleted)
+			}
+		})
+	}
+}
+
+func TestDeleteOrphans(t *testing.T) {
+	tests := []struct {
+		name        string
+		minAge      time.Duration
+		wantDeleted []string
+	}{
+		{
+			name:        "default safety age",
+			wantDeleted: []string{"downloaded/failed-1.pdf", "mathpix/failed-2.md"},
+		},
+		{
+			name:        "longer safety age",
+			minAge:      50 * 24 * time.Hour,
+			wantDeleted: []string{"downloaded/failed-1.pdf"},
+		},
+		{
+			name:        "short safety age",
+			minAge:      time.Minute,
+			wantDeleted: []string{"downloaded/failed-1.pdf", "mathpix/failed-2.md", "mathpix/running-2.md"},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			store, objects := seededStores()
+			auditor := newTestAuditor(store, objects, Options{Bucket: "bucket", MinOrphanAge: tc.minAge})
+
+			report, err := auditor.Audit(context.Background())
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if err := auditor.DeleteOrphans(context.Background(), report); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if !slices.Equal(objects.deleted, tc.wantDeleted) || report.OrphansDeleted != len(tc.wantDeleted) {
+				t.Fatalf("unexpected deletes: got %v want %v", objects.deleted, tc.wantDeleted)
+			}
+
+			// referenced objects are never deleted
+			for _, key := range []string{"downloaded/scan-1.pdf", "openai/scan-3.md"} {
+				if _, ok := objects.objects[key]; !ok {
+					t.Fatalf("deleted the referenced object %s", key)
+				}
+			}
+		})
+	}
+}
+
+func TestDeleteOrphansKeepsFinalNotes(t *testing.T) {
+	store, objects := seededStores()
+	objects.objects["final/doc-1/scan.md"] = fakeObject{size: 10, age: 90 * 24 * time.Hour}
+
+	auditor := newTestAuditor(store, objects, Options{Bucket: "bucket"})
+
+	report, err := auditor.Audit(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if report.OrphanedObjects != 3 || slices.Contains(report.OrphanExamples, "final/doc-1/scan.md") {
+		t.Fatalf("the final note is reported as an orphan: %+v", *report)
+	}
+
+	if err := auditor.DeleteOrphans(context.Background(), report); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if _, ok := objects.objects["final/doc-1/scan.md"]; !ok {
+		t.Fatalf("deleted the final note")
+	}
+}
+
+func TestDeleteOrphansBeforeAudit(t *testing.T) {
+	store, objects := seededStores()
+	auditor := newTestAuditor(store, objects, Options{Bucket: "bucket"})
+
+	if err := auditor.DeleteOrphans(context.Background(), &Report{}); err == nil {
+		t.Fatalf("expected an error deleting before the audit")
+	}
+
+	if len(objects.deleted) != 0 {
+		t.Fatalf("deleted objects without an audit: %v", objects.deleted)
+	}
+}
+
+func TestAuditHeadError(t *testing.T) {
+	// an error other than not found must not flag the stage
+	store, objects := seededStores()
+	objects.headErr = errors.New("access denied")
+	auditor := newTestAuditor(store, objects, Options{Bucket: "bucket", Repair: true})
+
+	if _, err := auditor.Audit(context.Background()); err == nil {
+		t.Fatalf("expected an error")
+	}
+
+	if len(store.flagged) != 0 {
+		t.Fatalf("flagged stages after a failed check: %v", store.flagged)
+	}
+}
+
+func TestAuditExamplesCapped(t *testing.T) {
+	store := &fakeStageStore{}
+	for i := 0; i < MAX_EXAMPLES+5; i++ {
+		store.stages = append(store.stages, &types.DocumentProcessingStage{
+			ID:    "doc-" + strconv.Itoa(i),
+			Stage: types.DOCUMENT_STAGE_OPENAI,
+			S3Key: "openai/missing-" + strconv.Itoa(i) + ".md",
+		})
+	}
+
+	auditor := newTestAuditor(store, &fakeObjectStore{}, Options{Bucket: "bucket"})
+
+	report, err := auditor.Audit(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if report.DanglingStages != MAX_EXAMPLES+5 || len(report.DanglingExamples) != MAX_EXAMPLES {
+		t.Fatalf("unexpected report: %d dangling with %d examples", report.DanglingStages, len(report.DanglingExamples))
+	}
+}
+
+func TestReportPrint(t *testing.T) {
+	report := &Report{
+		StagesChecked:    5,
+		DanglingStages:   1,
+		StagesFlagged:    1,
+		DanglingExamples: []string{"doc-1/mathpix -> mathpix/scan-2.md"},
+		ObjectsChecked:   4,
+		OrphanedObjects:  1,
+		OrphanedBytes:    200,
+		DeletableOrphans: 1,
+		OrphanExamples:   []string{"downloaded/failed-1.pdf"},
+	}
+
+	var out bytes.Buffer
+	report.Print(&out)
+
+	for _, want := range []string{
+		"dangling stages:    1 (1 flagged)",
+		"  doc-1/mathpix -> mathpix/scan-2.md",
+		"orphaned objects:   1 (200 bytes, 1 old enough to delete)",
+		"  downloaded/failed-1.pdf",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Fatalf("expected the report to contain %q:\n%s", want, out.String())
+		}
+	}
+
+	if strings.Contains(out.String(), "orphans deleted") {
+		t.Fatalf("reported deletes for a dry run:\n%s", out.String())
+	}
+}
+
+func equalReports(a, b Report) bool {
+	return slices.Equal(a.DanglingExamples, b.DanglingExamples) &&
+		slices.Equal(a.OrphanExamples, b.OrphanExamples) &&
+		a.StagesChecked == b.StagesChecked &&
+		a.DanglingStages == b.DanglingStages &&
+		a.StagesFlagged == b.StagesFlagged &&
+		a.ObjectsChecked == b.ObjectsChecked &&
+		a.OrphanedObjects == b.OrphanedObjects &&
+		a.OrphanedBytes == b.OrphanedBytes &&
+		a.DeletableOrphans == b.DeletableOrphans &&
+		a.OrphansDeleted == b.OrphansDeleted
+}
@@ -0,0 +1,66 @@
+package audit
+
+import (
+	"hash/fnv"
+	"math"
+)
+
+// BloomFilter is a set of keys that can answer "maybe present" or "definitely
+// absent" in a fixed amount of memory. A key that was added is never reported
+// absent, which is what keeps the audit from treating a referenced object as
+// an orphan.
+type BloomFilter struct {
+	bits   []uint64
+	size   uint64
+	hashes int
+}
+
+// NewBloomFilter sizes the filter for the expected number of keys and the
+// rate of false positives.
+func NewBloomFilter(expected int, falsePositiveRate float64) *BloomFilter {
+	expected = max(expected, 1)
+
+	size := uint64(math.Ceil(-float64(expected) * math.Log(falsePositiveRate) / (math.Ln2 * math.Ln2)))
+	size = max(size, 64)
+	hashes := max(int(math.Round(float64(size)/float64(expected)*math.Ln2)), 1)
+
+	return &BloomFilter{
+		bits:   make([]uint64, (size+63)/64),
+		size:   size,
+		hashes: hashes,
+	}
+}
+
+func (b *BloomFilter) Add(key string) {
+	h1, h2 := bloomHashes(key)
+	for i := 0; i < b.hashes; i++ {
+		bit := (h1 + uint64(i)*h2) % b.size
+		b.bits[bit/64] |= 1 << (bit % 64)
+	}
+}
+
+// MayContain is false only for keys that were never added.
+func (b *BloomFilter) MayContain(key string) bool {
+	h1, h2 := bloomHashes(key)
+	for i := 0; i < b.hashes; i++ {
+		bit := (h1 + uint64(i)*h2) % b.size
+		if b.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// The two hashes combined to derive the positions of a key
+func bloomHashes(key string) (uint64, uint64) {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	h1 := h.Sum64()
+
+	h = fnv.New64()
+	h.Write([]byte(key))
+	h2 := h.Sum64() | 1
+
+	return h1, h2
+}
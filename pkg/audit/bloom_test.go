@@ -0,0 +1,47 @@
+package audit
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestBloomFilter(t *testing.T) {
+	filter := NewBloomFilter(10_000, 0.01)
+
+	for i := 0; i < 10_000; i++ {
+		filter.Add(fmt.Sprintf("openai/scan-%d.md", i))
+	}
+
+	// a key that was added is never reported absent
+	for i := 0; i < 10_000; i++ {
+		if !filter.MayContain(fmt.Sprintf("openai/scan-%d.md", i)) {
+			t.Fatalf("added key %d reported absent", i)
+		}
+	}
+
+	falsePositives := 0
+	for i := 0; i < 10_000; i++ {
+		if filter.MayContain(fmt.Sprintf("mathpix/other-%d.md", i)) {
+			falsePositives++
+		}
+	}
+
+	if falsePositives > 300 {
+		t.Fatalf("too many false positives: %d of 10000", falsePositives)
+	}
+}
+
+func TestBloomFilterOverfilled(t *testing.T) {
+	// more keys than it was sized for only raises the false positives
+	filter := NewBloomFilter(10, 0.01)
+
+	for i := 0; i < 1_000; i++ {
+		filter.Add(fmt.Sprintf("key-%d", i))
+	}
+
+	for i := 0; i < 1_000; i++ {
+		if !filter.MayContain(fmt.Sprintf("key-%d", i)) {
+			t.Fatalf("added key %d reported absent", i)
+		}
+	}
+}
@@ -4,9 +4,14 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"maps"
+	"os"
 	"slices"
+	"time"
 
 	stypes "github.com/KyleBrandon/scriptor/pkg/types"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
 )
@@ -16,6 +21,23 @@ const (
 	DOCUMENT_PROCESSING_STAGE_TABLE = "DocumentProcessingStage"
 	WATCH_CHANNEL_TABLE             = "WatchChannels"
 	WATCH_CHANNEL_LOCK_TABLE        = "WatchChannelLocks"
+	WEBHOOK_CAPTURE_TABLE           = "WebhookCaptures"
+	FAILED_NOTIFICATION_TABLE       = "FailedNotifications"
+	NOTIFICATION_HISTORY_TABLE      = "NotificationHistory"
+
+	// Every watch channel has the same expiry partition, so ExpiryIndex
+	// keeps all of them in order of expiry
+	WATCH_CHANNEL_EXPIRY_PARTITION = "watch_channels"
+
+	// How long a watch channel lock is kept after it was created or last
+	// taken. Channels last 48 hours and get a new lock each time they are
+	// registered again, so a lock unused this long belongs to a channel
+	// that is gone and DynamoDB removes it.
+	WATCH_CHANNEL_LOCK_TTL = 7 * 24 * time.Hour
+
+	// The TTL attribute of the documents and their stages. Only completed
+	// documents have one, and only when RETENTION_DAYS is set.
+	DOCUMENT_TTL_ATTRIBUTE = "ttl"
 )
 
 type (
@@ -23,68 +45,247 @@ type (
 		Ping() error
 	}
 
+	// The DynamoDB operations the stores use, so a fake client can stand
+	// in for the tables in tests. *dynamodb.Client implements it.
+	dynamoAPI interface {
+		GetItem(
+			ctx context.Context,
+			params *dynamodb.GetItemInput,
+			optFns ...func(*dynamodb.Options),
+		) (*dynamodb.GetItemOutput, error)
+		PutItem(
+			ctx context.Context,
+			params *dynamodb.PutItemInput,
+			optFns ...func(*dynamodb.Options),
+		) (*dynamodb.PutItemOutput, error)
+		UpdateItem(
+			ctx context.Context,
+			params *dynamodb.UpdateItemInput,
+			optFns ...func(*dynamodb.Options),
+		) (*dynamodb.UpdateItemOutput, error)
+		DeleteItem(
+			ctx context.Context,
+			params *dynamodb.DeleteItemInput,
+			optFns ...func(*dynamodb.Options),
+		) (*dynamodb.DeleteItemOutput, error)
+		Query(
+			ctx context.Context,
+			params *dynamodb.QueryInput,
+			optFns ...func(*dynamodb.Options),
+		) (*dynamodb.QueryOutput, error)
+		Scan(
+			ctx context.Context,
+			params *dynamodb.ScanInput,
+			optFns ...func(*dynamodb.Options),
+		) (*dynamodb.ScanOutput, error)
+		TransactWriteItems(
+			ctx context.Context,
+			params *dynamodb.TransactWriteItemsInput,
+			optFns ...func(*dynamodb.Options),
+		) (*dynamodb.TransactWriteItemsOutput, error)
+	}
+
 	DocumentStore interface {
 		InsertDocument(ctx context.Context, document *stypes.Document) error
+		InsertDocumentWithStage(
+			ctx context.Context,
+			document *stypes.Document,
+			stage *stypes.DocumentProcessingStage,
+		) error
+		UpdateDocumentFields(ctx context.Context, id string, update *stypes.DocumentUpdate) error
 		GetDocument(ctx context.Context, id string) (*stypes.Document, error)
 		GetDocumentBySourceKey(ctx context.Context, sourceKey string) (*stypes.Document, error)
 		GetDocumentByGoogleID(ctx context.Context, googleFileID string) (*stypes.Document, error)
-		GetDocumentStage(ctx context.Context, id string, stage string) (*stypes.DocumentProcessingStage, error)
+		GetDocumentByContentHash(ctx context.Context, contentHash string) (*stypes.Document, error)
+		ListDocuments(ctx context.Context, since time.Time) ([]*stypes.Document, error)
+		ListDocumentsByStatus(
+			ctx context.Context,
+			status string,
+			since, until time.Time,
+			limit int,
+			cursor string,
+		) ([]*stypes.Document, string, error)
+		UpdateDocumentStatus(ctx context.Context, id string, stage stypes.Stage, status string) error
+		UpdateDocumentAttestation(ctx context.Context, id string, links []stypes.AttestationLink) error
+		UpdateDocumentContentHash(ctx context.Context, id string, contentHash string) error
+		MarkDocumentDuplicate(ctx context.Context, id string, originalID string) error
+		SupersedeDocument(ctx context.Context, id string, newerID string) error
+		UpdateDocumentChildren(ctx context.Context, id string, childIDs []string) error
+		CompleteChildDocument(ctx context.Context, parentID string, childID string) (int, error)
+		GetDocumentStage(ctx context.Context, id string, stage stypes.Stage) (*stypes.DocumentProcessingStage, error)
+		GetDocumentStages(ctx context.Context, id string) ([]*stypes.DocumentProcessingStage, error)
+		GetStageDurationStats(ctx context.Context, since time.Time) ([]*stypes.StageDurationStats, error)
 		StartDocumentStage(
 			ctx context.Context,
 			id string,
-			stage string,
+			stage stypes.Stage,
+			originalFileName string,
+		) (*stypes.DocumentProcessingStage, error)
+		StartPendingDocumentStage(
+			ctx context.Context,
+			id string,
+			stage stypes.Stage,
 			originalFileName string,
 		) (*stypes.DocumentProcessingStage, error)
 		CompleteDocumentStage(ctx context.Context, stage *stypes.DocumentProcessingStage) error
+		ScanDocumentStages(ctx context.Context, fn func(stages []*stypes.DocumentProcessingStage) error) error
+		MarkStageArtifactMissing(ctx context.Context, id string, stage stypes.Stage) error
+		CompleteStageDestinations(ctx context.Context, id string, stage stypes.Stage, folderIDs []string) error
+		FailDocumentStage(
+			ctx context.Context,
+			stage *stypes.DocumentProcessingStage,
+			status string,
+			code string,
+			reason string,
+		) error
+		ReleaseHeldDocument(ctx context.Context, id string) (bool, error)
+		HoldExecutionSlot(ctx context.Context, id string) (bool, error)
+		ReleaseExecutionSlot(ctx context.Context, id string) (bool, error)
 	}
 
 	DocumentStoreContext struct {
-		store *dynamodb.Client
+		store dynamoAPI
+
+		// How long a completed document and its stages are kept, forever
+		// when zero
+		retention time.Duration
 	}
 
 	WatchChannelStore interface {
 		GetWatchChannels(ctx context.Context) ([]*stypes.WatchChannel, error)
+		GetWatchChannelsExpiringBefore(ctx context.Context, before time.Time) ([]*stypes.WatchChannel, error)
+		HasWatchChannels(ctx context.Context) (bool, error)
+		GetWatchChannel(ctx context.Context, folderID string) (*stypes.WatchChannel, error)
+		InsertWatchChannel(ctx context.Context, watchChannel *stypes.WatchChannel) error
 		UpdateWatchChannel(ctx context.Context, watchChannel *stypes.WatchChannel) error
+		DeleteWatchChannel(ctx context.Context, folderID string) error
+		SetWatchChannelPaused(ctx context.Context, folderID string, paused bool) error
 		GetWatchChannelByID(ctx context.Context, channelID string) (*stypes.WatchChannel, error)
 		GetWatchChannelLock(ctx context.Context, channelID string) (*stypes.WatchChannelLock, error)
 		CreateWatchChannelLock(ctx context.Context, channelID, startToken string) error
+		ListWatchChannelLocks(ctx context.Context) ([]*stypes.WatchChannelLock, error)
 		DeleteWatchChannelLock(ctx context.Context, channelID string) error
 		ClearWatchChannelLock(ctx context.Context, channelID, newStartToken string) error
 		AcquireChangesToken(ctx context.Context, channelID string) (string, error)
 		ReleaseChangesToken(ctx context.Context, channelID, newStartToken string) error
+		IncrementActiveExecutions(ctx context.Context, channelID string, limit int) error
+		DecrementActiveExecutions(ctx context.Context, channelID string) error
+		MarkNotificationPending(ctx context.Context, channelID string, until time.Time) error
+		ClearNotificationPending(ctx context.Context, channelID string) error
 	}
 
 	WatchChannelStoreContext struct {
-		store *dynamodb.Client
+		store dynamoAPI
+	}
+
+	// WebhookCaptureStore keeps the redacted webhook requests. Captures are
+	// listed newest first a page at a time, the cursor is empty on the last
+	// page.
+	WebhookCaptureStore interface {
+		InsertWebhookCapture(ctx context.Context, capture *stypes.WebhookCapture) error
+		ListWebhookCaptures(
+			ctx context.Context,
+			channelID string,
+			limit int32,
+			cursor string,
+		) ([]*stypes.WebhookCapture, string, error)
+	}
+
+	WebhookCaptureStoreContext struct {
+		store dynamoAPI
+	}
+
+	// FailedNotificationStore keeps the notifications that were moved to the
+	// dead-letter queue. A notification that isn't recorded is returned
+	// empty.
+	FailedNotificationStore interface {
+		InsertFailedNotification(ctx context.Context, notification *stypes.FailedNotification) error
+		UpdateFailedNotification(ctx context.Context, notification *stypes.FailedNotification) error
+		GetFailedNotification(ctx context.Context, messageID string) (*stypes.FailedNotification, error)
+	}
+
+	FailedNotificationStoreContext struct {
+		store dynamoAPI
+	}
+
+	// NotificationHistoryStore keeps the audit trail of each notification.
+	// The updates add to the history, so deliveries of the same
+	// notification and the documents started from it can record at once.
+	NotificationHistoryStore interface {
+		InsertNotificationHistory(ctx context.Context, history *stypes.NotificationHistory) error
+		RecordNotificationProcessed(
+			ctx context.Context,
+			notificationID string,
+			documentIDs []string,
+			reason string,
+		) error
+		RecordNotificationExecution(ctx context.Context, notificationID, executionName string) error
+	}
+
+	NotificationHistoryStoreContext struct {
+		store dynamoAPI
 	}
 )
 
 var (
 	ErrDocumentNotFound         = errors.New("document not found")
+	ErrDocumentExists           = errors.New("document already exists")
+	ErrStageNotFound            = errors.New("document stage not found")
 	ErrWatchChannelLockNotFound = errors.New("watch channel lock not found")
+	ErrWatchChannelLockExists   = errors.New("watch channel lock already exists")
+	ErrWatchChannelLockHeld     = errors.New("watch channel lock is held by another notification")
+	ErrWatchChannelNotFound     = errors.New("watch channel not found")
+	ErrWatchChannelExists       = errors.New("watch channel already exists")
+	ErrExecutionLimitReached    = errors.New("channel is running as many executions as it allows")
+	ErrFailedNotificationExists = errors.New("failed notification already recorded")
+	ErrNotificationPending      = errors.New("channel already has a notification pending")
 )
 
+// Configure a DynamoDB client from the environment. DYNAMODB_ENDPOINT points
+// it at another endpoint, like DynamoDB Local or LocalStack, instead of AWS.
+func newDynamoClient(ctx context.Context) (*dynamodb.Client, error) {
+	awsCfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	endpoint := os.Getenv("DYNAMODB_ENDPOINT")
+
+	return dynamodb.NewFromConfig(awsCfg, func(o *dynamodb.Options) {
+		if endpoint != "" {
+			o.BaseEndpoint = aws.String(endpoint)
+		}
+	}), nil
+}
+
+// Build a SET of every attribute besides the keys, in the order of their
+// names. The attribute names are passed as expression attribute names since
+// some, like status and name, are reserved words.
 func buildUpdateExpression(
 	input map[string]types.AttributeValue,
 	excludeKeys []string,
-) (string, map[string]types.AttributeValue) {
+) (string, map[string]string, map[string]types.AttributeValue) {
 	updateExpr := "SET "
+	exprNames := map[string]string{}
 	exprValues := map[string]types.AttributeValue{}
 	i := 0
 
-	for key, value := range input {
+	for _, key := range slices.Sorted(maps.Keys(input)) {
 		// skip the keys
 		if slices.Contains(excludeKeys, key) {
 			continue
 		}
+		value := input[key]
 
+		name := fmt.Sprintf("#attr%d", i)
 		placeholder := fmt.Sprintf(":val%d", i)
-		updateExpr += fmt.Sprintf("%s = %s, ", key, placeholder)
+		updateExpr += fmt.Sprintf("%s = %s, ", name, placeholder)
+		exprNames[name] = key
 		exprValues[placeholder] = value
 		i++
 	}
 
 	// remove trailing comma and space
 	updateExpr = updateExpr[:len(updateExpr)-2]
-	return updateExpr, exprValues
+	return updateExpr, exprNames, exprValues
 }
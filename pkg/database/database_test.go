@@ -0,0 +1,378 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+
+	stypes "github.com/KyleBrandon/scriptor/pkg/types"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// An in-memory table client. Items are kept in the order they were put and
+// found by the string values of their keys. Queries return every item of the
+// table whose key attributes match the values of the key condition, a page
+// of Limit items at a time, and ignore the rest of the condition. Updates are
+// recorded but not applied.
+type fakeClient struct {
+	dynamoAPI
+	tables  map[string][]map[string]types.AttributeValue
+	updates []*dynamodb.UpdateItemInput
+
+	// the error of an update, when there is one
+	updateErr func(params *dynamodb.UpdateItemInput) error
+}
+
+func newFakeClient() *fakeClient {
+	return &fakeClient{tables: make(map[string][]map[string]types.AttributeValue)}
+}
+
+// The key attributes of each table
+var tableKeys = map[string][]string{
+	DOCUMENT_TABLE:                  {"id"},
+	DOCUMENT_PROCESSING_STAGE_TABLE: {"id", "stage"},
+	WEBHOOK_CAPTURE_TABLE:           {"channel_id", "captured_at"},
+}
+
+func stringValue(value types.AttributeValue) string {
+	if s, ok := value.(*types.AttributeValueMemberS); ok {
+		return s.Value
+	}
+
+	return ""
+}
+
+func matches(item, key map[string]types.AttributeValue) bool {
+	for name, value := range key {
+		if stringValue(item[name]) != stringValue(value) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (c *fakeClient) put(table string, item map[string]types.AttributeValue) {
+	key := make(map[string]types.AttributeValue)
+	for _, name := range tableKeys[table] {
+		key[name] = item[name]
+	}
+
+	items := slices.DeleteFunc(c.tables[table], func(existing map[string]types.AttributeValue) bool {
+		return matches(existing, key)
+	})
+	c.tables[table] = append(items, item)
+}
+
+func (c *fakeClient) PutItem(
+	ctx context.Context,
+	params *dynamodb.PutItemInput,
+	optFns ...func(*dynamodb.Options),
+) (*dynamodb.PutItemOutput, error) {
+	c.put(aws.ToString(params.TableName), params.Item)
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+func (c *fakeClient) TransactWriteItems(
+	ctx context.Context,
+	params *dynamodb.TransactWriteItemsInput,
+	optFns ...func(*dynamodb.Options),
+) (*dynamodb.TransactWriteItemsOutput, error) {
+	for _, item := range params.TransactItems {
+		c.put(aws.ToString(item.Put.TableName), item.Put.Item)
+	}
+
+	return &dynamodb.TransactWriteItemsOutput{}, nil
+}
+
+func (c *fakeClient) UpdateItem(
+	ctx context.Context,
+	params *dynamodb.UpdateItemInput,
+	optFns ...func(*dynamodb.Options),
+) (*dynamodb.UpdateItemOutput, error) {
+	c.updates = append(c.updates, params)
+	if c.updateErr != nil {
+		if err := c.updateErr(params); err != nil {
+			return nil, err
+		}
+	}
+
+	return &dynamodb.UpdateItemOutput{}, nil
+}
+
+func (c *fakeClient) GetItem(
+	ctx context.Context,
+	params *dynamodb.GetItemInput,
+	optFns ...func(*dynamodb.Options),
+) (*dynamodb.GetItemOutput, error) {
+	for _, item := range c.tables[aws.ToString(params.TableName)] {
+		if matches(item, params.Key) {
+			return &dynamodb.GetItemOutput{Item: item}, nil
+		}
+	}
+
+	return &dynamodb.GetItemOutput{}, nil
+}
+
+func (c *fakeClient) Query(
+	ctx context.Context,
+	params *dynamodb.QueryInput,
+	optFns ...func(*dynamodb.Options),
+) (*dynamodb.QueryOutput, error) {
+	table := aws.ToString(params.TableName)
+
+	// the partition key is the only value a key condition of these tables
+	// compares for equality
+	partition := tableKeys[table][0]
+	var items []map[string]types.AttributeValue
+	for _, item := range c.tables[table] {
+		for _, value := range params.ExpressionAttributeValues {
+			if stringValue(item[partition]) == stringValue(value) {
+				items = append(items, item)
+				break
+			}
+		}
+	}
+
+	if params.ScanIndexForward != nil && !*params.ScanIndexForward {
+		slices.Reverse(items)
+	}
+
+	if params.ExclusiveStartKey != nil {
+		i := slices.IndexFunc(items, func(item map[string]types.AttributeValue) bool {
+			return matches(item, params.ExclusiveStartKey)
+		})
+		items = items[i+1:]
+	}
+
+	output := &dynamodb.QueryOutput{Items: items}
+	if limit := int(aws.ToInt32(params.Limit)); limit > 0 && len(items) > limit {
+		output.Items = items[:limit]
+
+		last := output.Items[limit-1]
+		output.LastEvaluatedKey = make(map[string]types.AttributeValue)
+		for _, name := range tableKeys[table] {
+			output.LastEvaluatedKey[name] = last[name]
+		}
+	}
+
+	return output, nil
+}
+
+func TestNewDynamoClientEndpoint(t *testing.T) {
+	t.Setenv("AWS_REGION", "us-east-1")
+
+	tests := []struct {
+		name     string
+		endpoint string
+		want     *string
+	}{
+		{name: "AWS"},
+		{name: "DynamoDB Local", endpoint: "http://localhost:8000", want: aws.String("http://localhost:8000")},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Setenv("DYNAMODB_ENDPOINT", tc.endpoint)
+
+			client, err := newDynamoClient(context.Background())
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if got := client.Options().BaseEndpoint; !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("unexpected endpoint: got %v want %v", aws.ToString(got), aws.ToString(tc.want))
+			}
+		})
+	}
+}
+
+func TestDocumentRoundTrip(t *testing.T) {
+	store := NewDocumentStoreWithClient(newFakeClient())
+	ctx := context.Background()
+
+	created := time.Date(2025, 1, 2, 3, 4, 5, 600, time.UTC)
+	document := &stypes.Document{
+		ID:             "doc-1",
+		GoogleID:       "file-1",
+		Name:           "scan.pdf",
+		Status:         stypes.DOCUMENT_STATUS_PENDING,
+		CreatedTime:    created,
+		ModifiedTime:   created.Add(time.Hour),
+		HeadRevisionID: "rev-1",
+	}
+	stage := &stypes.DocumentProcessingStage{
+		ID:               "doc-1",
+		Stage:            stypes.DOCUMENT_STAGE_DOWNLOAD,
+		StageStatus:      stypes.DOCUMENT_STATUS_PENDING,
+		OriginalFileName: "scan.pdf",
+	}
+
+	if err := store.InsertDocumentWithStage(ctx, document, stage); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	gotDocument, err := store.GetDocument(ctx, "doc-1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(gotDocument, document) {
+		t.Fatalf("unexpected document:\ngot  %+v\nwant %+v", gotDocument, document)
+	}
+
+	if _, err := store.GetDocument(ctx, "doc-2"); !errors.Is(err, ErrDocumentNotFound) {
+		t.Fatalf("expected a missing document to be not found: %v", err)
+	}
+
+	gotStage, err := store.GetDocumentStage(ctx, "doc-1", stypes.DOCUMENT_STAGE_DOWNLOAD)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(gotStage, stage) {
+		t.Fatalf("unexpected stage:\ngot  %+v\nwant %+v", gotStage, stage)
+	}
+
+	stages, err := store.GetDocumentStages(ctx, "doc-1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(stages) != 1 || !reflect.DeepEqual(stages[0], stage) {
+		t.Fatalf("unexpected stages: %+v", stages)
+	}
+}
+
+func TestGetDocumentStageNotFound(t *testing.T) {
+	store := NewDocumentStoreWithClient(newFakeClient())
+
+	_, err := store.GetDocumentStage(context.Background(), "doc-1", stypes.DOCUMENT_STAGE_DOWNLOAD)
+	if !errors.Is(err, ErrStageNotFound) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestListWebhookCaptures(t *testing.T) {
+	store := NewWebhookCaptureStoreWithClient(newFakeClient())
+	ctx := context.Background()
+
+	for _, capturedAt := range []string{"2025-01-01T00:00:01Z", "2025-01-01T00:00:02Z", "2025-01-01T00:00:03Z"} {
+		capture := &stypes.WebhookCapture{ChannelID: "channel-1", CapturedAt: capturedAt, Outcome: "queued"}
+		if err := store.InsertWebhookCapture(ctx, capture); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	// another channel's captures aren't listed
+	other := &stypes.WebhookCapture{ChannelID: "channel-2", CapturedAt: "2025-01-01T00:00:04Z"}
+	if err := store.InsertWebhookCapture(ctx, other); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// newest first, a page at a time
+	var pages [][]string
+	cursor := ""
+	for {
+		captures, next, err := store.ListWebhookCaptures(ctx, "channel-1", 2, cursor)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		var page []string
+		for _, capture := range captures {
+			page = append(page, capture.CapturedAt)
+		}
+		pages = append(pages, page)
+
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+
+	want := [][]string{
+		{"2025-01-01T00:00:03Z", "2025-01-01T00:00:02Z"},
+		{"2025-01-01T00:00:01Z"},
+	}
+	if !reflect.DeepEqual(pages, want) {
+		t.Fatalf("unexpected pages: got %v want %v", pages, want)
+	}
+}
+
+func TestBuildUpdateExpression(t *testing.T) {
+	value := func(s string) types.AttributeValue { return &types.AttributeValueMemberS{Value: s} }
+
+	tests := []struct {
+		name        string
+		input       map[string]types.AttributeValue
+		excludeKeys []string
+
+		wantExpr   string
+		wantNames  map[string]string
+		wantValues map[string]types.AttributeValue
+	}{
+		{
+			name:       "one attribute",
+			input:      map[string]types.AttributeValue{"folder_id": value("folder-1")},
+			wantExpr:   "SET #attr0 = :val0",
+			wantNames:  map[string]string{"#attr0": "folder_id"},
+			wantValues: map[string]types.AttributeValue{":val0": value("folder-1")},
+		},
+		{
+			// every name is reserved by DynamoDB
+			name: "reserved words",
+			input: map[string]types.AttributeValue{
+				"name":      value("scan.pdf"),
+				"size":      &types.AttributeValueMemberN{Value: "42"},
+				"status":    value("complete"),
+				"timestamp": value("2025-01-01T10:00:00Z"),
+			},
+			wantExpr: "SET #attr0 = :val0, #attr1 = :val1, #attr2 = :val2, #attr3 = :val3",
+			wantNames: map[string]string{
+				"#attr0": "name",
+				"#attr1": "size",
+				"#attr2": "status",
+				"#attr3": "timestamp",
+			},
+			wantValues: map[string]types.AttributeValue{
+				":val0": value("scan.pdf"),
+				":val1": &types.AttributeValueMemberN{Value: "42"},
+				":val2": value("complete"),
+				":val3": value("2025-01-01T10:00:00Z"),
+			},
+		},
+		{
+			name: "keys left out",
+			input: map[string]types.AttributeValue{
+				"id":           value("doc-1"),
+				"stage":        value("mathpix"),
+				"stage_status": value("error"),
+			},
+			excludeKeys: []string{"id", "stage"},
+			wantExpr:    "SET #attr0 = :val0",
+			wantNames:   map[string]string{"#attr0": "stage_status"},
+			wantValues:  map[string]types.AttributeValue{":val0": value("error")},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			expr, names, values := buildUpdateExpression(tc.input, tc.excludeKeys)
+
+			if expr != tc.wantExpr {
+				t.Fatalf("unexpected expression: got %q want %q", expr, tc.wantExpr)
+			}
+
+			if !reflect.DeepEqual(names, tc.wantNames) {
+				t.Fatalf("unexpected names: got %v want %v", names, tc.wantNames)
+			}
+
+			if !reflect.DeepEqual(values, tc.wantValues) {
+				t.Fatalf("unexpected values: got %v want %v", values, tc.wantValues)
+			}
+		})
+	}
+}
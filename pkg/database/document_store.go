@@ -2,20 +2,27 @@ package database
 
 import (
 	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"log/slog"
+	"maps"
+	"os"
+	"slices"
+	"strconv"
 	"time"
 
-	"github.com/KyleBrandon/scriptor/lambdas/util"
+	"github.com/KyleBrandon/scriptor/pkg/metrics"
 	stypes "github.com/KyleBrandon/scriptor/pkg/types"
 	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
 )
 
 func NewDocumentStore(ctx context.Context) (DocumentStore, error) {
-	awsCfg, err := config.LoadDefaultConfig(ctx)
+	store, err := newDynamoClient(ctx)
 	if err != nil {
 		slog.Error(
 			"Failed to configure the DocumentStoreContext ",
@@ -25,13 +32,46 @@ func NewDocumentStore(ctx context.Context) (DocumentStore, error) {
 		return nil, err
 	}
 
-	store := dynamodb.NewFromConfig(awsCfg)
+	retention, err := parseRetention(os.Getenv("RETENTION_DAYS"))
+	if err != nil {
+		slog.Error("Failed to read the retention of the documents", "error", err)
+		return nil, err
+	}
 
 	return &DocumentStoreContext{
-		store,
+		store:     store,
+		retention: retention,
 	}, nil
 }
 
+// The retention of the completed documents from the number of days in the
+// setting. The documents are kept forever when it isn't set.
+func parseRetention(setting string) (time.Duration, error) {
+	if setting == "" {
+		return 0, nil
+	}
+
+	days, err := strconv.Atoi(setting)
+	if err != nil {
+		return 0, fmt.Errorf("invalid RETENTION_DAYS: %w", err)
+	}
+	if days <= 0 {
+		return 0, fmt.Errorf("invalid RETENTION_DAYS: %d is not a number of days", days)
+	}
+
+	return time.Duration(days) * 24 * time.Hour, nil
+}
+
+// NewDocumentStoreWithClient uses the client given instead of one configured
+// from the environment.
+func NewDocumentStoreWithClient(store dynamoAPI) DocumentStore {
+	return &DocumentStoreContext{
+		store: store,
+	}
+}
+
+// GetDocument returns the document with the ID, or ErrDocumentNotFound when
+// there is none.
 func (db *DocumentStoreContext) GetDocument(
 	ctx context.Context,
 	id string,
@@ -52,6 +92,10 @@ func (db *DocumentStoreContext) GetDocument(
 		return ret, err
 	}
 
+	if len(result.Item) == 0 {
+		return nil, ErrDocumentNotFound
+	}
+
 	err = attributevalue.UnmarshalMap(result.Item, ret)
 	if err != nil {
 		slog.Error("Failed to unmarshal the document", "error", err)
@@ -61,219 +105,1475 @@ func (db *DocumentStoreContext) GetDocument(
 	return ret, nil
 }
 
-func (db *DocumentStoreContext) GetDocumentByGoogleID(
-	ctx context.Context,
-	googleFileID string,
-) (*stypes.Document, error) {
-	return db.getDocumentByIndex(
-		ctx,
-		"GoogleFileIDIndex",
-		"google_id",
-		googleFileID,
-	)
-}
-
-func (db *DocumentStoreContext) GetDocumentBySourceKey(
-	ctx context.Context,
-	sourceKey string,
-) (*stypes.Document, error) {
-	return db.getDocumentByIndex(
-		ctx,
-		"SourceKeyIndex",
-		"source_key",
-		sourceKey,
-	)
-}
-
-func (db *DocumentStoreContext) getDocumentByIndex(
+// UpdateDocumentFields saves the fields of the update that are set, leaving
+// the other attributes of the document alone. It fails with
+// ErrDocumentNotFound when there is no document with the ID.
+func (db *DocumentStoreContext) UpdateDocumentFields(
 	ctx context.Context,
-	indexName, attributeName, value string,
-) (*stypes.Document, error) {
-	queryInput := &dynamodb.QueryInput{
-		TableName:              aws.String(DOCUMENT_TABLE),
-		IndexName:              aws.String(indexName),
-		KeyConditionExpression: aws.String(attributeName + " = :lookupValue"),
-		ExpressionAttributeValues: map[string]types.AttributeValue{
-			":lookupValue": &types.AttributeValueMemberS{Value: value},
-		},
-	}
-
-	result, err := db.store.Query(ctx, queryInput)
+	id string,
+	update *stypes.DocumentUpdate,
+) error {
+	av, err := marshalMap(update)
 	if err != nil {
-		return nil, err
+		slog.Error("Failed to marshal the document update", "error", err)
+		return err
 	}
 
-	if len(result.Items) == 0 {
-		return nil, ErrDocumentNotFound
+	// nothing to save
+	if len(av) == 0 {
+		return nil
 	}
 
-	util.Assert(
-		len(result.Items),
-		1,
-		"We should only have 1 file returned when querying by the source index",
+	updateExpression, expressionAttributeNames, expressionAttributeValues := buildUpdateExpression(
+		av,
+		[]string{"id"},
 	)
 
-	var documents []stypes.Document
+	input := &dynamodb.UpdateItemInput{
+		TableName: aws.String(DOCUMENT_TABLE),
+		Key: map[string]types.AttributeValue{
+			"id": &types.AttributeValueMemberS{Value: id},
+		},
+		UpdateExpression:          aws.String(updateExpression),
+		ConditionExpression:       aws.String("attribute_exists(id)"),
+		ExpressionAttributeNames:  expressionAttributeNames,
+		ExpressionAttributeValues: expressionAttributeValues,
+	}
 
-	err = attributevalue.UnmarshalListOfMaps(result.Items, &documents)
+	_, err = db.store.UpdateItem(ctx, input)
 	if err != nil {
-		return nil, err
+		var ccfe *types.ConditionalCheckFailedException
+		if errors.As(err, &ccfe) {
+			return ErrDocumentNotFound
+		}
+
+		slog.Error(
+			"Failed to update the fields of the document",
+			"id",
+			id,
+			"error",
+			err,
+		)
+		return err
 	}
 
-	return &documents[0], nil
+	return nil
 }
 
-func (db *DocumentStoreContext) InsertDocument(
+// UpdateDocumentStatus records the overall status of the document and the
+// stage it is at, the stage is left as it is when empty. A document that was
+// superseded or deleted, or that doesn't exist, is left alone.
+func (db *DocumentStoreContext) UpdateDocumentStatus(
 	ctx context.Context,
-	document *stypes.Document,
+	id string,
+	stage stypes.Stage,
+	status string,
 ) error {
+	updateExpression := "SET #status = :status"
+	values := map[string]types.AttributeValue{
+		":status":     &types.AttributeValueMemberS{Value: status},
+		":superseded": &types.AttributeValueMemberS{Value: stypes.DOCUMENT_STATUS_SUPERSEDED},
+		":deleted":    &types.AttributeValueMemberS{Value: stypes.DOCUMENT_STATUS_DELETED},
+	}
+	if stage != "" {
+		updateExpression += ", current_stage = :stage"
+		values[":stage"] = &types.AttributeValueMemberS{Value: string(stage)}
+	}
 
-	av, err := attributevalue.MarshalMap(document)
-	if err != nil {
-		slog.Error("Failed to marshal the document", "error", err)
-		return err
+	names := map[string]string{
+		"#status": "status",
 	}
 
-	item := &dynamodb.PutItemInput{
+	// a completed document that fails when it is processed again is kept
+	if status == stypes.DOCUMENT_STATUS_ERROR {
+		updateExpression += " REMOVE #ttl"
+		names["#ttl"] = DOCUMENT_TTL_ATTRIBUTE
+	}
+
+	input := &dynamodb.UpdateItemInput{
 		TableName: aws.String(DOCUMENT_TABLE),
-		Item:      av,
+		Key: map[string]types.AttributeValue{
+			"id": &types.AttributeValueMemberS{Value: id},
+		},
+		UpdateExpression: aws.String(updateExpression),
+		ConditionExpression: aws.String(
+			"attribute_exists(id) AND NOT (#status IN (:superseded, :deleted))",
+		),
+		ExpressionAttributeNames:  names,
+		ExpressionAttributeValues: values,
 	}
 
-	_, err = db.store.PutItem(ctx, item)
+	_, err := db.store.UpdateItem(ctx, input)
 	if err != nil {
-		slog.Error("Failed to insert the document", "error", err)
+		var ccfe *types.ConditionalCheckFailedException
+		if errors.As(err, &ccfe) {
+			slog.Info(
+				"The document status is no longer updated",
+				"id",
+				id,
+				"status",
+				status,
+			)
+			return nil
+		}
+
+		slog.Error(
+			"Failed to update the document status",
+			"id",
+			id,
+			"status",
+			status,
+			"error",
+			err,
+		)
 		return err
 	}
 
 	return nil
+}
+
+// UpdateDocumentAttestation records the hash chain of the published note
+func (db *DocumentStoreContext) UpdateDocumentAttestation(
+	ctx context.Context,
+	id string,
+	links []stypes.AttestationLink,
+) error {
+	av, err := marshalValue(links)
+	if err != nil {
+		slog.Error("Failed to marshal the document attestation", "error", err)
+		return err
+	}
 
+	return db.updateDocumentAttribute(ctx, id, "attestation", av)
 }
 
-func (db *DocumentStoreContext) GetDocumentStage(
+// UpdateDocumentContentHash records the hash of the downloaded content
+func (db *DocumentStoreContext) UpdateDocumentContentHash(
 	ctx context.Context,
 	id string,
-	stage string,
-) (*stypes.DocumentProcessingStage, error) {
-	ret := &stypes.DocumentProcessingStage{}
+	contentHash string,
+) error {
+	return db.updateDocumentAttribute(
+		ctx,
+		id,
+		"content_hash",
+		&types.AttributeValueMemberS{Value: contentHash},
+	)
+}
 
-	key := map[string]types.AttributeValue{
-		"id":    &types.AttributeValueMemberS{Value: id},
-		"stage": &types.AttributeValueMemberS{Value: stage},
-	}
+// MarkDocumentDuplicate records the document whose note was reused for the
+// document
+func (db *DocumentStoreContext) MarkDocumentDuplicate(
+	ctx context.Context,
+	id string,
+	originalID string,
+) error {
+	return db.updateDocumentAttribute(
+		ctx,
+		id,
+		"duplicate_of",
+		&types.AttributeValueMemberS{Value: originalID},
+	)
+}
 
-	item := &dynamodb.GetItemInput{
-		TableName: aws.String(DOCUMENT_PROCESSING_STAGE_TABLE),
-		Key:       key,
+// SupersedeDocument records the newer version that replaced the document
+// and ends it with the superseded status
+func (db *DocumentStoreContext) SupersedeDocument(
+	ctx context.Context,
+	id string,
+	newerID string,
+) error {
+	input := &dynamodb.UpdateItemInput{
+		TableName: aws.String(DOCUMENT_TABLE),
+		Key: map[string]types.AttributeValue{
+			"id": &types.AttributeValueMemberS{Value: id},
+		},
+		UpdateExpression: aws.String("SET superseded_by = :newer, #status = :status"),
+		ExpressionAttributeNames: map[string]string{
+			"#status": "status",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":newer":  &types.AttributeValueMemberS{Value: newerID},
+			":status": &types.AttributeValueMemberS{Value: stypes.DOCUMENT_STATUS_SUPERSEDED},
+		},
 	}
 
-	result, err := db.store.GetItem(ctx, item)
+	_, err := db.store.UpdateItem(ctx, input)
 	if err != nil {
 		slog.Error(
-			"Failed to find the document processing stage",
+			"Failed to record the newer version of the document",
 			"id",
 			id,
-			"stage",
-			stage,
-			"error",
-			err,
-		)
-		return ret, err
-	}
-
-	// Convert DynamoDB result into a slice of WatchChannels
-	err = attributevalue.UnmarshalMap(result.Item, ret)
-	if err != nil {
-		slog.Error(
-			"Failed to unmarshal the document processing stage",
+			"newerID",
+			newerID,
 			"error",
 			err,
 		)
-		return ret, err
+		return err
 	}
 
-	return ret, nil
+	return nil
 }
 
-func (db *DocumentStoreContext) insertDocumentStage(
+// UpdateDocumentChildren records the child documents the document was split
+// into. The children completed by an earlier attempt are cleared.
+func (db *DocumentStoreContext) UpdateDocumentChildren(
 	ctx context.Context,
-	stage *stypes.DocumentProcessingStage,
+	id string,
+	childIDs []string,
 ) error {
-
-	stage.StartedAt = time.Now().UTC()
-
-	av, err := attributevalue.MarshalMap(*stage)
+	children, err := marshalValue(childIDs)
 	if err != nil {
-		slog.Error("Failed to marshal the document stage", "error", err)
 		return err
 	}
 
-	item := &dynamodb.PutItemInput{
-		TableName: aws.String(DOCUMENT_PROCESSING_STAGE_TABLE),
-		Item:      av,
+	input := &dynamodb.UpdateItemInput{
+		TableName: aws.String(DOCUMENT_TABLE),
+		Key: map[string]types.AttributeValue{
+			"id": &types.AttributeValueMemberS{Value: id},
+		},
+		UpdateExpression: aws.String("SET child_ids = :children REMOVE children_completed"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":children": children,
+		},
 	}
 
-	_, err = db.store.PutItem(ctx, item)
+	_, err = db.store.UpdateItem(ctx, input)
 	if err != nil {
-		slog.Error("Failed to insert the document stage", "error", err)
+		slog.Error(
+			"Failed to record the child documents",
+			"id",
+			id,
+			"error",
+			err,
+		)
 		return err
 	}
 
 	return nil
-
 }
 
-func (db *DocumentStoreContext) StartDocumentStage(
+// CompleteChildDocument records that the child document was published and
+// returns the number of children of the parent that have been. Completing a
+// child again doesn't change the count.
+func (db *DocumentStoreContext) CompleteChildDocument(
 	ctx context.Context,
-	id string,
-	stage string,
-	originalFileName string,
-) (*stypes.DocumentProcessingStage, error) {
-	// Update the 'download' processing stage to in-progress
-	docStage := &stypes.DocumentProcessingStage{
-		ID:               id,
-		Stage:            stage,
-		StageStatus:      stypes.DOCUMENT_STATUS_INPROGRESS,
-		StartedAt:        time.Now().UTC(),
-		OriginalFileName: originalFileName,
+	parentID string,
+	childID string,
+) (int, error) {
+	input := &dynamodb.UpdateItemInput{
+		TableName: aws.String(DOCUMENT_TABLE),
+		Key: map[string]types.AttributeValue{
+			"id": &types.AttributeValueMemberS{Value: parentID},
+		},
+		UpdateExpression: aws.String("ADD children_completed :child"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":child": &types.AttributeValueMemberSS{Value: []string{childID}},
+		},
+		ReturnValues: types.ReturnValueUpdatedNew,
 	}
 
-	err := db.insertDocumentStage(ctx, docStage)
+	result, err := db.store.UpdateItem(ctx, input)
 	if err != nil {
-		slog.Error("Failed to save the document processing stage", "error", err)
-		return nil, err
+		slog.Error(
+			"Failed to record the completed child document",
+			"id",
+			parentID,
+			"childID",
+			childID,
+			"error",
+			err,
+		)
+		return 0, err
 	}
 
-	return docStage, nil
+	completed, ok := result.Attributes["children_completed"].(*types.AttributeValueMemberSS)
+	if !ok {
+		return 0, fmt.Errorf("completed children missing from the update of %s", parentID)
+	}
+
+	return len(completed.Value), nil
 }
 
-func (db *DocumentStoreContext) CompleteDocumentStage(
+// Set a single attribute of the document. The name is always passed as an
+// expression attribute name since some, like status, are reserved words.
+func (db *DocumentStoreContext) updateDocumentAttribute(
 	ctx context.Context,
-	stage *stypes.DocumentProcessingStage,
+	id string,
+	name string,
+	value types.AttributeValue,
 ) error {
-
-	stage.CompletedAt = time.Now().UTC()
-	stage.StageStatus = stypes.DOCUMENT_STATUS_COMPLETE
-
-	key := map[string]types.AttributeValue{
-		"id":    &types.AttributeValueMemberS{Value: stage.ID},
-		"stage": &types.AttributeValueMemberS{Value: stage.Stage},
+	input := &dynamodb.UpdateItemInput{
+		TableName: aws.String(DOCUMENT_TABLE),
+		Key: map[string]types.AttributeValue{
+			"id": &types.AttributeValueMemberS{Value: id},
+		},
+		UpdateExpression: aws.String("SET #name = :value"),
+		ExpressionAttributeNames: map[string]string{
+			"#name": name,
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":value": value,
+		},
 	}
 
-	av, err := attributevalue.MarshalMap(stage)
+	_, err := db.store.UpdateItem(ctx, input)
 	if err != nil {
-		slog.Error("Failed to marshal the document stage", "error", err)
+		slog.Error(
+			"Failed to update the document",
+			"id",
+			id,
+			"attribute",
+			name,
+			"error",
+			err,
+		)
 		return err
 	}
 
-	updateExpression, expressionAttributeValues := buildUpdateExpression(
-		av,
-		[]string{"id", "stage"},
+	return nil
+}
+
+func (db *DocumentStoreContext) GetDocumentByGoogleID(
+	ctx context.Context,
+	googleFileID string,
+) (*stypes.Document, error) {
+	return db.getDocumentByIndex(
+		ctx,
+		"GoogleFileIDIndex",
+		"google_id",
+		googleFileID,
 	)
+}
 
-	input := &dynamodb.UpdateItemInput{
-		TableName:                 aws.String(DOCUMENT_PROCESSING_STAGE_TABLE),
+func (db *DocumentStoreContext) GetDocumentBySourceKey(
+	ctx context.Context,
+	sourceKey string,
+) (*stypes.Document, error) {
+	return db.getDocumentByIndex(
+		ctx,
+		"SourceKeyIndex",
+		"source_key",
+		sourceKey,
+	)
+}
+
+// GetDocumentByContentHash returns the first document processed with the
+// content. Documents that reused the note of another are skipped.
+func (db *DocumentStoreContext) GetDocumentByContentHash(
+	ctx context.Context,
+	contentHash string,
+) (*stypes.Document, error) {
+	documents, err := db.queryDocumentsByIndex(
+		ctx,
+		"ContentHashIndex",
+		"content_hash",
+		contentHash,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	var original *stypes.Document
+	for i := range documents {
+		if documents[i].DuplicateOf != "" {
+			continue
+		}
+
+		if original == nil ||
+			documents[i].CreatedTime.Before(original.CreatedTime) {
+			original = &documents[i]
+		}
+	}
+
+	if original == nil {
+		return nil, ErrDocumentNotFound
+	}
+
+	return original, nil
+}
+
+// ListDocuments returns the documents created in Drive or received by email
+// since the time. The whole table is scanned so keep the window small.
+func (db *DocumentStoreContext) ListDocuments(
+	ctx context.Context,
+	since time.Time,
+) ([]*stypes.Document, error) {
+	sinceValue, err := marshalValue(since.UTC())
+	if err != nil {
+		return nil, err
+	}
+
+	input := &dynamodb.ScanInput{
+		TableName:        aws.String(DOCUMENT_TABLE),
+		FilterExpression: aws.String("created_time >= :since"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":since": sinceValue,
+		},
+	}
+
+	documents := make([]*stypes.Document, 0)
+
+	paginator := dynamodb.NewScanPaginator(db.store, input)
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			slog.Error("Failed to scan the documents", "error", err)
+			return nil, err
+		}
+
+		var items []*stypes.Document
+		err = attributevalue.UnmarshalListOfMaps(page.Items, &items)
+		if err != nil {
+			slog.Error("Failed to unmarshal the documents", "error", err)
+			return nil, err
+		}
+
+		documents = append(documents, items...)
+	}
+
+	return documents, nil
+}
+
+// ListDocumentsByStatus returns a page of the documents with the status that
+// were created between since and until, oldest first. The cursor is opaque,
+// pass the one returned to get the next page, it's empty on the last page.
+// A limit of zero leaves the page size to DynamoDB.
+func (db *DocumentStoreContext) ListDocumentsByStatus(
+	ctx context.Context,
+	status string,
+	since, until time.Time,
+	limit int,
+	cursor string,
+) ([]*stypes.Document, string, error) {
+	sinceValue, err := marshalValue(since.UTC())
+	if err != nil {
+		return nil, "", err
+	}
+
+	untilValue, err := marshalValue(until.UTC())
+	if err != nil {
+		return nil, "", err
+	}
+
+	input := &dynamodb.QueryInput{
+		TableName: aws.String(DOCUMENT_TABLE),
+		IndexName: aws.String("StatusIndex"),
+		KeyConditionExpression: aws.String(
+			"#status = :status AND created_time BETWEEN :since AND :until",
+		),
+		ExpressionAttributeNames: map[string]string{
+			"#status": "status",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":status": &types.AttributeValueMemberS{Value: status},
+			":since":  sinceValue,
+			":until":  untilValue,
+		},
+	}
+
+	if limit > 0 {
+		input.Limit = aws.Int32(int32(limit))
+	}
+
+	if cursor != "" {
+		input.ExclusiveStartKey, err = decodeCursor(cursor)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+
+	result, err := db.store.Query(ctx, input)
+	if err != nil {
+		slog.Error(
+			"Failed to query the documents by status",
+			"status",
+			status,
+			"error",
+			err,
+		)
+		return nil, "", err
+	}
+
+	documents := make([]*stypes.Document, 0, len(result.Items))
+	err = attributevalue.UnmarshalListOfMaps(result.Items, &documents)
+	if err != nil {
+		slog.Error("Failed to unmarshal the documents", "error", err)
+		return nil, "", err
+	}
+
+	next, err := encodeCursor(result.LastEvaluatedKey)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return documents, next, nil
+}
+
+// encodeCursor turns the key a query stopped at into a cursor. The keys of
+// the index are all strings.
+func encodeCursor(key map[string]types.AttributeValue) (string, error) {
+	if len(key) == 0 {
+		return "", nil
+	}
+
+	var values map[string]string
+	if err := attributevalue.UnmarshalMap(key, &values); err != nil {
+		return "", err
+	}
+
+	data, err := json.Marshal(values)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// decodeCursor turns a cursor back into the key the query starts after.
+func decodeCursor(cursor string) (map[string]types.AttributeValue, error) {
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor: %w", err)
+	}
+
+	var values map[string]string
+	if err := json.Unmarshal(data, &values); err != nil {
+		return nil, fmt.Errorf("invalid cursor: %w", err)
+	}
+
+	return marshalMap(values)
+}
+
+func (db *DocumentStoreContext) getDocumentByIndex(
+	ctx context.Context,
+	indexName, attributeName, value string,
+) (*stypes.Document, error) {
+	documents, err := db.queryDocumentsByIndex(
+		ctx,
+		indexName,
+		attributeName,
+		value,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	// a file that changed after it was processed has a document for each
+	// version, return the latest one
+	latest := &documents[0]
+	for i := range documents {
+		if documents[i].Version > latest.Version {
+			latest = &documents[i]
+		}
+	}
+
+	return latest, nil
+}
+
+func (db *DocumentStoreContext) queryDocumentsByIndex(
+	ctx context.Context,
+	indexName, attributeName, value string,
+) ([]stypes.Document, error) {
+	queryInput := &dynamodb.QueryInput{
+		TableName:              aws.String(DOCUMENT_TABLE),
+		IndexName:              aws.String(indexName),
+		KeyConditionExpression: aws.String(attributeName + " = :lookupValue"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":lookupValue": &types.AttributeValueMemberS{Value: value},
+		},
+	}
+
+	// the matches can fill more than one page, the document looked for can
+	// be on any of them
+	var documents []stypes.Document
+
+	paginator := dynamodb.NewQueryPaginator(db.store, queryInput)
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		var pageDocuments []stypes.Document
+		err = attributevalue.UnmarshalListOfMaps(page.Items, &pageDocuments)
+		if err != nil {
+			return nil, err
+		}
+
+		documents = append(documents, pageDocuments...)
+	}
+
+	if len(documents) == 0 {
+		return nil, ErrDocumentNotFound
+	}
+
+	return documents, nil
+}
+
+// ReleaseHeldDocument moves a held document to pending. Returns false when
+// the document is no longer held, so only one release starts it.
+func (db *DocumentStoreContext) ReleaseHeldDocument(
+	ctx context.Context,
+	id string,
+) (bool, error) {
+	input := &dynamodb.UpdateItemInput{
+		TableName: aws.String(DOCUMENT_TABLE),
+		Key: map[string]types.AttributeValue{
+			"id": &types.AttributeValueMemberS{Value: id},
+		},
+		UpdateExpression:    aws.String("SET #status = :pending"),
+		ConditionExpression: aws.String("#status = :held"),
+		ExpressionAttributeNames: map[string]string{
+			"#status": "status",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":pending": &types.AttributeValueMemberS{Value: stypes.DOCUMENT_STATUS_PENDING},
+			":held":    &types.AttributeValueMemberS{Value: stypes.DOCUMENT_STATUS_HELD},
+		},
+	}
+
+	_, err := db.store.UpdateItem(ctx, input)
+	if err != nil {
+		var ccfe *types.ConditionalCheckFailedException
+		if errors.As(err, &ccfe) {
+			return false, nil
+		}
+
+		slog.Error(
+			"Failed to release the held document",
+			"id",
+			id,
+			"error",
+			err,
+		)
+		return false, err
+	}
+
+	return true, nil
+}
+
+// HoldExecutionSlot marks the document as counted against the execution
+// limit of its channel. Returns false when it already was, so a document is
+// only counted once.
+func (db *DocumentStoreContext) HoldExecutionSlot(
+	ctx context.Context,
+	id string,
+) (bool, error) {
+	return db.updateExecutionSlot(ctx, id, &dynamodb.UpdateItemInput{
+		UpdateExpression:    aws.String("SET execution_slot = :true"),
+		ConditionExpression: aws.String("attribute_not_exists(execution_slot)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":true": &types.AttributeValueMemberBOOL{Value: true},
+		},
+	})
+}
+
+// ReleaseExecutionSlot clears the mark of HoldExecutionSlot. Returns whether
+// the document was marked, so the execution it was counted for is only
+// given back once.
+func (db *DocumentStoreContext) ReleaseExecutionSlot(
+	ctx context.Context,
+	id string,
+) (bool, error) {
+	return db.updateExecutionSlot(ctx, id, &dynamodb.UpdateItemInput{
+		UpdateExpression:    aws.String("REMOVE execution_slot"),
+		ConditionExpression: aws.String("attribute_exists(execution_slot)"),
+	})
+}
+
+// Apply the conditional update to the execution slot mark of the document,
+// reporting whether the condition held
+func (db *DocumentStoreContext) updateExecutionSlot(
+	ctx context.Context,
+	id string,
+	input *dynamodb.UpdateItemInput,
+) (bool, error) {
+	input.TableName = aws.String(DOCUMENT_TABLE)
+	input.Key = map[string]types.AttributeValue{
+		"id": &types.AttributeValueMemberS{Value: id},
+	}
+
+	_, err := db.store.UpdateItem(ctx, input)
+	if err != nil {
+		var ccfe *types.ConditionalCheckFailedException
+		if errors.As(err, &ccfe) {
+			return false, nil
+		}
+
+		slog.Error(
+			"Failed to update the execution slot of the document",
+			"id",
+			id,
+			"error",
+			err,
+		)
+		return false, err
+	}
+
+	return true, nil
+}
+
+// InsertDocument saves a new document. Only the first writer of a document
+// ID wins, any later one gets ErrDocumentExists.
+func (db *DocumentStoreContext) InsertDocument(
+	ctx context.Context,
+	document *stypes.Document,
+) error {
+
+	av, err := marshalMap(document)
+	if err != nil {
+		slog.Error("Failed to marshal the document", "error", err)
+		return err
+	}
+
+	item := &dynamodb.PutItemInput{
+		TableName:           aws.String(DOCUMENT_TABLE),
+		Item:                av,
+		ConditionExpression: aws.String("attribute_not_exists(id)"),
+	}
+
+	_, err = db.store.PutItem(ctx, item)
+	if err != nil {
+		var ccfe *types.ConditionalCheckFailedException
+		if errors.As(err, &ccfe) {
+			return ErrDocumentExists
+		}
+
+		slog.Error("Failed to insert the document", "error", err)
+		return err
+	}
+
+	return nil
+
+}
+
+// InsertDocumentWithStage saves a new document along with its first stage
+// in one transaction, so a document is never left without the stage that
+// starts it. Neither is saved when either fails. Only the first writer of a
+// document ID wins, any later one gets ErrDocumentExists.
+func (db *DocumentStoreContext) InsertDocumentWithStage(
+	ctx context.Context,
+	document *stypes.Document,
+	stage *stypes.DocumentProcessingStage,
+) error {
+	documentAV, err := marshalMap(document)
+	if err != nil {
+		slog.Error("Failed to marshal the document", "error", err)
+		return err
+	}
+
+	stage.StartedAt = time.Now().UTC()
+
+	stageAV, err := marshalMap(stage)
+	if err != nil {
+		slog.Error("Failed to marshal the document stage", "error", err)
+		return err
+	}
+
+	input := &dynamodb.TransactWriteItemsInput{
+		TransactItems: []types.TransactWriteItem{
+			{
+				Put: &types.Put{
+					TableName:           aws.String(DOCUMENT_TABLE),
+					Item:                documentAV,
+					ConditionExpression: aws.String("attribute_not_exists(id)"),
+				},
+			},
+			{
+				Put: &types.Put{
+					TableName: aws.String(DOCUMENT_PROCESSING_STAGE_TABLE),
+					Item:      stageAV,
+				},
+			},
+		},
+	}
+
+	_, err = db.store.TransactWriteItems(ctx, input)
+	if err != nil {
+		// the reasons are in the order of the items, the document is first
+		var tce *types.TransactionCanceledException
+		if errors.As(err, &tce) && len(tce.CancellationReasons) > 0 &&
+			aws.ToString(tce.CancellationReasons[0].Code) == "ConditionalCheckFailed" {
+			return ErrDocumentExists
+		}
+
+		slog.Error(
+			"Failed to insert the document with its stage",
+			"id",
+			document.ID,
+			"error",
+			err,
+		)
+		return err
+	}
+
+	return nil
+}
+
+// GetDocumentStage returns the record of the stage of the document. A stage
+// the document has no record of is returned empty with ErrStageNotFound.
+func (db *DocumentStoreContext) GetDocumentStage(
+	ctx context.Context,
+	id string,
+	stage stypes.Stage,
+) (*stypes.DocumentProcessingStage, error) {
+	ret := &stypes.DocumentProcessingStage{}
+
+	key := map[string]types.AttributeValue{
+		"id":    &types.AttributeValueMemberS{Value: id},
+		"stage": &types.AttributeValueMemberS{Value: string(stage)},
+	}
+
+	item := &dynamodb.GetItemInput{
+		TableName: aws.String(DOCUMENT_PROCESSING_STAGE_TABLE),
+		Key:       key,
+	}
+
+	result, err := db.store.GetItem(ctx, item)
+	if err != nil {
+		slog.Error(
+			"Failed to find the document processing stage",
+			"id",
+			id,
+			"stage",
+			stage,
+			"error",
+			err,
+		)
+		return ret, err
+	}
+
+	if len(result.Item) == 0 {
+		return ret, ErrStageNotFound
+	}
+
+	// Convert DynamoDB result into a slice of WatchChannels
+	err = attributevalue.UnmarshalMap(result.Item, ret)
+	if err != nil {
+		slog.Error(
+			"Failed to unmarshal the document processing stage",
+			"error",
+			err,
+		)
+		return ret, err
+	}
+
+	return ret, nil
+}
+
+// GetDocumentStages returns every stage the document has a record of, in the
+// order they started. A document that has no stages yet has none.
+func (db *DocumentStoreContext) GetDocumentStages(
+	ctx context.Context,
+	id string,
+) ([]*stypes.DocumentProcessingStage, error) {
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(DOCUMENT_PROCESSING_STAGE_TABLE),
+		KeyConditionExpression: aws.String("id = :id"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":id": &types.AttributeValueMemberS{Value: id},
+		},
+	}
+
+	stages := make([]*stypes.DocumentProcessingStage, 0)
+
+	paginator := dynamodb.NewQueryPaginator(db.store, input)
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			slog.Error("Failed to query the stages of the document", "id", id, "error", err)
+			return nil, err
+		}
+
+		var pageStages []*stypes.DocumentProcessingStage
+		err = attributevalue.UnmarshalListOfMaps(page.Items, &pageStages)
+		if err != nil {
+			slog.Error("Failed to unmarshal the stages of the document", "id", id, "error", err)
+			return nil, err
+		}
+
+		stages = append(stages, pageStages...)
+	}
+
+	slices.SortStableFunc(stages, func(a, b *stypes.DocumentProcessingStage) int {
+		return a.StartedAt.Compare(b.StartedAt)
+	})
+
+	return stages, nil
+}
+
+// GetStageDurationStats returns how long each stage of the documents that
+// completed since the time took, in the order of the stage names. Only the
+// completed runs are counted, the ones completed before the durations were
+// saved are timed from their start and completion.
+func (db *DocumentStoreContext) GetStageDurationStats(
+	ctx context.Context,
+	since time.Time,
+) ([]*stypes.StageDurationStats, error) {
+	until := time.Now().UTC()
+
+	var stages []*stypes.DocumentProcessingStage
+	cursor := ""
+	for {
+		documents, next, err := db.ListDocumentsByStatus(
+			ctx,
+			stypes.DOCUMENT_STATUS_COMPLETE,
+			since,
+			until,
+			0,
+			cursor,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, document := range documents {
+			documentStages, err := db.GetDocumentStages(ctx, document.ID)
+			if err != nil {
+				return nil, err
+			}
+
+			stages = append(stages, documentStages...)
+		}
+
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+
+	return stageDurationStats(stages), nil
+}
+
+// Aggregate the durations of the completed stages by stage
+func stageDurationStats(stages []*stypes.DocumentProcessingStage) []*stypes.StageDurationStats {
+	durations := make(map[stypes.Stage][]int64)
+	external := make(map[stypes.Stage]int64)
+	for _, stage := range stages {
+		if stage.StageStatus != stypes.DOCUMENT_STATUS_COMPLETE {
+			continue
+		}
+
+		duration := stage.DurationMillis
+		if duration == 0 && !stage.StartedAt.IsZero() && !stage.CompletedAt.IsZero() {
+			duration = stage.CompletedAt.Sub(stage.StartedAt).Milliseconds()
+		}
+
+		durations[stage.Stage] = append(durations[stage.Stage], duration)
+		external[stage.Stage] += stage.ExternalMillis
+	}
+
+	ret := make([]*stypes.StageDurationStats, 0, len(durations))
+	for _, name := range slices.Sorted(maps.Keys(durations)) {
+		values := durations[name]
+		slices.Sort(values)
+
+		var total int64
+		for _, value := range values {
+			total += value
+		}
+
+		count := int64(len(values))
+		ret = append(ret, &stypes.StageDurationStats{
+			Stage:                 name,
+			Count:                 len(values),
+			AverageMillis:         total / count,
+			P50Millis:             percentile(values, 50),
+			P90Millis:             percentile(values, 90),
+			P99Millis:             percentile(values, 99),
+			AverageExternalMillis: external[name] / count,
+		})
+	}
+
+	return ret
+}
+
+// The nearest-rank percentile of the sorted values
+func percentile(sorted []int64, p int) int64 {
+	rank := (p*len(sorted) + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+
+	return sorted[rank-1]
+}
+
+// Put the stage, started now, when the condition of the input holds
+func (db *DocumentStoreContext) insertDocumentStage(
+	ctx context.Context,
+	stage *stypes.DocumentProcessingStage,
+	input *dynamodb.PutItemInput,
+) error {
+
+	stage.StartedAt = time.Now().UTC()
+
+	av, err := marshalMap(*stage)
+	if err != nil {
+		slog.Error("Failed to marshal the document stage", "error", err)
+		return err
+	}
+
+	input.TableName = aws.String(DOCUMENT_PROCESSING_STAGE_TABLE)
+	input.Item = av
+
+	_, err = db.store.PutItem(ctx, input)
+	if err != nil {
+		var ccfe *types.ConditionalCheckFailedException
+		if !errors.As(err, &ccfe) {
+			slog.Error("Failed to insert the document stage", "error", err)
+		}
+		return err
+	}
+
+	return nil
+
+}
+
+// StartDocumentStage records a new run of the stage. The first run is attempt
+// 1. A stage that already has a record is being retried, the record moves on
+// to the next attempt and keeps the earlier runs in its history.
+func (db *DocumentStoreContext) StartDocumentStage(
+	ctx context.Context,
+	id string,
+	stage stypes.Stage,
+	originalFileName string,
+) (*stypes.DocumentProcessingStage, error) {
+	// Update the 'download' processing stage to in-progress
+	docStage := &stypes.DocumentProcessingStage{
+		ID:               id,
+		Stage:            stage,
+		StageStatus:      stypes.DOCUMENT_STATUS_INPROGRESS,
+		StartedAt:        time.Now().UTC(),
+		OriginalFileName: originalFileName,
+		Attempt:          1,
+	}
+
+	err := db.insertDocumentStage(ctx, docStage, &dynamodb.PutItemInput{
+		ConditionExpression: aws.String("attribute_not_exists(id)"),
+	})
+
+	var ccfe *types.ConditionalCheckFailedException
+	if errors.As(err, &ccfe) {
+		err = db.retryDocumentStage(ctx, docStage)
+	}
+
+	if err != nil {
+		slog.Error("Failed to save the document processing stage", "error", err)
+		return nil, err
+	}
+
+	err = db.rollUpDocumentStatus(ctx, docStage)
+	if err != nil {
+		return nil, err
+	}
+
+	return docStage, nil
+}
+
+// Replace the record of the stage with the next attempt. The record is only
+// replaced when it is still at the attempt that was read, so two runs
+// started at once don't both count as the same attempt.
+func (db *DocumentStoreContext) retryDocumentStage(
+	ctx context.Context,
+	stage *stypes.DocumentProcessingStage,
+) error {
+	previous, err := db.GetDocumentStage(ctx, stage.ID, stage.Stage)
+	if err != nil {
+		return err
+	}
+
+	nextStageAttempt(previous, stage)
+
+	err = db.insertDocumentStage(ctx, stage, &dynamodb.PutItemInput{
+		ConditionExpression: aws.String("attribute_not_exists(attempt) OR attempt = :attempt"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":attempt": &types.AttributeValueMemberN{
+				Value: strconv.Itoa(previous.Attempt),
+			},
+		},
+	})
+
+	var ccfe *types.ConditionalCheckFailedException
+	if errors.As(err, &ccfe) {
+		return fmt.Errorf(
+			"the %s stage of the document %s was started again by another run",
+			stage.Stage,
+			stage.ID,
+		)
+	}
+
+	return err
+}
+
+// Count the stage as the attempt after the previous record of it, keeping
+// the previous run in the history. Records from before the runs were counted
+// were the first attempt.
+func nextStageAttempt(previous, stage *stypes.DocumentProcessingStage) {
+	attempt := max(previous.Attempt, 1)
+
+	stage.Attempt = attempt + 1
+	stage.Attempts = append(previous.Attempts, stypes.StageAttempt{
+		Attempt:     attempt,
+		StageStatus: previous.StageStatus,
+		StartedAt:   previous.StartedAt,
+		CompletedAt: previous.CompletedAt,
+		ErrorCode:   previous.ErrorCode,
+		ErrorReason: previous.ErrorReason,
+	})
+
+	stage.LastError = previous.LastError
+	if previous.ErrorReason != "" {
+		stage.LastError = previous.ErrorReason
+	}
+}
+
+// StartPendingDocumentStage moves the stage saved pending along with its
+// document to in-progress. A stage that isn't pending, from an earlier
+// attempt or a document saved without one, is started over.
+func (db *DocumentStoreContext) StartPendingDocumentStage(
+	ctx context.Context,
+	id string,
+	stage stypes.Stage,
+	originalFileName string,
+) (*stypes.DocumentProcessingStage, error) {
+	input := &dynamodb.UpdateItemInput{
+		TableName: aws.String(DOCUMENT_PROCESSING_STAGE_TABLE),
+		Key: map[string]types.AttributeValue{
+			"id":    &types.AttributeValueMemberS{Value: id},
+			"stage": &types.AttributeValueMemberS{Value: string(stage)},
+		},
+		// the pending stage hasn't run yet, this is its first attempt
+		UpdateExpression: aws.String(
+			"SET stage_status = :inProgress, started_at = :startedAt, attempt = :attempt",
+		),
+		ConditionExpression: aws.String("stage_status = :pending"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":inProgress": &types.AttributeValueMemberS{Value: stypes.DOCUMENT_STATUS_INPROGRESS},
+			":pending":    &types.AttributeValueMemberS{Value: stypes.DOCUMENT_STATUS_PENDING},
+			":attempt":    &types.AttributeValueMemberN{Value: "1"},
+			":startedAt":  timestampValue(time.Now()),
+		},
+		ReturnValues: types.ReturnValueAllNew,
+	}
+
+	result, err := db.store.UpdateItem(ctx, input)
+	if err != nil {
+		var ccfe *types.ConditionalCheckFailedException
+		if errors.As(err, &ccfe) {
+			return db.StartDocumentStage(ctx, id, stage, originalFileName)
+		}
+
+		slog.Error(
+			"Failed to start the pending document stage",
+			"id",
+			id,
+			"stage",
+			stage,
+			"error",
+			err,
+		)
+		return nil, err
+	}
+
+	docStage := &stypes.DocumentProcessingStage{}
+	err = attributevalue.UnmarshalMap(result.Attributes, docStage)
+	if err != nil {
+		slog.Error("Failed to unmarshal the document stage", "error", err)
+		return nil, err
+	}
+
+	err = db.rollUpDocumentStatus(ctx, docStage)
+	if err != nil {
+		return nil, err
+	}
+
+	return docStage, nil
+}
+
+func (db *DocumentStoreContext) CompleteDocumentStage(
+	ctx context.Context,
+	stage *stypes.DocumentProcessingStage,
+) error {
+
+	stage.CompletedAt = time.Now().UTC()
+	stage.StageStatus = stypes.DOCUMENT_STATUS_COMPLETE
+	if !stage.StartedAt.IsZero() {
+		stage.DurationMillis = stage.CompletedAt.Sub(stage.StartedAt).Milliseconds()
+	}
+
+	err := db.updateDocumentStage(ctx, stage)
+	if err != nil {
+		return err
+	}
+
+	err = db.rollUpDocumentStatus(ctx, stage)
+	if err != nil {
+		return err
+	}
+
+	recordStageDuration(stage)
+	if stage.ExternalMillis > 0 {
+		metrics.Record(
+			metrics.EXTERNAL_CALL_DURATION,
+			float64(stage.ExternalMillis),
+			map[string]string{metrics.DIMENSION_STAGE: string(stage.Stage)},
+		)
+	}
+
+	if stage.Stage == stypes.DOCUMENT_STAGE_UPLOAD {
+		db.recordPipelineDuration(ctx, stage)
+		db.expireDocument(ctx, stage)
+	}
+
+	return nil
+}
+
+// Once the upload completes, DynamoDB removes the document and its stages
+// when the retention passes. A document that isn't complete keeps its
+// records, so failures aren't removed before they are looked at. Failing to
+// set the TTL only keeps the records longer, so it doesn't fail the upload.
+func (db *DocumentStoreContext) expireDocument(
+	ctx context.Context,
+	upload *stypes.DocumentProcessingStage,
+) {
+	if db.retention <= 0 {
+		return
+	}
+
+	expiresAt := ttlValue(upload.CompletedAt.Add(db.retention))
+	names := map[string]string{
+		"#status": "status",
+		"#ttl":    DOCUMENT_TTL_ATTRIBUTE,
+	}
+
+	_, err := db.store.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(DOCUMENT_TABLE),
+		Key: map[string]types.AttributeValue{
+			"id": &types.AttributeValueMemberS{Value: upload.ID},
+		},
+		UpdateExpression:         aws.String("SET #ttl = :ttl"),
+		ConditionExpression:      aws.String("attribute_exists(id) AND #status = :complete"),
+		ExpressionAttributeNames: names,
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":ttl":      expiresAt,
+			":complete": &types.AttributeValueMemberS{Value: stypes.DOCUMENT_STATUS_COMPLETE},
+		},
+	})
+	if err != nil {
+		var ccfe *types.ConditionalCheckFailedException
+		if errors.As(err, &ccfe) {
+			slog.Info(
+				"The document isn't complete and is kept",
+				"id",
+				upload.ID,
+			)
+			return
+		}
+
+		slog.Warn(
+			"Failed to set when the document expires",
+			"id",
+			upload.ID,
+			"error",
+			err,
+		)
+		return
+	}
+
+	stages, err := db.GetDocumentStages(ctx, upload.ID)
+	if err != nil {
+		slog.Warn(
+			"Failed to get the stages to expire",
+			"id",
+			upload.ID,
+			"error",
+			err,
+		)
+		return
+	}
+
+	for _, stage := range stages {
+		_, err = db.store.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+			TableName: aws.String(DOCUMENT_PROCESSING_STAGE_TABLE),
+			Key: map[string]types.AttributeValue{
+				"id":    &types.AttributeValueMemberS{Value: stage.ID},
+				"stage": &types.AttributeValueMemberS{Value: string(stage.Stage)},
+			},
+			UpdateExpression:          aws.String("SET #ttl = :ttl"),
+			ConditionExpression:       aws.String("attribute_exists(id)"),
+			ExpressionAttributeNames:  map[string]string{"#ttl": DOCUMENT_TTL_ATTRIBUTE},
+			ExpressionAttributeValues: map[string]types.AttributeValue{":ttl": expiresAt},
+		})
+		if err != nil {
+			slog.Warn(
+				"Failed to set when the stage expires",
+				"id",
+				stage.ID,
+				"stage",
+				stage.Stage,
+				"error",
+				err,
+			)
+		}
+	}
+}
+
+// Save the time from the start of the download until the upload completed on
+// the document. The duration is only for analysis, so failing to save it
+// doesn't fail the upload.
+func (db *DocumentStoreContext) recordPipelineDuration(
+	ctx context.Context,
+	upload *stypes.DocumentProcessingStage,
+) {
+	download, err := db.GetDocumentStage(ctx, upload.ID, stypes.DOCUMENT_STAGE_DOWNLOAD)
+	if errors.Is(err, ErrStageNotFound) {
+		// the documents split from a scan start at the Mathpix stage
+		return
+	}
+	if err != nil {
+		slog.Warn(
+			"Failed to get the start of the download",
+			"id",
+			upload.ID,
+			"error",
+			err,
+		)
+		return
+	}
+	if download.StartedAt.IsZero() {
+		return
+	}
+
+	duration := upload.CompletedAt.Sub(download.StartedAt).Milliseconds()
+
+	_, err = db.store.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(DOCUMENT_TABLE),
+		Key: map[string]types.AttributeValue{
+			"id": &types.AttributeValueMemberS{Value: upload.ID},
+		},
+		UpdateExpression:    aws.String("SET pipeline_duration_millis = :duration"),
+		ConditionExpression: aws.String("attribute_exists(id)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":duration": &types.AttributeValueMemberN{Value: strconv.FormatInt(duration, 10)},
+		},
+	})
+	if err != nil {
+		slog.Warn(
+			"Failed to save the pipeline duration of the document",
+			"id",
+			upload.ID,
+			"error",
+			err,
+		)
+		return
+	}
+
+	metrics.Record(metrics.PIPELINE_DURATION, float64(duration), nil)
+}
+
+// FailDocumentStage ends the stage with a terminal status, either
+// DOCUMENT_STATUS_ERROR or DOCUMENT_STATUS_SOURCE_MISSING, along with the code
+// of the failure and a reason for why it could not be processed.
+func (db *DocumentStoreContext) FailDocumentStage(
+	ctx context.Context,
+	stage *stypes.DocumentProcessingStage,
+	status string,
+	code string,
+	reason string,
+) error {
+
+	stage.CompletedAt = time.Now().UTC()
+	stage.StageStatus = status
+	stage.ErrorCode = code
+	stage.ErrorReason = reason
+
+	err := db.updateDocumentStage(ctx, stage)
+	if err != nil {
+		return err
+	}
+
+	err = db.rollUpDocumentStatus(ctx, stage)
+	if err != nil {
+		return err
+	}
+
+	recordStageDuration(stage)
+	metrics.Record(
+		metrics.STAGES_FAILED,
+		1,
+		map[string]string{metrics.DIMENSION_STAGE: string(stage.Stage)},
+	)
+
+	return nil
+}
+
+// Keep the status of the document current with the stage it is at
+func (db *DocumentStoreContext) rollUpDocumentStatus(
+	ctx context.Context,
+	stage *stypes.DocumentProcessingStage,
+) error {
+	return db.UpdateDocumentStatus(
+		ctx,
+		stage.ID,
+		stage.Stage,
+		documentStatus(stage.Stage, stage.StageStatus),
+	)
+}
+
+// The overall status of a document from the status of the stage it is at. A
+// document is still in progress when any stage but the upload completes.
+func documentStatus(stage stypes.Stage, stageStatus string) string {
+	if stageStatus == stypes.DOCUMENT_STATUS_COMPLETE && stage != stypes.DOCUMENT_STAGE_UPLOAD {
+		return stypes.DOCUMENT_STATUS_INPROGRESS
+	}
+
+	return stageStatus
+}
+
+func recordStageDuration(stage *stypes.DocumentProcessingStage) {
+	if stage.StartedAt.IsZero() {
+		return
+	}
+
+	metrics.Record(
+		metrics.STAGE_DURATION,
+		float64(stage.CompletedAt.Sub(stage.StartedAt).Milliseconds()),
+		map[string]string{metrics.DIMENSION_STAGE: string(stage.Stage)},
+	)
+}
+
+func (db *DocumentStoreContext) updateDocumentStage(
+	ctx context.Context,
+	stage *stypes.DocumentProcessingStage,
+) error {
+	key := map[string]types.AttributeValue{
+		"id":    &types.AttributeValueMemberS{Value: stage.ID},
+		"stage": &types.AttributeValueMemberS{Value: string(stage.Stage)},
+	}
+
+	av, err := marshalMap(stage)
+	if err != nil {
+		slog.Error("Failed to marshal the document stage", "error", err)
+		return err
+	}
+
+	updateExpression, expressionAttributeNames, expressionAttributeValues := buildUpdateExpression(
+		av,
+		[]string{"id", "stage"},
+	)
+
+	// a failed stage is kept, like its document
+	if stage.StageStatus == stypes.DOCUMENT_STATUS_ERROR {
+		updateExpression += " REMOVE #ttl"
+		expressionAttributeNames["#ttl"] = DOCUMENT_TTL_ATTRIBUTE
+	}
+
+	input := &dynamodb.UpdateItemInput{
+		TableName:                 aws.String(DOCUMENT_PROCESSING_STAGE_TABLE),
 		Key:                       key,
 		UpdateExpression:          aws.String(updateExpression),
+		ExpressionAttributeNames:  expressionAttributeNames,
 		ExpressionAttributeValues: expressionAttributeValues,
 		ReturnValues:              types.ReturnValueUpdatedNew,
 	}
@@ -290,3 +1590,116 @@ func (db *DocumentStoreContext) CompleteDocumentStage(
 
 	return nil
 }
+
+// ScanDocumentStages calls fn with each page of the stages of every document
+// so the table is never held in memory at once. Scanning stops at the first
+// error from fn.
+func (db *DocumentStoreContext) ScanDocumentStages(
+	ctx context.Context,
+	fn func(stages []*stypes.DocumentProcessingStage) error,
+) error {
+	input := &dynamodb.ScanInput{
+		TableName: aws.String(DOCUMENT_PROCESSING_STAGE_TABLE),
+	}
+
+	paginator := dynamodb.NewScanPaginator(db.store, input)
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			slog.Error("Failed to scan the document stages", "error", err)
+			return err
+		}
+
+		var stages []*stypes.DocumentProcessingStage
+		err = attributevalue.UnmarshalListOfMaps(page.Items, &stages)
+		if err != nil {
+			slog.Error("Failed to unmarshal the document stages", "error", err)
+			return err
+		}
+
+		if err := fn(stages); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// MarkStageArtifactMissing flags the stage when the object it recorded is
+// gone from S3.
+func (db *DocumentStoreContext) MarkStageArtifactMissing(
+	ctx context.Context,
+	id string,
+	stage stypes.Stage,
+) error {
+	input := &dynamodb.UpdateItemInput{
+		TableName: aws.String(DOCUMENT_PROCESSING_STAGE_TABLE),
+		Key: map[string]types.AttributeValue{
+			"id":    &types.AttributeValueMemberS{Value: id},
+			"stage": &types.AttributeValueMemberS{Value: string(stage)},
+		},
+		UpdateExpression: aws.String("SET artifact_missing = :true"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":true": &types.AttributeValueMemberBOOL{Value: true},
+		},
+	}
+
+	_, err := db.store.UpdateItem(ctx, input)
+	if err != nil {
+		slog.Error(
+			"Failed to flag the missing artifact of the stage",
+			"id",
+			id,
+			"stage",
+			stage,
+			"error",
+			err,
+		)
+		return err
+	}
+
+	return nil
+}
+
+// CompleteStageDestinations records the destination folders the stage
+// finished publishing to. Folders already recorded are left as they are.
+func (db *DocumentStoreContext) CompleteStageDestinations(
+	ctx context.Context,
+	id string,
+	stage stypes.Stage,
+	folderIDs []string,
+) error {
+	if len(folderIDs) == 0 {
+		return nil
+	}
+
+	input := &dynamodb.UpdateItemInput{
+		TableName: aws.String(DOCUMENT_PROCESSING_STAGE_TABLE),
+		Key: map[string]types.AttributeValue{
+			"id":    &types.AttributeValueMemberS{Value: id},
+			"stage": &types.AttributeValueMemberS{Value: string(stage)},
+		},
+		UpdateExpression: aws.String("ADD completed_destinations :folders"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":folders": &types.AttributeValueMemberSS{Value: folderIDs},
+		},
+	}
+
+	_, err := db.store.UpdateItem(ctx, input)
+	if err != nil {
+		slog.Error(
+			"Failed to record the completed destinations of the stage",
+			"id",
+			id,
+			"stage",
+			stage,
+			"folderIDs",
+			folderIDs,
+			"error",
+			err,
+		)
+		return err
+	}
+
+	return nil
+}
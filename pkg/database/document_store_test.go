@@ -0,0 +1,1452 @@
+package database
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	stypes "github.com/KyleBrandon/scriptor/pkg/types"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+func TestExecutionSlot(t *testing.T) {
+	hold := &updateRequest{
+		TableName:           DOCUMENT_TABLE,
+		Key:                 map[string]map[string]any{"id": {"S": "doc-1"}},
+		UpdateExpression:    "SET execution_slot = :true",
+		ConditionExpression: "attribute_not_exists(execution_slot)",
+		ExpressionAttributeValues: map[string]map[string]any{
+			":true": {"BOOL": true},
+		},
+	}
+	release := &updateRequest{
+		TableName:           DOCUMENT_TABLE,
+		Key:                 map[string]map[string]any{"id": {"S": "doc-1"}},
+		UpdateExpression:    "REMOVE execution_slot",
+		ConditionExpression: "attribute_exists(execution_slot)",
+	}
+
+	tests := []struct {
+		name     string
+		release  bool
+		response dynamoResponse
+
+		want        bool
+		wantErr     bool
+		wantRequest *updateRequest
+	}{
+		{name: "hold", response: updated, want: true, wantRequest: hold},
+		// the document is only counted once
+		{name: "hold when already held", response: conditionFailed, wantRequest: hold},
+		{name: "hold fails", response: validationFailed, wantErr: true, wantRequest: hold},
+		{name: "release", release: true, response: updated, want: true, wantRequest: release},
+		// the execution is only given back once
+		{name: "release when not held", release: true, response: conditionFailed, wantRequest: release},
+		{name: "release fails", release: true, response: validationFailed, wantErr: true, wantRequest: release},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			client, request := fakeDynamoDB(t, tc.response)
+			db := &DocumentStoreContext{store: client}
+
+			update := db.HoldExecutionSlot
+			if tc.release {
+				update = db.ReleaseExecutionSlot
+			}
+
+			got, err := update(context.Background(), "doc-1")
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if got != tc.want {
+				t.Fatalf("unexpected result: got %v want %v", got, tc.want)
+			}
+
+			if !reflect.DeepEqual(request, tc.wantRequest) {
+				t.Fatalf("unexpected request:\ngot  %+v\nwant %+v", request, tc.wantRequest)
+			}
+		})
+	}
+}
+
+func TestReleaseHeldDocument(t *testing.T) {
+	tests := []struct {
+		name     string
+		response dynamoResponse
+		want     bool
+		wantErr  bool
+	}{
+		{name: "held", response: updated, want: true},
+		// released by another notification, or superseded or deleted
+		{name: "no longer held", response: conditionFailed},
+		{name: "release fails", response: validationFailed, wantErr: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			client, request := fakeDynamoDB(t, tc.response)
+			db := &DocumentStoreContext{store: client}
+
+			got, err := db.ReleaseHeldDocument(context.Background(), "doc-1")
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if got != tc.want {
+				t.Fatalf("unexpected result: got %v want %v", got, tc.want)
+			}
+
+			want := &updateRequest{
+				TableName:           DOCUMENT_TABLE,
+				Key:                 map[string]map[string]any{"id": {"S": "doc-1"}},
+				UpdateExpression:    "SET #status = :pending",
+				ConditionExpression: "#status = :held",
+				ExpressionAttributeNames: map[string]string{
+					"#status": "status",
+				},
+				ExpressionAttributeValues: map[string]map[string]any{
+					":pending": {"S": stypes.DOCUMENT_STATUS_PENDING},
+					":held":    {"S": stypes.DOCUMENT_STATUS_HELD},
+				},
+			}
+			if !reflect.DeepEqual(request, want) {
+				t.Fatalf("unexpected request:\ngot  %+v\nwant %+v", request, want)
+			}
+		})
+	}
+}
+
+func TestInsertDocument(t *testing.T) {
+	tests := []struct {
+		name     string
+		response dynamoResponse
+		wantErr  error
+		anyErr   bool
+	}{
+		{name: "inserted", response: updated},
+		// another notification saved the document first
+		{name: "already saved", response: conditionFailed, wantErr: ErrDocumentExists},
+		{name: "insert fails", response: validationFailed, anyErr: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			client, request := fakeDynamoDB(t, tc.response)
+			db := &DocumentStoreContext{store: client}
+
+			err := db.InsertDocument(context.Background(), &stypes.Document{
+				ID:     "doc-1",
+				Name:   "scan.pdf",
+				Status: stypes.DOCUMENT_STATUS_PENDING,
+			})
+			if tc.anyErr {
+				if err == nil || errors.Is(err, ErrDocumentExists) {
+					t.Fatalf("unexpected error: %v", err)
+				}
+			} else if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("unexpected error: got %v want %v", err, tc.wantErr)
+			}
+
+			// the document is only written when there is none with the ID
+			if request.TableName != DOCUMENT_TABLE ||
+				request.ConditionExpression != "attribute_not_exists(id)" ||
+				request.Item["id"]["S"] != "doc-1" ||
+				request.Item["status"]["S"] != stypes.DOCUMENT_STATUS_PENDING {
+				t.Fatalf("unexpected request: %+v", request)
+			}
+		})
+	}
+}
+
+// The requests a fake DynamoDB answered in turn
+type dynamoSequence struct {
+	// the operation and the table of each request, with the table and the
+	// condition of each item of a transaction
+	calls []string
+
+	// each request as it was sent
+	requests []*updateRequest
+}
+
+// A DynamoDB endpoint that answers each request in turn, recording the
+// operation and the table of each
+func fakeDynamoDBSequence(t *testing.T, bodies ...string) (*dynamodb.Client, *dynamoSequence) {
+	t.Helper()
+
+	sequence := &dynamoSequence{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("failed to read the request: %v", err)
+		}
+
+		request := &updateRequest{}
+		if err := json.Unmarshal(body, request); err != nil {
+			t.Errorf("request is not JSON: %v", err)
+		}
+
+		var input struct {
+			TransactItems []struct {
+				Put struct {
+					TableName           string
+					ConditionExpression string
+				}
+			}
+		}
+		json.Unmarshal(body, &input)
+
+		_, operation, _ := strings.Cut(r.Header.Get("X-Amz-Target"), ".")
+		parts := []string{operation}
+		if request.TableName != "" {
+			parts = append(parts, request.TableName)
+		}
+		for _, item := range input.TransactItems {
+			parts = append(parts, item.Put.TableName+"["+item.Put.ConditionExpression+"]")
+		}
+		call := strings.Join(parts, " ")
+
+		if len(sequence.calls) >= len(bodies) {
+			t.Errorf("unexpected request: %s", call)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		response := bodies[len(sequence.calls)]
+		sequence.calls = append(sequence.calls, call)
+		sequence.requests = append(sequence.requests, request)
+
+		w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+		if strings.Contains(response, "__type") {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+		w.Write([]byte(response))
+	}))
+	t.Cleanup(server.Close)
+
+	client := dynamodb.New(dynamodb.Options{
+		Region:           "us-east-1",
+		BaseEndpoint:     aws.String(server.URL),
+		Credentials:      aws.AnonymousCredentials{},
+		HTTPClient:       server.Client(),
+		RetryMaxAttempts: 1,
+	})
+
+	return client, sequence
+}
+
+// A transaction cancelled for the reasons, in the order of its items
+func transactionCanceled(reasons ...string) string {
+	codes := make([]string, 0, len(reasons))
+	for _, reason := range reasons {
+		codes = append(codes, `{"Code":"`+reason+`"}`)
+	}
+
+	return `{"__type":"com.amazonaws.dynamodb.v20120810#TransactionCanceledException",` +
+		`"message":"cancelled","CancellationReasons":[` + strings.Join(codes, ",") + `]}`
+}
+
+func TestInsertDocumentWithStage(t *testing.T) {
+	// the document and its stage are written together or not at all
+	transaction := "TransactWriteItems " +
+		DOCUMENT_TABLE + "[attribute_not_exists(id)] " +
+		DOCUMENT_PROCESSING_STAGE_TABLE + "[]"
+
+	tests := []struct {
+		name    string
+		body    string
+		wantErr error
+		anyErr  bool
+	}{
+		{name: "inserted", body: "{}"},
+		// another notification saved the document first
+		{
+			name:    "already saved",
+			body:    transactionCanceled("ConditionalCheckFailed", "None"),
+			wantErr: ErrDocumentExists,
+		},
+		{
+			name:   "stage fails",
+			body:   transactionCanceled("None", "ValidationError"),
+			anyErr: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			client, sequence := fakeDynamoDBSequence(t, tc.body)
+			db := &DocumentStoreContext{store: client}
+
+			stage := &stypes.DocumentProcessingStage{
+				ID:          "doc-1",
+				Stage:       stypes.DOCUMENT_STAGE_DOWNLOAD,
+				StageStatus: stypes.DOCUMENT_STATUS_PENDING,
+			}
+			err := db.InsertDocumentWithStage(
+				context.Background(),
+				&stypes.Document{ID: "doc-1", Status: stypes.DOCUMENT_STATUS_PENDING},
+				stage,
+			)
+			if tc.anyErr {
+				if err == nil || errors.Is(err, ErrDocumentExists) {
+					t.Fatalf("unexpected error: %v", err)
+				}
+			} else if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("unexpected error: got %v want %v", err, tc.wantErr)
+			}
+
+			if !slices.Equal(sequence.calls, []string{transaction}) {
+				t.Fatalf("unexpected requests: %q", sequence.calls)
+			}
+
+			if stage.StartedAt.IsZero() {
+				t.Fatal("the stage has no start time")
+			}
+		})
+	}
+}
+
+func TestStartPendingDocumentStage(t *testing.T) {
+	pending := `{"Attributes":{"id":{"S":"doc-1"},"stage":{"S":"downloaded"},` +
+		`"stage_status":{"S":"in-progress"},"original_file_name":{"S":"scan.pdf"}}}`
+	conditionFailed := `{"__type":"com.amazonaws.dynamodb.v20120810#ConditionalCheckFailedException"}`
+	validationFailed := `{"__type":"com.amazonaws.dynamodb.v20120810#ValidationException"}`
+	started := `{"Item":{"id":{"S":"doc-1"},"stage":{"S":"downloaded"},` +
+		`"stage_status":{"S":"in-progress"},"attempt":{"N":"1"}}}`
+
+	tests := []struct {
+		name      string
+		bodies    []string
+		wantCalls []string
+		wantErr   bool
+	}{
+		{
+			name:   "pending",
+			bodies: []string{pending, "{}"},
+			wantCalls: []string{
+				"UpdateItem " + DOCUMENT_PROCESSING_STAGE_TABLE,
+				"UpdateItem " + DOCUMENT_TABLE,
+			},
+		},
+		{
+			// an earlier attempt already started it
+			name:   "not pending",
+			bodies: []string{conditionFailed, conditionFailed, started, "{}", "{}"},
+			wantCalls: []string{
+				"UpdateItem " + DOCUMENT_PROCESSING_STAGE_TABLE,
+				"PutItem " + DOCUMENT_PROCESSING_STAGE_TABLE,
+				"GetItem " + DOCUMENT_PROCESSING_STAGE_TABLE,
+				"PutItem " + DOCUMENT_PROCESSING_STAGE_TABLE,
+				"UpdateItem " + DOCUMENT_TABLE,
+			},
+		},
+		{
+			name:      "update fails",
+			bodies:    []string{validationFailed},
+			wantCalls: []string{"UpdateItem " + DOCUMENT_PROCESSING_STAGE_TABLE},
+			wantErr:   true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			client, sequence := fakeDynamoDBSequence(t, tc.bodies...)
+			db := &DocumentStoreContext{store: client}
+
+			stage, err := db.StartPendingDocumentStage(
+				context.Background(),
+				"doc-1",
+				stypes.DOCUMENT_STAGE_DOWNLOAD,
+				"scan.pdf",
+			)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if !slices.Equal(sequence.calls, tc.wantCalls) {
+				t.Fatalf("unexpected requests: got %q want %q", sequence.calls, tc.wantCalls)
+			}
+
+			if tc.wantErr {
+				return
+			}
+
+			if stage.ID != "doc-1" ||
+				stage.Stage != stypes.DOCUMENT_STAGE_DOWNLOAD ||
+				stage.StageStatus != stypes.DOCUMENT_STATUS_INPROGRESS ||
+				stage.OriginalFileName != "scan.pdf" {
+				t.Fatalf("unexpected stage: %+v", stage)
+			}
+		})
+	}
+}
+
+func TestFailDocumentStage(t *testing.T) {
+	tests := []struct {
+		name      string
+		responses map[string]dynamoResponse
+
+		wantErr      bool
+		wantRequests int
+	}{
+		{name: "failed", wantRequests: 2},
+		{
+			name:         "update fails",
+			responses:    map[string]dynamoResponse{DOCUMENT_PROCESSING_STAGE_TABLE: validationFailed},
+			wantErr:      true,
+			wantRequests: 1,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			client, requests := fakeDocumentTables(t, tc.responses)
+			db := &DocumentStoreContext{store: client}
+
+			stage := &stypes.DocumentProcessingStage{
+				ID:          "doc-1",
+				Stage:       stypes.DOCUMENT_STAGE_MATHPIX,
+				StageStatus: stypes.DOCUMENT_STATUS_INPROGRESS,
+				StartedAt:   time.Now().UTC().Add(-time.Minute),
+			}
+
+			err := db.FailDocumentStage(
+				context.Background(),
+				stage,
+				stypes.DOCUMENT_STATUS_ERROR,
+				"drive_unavailable",
+				"mathpix conversion failed",
+			)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if len(*requests) != tc.wantRequests {
+				t.Fatalf("unexpected requests: %+v", *requests)
+			}
+
+			request := (*requests)[0]
+			if request.TableName != DOCUMENT_PROCESSING_STAGE_TABLE {
+				t.Fatalf("unexpected table: %s", request.TableName)
+			}
+
+			wantKey := map[string]map[string]any{
+				"id":    {"S": "doc-1"},
+				"stage": {"S": string(stypes.DOCUMENT_STAGE_MATHPIX)},
+			}
+			if !reflect.DeepEqual(request.Key, wantKey) {
+				t.Fatalf("unexpected key: %v", request.Key)
+			}
+
+			item := updatedAttributes(request)
+			for name, want := range map[string]string{
+				"stage_status": stypes.DOCUMENT_STATUS_ERROR,
+				"error_code":   "drive_unavailable",
+				"error_reason": "mathpix conversion failed",
+			} {
+				if got := item[name]["S"]; got != want {
+					t.Fatalf("unexpected %s: got %v want %s", name, got, want)
+				}
+			}
+
+			completedAt, _ := item["completed_at"]["S"].(string)
+			got, err := time.Parse(time.RFC3339Nano, completedAt)
+			if err != nil || got.IsZero() {
+				t.Fatalf("completed_at is not set: %q", completedAt)
+			}
+		})
+	}
+}
+
+func TestDocumentStatus(t *testing.T) {
+	tests := []struct {
+		stage       stypes.Stage
+		stageStatus string
+		want        string
+	}{
+		{stypes.DOCUMENT_STAGE_DOWNLOAD, stypes.DOCUMENT_STATUS_INPROGRESS, stypes.DOCUMENT_STATUS_INPROGRESS},
+		// the document goes on to the next stage
+		{stypes.DOCUMENT_STAGE_DOWNLOAD, stypes.DOCUMENT_STATUS_COMPLETE, stypes.DOCUMENT_STATUS_INPROGRESS},
+		{stypes.DOCUMENT_STAGE_MATHPIX, stypes.DOCUMENT_STATUS_COMPLETE, stypes.DOCUMENT_STATUS_INPROGRESS},
+		{stypes.DOCUMENT_STAGE_OPENAI, stypes.DOCUMENT_STATUS_ERROR, stypes.DOCUMENT_STATUS_ERROR},
+		{stypes.DOCUMENT_STAGE_DOWNLOAD, stypes.DOCUMENT_STATUS_SOURCE_MISSING, stypes.DOCUMENT_STATUS_SOURCE_MISSING},
+		{stypes.DOCUMENT_STAGE_UPLOAD, stypes.DOCUMENT_STATUS_INPROGRESS, stypes.DOCUMENT_STATUS_INPROGRESS},
+		// only the upload finishes the document
+		{stypes.DOCUMENT_STAGE_UPLOAD, stypes.DOCUMENT_STATUS_COMPLETE, stypes.DOCUMENT_STATUS_COMPLETE},
+	}
+
+	for _, tc := range tests {
+		if got := documentStatus(tc.stage, tc.stageStatus); got != tc.want {
+			t.Fatalf("unexpected status of %s %s: got %s want %s", tc.stage, tc.stageStatus, got, tc.want)
+		}
+	}
+}
+
+func TestStageTransitionsUpdateDocumentStatus(t *testing.T) {
+	tests := []struct {
+		name       string
+		transition func(db *DocumentStoreContext, stage *stypes.DocumentProcessingStage) error
+		stage      stypes.Stage
+		want       string
+	}{
+		{
+			name:  "started",
+			stage: stypes.DOCUMENT_STAGE_MATHPIX,
+			transition: func(db *DocumentStoreContext, stage *stypes.DocumentProcessingStage) error {
+				_, err := db.StartDocumentStage(context.Background(), stage.ID, stage.Stage, "scan.pdf")
+				return err
+			},
+			want: stypes.DOCUMENT_STATUS_INPROGRESS,
+		},
+		{
+			name:  "completed",
+			stage: stypes.DOCUMENT_STAGE_MATHPIX,
+			transition: func(db *DocumentStoreContext, stage *stypes.DocumentProcessingStage) error {
+				return db.CompleteDocumentStage(context.Background(), stage)
+			},
+			want: stypes.DOCUMENT_STATUS_INPROGRESS,
+		},
+		{
+			name:  "uploaded",
+			stage: stypes.DOCUMENT_STAGE_UPLOAD,
+			transition: func(db *DocumentStoreContext, stage *stypes.DocumentProcessingStage) error {
+				return db.CompleteDocumentStage(context.Background(), stage)
+			},
+			want: stypes.DOCUMENT_STATUS_COMPLETE,
+		},
+		{
+			name:  "failed",
+			stage: stypes.DOCUMENT_STAGE_OPENAI,
+			transition: func(db *DocumentStoreContext, stage *stypes.DocumentProcessingStage) error {
+				return db.FailDocumentStage(
+					context.Background(),
+					stage,
+					stypes.DOCUMENT_STATUS_ERROR,
+					"unknown",
+					"cleanup failed",
+				)
+			},
+			want: stypes.DOCUMENT_STATUS_ERROR,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			client, requests := fakeDocumentTables(t, nil)
+			db := &DocumentStoreContext{store: client}
+
+			stage := &stypes.DocumentProcessingStage{ID: "doc-1", Stage: tc.stage}
+			if err := tc.transition(db, stage); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			// the upload also reads the download stage, for the duration of
+			// the whole pipeline
+			wantRequests := 2
+			if tc.stage == stypes.DOCUMENT_STAGE_UPLOAD {
+				wantRequests = 3
+			}
+			if len(*requests) != wantRequests {
+				t.Fatalf("unexpected requests: %+v", *requests)
+			}
+
+			want := documentStatusRequest("doc-1", tc.stage, tc.want)
+			if got := (*requests)[1]; !reflect.DeepEqual(got, want) {
+				t.Fatalf("unexpected document update:\ngot  %+v\nwant %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestCompleteDocumentStageDurations(t *testing.T) {
+	client := newFakeClient()
+	db := &DocumentStoreContext{store: client}
+	ctx := context.Background()
+
+	now := time.Now().UTC()
+	download, err := attributevalue.MarshalMap(&stypes.DocumentProcessingStage{
+		ID:          "doc-1",
+		Stage:       stypes.DOCUMENT_STAGE_DOWNLOAD,
+		StageStatus: stypes.DOCUMENT_STATUS_COMPLETE,
+		StartedAt:   now.Add(-10 * time.Minute),
+		CompletedAt: now.Add(-9 * time.Minute),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.put(DOCUMENT_PROCESSING_STAGE_TABLE, download)
+
+	upload := &stypes.DocumentProcessingStage{
+		ID:        "doc-1",
+		Stage:     stypes.DOCUMENT_STAGE_UPLOAD,
+		StartedAt: now.Add(-time.Minute),
+	}
+	if err := db.CompleteDocumentStage(ctx, upload); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// a minute for the stage, ten for the pipeline, give or take the test
+	within := func(name string, got int64, want time.Duration) {
+		if got < want.Milliseconds() || got > (want+time.Second).Milliseconds() {
+			t.Fatalf("unexpected %s: got %d want %v", name, got, want)
+		}
+	}
+
+	within("stage duration", upload.DurationMillis, time.Minute)
+
+	// the stage, the status and the pipeline duration of the document
+	if len(client.updates) != 3 {
+		t.Fatalf("unexpected updates: %+v", client.updates)
+	}
+
+	// the duration is saved with the stage
+	var saved string
+	for name, attribute := range client.updates[0].ExpressionAttributeNames {
+		if attribute == "duration_millis" {
+			value := client.updates[0].ExpressionAttributeValues[":val"+strings.TrimPrefix(name, "#attr")]
+			if n, ok := value.(*types.AttributeValueMemberN); ok {
+				saved = n.Value
+			}
+		}
+	}
+	if saved != strconv.FormatInt(upload.DurationMillis, 10) {
+		t.Fatalf("stage duration not saved: %+v", client.updates[0])
+	}
+
+	update := client.updates[2]
+	if aws.ToString(update.TableName) != DOCUMENT_TABLE ||
+		aws.ToString(update.UpdateExpression) != "SET pipeline_duration_millis = :duration" {
+		t.Fatalf("unexpected update: %+v", update)
+	}
+
+	value, _ := update.ExpressionAttributeValues[":duration"].(*types.AttributeValueMemberN)
+	if value == nil {
+		t.Fatalf("unexpected update: %+v", update)
+	}
+	duration, err := strconv.ParseInt(value.Value, 10, 64)
+	if err != nil {
+		t.Fatalf("unexpected duration %q: %v", value.Value, err)
+	}
+	within("pipeline duration", duration, 10*time.Minute)
+}
+
+func TestCompleteDocumentStageRetention(t *testing.T) {
+	tests := []struct {
+		name      string
+		retention time.Duration
+		// the document isn't complete when the TTL is set
+		notComplete bool
+		wantTTL     []string
+	}{
+		{name: "kept forever by default"},
+		{
+			name:      "expires after the retention",
+			retention: 30 * 24 * time.Hour,
+			wantTTL:   []string{DOCUMENT_TABLE, DOCUMENT_PROCESSING_STAGE_TABLE, DOCUMENT_PROCESSING_STAGE_TABLE},
+		},
+		// the document is only asked to expire, and refuses
+		{
+			name:        "failed document kept",
+			retention:   30 * 24 * time.Hour,
+			notComplete: true,
+			wantTTL:     []string{DOCUMENT_TABLE},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			client := newFakeClient()
+			db := &DocumentStoreContext{store: client, retention: tc.retention}
+			ctx := context.Background()
+
+			if tc.notComplete {
+				client.updateErr = func(params *dynamodb.UpdateItemInput) error {
+					if _, ok := params.ExpressionAttributeValues[":complete"]; ok {
+						return &types.ConditionalCheckFailedException{}
+					}
+					return nil
+				}
+			}
+
+			for _, name := range []stypes.Stage{stypes.DOCUMENT_STAGE_DOWNLOAD, stypes.DOCUMENT_STAGE_UPLOAD} {
+				item, err := attributevalue.MarshalMap(&stypes.DocumentProcessingStage{ID: "doc-1", Stage: name})
+				if err != nil {
+					t.Fatal(err)
+				}
+				client.put(DOCUMENT_PROCESSING_STAGE_TABLE, item)
+			}
+
+			upload := &stypes.DocumentProcessingStage{ID: "doc-1", Stage: stypes.DOCUMENT_STAGE_UPLOAD}
+			if err := db.CompleteDocumentStage(ctx, upload); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			want := strconv.FormatInt(upload.CompletedAt.Add(tc.retention).Unix(), 10)
+			var got []string
+			for _, update := range client.updates {
+				if update.ExpressionAttributeNames["#ttl"] != DOCUMENT_TTL_ATTRIBUTE {
+					continue
+				}
+
+				value, _ := update.ExpressionAttributeValues[":ttl"].(*types.AttributeValueMemberN)
+				if value == nil || value.Value != want {
+					t.Fatalf("unexpected ttl: %+v", update)
+				}
+				got = append(got, aws.ToString(update.TableName))
+			}
+
+			if !slices.Equal(got, tc.wantTTL) {
+				t.Fatalf("unexpected ttl updates: got %v want %v", got, tc.wantTTL)
+			}
+		})
+	}
+}
+
+func TestParseRetention(t *testing.T) {
+	tests := []struct {
+		setting string
+		want    time.Duration
+		wantErr bool
+	}{
+		{setting: "", want: 0},
+		{setting: "30", want: 30 * 24 * time.Hour},
+		{setting: "0", wantErr: true},
+		{setting: "-1", wantErr: true},
+		{setting: "a month", wantErr: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.setting, func(t *testing.T) {
+			got, err := parseRetention(tc.setting)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if got != tc.want {
+				t.Fatalf("unexpected retention: got %v want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestStageDurationStats(t *testing.T) {
+	start := time.Date(2025, 1, 2, 3, 0, 0, 0, time.UTC)
+
+	// the Mathpix runs of ten documents, taking one to ten seconds
+	var stages []*stypes.DocumentProcessingStage
+	for i := 1; i <= 10; i++ {
+		stages = append(stages, &stypes.DocumentProcessingStage{
+			Stage:          stypes.DOCUMENT_STAGE_MATHPIX,
+			StageStatus:    stypes.DOCUMENT_STATUS_COMPLETE,
+			DurationMillis: int64(i) * 1000,
+			ExternalMillis: int64(i) * 800,
+		})
+	}
+
+	stages = append(stages,
+		// the durations of the stages completed before they were saved
+		&stypes.DocumentProcessingStage{
+			Stage:       stypes.DOCUMENT_STAGE_OPENAI,
+			StageStatus: stypes.DOCUMENT_STATUS_COMPLETE,
+			StartedAt:   start,
+			CompletedAt: start.Add(20 * time.Second),
+		},
+		&stypes.DocumentProcessingStage{
+			Stage:          stypes.DOCUMENT_STAGE_OPENAI,
+			StageStatus:    stypes.DOCUMENT_STATUS_COMPLETE,
+			DurationMillis: 40000,
+			ExternalMillis: 36000,
+		},
+		// the runs that didn't complete aren't counted
+		&stypes.DocumentProcessingStage{
+			Stage:       stypes.DOCUMENT_STAGE_OPENAI,
+			StageStatus: stypes.DOCUMENT_STATUS_ERROR,
+			StartedAt:   start,
+			CompletedAt: start.Add(time.Hour),
+		},
+		&stypes.DocumentProcessingStage{
+			Stage:       stypes.DOCUMENT_STAGE_UPLOAD,
+			StageStatus: stypes.DOCUMENT_STATUS_INPROGRESS,
+			StartedAt:   start,
+		},
+	)
+
+	want := []*stypes.StageDurationStats{
+		{
+			Stage:                 stypes.DOCUMENT_STAGE_MATHPIX,
+			Count:                 10,
+			AverageMillis:         5500,
+			P50Millis:             5000,
+			P90Millis:             9000,
+			P99Millis:             10000,
+			AverageExternalMillis: 4400,
+		},
+		{
+			Stage:                 stypes.DOCUMENT_STAGE_OPENAI,
+			Count:                 2,
+			AverageMillis:         30000,
+			P50Millis:             20000,
+			P90Millis:             40000,
+			P99Millis:             40000,
+			AverageExternalMillis: 18000,
+		},
+	}
+
+	got := stageDurationStats(stages)
+	if !reflect.DeepEqual(got, want) {
+		for i := range got {
+			t.Logf("got %+v", got[i])
+		}
+		t.Fatalf("unexpected stats")
+	}
+
+	if stats := stageDurationStats(nil); len(stats) != 0 {
+		t.Fatalf("unexpected stats without stages: %+v", stats)
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	tests := []struct {
+		name   string
+		sorted []int64
+		p      int
+		want   int64
+	}{
+		{name: "one value", sorted: []int64{7}, p: 99, want: 7},
+		{name: "median of an even count", sorted: []int64{1, 2, 3, 4}, p: 50, want: 2},
+		{name: "median of an odd count", sorted: []int64{1, 2, 3}, p: 50, want: 2},
+		{name: "highest", sorted: []int64{1, 2, 3}, p: 100, want: 3},
+		{name: "lowest", sorted: []int64{1, 2, 3}, p: 0, want: 1},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := percentile(tc.sorted, tc.p); got != tc.want {
+				t.Fatalf("unexpected percentile: got %d want %d", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestUpdateDocumentStatus(t *testing.T) {
+	tests := []struct {
+		name     string
+		stage    stypes.Stage
+		status   string
+		response dynamoResponse
+		wantErr  bool
+	}{
+		{name: "status and stage", stage: stypes.DOCUMENT_STAGE_DOWNLOAD, response: updated},
+		// a failed document loses its TTL so it isn't removed
+		{
+			name:     "error",
+			stage:    stypes.DOCUMENT_STAGE_OPENAI,
+			status:   stypes.DOCUMENT_STATUS_ERROR,
+			response: updated,
+		},
+		// the stage it was at is kept
+		{name: "status only", response: updated},
+		// a superseded, deleted or missing document is left alone
+		{name: "document left alone", stage: stypes.DOCUMENT_STAGE_DOWNLOAD, response: conditionFailed},
+		{name: "update fails", stage: stypes.DOCUMENT_STAGE_DOWNLOAD, response: validationFailed, wantErr: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			client, request := fakeDynamoDB(t, tc.response)
+			db := &DocumentStoreContext{store: client}
+
+			status := tc.status
+			if status == "" {
+				status = stypes.DOCUMENT_STATUS_PENDING
+			}
+
+			err := db.UpdateDocumentStatus(context.Background(), "doc-1", tc.stage, status)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			want := documentStatusRequest("doc-1", tc.stage, status)
+			if !reflect.DeepEqual(request, want) {
+				t.Fatalf("unexpected request:\ngot  %+v\nwant %+v", request, want)
+			}
+		})
+	}
+}
+
+func TestUpdateDocumentFields(t *testing.T) {
+	completedAt := time.Date(2025, 1, 1, 10, 0, 0, 0, time.UTC)
+	fileName := "Meeting Notes.md"
+	empty := ""
+
+	tests := []struct {
+		name     string
+		update   *stypes.DocumentUpdate
+		response dynamoResponse
+		want     []string
+		wantErr  error
+		anyErr   bool
+	}{
+		{
+			name:     "set fields",
+			update:   &stypes.DocumentUpdate{CompletedAt: &completedAt, FinalFileName: &fileName},
+			response: updated,
+			want:     []string{"completed_at", "final_file_name"},
+		},
+		// a field set to its zero value is still saved
+		{
+			name:     "cleared field",
+			update:   &stypes.DocumentUpdate{ArchivedDriveFileID: &empty},
+			response: updated,
+			want:     []string{"archived_drive_file_id"},
+		},
+		// nothing is asked of DynamoDB
+		{name: "nothing set", update: &stypes.DocumentUpdate{}},
+		{
+			name:     "document missing",
+			update:   &stypes.DocumentUpdate{FinalFileName: &fileName},
+			response: conditionFailed,
+			want:     []string{"final_file_name"},
+			wantErr:  ErrDocumentNotFound,
+		},
+		{
+			name:     "update fails",
+			update:   &stypes.DocumentUpdate{FinalFileName: &fileName},
+			response: validationFailed,
+			want:     []string{"final_file_name"},
+			anyErr:   true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			client, request := fakeDynamoDB(t, tc.response)
+			db := &DocumentStoreContext{store: client}
+
+			err := db.UpdateDocumentFields(context.Background(), "doc-1", tc.update)
+			if tc.anyErr {
+				if err == nil || errors.Is(err, ErrDocumentNotFound) {
+					t.Fatalf("unexpected error: %v", err)
+				}
+			} else if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("unexpected error: got %v want %v", err, tc.wantErr)
+			}
+
+			if len(tc.want) == 0 {
+				if request.UpdateExpression != "" {
+					t.Fatalf("unexpected request: %+v", request)
+				}
+				return
+			}
+
+			if request.TableName != DOCUMENT_TABLE ||
+				request.ConditionExpression != "attribute_exists(id)" {
+				t.Fatalf("unexpected request: %+v", request)
+			}
+
+			// only the fields that are set are saved
+			got := slices.Sorted(maps.Keys(updatedAttributes(request)))
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("unexpected attributes: got %v want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestGetDocumentStages(t *testing.T) {
+	stage := func(name stypes.Stage, startedAt string) string {
+		return `{"id":{"S":"doc-1"},"stage":{"S":"` + string(name) + `"},"started_at":{"S":"` + startedAt + `"}}`
+	}
+	download := stage(stypes.DOCUMENT_STAGE_DOWNLOAD, "2025-01-01T10:00:00Z")
+	mathpix := stage(stypes.DOCUMENT_STAGE_MATHPIX, "2025-01-01T10:01:00Z")
+	openai := stage(stypes.DOCUMENT_STAGE_OPENAI, "2025-01-01T10:02:00Z")
+	upload := stage(stypes.DOCUMENT_STAGE_UPLOAD, "2025-01-01T10:03:00Z")
+
+	// the stages come back in any order
+	tests := []struct {
+		name  string
+		pages []string
+		want  []stypes.Stage
+	}{
+		{name: "no stages", pages: []string{`{"Items":[]}`}, want: []stypes.Stage{}},
+		{
+			name:  "partial",
+			pages: []string{`{"Items":[` + mathpix + `,` + download + `]}`},
+			want:  []stypes.Stage{stypes.DOCUMENT_STAGE_DOWNLOAD, stypes.DOCUMENT_STAGE_MATHPIX},
+		},
+		{
+			name: "complete over two pages",
+			pages: []string{
+				`{"Items":[` + upload + `,` + mathpix + `],"LastEvaluatedKey":{"id":{"S":"doc-1"},"stage":{"S":"mathpix"}}}`,
+				`{"Items":[` + download + `,` + openai + `]}`,
+			},
+			want: []stypes.Stage{
+				stypes.DOCUMENT_STAGE_DOWNLOAD,
+				stypes.DOCUMENT_STAGE_MATHPIX,
+				stypes.DOCUMENT_STAGE_OPENAI,
+				stypes.DOCUMENT_STAGE_UPLOAD,
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			client, sequence := fakeDynamoDBSequence(t, tc.pages...)
+			db := &DocumentStoreContext{store: client}
+
+			stages, err := db.GetDocumentStages(context.Background(), "doc-1")
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			for _, input := range sequence.requests {
+				if input.TableName != DOCUMENT_PROCESSING_STAGE_TABLE ||
+					input.KeyConditionExpression != "id = :id" ||
+					input.ExpressionAttributeValues[":id"]["S"] != "doc-1" {
+					t.Fatalf("unexpected query: %+v", input)
+				}
+			}
+			queries := len(sequence.requests)
+
+			got := make([]stypes.Stage, 0, len(stages))
+			for _, stage := range stages {
+				got = append(got, stage.Stage)
+			}
+
+			if !reflect.DeepEqual(got, tc.want) || queries != len(tc.pages) {
+				t.Fatalf("unexpected stages after %d queries: got %v want %v", queries, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestGetDocumentByContentHash(t *testing.T) {
+	document := func(id, createdTime, duplicateOf string) string {
+		item := `{"id":{"S":"` + id + `"},"content_hash":{"S":"hash-1"},"created_time":{"S":"` + createdTime + `"}`
+		if duplicateOf != "" {
+			item += `,"duplicate_of":{"S":"` + duplicateOf + `"}`
+		}
+		return item + `}`
+	}
+	original := document("doc-1", "2025-01-01T10:00:00.000000000Z", "")
+	duplicate := document("doc-2", "2025-01-02T10:00:00.000000000Z", "doc-1")
+	later := document("doc-3", "2025-01-03T10:00:00.000000000Z", "")
+	lastKey := `"LastEvaluatedKey":{"id":{"S":"doc-2"},"content_hash":{"S":"hash-1"}}`
+
+	tests := []struct {
+		name    string
+		pages   []string
+		want    string
+		wantErr error
+	}{
+		{name: "no documents", pages: []string{`{"Items":[]}`}, wantErr: ErrDocumentNotFound},
+		{
+			name:  "earliest original",
+			pages: []string{`{"Items":[` + later + `,` + duplicate + `,` + original + `]}`},
+			want:  "doc-1",
+		},
+		{
+			// the duplicates filled the first page
+			name: "original on the second page",
+			pages: []string{
+				`{"Items":[` + duplicate + `],` + lastKey + `}`,
+				`{"Items":[` + original + `]}`,
+			},
+			want: "doc-1",
+		},
+		{
+			name:    "only duplicates",
+			pages:   []string{`{"Items":[` + duplicate + `]}`},
+			wantErr: ErrDocumentNotFound,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			client, sequence := fakeDynamoDBSequence(t, tc.pages...)
+			db := &DocumentStoreContext{store: client}
+
+			document, err := db.GetDocumentByContentHash(context.Background(), "hash-1")
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if len(sequence.requests) != len(tc.pages) {
+				t.Fatalf("unexpected queries: %v", sequence.calls)
+			}
+
+			// each page carries on from the key the one before ended at
+			for i, input := range sequence.requests {
+				if input.IndexName != "ContentHashIndex" ||
+					input.KeyConditionExpression != "content_hash = :lookupValue" {
+					t.Fatalf("unexpected query: %+v", input)
+				}
+
+				if (i > 0) != (input.ExclusiveStartKey != nil) {
+					t.Fatalf("unexpected start key on query %d: %v", i, input.ExclusiveStartKey)
+				}
+			}
+
+			if tc.wantErr == nil && document.ID != tc.want {
+				t.Fatalf("unexpected original: got %s want %s", document.ID, tc.want)
+			}
+		})
+	}
+}
+
+func TestListDocumentsByStatus(t *testing.T) {
+	document := func(id, createdTime string) string {
+		return `{"id":{"S":"` + id + `"},"status":{"S":"error"},"created_time":{"S":"` + createdTime + `"}}`
+	}
+	lastKey := `{"id":{"S":"doc-2"},"status":{"S":"error"},"created_time":{"S":"2025-01-02T00:00:00Z"}}`
+
+	tests := []struct {
+		name  string
+		pages []string
+		want  [][]string
+	}{
+		{name: "no documents", pages: []string{`{"Items":[]}`}, want: [][]string{{}}},
+		{
+			name: "two pages",
+			pages: []string{
+				`{"Items":[` + document("doc-1", "2025-01-01T00:00:00Z") + `,` +
+					document("doc-2", "2025-01-02T00:00:00Z") + `],"LastEvaluatedKey":` + lastKey + `}`,
+				`{"Items":[` + document("doc-3", "2025-01-03T00:00:00Z") + `]}`,
+			},
+			want: [][]string{{"doc-1", "doc-2"}, {"doc-3"}},
+		},
+		{
+			// the last page can come back empty
+			name: "empty last page",
+			pages: []string{
+				`{"Items":[` + document("doc-1", "2025-01-01T00:00:00Z") + `],"LastEvaluatedKey":` + lastKey + `}`,
+				`{"Items":[]}`,
+			},
+			want: [][]string{{"doc-1"}, {}},
+		},
+	}
+
+	since := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	until := since.Add(7 * 24 * time.Hour)
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			client, sequence := fakeDynamoDBSequence(t, tc.pages...)
+			db := &DocumentStoreContext{store: client}
+
+			got := make([][]string, 0)
+			cursor := ""
+			for {
+				documents, next, err := db.ListDocumentsByStatus(
+					context.Background(),
+					stypes.DOCUMENT_STATUS_ERROR,
+					since,
+					until,
+					2,
+					cursor,
+				)
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+
+				ids := make([]string, 0, len(documents))
+				for _, document := range documents {
+					ids = append(ids, document.ID)
+				}
+				got = append(got, ids)
+
+				if next == "" {
+					break
+				}
+				cursor = next
+			}
+
+			for i, input := range sequence.requests {
+				if input.TableName != DOCUMENT_TABLE ||
+					input.IndexName != "StatusIndex" ||
+					input.Limit != 2 ||
+					input.ExpressionAttributeValues[":status"]["S"] != "error" ||
+					input.ExpressionAttributeValues[":since"]["S"] != "2025-01-01T00:00:00.000000000Z" ||
+					input.ExpressionAttributeValues[":until"]["S"] != "2025-01-08T00:00:00.000000000Z" {
+					t.Fatalf("unexpected query: %+v", input)
+				}
+
+				// the next page starts after the key the previous one stopped at
+				var want map[string]map[string]any
+				if i > 0 {
+					json.Unmarshal([]byte(lastKey), &want)
+				}
+				if !reflect.DeepEqual(input.ExclusiveStartKey, want) {
+					t.Fatalf("unexpected start key of query %d: %v", i, input.ExclusiveStartKey)
+				}
+			}
+
+			queries := len(sequence.requests)
+			if !reflect.DeepEqual(got, tc.want) || queries != len(tc.pages) {
+				t.Fatalf("unexpected pages after %d queries: got %v want %v", queries, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestListDocumentsByStatusInvalidCursor(t *testing.T) {
+	db := &DocumentStoreContext{}
+
+	_, _, err := db.ListDocumentsByStatus(
+		context.Background(),
+		stypes.DOCUMENT_STATUS_ERROR,
+		time.Time{},
+		time.Now(),
+		0,
+		"not a cursor!",
+	)
+	if err == nil {
+		t.Fatal("expected an error for the cursor")
+	}
+}
+
+func TestStartDocumentStageAttempts(t *testing.T) {
+	conditionFailed := `{"__type":"com.amazonaws.dynamodb.v20120810#ConditionalCheckFailedException"}`
+	failed := `{"Item":{"id":{"S":"doc-1"},"stage":{"S":"mathpix"},"stage_status":{"S":"error"},` +
+		`"started_at":{"S":"2025-01-01T10:00:00Z"},"completed_at":{"S":"2025-01-01T10:01:00Z"},` +
+		`"error_code":{"S":"mathpix_failed"},"error_reason":{"S":"conversion failed"},"attempt":{"N":"1"}}}`
+
+	put := "PutItem " + DOCUMENT_PROCESSING_STAGE_TABLE
+	get := "GetItem " + DOCUMENT_PROCESSING_STAGE_TABLE
+	rollUp := "UpdateItem " + DOCUMENT_TABLE
+
+	tests := []struct {
+		name      string
+		bodies    []string
+		wantCalls []string
+
+		wantErr       bool
+		wantAttempt   int
+		wantLastError string
+		wantHistory   []stypes.StageAttempt
+	}{
+		{
+			name:        "first attempt",
+			bodies:      []string{"{}", "{}"},
+			wantCalls:   []string{put, rollUp},
+			wantAttempt: 1,
+		},
+		{
+			name:          "retry",
+			bodies:        []string{conditionFailed, failed, "{}", "{}"},
+			wantCalls:     []string{put, get, put, rollUp},
+			wantAttempt:   2,
+			wantLastError: "conversion failed",
+			wantHistory: []stypes.StageAttempt{{
+				Attempt:     1,
+				StageStatus: stypes.DOCUMENT_STATUS_ERROR,
+				StartedAt:   time.Date(2025, 1, 1, 10, 0, 0, 0, time.UTC),
+				CompletedAt: time.Date(2025, 1, 1, 10, 1, 0, 0, time.UTC),
+				ErrorCode:   "mathpix_failed",
+				ErrorReason: "conversion failed",
+			}},
+		},
+		{
+			// another run moved the stage on after it was read
+			name:      "retried at once",
+			bodies:    []string{conditionFailed, failed, conditionFailed},
+			wantCalls: []string{put, get, put},
+			wantErr:   true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			client, sequence := fakeDynamoDBSequence(t, tc.bodies...)
+			db := &DocumentStoreContext{store: client}
+
+			stage, err := db.StartDocumentStage(
+				context.Background(),
+				"doc-1",
+				stypes.DOCUMENT_STAGE_MATHPIX,
+				"scan.pdf",
+			)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if !slices.Equal(sequence.calls, tc.wantCalls) {
+				t.Fatalf("unexpected requests: got %q want %q", sequence.calls, tc.wantCalls)
+			}
+
+			if tc.wantErr {
+				return
+			}
+
+			if stage.Attempt != tc.wantAttempt ||
+				stage.LastError != tc.wantLastError ||
+				stage.StageStatus != stypes.DOCUMENT_STATUS_INPROGRESS ||
+				!reflect.DeepEqual(stage.Attempts, tc.wantHistory) {
+				t.Fatalf("unexpected stage: %+v", stage)
+			}
+		})
+	}
+}
+
+func TestNextStageAttempt(t *testing.T) {
+	tests := []struct {
+		name     string
+		previous *stypes.DocumentProcessingStage
+
+		wantAttempt   int
+		wantLastError string
+		wantHistory   []int
+	}{
+		{
+			// recorded before the runs were counted
+			name:        "uncounted",
+			previous:    &stypes.DocumentProcessingStage{StageStatus: stypes.DOCUMENT_STATUS_INPROGRESS},
+			wantAttempt: 2,
+			wantHistory: []int{1},
+		},
+		{
+			// a run that timed out has no reason, the earlier one is kept
+			name: "third attempt",
+			previous: &stypes.DocumentProcessingStage{
+				Attempt:   2,
+				LastError: "conversion failed",
+				Attempts:  []stypes.StageAttempt{{Attempt: 1}},
+			},
+			wantAttempt:   3,
+			wantLastError: "conversion failed",
+			wantHistory:   []int{1, 2},
+		},
+		{
+			name: "failed again",
+			previous: &stypes.DocumentProcessingStage{
+				Attempt:     2,
+				ErrorReason: "rate limited",
+				LastError:   "conversion failed",
+				Attempts:    []stypes.StageAttempt{{Attempt: 1}},
+			},
+			wantAttempt:   3,
+			wantLastError: "rate limited",
+			wantHistory:   []int{1, 2},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			stage := &stypes.DocumentProcessingStage{}
+			nextStageAttempt(tc.previous, stage)
+
+			history := make([]int, 0, len(stage.Attempts))
+			for _, attempt := range stage.Attempts {
+				history = append(history, attempt.Attempt)
+			}
+
+			if stage.Attempt != tc.wantAttempt ||
+				stage.LastError != tc.wantLastError ||
+				!slices.Equal(history, tc.wantHistory) {
+				t.Fatalf("unexpected stage: %+v", stage)
+			}
+		})
+	}
+}
+
+// The update of the status of the document, and the stage when it is set
+func documentStatusRequest(id string, stage stypes.Stage, status string) *updateRequest {
+	request := &updateRequest{
+		TableName:           DOCUMENT_TABLE,
+		Key:                 map[string]map[string]any{"id": {"S": id}},
+		UpdateExpression:    "SET #status = :status",
+		ConditionExpression: "attribute_exists(id) AND NOT (#status IN (:superseded, :deleted))",
+		ExpressionAttributeNames: map[string]string{
+			"#status": "status",
+		},
+		ExpressionAttributeValues: map[string]map[string]any{
+			":status":     {"S": status},
+			":superseded": {"S": stypes.DOCUMENT_STATUS_SUPERSEDED},
+			":deleted":    {"S": stypes.DOCUMENT_STATUS_DELETED},
+		},
+	}
+
+	if stage != "" {
+		request.UpdateExpression += ", current_stage = :stage"
+		request.ExpressionAttributeValues[":stage"] = map[string]any{"S": string(stage)}
+	}
+
+	if status == stypes.DOCUMENT_STATUS_ERROR {
+		request.UpdateExpression += " REMOVE #ttl"
+		request.ExpressionAttributeNames["#ttl"] = DOCUMENT_TTL_ATTRIBUTE
+	}
+
+	return request
+}
+
+// A DynamoDB endpoint that records every write to the document tables and
+// answers it with the response for the table, updated when there is none
+func fakeDocumentTables(
+	t *testing.T,
+	responses map[string]dynamoResponse,
+) (*dynamodb.Client, *[]*updateRequest) {
+	t.Helper()
+
+	requests := make([]*updateRequest, 0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		request := &updateRequest{}
+		if err := json.NewDecoder(r.Body).Decode(request); err != nil {
+			t.Errorf("request is not JSON: %v", err)
+		}
+		requests = append(requests, request)
+
+		response, ok := responses[request.TableName]
+		if !ok {
+			response = updated
+		}
+
+		w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+		w.WriteHeader(response.status)
+		if response.errorType != "" {
+			json.NewEncoder(w).Encode(map[string]string{
+				"__type":  "com.amazonaws.dynamodb.v20120810#" + response.errorType,
+				"message": "failed",
+			})
+			return
+		}
+
+		w.Write([]byte("{}"))
+	}))
+	t.Cleanup(server.Close)
+
+	client := dynamodb.New(dynamodb.Options{
+		Region:           "us-east-1",
+		BaseEndpoint:     aws.String(server.URL),
+		Credentials:      aws.AnonymousCredentials{},
+		HTTPClient:       server.Client(),
+		RetryMaxAttempts: 1,
+	})
+
+	return client, &requests
+}
+
+// The attributes a SET update writes, by their names
+func updatedAttributes(request *updateRequest) map[string]map[string]any {
+	attributes := make(map[string]map[string]any)
+
+	assignments := strings.Split(strings.TrimPrefix(request.UpdateExpression, "SET "), ", ")
+	for _, assignment := range assignments {
+		name, placeholder, _ := strings.Cut(assignment, " = ")
+		attributes[request.ExpressionAttributeNames[name]] = request.ExpressionAttributeValues[placeholder]
+	}
+
+	return attributes
+}
@@ -0,0 +1,141 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+
+	stypes "github.com/KyleBrandon/scriptor/pkg/types"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+func NewFailedNotificationStore(ctx context.Context) (FailedNotificationStore, error) {
+	store, err := newDynamoClient(ctx)
+	if err != nil {
+		slog.Error(
+			"Failed to configure the FailedNotificationStoreContext",
+			"error",
+			err,
+		)
+		return nil, err
+	}
+
+	return NewFailedNotificationStoreWithClient(store), nil
+}
+
+// NewFailedNotificationStoreWithClient uses the client given instead of one
+// configured from the environment.
+func NewFailedNotificationStoreWithClient(store dynamoAPI) FailedNotificationStore {
+	return &FailedNotificationStoreContext{
+		store,
+	}
+}
+
+// InsertFailedNotification records the notification once. A message the
+// dead-letter queue delivers again returns ErrFailedNotificationExists.
+func (db *FailedNotificationStoreContext) InsertFailedNotification(
+	ctx context.Context,
+	notification *stypes.FailedNotification,
+) error {
+	av, err := marshalMap(notification)
+	if err != nil {
+		slog.Error("Failed to marshal the failed notification", "error", err)
+		return err
+	}
+
+	_, err = db.store.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:           aws.String(FAILED_NOTIFICATION_TABLE),
+		Item:                av,
+		ConditionExpression: aws.String("attribute_not_exists(message_id)"),
+	})
+	if err != nil {
+		var ccfe *types.ConditionalCheckFailedException
+		if errors.As(err, &ccfe) {
+			return ErrFailedNotificationExists
+		}
+
+		slog.Error(
+			"Failed to insert the failed notification",
+			"messageID",
+			notification.MessageID,
+			"error",
+			err,
+		)
+		return err
+	}
+
+	return nil
+}
+
+func (db *FailedNotificationStoreContext) UpdateFailedNotification(
+	ctx context.Context,
+	notification *stypes.FailedNotification,
+) error {
+	av, err := marshalMap(notification)
+	if err != nil {
+		slog.Error("Failed to marshal the failed notification", "error", err)
+		return err
+	}
+
+	updateExpression, expressionAttributeNames, expressionAttributeValues := buildUpdateExpression(
+		av,
+		[]string{"message_id"},
+	)
+
+	_, err = db.store.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(FAILED_NOTIFICATION_TABLE),
+		Key: map[string]types.AttributeValue{
+			"message_id": &types.AttributeValueMemberS{Value: notification.MessageID},
+		},
+		UpdateExpression:          aws.String(updateExpression),
+		ExpressionAttributeNames:  expressionAttributeNames,
+		ExpressionAttributeValues: expressionAttributeValues,
+	})
+	if err != nil {
+		slog.Error(
+			"Failed to update the failed notification",
+			"messageID",
+			notification.MessageID,
+			"error",
+			err,
+		)
+		return err
+	}
+
+	return nil
+}
+
+func (db *FailedNotificationStoreContext) GetFailedNotification(
+	ctx context.Context,
+	messageID string,
+) (*stypes.FailedNotification, error) {
+	ret := &stypes.FailedNotification{}
+
+	result, err := db.store.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(FAILED_NOTIFICATION_TABLE),
+		Key: map[string]types.AttributeValue{
+			"message_id": &types.AttributeValueMemberS{Value: messageID},
+		},
+	})
+	if err != nil {
+		slog.Error(
+			"Failed to get the failed notification",
+			"messageID",
+			messageID,
+			"error",
+			err,
+		)
+		return ret, err
+	}
+
+	err = attributevalue.UnmarshalMap(result.Item, ret)
+	if err != nil {
+		slog.Error("Failed to unmarshal the failed notification", "error", err)
+		return ret, err
+	}
+
+	return ret, nil
+}
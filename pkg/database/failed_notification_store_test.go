@@ -0,0 +1,54 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	stypes "github.com/KyleBrandon/scriptor/pkg/types"
+)
+
+func TestInsertFailedNotification(t *testing.T) {
+	tests := []struct {
+		name     string
+		response dynamoResponse
+		wantErr  error
+	}{
+		{name: "recorded", response: updated},
+		// the dead-letter queue delivered the message again
+		{name: "already recorded", response: conditionFailed, wantErr: ErrFailedNotificationExists},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			client, request := fakeDynamoDB(t, tc.response)
+			db := &FailedNotificationStoreContext{store: client}
+
+			err := db.InsertFailedNotification(
+				context.Background(),
+				&stypes.FailedNotification{MessageID: "message-1"},
+			)
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("unexpected error: got %v want %v", err, tc.wantErr)
+			}
+
+			if request.TableName != FAILED_NOTIFICATION_TABLE ||
+				request.ConditionExpression != "attribute_not_exists(message_id)" {
+				t.Fatalf("unexpected request: %+v", request)
+			}
+		})
+	}
+
+	t.Run("fails", func(t *testing.T) {
+		client, _ := fakeDynamoDB(t, validationFailed)
+		db := &FailedNotificationStoreContext{store: client}
+
+		err := db.InsertFailedNotification(
+			context.Background(),
+			&stypes.FailedNotification{MessageID: "message-1"},
+		)
+		if err == nil || errors.Is(err, ErrFailedNotificationExists) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+}
@@ -0,0 +1,148 @@
+package database
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	stypes "github.com/KyleBrandon/scriptor/pkg/types"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+func NewNotificationHistoryStore(ctx context.Context) (NotificationHistoryStore, error) {
+	store, err := newDynamoClient(ctx)
+	if err != nil {
+		slog.Error(
+			"Failed to configure the NotificationHistoryStoreContext",
+			"error",
+			err,
+		)
+		return nil, err
+	}
+
+	return NewNotificationHistoryStoreWithClient(store), nil
+}
+
+// NewNotificationHistoryStoreWithClient uses the client given instead of one
+// configured from the environment.
+func NewNotificationHistoryStoreWithClient(store dynamoAPI) NotificationHistoryStore {
+	return &NotificationHistoryStoreContext{
+		store,
+	}
+}
+
+func (db *NotificationHistoryStoreContext) InsertNotificationHistory(
+	ctx context.Context,
+	history *stypes.NotificationHistory,
+) error {
+	av, err := marshalMap(history)
+	if err != nil {
+		slog.Error("Failed to marshal the notification history", "error", err)
+		return err
+	}
+
+	_, err = db.store.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(NOTIFICATION_HISTORY_TABLE),
+		Item:      av,
+	})
+	if err != nil {
+		slog.Error(
+			"Failed to insert the notification history",
+			"notificationID",
+			history.NotificationID,
+			"error",
+			err,
+		)
+		return err
+	}
+
+	return nil
+}
+
+// RecordNotificationProcessed counts a delivery of the notification the SQS
+// handler processed. The documents it found are added to the ones earlier
+// deliveries found, and the reason it failed replaces the last one. A
+// delivery that succeeded clears the reason.
+func (db *NotificationHistoryStoreContext) RecordNotificationProcessed(
+	ctx context.Context,
+	notificationID string,
+	documentIDs []string,
+	reason string,
+) error {
+	update := "SET processed_at = :now, attempts = if_not_exists(attempts, :zero) + :one"
+	values := map[string]types.AttributeValue{
+		":now":  timestampValue(time.Now()),
+		":zero": &types.AttributeValueMemberN{Value: "0"},
+		":one":  &types.AttributeValueMemberN{Value: "1"},
+	}
+
+	if reason != "" {
+		update += ", last_error = :reason"
+		values[":reason"] = &types.AttributeValueMemberS{Value: reason}
+	}
+
+	// an empty set can't be stored
+	if len(documentIDs) > 0 {
+		update += " ADD documents_found :documents"
+		values[":documents"] = &types.AttributeValueMemberSS{Value: documentIDs}
+	}
+
+	if reason == "" {
+		update += " REMOVE last_error"
+	}
+
+	_, err := db.store.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(NOTIFICATION_HISTORY_TABLE),
+		Key: map[string]types.AttributeValue{
+			"notification_id": &types.AttributeValueMemberS{Value: notificationID},
+		},
+		UpdateExpression:          aws.String(update),
+		ExpressionAttributeValues: values,
+	})
+	if err != nil {
+		slog.Error(
+			"Failed to record the processing of the notification",
+			"notificationID",
+			notificationID,
+			"error",
+			err,
+		)
+		return err
+	}
+
+	return nil
+}
+
+// RecordNotificationExecution adds a workflow started for a document of the
+// notification
+func (db *NotificationHistoryStoreContext) RecordNotificationExecution(
+	ctx context.Context,
+	notificationID, executionName string,
+) error {
+	_, err := db.store.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(NOTIFICATION_HISTORY_TABLE),
+		Key: map[string]types.AttributeValue{
+			"notification_id": &types.AttributeValueMemberS{Value: notificationID},
+		},
+		UpdateExpression: aws.String("ADD executions_started :execution"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":execution": &types.AttributeValueMemberSS{Value: []string{executionName}},
+		},
+	})
+	if err != nil {
+		slog.Error(
+			"Failed to record the execution of the notification",
+			"notificationID",
+			notificationID,
+			"execution",
+			executionName,
+			"error",
+			err,
+		)
+		return err
+	}
+
+	return nil
+}
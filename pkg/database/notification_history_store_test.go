@@ -0,0 +1,105 @@
+package database
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestRecordNotificationProcessed(t *testing.T) {
+	tests := []struct {
+		name      string
+		documents []string
+		reason    string
+
+		wantUpdate string
+		wantValues map[string]map[string]any
+	}{
+		{
+			name:       "documents found",
+			documents:  []string{"doc-1", "doc-2"},
+			wantUpdate: "SET processed_at = :now, attempts = if_not_exists(attempts, :zero) + :one ADD documents_found :documents REMOVE last_error",
+			wantValues: map[string]map[string]any{
+				":documents": {"SS": []any{"doc-1", "doc-2"}},
+			},
+		},
+		{
+			name:       "nothing found",
+			wantUpdate: "SET processed_at = :now, attempts = if_not_exists(attempts, :zero) + :one REMOVE last_error",
+		},
+		{
+			name:       "failed",
+			documents:  []string{"doc-1"},
+			reason:     "drive unavailable",
+			wantUpdate: "SET processed_at = :now, attempts = if_not_exists(attempts, :zero) + :one, last_error = :reason ADD documents_found :documents",
+			wantValues: map[string]map[string]any{
+				":documents": {"SS": []any{"doc-1"}},
+				":reason":    {"S": "drive unavailable"},
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			client, request := fakeDynamoDB(t, updated)
+			db := &NotificationHistoryStoreContext{store: client}
+
+			err := db.RecordNotificationProcessed(
+				context.Background(),
+				"notification-1",
+				tc.documents,
+				tc.reason,
+			)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if request.TableName != NOTIFICATION_HISTORY_TABLE ||
+				request.Key["notification_id"]["S"] != "notification-1" {
+				t.Fatalf("unexpected item: %s %v", request.TableName, request.Key)
+			}
+
+			if request.UpdateExpression != tc.wantUpdate {
+				t.Fatalf("unexpected update:\ngot  %q\nwant %q", request.UpdateExpression, tc.wantUpdate)
+			}
+
+			// the time it was processed changes, the rest of the values don't
+			for _, name := range []string{":now", ":zero", ":one"} {
+				if _, ok := request.ExpressionAttributeValues[name]; !ok {
+					t.Fatalf("missing %s: %v", name, request.ExpressionAttributeValues)
+				}
+				delete(request.ExpressionAttributeValues, name)
+			}
+
+			values := request.ExpressionAttributeValues
+			if len(values) == 0 {
+				values = nil
+			}
+			if !reflect.DeepEqual(values, tc.wantValues) {
+				t.Fatalf("unexpected values:\ngot  %v\nwant %v", values, tc.wantValues)
+			}
+		})
+	}
+}
+
+func TestRecordNotificationExecution(t *testing.T) {
+	client, request := fakeDynamoDB(t, updated)
+	db := &NotificationHistoryStoreContext{store: client}
+
+	err := db.RecordNotificationExecution(context.Background(), "notification-1", "execution-1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	want := &updateRequest{
+		TableName:        NOTIFICATION_HISTORY_TABLE,
+		Key:              map[string]map[string]any{"notification_id": {"S": "notification-1"}},
+		UpdateExpression: "ADD executions_started :execution",
+		ExpressionAttributeValues: map[string]map[string]any{
+			":execution": {"SS": []any{"execution-1"}},
+		},
+	}
+	if !reflect.DeepEqual(request, want) {
+		t.Fatalf("unexpected request:\ngot  %+v\nwant %+v", request, want)
+	}
+}
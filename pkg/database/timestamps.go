@@ -0,0 +1,90 @@
+package database
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// Timestamps are stored one of two ways. The times people read, like
+// updated_at, are RFC 3339 strings in UTC with all nine digits of the
+// fraction, so they sort as text. The items are marshalled the same way, so
+// created_time can be compared with a range. Rows written before the
+// fraction was padded keep their shorter value. The times DynamoDB compares
+// or expires items by are numbers. The TTL attributes are Unix seconds,
+// which DynamoDB requires. The lock leases, the pending notifications and
+// the channel expirations are Unix milliseconds, the unit Google reports the
+// expiration of a channel in, and are only ever compared with each other.
+
+// RFC 3339 with the fraction padded to nanoseconds. time.RFC3339Nano trims
+// trailing zeros, which puts "05Z" after "05.5Z" when sorted as text.
+const timestampLayout = "2006-01-02T15:04:05.000000000Z07:00"
+
+// The layout of time.Time.String, the updated_at of the locks written before
+// the timestamps were standardized
+const legacyTimestampLayout = "2006-01-02 15:04:05.999999999 -0700 MST"
+
+// Values at or above this are Unix milliseconds rather than seconds. In
+// seconds it is the year 5138.
+const unixMilliThreshold = 100_000_000_000
+
+// The time as an RFC 3339 string in UTC
+func timestampValue(t time.Time) *types.AttributeValueMemberS {
+	return &types.AttributeValueMemberS{Value: t.UTC().Format(timestampLayout)}
+}
+
+// Write the times in items the same as timestampValue
+func encodeTimestamps(options *attributevalue.EncoderOptions) {
+	options.EncodeTime = func(t time.Time) (types.AttributeValue, error) {
+		return timestampValue(t), nil
+	}
+}
+
+// Marshal an item, with its times written by timestampValue
+func marshalMap(in any) (map[string]types.AttributeValue, error) {
+	return attributevalue.MarshalMapWithOptions(in, encodeTimestamps)
+}
+
+// Marshal a value, with its times written by timestampValue
+func marshalValue(in any) (types.AttributeValue, error) {
+	return attributevalue.MarshalWithOptions(in, encodeTimestamps)
+}
+
+// The time as Unix seconds, for the TTL attributes
+func ttlValue(t time.Time) *types.AttributeValueMemberN {
+	return &types.AttributeValueMemberN{Value: strconv.FormatInt(t.Unix(), 10)}
+}
+
+// The time as Unix milliseconds, for the leases and expirations
+func unixMilliValue(t time.Time) *types.AttributeValueMemberN {
+	return &types.AttributeValueMemberN{Value: strconv.FormatInt(t.UnixMilli(), 10)}
+}
+
+// ParseTimestamp reads a timestamp stored as text. Rows written before the
+// timestamps were standardized may have the format of time.Time.String, or
+// Unix seconds or milliseconds, and are read as well. The time is in UTC.
+func ParseTimestamp(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339Nano, value); err == nil {
+		return t.UTC(), nil
+	}
+
+	// the monotonic clock reading is only there when the time wasn't in UTC
+	legacy, _, _ := strings.Cut(value, " m=")
+	if t, err := time.Parse(legacyTimestampLayout, legacy); err == nil {
+		return t.UTC(), nil
+	}
+
+	if n, err := strconv.ParseInt(value, 10, 64); err == nil {
+		if n >= unixMilliThreshold {
+			return time.UnixMilli(n).UTC(), nil
+		}
+
+		return time.Unix(n, 0).UTC(), nil
+	}
+
+	return time.Time{}, fmt.Errorf("unknown timestamp format: %q", value)
+}
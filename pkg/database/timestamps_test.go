@@ -0,0 +1,234 @@
+package database
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	stypes "github.com/KyleBrandon/scriptor/pkg/types"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+func TestParseTimestamp(t *testing.T) {
+	want := time.Date(2025, 1, 2, 15, 4, 5, 999_000_000, time.UTC)
+
+	tests := []struct {
+		name    string
+		value   string
+		want    time.Time
+		wantErr bool
+	}{
+		{name: "RFC 3339", value: "2025-01-02T15:04:05.999Z", want: want},
+		{name: "RFC 3339 with an offset", value: "2025-01-02T10:04:05.999-05:00", want: want},
+		// the updated_at of the locks before the timestamps were standardized
+		{name: "time.String", value: "2025-01-02 15:04:05.999 +0000 UTC", want: want},
+		{
+			name:  "time.String with a monotonic reading",
+			value: "2025-01-02 15:04:05.999 +0000 UTC m=+0.000012345",
+			want:  want,
+		},
+		{name: "Unix seconds", value: "1735830245", want: want.Truncate(time.Second)},
+		{name: "Unix milliseconds", value: "1735830245999", want: want},
+		{name: "unknown", value: "yesterday", wantErr: true},
+		{name: "empty", value: "", wantErr: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := ParseTimestamp(tc.value)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if !got.Equal(tc.want) || (!tc.wantErr && got.Location() != time.UTC) {
+				t.Fatalf("unexpected time: got %v want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestTimestampRoundTrip(t *testing.T) {
+	// a time outside UTC, with more precision than milliseconds
+	at := time.Date(2025, 1, 2, 10, 4, 5, 999_999_999, time.FixedZone("EST", -5*60*60))
+
+	tests := []struct {
+		name  string
+		value string
+		want  time.Time
+	}{
+		{name: "timestamp", value: timestampValue(at).Value, want: at},
+		{name: "TTL", value: ttlValue(at).Value, want: at.Truncate(time.Second)},
+		{name: "Unix milliseconds", value: unixMilliValue(at).Value, want: at.Truncate(time.Millisecond)},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := ParseTimestamp(tc.value)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if !got.Equal(tc.want) {
+				t.Fatalf("unexpected time from %q: got %v want %v", tc.value, got, tc.want)
+			}
+		})
+	}
+
+	if value := timestampValue(at).Value; value != "2025-01-02T15:04:05.999999999Z" {
+		t.Fatalf("timestamp isn't RFC 3339 in UTC: %q", value)
+	}
+}
+
+// The timestamps sort as text in the order of the times, which the range on
+// created_time depends on
+func TestTimestampOrder(t *testing.T) {
+	at := time.Date(2025, 1, 2, 15, 4, 5, 0, time.UTC)
+
+	times := []time.Time{
+		at,
+		at.Add(time.Nanosecond),
+		at.Add(100 * time.Millisecond),
+		at.Add(500 * time.Millisecond),
+		at.Add(time.Second),
+		at.Add(time.Second + 10*time.Millisecond),
+	}
+
+	for i := 1; i < len(times); i++ {
+		earlier := timestampValue(times[i-1]).Value
+		later := timestampValue(times[i]).Value
+		if earlier >= later {
+			t.Fatalf("%q doesn't sort before %q", earlier, later)
+		}
+	}
+
+	// the items are marshalled with the same layout
+	item, err := marshalMap(struct {
+		CreatedTime time.Time `dynamodbav:"created_time"`
+	}{CreatedTime: at})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	value, _ := item["created_time"].(*types.AttributeValueMemberS)
+	if value == nil || value.Value != "2025-01-02T15:04:05.000000000Z" {
+		t.Fatalf("unexpected created_time: %v", item["created_time"])
+	}
+}
+
+// The timestamps each writer of the lock table saves
+func TestWatchChannelLockTimestamps(t *testing.T) {
+	tests := []struct {
+		name  string
+		write func(db *WatchChannelStoreContext) error
+
+		// the attributes written as RFC 3339, Unix seconds and Unix
+		// milliseconds, and how far they are from now
+		wantTimestamps []string
+		wantTTL        []string
+		wantMillis     map[string]time.Duration
+	}{
+		{
+			name: "create",
+			write: func(db *WatchChannelStoreContext) error {
+				return db.CreateWatchChannelLock(context.Background(), "channel-1", "token-1")
+			},
+			wantTimestamps: []string{":updatedAt"},
+			wantTTL:        []string{":expiresAt"},
+		},
+		{
+			name: "acquire",
+			write: func(db *WatchChannelStoreContext) error {
+				// the fake returns no start token
+				db.AcquireChangesToken(context.Background(), "channel-1")
+				return nil
+			},
+			wantTimestamps: []string{":updatedAt"},
+			wantTTL:        []string{":expiresAt"},
+			wantMillis:     map[string]time.Duration{":now": 0, ":leaseUntil": 30 * time.Second},
+		},
+		{
+			name: "clear",
+			write: func(db *WatchChannelStoreContext) error {
+				return db.ClearWatchChannelLock(context.Background(), "channel-1", "token-2")
+			},
+			wantTimestamps: []string{":updatedAt"},
+		},
+		{
+			name: "notification pending",
+			write: func(db *WatchChannelStoreContext) error {
+				return db.MarkNotificationPending(context.Background(), "channel-1", time.Now().Add(time.Minute))
+			},
+			wantMillis: map[string]time.Duration{":now": 0, ":until": time.Minute},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			client, request := fakeDynamoDB(t, updated)
+			db := &WatchChannelStoreContext{store: client}
+
+			before := time.Now().UTC()
+			if err := tc.write(db); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			after := time.Now().UTC()
+
+			// within the time of the write, at the precision of the unit
+			within := func(name string, got time.Time, offset, precision time.Duration) {
+				if got.Before(before.Add(offset).Truncate(precision)) || got.After(after.Add(offset)) {
+					t.Fatalf("unexpected %s: %v", name, got)
+				}
+			}
+
+			for _, name := range tc.wantTimestamps {
+				value, _ := request.ExpressionAttributeValues[name]["S"].(string)
+				got, err := time.Parse(time.RFC3339Nano, value)
+				if err != nil {
+					t.Fatalf("%s isn't RFC 3339: %q", name, value)
+				}
+				within(name, got, 0, 0)
+			}
+
+			for _, name := range tc.wantTTL {
+				value, _ := request.ExpressionAttributeValues[name]["N"].(string)
+				seconds, err := strconv.ParseInt(value, 10, 64)
+				if err != nil {
+					t.Fatalf("%s isn't a number: %q", name, value)
+				}
+				within(name, time.Unix(seconds, 0), WATCH_CHANNEL_LOCK_TTL, time.Second)
+			}
+
+			for name, offset := range tc.wantMillis {
+				value, _ := request.ExpressionAttributeValues[name]["N"].(string)
+				millis, err := strconv.ParseInt(value, 10, 64)
+				if err != nil {
+					t.Fatalf("%s isn't a number: %q", name, value)
+				}
+				within(name, time.UnixMilli(millis), offset, time.Millisecond)
+			}
+		})
+	}
+}
+
+// The times of a watch channel are marshalled by attributevalue, and are read
+// back the same as the ones written by hand
+func TestWatchChannelTimestamps(t *testing.T) {
+	client, request := fakeDynamoDB(t, updated)
+	db := &WatchChannelStoreContext{store: client}
+
+	before := time.Now().UTC()
+	wc := &stypes.WatchChannel{FolderID: "folder-1", CreatedAt: before.Add(-time.Hour)}
+	if err := db.UpdateWatchChannel(context.Background(), wc); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	attributes := updatedAttributes(request)
+	for name, want := range map[string]time.Time{"created_at": wc.CreatedAt, "updated_at": wc.UpdatedAt} {
+		value, _ := attributes[name]["S"].(string)
+		got, err := time.Parse(time.RFC3339Nano, value)
+		if err != nil || !got.Equal(want) {
+			t.Fatalf("unexpected %s: %q want %v", name, value, want)
+		}
+	}
+}
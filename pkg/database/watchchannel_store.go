@@ -9,14 +9,13 @@ import (
 
 	stypes "github.com/KyleBrandon/scriptor/pkg/types"
 	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
 )
 
 func NewWatchChannelStore(ctx context.Context) (WatchChannelStore, error) {
-	awsCfg, err := config.LoadDefaultConfig(ctx)
+	store, err := newDynamoClient(ctx)
 	if err != nil {
 		slog.Error(
 			"Failed to configure the WatchChannelStoreContext",
@@ -26,40 +25,170 @@ func NewWatchChannelStore(ctx context.Context) (WatchChannelStore, error) {
 		return nil, err
 	}
 
-	store := dynamodb.NewFromConfig(awsCfg)
+	return NewWatchChannelStoreWithClient(store), nil
+}
 
+// NewWatchChannelStoreWithClient uses the client given instead of one
+// configured from the environment.
+func NewWatchChannelStoreWithClient(store dynamoAPI) WatchChannelStore {
 	return &WatchChannelStoreContext{
 		store,
-	}, nil
+	}
 }
 
 func (db *WatchChannelStoreContext) GetWatchChannels(
 	ctx context.Context,
 ) ([]*stypes.WatchChannel, error) {
-	scanInput := &dynamodb.ScanInput{
+	return db.scanWatchChannels(ctx, &dynamodb.ScanInput{
 		TableName: aws.String(WATCH_CHANNEL_TABLE),
+	})
+}
+
+// GetWatchChannelsExpiringBefore returns the channels that expire before the
+// time, soonest first, along with the ones that were never registered. It
+// queries ExpiryIndex, which only has the channels saved since it was added.
+func (db *WatchChannelStoreContext) GetWatchChannelsExpiringBefore(
+	ctx context.Context,
+	before time.Time,
+) ([]*stypes.WatchChannel, error) {
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(WATCH_CHANNEL_TABLE),
+		IndexName:              aws.String("ExpiryIndex"),
+		KeyConditionExpression: aws.String("expiry_partition = :partition AND expires_at < :before"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":partition": &types.AttributeValueMemberS{Value: WATCH_CHANNEL_EXPIRY_PARTITION},
+			":before":    unixMilliValue(before),
+		},
 	}
 
-	// Execute Scan
-	result, err := db.store.Scan(ctx, scanInput)
-	if err != nil {
-		return nil, fmt.Errorf("failed to scan watch channels: %w", err)
+	results := make([]*stypes.WatchChannel, 0)
+
+	paginator := dynamodb.NewQueryPaginator(db.store, input)
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to query the expiring watch channels: %w", err)
+		}
+
+		var wcs []*stypes.WatchChannel
+		err = attributevalue.UnmarshalListOfMaps(page.Items, &wcs)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unmarshal DynamoDB items: %w", err)
+		}
+
+		results = append(results, wcs...)
 	}
 
-	// Convert DynamoDB result into a slice of WatchChannels
-	var wcs []stypes.WatchChannel
-	err = attributevalue.UnmarshalListOfMaps(result.Items, &wcs)
+	return results, nil
+}
+
+// HasWatchChannels reports whether any channel is registered. It reads a
+// single channel rather than all of them, from the table so the ones saved
+// before ExpiryIndex existed are counted.
+func (db *WatchChannelStoreContext) HasWatchChannels(ctx context.Context) (bool, error) {
+	result, err := db.store.Scan(ctx, &dynamodb.ScanInput{
+		TableName: aws.String(WATCH_CHANNEL_TABLE),
+		Limit:     aws.Int32(1),
+	})
 	if err != nil {
-		return nil, fmt.Errorf("failed to unmarshal DynamoDB items: %w", err)
+		return false, fmt.Errorf("failed to read the watch channels: %w", err)
 	}
 
+	return len(result.Items) > 0, nil
+}
+
+func (db *WatchChannelStoreContext) scanWatchChannels(
+	ctx context.Context,
+	input *dynamodb.ScanInput,
+) ([]*stypes.WatchChannel, error) {
+	// a scan returns at most 1 MB of items, the rest are on the next pages
 	results := make([]*stypes.WatchChannel, 0)
-	for _, wc := range wcs {
-		results = append(results, &wc)
+
+	paginator := dynamodb.NewScanPaginator(db.store, input)
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan watch channels: %w", err)
+		}
+
+		// each channel is unmarshaled into a value of its own
+		var wcs []*stypes.WatchChannel
+		err = attributevalue.UnmarshalListOfMaps(page.Items, &wcs)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unmarshal DynamoDB items: %w", err)
+		}
+
+		results = append(results, wcs...)
 	}
 
 	return results, nil
+}
+
+// GetWatchChannel returns the watch channel for the folder. The channel is
+// empty if the folder isn't watched.
+func (db *WatchChannelStoreContext) GetWatchChannel(
+	ctx context.Context,
+	folderID string,
+) (*stypes.WatchChannel, error) {
+	ret := &stypes.WatchChannel{}
+
+	getItemInput := &dynamodb.GetItemInput{
+		TableName: aws.String(WATCH_CHANNEL_TABLE),
+		Key: map[string]types.AttributeValue{
+			"folder_id": &types.AttributeValueMemberS{Value: folderID},
+		},
+	}
+
+	result, err := db.store.GetItem(ctx, getItemInput)
+	if err != nil {
+		slog.Error("Failed to query the watch channel", "error", err)
+		return ret, err
+	}
+
+	err = attributevalue.UnmarshalMap(result.Item, ret)
+	if err != nil {
+		slog.Error("Failed to unmarshal the watch channel", "error", err)
+		return ret, err
+	}
 
+	return ret, nil
+}
+
+// InsertWatchChannel saves the watch channel of a folder that isn't watched
+// yet. It fails with ErrWatchChannelExists when the folder already has one.
+func (db *WatchChannelStoreContext) InsertWatchChannel(
+	ctx context.Context,
+	watchChannel *stypes.WatchChannel,
+) error {
+	now := time.Now().UTC()
+	if watchChannel.CreatedAt.IsZero() {
+		watchChannel.CreatedAt = now
+	}
+	watchChannel.UpdatedAt = now
+	watchChannel.ExpiryPartition = WATCH_CHANNEL_EXPIRY_PARTITION
+
+	av, err := marshalMap(watchChannel)
+	if err != nil {
+		slog.Error("Failed to marshal the watch channel", "error", err)
+		return err
+	}
+
+	_, err = db.store.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:           aws.String(WATCH_CHANNEL_TABLE),
+		Item:                av,
+		ConditionExpression: aws.String("attribute_not_exists(folder_id)"),
+	})
+	if err != nil {
+		var ccfe *types.ConditionalCheckFailedException
+		if errors.As(err, &ccfe) {
+			return ErrWatchChannelExists
+		}
+
+		slog.Error("Failed to insert the watch channel", "folderID", watchChannel.FolderID, "error", err)
+		return err
+	}
+
+	return nil
 }
 
 func (db *WatchChannelStoreContext) UpdateWatchChannel(
@@ -68,19 +197,20 @@ func (db *WatchChannelStoreContext) UpdateWatchChannel(
 ) error {
 
 	watchChannel.UpdatedAt = time.Now().UTC()
+	watchChannel.ExpiryPartition = WATCH_CHANNEL_EXPIRY_PARTITION
 
 	// Define the primary key
 	key := map[string]types.AttributeValue{
 		"folder_id": &types.AttributeValueMemberS{Value: watchChannel.FolderID},
 	}
 
-	av, err := attributevalue.MarshalMap(watchChannel)
+	av, err := marshalMap(watchChannel)
 	if err != nil {
 		slog.Error("Failed to marshal the document", "error", err)
 		return err
 	}
 
-	updateExpression, expressionAttributeValues := buildUpdateExpression(
+	updateExpression, expressionAttributeNames, expressionAttributeValues := buildUpdateExpression(
 		av,
 		[]string{"folder_id"},
 	)
@@ -90,6 +220,7 @@ func (db *WatchChannelStoreContext) UpdateWatchChannel(
 		TableName:                 aws.String(WATCH_CHANNEL_TABLE),
 		Key:                       key,
 		UpdateExpression:          aws.String(updateExpression),
+		ExpressionAttributeNames:  expressionAttributeNames,
 		ExpressionAttributeValues: expressionAttributeValues,
 		ReturnValues:              types.ReturnValueUpdatedNew, // Return the updated attributes
 	}
@@ -104,6 +235,71 @@ func (db *WatchChannelStoreContext) UpdateWatchChannel(
 	return nil
 }
 
+// DeleteWatchChannel removes the watch channel of the folder. It fails with
+// ErrWatchChannelNotFound when the folder isn't watched.
+func (db *WatchChannelStoreContext) DeleteWatchChannel(ctx context.Context, folderID string) error {
+	_, err := db.store.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(WATCH_CHANNEL_TABLE),
+		Key: map[string]types.AttributeValue{
+			"folder_id": &types.AttributeValueMemberS{Value: folderID},
+		},
+		ConditionExpression: aws.String("attribute_exists(folder_id)"),
+	})
+	if err != nil {
+		var ccfe *types.ConditionalCheckFailedException
+		if errors.As(err, &ccfe) {
+			return ErrWatchChannelNotFound
+		}
+
+		slog.Error("Failed to delete the watch channel", "folderID", folderID, "error", err)
+		return err
+	}
+
+	return nil
+}
+
+// SetWatchChannelPaused pauses or resumes the watch channel of the folder.
+// Only the flag is written, so a run of the register lambda saving the
+// channel at the same time doesn't undo it. It fails with
+// ErrWatchChannelNotFound when the folder isn't watched.
+func (db *WatchChannelStoreContext) SetWatchChannelPaused(
+	ctx context.Context,
+	folderID string,
+	paused bool,
+) error {
+	_, err := db.store.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(WATCH_CHANNEL_TABLE),
+		Key: map[string]types.AttributeValue{
+			"folder_id": &types.AttributeValueMemberS{Value: folderID},
+		},
+		UpdateExpression:    aws.String("SET paused = :paused, updated_at = :updatedAt"),
+		ConditionExpression: aws.String("attribute_exists(folder_id)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":paused":    &types.AttributeValueMemberBOOL{Value: paused},
+			":updatedAt": timestampValue(time.Now()),
+		},
+	})
+	if err != nil {
+		var ccfe *types.ConditionalCheckFailedException
+		if errors.As(err, &ccfe) {
+			return ErrWatchChannelNotFound
+		}
+
+		slog.Error(
+			"Failed to set whether the watch channel is paused",
+			"folderID",
+			folderID,
+			"paused",
+			paused,
+			"error",
+			err,
+		)
+		return err
+	}
+
+	return nil
+}
+
 func (db *WatchChannelStoreContext) GetWatchChannelByID(
 	ctx context.Context,
 	channelID string,
@@ -123,7 +319,7 @@ func (db *WatchChannelStoreContext) GetWatchChannelByID(
 		return nil, err
 	}
 	if len(result.Items) == 0 {
-		return nil, fmt.Errorf("watch channel not found")
+		return nil, ErrWatchChannelNotFound
 	}
 
 	var wcs []stypes.WatchChannel
@@ -136,6 +332,8 @@ func (db *WatchChannelStoreContext) GetWatchChannelByID(
 	return &wcs[0], nil
 }
 
+// GetWatchChannelLock returns the lock of the channel, or
+// ErrWatchChannelLockNotFound when the channel has none.
 func (db *WatchChannelStoreContext) GetWatchChannelLock(
 	ctx context.Context,
 	channelID string,
@@ -168,6 +366,9 @@ func (db *WatchChannelStoreContext) GetWatchChannelLock(
 	return wc, nil
 }
 
+// CreateWatchChannelLock creates the unlocked lock of the channel with the
+// changes token to start from. An existing lock isn't replaced, so its token
+// isn't lost, and ErrWatchChannelLockExists is returned instead.
 func (db *WatchChannelStoreContext) CreateWatchChannelLock(
 	ctx context.Context,
 	channelID, startToken string,
@@ -180,17 +381,22 @@ func (db *WatchChannelStoreContext) CreateWatchChannelLock(
 			"channel_id": &types.AttributeValueMemberS{Value: channelID},
 		},
 		UpdateExpression: aws.String(
-			"SET locked = :false, changes_start_token = :token, updated_at = :updatedAt",
+			"SET locked = :false, changes_start_token = :token, updated_at = :updatedAt, expires_at = :expiresAt",
 		),
 		ExpressionAttributeValues: map[string]types.AttributeValue{
-			":false": &types.AttributeValueMemberBOOL{Value: false},
-			":token": &types.AttributeValueMemberS{Value: startToken},
-			":updatedAt": &types.AttributeValueMemberS{
-				Value: updatedAt.String(),
-			},
+			":false":     &types.AttributeValueMemberBOOL{Value: false},
+			":token":     &types.AttributeValueMemberS{Value: startToken},
+			":updatedAt": timestampValue(updatedAt),
+			":expiresAt": ttlValue(updatedAt.Add(WATCH_CHANNEL_LOCK_TTL)),
 		},
+		ConditionExpression: aws.String("attribute_not_exists(channel_id)"),
 	})
 	if err != nil {
+		var ccfe *types.ConditionalCheckFailedException
+		if errors.As(err, &ccfe) {
+			return ErrWatchChannelLockExists
+		}
+
 		slog.Error(
 			"Failed to create the changes token",
 			"channelID",
@@ -204,10 +410,42 @@ func (db *WatchChannelStoreContext) CreateWatchChannelLock(
 	return nil
 }
 
-func (db *WatchChannelStoreContext) DeleteWatchChannelLock(ctx context.Context, channelID string) error {
+// ListWatchChannelLocks returns the locks of every channel, including the
+// ones of channels that were replaced.
+func (db *WatchChannelStoreContext) ListWatchChannelLocks(
+	ctx context.Context,
+) ([]*stypes.WatchChannelLock, error) {
+	input := &dynamodb.ScanInput{
+		TableName: aws.String(WATCH_CHANNEL_LOCK_TABLE),
+	}
 
-	deleteItemInput := &dynamodb.DeleteItemInput{
+	locks := make([]*stypes.WatchChannelLock, 0)
+
+	paginator := dynamodb.NewScanPaginator(db.store, input)
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			slog.Error("Failed to scan the watch channel locks", "error", err)
+			return nil, err
+		}
 
+		var items []*stypes.WatchChannelLock
+		err = attributevalue.UnmarshalListOfMaps(page.Items, &items)
+		if err != nil {
+			slog.Error("Failed to unmarshal the watch channel locks", "error", err)
+			return nil, err
+		}
+
+		locks = append(locks, items...)
+	}
+
+	return locks, nil
+}
+
+// DeleteWatchChannelLock removes the lock of the channel. A channel without
+// a lock isn't an error, so the delete can be repeated.
+func (db *WatchChannelStoreContext) DeleteWatchChannelLock(ctx context.Context, channelID string) error {
+	deleteItemInput := &dynamodb.DeleteItemInput{
 		TableName: aws.String(WATCH_CHANNEL_LOCK_TABLE),
 		Key: map[string]types.AttributeValue{
 			"channel_id": &types.AttributeValueMemberS{Value: channelID},
@@ -223,6 +461,9 @@ func (db *WatchChannelStoreContext) DeleteWatchChannelLock(ctx context.Context,
 	return nil
 }
 
+// ClearWatchChannelLock unlocks the channel, moving its start token on when
+// a new one is given. It returns ErrWatchChannelLockNotFound when the channel
+// has no lock, rather than making a lock without a start token.
 func (db *WatchChannelStoreContext) ClearWatchChannelLock(
 	ctx context.Context,
 	channelID, newStartToken string,
@@ -234,16 +475,21 @@ func (db *WatchChannelStoreContext) ClearWatchChannelLock(
 			"channel_id": &types.AttributeValueMemberS{Value: channelID},
 		},
 		UpdateExpression: aws.String(
-			"SET locked = :false, LockExpires = :expires",
+			"SET locked = :false, lock_expires = :expires, updated_at = :updatedAt",
 		),
+		ConditionExpression: aws.String("attribute_exists(channel_id)"),
 		ExpressionAttributeValues: map[string]types.AttributeValue{
-			":false":   &types.AttributeValueMemberBOOL{Value: false},
-			":expires": &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", 0)},
+			":false":     &types.AttributeValueMemberBOOL{Value: false},
+			":expires":   &types.AttributeValueMemberN{Value: "0"},
+			":updatedAt": timestampValue(time.Now()),
 		},
 	}
 
 	// if we have a new start token then update it as well
 	if newStartToken != "" {
+		updateItemInput.UpdateExpression = aws.String(
+			"SET locked = :false, lock_expires = :expires, updated_at = :updatedAt, changes_start_token = :new_start_token",
+		)
 		updateItemInput.ExpressionAttributeValues[":new_start_token"] =
 			&types.AttributeValueMemberS{Value: newStartToken}
 	}
@@ -253,7 +499,7 @@ func (db *WatchChannelStoreContext) ClearWatchChannelLock(
 	if err != nil {
 		var ccfe *types.ConditionalCheckFailedException
 		if errors.As(err, &ccfe) {
-			return fmt.Errorf("lock is currently held")
+			return ErrWatchChannelLockNotFound
 		}
 
 		return err
@@ -262,39 +508,41 @@ func (db *WatchChannelStoreContext) ClearWatchChannelLock(
 	return nil
 }
 
+// AcquireChangesToken locks the changes of the channel and returns the start
+// token to query them from. It returns ErrWatchChannelLockHeld while another
+// notification holds the lock, and ErrWatchChannelLockNotFound when the
+// channel has no lock.
 func (db *WatchChannelStoreContext) AcquireChangesToken(
 	ctx context.Context,
 	channelID string,
 ) (string, error) {
 	updatedAt := time.Now().UTC()
-	now := updatedAt.UnixMilli()
-	leaseUntil := now + (30 * time.Second).Milliseconds()
+	leaseUntil := updatedAt.Add(30 * time.Second)
 
 	result, err := db.store.UpdateItem(ctx, &dynamodb.UpdateItemInput{
 		TableName: aws.String(WATCH_CHANNEL_LOCK_TABLE),
 		Key: map[string]types.AttributeValue{
 			"channel_id": &types.AttributeValueMemberS{Value: channelID},
 		},
+		// the lock of a channel in use is kept from expiring
 		UpdateExpression: aws.String(
-			"SET locked = :true, lock_expires = :leaseUntil, updated_at = :updatedAt",
+			"SET locked = :true, lock_expires = :leaseUntil, updated_at = :updatedAt, expires_at = :expiresAt",
 		),
 		ConditionExpression: aws.String(
 			"locked = :false OR lock_expires < :now",
 		),
 		ExpressionAttributeValues: map[string]types.AttributeValue{
-			":true":  &types.AttributeValueMemberBOOL{Value: true},
-			":false": &types.AttributeValueMemberBOOL{Value: false},
-			":now": &types.AttributeValueMemberN{
-				Value: fmt.Sprintf("%d", now),
-			},
-			":leaseUntil": &types.AttributeValueMemberN{
-				Value: fmt.Sprintf("%d", leaseUntil),
-			},
-			":updatedAt": &types.AttributeValueMemberS{
-				Value: updatedAt.String(),
-			},
+			":true":       &types.AttributeValueMemberBOOL{Value: true},
+			":false":      &types.AttributeValueMemberBOOL{Value: false},
+			":now":        unixMilliValue(updatedAt),
+			":leaseUntil": unixMilliValue(leaseUntil),
+			":updatedAt":  timestampValue(updatedAt),
+			":expiresAt":  ttlValue(updatedAt.Add(WATCH_CHANNEL_LOCK_TTL)),
 		},
 		ReturnValues: types.ReturnValueAllNew,
+		// a failed condition returns the lock, which is missing when the
+		// channel has none rather than when it is held
+		ReturnValuesOnConditionCheckFailure: types.ReturnValuesOnConditionCheckFailureAllOld,
 	})
 
 	if err != nil {
@@ -307,8 +555,11 @@ func (db *WatchChannelStoreContext) AcquireChangesToken(
 		)
 
 		var ccfe *types.ConditionalCheckFailedException
+		if errors.As(err, &ccfe) && len(ccfe.Item) == 0 {
+			return "", ErrWatchChannelLockNotFound
+		}
 		if errors.As(err, &ccfe) {
-			return "", fmt.Errorf("lock is currently held")
+			return "", ErrWatchChannelLockHeld
 		}
 
 		return "", err
@@ -322,6 +573,11 @@ func (db *WatchChannelStoreContext) AcquireChangesToken(
 	return "", fmt.Errorf("changes_start_token attribute not found or invalid")
 }
 
+// ReleaseChangesToken unlocks the changes of the channel. The start token is
+// advanced to the new start token, an empty token releases the lock and
+// keeps the start token so the same changes are queried again. A lock that
+// expired while it was held is gone and isn't made again, that's only
+// logged.
 func (db *WatchChannelStoreContext) ReleaseChangesToken(
 	ctx context.Context,
 	channelID, newStartToken string,
@@ -332,16 +588,18 @@ func (db *WatchChannelStoreContext) ReleaseChangesToken(
 		Key: map[string]types.AttributeValue{
 			"channel_id": &types.AttributeValueMemberS{Value: channelID},
 		},
-		UpdateExpression: aws.String(
-			"SET locked = :false, changes_start_token = :new_start_token",
-		),
+		UpdateExpression: aws.String("SET locked = :false"),
 		ExpressionAttributeValues: map[string]types.AttributeValue{
 			":false": &types.AttributeValueMemberBOOL{Value: false},
 		},
+		ConditionExpression: aws.String("attribute_exists(channel_id)"),
 	}
 
 	// if we have a new start token then update it as well
 	if newStartToken != "" {
+		updateItemInput.UpdateExpression = aws.String(
+			"SET locked = :false, changes_start_token = :new_start_token",
+		)
 		updateItemInput.ExpressionAttributeValues[":new_start_token"] =
 			&types.AttributeValueMemberS{Value: newStartToken}
 	}
@@ -351,9 +609,185 @@ func (db *WatchChannelStoreContext) ReleaseChangesToken(
 	if err != nil {
 		var ccfe *types.ConditionalCheckFailedException
 		if errors.As(err, &ccfe) {
-			return fmt.Errorf("lock is currently held")
+			slog.Warn(
+				"The watch channel lock was gone when it was released",
+				"channelID",
+				channelID,
+			)
+			return nil
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+// IncrementActiveExecutions counts an execution started for the channel. A
+// channel already running limit executions isn't counted and
+// ErrExecutionLimitReached is returned instead. The count is kept on the
+// channel's lock item.
+func (db *WatchChannelStoreContext) IncrementActiveExecutions(
+	ctx context.Context,
+	channelID string,
+	limit int,
+) error {
+	_, err := db.store.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(WATCH_CHANNEL_LOCK_TABLE),
+		Key: map[string]types.AttributeValue{
+			"channel_id": &types.AttributeValueMemberS{Value: channelID},
+		},
+		UpdateExpression: aws.String(
+			"SET active_executions = if_not_exists(active_executions, :zero) + :one",
+		),
+		ConditionExpression: aws.String(
+			"attribute_not_exists(active_executions) OR active_executions < :limit",
+		),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":zero":  &types.AttributeValueMemberN{Value: "0"},
+			":one":   &types.AttributeValueMemberN{Value: "1"},
+			":limit": &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", limit)},
+		},
+	})
+	if err != nil {
+		var ccfe *types.ConditionalCheckFailedException
+		if errors.As(err, &ccfe) {
+			return ErrExecutionLimitReached
+		}
+
+		slog.Error(
+			"Failed to count the execution of the channel",
+			"channelID",
+			channelID,
+			"error",
+			err,
+		)
+		return err
+	}
+
+	return nil
+}
+
+// DecrementActiveExecutions gives back an execution counted for the channel.
+// The count never goes below zero, a channel with nothing counted is left
+// alone.
+func (db *WatchChannelStoreContext) DecrementActiveExecutions(
+	ctx context.Context,
+	channelID string,
+) error {
+	_, err := db.store.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(WATCH_CHANNEL_LOCK_TABLE),
+		Key: map[string]types.AttributeValue{
+			"channel_id": &types.AttributeValueMemberS{Value: channelID},
+		},
+		UpdateExpression:    aws.String("SET active_executions = active_executions - :one"),
+		ConditionExpression: aws.String("active_executions > :zero"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":zero": &types.AttributeValueMemberN{Value: "0"},
+			":one":  &types.AttributeValueMemberN{Value: "1"},
+		},
+	})
+	if err != nil {
+		var ccfe *types.ConditionalCheckFailedException
+		if errors.As(err, &ccfe) {
+			slog.Warn(
+				"The channel had no executions counted to give back",
+				"channelID",
+				channelID,
+			)
+			return nil
+		}
+
+		slog.Error(
+			"Failed to give back the execution of the channel",
+			"channelID",
+			channelID,
+			"error",
+			err,
+		)
+		return err
+	}
+
+	return nil
+}
+
+// MarkNotificationPending records that a notification was queued for the
+// channel and is pending until the time given. Returns
+// ErrNotificationPending when another one already is, so a burst of webhook
+// requests only queues one notification, and ErrWatchChannelLockNotFound
+// when the channel has no lock to record it on.
+func (db *WatchChannelStoreContext) MarkNotificationPending(
+	ctx context.Context,
+	channelID string,
+	until time.Time,
+) error {
+	_, err := db.store.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(WATCH_CHANNEL_LOCK_TABLE),
+		Key: map[string]types.AttributeValue{
+			"channel_id": &types.AttributeValueMemberS{Value: channelID},
+		},
+		UpdateExpression: aws.String("SET notification_pending_until = :until"),
+		// a lock isn't made here, it would have no start token and keep
+		// the channel from getting its lock when it is registered
+		ConditionExpression: aws.String(
+			"attribute_exists(channel_id) AND (attribute_not_exists(notification_pending_until) OR notification_pending_until < :now)",
+		),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":until": unixMilliValue(until),
+			":now":   unixMilliValue(time.Now()),
+		},
+		ReturnValuesOnConditionCheckFailure: types.ReturnValuesOnConditionCheckFailureAllOld,
+	})
+	if err != nil {
+		var ccfe *types.ConditionalCheckFailedException
+		if errors.As(err, &ccfe) && len(ccfe.Item) == 0 {
+			return ErrWatchChannelLockNotFound
+		}
+		if errors.As(err, &ccfe) {
+			return ErrNotificationPending
 		}
 
+		slog.Error(
+			"Failed to mark the notification of the channel as pending",
+			"channelID",
+			channelID,
+			"error",
+			err,
+		)
+		return err
+	}
+
+	return nil
+}
+
+// ClearNotificationPending lets the webhook queue the next notification of
+// the channel, the pending one is being processed. Returns
+// ErrWatchChannelLockNotFound when the channel has no lock.
+func (db *WatchChannelStoreContext) ClearNotificationPending(
+	ctx context.Context,
+	channelID string,
+) error {
+	_, err := db.store.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(WATCH_CHANNEL_LOCK_TABLE),
+		Key: map[string]types.AttributeValue{
+			"channel_id": &types.AttributeValueMemberS{Value: channelID},
+		},
+		UpdateExpression:    aws.String("REMOVE notification_pending_until"),
+		ConditionExpression: aws.String("attribute_exists(channel_id)"),
+	})
+	if err != nil {
+		var ccfe *types.ConditionalCheckFailedException
+		if errors.As(err, &ccfe) {
+			return ErrWatchChannelLockNotFound
+		}
+
+		slog.Error(
+			"Failed to clear the pending notification of the channel",
+			"channelID",
+			channelID,
+			"error",
+			err,
+		)
 		return err
 	}
 
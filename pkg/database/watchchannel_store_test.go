@@ -0,0 +1,896 @@
+package database
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	stypes "github.com/KyleBrandon/scriptor/pkg/types"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+)
+
+// The parts of an UpdateItem or PutItem request the conditional writes are
+// made of
+type updateRequest struct {
+	TableName                 string
+	Key                       map[string]map[string]any
+	UpdateExpression          string
+	ConditionExpression       string
+	ExpressionAttributeValues map[string]map[string]any
+	ExpressionAttributeNames  map[string]string `json:",omitempty"`
+
+	// The item of a PutItem request
+	Item map[string]map[string]any `json:",omitempty"`
+
+	// The parts of a Query or Scan request
+	IndexName              string                    `json:",omitempty"`
+	KeyConditionExpression string                    `json:",omitempty"`
+	Limit                  int                       `json:",omitempty"`
+	ExclusiveStartKey      map[string]map[string]any `json:",omitempty"`
+}
+
+// How the fake DynamoDB answers, with the type of the error when it fails
+type dynamoResponse struct {
+	status    int
+	errorType string
+
+	// the item a failed condition returns
+	item map[string]any
+}
+
+// Responses the conditional updates are tested against
+var (
+	updated          = dynamoResponse{status: http.StatusOK}
+	conditionFailed  = dynamoResponse{status: http.StatusBadRequest, errorType: "ConditionalCheckFailedException"}
+	validationFailed = dynamoResponse{status: http.StatusBadRequest, errorType: "ValidationException"}
+	lockHeld         = dynamoResponse{
+		status:    http.StatusBadRequest,
+		errorType: "ConditionalCheckFailedException",
+		item: map[string]any{
+			"channel_id": map[string]any{"S": "channel-1"},
+			"locked":     map[string]any{"BOOL": true},
+		},
+	}
+	pendingLock = dynamoResponse{
+		status:    http.StatusBadRequest,
+		errorType: "ConditionalCheckFailedException",
+		item: map[string]any{
+			"channel_id":                 map[string]any{"S": "channel-1"},
+			"notification_pending_until": map[string]any{"N": "1773302400000"},
+		},
+	}
+)
+
+// A DynamoDB endpoint that records the UpdateItem request and answers it
+// with the response
+func fakeDynamoDB(t *testing.T, response dynamoResponse) (*dynamodb.Client, *updateRequest) {
+	t.Helper()
+
+	request := &updateRequest{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(request); err != nil {
+			t.Errorf("request is not JSON: %v", err)
+		}
+
+		w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+		w.WriteHeader(response.status)
+		if response.errorType != "" {
+			body := map[string]any{
+				"__type":  "com.amazonaws.dynamodb.v20120810#" + response.errorType,
+				"message": "failed",
+			}
+			if response.item != nil {
+				body["Item"] = response.item
+			}
+			json.NewEncoder(w).Encode(body)
+			return
+		}
+
+		w.Write([]byte("{}"))
+	}))
+	t.Cleanup(server.Close)
+
+	client := dynamodb.New(dynamodb.Options{
+		Region:           "us-east-1",
+		BaseEndpoint:     aws.String(server.URL),
+		Credentials:      aws.AnonymousCredentials{},
+		HTTPClient:       server.Client(),
+		RetryMaxAttempts: 1,
+	})
+
+	return client, request
+}
+
+func TestIncrementActiveExecutions(t *testing.T) {
+	tests := []struct {
+		name     string
+		response dynamoResponse
+		wantErr  error
+		anyErr   bool
+	}{
+		{name: "below the limit", response: updated},
+		{name: "at the limit", response: conditionFailed, wantErr: ErrExecutionLimitReached},
+		{name: "request fails", response: validationFailed, anyErr: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			client, request := fakeDynamoDB(t, tc.response)
+			db := &WatchChannelStoreContext{store: client}
+
+			err := db.IncrementActiveExecutions(context.Background(), "channel-1", 3)
+			switch {
+			case tc.wantErr != nil:
+				if !errors.Is(err, tc.wantErr) {
+					t.Fatalf("unexpected error: %v", err)
+				}
+			case tc.anyErr:
+				if err == nil || errors.Is(err, ErrExecutionLimitReached) {
+					t.Fatalf("unexpected error: %v", err)
+				}
+			case err != nil:
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			// the first execution of a channel starts the count, and the
+			// count is only raised while it is below the limit
+			want := &updateRequest{
+				TableName:           WATCH_CHANNEL_LOCK_TABLE,
+				Key:                 map[string]map[string]any{"channel_id": {"S": "channel-1"}},
+				UpdateExpression:    "SET active_executions = if_not_exists(active_executions, :zero) + :one",
+				ConditionExpression: "attribute_not_exists(active_executions) OR active_executions < :limit",
+				ExpressionAttributeValues: map[string]map[string]any{
+					":zero":  {"N": "0"},
+					":one":   {"N": "1"},
+					":limit": {"N": "3"},
+				},
+			}
+			if !reflect.DeepEqual(request, want) {
+				t.Fatalf("unexpected request:\ngot  %+v\nwant %+v", request, want)
+			}
+		})
+	}
+}
+
+func TestDecrementActiveExecutions(t *testing.T) {
+	tests := []struct {
+		name     string
+		response dynamoResponse
+		wantErr  bool
+	}{
+		{name: "execution counted", response: updated},
+		// nothing is counted, so the count isn't taken below zero
+		{name: "nothing counted", response: conditionFailed},
+		{name: "request fails", response: validationFailed, wantErr: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			client, request := fakeDynamoDB(t, tc.response)
+			db := &WatchChannelStoreContext{store: client}
+
+			err := db.DecrementActiveExecutions(context.Background(), "channel-1")
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			want := &updateRequest{
+				TableName:           WATCH_CHANNEL_LOCK_TABLE,
+				Key:                 map[string]map[string]any{"channel_id": {"S": "channel-1"}},
+				UpdateExpression:    "SET active_executions = active_executions - :one",
+				ConditionExpression: "active_executions > :zero",
+				ExpressionAttributeValues: map[string]map[string]any{
+					":zero": {"N": "0"},
+					":one":  {"N": "1"},
+				},
+			}
+			if !reflect.DeepEqual(request, want) {
+				t.Fatalf("unexpected request:\ngot  %+v\nwant %+v", request, want)
+			}
+		})
+	}
+}
+
+func TestMarkNotificationPending(t *testing.T) {
+	tests := []struct {
+		name     string
+		response dynamoResponse
+		wantErr  error
+		anyErr   bool
+	}{
+		{name: "nothing pending", response: updated},
+		{name: "already pending", response: pendingLock, wantErr: ErrNotificationPending},
+		{name: "no lock", response: conditionFailed, wantErr: ErrWatchChannelLockNotFound},
+		{name: "request fails", response: validationFailed, anyErr: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			client, request := fakeDynamoDB(t, tc.response)
+			db := &WatchChannelStoreContext{store: client}
+
+			until := time.UnixMilli(1773302400000)
+			err := db.MarkNotificationPending(context.Background(), "channel-1", until)
+			switch {
+			case tc.wantErr != nil:
+				if !errors.Is(err, tc.wantErr) {
+					t.Fatalf("unexpected error: %v", err)
+				}
+			case tc.anyErr:
+				if err == nil || errors.Is(err, ErrNotificationPending) {
+					t.Fatalf("unexpected error: %v", err)
+				}
+			case err != nil:
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			// the time it was marked at changes, the rest of the request
+			// doesn't
+			if _, ok := request.ExpressionAttributeValues[":now"]; !ok {
+				t.Fatalf("missing :now: %v", request.ExpressionAttributeValues)
+			}
+			delete(request.ExpressionAttributeValues, ":now")
+
+			// a pending notification that expired no longer holds back
+			// the next one
+			want := &updateRequest{
+				TableName:           WATCH_CHANNEL_LOCK_TABLE,
+				Key:                 map[string]map[string]any{"channel_id": {"S": "channel-1"}},
+				UpdateExpression:    "SET notification_pending_until = :until",
+				ConditionExpression: "attribute_exists(channel_id) AND (attribute_not_exists(notification_pending_until) OR notification_pending_until < :now)",
+				ExpressionAttributeValues: map[string]map[string]any{
+					":until": {"N": "1773302400000"},
+				},
+			}
+			if !reflect.DeepEqual(request, want) {
+				t.Fatalf("unexpected request:\ngot  %+v\nwant %+v", request, want)
+			}
+		})
+	}
+}
+
+func TestGetWatchChannelByIDNotFound(t *testing.T) {
+	tests := []struct {
+		name     string
+		response dynamoResponse
+		wantErr  error
+		anyErr   bool
+	}{
+		{name: "no channel", response: updated, wantErr: ErrWatchChannelNotFound},
+		{name: "request fails", response: validationFailed, anyErr: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			client, _ := fakeDynamoDB(t, tc.response)
+			db := &WatchChannelStoreContext{store: client}
+
+			_, err := db.GetWatchChannelByID(context.Background(), "channel-1")
+			if tc.wantErr != nil && !errors.Is(err, tc.wantErr) {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			// a failed lookup isn't mistaken for a channel that's gone
+			if tc.anyErr && (err == nil || errors.Is(err, ErrWatchChannelNotFound)) {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestGetWatchChannelLock(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+
+		want    *stypes.WatchChannelLock
+		wantErr error
+		anyErr  bool
+	}{
+		{
+			name: "lock",
+			body: `{"Item":{"channel_id":{"S":"channel-1"},"changes_start_token":{"S":"token-1"}}}`,
+			want: &stypes.WatchChannelLock{ChannelID: "channel-1", ChangesStartToken: "token-1"},
+		},
+		{name: "no lock", body: `{}`, wantErr: ErrWatchChannelLockNotFound},
+		{
+			name:   "request fails",
+			body:   `{"__type":"com.amazonaws.dynamodb.v20120810#ValidationException","message":"failed"}`,
+			anyErr: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			client, _ := fakeDynamoDBSequence(t, tc.body)
+			db := &WatchChannelStoreContext{store: client}
+
+			lock, err := db.GetWatchChannelLock(context.Background(), "channel-1")
+			switch {
+			case tc.wantErr != nil:
+				if !errors.Is(err, tc.wantErr) {
+					t.Fatalf("unexpected error: %v", err)
+				}
+			case tc.anyErr:
+				// a failed lookup isn't mistaken for a missing lock
+				if err == nil || errors.Is(err, ErrWatchChannelLockNotFound) {
+					t.Fatalf("unexpected error: %v", err)
+				}
+			case err != nil:
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if !reflect.DeepEqual(lock, tc.want) {
+				t.Fatalf("unexpected lock: got %+v want %+v", lock, tc.want)
+			}
+		})
+	}
+}
+
+func TestCreateWatchChannelLock(t *testing.T) {
+	tests := []struct {
+		name     string
+		response dynamoResponse
+		wantErr  error
+		anyErr   bool
+	}{
+		{name: "no lock", response: updated},
+		// the token of the existing lock isn't lost
+		{name: "lock exists", response: conditionFailed, wantErr: ErrWatchChannelLockExists},
+		{name: "request fails", response: validationFailed, anyErr: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			client, request := fakeDynamoDB(t, tc.response)
+			db := &WatchChannelStoreContext{store: client}
+
+			err := db.CreateWatchChannelLock(context.Background(), "channel-1", "token-1")
+			switch {
+			case tc.wantErr != nil:
+				if !errors.Is(err, tc.wantErr) {
+					t.Fatalf("unexpected error: %v", err)
+				}
+			case tc.anyErr:
+				if err == nil || errors.Is(err, ErrWatchChannelLockExists) {
+					t.Fatalf("unexpected error: %v", err)
+				}
+			case err != nil:
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if request.TableName != WATCH_CHANNEL_LOCK_TABLE ||
+				request.ConditionExpression != "attribute_not_exists(channel_id)" ||
+				request.ExpressionAttributeValues[":token"]["S"] != "token-1" ||
+				request.ExpressionAttributeValues[":false"]["BOOL"] != false {
+				t.Fatalf("unexpected request: %+v", request)
+			}
+		})
+	}
+}
+
+func TestDeleteWatchChannelLock(t *testing.T) {
+	// DynamoDB answers the delete of a missing lock like any other delete
+	client, request := fakeDynamoDB(t, updated)
+	db := &WatchChannelStoreContext{store: client}
+
+	for range 2 {
+		if err := db.DeleteWatchChannelLock(context.Background(), "channel-1"); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	want := &updateRequest{
+		TableName: WATCH_CHANNEL_LOCK_TABLE,
+		Key:       map[string]map[string]any{"channel_id": {"S": "channel-1"}},
+	}
+	if !reflect.DeepEqual(request, want) {
+		t.Fatalf("unexpected request:\ngot  %+v\nwant %+v", request, want)
+	}
+}
+
+func TestCreateWatchChannelLockExpires(t *testing.T) {
+	client, request := fakeDynamoDB(t, updated)
+	db := &WatchChannelStoreContext{store: client}
+
+	before := time.Now().UTC()
+	if err := db.CreateWatchChannelLock(context.Background(), "channel-1", "token-1"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// DynamoDB removes the lock once the TTL passes
+	value, ok := request.ExpressionAttributeValues[":expiresAt"]["N"].(string)
+	if !ok {
+		t.Fatalf("missing :expiresAt: %v", request.ExpressionAttributeValues)
+	}
+
+	expiresAt, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		t.Fatalf("unexpected :expiresAt %q: %v", value, err)
+	}
+
+	want := before.Add(WATCH_CHANNEL_LOCK_TTL).Unix()
+	if expiresAt < want || expiresAt > want+60 {
+		t.Fatalf("unexpected expiry: got %d want %d", expiresAt, want)
+	}
+}
+
+func TestAcquireChangesTokenRefreshesExpiry(t *testing.T) {
+	// the fake returns no attributes, only the request matters here
+	client, request := fakeDynamoDB(t, updated)
+	db := &WatchChannelStoreContext{store: client}
+
+	before := time.Now().UTC()
+	if _, err := db.AcquireChangesToken(context.Background(), "channel-1"); err == nil {
+		t.Fatal("expected an error without a start token")
+	}
+
+	value, ok := request.ExpressionAttributeValues[":expiresAt"]["N"].(string)
+	if !ok || !strings.Contains(request.UpdateExpression, "expires_at = :expiresAt") {
+		t.Fatalf("expiry not refreshed: %+v", request)
+	}
+
+	expiresAt, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		t.Fatalf("unexpected :expiresAt %q: %v", value, err)
+	}
+
+	want := before.Add(WATCH_CHANNEL_LOCK_TTL).Unix()
+	if expiresAt < want || expiresAt > want+60 {
+		t.Fatalf("unexpected expiry: got %d want %d", expiresAt, want)
+	}
+}
+
+func TestWatchChannelLockConditions(t *testing.T) {
+	acquire := func(db *WatchChannelStoreContext) error {
+		_, err := db.AcquireChangesToken(context.Background(), "channel-1")
+		return err
+	}
+	clear := func(db *WatchChannelStoreContext) error {
+		return db.ClearWatchChannelLock(context.Background(), "channel-1", "token-2")
+	}
+
+	tests := []struct {
+		name     string
+		write    func(db *WatchChannelStoreContext) error
+		response dynamoResponse
+		wantErr  error
+	}{
+		{name: "acquire held lock", write: acquire, response: lockHeld, wantErr: ErrWatchChannelLockHeld},
+		// a channel that was removed, or whose lock was never written
+		{name: "acquire missing lock", write: acquire, response: conditionFailed, wantErr: ErrWatchChannelLockNotFound},
+		{name: "clear missing lock", write: clear, response: conditionFailed, wantErr: ErrWatchChannelLockNotFound},
+		{
+			name: "clear pending notification of missing lock",
+			write: func(db *WatchChannelStoreContext) error {
+				return db.ClearNotificationPending(context.Background(), "channel-1")
+			},
+			response: conditionFailed,
+			wantErr:  ErrWatchChannelLockNotFound,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			client, request := fakeDynamoDB(t, tc.response)
+			db := &WatchChannelStoreContext{store: client}
+
+			if err := tc.write(db); !errors.Is(err, tc.wantErr) {
+				t.Fatalf("unexpected error: got %v want %v", err, tc.wantErr)
+			}
+
+			if request.ConditionExpression == "" {
+				t.Fatalf("update isn't conditional: %+v", request)
+			}
+		})
+	}
+}
+
+func TestReleaseChangesToken(t *testing.T) {
+	tests := []struct {
+		name     string
+		response dynamoResponse
+		wantErr  bool
+	}{
+		{name: "released", response: updated},
+		{name: "lock expired", response: conditionFailed},
+		{name: "request fails", response: validationFailed, wantErr: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			client, request := fakeDynamoDB(t, tc.response)
+			db := &WatchChannelStoreContext{store: client}
+
+			err := db.ReleaseChangesToken(context.Background(), "channel-1", "token-2")
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			// a lock that is gone isn't made again
+			if request.TableName != WATCH_CHANNEL_LOCK_TABLE ||
+				request.ConditionExpression != "attribute_exists(channel_id)" ||
+				request.ExpressionAttributeValues[":new_start_token"]["S"] != "token-2" {
+				t.Fatalf("unexpected request: %+v", request)
+			}
+		})
+	}
+}
+
+func TestListWatchChannelLocks(t *testing.T) {
+	// the locks are scanned a page at a time
+	pages := []string{
+		`{"Items":[{"channel_id":{"S":"channel-1"},"changes_start_token":{"S":"token-1"}}],
+		  "LastEvaluatedKey":{"channel_id":{"S":"channel-1"}}}`,
+		`{"Items":[{"channel_id":{"S":"channel-2"},"changes_start_token":{"S":"token-2"},"expires_at":{"N":"1773302400"}}]}`,
+	}
+
+	client, sequence := fakeDynamoDBSequence(t, pages...)
+	db := &WatchChannelStoreContext{store: client}
+
+	locks, err := db.ListWatchChannelLocks(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	checkScans(t, sequence, WATCH_CHANNEL_LOCK_TABLE, len(pages))
+
+	want := []*stypes.WatchChannelLock{
+		{ChannelID: "channel-1", ChangesStartToken: "token-1"},
+		{ChannelID: "channel-2", ChangesStartToken: "token-2", ExpiresAt: 1773302400},
+	}
+	if !reflect.DeepEqual(locks, want) {
+		t.Fatalf("unexpected locks: got %+v want %+v", locks, want)
+	}
+}
+
+// Every page of the table is scanned, each after the key the previous page
+// stopped at
+func checkScans(t *testing.T, sequence *dynamoSequence, table string, pages int) {
+	t.Helper()
+
+	if len(sequence.requests) != pages {
+		t.Fatalf("unexpected scans: %q", sequence.calls)
+	}
+
+	for i, input := range sequence.requests {
+		if sequence.calls[i] != "Scan "+table || (i > 0) != (input.ExclusiveStartKey != nil) {
+			t.Fatalf("unexpected scan %d: %s %+v", i, sequence.calls[i], input)
+		}
+	}
+}
+
+func TestGetWatchChannels(t *testing.T) {
+	// the channels are scanned a page at a time
+	pages := []string{
+		`{"Items":[{"folder_id":{"S":"folder-1"},"channel_id":{"S":"channel-1"}},
+		           {"folder_id":{"S":"folder-2"},"channel_id":{"S":"channel-2"}}],
+		  "LastEvaluatedKey":{"folder_id":{"S":"folder-2"}}}`,
+		`{"Items":[{"folder_id":{"S":"folder-3"},"channel_id":{"S":"channel-3"}}]}`,
+	}
+
+	client, sequence := fakeDynamoDBSequence(t, pages...)
+	db := &WatchChannelStoreContext{store: client}
+
+	wcs, err := db.GetWatchChannels(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	checkScans(t, sequence, WATCH_CHANNEL_TABLE, len(pages))
+
+	want := []*stypes.WatchChannel{
+		{FolderID: "folder-1", ChannelID: "channel-1"},
+		{FolderID: "folder-2", ChannelID: "channel-2"},
+		{FolderID: "folder-3", ChannelID: "channel-3"},
+	}
+	if !reflect.DeepEqual(wcs, want) {
+		t.Fatalf("unexpected channels: got %+v want %+v", wcs, want)
+	}
+
+	// every channel has a value of its own
+	if wcs[0] == wcs[1] || wcs[1] == wcs[2] {
+		t.Fatalf("the channels share a pointer: %p %p %p", wcs[0], wcs[1], wcs[2])
+	}
+}
+
+func TestGetWatchChannelsExpiringBefore(t *testing.T) {
+	before := time.UnixMilli(1_700_000_000_000)
+
+	// the index only has the channels that expire before the time in the
+	// pages, soonest first, and the ones never registered expire at 0
+	pages := []string{
+		`{"Items":[{"folder_id":{"S":"folder-3"},"expires_at":{"N":"0"}}],
+		  "LastEvaluatedKey":{"folder_id":{"S":"folder-3"},"expiry_partition":{"S":"watch_channels"},"expires_at":{"N":"0"}}}`,
+		`{"Items":[{"folder_id":{"S":"folder-1"},"channel_id":{"S":"channel-1"},"expires_at":{"N":"1699999999000"}}]}`,
+	}
+
+	client, sequence := fakeDynamoDBSequence(t, pages...)
+	db := &WatchChannelStoreContext{store: client}
+
+	wcs, err := db.GetWatchChannelsExpiringBefore(context.Background(), before)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for i, input := range sequence.requests {
+		if sequence.calls[i] != "Query "+WATCH_CHANNEL_TABLE ||
+			input.IndexName != "ExpiryIndex" ||
+			input.KeyConditionExpression != "expiry_partition = :partition AND expires_at < :before" ||
+			input.ExpressionAttributeValues[":partition"]["S"] != WATCH_CHANNEL_EXPIRY_PARTITION ||
+			input.ExpressionAttributeValues[":before"]["N"] != "1700000000000" ||
+			(i > 0) != (input.ExclusiveStartKey != nil) {
+			t.Fatalf("unexpected query %d: %+v", i, input)
+		}
+	}
+	queries := len(sequence.requests)
+
+	want := []*stypes.WatchChannel{
+		{FolderID: "folder-3"},
+		{FolderID: "folder-1", ChannelID: "channel-1", ExpiresAt: 1_699_999_999_000},
+	}
+	if !reflect.DeepEqual(wcs, want) || queries != 2 {
+		t.Fatalf("unexpected channels after %d queries: got %+v want %+v", queries, wcs, want)
+	}
+}
+
+func TestHasWatchChannels(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want bool
+	}{
+		{name: "channels", body: `{"Items":[{"folder_id":{"S":"folder-1"}}],"Count":1}`, want: true},
+		{name: "no channels", body: `{"Items":[],"Count":0}`},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			client, sequence := fakeDynamoDBSequence(t, tc.body)
+			db := &WatchChannelStoreContext{store: client}
+
+			got, err := db.HasWatchChannels(context.Background())
+			if err != nil || got != tc.want {
+				t.Fatalf("unexpected result: got %v, %v want %v", got, err, tc.want)
+			}
+
+			// only one channel of the table is read
+			input := sequence.requests[0]
+			if sequence.calls[0] != "Scan "+WATCH_CHANNEL_TABLE || input.IndexName != "" || input.Limit != 1 {
+				t.Fatalf("unexpected read: %s %+v", sequence.calls[0], input)
+			}
+		})
+	}
+}
+
+// Every channel saved is put in ExpiryIndex
+func TestWatchChannelExpiryPartition(t *testing.T) {
+	tests := []struct {
+		name  string
+		write func(db *WatchChannelStoreContext, wc *stypes.WatchChannel) error
+	}{
+		{
+			name: "insert",
+			write: func(db *WatchChannelStoreContext, wc *stypes.WatchChannel) error {
+				return db.InsertWatchChannel(context.Background(), wc)
+			},
+		},
+		{
+			name: "update",
+			write: func(db *WatchChannelStoreContext, wc *stypes.WatchChannel) error {
+				return db.UpdateWatchChannel(context.Background(), wc)
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			client, request := fakeDynamoDB(t, updated)
+			db := &WatchChannelStoreContext{store: client}
+
+			// never registered, it expires at 0 so it's found as expired
+			wc := &stypes.WatchChannel{FolderID: "folder-1"}
+			if err := tc.write(db, wc); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			attributes := request.Item
+			if attributes == nil {
+				attributes = updatedAttributes(request)
+			}
+			if attributes["expiry_partition"]["S"] != WATCH_CHANNEL_EXPIRY_PARTITION ||
+				attributes["expires_at"]["N"] != "0" {
+				t.Fatalf("not in the expiry index: %+v", attributes)
+			}
+		})
+	}
+}
+
+func TestInsertWatchChannel(t *testing.T) {
+	tests := []struct {
+		name     string
+		response dynamoResponse
+		wantErr  error
+		anyErr   bool
+	}{
+		{name: "new folder", response: updated},
+		{name: "folder exists", response: conditionFailed, wantErr: ErrWatchChannelExists},
+		{name: "request fails", response: validationFailed, anyErr: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			client, request := fakeDynamoDB(t, tc.response)
+			db := &WatchChannelStoreContext{store: client}
+
+			wc := &stypes.WatchChannel{FolderID: "folder-1", ChannelID: "channel-1"}
+			err := db.InsertWatchChannel(context.Background(), wc)
+			switch {
+			case tc.wantErr != nil:
+				if !errors.Is(err, tc.wantErr) {
+					t.Fatalf("unexpected error: %v", err)
+				}
+			case tc.anyErr:
+				if err == nil || errors.Is(err, ErrWatchChannelExists) {
+					t.Fatalf("unexpected error: %v", err)
+				}
+			case err != nil:
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			// a folder that is already watched isn't overwritten
+			if request.TableName != WATCH_CHANNEL_TABLE ||
+				request.ConditionExpression != "attribute_not_exists(folder_id)" {
+				t.Fatalf("unexpected request: %+v", request)
+			}
+
+			if wc.CreatedAt.IsZero() || !wc.UpdatedAt.Equal(wc.CreatedAt) {
+				t.Fatalf("unexpected timestamps: created %v updated %v", wc.CreatedAt, wc.UpdatedAt)
+			}
+
+			createdAt := timestampValue(wc.CreatedAt).Value
+			if request.Item["folder_id"]["S"] != "folder-1" ||
+				request.Item["created_at"]["S"] != createdAt ||
+				request.Item["updated_at"]["S"] != createdAt {
+				t.Fatalf("unexpected item: %v", request.Item)
+			}
+		})
+	}
+}
+
+func TestUpdateWatchChannelKeepsCreatedAt(t *testing.T) {
+	client, request := fakeDynamoDB(t, updated)
+	db := &WatchChannelStoreContext{store: client}
+
+	createdAt := time.Date(2026, 10, 1, 8, 0, 0, 0, time.UTC)
+	wc := &stypes.WatchChannel{FolderID: "folder-1", ChannelID: "channel-1", CreatedAt: createdAt}
+	if err := db.UpdateWatchChannel(context.Background(), wc); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if !wc.UpdatedAt.After(createdAt) {
+		t.Fatalf("unexpected updated at: %v", wc.UpdatedAt)
+	}
+
+	// the attributes are set by name, keyed by the folder
+	values := make(map[string]map[string]any)
+	for name, attribute := range request.ExpressionAttributeNames {
+		values[attribute] = request.ExpressionAttributeValues[":val"+name[len("#attr"):]]
+	}
+
+	if request.Key["folder_id"]["S"] != "folder-1" || values["folder_id"] != nil {
+		t.Fatalf("unexpected key: %v", request.Key)
+	}
+
+	if values["created_at"]["S"] != timestampValue(createdAt).Value ||
+		values["updated_at"]["S"] != timestampValue(wc.UpdatedAt).Value {
+		t.Fatalf("unexpected timestamps: %v", values)
+	}
+}
+
+func TestDeleteWatchChannel(t *testing.T) {
+	tests := []struct {
+		name     string
+		response dynamoResponse
+		wantErr  error
+		anyErr   bool
+	}{
+		{name: "folder watched", response: updated},
+		{name: "folder not watched", response: conditionFailed, wantErr: ErrWatchChannelNotFound},
+		{name: "request fails", response: validationFailed, anyErr: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			client, request := fakeDynamoDB(t, tc.response)
+			db := &WatchChannelStoreContext{store: client}
+
+			err := db.DeleteWatchChannel(context.Background(), "folder-1")
+			switch {
+			case tc.wantErr != nil:
+				if !errors.Is(err, tc.wantErr) {
+					t.Fatalf("unexpected error: %v", err)
+				}
+			case tc.anyErr:
+				if err == nil || errors.Is(err, ErrWatchChannelNotFound) {
+					t.Fatalf("unexpected error: %v", err)
+				}
+			case err != nil:
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			want := &updateRequest{
+				TableName:           WATCH_CHANNEL_TABLE,
+				Key:                 map[string]map[string]any{"folder_id": {"S": "folder-1"}},
+				ConditionExpression: "attribute_exists(folder_id)",
+			}
+			if !reflect.DeepEqual(request, want) {
+				t.Fatalf("unexpected request:\ngot  %+v\nwant %+v", request, want)
+			}
+		})
+	}
+}
+
+func TestSetWatchChannelPaused(t *testing.T) {
+	tests := []struct {
+		name     string
+		paused   bool
+		response dynamoResponse
+		wantErr  error
+		anyErr   bool
+	}{
+		{name: "pause", paused: true, response: updated},
+		{name: "resume", paused: false, response: updated},
+		{name: "folder not watched", paused: true, response: conditionFailed, wantErr: ErrWatchChannelNotFound},
+		{name: "request fails", paused: true, response: validationFailed, anyErr: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			client, request := fakeDynamoDB(t, tc.response)
+			db := &WatchChannelStoreContext{store: client}
+
+			err := db.SetWatchChannelPaused(context.Background(), "folder-1", tc.paused)
+			switch {
+			case tc.wantErr != nil:
+				if !errors.Is(err, tc.wantErr) {
+					t.Fatalf("unexpected error: %v", err)
+				}
+			case tc.anyErr:
+				if err == nil || errors.Is(err, ErrWatchChannelNotFound) {
+					t.Fatalf("unexpected error: %v", err)
+				}
+			case err != nil:
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			// the time it was set at changes, the rest of the request
+			// doesn't
+			if _, ok := request.ExpressionAttributeValues[":updatedAt"]; !ok {
+				t.Fatalf("missing :updatedAt: %v", request.ExpressionAttributeValues)
+			}
+			delete(request.ExpressionAttributeValues, ":updatedAt")
+
+			want := &updateRequest{
+				TableName:           WATCH_CHANNEL_TABLE,
+				Key:                 map[string]map[string]any{"folder_id": {"S": "folder-1"}},
+				UpdateExpression:    "SET paused = :paused, updated_at = :updatedAt",
+				ConditionExpression: "attribute_exists(folder_id)",
+				ExpressionAttributeValues: map[string]map[string]any{
+					":paused": {"BOOL": tc.paused},
+				},
+			}
+			if !reflect.DeepEqual(request, want) {
+				t.Fatalf("unexpected request:\ngot  %+v\nwant %+v", request, want)
+			}
+		})
+	}
+}
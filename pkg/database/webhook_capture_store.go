@@ -0,0 +1,103 @@
+package database
+
+import (
+	"context"
+	"log/slog"
+
+	stypes "github.com/KyleBrandon/scriptor/pkg/types"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+func NewWebhookCaptureStore(ctx context.Context) (WebhookCaptureStore, error) {
+	store, err := newDynamoClient(ctx)
+	if err != nil {
+		slog.Error(
+			"Failed to configure the WebhookCaptureStoreContext",
+			"error",
+			err,
+		)
+		return nil, err
+	}
+
+	return NewWebhookCaptureStoreWithClient(store), nil
+}
+
+// NewWebhookCaptureStoreWithClient uses the client given instead of one
+// configured from the environment.
+func NewWebhookCaptureStoreWithClient(store dynamoAPI) WebhookCaptureStore {
+	return &WebhookCaptureStoreContext{
+		store,
+	}
+}
+
+func (db *WebhookCaptureStoreContext) InsertWebhookCapture(
+	ctx context.Context,
+	capture *stypes.WebhookCapture,
+) error {
+	av, err := marshalMap(capture)
+	if err != nil {
+		slog.Error("Failed to marshal the webhook capture", "error", err)
+		return err
+	}
+
+	_, err = db.store.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(WEBHOOK_CAPTURE_TABLE),
+		Item:      av,
+	})
+	if err != nil {
+		slog.Error("Failed to insert the webhook capture", "error", err)
+		return err
+	}
+
+	return nil
+}
+
+// ListWebhookCaptures returns a page of the captures for the channel, newest
+// first. The cursor is the capture time of the last capture on the previous
+// page.
+func (db *WebhookCaptureStoreContext) ListWebhookCaptures(
+	ctx context.Context,
+	channelID string,
+	limit int32,
+	cursor string,
+) ([]*stypes.WebhookCapture, string, error) {
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(WEBHOOK_CAPTURE_TABLE),
+		KeyConditionExpression: aws.String("channel_id = :channelID"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":channelID": &types.AttributeValueMemberS{Value: channelID},
+		},
+		ScanIndexForward: aws.Bool(false),
+		Limit:            aws.Int32(limit),
+	}
+
+	if cursor != "" {
+		input.ExclusiveStartKey = map[string]types.AttributeValue{
+			"channel_id":  &types.AttributeValueMemberS{Value: channelID},
+			"captured_at": &types.AttributeValueMemberS{Value: cursor},
+		}
+	}
+
+	result, err := db.store.Query(ctx, input)
+	if err != nil {
+		slog.Error("Failed to query the webhook captures", "error", err)
+		return nil, "", err
+	}
+
+	var captures []*stypes.WebhookCapture
+	err = attributevalue.UnmarshalListOfMaps(result.Items, &captures)
+	if err != nil {
+		slog.Error("Failed to unmarshal the webhook captures", "error", err)
+		return nil, "", err
+	}
+
+	next := ""
+	if capturedAt, ok := result.LastEvaluatedKey["captured_at"].(*types.AttributeValueMemberS); ok {
+		next = capturedAt.Value
+	}
+
+	return captures, next, nil
+}
@@ -0,0 +1,298 @@
+package errorsmap
+
+import (
+	"net/http"
+
+	"github.com/KyleBrandon/scriptor/pkg/database"
+	"github.com/KyleBrandon/scriptor/pkg/google"
+	"google.golang.org/api/googleapi"
+)
+
+const (
+	//
+	// Error codes stored with a failed stage
+	//
+
+	CODE_UNKNOWN                      = "unknown"
+	CODE_DOCUMENT_NOT_FOUND           = "document_not_found"
+	CODE_DOCUMENT_EXISTS              = "document_exists"
+	CODE_DOCUMENT_TOO_LARGE           = "document_too_large"
+	CODE_STAGE_NOT_FOUND              = "stage_not_found"
+	CODE_SOURCE_MISSING               = "source_missing"
+	CODE_WATCH_CHANNEL_LOCK_NOT_FOUND = "watch_channel_lock_not_found"
+	CODE_WATCH_CHANNEL_LOCK_EXISTS    = "watch_channel_lock_exists"
+	CODE_WATCH_CHANNEL_LOCK_HELD      = "watch_channel_lock_held"
+	CODE_WATCH_CHANNEL_NOT_FOUND      = "watch_channel_not_found"
+	CODE_WATCH_CHANNEL_EXISTS         = "watch_channel_exists"
+	CODE_EXECUTION_LIMIT_REACHED      = "execution_limit_reached"
+	CODE_FAILED_NOTIFICATION_EXISTS   = "failed_notification_exists"
+	CODE_NOTIFICATION_PENDING         = "notification_pending"
+	CODE_FOLDER_LOOP                  = "folder_loop"
+	CODE_FOLDER_NOT_FOUND             = "folder_not_found"
+	CODE_FOLDER_NOT_WRITABLE          = "folder_not_writable"
+	CODE_FILE_GONE                    = "file_gone"
+	CODE_DRIVE_ACCESS_DENIED          = "drive_access_denied"
+	CODE_DRIVE_DELEGATION_FAILED      = "drive_delegation_failed"
+	CODE_DRIVE_NOT_FOUND              = "drive_not_found"
+	CODE_DRIVE_UNAVAILABLE            = "drive_unavailable"
+	CODE_PUBLISHED_NOTE_MISMATCH      = "published_note_mismatch"
+)
+
+type (
+	// Explanation is the human readable description of a failure along with
+	// what can be done about it.
+	Explanation struct {
+		Code             string `json:"code"`
+		Summary          string `json:"summary"`
+		Remediation      string `json:"remediation"`
+		TechnicalDetails string `json:"technical_details,omitempty"`
+	}
+
+	entry struct {
+		code        string
+		summary     string
+		remediation string
+
+		// match reports whether a single error in the chain is this failure.
+		// Entries without a matcher are only recorded by code.
+		match func(err error) bool
+	}
+)
+
+var (
+	unknown = entry{
+		code:        CODE_UNKNOWN,
+		summary:     "Something unexpected went wrong while processing the document.",
+		remediation: "Press Retry. If it fails again, share the technical details with whoever runs Scriptor.",
+	}
+
+	// Ordered so that the more specific entries are checked first when a
+	// single error matches more than one.
+	entries = []entry{
+		{
+			code:        CODE_DOCUMENT_NOT_FOUND,
+			summary:     "Scriptor has no record of this document.",
+			remediation: "The document may have been removed. Add the file to the watch folder again to reprocess it.",
+			match:       is(database.ErrDocumentNotFound),
+		},
+		{
+			code:        CODE_DOCUMENT_EXISTS,
+			summary:     "Scriptor already has a record of this revision of the document.",
+			remediation: "Nothing needs to be done, the revision is already being processed.",
+			match:       is(database.ErrDocumentExists),
+		},
+		{
+			code:        CODE_STAGE_NOT_FOUND,
+			summary:     "Scriptor has no record of a stage the document needed to have finished.",
+			remediation: "Press Retry to run the workflow again from the start.",
+			match:       is(database.ErrStageNotFound),
+		},
+		{
+			code:        CODE_DOCUMENT_TOO_LARGE,
+			summary:     "The document is larger than Scriptor is configured to process.",
+			remediation: "Split the document into smaller files, or raise MAX_DOCUMENT_SIZE_MB, and add it to the watch folder again.",
+		},
+		{
+			code:        CODE_SOURCE_MISSING,
+			summary:     "The file was deleted or moved out of the watch folder before Scriptor could download it.",
+			remediation: "Nothing needs to be done. If it was removed by mistake, add the file to the watch folder again.",
+		},
+		{
+			code:        CODE_WATCH_CHANNEL_LOCK_NOT_FOUND,
+			summary:     "The watch folder is not fully registered with Scriptor.",
+			remediation: "Wait for the daily registration to run, or run the register lambda manually, then press Retry.",
+			match:       is(database.ErrWatchChannelLockNotFound),
+		},
+		{
+			code:        CODE_WATCH_CHANNEL_LOCK_EXISTS,
+			summary:     "The watch channel already had its changes token saved.",
+			remediation: "Nothing needs to be done, the saved token is kept so no changes are missed.",
+			match:       is(database.ErrWatchChannelLockExists),
+		},
+		{
+			code:        CODE_WATCH_CHANNEL_LOCK_HELD,
+			summary:     "Another notification for the watch folder was querying its changes at the same time.",
+			remediation: "Nothing needs to be done, the notification is delivered again once the other one finishes.",
+			match:       is(database.ErrWatchChannelLockHeld),
+		},
+		{
+			code:        CODE_WATCH_CHANNEL_NOT_FOUND,
+			summary:     "The watch channel is no longer registered with Scriptor.",
+			remediation: "The channel was replaced when the folder was registered again. Nothing needs to be done, notifications come from the new channel.",
+			match:       is(database.ErrWatchChannelNotFound),
+		},
+		{
+			code:        CODE_WATCH_CHANNEL_EXISTS,
+			summary:     "The watch folder was already registered with Scriptor.",
+			remediation: "Nothing needs to be done, the folder is registered again on the next run.",
+			match:       is(database.ErrWatchChannelExists),
+		},
+		{
+			code:        CODE_EXECUTION_LIMIT_REACHED,
+			summary:     "The watch folder is already processing as many documents as its channel allows.",
+			remediation: "Nothing needs to be done, the document starts once one of the others finishes. Raise max_concurrent_executions on the watch channel to process more at once.",
+			match:       is(database.ErrExecutionLimitReached),
+		},
+		{
+			code:        CODE_FAILED_NOTIFICATION_EXISTS,
+			summary:     "The notification that failed was already recorded from the dead-letter queue.",
+			remediation: "Nothing needs to be done, the alert for it was already sent.",
+			match:       is(database.ErrFailedNotificationExists),
+		},
+		{
+			code:        CODE_NOTIFICATION_PENDING,
+			summary:     "A notification for the watch folder is already queued and will pick up this change.",
+			remediation: "Nothing needs to be done, the queued notification queries every change since the last one.",
+			match:       is(database.ErrNotificationPending),
+		},
+		{
+			code:        CODE_FOLDER_LOOP,
+			summary:     "The destination or archive folder is the folder Scriptor watches, so outputs would be processed again.",
+			remediation: "Choose destination and archive folders outside of the watch folder.",
+			match:       is(google.ErrFolderLoop),
+		},
+		{
+			code:        CODE_FOLDER_NOT_FOUND,
+			summary:     "A folder of the watch channel isn't a folder in Google Drive, isn't shared with the service account, or is in the trash.",
+			remediation: "Check the folder IDs and that the folders are shared with the Scriptor service account.",
+			match:       is(google.ErrFolderNotFound),
+		},
+		{
+			code:        CODE_FOLDER_NOT_WRITABLE,
+			summary:     "The Google service account can't add files to an archive or destination folder of the watch channel.",
+			remediation: "Share the folder with the Scriptor service account as an editor.",
+			match:       is(google.ErrFolderNotWritable),
+		},
+		{
+			code:        CODE_FILE_GONE,
+			summary:     "The original was deleted, or moved where the service account can't see it, before Scriptor could archive it.",
+			remediation: "Nothing needs to be done, there is nothing left to archive. If it was removed by mistake, restore it and move it to the archive folder.",
+			match:       is(google.ErrFileGone),
+		},
+		{
+			code:        CODE_DRIVE_DELEGATION_FAILED,
+			summary:     "The Google service account isn't allowed to act as the user set as impersonate_subject.",
+			remediation: "Allow the service account's client ID the Drive scope under domain-wide delegation in the Workspace admin console, or remove impersonate_subject from the secret.",
+			match:       is(google.ErrDelegationFailed),
+		},
+		{
+			code:        CODE_DRIVE_ACCESS_DENIED,
+			summary:     "The Google service account no longer has access to the file or folder.",
+			remediation: "Re-share the folder with the Scriptor service account and press Retry.",
+			match:       googleAPIStatus(http.StatusUnauthorized, http.StatusForbidden),
+		},
+		{
+			code:        CODE_DRIVE_NOT_FOUND,
+			summary:     "The file or folder could not be found in Google Drive.",
+			remediation: "Check that the file wasn't moved or deleted and that the folder is still shared with the Scriptor service account.",
+			match:       googleAPIStatus(http.StatusNotFound),
+		},
+		{
+			code:        CODE_DRIVE_UNAVAILABLE,
+			summary:     "Google Drive was temporarily unavailable.",
+			remediation: "Wait a few minutes and press Retry.",
+			match: googleAPIStatus(
+				http.StatusTooManyRequests,
+				http.StatusInternalServerError,
+				http.StatusBadGateway,
+				http.StatusServiceUnavailable,
+				http.StatusGatewayTimeout,
+			),
+		},
+		{
+			code:        CODE_PUBLISHED_NOTE_MISMATCH,
+			summary:     "The note Google Drive stored was different from the note Scriptor published, even after saving it again.",
+			remediation: "Press Retry. If it fails again, compare the note in Drive with the final note in the staging bucket using the technical details.",
+		},
+	}
+)
+
+func is(target error) func(err error) bool {
+	return func(err error) bool {
+		return err == target
+	}
+}
+
+func googleAPIStatus(codes ...int) func(err error) bool {
+	return func(err error) bool {
+		apiErr, ok := err.(*googleapi.Error)
+		if !ok {
+			return false
+		}
+
+		for _, code := range codes {
+			if apiErr.Code == code {
+				return true
+			}
+		}
+
+		return false
+	}
+}
+
+// Classify returns the code of the most specific known failure in the error
+// chain, or CODE_UNKNOWN. The chain is searched from the outermost error in,
+// so an error that adds meaning on top of the one it wraps wins.
+func Classify(err error) string {
+	if e, ok := find(err); ok {
+		return e.code
+	}
+
+	return CODE_UNKNOWN
+}
+
+// Explain builds the explanation for an error, keeping the raw error as the
+// technical details.
+func Explain(err error) Explanation {
+	if err == nil {
+		return ExplainCode(CODE_UNKNOWN, "")
+	}
+
+	return ExplainCode(Classify(err), err.Error())
+}
+
+// ExplainCode builds the explanation for a code recorded with a failed stage.
+// Unknown codes fall back to a generic explanation.
+func ExplainCode(code, details string) Explanation {
+	e := unknown
+	for _, candidate := range entries {
+		if candidate.code == code {
+			e = candidate
+			break
+		}
+	}
+
+	return Explanation{
+		Code:             e.code,
+		Summary:          e.summary,
+		Remediation:      e.remediation,
+		TechnicalDetails: details,
+	}
+}
+
+// Walk the error chain depth first, following joined errors, and stop at the
+// first error that matches an entry.
+func find(err error) (entry, bool) {
+	if err == nil {
+		return entry{}, false
+	}
+
+	for _, e := range entries {
+		if e.match != nil && e.match(err) {
+			return e, true
+		}
+	}
+
+	switch wrapped := err.(type) {
+	case interface{ Unwrap() error }:
+		return find(wrapped.Unwrap())
+	case interface{ Unwrap() []error }:
+		for _, inner := range wrapped.Unwrap() {
+			if e, ok := find(inner); ok {
+				return e, true
+			}
+		}
+	}
+
+	return entry{}, false
+}
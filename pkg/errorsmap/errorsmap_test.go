@@ -0,0 +1,220 @@
+package errorsmap
+
+import (
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io/fs"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/KyleBrandon/scriptor/pkg/database"
+	"github.com/KyleBrandon/scriptor/pkg/google"
+	"google.golang.org/api/googleapi"
+)
+
+func TestClassify(t *testing.T) {
+	forbidden := &googleapi.Error{Code: http.StatusForbidden, Message: "forbidden"}
+	unavailable := &googleapi.Error{Code: http.StatusServiceUnavailable}
+
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{name: "nil", err: nil, want: CODE_UNKNOWN},
+		{name: "plain error", err: errors.New("boom"), want: CODE_UNKNOWN},
+		{name: "sentinel", err: database.ErrDocumentNotFound, want: CODE_DOCUMENT_NOT_FOUND},
+		{
+			name: "wrapped sentinel",
+			err:  fmt.Errorf("download: %w", fmt.Errorf("lookup: %w", google.ErrFolderLoop)),
+			want: CODE_FOLDER_LOOP,
+		},
+		{
+			name: "missing folder",
+			err:  fmt.Errorf("%w: folder-1", google.ErrFolderNotFound),
+			want: CODE_FOLDER_NOT_FOUND,
+		},
+		{
+			name: "read-only folder",
+			err:  fmt.Errorf("invalid ArchiveFolderID: %w", fmt.Errorf("%w: folder-1", google.ErrFolderNotWritable)),
+			want: CODE_FOLDER_NOT_WRITABLE,
+		},
+		{
+			name: "delegation not allowed",
+			err:  fmt.Errorf("%w: unauthorized_client", google.ErrDelegationFailed),
+			want: CODE_DRIVE_DELEGATION_FAILED,
+		},
+		{
+			name: "archived file is gone",
+			err:  fmt.Errorf("%w: file-1: %w", google.ErrFileGone, &googleapi.Error{Code: http.StatusNotFound}),
+			want: CODE_FILE_GONE,
+		},
+		{name: "google api error", err: forbidden, want: CODE_DRIVE_ACCESS_DENIED},
+		{
+			name: "wrapped google api error",
+			err:  fmt.Errorf("copy: %w", fmt.Errorf("reader: %w", unavailable)),
+			want: CODE_DRIVE_UNAVAILABLE,
+		},
+		{
+			name: "outer sentinel wins over the error it wraps",
+			err: fmt.Errorf(
+				"%w: %w",
+				database.ErrWatchChannelLockNotFound,
+				forbidden,
+			),
+			want: CODE_WATCH_CHANNEL_LOCK_NOT_FOUND,
+		},
+		{
+			name: "outermost match wins in a nested chain",
+			err: fmt.Errorf(
+				"register: %w",
+				fmt.Errorf("%w: %w", google.ErrFolderLoop, fmt.Errorf("parents: %w", forbidden)),
+			),
+			want: CODE_FOLDER_LOOP,
+		},
+		{
+			name: "joined errors",
+			err:  errors.Join(errors.New("first"), fmt.Errorf("second: %w", forbidden)),
+			want: CODE_DRIVE_ACCESS_DENIED,
+		},
+		{
+			name: "unmapped status",
+			err:  fmt.Errorf("copy: %w", &googleapi.Error{Code: http.StatusTeapot}),
+			want: CODE_UNKNOWN,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := Classify(tc.err); got != tc.want {
+				t.Fatalf("unexpected code: got %q want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestExplain(t *testing.T) {
+	err := fmt.Errorf("copy: %w", &googleapi.Error{Code: http.StatusForbidden})
+
+	got := Explain(err)
+	if got.Code != CODE_DRIVE_ACCESS_DENIED {
+		t.Fatalf("unexpected code: got %q", got.Code)
+	}
+
+	if got.TechnicalDetails != err.Error() {
+		t.Fatalf("unexpected details: got %q want %q", got.TechnicalDetails, err.Error())
+	}
+}
+
+func TestExplainUnknownCode(t *testing.T) {
+	got := ExplainCode("no_such_code", "raw detail")
+
+	if got.Code != CODE_UNKNOWN {
+		t.Fatalf("unexpected code: got %q want %q", got.Code, CODE_UNKNOWN)
+	}
+
+	if got.Summary == "" || got.Remediation == "" {
+		t.Fatalf("generic explanation is missing guidance: %+v", got)
+	}
+
+	if got.TechnicalDetails != "raw detail" {
+		t.Fatalf("unexpected details: got %q", got.TechnicalDetails)
+	}
+}
+
+func TestEveryCodeHasGuidance(t *testing.T) {
+	seen := make(map[string]bool)
+
+	for _, e := range entries {
+		if seen[e.code] {
+			t.Fatalf("duplicate entry for %q", e.code)
+		}
+		seen[e.code] = true
+
+		if e.summary == "" || e.remediation == "" {
+			t.Fatalf("entry %q is missing guidance", e.code)
+		}
+	}
+}
+
+// Every sentinel error declared in the packages that surface failures must be
+// mapped, so adding one without an explanation fails here.
+func TestEveryTypedErrorIsMapped(t *testing.T) {
+	mapped := mappedErrors(t)
+
+	for _, pkg := range []string{"google", "database"} {
+		for _, name := range declaredErrors(t, "../"+pkg) {
+			if !mapped[pkg+"."+name] {
+				t.Errorf("%s.%s has no entry in the errors map", pkg, name)
+			}
+		}
+	}
+}
+
+// Collect the names of the exported Err* variables declared in a package.
+func declaredErrors(t *testing.T, dir string) []string {
+	t.Helper()
+
+	pkgs, err := parser.ParseDir(token.NewFileSet(), dir, func(info fs.FileInfo) bool {
+		return !strings.HasSuffix(info.Name(), "_test.go")
+	}, 0)
+	if err != nil {
+		t.Fatalf("failed to parse %s: %v", dir, err)
+	}
+
+	names := make([]string, 0)
+	for _, pkg := range pkgs {
+		for _, file := range pkg.Files {
+			for _, decl := range file.Decls {
+				gen, ok := decl.(*ast.GenDecl)
+				if !ok || gen.Tok != token.VAR {
+					continue
+				}
+
+				for _, spec := range gen.Specs {
+					for _, ident := range spec.(*ast.ValueSpec).Names {
+						if strings.HasPrefix(ident.Name, "Err") {
+							names = append(names, ident.Name)
+						}
+					}
+				}
+			}
+		}
+	}
+
+	if len(names) == 0 {
+		t.Fatalf("no errors found in %s", dir)
+	}
+
+	return names
+}
+
+// Collect the pkg.Err* references used by the entries.
+func mappedErrors(t *testing.T) map[string]bool {
+	t.Helper()
+
+	file, err := parser.ParseFile(token.NewFileSet(), "errorsmap.go", nil, 0)
+	if err != nil {
+		t.Fatalf("failed to parse errorsmap.go: %v", err)
+	}
+
+	mapped := make(map[string]bool)
+	ast.Inspect(file, func(node ast.Node) bool {
+		sel, ok := node.(*ast.SelectorExpr)
+		if !ok || !strings.HasPrefix(sel.Sel.Name, "Err") {
+			return true
+		}
+
+		if pkg, ok := sel.X.(*ast.Ident); ok {
+			mapped[pkg.Name+"."+sel.Sel.Name] = true
+		}
+
+		return true
+	})
+
+	return mapped
+}
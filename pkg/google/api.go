@@ -0,0 +1,223 @@
+package google
+
+import (
+	"context"
+	"io"
+	"net/http"
+
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/googleapi"
+)
+
+type (
+	// FilesAPI is the part of the Drive files API that Scriptor uses
+	FilesAPI interface {
+		Get(ctx context.Context, id, fields string) (*drive.File, error)
+		Download(ctx context.Context, id string) (*http.Response, error)
+		Export(ctx context.Context, id, mimeType string) (*http.Response, error)
+		List(ctx context.Context, req FileListRequest) (*drive.FileList, error)
+		Create(
+			ctx context.Context,
+			file *drive.File,
+			media io.Reader,
+			options ...googleapi.MediaOption,
+		) (*drive.File, error)
+		Copy(ctx context.Context, id string, file *drive.File) (*drive.File, error)
+
+		// Update changes the metadata set on the file, and moves it when
+		// the parents to add or remove are set. Either can be empty.
+		Update(ctx context.Context, id string, file *drive.File, addParents, removeParents string) error
+	}
+
+	// ChangesAPI is the part of the Drive changes API that Scriptor uses
+	ChangesAPI interface {
+		GetStartPageToken(ctx context.Context, driveID string) (string, error)
+		List(ctx context.Context, pageToken, driveID, fields string) (*drive.ChangeList, error)
+	}
+
+	// ChannelsAPI watches a folder for changes and stops watching it
+	ChannelsAPI interface {
+		Watch(ctx context.Context, folderID string, channel *drive.Channel) (*drive.Channel, error)
+		Stop(ctx context.Context, channel *drive.Channel) error
+	}
+
+	// CommentsAPI adds comments to files
+	CommentsAPI interface {
+		Create(ctx context.Context, fileID string, comment *drive.Comment) error
+	}
+
+	// DriveAPI has every Drive call GoogleDriveContext makes. NewDriveAPI
+	// makes them with the Drive service, and the googletest package has a
+	// fake of each for tests.
+	DriveAPI struct {
+		Files    FilesAPI
+		Changes  ChangesAPI
+		Channels ChannelsAPI
+		Comments CommentsAPI
+	}
+
+	// FileListRequest selects one page of the files of a List call
+	FileListRequest struct {
+		Query   string
+		Fields  string
+		OrderBy string
+
+		// Drive picks the page size when it isn't set
+		PageSize  int64
+		PageToken string
+
+		// The shared drive to search, every drive when empty
+		DriveID string
+	}
+)
+
+// NewDriveAPI returns the Drive calls made with the service. The calls on the
+// files are set up to work in shared drives as well, the shared drive
+// parameters don't change anything for files in My Drive.
+func NewDriveAPI(service *drive.Service) DriveAPI {
+	return DriveAPI{
+		Files:    serviceFiles{service},
+		Changes:  serviceChanges{service},
+		Channels: serviceChannels{service},
+		Comments: serviceComments{service},
+	}
+}
+
+type serviceFiles struct{ service *drive.Service }
+
+func (f serviceFiles) Get(ctx context.Context, id, fields string) (*drive.File, error) {
+	call := f.service.Files.Get(id).SupportsAllDrives(true)
+	if fields != "" {
+		call = call.Fields(googleapi.Field(fields))
+	}
+
+	return call.Context(ctx).Do()
+}
+
+func (f serviceFiles) Download(ctx context.Context, id string) (*http.Response, error) {
+	return f.service.Files.Get(id).SupportsAllDrives(true).Context(ctx).Download()
+}
+
+func (f serviceFiles) Export(ctx context.Context, id, mimeType string) (*http.Response, error) {
+	return f.service.Files.Export(id, mimeType).Context(ctx).Download()
+}
+
+func (f serviceFiles) List(ctx context.Context, req FileListRequest) (*drive.FileList, error) {
+	call := f.service.Files.List().
+		SupportsAllDrives(true).
+		IncludeItemsFromAllDrives(true).
+		Q(req.Query)
+	if req.DriveID != "" {
+		call = call.Corpora("drive").DriveId(req.DriveID)
+	}
+	if req.Fields != "" {
+		call = call.Fields(googleapi.Field(req.Fields))
+	}
+	if req.OrderBy != "" {
+		call = call.OrderBy(req.OrderBy)
+	}
+	if req.PageSize > 0 {
+		call = call.PageSize(req.PageSize)
+	}
+	if req.PageToken != "" {
+		call = call.PageToken(req.PageToken)
+	}
+
+	return call.Context(ctx).Do()
+}
+
+func (f serviceFiles) Create(
+	ctx context.Context,
+	file *drive.File,
+	media io.Reader,
+	options ...googleapi.MediaOption,
+) (*drive.File, error) {
+	call := f.service.Files.Create(file).SupportsAllDrives(true).Fields("id")
+	if media != nil {
+		call = call.Media(media, options...)
+	}
+
+	return call.Context(ctx).Do()
+}
+
+func (f serviceFiles) Copy(ctx context.Context, id string, file *drive.File) (*drive.File, error) {
+	return f.service.Files.Copy(id, file).
+		SupportsAllDrives(true).
+		Fields("id").
+		Context(ctx).
+		Do()
+}
+
+func (f serviceFiles) Update(
+	ctx context.Context,
+	id string,
+	file *drive.File,
+	addParents, removeParents string,
+) error {
+	call := f.service.Files.Update(id, file).SupportsAllDrives(true).Fields("id, parents")
+	if addParents != "" {
+		call = call.AddParents(addParents)
+	}
+	if removeParents != "" {
+		call = call.RemoveParents(removeParents)
+	}
+
+	_, err := call.Context(ctx).Do()
+	return err
+}
+
+type serviceChanges struct{ service *drive.Service }
+
+// The token of a shared drive is only good for the changes of that drive
+func (c serviceChanges) GetStartPageToken(ctx context.Context, driveID string) (string, error) {
+	call := c.service.Changes.GetStartPageToken().SupportsAllDrives(true)
+	if driveID != "" {
+		call = call.DriveId(driveID)
+	}
+
+	resp, err := call.Context(ctx).Do()
+	if err != nil {
+		return "", err
+	}
+
+	return resp.StartPageToken, nil
+}
+
+func (c serviceChanges) List(
+	ctx context.Context,
+	pageToken, driveID, fields string,
+) (*drive.ChangeList, error) {
+	call := c.service.Changes.List(pageToken).SupportsAllDrives(true)
+	if driveID != "" {
+		call = call.DriveId(driveID).IncludeItemsFromAllDrives(true)
+	}
+	if fields != "" {
+		call = call.Fields(googleapi.Field(fields))
+	}
+
+	return call.Context(ctx).Do()
+}
+
+type serviceChannels struct{ service *drive.Service }
+
+func (c serviceChannels) Watch(
+	ctx context.Context,
+	folderID string,
+	channel *drive.Channel,
+) (*drive.Channel, error) {
+	return c.service.Files.Watch(folderID, channel).
+		SupportsAllDrives(true).
+		Context(ctx).
+		Do()
+}
+
+func (c serviceChannels) Stop(ctx context.Context, channel *drive.Channel) error {
+	return c.service.Channels.Stop(channel).Context(ctx).Do()
+}
+
+type serviceComments struct{ service *drive.Service }
+
+func (c serviceComments) Create(ctx context.Context, fileID string, comment *drive.Comment) error {
+	_, err := c.service.Comments.Create(fileID, comment).Fields("id").Context(ctx).Do()
+	return err
+}
@@ -0,0 +1,979 @@
+package google_test
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/KyleBrandon/scriptor/pkg/google"
+	"github.com/KyleBrandon/scriptor/pkg/google/googletest"
+	"github.com/KyleBrandon/scriptor/pkg/types"
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/googleapi"
+)
+
+// A context on the fake that retries without waiting long
+func newFakeContext(fake *googletest.Drive) *google.GoogleDriveContext {
+	gd := google.NewGoogleDriveFromAPI(fake.API())
+	gd.SetRetryPolicy(google.RetryPolicy{
+		MaxAttempts:    3,
+		InitialBackoff: time.Millisecond,
+		MaxBackoff:     time.Millisecond,
+	})
+
+	return gd
+}
+
+func changed(id, name, parent string) *drive.Change {
+	return &drive.Change{
+		FileId: id,
+		File: &drive.File{
+			Id:           id,
+			Name:         name,
+			MimeType:     types.CONTENT_TYPE_PDF,
+			Parents:      []string{parent},
+			CreatedTime:  "2026-03-12T08:00:00Z",
+			ModifiedTime: "2026-03-12T08:00:00Z",
+		},
+	}
+}
+
+func TestQueryChangesWithFake(t *testing.T) {
+	folder := changed("folder-1", "archive", "watch")
+	folder.File.MimeType = google.GOOGLE_FOLDER_MIME_TYPE
+
+	output := changed("file-6", "scan.md", "watch")
+	output.File.AppProperties = map[string]string{google.SCRIPTOR_OUTPUT_PROPERTY: "true"}
+
+	trashed := changed("file-4", "old.pdf", "watch")
+	trashed.File.Trashed = true
+
+	fake := googletest.NewDrive()
+	fake.ChangePages["start"] = &drive.ChangeList{
+		NextPageToken: "page-2",
+		Changes: []*drive.Change{
+			changed("file-1", "scan.pdf", "watch"),
+			changed("file-2", "elsewhere.pdf", "other"),
+			folder,
+			changed("file-7", "scan.pdf.scriptor.yaml", "watch"),
+			{ChangeType: "drive", DriveId: "drive-1"},
+		},
+	}
+	fake.ChangePages["page-2"] = &drive.ChangeList{
+		NewStartPageToken: "next",
+		Changes: []*drive.Change{
+			// the same file again, and another file with its name
+			changed("file-1", "scan.pdf", "watch"),
+			changed("file-3", "scan.pdf", "watch"),
+			trashed,
+			{FileId: "file-5", Removed: true},
+			output,
+			changed("file-8", "photo.heic", "watch"),
+		},
+	}
+
+	changes, err := newFakeContext(fake).QueryChanges(context.Background(), "watch", "", "start", false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	ids := make([]string, 0)
+	for _, document := range changes.Documents {
+		ids = append(ids, document.GoogleID)
+	}
+
+	// the files of other folders, folders, outputs and the files already
+	// seen by ID or name are skipped
+	if !slices.Equal(ids, []string{"file-1", "file-8"}) {
+		t.Fatalf("unexpected documents: %v", ids)
+	}
+
+	if len(changes.Sidecars) != 1 || changes.Sidecars[0].GoogleID != "file-7" ||
+		changes.Sidecars[0].FolderID != "watch" {
+		t.Fatalf("unexpected sidecars: %+v", changes.Sidecars)
+	}
+
+	if !slices.Equal(changes.Removed, []string{"file-4", "file-5"}) || changes.OutputsSkipped != 1 {
+		t.Fatalf("unexpected removals %v and outputs %d", changes.Removed, changes.OutputsSkipped)
+	}
+
+	// every page is read and the token of the next query is kept
+	if changes.NextStartToken != "next" ||
+		!slices.Equal(fake.Calls, []string{"Changes.List start", "Changes.List page-2"}) {
+		t.Fatalf("unexpected token %q after %v", changes.NextStartToken, fake.Calls)
+	}
+}
+
+func TestQueryChangesParentsWithFake(t *testing.T) {
+	tests := []struct {
+		name    string
+		parents []string
+
+		wantFolder string
+		wantFound  bool
+	}{
+		{
+			// shared with the service account on its own
+			name: "no parents",
+		},
+		{
+			name:       "the watch folder",
+			parents:    []string{"watch"},
+			wantFolder: "watch",
+			wantFound:  true,
+		},
+		{
+			name:    "another folder",
+			parents: []string{"other"},
+		},
+		{
+			name:       "the watch folder after another",
+			parents:    []string{"other", "watch"},
+			wantFolder: "watch",
+			wantFound:  true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			change := changed("file-1", "scan.pdf", "")
+			change.File.Parents = tc.parents
+
+			fake := googletest.NewDrive()
+			fake.ChangePages["start"] = &drive.ChangeList{
+				NewStartPageToken: "next",
+				Changes:           []*drive.Change{change},
+			}
+
+			changes, err := newFakeContext(fake).QueryChanges(context.Background(), "watch", "", "start", false)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if !tc.wantFound {
+				if len(changes.Documents) != 0 {
+					t.Fatalf("unexpected documents: %+v", changes.Documents)
+				}
+				return
+			}
+
+			// the folder is the parent that was watched, every parent is kept
+			if len(changes.Documents) != 1 || changes.Documents[0].GoogleFolderID != tc.wantFolder ||
+				!slices.Equal(changes.Documents[0].GoogleParentIDs, tc.parents) {
+				t.Fatalf("unexpected documents: %+v", changes.Documents)
+			}
+		})
+	}
+}
+
+func TestQueryChangesRetriesPagesWithFake(t *testing.T) {
+	fake := googletest.NewDrive()
+	fake.ChangePages["start"] = &drive.ChangeList{
+		NextPageToken: "page-2",
+		Changes:       []*drive.Change{changed("file-1", "scan.pdf", "watch")},
+	}
+	fake.ChangePages["page-2"] = &drive.ChangeList{
+		NewStartPageToken: "next",
+		Changes:           []*drive.Change{changed("file-2", "notes.pdf", "watch")},
+	}
+
+	// only the page that failed is queried again
+	fake.Fail("Changes.List", nil, &googleapi.Error{Code: http.StatusServiceUnavailable})
+
+	changes, err := newFakeContext(fake).QueryChanges(context.Background(), "watch", "", "start", false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(changes.Documents) != 2 || changes.NextStartToken != "next" {
+		t.Fatalf("unexpected changes: %+v", changes)
+	}
+
+	want := []string{"Changes.List start", "Changes.List page-2", "Changes.List page-2"}
+	if !slices.Equal(fake.Calls, want) {
+		t.Fatalf("unexpected calls: %v", fake.Calls)
+	}
+}
+
+func TestArchiveWithFake(t *testing.T) {
+	unavailable := &googleapi.Error{Code: http.StatusServiceUnavailable}
+
+	tests := []struct {
+		name    string
+		parents []string
+		fileID  string
+		getErrs []error
+		updErrs []error
+
+		wantParents []string
+		wantUpdates int
+		wantErr     bool
+	}{
+		{
+			name:        "moved to the archive folder",
+			parents:     []string{"watch", "shared"},
+			wantParents: []string{"archive"},
+			wantUpdates: 1,
+		},
+		{
+			name:        "moved from its only folder",
+			parents:     []string{"watch"},
+			wantParents: []string{"archive"},
+			wantUpdates: 1,
+		},
+		{
+			// shared with the service account on its own
+			name:        "no folder it can see",
+			wantParents: []string{"archive"},
+			wantUpdates: 1,
+		},
+		{
+			// an earlier attempt moved it
+			name:        "already archived",
+			parents:     []string{"archive"},
+			wantParents: []string{"archive"},
+		},
+		{
+			// added to the archive folder by hand, it isn't taken out
+			// of the other folder
+			name:        "archived in another folder as well",
+			parents:     []string{"elsewhere", "archive"},
+			wantParents: []string{"elsewhere", "archive"},
+		},
+		{
+			name:        "transient failure to move",
+			parents:     []string{"watch"},
+			updErrs:     []error{unavailable},
+			wantParents: []string{"archive"},
+			wantUpdates: 2,
+		},
+		{
+			name:        "transient failure to look it up",
+			parents:     []string{"watch"},
+			getErrs:     []error{unavailable},
+			wantParents: []string{"archive"},
+			wantUpdates: 1,
+		},
+		{
+			name:        "file missing",
+			parents:     []string{"watch"},
+			fileID:      "file-missing",
+			wantParents: []string{"watch"},
+			wantErr:     true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			fake := googletest.NewDrive()
+			fake.AddFile(&drive.File{Id: "file-1", Name: "scan.pdf", Parents: tc.parents}, nil)
+			fake.Fail("Files.Get", tc.getErrs...)
+			fake.Fail("Files.Update", tc.updErrs...)
+
+			fileID := "file-1"
+			if tc.fileID != "" {
+				fileID = tc.fileID
+			}
+
+			err := newFakeContext(fake).Archive(context.Background(), fileID, "archive")
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			// a missing file isn't looked for again
+			if tc.wantErr && (!errors.Is(err, google.ErrFileGone) || !google.IsNotFoundError(err) ||
+				len(fake.Calls) != 1) {
+				t.Fatalf("unexpected failure %v after %v", err, fake.Calls)
+			}
+
+			if parents := fake.File("file-1").Parents; !slices.Equal(parents, tc.wantParents) {
+				t.Fatalf("unexpected parents: %v", parents)
+			}
+
+			updates := 0
+			for _, call := range fake.Calls {
+				if call == "Files.Update file-1" {
+					updates++
+				}
+			}
+			if updates != tc.wantUpdates {
+				t.Fatalf("unexpected updates %d: %v", updates, fake.Calls)
+			}
+		})
+	}
+}
+
+func TestSavedFilesWithFake(t *testing.T) {
+	fake := googletest.NewDrive()
+	gd := newFakeContext(fake)
+	ctx := context.Background()
+
+	err := gd.SaveFileAs(ctx, "doc-1", "Tom's notes.md", "dest", "", "", strings.NewReader("# Notes"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	exists, err := gd.FileExists(ctx, "doc-1", "Tom's notes.md", "dest")
+	if err != nil || !exists {
+		t.Fatalf("the saved file wasn't found: %v", err)
+	}
+
+	id, err := gd.SavedFileID(ctx, "doc-1", "Tom's notes.md", "dest")
+	if err != nil || id == "" || fake.File(id).Name != "Tom's notes.md" {
+		t.Fatalf("unexpected saved file %q: %v", id, err)
+	}
+
+	// another name, folder or document is a different file
+	for _, args := range [][3]string{
+		{"doc-1", "notes.md", "dest"},
+		{"doc-1", "Tom's notes.md", "other"},
+		{"doc-2", "Tom's notes.md", "dest"},
+	} {
+		id, err := gd.SavedFileID(ctx, args[0], args[1], args[2])
+		if err != nil || id != "" {
+			t.Fatalf("unexpected saved file %q for %v: %v", id, args, err)
+		}
+	}
+
+	content, err := gd.ReadSavedFile(ctx, "doc-1", "Tom's notes.md", "dest")
+	if err != nil || string(content) != "# Notes" {
+		t.Fatalf("unexpected content %q: %v", content, err)
+	}
+
+	// the files of other documents are left alone
+	fake.AddFile(&drive.File{
+		Id:            "other",
+		Name:          "Tom's notes.md",
+		Parents:       []string{"dest"},
+		AppProperties: map[string]string{google.SCRIPTOR_DOCUMENT_PROPERTY: "doc-2"},
+	}, nil)
+
+	if err := gd.TrashDocumentFiles(ctx, "doc-1", "dest"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	exists, err = gd.FileExists(ctx, "doc-1", "Tom's notes.md", "dest")
+	if err != nil || exists || fake.File("other").Trashed {
+		t.Fatalf("unexpected files after the trash: %v %v", exists, err)
+	}
+}
+
+func TestCommentWithFake(t *testing.T) {
+	fake := googletest.NewDrive()
+	fake.AddFile(&drive.File{Id: "file-1", Name: "scan.pdf"}, nil)
+	gd := newFakeContext(fake)
+
+	if err := gd.AddComment(context.Background(), "file-1", google.ProcessedComment("dest")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	err := gd.AddComment(context.Background(), "file-2", "lost")
+	if !google.IsNotFoundError(err) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if !slices.Equal(fake.Comments["file-1"], []string{google.ProcessedComment("dest")}) {
+		t.Fatalf("unexpected comments: %v", fake.Comments)
+	}
+}
+
+func TestListFolderWithFake(t *testing.T) {
+	unavailable := &googleapi.Error{Code: http.StatusServiceUnavailable}
+
+	tests := []struct {
+		name    string
+		listErr []error
+
+		wantDocs  []string
+		wantPages int
+		wantErr   bool
+	}{
+		{
+			name:      "every page",
+			wantDocs:  []string{"file-1", "file-2", "file-3", "file-4", "file-5"},
+			wantPages: 3,
+		},
+		{
+			// only the page that failed is listed again
+			name:      "transient failure of a later page",
+			listErr:   []error{nil, unavailable},
+			wantDocs:  []string{"file-1", "file-2", "file-3", "file-4", "file-5"},
+			wantPages: 4,
+		},
+		{
+			name:    "failure of a later page",
+			listErr: []error{nil, &googleapi.Error{Code: http.StatusForbidden}},
+			wantErr: true,
+		},
+		{
+			name:    "transient failure on every attempt",
+			listErr: []error{nil, unavailable, unavailable, unavailable},
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			fake := googletest.NewDrive()
+			fake.PageSize = 2
+
+			for _, name := range []string{"a.pdf", "b.pdf", "c.pdf", "d.pdf", "e.pdf"} {
+				fake.AddFile(changed("", name, "watch").File, nil)
+			}
+			fake.AddFile(changed("elsewhere", "elsewhere.pdf", "other").File, nil)
+
+			trashed := changed("trashed", "old.pdf", "watch").File
+			trashed.Trashed = true
+			fake.AddFile(trashed, nil)
+			fake.Fail("Files.List", tc.listErr...)
+
+			contents, err := newFakeContext(fake).ListFolder(context.Background(), "watch", "", false)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if tc.wantErr {
+				if contents != nil {
+					t.Fatalf("unexpected contents of a failed listing: %+v", contents)
+				}
+				return
+			}
+
+			ids := make([]string, 0)
+			for _, document := range contents.Documents {
+				ids = append(ids, document.GoogleID)
+			}
+
+			if !slices.Equal(ids, tc.wantDocs) || len(fake.Calls) != tc.wantPages {
+				t.Fatalf("unexpected documents %v after %v", ids, fake.Calls)
+			}
+		})
+	}
+}
+
+// Impersonating a user, the files the user uploads are owned by the caller
+// like the ones Scriptor saves, and only the outputs are skipped
+func TestImpersonatedUserUploadsWithFake(t *testing.T) {
+	upload := changed("file-1", "scan.pdf", "watch")
+	upload.File.OwnedByMe = true
+
+	output := changed("file-2", "scan.md", "watch")
+	output.File.OwnedByMe = true
+	output.File.AppProperties = map[string]string{google.SCRIPTOR_OUTPUT_PROPERTY: "true"}
+
+	fake := googletest.NewDrive()
+	fake.ChangePages["start"] = &drive.ChangeList{
+		NewStartPageToken: "next",
+		Changes:           []*drive.Change{upload, output},
+	}
+	fake.AddFile(upload.File, nil)
+	fake.AddFile(output.File, nil)
+
+	gd := newFakeContext(fake)
+	ctx := context.Background()
+
+	changes, err := gd.QueryChanges(ctx, "watch", "", "start", false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(changes.Documents) != 1 || changes.Documents[0].GoogleID != "file-1" ||
+		changes.OutputsSkipped != 1 {
+		t.Fatalf("unexpected changes: %+v", changes)
+	}
+
+	contents, err := gd.ListFolder(ctx, "watch", "", false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(contents.Documents) != 1 || contents.Documents[0].GoogleID != "file-1" {
+		t.Fatalf("unexpected contents: %+v", contents)
+	}
+
+	document, err := gd.FindDocument(ctx, "watch", "scan.pdf")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if document == nil || document.GoogleID != "file-1" {
+		t.Fatalf("unexpected document: %+v", document)
+	}
+}
+
+// A folder with the ID as its name
+func folder(id, parent string) *drive.File {
+	return &drive.File{
+		Id:       id,
+		Name:     id,
+		MimeType: google.GOOGLE_FOLDER_MIME_TYPE,
+		Parents:  []string{parent},
+	}
+}
+
+// The number of calls with the name whose query or ID has the text
+func countCalls(fake *googletest.Drive, name, text string) int {
+	count := 0
+	for _, call := range fake.Calls {
+		if strings.HasPrefix(call, name+" ") && strings.Contains(call, text) {
+			count++
+		}
+	}
+
+	return count
+}
+
+func TestEnsureFolderPathWithFake(t *testing.T) {
+	existingYear := &drive.File{
+		Id:       "year",
+		Name:     "2026",
+		MimeType: google.GOOGLE_FOLDER_MIME_TYPE,
+		Parents:  []string{"destination"},
+	}
+	existingMonth := &drive.File{
+		Id:       "month",
+		Name:     "03",
+		MimeType: google.GOOGLE_FOLDER_MIME_TYPE,
+		Parents:  []string{"year"},
+	}
+
+	tests := []struct {
+		name     string
+		folders  []*drive.File
+		segments []string
+
+		// the folder found, empty when it is created
+		want        string
+		wantCreates int
+	}{
+		{
+			name:     "existing path",
+			folders:  []*drive.File{existingYear, existingMonth},
+			segments: []string{"2026", "03"},
+			want:     "month",
+		},
+		{
+			name:        "missing month",
+			folders:     []*drive.File{existingYear},
+			segments:    []string{"2026", "04"},
+			wantCreates: 1,
+		},
+		{
+			name:        "missing path",
+			segments:    []string{"2026", "03"},
+			wantCreates: 2,
+		},
+		{
+			name:     "no segments",
+			segments: nil,
+			want:     "destination",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			fake := googletest.NewDrive()
+			for _, existing := range tc.folders {
+				fake.AddFile(existing, nil)
+			}
+			gd := newFakeContext(fake)
+			ctx := context.Background()
+
+			got, err := gd.EnsureFolderPath(ctx, "destination", tc.segments)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			creates := countCalls(fake, "Files.Create", "")
+			if (tc.want != "" && got != tc.want) || creates != tc.wantCreates {
+				t.Fatalf("unexpected folder: got %s with %d creates, want %s with %d", got, creates, tc.want, tc.wantCreates)
+			}
+
+			// a created folder is named by the last segment and marked as
+			// a Scriptor output
+			if tc.want == "" {
+				created := fake.File(got)
+				if created == nil ||
+					created.Name != tc.segments[len(tc.segments)-1] ||
+					created.MimeType != google.GOOGLE_FOLDER_MIME_TYPE ||
+					created.AppProperties[google.SCRIPTOR_OUTPUT_PROPERTY] != "true" {
+					t.Fatalf("unexpected created folder: %+v", created)
+				}
+			}
+
+			// the created folders are found again without another lookup
+			lists := countCalls(fake, "Files.List", "")
+			again, err := gd.EnsureFolderPath(ctx, "destination", tc.segments)
+			if err != nil || again != got ||
+				countCalls(fake, "Files.List", "") != lists ||
+				countCalls(fake, "Files.Create", "") != tc.wantCreates {
+				t.Fatalf("path was not cached: got %s after %v", again, fake.Calls)
+			}
+
+			// forgetting the paths looks them up again without creating them
+			gd.ForgetFolderPaths()
+			again, err = gd.EnsureFolderPath(ctx, "destination", tc.segments)
+			if err != nil || again != got ||
+				countCalls(fake, "Files.List", "") != lists+len(tc.segments) ||
+				countCalls(fake, "Files.Create", "") != tc.wantCreates {
+				t.Fatalf("unexpected lookup after forgetting: got %s after %v", again, fake.Calls)
+			}
+		})
+	}
+}
+
+func TestEnsureFolderPathErrorWithFake(t *testing.T) {
+	unavailable := &googleapi.Error{Code: http.StatusServiceUnavailable}
+
+	fake := googletest.NewDrive()
+	fake.Fail("Files.List", unavailable, unavailable, unavailable)
+
+	_, err := newFakeContext(fake).EnsureFolderPath(context.Background(), "destination", []string{"2026"})
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+
+	if countCalls(fake, "Files.Create", "") != 0 {
+		t.Fatalf("created a folder after a failed lookup")
+	}
+}
+
+// A Drive with the folders the validation looks up
+func newValidationFake() *googletest.Drive {
+	writable := &drive.FileCapabilities{CanAddChildren: true}
+
+	fake := googletest.NewDrive()
+	fake.AddFile(&drive.File{Id: "folder", MimeType: google.GOOGLE_FOLDER_MIME_TYPE, Capabilities: writable}, nil)
+	fake.AddFile(&drive.File{
+		Id:           "read-only",
+		MimeType:     google.GOOGLE_FOLDER_MIME_TYPE,
+		Capabilities: &drive.FileCapabilities{},
+	}, nil)
+	fake.AddFile(&drive.File{Id: "file", MimeType: types.CONTENT_TYPE_PDF, Capabilities: writable}, nil)
+	fake.AddFile(&drive.File{
+		Id:           "trashed",
+		MimeType:     google.GOOGLE_FOLDER_MIME_TYPE,
+		Trashed:      true,
+		Capabilities: writable,
+	}, nil)
+
+	return fake
+}
+
+func TestValidateFolderWithFake(t *testing.T) {
+	forbidden := &googleapi.Error{Code: http.StatusForbidden, Message: "insufficient permissions"}
+
+	tests := []struct {
+		id              string
+		getErr          error
+		wantErr         error
+		wantWritableErr error
+		wantOtherErr    bool
+	}{
+		{id: "folder"},
+		{id: "read-only", wantWritableErr: google.ErrFolderNotWritable},
+		{id: "file", wantErr: google.ErrFolderNotFound},
+		{id: "trashed", wantErr: google.ErrFolderNotFound},
+		{id: "missing", wantErr: google.ErrFolderNotFound},
+		{id: "folder", getErr: forbidden, wantOtherErr: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.id, func(t *testing.T) {
+			fake := newValidationFake()
+			if tc.getErr != nil {
+				fake.Fail("Files.Get", tc.getErr, tc.getErr)
+			}
+			gd := newFakeContext(fake)
+
+			err := gd.ValidateFolder(context.Background(), tc.id)
+			writableErr := gd.ValidateWritableFolder(context.Background(), tc.id)
+
+			if tc.wantOtherErr {
+				if err == nil || errors.Is(err, google.ErrFolderNotFound) || writableErr == nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("unexpected error: got %v want %v", err, tc.wantErr)
+			}
+
+			// a folder that can't be found can't be written to either
+			wantWritableErr := tc.wantWritableErr
+			if tc.wantErr != nil {
+				wantWritableErr = tc.wantErr
+			}
+
+			if !errors.Is(writableErr, wantWritableErr) {
+				t.Fatalf("unexpected writable error: got %v want %v", writableErr, wantWritableErr)
+			}
+		})
+	}
+}
+
+func TestValidateWatchChannelFoldersWithFake(t *testing.T) {
+	gd := newFakeContext(newValidationFake())
+
+	tests := []struct {
+		name      string
+		wc        types.WatchChannel
+		wantErr   error
+		wantField string
+	}{
+		{
+			name: "valid folders",
+			wc: types.WatchChannel{
+				FolderID:             "folder",
+				ArchiveFolderID:      "folder",
+				DestinationFolderIDs: []string{"folder"},
+				Routes:               map[string]string{"work": "folder"},
+			},
+		},
+		{
+			// nothing is written to the watch folder
+			name: "read-only watch folder",
+			wc: types.WatchChannel{
+				FolderID:            "read-only",
+				DestinationFolderID: "folder",
+			},
+		},
+		{
+			name:      "missing watch folder",
+			wc:        types.WatchChannel{FolderID: "missing"},
+			wantErr:   google.ErrFolderNotFound,
+			wantField: "FolderID",
+		},
+		{
+			name: "trashed archive folder",
+			wc: types.WatchChannel{
+				FolderID:        "folder",
+				ArchiveFolderID: "trashed",
+			},
+			wantErr:   google.ErrFolderNotFound,
+			wantField: "ArchiveFolderID",
+		},
+		{
+			name: "read-only archive folder",
+			wc: types.WatchChannel{
+				FolderID:        "folder",
+				ArchiveFolderID: "read-only",
+			},
+			wantErr:   google.ErrFolderNotWritable,
+			wantField: "ArchiveFolderID",
+		},
+		{
+			name: "second destination is a file",
+			wc: types.WatchChannel{
+				FolderID:             "folder",
+				DestinationFolderIDs: []string{"folder", "file"},
+			},
+			wantErr:   google.ErrFolderNotFound,
+			wantField: "DestinationFolderID",
+		},
+		{
+			name: "read-only destination folder",
+			wc: types.WatchChannel{
+				FolderID:            "folder",
+				DestinationFolderID: "read-only",
+			},
+			wantErr:   google.ErrFolderNotWritable,
+			wantField: "DestinationFolderID",
+		},
+		{
+			name: "missing route folder",
+			wc: types.WatchChannel{
+				FolderID: "folder",
+				Routes:   map[string]string{"work": "missing"},
+			},
+			wantErr:   google.ErrFolderNotFound,
+			wantField: "route work",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := gd.ValidateWatchChannelFolders(context.Background(), &tc.wc)
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("unexpected error: got %v want %v", err, tc.wantErr)
+			}
+
+			if tc.wantErr != nil && !strings.Contains(err.Error(), "invalid "+tc.wantField+":") {
+				t.Fatalf("error doesn't name the %s: %v", tc.wantField, err)
+			}
+		})
+	}
+}
+
+func TestResolveFolderTreeCacheWithFake(t *testing.T) {
+	fake := googletest.NewDrive()
+	fake.AddFile(folder("2026-01", "watch"), nil)
+	fake.AddFile(folder("week-1", "2026-01"), nil)
+	fake.AddFile(folder("other", "elsewhere"), nil)
+
+	gd := newFakeContext(fake)
+	ctx := context.Background()
+
+	resolve := func() map[string]bool {
+		t.Helper()
+		folders, err := gd.ResolveFolderTree(ctx, "watch")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return folders
+	}
+	listings := func() int {
+		return countCalls(fake, "Files.List", google.GOOGLE_FOLDER_MIME_TYPE)
+	}
+
+	folders := resolve()
+	if !maps.Equal(folders, map[string]bool{"watch": true, "2026-01": true, "week-1": true}) {
+		t.Fatalf("unexpected folders: %v", folders)
+	}
+
+	// the watch folder, the month and the week are each listed once
+	if listings() != 3 {
+		t.Fatalf("unexpected listings: %d", listings())
+	}
+
+	// the cached tree is used, and changing the copy returned doesn't
+	// change it
+	delete(folders, "week-1")
+	if !resolve()["week-1"] || listings() != 3 {
+		t.Fatalf("the cached tree wasn't used, listings %d", listings())
+	}
+
+	fake.AddFile(folder("2026-02", "watch"), nil)
+
+	gd.ForgetFolderTree("watch")
+	if !resolve()["2026-02"] || listings() != 6 {
+		t.Fatalf("the forgotten tree wasn't walked again, listings %d", listings())
+	}
+
+	// an expired tree is walked again
+	gd.ExpireFolderTree("watch")
+	resolve()
+	if listings() != 9 {
+		t.Fatalf("the expired tree wasn't walked again, listings %d", listings())
+	}
+}
+
+func TestQueryChangesRecursiveWithFake(t *testing.T) {
+	file := func(name, parent string) *drive.Change {
+		return changed("id-"+name, name, parent)
+	}
+
+	newFolder := &drive.Change{FileId: "2026-02", File: folder("2026-02", "watch")}
+
+	tests := []struct {
+		name      string
+		recursive bool
+		changes   []*drive.Change
+
+		// a folder added to the watch folder after the tree was cached
+		addedFolder string
+
+		wantDocuments []string
+		wantFolders   []string
+		wantListings  int
+	}{
+		{
+			name:          "only the watch folder",
+			changes:       []*drive.Change{file("scan-1.pdf", "watch"), file("scan-2.pdf", "2026-01")},
+			wantDocuments: []string{"scan-1.pdf"},
+			wantFolders:   []string{"watch"},
+		},
+		{
+			name:          "nested folders",
+			recursive:     true,
+			changes:       []*drive.Change{file("scan-1.pdf", "watch"), file("scan-2.pdf", "week-1"), file("scan-3.pdf", "elsewhere")},
+			wantDocuments: []string{"scan-1.pdf", "scan-2.pdf"},
+			wantFolders:   []string{"watch", "week-1"},
+			wantListings:  3,
+		},
+		{
+			// the folder is added to the tree and its file accepted in
+			// the same batch of changes
+			name:          "folder added",
+			recursive:     true,
+			changes:       []*drive.Change{newFolder, file("scan-4.pdf", "2026-02")},
+			addedFolder:   "2026-02",
+			wantDocuments: []string{"scan-4.pdf"},
+			wantFolders:   []string{"2026-02"},
+			wantListings:  6,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			fake := googletest.NewDrive()
+			fake.AddFile(folder("2026-01", "watch"), nil)
+			fake.AddFile(folder("week-1", "2026-01"), nil)
+			fake.ChangePages["start"] = &drive.ChangeList{Changes: tc.changes, NewStartPageToken: "next"}
+
+			gd := newFakeContext(fake)
+
+			if tc.addedFolder != "" {
+				if _, err := gd.ResolveFolderTree(context.Background(), "watch"); err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				fake.AddFile(folder(tc.addedFolder, "watch"), nil)
+			}
+
+			changes, err := gd.QueryChanges(context.Background(), "watch", "", "start", tc.recursive)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			names := make([]string, 0)
+			folders := make([]string, 0)
+			for _, document := range changes.Documents {
+				names = append(names, document.Name)
+				folders = append(folders, document.GoogleFolderID)
+			}
+
+			if !slices.Equal(names, tc.wantDocuments) || !slices.Equal(folders, tc.wantFolders) {
+				t.Fatalf("unexpected documents: %v in %v", names, folders)
+			}
+
+			listings := countCalls(fake, "Files.List", google.GOOGLE_FOLDER_MIME_TYPE)
+			if listings != tc.wantListings || changes.NextStartToken != "next" {
+				t.Fatalf("unexpected listings %d, token %q", listings, changes.NextStartToken)
+			}
+		})
+	}
+}
+
+func TestListFolderRecursiveWithFake(t *testing.T) {
+	fake := googletest.NewDrive()
+	fake.AddFile(folder("2026-01", "watch"), nil)
+	fake.AddFile(folder("week-1", "2026-01"), nil)
+	fake.AddFile(changed("id-scan-1", "scan-1.pdf", "watch").File, nil)
+	fake.AddFile(changed("id-scan-2", "scan-2.pdf", "week-1").File, nil)
+	fake.AddFile(changed("id-sidecar", "scan-2.pdf.scriptor.yaml", "week-1").File, nil)
+	fake.AddFile(changed("id-scan-3", "scan-3.pdf", "elsewhere").File, nil)
+
+	contents, err := newFakeContext(fake).ListFolder(context.Background(), "watch", "", true)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	names := make([]string, 0)
+	for _, document := range contents.Documents {
+		names = append(names, document.Name)
+	}
+	slices.Sort(names)
+
+	// the folders themselves are listed as well, and skipped
+	if !slices.Equal(names, []string{"scan-1.pdf", "scan-2.pdf"}) {
+		t.Fatalf("unexpected documents: %v", names)
+	}
+
+	// the sidecar is looked for next to its document
+	if len(contents.Sidecars) != 1 || contents.Sidecars[0].FolderID != "week-1" {
+		t.Fatalf("unexpected sidecars: %+v", contents.Sidecars)
+	}
+}
@@ -2,14 +2,24 @@ package google
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
+	"maps"
+	"mime"
+	"net"
+	"net/http"
 	"os"
+	"path/filepath"
 	"slices"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
+	"github.com/KyleBrandon/scriptor/pkg/sidecar"
 	"github.com/KyleBrandon/scriptor/pkg/types"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
@@ -17,13 +27,89 @@ import (
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
 	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/googleapi"
 	"google.golang.org/api/option"
 )
 
+const (
+	// Native Google formats (Docs, Slides, ...) cannot be downloaded directly
+	// and must be exported to a concrete format instead.
+	GOOGLE_APPS_MIME_TYPE_PREFIX = "application/vnd.google-apps."
+
+	// Format used when exporting native Google documents
+	GOOGLE_EXPORT_MIME_TYPE = "application/pdf"
+
+	// Shortcuts in the watch folder point to files elsewhere in Drive
+	GOOGLE_SHORTCUT_MIME_TYPE = "application/vnd.google-apps.shortcut"
+
+	// App property set on every file Scriptor saves so they are never
+	// ingested as new documents
+	SCRIPTOR_OUTPUT_PROPERTY = "scriptor_output"
+
+	// App property with the ID of the document a saved file belongs to
+	SCRIPTOR_DOCUMENT_PROPERTY = "scriptor_document_id"
+
+	// App properties set on the original when it was processed, the ID of
+	// the document is in SCRIPTOR_DOCUMENT_PROPERTY
+	SCRIPTOR_PROCESSED_AT_PROPERTY = "scriptor_processed_at"
+	SCRIPTOR_STATUS_PROPERTY       = "scriptor_status"
+	SCRIPTOR_REVISION_PROPERTY     = "scriptor_revision"
+
+	// Link to open a Drive folder in the browser
+	DRIVE_FOLDER_URL = "https://drive.google.com/drive/folders/%s"
+
+	// Content type of an upload whose type isn't known from its name
+	DEFAULT_UPLOAD_MIME_TYPE = "application/octet-stream"
+)
+
+// Content types of the files Scriptor saves, by extension. The types the
+// mime package knows from the system can differ between hosts, so these are
+// never left to it.
+var uploadContentTypes = map[string]string{
+	".md":       types.CONTENT_TYPE_MARKDOWN,
+	".markdown": types.CONTENT_TYPE_MARKDOWN,
+	".pdf":      types.CONTENT_TYPE_PDF,
+	".txt":      types.CONTENT_TYPE_TEXT,
+	".png":      types.CONTENT_TYPE_PNG,
+	".jpg":      types.CONTENT_TYPE_JPEG,
+	".jpeg":     types.CONTENT_TYPE_JPEG,
+	".docx":     "application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+}
+
+// Escapes the quotes and backslashes of a value in a Drive query
+var queryEscaper = strings.NewReplacer(`\`, `\\`, `'`, `\'`)
+
+// ErrDelegationFailed is returned by NewGoogleDrive when the service account
+// can't impersonate the user set in the secret.
+var ErrDelegationFailed = errors.New("domain-wide delegation failed")
+
+// ErrFileGone is returned by Archive when the file was deleted, or moved
+// somewhere the service account can't see, so there is nothing to archive.
+var ErrFileGone = errors.New("file is gone")
+
 type (
 	GoogleDriveContext struct {
-		ctx          context.Context
-		driveService *drive.Service
+		api         DriveAPI
+		retryPolicy RetryPolicy
+
+		// IDs of the folders found or created by EnsureFolderPath, keyed by
+		// the parent ID and the folder name
+		folderMu  sync.Mutex
+		folderIDs map[string]string
+
+		// The folders below the watch folders resolved by
+		// ResolveFolderTree, keyed by the watch folder ID
+		treeMu      sync.Mutex
+		folderTrees map[string]*folderTree
+	}
+
+	// The settings of the scriptor/google-service secret kept next to the
+	// service account key
+	serviceAccountOptions struct {
+		// User the service account acts as through domain-wide delegation,
+		// so the files it creates are owned by the user and count against
+		// their storage quota
+		ImpersonateSubject string `json:"impersonate_subject"`
 	}
 )
 
@@ -37,12 +123,18 @@ func NewGoogleDrive(ctx context.Context) (*GoogleDriveContext, error) {
 		return nil, err
 	}
 
-	drive := &GoogleDriveContext{
-		ctx,
-		driveService,
-	}
+	return NewGoogleDriveFromAPI(NewDriveAPI(driveService)), nil
+}
 
-	return drive, nil
+// NewGoogleDriveFromAPI returns a context making its Drive calls through the
+// API, like the fake of the googletest package.
+func NewGoogleDriveFromAPI(api DriveAPI) *GoogleDriveContext {
+	return &GoogleDriveContext{
+		api:         api,
+		retryPolicy: DefaultRetryPolicy,
+		folderIDs:   make(map[string]string),
+		folderTrees: make(map[string]*folderTree),
+	}
 }
 
 func getGoogleCredentials(ctx context.Context) ([]byte, error) {
@@ -73,15 +165,13 @@ func getDriveService(ctx context.Context) (*drive.Service, error) {
 		return nil, err
 	}
 
-	// Authenticate with Google Drive API using Service Account
-	creds, err := google.CredentialsFromJSON(ctx, data, drive.DriveScope)
+	tokenSource, err := newTokenSource(ctx, data)
 	if err != nil {
-		slog.Error("Unable to parse credentials", "error", err)
 		return nil, err
 	}
 
 	// Create an HTTP client using TokenSource
-	client := oauth2.NewClient(ctx, creds.TokenSource)
+	client := oauth2.NewClient(ctx, tokenSource)
 
 	// Create Google Drive service
 	service, err := drive.NewService(ctx, option.WithHTTPClient(client))
@@ -93,37 +183,136 @@ func getDriveService(ctx context.Context) (*drive.Service, error) {
 	return service, nil
 }
 
-func (gd *GoogleDriveContext) GetChangesStartToken() (string, error) {
+// Authenticate with Google Drive API using the service account, acting as
+// the user in impersonate_subject when it is set
+func newTokenSource(ctx context.Context, data []byte) (oauth2.TokenSource, error) {
+	var options serviceAccountOptions
+	if err := json.Unmarshal(data, &options); err != nil {
+		slog.Error("Unable to parse credentials", "error", err)
+		return nil, err
+	}
+
+	if options.ImpersonateSubject == "" {
+		creds, err := google.CredentialsFromJSON(ctx, data, drive.DriveScope)
+		if err != nil {
+			slog.Error("Unable to parse credentials", "error", err)
+			return nil, err
+		}
+
+		return creds.TokenSource, nil
+	}
+
+	conf, err := google.JWTConfigFromJSON(data, drive.DriveScope)
+	if err != nil {
+		slog.Error("Unable to parse credentials", "error", err)
+		return nil, err
+	}
+	conf.Subject = options.ImpersonateSubject
+
+	// a delegation that isn't allowed only fails once a token is requested,
+	// so one is requested now instead of every Drive call failing with a 403
+	tokenSource := conf.TokenSource(ctx)
+	if _, err := tokenSource.Token(); err != nil {
+		slog.Error(
+			"Unable to impersonate the user",
+			"subject",
+			options.ImpersonateSubject,
+			"clientEmail",
+			conf.Email,
+			"error",
+			err,
+		)
+		return nil, fmt.Errorf(
+			"%w: %s can't impersonate %s, check that its client ID is allowed the Drive scope in the domain-wide delegation of the Workspace admin console: %w",
+			ErrDelegationFailed,
+			conf.Email,
+			options.ImpersonateSubject,
+			err,
+		)
+	}
+
+	return tokenSource, nil
+}
+
+// List every page of the files, handing each page to the function as it
+// comes in. A page that fails transiently is asked for again without the
+// pages before it.
+func (gd *GoogleDriveContext) listFiles(
+	ctx context.Context,
+	call string,
+	req FileListRequest,
+	each func(files *drive.FileList) error,
+) error {
+	for {
+		var files *drive.FileList
+		err := gd.retry(ctx, call, func() error {
+			var err error
+			files, err = gd.api.Files.List(ctx, req)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+
+		if err := each(files); err != nil {
+			return err
+		}
+
+		if files.NextPageToken == "" {
+			return nil
+		}
+
+		req.PageToken = files.NextPageToken
+	}
+}
+
+// GetChangesStartToken returns the token the changes are queried from. The
+// token of a shared drive is only good for the changes of that drive.
+func (gd *GoogleDriveContext) GetChangesStartToken(
+	ctx context.Context,
+	driveID string,
+) (string, error) {
 	slog.Debug(">>GetChangesStartToken")
 	defer slog.Debug("<<GetChangesStartToken")
 
-	resp, err := gd.driveService.Changes.GetStartPageToken().Do()
+	token, err := gd.api.Changes.GetStartPageToken(ctx, driveID)
 	if err != nil {
 		slog.Error("Failed to query the changes start token", "error", err)
 		return "", err
 	}
 
-	return resp.StartPageToken, nil
+	return token, nil
 }
 
+// QueryChanges returns the documents and sidecars of the folder that changed
+// since the start token. The changes of a folder in a shared drive are
+// queried for the drive. When recursive is set, the changes in the folders
+// nested below the folder are returned as well.
 func (gd *GoogleDriveContext) QueryChanges(
-	folderID, startToken string,
+	ctx context.Context,
+	folderID, driveID, startToken string,
+	recursive bool,
 ) (*types.DocumentChanges, error) {
 	slog.Debug(">>QueryChanges")
 	defer slog.Debug("<<QueryChanges")
 
-	documents := make([]*types.Document, 0)
+	all := make([]*drive.Change, 0)
 	pageToken := startToken
 
-	seen := make(map[string]bool)
-
 	for pageToken != "" {
 
 		// get the changes since the pageToken
-		changes, err := gd.driveService.Changes.
-			List(pageToken).
-			Fields("nextPageToken, newStartPageToken, changes(fileId, removed, file(id, name, parents, createdTime, modifiedTime, size))").
-			Do()
+		var changes *drive.ChangeList
+		err := gd.retry(ctx, "QueryChanges", func() error {
+			var err error
+			changes, err = gd.api.Changes.List(
+				ctx,
+				pageToken,
+				driveID,
+				"nextPageToken, newStartPageToken, changes(fileId, removed, file(id, name, mimeType, parents, trashed, createdTime, modifiedTime, size, headRevisionId, appProperties))",
+			)
+			return err
+		})
 		if err != nil {
 			slog.Error(
 				"Failed to query the drive changes using a start token",
@@ -137,79 +326,357 @@ func (gd *GoogleDriveContext) QueryChanges(
 			return nil, err
 		}
 
-		// build a Document from each file that's changed
+		// ignore drive changes
 		for _, change := range changes.Changes {
-			// ignore drive changes
-			if change.ChangeType == "drive" || change.Removed ||
-				change.File.Trashed {
-				continue
+			if change.ChangeType != "drive" {
+				all = append(all, change)
 			}
+		}
 
-			// is the file in the folder we're monitoring?
-			if !slices.Contains(change.File.Parents, folderID) {
-				slog.Warn(
-					"Document not in the folder we're monitoring",
-					"id",
-					change.File.Id,
-				)
-				continue
-			}
+		if changes.NextPageToken == "" {
+			pageToken = changes.NewStartPageToken
+			break
+		}
 
-			// We deduplicate the change notifications
-			if seen[change.File.Id] {
-				slog.Warn("Already processed document", "id", change.File.Id)
-				continue
-			}
+		pageToken = changes.NextPageToken
+	}
 
-			seen[change.File.Id] = true
+	folders, err := gd.watchedFolders(ctx, folderID, recursive, all)
+	if err != nil {
+		return nil, err
+	}
 
-			if seen[change.File.Name] {
-				slog.Warn("Already processed a document with this name", "name", change.File.Name)
-				continue
-			}
+	// build a Document from each file that's changed
+	contents := newFolderContents(folders)
+	for _, change := range all {
+		// a removed file has no parents left to check
+		if change.Removed {
+			contents.remove(change.FileId)
+			continue
+		}
+
+		// is the file in the folder we're monitoring?
+		if contents.parent(change.File) == "" {
+			slog.Warn(
+				"Document not in the folder we're monitoring",
+				"id",
+				change.File.Id,
+			)
+			continue
+		}
 
-			seen[change.File.Name] = true
-
-			// create a document structure to save
-			document, err := buildDocument(change.File)
-			if err != nil {
-				slog.Error(
-					"Failed to build the document from the Google Drive File",
-					"docName",
-					change.File.Name,
-					"error",
-					err,
-				)
-				continue
+		if change.File.Trashed {
+			contents.remove(change.File.Id)
+			continue
+		}
+
+		contents.add(change.File)
+	}
+
+	contents.changes.NextStartToken = pageToken
+
+	return contents.changes, nil
+}
+
+// ListFolder returns the documents and sidecars directly in the folder,
+// the same way QueryChanges returns the ones that changed. When recursive is
+// set, the files in the folders nested below it are returned as well. It is
+// used to find the files that were added before the folder was watched, or
+// that were missed while its channel was broken.
+func (gd *GoogleDriveContext) ListFolder(
+	ctx context.Context,
+	folderID, driveID string,
+	recursive bool,
+) (*types.DocumentChanges, error) {
+	slog.Debug(">>ListFolder")
+	defer slog.Debug("<<ListFolder")
+
+	folders, err := gd.watchedFolders(ctx, folderID, recursive, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	contents := newFolderContents(folders)
+
+	for batch := range slices.Chunk(slices.Sorted(maps.Keys(folders)), folderQueryBatchSize) {
+		req := FileListRequest{
+			Query:   inParentsQuery(batch) + " and trashed = false",
+			Fields:  "nextPageToken, files(id, name, mimeType, parents, createdTime, modifiedTime, size, headRevisionId, appProperties)",
+			DriveID: driveID,
+		}
+
+		err = gd.listFiles(ctx, "ListFolder", req, func(files *drive.FileList) error {
+			for _, file := range files.Files {
+				contents.add(file)
 			}
 
-			// add to the list of documents to return
-			documents = append(documents, document)
+			return nil
+		})
+		if err != nil {
+			slog.Error(
+				"Failed to list the files in the folder",
+				"folderID",
+				folderID,
+				"error",
+				err,
+			)
+			return nil, err
 		}
+	}
 
-		if changes.NextPageToken == "" {
-			pageToken = changes.NewStartPageToken
-			break
+	return contents.changes, nil
+}
+
+// The folders whose files are accepted: the watch folder, and when it is
+// watched recursively the folders nested below it. The tree is walked again
+// when one of the changes moves it.
+func (gd *GoogleDriveContext) watchedFolders(
+	ctx context.Context,
+	folderID string,
+	recursive bool,
+	changes []*drive.Change,
+) (map[string]bool, error) {
+	if !recursive {
+		return map[string]bool{folderID: true}, nil
+	}
+
+	folders, err := gd.ResolveFolderTree(ctx, folderID)
+	if err != nil || !changesFolderTree(folders, changes) {
+		return folders, err
+	}
+
+	slog.Info("A folder below the watch folder changed, resolving its folders again", "folderID", folderID)
+	gd.ForgetFolderTree(folderID)
+
+	return gd.ResolveFolderTree(ctx, folderID)
+}
+
+// The documents and sidecars found in a watch folder, or in the folders
+// below it. Each file is only added once, and only the first file with a
+// name.
+type folderContents struct {
+	folders map[string]bool
+	seen    map[string]bool
+	changes *types.DocumentChanges
+}
+
+func newFolderContents(folders map[string]bool) *folderContents {
+	return &folderContents{
+		folders: folders,
+		seen:    make(map[string]bool),
+		changes: &types.DocumentChanges{
+			Documents: make([]*types.Document, 0),
+			Sidecars:  make([]*types.SidecarFile, 0),
+			Removed:   make([]string, 0),
+		},
+	}
+}
+
+// The watched folder the file is in, empty when it isn't in one
+func (c *folderContents) parent(file *drive.File) string {
+	for _, id := range file.Parents {
+		if c.folders[id] {
+			return id
 		}
+	}
 
-		pageToken = changes.NextPageToken
+	return ""
+}
+
+// Only the last change of a file counts, so a file that was removed isn't
+// also processed
+func (c *folderContents) remove(id string) {
+	c.changes.Removed = append(c.changes.Removed, id)
+	c.changes.Documents = slices.DeleteFunc(c.changes.Documents, func(document *types.Document) bool {
+		return document.GoogleID == id
+	})
+}
+
+func (c *folderContents) add(file *drive.File) {
+	// folders and shortcuts have no content to process
+	if isFolderOrShortcut(file) {
+		slog.Info(
+			"Ignoring a folder or shortcut in the watch folder",
+			"id",
+			file.Id,
+			"name",
+			file.Name,
+			"mimeType",
+			file.MimeType,
+		)
+		return
+	}
+
+	// never ingest files that we saved ourselves
+	if isScriptorOutput(file) {
+		slog.Warn(
+			"Ignoring a file saved by Scriptor in the watch folder",
+			"id",
+			file.Id,
+			"name",
+			file.Name,
+		)
+		c.changes.OutputsSkipped++
+		return
 	}
 
-	dc := &types.DocumentChanges{
-		Documents:      documents,
-		NextStartToken: pageToken,
+	// We deduplicate the change notifications
+	if c.seen[file.Id] {
+		slog.Warn("Already processed document", "id", file.Id)
+		return
 	}
 
-	return dc, nil
+	c.seen[file.Id] = true
+
+	if c.seen[file.Name] {
+		slog.Warn("Already processed a document with this name", "name", file.Name)
+		return
+	}
+
+	c.seen[file.Name] = true
+
+	// sidecars carry the directives for a document and are never
+	// processed themselves
+	if sidecar.IsSidecar(file.Name) {
+		c.changes.Sidecars = append(c.changes.Sidecars, &types.SidecarFile{
+			GoogleID: file.Id,
+			Name:     file.Name,
+			FolderID: c.parent(file),
+		})
+		return
+	}
+
+	// create a document structure to save
+	document, err := buildDocument(file)
+	if err != nil {
+		slog.Error(
+			"Failed to build the document from the Google Drive File",
+			"docName",
+			file.Name,
+			"error",
+			err,
+		)
+		return
+	}
+
+	// the file can have other parents besides the folder it was found in
+	document.GoogleFolderID = c.parent(file)
+
+	// add to the list of documents to return
+	c.changes.Documents = append(c.changes.Documents, document)
 }
 
-func (gd *GoogleDriveContext) GetDocument(id string) (*types.Document, error) {
+// FindSidecar returns the sidecar of the document in the folder, nil when
+// the document has none.
+func (gd *GoogleDriveContext) FindSidecar(
+	ctx context.Context,
+	folderID, documentName string,
+) (*types.SidecarFile, error) {
+	names := sidecar.Names(documentName)
+
+	clauses := make([]string, 0, len(names))
+	for _, name := range names {
+		clauses = append(clauses, fmt.Sprintf("name = '%s'", queryEscaper.Replace(name)))
+	}
+
+	files, err := gd.api.Files.List(ctx, FileListRequest{
+		Query: fmt.Sprintf(
+			"(%s) and '%s' in parents and trashed = false",
+			strings.Join(clauses, " or "),
+			queryEscaper.Replace(folderID),
+		),
+		Fields: "files(id, name)",
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to search for the sidecar: %w", err)
+	}
+
+	// the text sidecar wins when there are both
+	for _, name := range names {
+		for _, file := range files.Files {
+			if file.Name == name {
+				return &types.SidecarFile{GoogleID: file.Id, Name: file.Name, FolderID: folderID}, nil
+			}
+		}
+	}
+
+	return nil, nil
+}
+
+// ReadSidecar returns the content of the sidecar, which can't be larger
+// than sidecar.MAX_SIZE.
+func (gd *GoogleDriveContext) ReadSidecar(ctx context.Context, id string) (string, error) {
+	resp, err := gd.api.Files.Download(ctx, id)
+	if err != nil {
+		return "", fmt.Errorf("unable to download the sidecar: %w", err)
+	}
+	defer resp.Body.Close()
+
+	content, err := io.ReadAll(io.LimitReader(resp.Body, sidecar.MAX_SIZE+1))
+	if err != nil {
+		return "", fmt.Errorf("unable to read the sidecar: %w", err)
+	}
+
+	if len(content) > sidecar.MAX_SIZE {
+		return "", fmt.Errorf("sidecar is larger than %d bytes", sidecar.MAX_SIZE)
+	}
+
+	return string(content), nil
+}
+
+// FindDocument returns the document for the file with the name in the
+// folder, nil when there is no such file. Files saved by Scriptor are never
+// documents.
+func (gd *GoogleDriveContext) FindDocument(
+	ctx context.Context,
+	folderID, name string,
+) (*types.Document, error) {
+	files, err := gd.api.Files.List(ctx, FileListRequest{
+		Query: fmt.Sprintf(
+			"name = '%s' and '%s' in parents and trashed = false",
+			queryEscaper.Replace(name),
+			queryEscaper.Replace(folderID),
+		),
+		Fields: "files(id, name, mimeType, parents, createdTime, modifiedTime, size, headRevisionId, appProperties)",
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to search for the document: %w", err)
+	}
+
+	for _, file := range files.Files {
+		if !isScriptorOutput(file) {
+			return buildDocument(file)
+		}
+	}
+
+	return nil, nil
+}
+
+// Files saved by Scriptor carry the output app property. Who owns a file
+// says nothing, an impersonated user owns the files they upload as well.
+func isScriptorOutput(file *drive.File) bool {
+	return file.AppProperties[SCRIPTOR_OUTPUT_PROPERTY] == "true"
+}
+
+func isFolderOrShortcut(file *drive.File) bool {
+	return file.MimeType == GOOGLE_FOLDER_MIME_TYPE ||
+		file.MimeType == GOOGLE_SHORTCUT_MIME_TYPE
+}
+
+func (gd *GoogleDriveContext) GetDocument(ctx context.Context, id string) (*types.Document, error) {
 	slog.Debug(">>GetDocument")
 	defer slog.Debug("<<GetDocument")
 
-	file, err := gd.driveService.Files.Get(id).
-		Fields("id, name, parents, createdTime, modifiedTime, size").
-		Do()
+	var file *drive.File
+	err := gd.retry(ctx, "GetDocument", func() error {
+		var err error
+		file, err = gd.api.Files.Get(
+			ctx,
+			id,
+			"id, name, mimeType, parents, createdTime, modifiedTime, size, headRevisionId",
+		)
+		return err
+	})
 	if err != nil {
 		slog.Error("Failed to get document by ID", "id", id, "error", err)
 		return nil, err
@@ -224,6 +691,22 @@ func (gd *GoogleDriveContext) GetDocument(id string) (*types.Document, error) {
 	return document, nil
 }
 
+// The document ID is derived from the file and its revision, so every
+// notification of the same revision builds the same document and only the
+// first one saved is processed. Files Drive reports no revision for use
+// their modified time instead.
+func documentID(file *drive.File) string {
+	source := fmt.Sprintf("https://drive.google.com/file/d/%s", file.Id)
+	switch {
+	case file.HeadRevisionId != "":
+		source += "?revision=" + file.HeadRevisionId
+	case file.ModifiedTime != "":
+		source += "?modified=" + file.ModifiedTime
+	}
+
+	return uuid.NewSHA1(uuid.NameSpaceURL, []byte(source)).String()
+}
+
 func buildDocument(file *drive.File) (*types.Document, error) {
 	createdTime, err := time.Parse(time.RFC3339, file.CreatedTime)
 	if err != nil {
@@ -257,45 +740,169 @@ func buildDocument(file *drive.File) (*types.Document, error) {
 		return nil, err
 	}
 
+	// files shared with the service account on their own have no parent
+	// it can see. The folder of a file found in a watch folder is set to
+	// the parent that matched.
+	var folderID string
+	if len(file.Parents) > 0 {
+		folderID = file.Parents[0]
+	}
+
 	document := &types.Document{
-		ID:             uuid.New().String(),
-		SourceType:     types.DOCUMENT_SOURCE_GOOGLE_DRIVE,
-		SourceKey:      fmt.Sprintf("%s:%s", types.DOCUMENT_SOURCE_GOOGLE_DRIVE, file.Id),
-		GoogleID:       file.Id,
-		GoogleFolderID: file.Parents[0],
-		Name:           file.Name,
-		Size:           file.Size,
-		CreatedTime:    createdTime,
-		ModifiedTime:   modifiedTime,
+		ID:              documentID(file),
+		SourceType:      types.DOCUMENT_SOURCE_GOOGLE_DRIVE,
+		SourceKey:       fmt.Sprintf("%s:%s", types.DOCUMENT_SOURCE_GOOGLE_DRIVE, file.Id),
+		GoogleID:        file.Id,
+		GoogleFolderID:  folderID,
+		GoogleParentIDs: slices.Clone(file.Parents),
+		Name:            file.Name,
+		MimeType:        file.MimeType,
+		Size:            file.Size,
+		CreatedTime:     createdTime,
+		ModifiedTime:    modifiedTime,
+		HeadRevisionID:  file.HeadRevisionId,
+		Version:         1,
+
+		TaggedDocumentID: file.AppProperties[SCRIPTOR_DOCUMENT_PROPERTY],
+		TaggedRevisionID: file.AppProperties[SCRIPTOR_REVISION_PROPERTY],
 	}
 
 	return document, nil
 }
 
-func (gd *GoogleDriveContext) Archive(id string, archiveFolderID string) error {
-	// 	// move the document to the archive folder
-	file, err := gd.driveService.Files.Get(id).Fields("parents").Do()
+// Archive moves the file to the archive folder. A file that is already in
+// the archive folder, from an earlier attempt or moved there by hand, is
+// left alone. A file that is gone fails with ErrFileGone.
+func (gd *GoogleDriveContext) Archive(ctx context.Context, id string, archiveFolderID string) error {
+	// a retry finds the file archived when the move went through
+	err := gd.retry(ctx, "Archive", func() error {
+		return gd.archive(ctx, id, archiveFolderID)
+	})
+	if IsNotFoundError(err) {
+		return fmt.Errorf("%w: %s: %w", ErrFileGone, id, err)
+	}
+
+	return err
+}
+
+// The parents are read right before the move, so the file is only taken
+// out of the folders it is in now
+func (gd *GoogleDriveContext) archive(ctx context.Context, id string, archiveFolderID string) error {
+	file, err := gd.api.Files.Get(ctx, id, "parents")
 	if err != nil {
 		return err
 	}
 
+	if slices.Contains(file.Parents, archiveFolderID) {
+		slog.Info("File is already archived", "id", id, "folderID", archiveFolderID)
+		return nil
+	}
+
 	previousParents := strings.Join(file.Parents, ",")
-	_, err = gd.driveService.Files.Update(id, nil).
-		AddParents(archiveFolderID).
-		RemoveParents(previousParents).
-		Fields("id, parents").
-		Do()
+	return gd.api.Files.Update(ctx, id, nil, archiveFolderID, previousParents)
+}
+
+// CopyFile copies the file to the folder under the same name. The copy is
+// tagged like the files Scriptor saves so it's never ingested.
+func (gd *GoogleDriveContext) CopyFile(ctx context.Context, documentID, id, folderID string) error {
+	copied := &drive.File{
+		Parents: []string{folderID},
+		AppProperties: map[string]string{
+			SCRIPTOR_OUTPUT_PROPERTY:   "true",
+			SCRIPTOR_DOCUMENT_PROPERTY: documentID,
+		},
+	}
+
+	_, err := gd.api.Files.Copy(ctx, id, copied)
 	if err != nil {
-		return err
+		return fmt.Errorf("unable to copy the file: %w", err)
+	}
+
+	return nil
+}
+
+// SetAppProperties sets the app properties on the file, leaving its other
+// properties as they are.
+func (gd *GoogleDriveContext) SetAppProperties(
+	ctx context.Context,
+	id string,
+	properties map[string]string,
+) error {
+	err := gd.api.Files.Update(ctx, id, &drive.File{AppProperties: properties}, "", "")
+	if err != nil {
+		return fmt.Errorf("unable to set the app properties: %w", err)
 	}
 
 	return nil
 }
 
-// Get a io.Reader for the document
-func (gd *GoogleDriveContext) GetReader(document *types.Document) (io.ReadCloser, error) {
-	// Get the file data
-	resp, err := gd.driveService.Files.Get(document.GoogleID).Download()
+// AddComment adds a comment to the file that everyone who can see the file
+// can read.
+func (gd *GoogleDriveContext) AddComment(ctx context.Context, fileID, text string) error {
+	err := gd.api.Comments.Create(ctx, fileID, &drive.Comment{Content: text})
+	if err != nil {
+		return fmt.Errorf("unable to add the comment: %w", err)
+	}
+
+	return nil
+}
+
+// FolderLink returns the link to open the folder in Drive.
+func FolderLink(folderID string) string {
+	return fmt.Sprintf(DRIVE_FOLDER_URL, folderID)
+}
+
+// ProcessedProperties are the app properties that tag the original of the
+// document once it has been processed.
+func ProcessedProperties(
+	document *types.Document,
+	processedAt time.Time,
+	status string,
+) map[string]string {
+	return map[string]string{
+		SCRIPTOR_DOCUMENT_PROPERTY:     document.ID,
+		SCRIPTOR_PROCESSED_AT_PROPERTY: processedAt.UTC().Format(time.RFC3339),
+		SCRIPTOR_STATUS_PROPERTY:       status,
+		SCRIPTOR_REVISION_PROPERTY:     document.HeadRevisionID,
+	}
+}
+
+// ProcessedComment is the comment left on the original once its note was
+// published to the destination folder.
+func ProcessedComment(destFolderID string) string {
+	return "Processed successfully → " + FolderLink(destFolderID)
+}
+
+// FailedComment is the comment left on the original when a stage failed to
+// process it.
+func FailedComment(stage, reason string) string {
+	return fmt.Sprintf("Processing failed at %s: %s", stage, reason)
+}
+
+// IsGoogleAppsDocument reports whether the MIME type is a native Google format
+// that has to be exported rather than downloaded.
+func IsGoogleAppsDocument(mimeType string) bool {
+	return strings.HasPrefix(mimeType, GOOGLE_APPS_MIME_TYPE_PREFIX)
+}
+
+// Get a io.Reader for the document. Native Google documents are exported as
+// PDF, everything else is downloaded as-is.
+func (gd *GoogleDriveContext) GetReader(
+	ctx context.Context,
+	document *types.Document,
+) (io.ReadCloser, error) {
+	var resp *http.Response
+
+	// only opening the download is retried, the body is read by the caller
+	err := gd.retry(ctx, "GetReader", func() error {
+		var err error
+		if IsGoogleAppsDocument(document.MimeType) {
+			resp, err = gd.api.Files.Export(ctx, document.GoogleID, GOOGLE_EXPORT_MIME_TYPE)
+		} else {
+			resp, err = gd.api.Files.Download(ctx, document.GoogleID)
+		}
+		return err
+	})
 	if err != nil {
 		slog.Error(
 			"Unable to get the file reader",
@@ -311,18 +918,75 @@ func (gd *GoogleDriveContext) GetReader(document *types.Document) (io.ReadCloser
 	return resp.Body, nil
 }
 
-// Save a file to a Google Drive folder location
-func (gd *GoogleDriveContext) SaveFile(fileName, folderID string, reader io.Reader) error {
+// Save a file for the document to a Google Drive folder location with the
+// content type. An empty content type is found from the extension of the
+// file name.
+func (gd *GoogleDriveContext) SaveFile(
+	ctx context.Context,
+	documentID, fileName, folderID, contentType string,
+	reader io.Reader,
+) error {
+	return gd.SaveFileAs(ctx, documentID, fileName, folderID, contentType, "", reader)
+}
+
+// Save a file for the document to a Google Drive folder location converting
+// it from the source MIME type to the target. A Google Workspace target, such
+// as types.CONTENT_TYPE_GOOGLE_DOC, has Drive import the file as a native
+// document. An empty source MIME type is found from the extension of the
+// file name, and an empty target keeps the file as the source type.
+func (gd *GoogleDriveContext) SaveFileAs(
+	ctx context.Context,
+	documentID, fileName, folderID string,
+	sourceMimeType, targetMimeType string,
+	reader io.Reader,
+) error {
+	if sourceMimeType == "" {
+		sourceMimeType = contentTypeOf(fileName)
+	}
+	if targetMimeType == "" {
+		targetMimeType = sourceMimeType
+	}
+
 	// Define file metadata (including folder destination)
 	fileMetadata := &drive.File{
-		Name:    fileName,
-		Parents: []string{folderID}, // Upload to specific folder
+		Name:     fileName,
+		Parents:  []string{folderID}, // Upload to specific folder
+		MimeType: targetMimeType,
+		AppProperties: map[string]string{
+			SCRIPTOR_OUTPUT_PROPERTY:   "true",
+			SCRIPTOR_DOCUMENT_PROPERTY: documentID,
+		},
+	}
+
+	upload := func() error {
+		_, err := gd.api.Files.Create(
+			ctx,
+			fileMetadata,
+			reader,
+			googleapi.ContentType(sourceMimeType),
+		)
+		return err
 	}
 
-	// Upload the file
-	_, err := gd.driveService.Files.Create(fileMetadata).
-		Media(reader).
-		Do()
+	// Upload the file. The content can only be sent again when the reader
+	// can go back to its start.
+	var err error
+	if seeker, ok := reader.(io.Seeker); ok {
+		var start int64
+		start, err = seeker.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return fmt.Errorf("unable to upload file: %w", err)
+		}
+
+		err = gd.retry(ctx, "SaveFile", func() error {
+			if _, err := seeker.Seek(start, io.SeekStart); err != nil {
+				return err
+			}
+			return upload()
+		})
+	} else {
+		err = upload()
+	}
 	if err != nil {
 		return fmt.Errorf("unable to upload file: %w", err)
 	}
@@ -330,7 +994,143 @@ func (gd *GoogleDriveContext) SaveFile(fileName, folderID string, reader io.Read
 	return nil
 }
 
-func (gd *GoogleDriveContext) CreateWatchChannel(wc *types.WatchChannel) (string, error) {
+// The content type of a file from the extension of its name
+func contentTypeOf(fileName string) string {
+	ext := strings.ToLower(filepath.Ext(fileName))
+	if contentType, ok := uploadContentTypes[ext]; ok {
+		return contentType
+	}
+
+	mediaType, _, err := mime.ParseMediaType(mime.TypeByExtension(ext))
+	if err != nil {
+		return DEFAULT_UPLOAD_MIME_TYPE
+	}
+
+	return mediaType
+}
+
+// FileExists reports whether the file was already saved to the folder for
+// the document.
+func (gd *GoogleDriveContext) FileExists(
+	ctx context.Context,
+	documentID, fileName, folderID string,
+) (bool, error) {
+	id, err := gd.SavedFileID(ctx, documentID, fileName, folderID)
+	return id != "", err
+}
+
+// SavedFileID returns the ID of the file saved to the folder for the document
+// under the name, empty when there is none.
+func (gd *GoogleDriveContext) SavedFileID(
+	ctx context.Context,
+	documentID, fileName, folderID string,
+) (string, error) {
+	files, err := gd.api.Files.List(ctx, FileListRequest{
+		Query:    savedFileQuery(documentID, fileName, folderID),
+		Fields:   "files(id)",
+		PageSize: 1,
+	})
+	if err != nil {
+		return "", fmt.Errorf("unable to search for file: %w", err)
+	}
+
+	if len(files.Files) == 0 {
+		return "", nil
+	}
+
+	return files.Files[0].Id, nil
+}
+
+// ReadSavedFile returns the content of the file saved to the folder for the
+// document under the name, as Drive stored it.
+func (gd *GoogleDriveContext) ReadSavedFile(
+	ctx context.Context,
+	documentID, fileName, folderID string,
+) ([]byte, error) {
+	files, err := gd.api.Files.List(ctx, FileListRequest{
+		Query:    savedFileQuery(documentID, fileName, folderID),
+		Fields:   "files(id)",
+		PageSize: 1,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to search for file: %w", err)
+	}
+
+	if len(files.Files) == 0 {
+		return nil, fmt.Errorf("saved file %q was not found", fileName)
+	}
+
+	resp, err := gd.api.Files.Download(ctx, files.Files[0].Id)
+	if err != nil {
+		return nil, fmt.Errorf("unable to download the saved file: %w", err)
+	}
+	defer resp.Body.Close()
+
+	return io.ReadAll(resp.Body)
+}
+
+// TrashSavedFile moves the files saved to the folder for the document under
+// the name to the trash. Nothing happens when there are none.
+func (gd *GoogleDriveContext) TrashSavedFile(
+	ctx context.Context,
+	documentID, fileName, folderID string,
+) error {
+	return gd.trashFiles(ctx, savedFileQuery(documentID, fileName, folderID))
+}
+
+// TrashDocumentFiles moves every file saved to the folder for the document
+// to the trash, whatever its name. The files are found by the document ID in
+// their app properties. Nothing happens when there are none.
+func (gd *GoogleDriveContext) TrashDocumentFiles(
+	ctx context.Context,
+	documentID, folderID string,
+) error {
+	return gd.trashFiles(ctx, documentFilesQuery(documentID, folderID))
+}
+
+func (gd *GoogleDriveContext) trashFiles(ctx context.Context, query string) error {
+	files, err := gd.api.Files.List(ctx, FileListRequest{Query: query, Fields: "files(id)"})
+	if err != nil {
+		return fmt.Errorf("unable to search for file: %w", err)
+	}
+
+	for _, file := range files.Files {
+		err = gd.api.Files.Update(ctx, file.Id, &drive.File{Trashed: true}, "", "")
+		if err != nil {
+			return fmt.Errorf("unable to trash the file: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// Drive query for a file saved for the document
+func savedFileQuery(documentID, fileName, folderID string) string {
+	return fmt.Sprintf(
+		"name = '%s' and %s",
+		queryEscaper.Replace(fileName),
+		documentFilesQuery(documentID, folderID),
+	)
+}
+
+// Drive query for every file saved to the folder for the document
+func documentFilesQuery(documentID, folderID string) string {
+	return fmt.Sprintf(
+		"'%s' in parents and appProperties has { key='%s' and value='%s' } and trashed = false",
+		queryEscaper.Replace(folderID),
+		SCRIPTOR_DOCUMENT_PROPERTY,
+		queryEscaper.Replace(documentID),
+	)
+}
+
+// CreateWatchChannel watches the folder of the channel with the ID, token,
+// expiry and webhook URL already set on it, and returns the ID of the
+// resource Drive watches. The register lambda makes the identity of the
+// channel, this only asks Drive to send it the notifications.
+func (gd *GoogleDriveContext) CreateWatchChannel(
+	ctx context.Context,
+	wc *types.WatchChannel,
+) (string, error) {
 	slog.Debug(">>createWatchChannel")
 	defer slog.Debug("<<createWatchChannel")
 
@@ -338,11 +1138,17 @@ func (gd *GoogleDriveContext) CreateWatchChannel(wc *types.WatchChannel) (string
 		Id:         wc.ChannelID,
 		Address:    wc.WebhookUrl,
 		Expiration: wc.ExpiresAt,
+		Token:      wc.Token,
 		Type:       "web_hook",
 	}
 
 	// Watch for changes in the folder
-	channel, err := gd.driveService.Files.Watch(wc.FolderID, req).Do()
+	var channel *drive.Channel
+	err := gd.retry(ctx, "CreateWatchChannel", func() error {
+		var err error
+		channel, err = gd.api.Channels.Watch(ctx, wc.FolderID, req)
+		return err
+	})
 	if err != nil {
 		slog.Error(
 			"Failed to watch folder",
@@ -357,7 +1163,13 @@ func (gd *GoogleDriveContext) CreateWatchChannel(wc *types.WatchChannel) (string
 	return channel.ResourceId, nil
 }
 
-func (gd *GoogleDriveContext) StopWatchChannel(channelID, resourceID string) error {
+// StopWatchChannel stops Drive sending the notifications of the channel. A
+// channel Drive no longer knows, because it expired or was already stopped,
+// is stopped.
+func (gd *GoogleDriveContext) StopWatchChannel(
+	ctx context.Context,
+	channelID, resourceID string,
+) error {
 	slog.Debug(">>stopWatchChannel")
 	defer slog.Debug("<<stopWatchChannel")
 
@@ -366,7 +1178,11 @@ func (gd *GoogleDriveContext) StopWatchChannel(channelID, resourceID string) err
 		ResourceId: resourceID,
 	}
 
-	err := gd.driveService.Channels.Stop(req).Context(gd.ctx).Do()
+	err := gd.api.Channels.Stop(ctx, req)
+	if IsNotFoundError(err) {
+		slog.Info("The channel was already stopped", "channelID", channelID, "resourceID", resourceID)
+		return nil
+	}
 	if err != nil {
 		slog.Warn("Failed to stop the channel", "channelID", channelID, "resourceID", resourceID, "error", err)
 		return err
@@ -374,3 +1190,52 @@ func (gd *GoogleDriveContext) StopWatchChannel(channelID, resourceID string) err
 
 	return nil
 }
+
+// IsRetryableError reports whether a Drive request failed in a way that is
+// worth retrying. Rate limits, including the ones Drive answers with a 403,
+// and server errors are retried, as are connections that are reset or cut
+// off part way through a download. Other API errors such as 401, 403 and 404
+// will fail the same way again.
+func IsRetryableError(err error) bool {
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		switch apiErr.Code {
+		case http.StatusTooManyRequests,
+			http.StatusInternalServerError,
+			http.StatusBadGateway,
+			http.StatusServiceUnavailable:
+			return true
+		case http.StatusForbidden:
+			return isRateLimited(apiErr)
+		}
+		return false
+	}
+
+	if errors.Is(err, context.Canceled) ||
+		errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET)
+}
+
+// Drive answers some rate limits with a 403 and gives the reason
+func isRateLimited(apiErr *googleapi.Error) bool {
+	for _, item := range apiErr.Errors {
+		if item.Reason == "userRateLimitExceeded" || item.Reason == "rateLimitExceeded" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// IsNotFoundError reports whether a Drive request failed because the file
+// no longer exists or was moved somewhere the service account can't see.
+func IsNotFoundError(err error) bool {
+	var apiErr *googleapi.Error
+	return errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound
+}
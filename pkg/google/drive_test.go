@@ -0,0 +1,1352 @@
+package google
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/KyleBrandon/scriptor/pkg/types"
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+)
+
+func TestIsScriptorOutput(t *testing.T) {
+	tests := []struct {
+		name string
+		file *drive.File
+		want bool
+	}{
+		{
+			name: "file added by the user",
+			file: &drive.File{Name: "scan.pdf"},
+		},
+		{
+			name: "file saved by Scriptor",
+			file: &drive.File{
+				Name:          "scan.pdf",
+				AppProperties: map[string]string{SCRIPTOR_OUTPUT_PROPERTY: "true"},
+				OwnedByMe:     true,
+			},
+			want: true,
+		},
+		{
+			// uploaded by the user Drive is called as
+			name: "file owned by the caller",
+			file: &drive.File{Name: "scan.pdf", OwnedByMe: true},
+		},
+		{
+			name: "unrelated app properties",
+			file: &drive.File{
+				Name:          "scan.pdf",
+				AppProperties: map[string]string{"other": "true"},
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := isScriptorOutput(tc.file); got != tc.want {
+				t.Fatalf("unexpected result: got %v want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestIsRetryableError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "rate limited", err: &googleapi.Error{Code: http.StatusTooManyRequests}, want: true},
+		{name: "server error", err: &googleapi.Error{Code: http.StatusInternalServerError}, want: true},
+		{name: "bad gateway", err: &googleapi.Error{Code: http.StatusBadGateway}, want: true},
+		{name: "unavailable", err: &googleapi.Error{Code: http.StatusServiceUnavailable}, want: true},
+		{name: "forbidden", err: &googleapi.Error{Code: http.StatusForbidden}},
+		{
+			name: "user rate limit",
+			err: &googleapi.Error{
+				Code:   http.StatusForbidden,
+				Errors: []googleapi.ErrorItem{{Reason: "userRateLimitExceeded"}},
+			},
+			want: true,
+		},
+		{
+			name: "rate limit",
+			err: &googleapi.Error{
+				Code:   http.StatusForbidden,
+				Errors: []googleapi.ErrorItem{{Reason: "rateLimitExceeded"}},
+			},
+			want: true,
+		},
+		{
+			name: "insufficient permissions",
+			err: &googleapi.Error{
+				Code:   http.StatusForbidden,
+				Errors: []googleapi.ErrorItem{{Reason: "insufficientFilePermissions"}},
+			},
+		},
+		{name: "unauthorized", err: &googleapi.Error{Code: http.StatusUnauthorized}},
+		{name: "not found", err: &googleapi.Error{Code: http.StatusNotFound}},
+		{
+			name: "wrapped server error",
+			err:  fmt.Errorf("download: %w", &googleapi.Error{Code: http.StatusInternalServerError}),
+			want: true,
+		},
+		{name: "connection reset", err: fmt.Errorf("read: %w", syscall.ECONNRESET), want: true},
+		{name: "truncated body", err: io.ErrUnexpectedEOF, want: true},
+		{name: "network error", err: &net.OpError{Op: "read", Err: errors.New("broken pipe")}, want: true},
+		{name: "deadline exceeded", err: context.DeadlineExceeded},
+		{name: "other error", err: errors.New("boom")},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := IsRetryableError(tc.err); got != tc.want {
+				t.Fatalf("unexpected result: got %v want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestBuildDocumentRecordsRevision(t *testing.T) {
+	document, err := buildDocument(&drive.File{
+		Id:             "file-1",
+		Name:           "scan.pdf",
+		Parents:        []string{"folder-1"},
+		CreatedTime:    "2026-03-11T23:30:00Z",
+		ModifiedTime:   "2026-03-12T08:00:00Z",
+		HeadRevisionId: "rev-2",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if document.HeadRevisionID != "rev-2" {
+		t.Fatalf("unexpected revision: got %q want %q", document.HeadRevisionID, "rev-2")
+	}
+
+	if document.Version != 1 {
+		t.Fatalf("unexpected version: got %d want 1", document.Version)
+	}
+}
+
+func TestBuildDocumentIDFollowsRevision(t *testing.T) {
+	build := func(fileID, revision string, modified ...string) string {
+		modifiedTime := "2026-03-12T08:00:00Z"
+		if len(modified) > 0 {
+			modifiedTime = modified[0]
+		}
+
+		document, err := buildDocument(&drive.File{
+			Id:             fileID,
+			Name:           "scan.pdf",
+			Parents:        []string{"folder-1"},
+			CreatedTime:    "2026-03-11T23:30:00Z",
+			ModifiedTime:   modifiedTime,
+			HeadRevisionId: revision,
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		return document.ID
+	}
+
+	first := build("file-1", "rev-1")
+	if again := build("file-1", "rev-1"); again != first {
+		t.Fatalf("same revision built different IDs: %q and %q", first, again)
+	}
+
+	for _, other := range []string{
+		build("file-1", "rev-2"),
+		build("file-2", "rev-1"),
+		build("file-1", ""),
+	} {
+		if other == first {
+			t.Fatalf("different files or revisions built the same ID %q", first)
+		}
+	}
+
+	// the revision wins over the modified time, without one the modified
+	// time tells the versions apart
+	if build("file-1", "rev-1", "2026-03-13T08:00:00Z") != first {
+		t.Fatal("the modified time changed the ID of a revision")
+	}
+	if build("file-1", "") == build("file-1", "", "2026-03-13T08:00:00Z") {
+		t.Fatal("a modified file without a revision built the same ID")
+	}
+}
+
+func TestBuildDocumentEdgeCases(t *testing.T) {
+	file := func(change func(file *drive.File)) *drive.File {
+		file := &drive.File{
+			Id:           "file-1",
+			Name:         "scan.pdf",
+			MimeType:     types.CONTENT_TYPE_PDF,
+			Parents:      []string{"folder-1", "folder-2"},
+			CreatedTime:  "2026-03-11T23:30:00Z",
+			ModifiedTime: "2026-03-12T08:00:00+01:00",
+			Size:         2048,
+		}
+		change(file)
+		return file
+	}
+
+	tests := []struct {
+		name    string
+		file    *drive.File
+		wantErr bool
+		check   func(document *types.Document) bool
+	}{
+		{
+			name: "every field",
+			file: file(func(*drive.File) {}),
+			check: func(document *types.Document) bool {
+				return document.GoogleID == "file-1" && document.GoogleFolderID == "folder-1" &&
+					slices.Equal(document.GoogleParentIDs, []string{"folder-1", "folder-2"}) &&
+					document.SourceType == types.DOCUMENT_SOURCE_GOOGLE_DRIVE &&
+					document.SourceKey == types.DOCUMENT_SOURCE_GOOGLE_DRIVE+":file-1" &&
+					document.MimeType == types.CONTENT_TYPE_PDF && document.Size == 2048 &&
+					document.ModifiedTime.Equal(time.Date(2026, 3, 12, 7, 0, 0, 0, time.UTC))
+			},
+		},
+		{
+			// a file shared on its own has no parent the service account
+			// can see
+			name: "no parents",
+			file: file(func(file *drive.File) { file.Parents = nil }),
+			check: func(document *types.Document) bool {
+				return document.GoogleFolderID == "" && len(document.GoogleParentIDs) == 0
+			},
+		},
+		{
+			name: "one parent",
+			file: file(func(file *drive.File) { file.Parents = []string{"folder-2"} }),
+			check: func(document *types.Document) bool {
+				return document.GoogleFolderID == "folder-2" &&
+					slices.Equal(document.GoogleParentIDs, []string{"folder-2"})
+			},
+		},
+		{
+			name: "no app properties",
+			file: file(func(file *drive.File) { file.AppProperties = nil }),
+			check: func(document *types.Document) bool {
+				return document.TaggedDocumentID == "" && document.TaggedRevisionID == ""
+			},
+		},
+		{
+			name:    "no created time",
+			file:    file(func(file *drive.File) { file.CreatedTime = "" }),
+			wantErr: true,
+		},
+		{
+			name:    "created time without a zone",
+			file:    file(func(file *drive.File) { file.CreatedTime = "2026-03-11 23:30:00" }),
+			wantErr: true,
+		},
+		{
+			name:    "no modified time",
+			file:    file(func(file *drive.File) { file.ModifiedTime = "" }),
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			document, err := buildDocument(tc.file)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if err == nil && !tc.check(document) {
+				t.Fatalf("unexpected document: %+v", document)
+			}
+		})
+	}
+}
+
+func TestSavedFileQuery(t *testing.T) {
+	got := savedFileQuery("doc-1", `Tom's \ notes.md`, "folder")
+	want := `name = 'Tom\'s \\ notes.md' and 'folder' in parents and ` +
+		`appProperties has { key='scriptor_document_id' and value='doc-1' } and trashed = false`
+
+	if got != want {
+		t.Fatalf("unexpected query:\ngot  %s\nwant %s", got, want)
+	}
+
+	got = documentFilesQuery("doc-1", "folder")
+	want = `'folder' in parents and ` +
+		`appProperties has { key='scriptor_document_id' and value='doc-1' } and trashed = false`
+
+	if got != want {
+		t.Fatalf("unexpected query:\ngot  %s\nwant %s", got, want)
+	}
+}
+
+func TestBuildDocumentReadsTags(t *testing.T) {
+	document, err := buildDocument(&drive.File{
+		Id:             "file-1",
+		Name:           "scan.pdf",
+		Parents:        []string{"folder-1"},
+		CreatedTime:    "2026-03-11T23:30:00Z",
+		ModifiedTime:   "2026-03-12T08:00:00Z",
+		HeadRevisionId: "rev-2",
+		AppProperties: map[string]string{
+			SCRIPTOR_DOCUMENT_PROPERTY: "doc-1",
+			SCRIPTOR_REVISION_PROPERTY: "rev-1",
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if document.TaggedDocumentID != "doc-1" || document.TaggedRevisionID != "rev-1" {
+		t.Fatalf(
+			"unexpected tags: got %q %q",
+			document.TaggedDocumentID,
+			document.TaggedRevisionID,
+		)
+	}
+}
+
+func TestAddComment(t *testing.T) {
+	var method, path, fields string
+	var body drive.Comment
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method, path = r.Method, r.URL.Path
+		fields = r.URL.Query().Get("fields")
+		json.NewDecoder(r.Body).Decode(&body)
+		json.NewEncoder(w).Encode(&drive.Comment{Id: "comment-1"})
+	}))
+	t.Cleanup(server.Close)
+
+	service, err := drive.NewService(
+		context.Background(),
+		option.WithEndpoint(server.URL+"/"),
+		option.WithHTTPClient(server.Client()),
+	)
+	if err != nil {
+		t.Fatalf("failed to create the Drive service: %v", err)
+	}
+
+	gd := &GoogleDriveContext{api: NewDriveAPI(service)}
+
+	if err := gd.AddComment(context.Background(), "file-1", "Processed successfully"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if method != http.MethodPost || path != "/files/file-1/comments" || fields != "id" {
+		t.Fatalf("unexpected request: %s %s fields=%s", method, path, fields)
+	}
+
+	if body.Content != "Processed successfully" {
+		t.Fatalf("unexpected comment: %q", body.Content)
+	}
+}
+
+func TestCopyFile(t *testing.T) {
+	var method, path string
+	var body drive.File
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method, path = r.Method, r.URL.Path
+		json.NewDecoder(r.Body).Decode(&body)
+		json.NewEncoder(w).Encode(&drive.File{Id: "copy-1"})
+	}))
+	t.Cleanup(server.Close)
+
+	service, err := drive.NewService(
+		context.Background(),
+		option.WithEndpoint(server.URL+"/"),
+		option.WithHTTPClient(server.Client()),
+	)
+	if err != nil {
+		t.Fatalf("failed to create the Drive service: %v", err)
+	}
+
+	gd := &GoogleDriveContext{api: NewDriveAPI(service)}
+
+	if err := gd.CopyFile(context.Background(), "doc-1", "file-1", "archive"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if method != http.MethodPost || path != "/files/file-1/copy" {
+		t.Fatalf("unexpected request: %s %s", method, path)
+	}
+
+	// the copy keeps the name of the original and is tagged as an output
+	want := map[string]string{
+		SCRIPTOR_OUTPUT_PROPERTY:   "true",
+		SCRIPTOR_DOCUMENT_PROPERTY: "doc-1",
+	}
+	if body.Name != "" || !slices.Equal(body.Parents, []string{"archive"}) ||
+		!maps.Equal(body.AppProperties, want) {
+		t.Fatalf("unexpected copy: %+v", body)
+	}
+}
+
+func TestSaveFileContentType(t *testing.T) {
+	tests := []struct {
+		name        string
+		fileName    string
+		contentType string
+		target      string
+
+		wantMetadata string
+		wantMedia    string
+	}{
+		{
+			name:         "declared type",
+			fileName:     "scan",
+			contentType:  types.CONTENT_TYPE_PDF,
+			wantMetadata: types.CONTENT_TYPE_PDF,
+			wantMedia:    types.CONTENT_TYPE_PDF,
+		},
+		{
+			name:         "markdown by name",
+			fileName:     "Scan.MD",
+			wantMetadata: types.CONTENT_TYPE_MARKDOWN,
+			wantMedia:    types.CONTENT_TYPE_MARKDOWN,
+		},
+		{
+			name:         "docx by name",
+			fileName:     "scan.docx",
+			wantMetadata: "application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+			wantMedia:    "application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+		},
+		{
+			name:         "unknown name",
+			fileName:     "scan",
+			wantMetadata: DEFAULT_UPLOAD_MIME_TYPE,
+			wantMedia:    DEFAULT_UPLOAD_MIME_TYPE,
+		},
+		{
+			// Drive converts the upload
+			name:         "converted",
+			fileName:     "scan",
+			contentType:  types.CONTENT_TYPE_MARKDOWN,
+			target:       types.CONTENT_TYPE_GOOGLE_DOC,
+			wantMetadata: types.CONTENT_TYPE_GOOGLE_DOC,
+			wantMedia:    types.CONTENT_TYPE_MARKDOWN,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var metadata drive.File
+			var media string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+
+				// the metadata part and then the media part
+				parts := multipart.NewReader(r.Body, params["boundary"])
+				part, err := parts.NextPart()
+				if err == nil {
+					err = json.NewDecoder(part).Decode(&metadata)
+				}
+				if err == nil {
+					part, err = parts.NextPart()
+				}
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+
+				media = part.Header.Get("Content-Type")
+				json.NewEncoder(w).Encode(&drive.File{Id: "file-1"})
+			}))
+			t.Cleanup(server.Close)
+
+			service, err := drive.NewService(
+				context.Background(),
+				option.WithEndpoint(server.URL+"/"),
+				option.WithHTTPClient(server.Client()),
+			)
+			if err != nil {
+				t.Fatalf("failed to create the Drive service: %v", err)
+			}
+
+			gd := &GoogleDriveContext{api: NewDriveAPI(service)}
+
+			err = gd.SaveFileAs(
+				context.Background(),
+				"doc-1",
+				tc.fileName,
+				"dest",
+				tc.contentType,
+				tc.target,
+				strings.NewReader("the content"),
+			)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if metadata.MimeType != tc.wantMetadata || media != tc.wantMedia {
+				t.Fatalf("unexpected content types %q and %q", metadata.MimeType, media)
+			}
+		})
+	}
+}
+
+func TestTrashSavedFile(t *testing.T) {
+	var query string
+	trashed := make([]string, 0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			query = r.URL.Query().Get("q")
+			json.NewEncoder(w).Encode(&drive.FileList{
+				Files: []*drive.File{{Id: "part-1"}, {Id: "part-1-copy"}},
+			})
+		case http.MethodPatch:
+			var body drive.File
+			json.NewDecoder(r.Body).Decode(&body)
+			if body.Trashed {
+				trashed = append(trashed, strings.TrimPrefix(r.URL.Path, "/files/"))
+			}
+			json.NewEncoder(w).Encode(&drive.File{})
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	service, err := drive.NewService(
+		context.Background(),
+		option.WithEndpoint(server.URL+"/"),
+		option.WithHTTPClient(server.Client()),
+	)
+	if err != nil {
+		t.Fatalf("failed to create the Drive service: %v", err)
+	}
+
+	gd := &GoogleDriveContext{api: NewDriveAPI(service)}
+
+	if err := gd.TrashSavedFile(context.Background(), "doc-1", "scan - Part 3.md", "dest"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if query != savedFileQuery("doc-1", "scan - Part 3.md", "dest") {
+		t.Fatalf("unexpected query: %s", query)
+	}
+
+	if !slices.Equal(trashed, []string{"part-1", "part-1-copy"}) {
+		t.Fatalf("unexpected files trashed: %v", trashed)
+	}
+
+	// every file of the document, whatever its name
+	trashed = trashed[:0]
+	if err := gd.TrashDocumentFiles(context.Background(), "doc-1", "dest"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if query != documentFilesQuery("doc-1", "dest") {
+		t.Fatalf("unexpected query: %s", query)
+	}
+
+	if !slices.Equal(trashed, []string{"part-1", "part-1-copy"}) {
+		t.Fatalf("unexpected files trashed: %v", trashed)
+	}
+}
+
+func TestReadSavedFile(t *testing.T) {
+	var query string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/files":
+			query = r.URL.Query().Get("q")
+			files := []*drive.File{{Id: "note-1"}}
+			if strings.Contains(query, "missing.md") {
+				files = nil
+			}
+			json.NewEncoder(w).Encode(&drive.FileList{Files: files})
+		case "/files/note-1":
+			if r.URL.Query().Get("alt") != "media" {
+				http.Error(w, "not a download", http.StatusBadRequest)
+				return
+			}
+			w.Write([]byte("# Notes\r\n"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	service, err := drive.NewService(
+		context.Background(),
+		option.WithEndpoint(server.URL+"/"),
+		option.WithHTTPClient(server.Client()),
+	)
+	if err != nil {
+		t.Fatalf("failed to create the Drive service: %v", err)
+	}
+
+	gd := &GoogleDriveContext{api: NewDriveAPI(service)}
+
+	content, err := gd.ReadSavedFile(context.Background(), "doc-1", "scan.md", "dest")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if query != savedFileQuery("doc-1", "scan.md", "dest") {
+		t.Fatalf("unexpected query: %s", query)
+	}
+
+	// the content is returned as Drive stored it
+	if string(content) != "# Notes\r\n" {
+		t.Fatalf("unexpected content: %q", content)
+	}
+
+	if _, err := gd.ReadSavedFile(context.Background(), "doc-1", "missing.md", "dest"); err == nil {
+		t.Fatal("expected an error for a file that wasn't saved")
+	}
+}
+
+func TestSetAppProperties(t *testing.T) {
+	var method, path string
+	var body drive.File
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method, path = r.Method, r.URL.Path
+		json.NewDecoder(r.Body).Decode(&body)
+		json.NewEncoder(w).Encode(&drive.File{Id: "file-1"})
+	}))
+	t.Cleanup(server.Close)
+
+	service, err := drive.NewService(
+		context.Background(),
+		option.WithEndpoint(server.URL+"/"),
+		option.WithHTTPClient(server.Client()),
+	)
+	if err != nil {
+		t.Fatalf("failed to create the Drive service: %v", err)
+	}
+
+	gd := &GoogleDriveContext{api: NewDriveAPI(service)}
+
+	processedAt := time.Date(2026, 3, 12, 8, 30, 0, 0, time.FixedZone("EST", -5*60*60))
+	properties := ProcessedProperties(
+		&types.Document{ID: "doc-1", HeadRevisionID: "rev-2"},
+		processedAt,
+		types.DOCUMENT_STATUS_COMPLETE,
+	)
+
+	if err := gd.SetAppProperties(context.Background(), "file-1", properties); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if method != http.MethodPatch || path != "/files/file-1" {
+		t.Fatalf("unexpected request: %s %s", method, path)
+	}
+
+	want := map[string]string{
+		SCRIPTOR_DOCUMENT_PROPERTY:     "doc-1",
+		SCRIPTOR_PROCESSED_AT_PROPERTY: "2026-03-12T13:30:00Z",
+		SCRIPTOR_STATUS_PROPERTY:       "complete",
+		SCRIPTOR_REVISION_PROPERTY:     "rev-2",
+	}
+	if !maps.Equal(body.AppProperties, want) {
+		t.Fatalf("unexpected app properties: got %v want %v", body.AppProperties, want)
+	}
+
+	// only the app properties are sent, the rest of the file is untouched
+	if body.Name != "" || len(body.Parents) != 0 {
+		t.Fatalf("unexpected file fields: %+v", body)
+	}
+}
+
+func TestQueryChangesSkipsSidecars(t *testing.T) {
+	file := func(id, name string) *drive.File {
+		return &drive.File{
+			Id:           id,
+			Name:         name,
+			Parents:      []string{"watch"},
+			CreatedTime:  "2026-03-11T23:30:00Z",
+			ModifiedTime: "2026-03-12T08:00:00Z",
+		}
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(&drive.ChangeList{
+			NewStartPageToken: "next",
+			Changes: []*drive.Change{
+				{FileId: "file-1", File: file("file-1", "scan.pdf")},
+				{FileId: "file-2", File: file("file-2", "scan.pdf.scriptor.txt")},
+				{FileId: "file-3", File: file("file-3", "receipt.pdf.scriptor.yaml")},
+			},
+		})
+	}))
+	t.Cleanup(server.Close)
+
+	service, err := drive.NewService(
+		context.Background(),
+		option.WithEndpoint(server.URL+"/"),
+		option.WithHTTPClient(server.Client()),
+	)
+	if err != nil {
+		t.Fatalf("failed to create the Drive service: %v", err)
+	}
+
+	gd := &GoogleDriveContext{api: NewDriveAPI(service)}
+
+	changes, err := gd.QueryChanges(context.Background(), "watch", "", "token", false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(changes.Documents) != 1 || changes.Documents[0].Name != "scan.pdf" {
+		t.Fatalf("unexpected documents: %+v", changes.Documents)
+	}
+
+	want := []types.SidecarFile{
+		{GoogleID: "file-2", Name: "scan.pdf.scriptor.txt", FolderID: "watch"},
+		{GoogleID: "file-3", Name: "receipt.pdf.scriptor.yaml", FolderID: "watch"},
+	}
+	got := make([]types.SidecarFile, 0, len(changes.Sidecars))
+	for _, sidecar := range changes.Sidecars {
+		got = append(got, *sidecar)
+	}
+	if !slices.Equal(got, want) {
+		t.Fatalf("unexpected sidecars: got %+v want %+v", got, want)
+	}
+}
+
+func TestQueryChangesSkipsFolders(t *testing.T) {
+	file := func(id, name, mimeType string) *drive.File {
+		return &drive.File{
+			Id:           id,
+			Name:         name,
+			MimeType:     mimeType,
+			Parents:      []string{"watch"},
+			CreatedTime:  "2026-03-11T23:30:00Z",
+			ModifiedTime: "2026-03-12T08:00:00Z",
+		}
+	}
+
+	trashed := file("file-6", "old.pdf", types.CONTENT_TYPE_PDF)
+	trashed.Trashed = true
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(&drive.ChangeList{
+			NewStartPageToken: "next",
+			Changes: []*drive.Change{
+				{FileId: "file-1", File: file("file-1", "scan.pdf", types.CONTENT_TYPE_PDF)},
+				{FileId: "file-2", File: file("file-2", "2026", GOOGLE_FOLDER_MIME_TYPE)},
+				{FileId: "file-3", File: file("file-3", "scan link", GOOGLE_SHORTCUT_MIME_TYPE)},
+				{FileId: "file-4", File: file("file-4", "budget", "application/vnd.google-apps.spreadsheet")},
+				{FileId: "file-5", Removed: true, File: &drive.File{}},
+				{FileId: "file-6", File: trashed},
+			},
+		})
+	}))
+	t.Cleanup(server.Close)
+
+	service, err := drive.NewService(
+		context.Background(),
+		option.WithEndpoint(server.URL+"/"),
+		option.WithHTTPClient(server.Client()),
+	)
+	if err != nil {
+		t.Fatalf("failed to create the Drive service: %v", err)
+	}
+
+	gd := &GoogleDriveContext{api: NewDriveAPI(service)}
+
+	changes, err := gd.QueryChanges(context.Background(), "watch", "", "token", false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// the types of files the channel processes are checked by the handler
+	names := make([]string, 0, len(changes.Documents))
+	for _, document := range changes.Documents {
+		names = append(names, document.Name)
+	}
+	if !slices.Equal(names, []string{"scan.pdf", "budget"}) {
+		t.Fatalf("unexpected documents: %v", names)
+	}
+}
+
+func TestFindSidecar(t *testing.T) {
+	var query string
+	files := []*drive.File{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.Query().Get("q")
+		json.NewEncoder(w).Encode(&drive.FileList{Files: files})
+	}))
+	t.Cleanup(server.Close)
+
+	service, err := drive.NewService(
+		context.Background(),
+		option.WithEndpoint(server.URL+"/"),
+		option.WithHTTPClient(server.Client()),
+	)
+	if err != nil {
+		t.Fatalf("failed to create the Drive service: %v", err)
+	}
+
+	gd := &GoogleDriveContext{api: NewDriveAPI(service)}
+
+	found, err := gd.FindSidecar(context.Background(), "watch", "Tom's scan.pdf")
+	if err != nil || found != nil {
+		t.Fatalf("unexpected sidecar: %+v %v", found, err)
+	}
+
+	want := `(name = 'Tom\'s scan.pdf.scriptor.txt' or name = 'Tom\'s scan.pdf.scriptor.yaml') ` +
+		`and 'watch' in parents and trashed = false`
+	if query != want {
+		t.Fatalf("unexpected query:\ngot  %s\nwant %s", query, want)
+	}
+
+	// the text sidecar is used when there are both
+	files = []*drive.File{
+		{Id: "yaml", Name: "Tom's scan.pdf.scriptor.yaml"},
+		{Id: "text", Name: "Tom's scan.pdf.scriptor.txt"},
+	}
+
+	found, err = gd.FindSidecar(context.Background(), "watch", "Tom's scan.pdf")
+	if err != nil || found == nil || found.GoogleID != "text" {
+		t.Fatalf("unexpected sidecar: %+v %v", found, err)
+	}
+}
+
+func TestListFolder(t *testing.T) {
+	file := func(id, name, mimeType string) *drive.File {
+		return &drive.File{
+			Id:           id,
+			Name:         name,
+			MimeType:     mimeType,
+			Parents:      []string{"watch"},
+			CreatedTime:  "2026-03-12T08:00:00Z",
+			ModifiedTime: "2026-03-12T08:00:00Z",
+		}
+	}
+
+	output := file("file-3", "scan.md", "text/markdown")
+	output.AppProperties = map[string]string{SCRIPTOR_OUTPUT_PROPERTY: "true"}
+
+	pages := map[string]*drive.FileList{
+		"": {
+			NextPageToken: "page-2",
+			Files: []*drive.File{
+				file("file-1", "scan.pdf", types.CONTENT_TYPE_PDF),
+				file("folder-1", "archive", GOOGLE_FOLDER_MIME_TYPE),
+				output,
+			},
+		},
+		"page-2": {
+			Files: []*drive.File{
+				file("file-4", "scan.pdf.scriptor.yaml", "application/x-yaml"),
+				file("file-5", "photo.heic", types.CONTENT_TYPE_HEIC),
+			},
+		},
+	}
+
+	var query string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.Query().Get("q")
+		json.NewEncoder(w).Encode(pages[r.URL.Query().Get("pageToken")])
+	}))
+	t.Cleanup(server.Close)
+
+	service, err := drive.NewService(
+		context.Background(),
+		option.WithEndpoint(server.URL+"/"),
+		option.WithHTTPClient(server.Client()),
+	)
+	if err != nil {
+		t.Fatalf("failed to create the Drive service: %v", err)
+	}
+
+	gd := &GoogleDriveContext{api: NewDriveAPI(service)}
+
+	contents, err := gd.ListFolder(context.Background(), "watch", "", false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if query != "'watch' in parents and trashed = false" {
+		t.Fatalf("unexpected query: %q", query)
+	}
+
+	names := make([]string, 0, len(contents.Documents))
+	for _, document := range contents.Documents {
+		names = append(names, document.Name)
+	}
+
+	// folders and outputs are skipped and the sidecars kept apart, across
+	// every page of the listing
+	if !slices.Equal(names, []string{"scan.pdf", "photo.heic"}) {
+		t.Fatalf("unexpected documents: %v", names)
+	}
+
+	if len(contents.Sidecars) != 1 || contents.Sidecars[0].GoogleID != "file-4" ||
+		contents.OutputsSkipped != 1 || contents.NextStartToken != "" {
+		t.Fatalf("unexpected contents: %+v", contents)
+	}
+}
+
+func TestQueryChangesReportsRemovals(t *testing.T) {
+	file := func(id, name string, parents ...string) *drive.File {
+		return &drive.File{
+			Id:           id,
+			Name:         name,
+			MimeType:     types.CONTENT_TYPE_PDF,
+			Parents:      parents,
+			CreatedTime:  "2026-03-12T08:00:00Z",
+			ModifiedTime: "2026-03-12T08:00:00Z",
+		}
+	}
+
+	trashed := file("file-2", "trashed.pdf", "watch")
+	trashed.Trashed = true
+
+	elsewhere := file("file-4", "elsewhere.pdf", "archive")
+	elsewhere.Trashed = true
+
+	// file-5 is added on the first page and trashed on the second
+	added := file("file-5", "brief.pdf", "watch")
+	later := file("file-5", "brief.pdf", "watch")
+	later.Trashed = true
+
+	pages := map[string]*drive.ChangeList{
+		"start": {
+			NextPageToken: "page-2",
+			Changes: []*drive.Change{
+				{FileId: "file-1", File: file("file-1", "scan.pdf", "watch")},
+				{FileId: "file-2", File: trashed},
+				{FileId: "file-5", File: added},
+			},
+		},
+		"page-2": {
+			NewStartPageToken: "next",
+			Changes: []*drive.Change{
+				{FileId: "file-3", Removed: true},
+				{FileId: "file-4", File: elsewhere},
+				{FileId: "file-5", File: later},
+			},
+		},
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(pages[r.URL.Query().Get("pageToken")])
+	}))
+	t.Cleanup(server.Close)
+
+	service, err := drive.NewService(
+		context.Background(),
+		option.WithEndpoint(server.URL+"/"),
+		option.WithHTTPClient(server.Client()),
+	)
+	if err != nil {
+		t.Fatalf("failed to create the Drive service: %v", err)
+	}
+
+	gd := &GoogleDriveContext{api: NewDriveAPI(service)}
+
+	changes, err := gd.QueryChanges(context.Background(), "watch", "", "start", false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(changes.Documents) != 1 || changes.Documents[0].GoogleID != "file-1" {
+		t.Fatalf("unexpected documents: %+v", changes.Documents)
+	}
+
+	// files trashed in other folders aren't ours to report
+	if !slices.Equal(changes.Removed, []string{"file-2", "file-3", "file-5"}) ||
+		changes.NextStartToken != "next" {
+		t.Fatalf("unexpected changes: %+v", changes)
+	}
+}
+
+func TestCreateWatchChannel(t *testing.T) {
+	var method, path string
+	var body drive.Channel
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method, path = r.Method, r.URL.Path
+		json.NewDecoder(r.Body).Decode(&body)
+		json.NewEncoder(w).Encode(&drive.Channel{Id: body.Id, ResourceId: "resource-1"})
+	}))
+	t.Cleanup(server.Close)
+
+	service, err := drive.NewService(
+		context.Background(),
+		option.WithEndpoint(server.URL+"/"),
+		option.WithHTTPClient(server.Client()),
+	)
+	if err != nil {
+		t.Fatalf("failed to create the Drive service: %v", err)
+	}
+
+	gd := &GoogleDriveContext{api: NewDriveAPI(service)}
+
+	wc := &types.WatchChannel{
+		ChannelID:  "channel-1",
+		FolderID:   "folder-1",
+		WebhookUrl: "https://example.com/webhook",
+		ExpiresAt:  1767225600000,
+		Token:      "token-1",
+	}
+
+	resourceID, err := gd.CreateWatchChannel(context.Background(), wc)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if resourceID != "resource-1" {
+		t.Fatalf("unexpected resource: %q", resourceID)
+	}
+
+	if method != http.MethodPost || path != "/files/folder-1/watch" {
+		t.Fatalf("unexpected request: %s %s", method, path)
+	}
+
+	// the channel is sent as it was given, nothing is made up here
+	if body.Id != "channel-1" ||
+		body.Address != "https://example.com/webhook" ||
+		body.Expiration != 1767225600000 ||
+		body.Token != "token-1" ||
+		body.Type != "web_hook" {
+		t.Fatalf("unexpected channel: %+v", body)
+	}
+}
+
+func TestStopWatchChannel(t *testing.T) {
+	var method, path string
+	var body drive.Channel
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method, path = r.Method, r.URL.Path
+		json.NewDecoder(r.Body).Decode(&body)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(server.Close)
+
+	service, err := drive.NewService(
+		context.Background(),
+		option.WithEndpoint(server.URL+"/"),
+		option.WithHTTPClient(server.Client()),
+	)
+	if err != nil {
+		t.Fatalf("failed to create the Drive service: %v", err)
+	}
+
+	gd := &GoogleDriveContext{api: NewDriveAPI(service)}
+
+	if err := gd.StopWatchChannel(context.Background(), "channel-1", "resource-1"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if method != http.MethodPost || path != "/channels/stop" {
+		t.Fatalf("unexpected request: %s %s", method, path)
+	}
+
+	if body.Id != "channel-1" || body.ResourceId != "resource-1" {
+		t.Fatalf("unexpected channel: %+v", body)
+	}
+}
+
+func TestStopWatchChannelAlreadyStopped(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `{"error":{"code":404,"message":"Channel 'channel-1' not found for project"}}`)
+	}))
+	t.Cleanup(server.Close)
+
+	service, err := drive.NewService(
+		context.Background(),
+		option.WithEndpoint(server.URL+"/"),
+		option.WithHTTPClient(server.Client()),
+	)
+	if err != nil {
+		t.Fatalf("failed to create the Drive service: %v", err)
+	}
+
+	gd := &GoogleDriveContext{api: NewDriveAPI(service)}
+
+	if err := gd.StopWatchChannel(context.Background(), "channel-1", "resource-1"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestNewTokenSource(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate the key: %v", err)
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatalf("failed to encode the key: %v", err)
+	}
+
+	// the token endpoint only grants tokens for the allowed user
+	requests := 0
+	subjects := make([]string, 0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+
+		parts := strings.Split(r.FormValue("assertion"), ".")
+		payload, _ := base64.RawURLEncoding.DecodeString(parts[1])
+		var claims struct {
+			Subject string `json:"sub"`
+		}
+		json.Unmarshal(payload, &claims)
+		subjects = append(subjects, claims.Subject)
+
+		w.Header().Set("Content-Type", "application/json")
+		if claims.Subject != "allowed@example.com" {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, `{"error":"unauthorized_client","error_description":"Client is unauthorized to retrieve access tokens using this method"}`)
+			return
+		}
+
+		fmt.Fprint(w, `{"access_token":"token","token_type":"Bearer","expires_in":3600}`)
+	}))
+	t.Cleanup(server.Close)
+
+	tests := []struct {
+		name         string
+		subject      string
+		wantErr      error
+		wantRequests int
+	}{
+		{
+			// the token is only requested by the first Drive call
+			name: "no impersonation",
+		},
+		{
+			name:         "allowed user",
+			subject:      "allowed@example.com",
+			wantRequests: 1,
+		},
+		{
+			name:         "delegation not allowed",
+			subject:      "other@example.com",
+			wantErr:      ErrDelegationFailed,
+			wantRequests: 1,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			requests = 0
+			subjects = subjects[:0]
+
+			data, _ := json.Marshal(map[string]string{
+				"type":                "service_account",
+				"client_email":        "scriptor@example.iam.gserviceaccount.com",
+				"private_key_id":      "key-1",
+				"private_key":         string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+				"token_uri":           server.URL,
+				"impersonate_subject": tc.subject,
+			})
+
+			tokenSource, err := newTokenSource(context.Background(), data)
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("unexpected error: got %v want %v", err, tc.wantErr)
+			}
+
+			if tc.wantErr == nil && tokenSource == nil {
+				t.Fatalf("expected a token source")
+			}
+
+			if requests != tc.wantRequests {
+				t.Fatalf("unexpected token requests: %d", requests)
+			}
+
+			if tc.subject != "" && !slices.Equal(subjects, []string{tc.subject}) {
+				t.Fatalf("unexpected subjects: %v", subjects)
+			}
+		})
+	}
+}
+
+func TestCancelledContextAbortsCall(t *testing.T) {
+	// the fake Drive never answers until the request is abandoned
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(10 * time.Second):
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	service, err := drive.NewService(
+		context.Background(),
+		option.WithEndpoint(server.URL+"/"),
+		option.WithHTTPClient(server.Client()),
+	)
+	if err != nil {
+		t.Fatalf("failed to create the Drive service: %v", err)
+	}
+
+	gd := &GoogleDriveContext{api: NewDriveAPI(service)}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	start := time.Now()
+	_, err = gd.GetChangesStartToken(ctx, "")
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("the call kept running for %s after it was cancelled", elapsed)
+	}
+}
+
+func TestSharedDriveParameters(t *testing.T) {
+	tests := []struct {
+		name    string
+		driveID string
+		call    func(gd *GoogleDriveContext, driveID string) error
+		want    map[string]string
+	}{
+		{
+			name: "start token in My Drive",
+			call: func(gd *GoogleDriveContext, driveID string) error {
+				_, err := gd.GetChangesStartToken(context.Background(), driveID)
+				return err
+			},
+			want: map[string]string{"supportsAllDrives": "true", "driveId": ""},
+		},
+		{
+			name:    "start token in a shared drive",
+			driveID: "drive-1",
+			call: func(gd *GoogleDriveContext, driveID string) error {
+				_, err := gd.GetChangesStartToken(context.Background(), driveID)
+				return err
+			},
+			want: map[string]string{"supportsAllDrives": "true", "driveId": "drive-1"},
+		},
+		{
+			name: "changes in My Drive",
+			call: func(gd *GoogleDriveContext, driveID string) error {
+				_, err := gd.QueryChanges(context.Background(), "watch", driveID, "start", false)
+				return err
+			},
+			want: map[string]string{
+				"supportsAllDrives":         "true",
+				"driveId":                   "",
+				"includeItemsFromAllDrives": "",
+			},
+		},
+		{
+			name:    "changes in a shared drive",
+			driveID: "drive-1",
+			call: func(gd *GoogleDriveContext, driveID string) error {
+				_, err := gd.QueryChanges(context.Background(), "watch", driveID, "start", false)
+				return err
+			},
+			want: map[string]string{
+				"supportsAllDrives":         "true",
+				"driveId":                   "drive-1",
+				"includeItemsFromAllDrives": "true",
+			},
+		},
+		{
+			name: "listing in My Drive",
+			call: func(gd *GoogleDriveContext, driveID string) error {
+				_, err := gd.ListFolder(context.Background(), "watch", driveID, false)
+				return err
+			},
+			want: map[string]string{
+				"supportsAllDrives":         "true",
+				"includeItemsFromAllDrives": "true",
+				"corpora":                   "",
+				"driveId":                   "",
+			},
+		},
+		{
+			name:    "listing in a shared drive",
+			driveID: "drive-1",
+			call: func(gd *GoogleDriveContext, driveID string) error {
+				_, err := gd.ListFolder(context.Background(), "watch", driveID, false)
+				return err
+			},
+			want: map[string]string{
+				"supportsAllDrives":         "true",
+				"includeItemsFromAllDrives": "true",
+				"corpora":                   "drive",
+				"driveId":                   "drive-1",
+			},
+		},
+		{
+			name: "file copy",
+			call: func(gd *GoogleDriveContext, driveID string) error {
+				return gd.CopyFile(context.Background(), "document", "file-1", "folder-1")
+			},
+			want: map[string]string{"supportsAllDrives": "true"},
+		},
+		{
+			name: "file update",
+			call: func(gd *GoogleDriveContext, driveID string) error {
+				return gd.SetAppProperties(context.Background(), "file-1", map[string]string{"a": "b"})
+			},
+			want: map[string]string{"supportsAllDrives": "true"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var requests []map[string]string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				query := r.URL.Query()
+				recorded := make(map[string]string, len(tt.want))
+				for key := range tt.want {
+					recorded[key] = query.Get(key)
+				}
+				requests = append(requests, recorded)
+
+				fmt.Fprint(w, `{"startPageToken": "start", "newStartPageToken": "next"}`)
+			}))
+			t.Cleanup(server.Close)
+
+			service, err := drive.NewService(
+				context.Background(),
+				option.WithEndpoint(server.URL+"/"),
+				option.WithHTTPClient(server.Client()),
+			)
+			if err != nil {
+				t.Fatalf("failed to create the Drive service: %v", err)
+			}
+
+			gd := &GoogleDriveContext{api: NewDriveAPI(service)}
+			if err := tt.call(gd, tt.driveID); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if len(requests) == 0 {
+				t.Fatal("no request was made")
+			}
+
+			for _, recorded := range requests {
+				if !maps.Equal(recorded, tt.want) {
+					t.Fatalf("unexpected parameters: %v, want %v", recorded, tt.want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,9 @@
+package google
+
+import "time"
+
+// ExpireFolderTree makes the cached tree below the root expire, for the
+// tests of the package that use the fake Drive
+func (gd *GoogleDriveContext) ExpireFolderTree(rootID string) {
+	gd.folderTrees[rootID].resolvedAt = time.Now().Add(-FOLDER_TREE_TTL)
+}
@@ -0,0 +1,333 @@
+package google
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+
+	"github.com/KyleBrandon/scriptor/pkg/types"
+	"google.golang.org/api/drive/v3"
+)
+
+const (
+	// Limit on how far up the folder hierarchy the nesting check walks
+	maxFolderDepth = 32
+
+	GOOGLE_FOLDER_MIME_TYPE = "application/vnd.google-apps.folder"
+)
+
+// ErrFolderLoop is returned when a folder Scriptor writes to would feed files
+// back into the folder it watches.
+var ErrFolderLoop = errors.New("folder would feed files back into the watch folder")
+
+// ErrFolderNotFound is returned when a folder isn't in Drive, isn't shared
+// with the service account, is in the trash, or isn't a folder.
+var ErrFolderNotFound = errors.New("folder not found")
+
+// ErrFolderNotWritable is returned when the service account can't add files
+// to a folder it writes to.
+var ErrFolderNotWritable = errors.New("folder not writable")
+
+// ValidateFolder returns ErrFolderNotFound unless the ID is of a folder in
+// Drive that the service account can see and isn't in the trash.
+func (gd *GoogleDriveContext) ValidateFolder(ctx context.Context, folderID string) error {
+	_, err := gd.getFolder(ctx, folderID)
+	return err
+}
+
+// ValidateWritableFolder checks the folder like ValidateFolder and returns
+// ErrFolderNotWritable when the service account can't add files to it. Only
+// the capabilities of the folder are read, nothing is written to probe it.
+func (gd *GoogleDriveContext) ValidateWritableFolder(ctx context.Context, folderID string) error {
+	folder, err := gd.getFolder(ctx, folderID)
+	if err != nil {
+		return err
+	}
+
+	if folder.Capabilities == nil || !folder.Capabilities.CanAddChildren {
+		return fmt.Errorf("%w: %s", ErrFolderNotWritable, folderID)
+	}
+
+	return nil
+}
+
+// ValidateWatchChannelFolders checks every folder of the watch channel in
+// Drive. The watch folder only has to be readable, the archive, destination
+// and route folders have to be writable. The error names the field of the
+// folder that failed.
+func (gd *GoogleDriveContext) ValidateWatchChannelFolders(
+	ctx context.Context,
+	wc *types.WatchChannel,
+) error {
+	return validateWatchChannelFolders(
+		wc,
+		func(folderID string) error { return gd.ValidateFolder(ctx, folderID) },
+		func(folderID string) error { return gd.ValidateWritableFolder(ctx, folderID) },
+	)
+}
+
+func (gd *GoogleDriveContext) getFolder(ctx context.Context, folderID string) (*drive.File, error) {
+	folder, err := gd.api.Files.Get(ctx, folderID, "mimeType, trashed, capabilities/canAddChildren")
+	if IsNotFoundError(err) {
+		return nil, fmt.Errorf(
+			"%w: %s doesn't exist or isn't shared with the service account",
+			ErrFolderNotFound,
+			folderID,
+		)
+	}
+	if err != nil {
+		slog.Error("Failed to get the folder", "id", folderID, "error", err)
+		return nil, err
+	}
+
+	if folder.MimeType != GOOGLE_FOLDER_MIME_TYPE {
+		return nil, fmt.Errorf("%w: %s isn't a folder", ErrFolderNotFound, folderID)
+	}
+
+	if folder.Trashed {
+		return nil, fmt.Errorf("%w: %s is in the trash", ErrFolderNotFound, folderID)
+	}
+
+	return folder, nil
+}
+
+func validateWatchChannelFolders(
+	wc *types.WatchChannel,
+	validate func(folderID string) error,
+	validateWritable func(folderID string) error,
+) error {
+	if err := validate(wc.FolderID); err != nil {
+		return fmt.Errorf("invalid FolderID: %w", err)
+	}
+
+	if wc.ArchiveFolderID != "" {
+		if err := validateWritable(wc.ArchiveFolderID); err != nil {
+			return fmt.Errorf("invalid ArchiveFolderID: %w", err)
+		}
+	}
+
+	for _, id := range wc.Destinations() {
+		if err := validateWritable(id); err != nil {
+			return fmt.Errorf("invalid DestinationFolderID: %w", err)
+		}
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(wc.Routes)) {
+		if err := validateWritable(wc.Routes[name]); err != nil {
+			return fmt.Errorf("invalid route %s: %w", name, err)
+		}
+	}
+
+	return nil
+}
+
+// ValidateFolderLocations rejects a watch channel with a destination or
+// archive folder that is the watch folder. When the watch folder is watched
+// recursively, folders nested anywhere below it are rejected as well.
+func (gd *GoogleDriveContext) ValidateFolderLocations(
+	ctx context.Context,
+	wc *types.WatchChannel,
+	recursive bool,
+) error {
+	return validateFolderLocations(wc, recursive, func(id string) ([]string, error) {
+		return gd.getParents(ctx, id)
+	})
+}
+
+func (gd *GoogleDriveContext) getParents(ctx context.Context, id string) ([]string, error) {
+	file, err := gd.api.Files.Get(ctx, id, "parents")
+	if err != nil {
+		slog.Error("Failed to get the parents of the folder", "id", id, "error", err)
+		return nil, err
+	}
+
+	return file.Parents, nil
+}
+
+func validateFolderLocations(
+	wc *types.WatchChannel,
+	recursive bool,
+	parentsOf func(id string) ([]string, error),
+) error {
+	type location struct{ name, id string }
+
+	folders := make([]location, 0)
+	for _, id := range wc.Destinations() {
+		folders = append(folders, location{"destination", id})
+	}
+	folders = append(folders, location{"archive", wc.ArchiveFolderID})
+
+	for _, folder := range folders {
+		if folder.id == "" {
+			continue
+		}
+
+		if folder.id == wc.FolderID {
+			return fmt.Errorf(
+				"%w: the %s folder %s is the watch folder",
+				ErrFolderLoop,
+				folder.name,
+				folder.id,
+			)
+		}
+
+		if !recursive {
+			continue
+		}
+
+		nested, err := isNestedIn(folder.id, wc.FolderID, parentsOf)
+		if err != nil {
+			return err
+		}
+
+		if nested {
+			return fmt.Errorf(
+				"%w: the %s folder %s is inside the watch folder %s",
+				ErrFolderLoop,
+				folder.name,
+				folder.id,
+				wc.FolderID,
+			)
+		}
+	}
+
+	return nil
+}
+
+// Walk the parent chain of the folder looking for the ancestor. Drive items
+// can have more than one parent so every branch is followed.
+func isNestedIn(
+	folderID, ancestorID string,
+	parentsOf func(id string) ([]string, error),
+) (bool, error) {
+	seen := map[string]bool{folderID: true}
+	current := []string{folderID}
+
+	for depth := 0; depth < maxFolderDepth && len(current) != 0; depth++ {
+		next := make([]string, 0)
+
+		for _, id := range current {
+			parents, err := parentsOf(id)
+			if err != nil {
+				return false, err
+			}
+
+			for _, parent := range parents {
+				if parent == ancestorID {
+					return true, nil
+				}
+
+				if !seen[parent] {
+					seen[parent] = true
+					next = append(next, parent)
+				}
+			}
+		}
+
+		current = next
+	}
+
+	return false, nil
+}
+
+// EnsureFolderPath returns the ID of the folder at the path of folder names
+// below the parent, creating the folders that don't exist. When a folder
+// name was created more than once the oldest folder is used. The IDs are
+// cached until ForgetFolderPaths is called.
+func (gd *GoogleDriveContext) EnsureFolderPath(
+	ctx context.Context,
+	parentID string,
+	segments []string,
+) (string, error) {
+	gd.folderMu.Lock()
+	defer gd.folderMu.Unlock()
+
+	folderID := parentID
+	for _, name := range segments {
+		key := folderID + "/" + name
+		if id, ok := gd.folderIDs[key]; ok {
+			folderID = id
+			continue
+		}
+
+		id, err := gd.findFolder(ctx, folderID, name)
+		if err != nil {
+			return "", err
+		}
+
+		if id == "" {
+			id, err = gd.createFolder(ctx, folderID, name)
+			if err != nil {
+				return "", err
+			}
+		}
+
+		gd.folderIDs[key] = id
+		folderID = id
+	}
+
+	return folderID, nil
+}
+
+// ForgetFolderPaths clears the folder IDs cached by EnsureFolderPath so a
+// folder that was moved or deleted since is looked up again.
+func (gd *GoogleDriveContext) ForgetFolderPaths() {
+	gd.folderMu.Lock()
+	defer gd.folderMu.Unlock()
+
+	gd.folderIDs = make(map[string]string)
+}
+
+// The ID of the oldest folder with the name in the parent, empty when there
+// is none
+func (gd *GoogleDriveContext) findFolder(ctx context.Context, parentID, name string) (string, error) {
+	files, err := gd.api.Files.List(ctx, FileListRequest{
+		Query:    folderQuery(parentID, name),
+		Fields:   "files(id)",
+		OrderBy:  "createdTime",
+		PageSize: 1,
+	})
+	if err != nil {
+		return "", fmt.Errorf("unable to search for folder %s: %w", name, err)
+	}
+
+	if len(files.Files) == 0 {
+		return "", nil
+	}
+
+	return files.Files[0].Id, nil
+}
+
+func (gd *GoogleDriveContext) createFolder(
+	ctx context.Context,
+	parentID, name string,
+) (string, error) {
+	folder, err := gd.api.Files.Create(ctx, &drive.File{
+		Name:     name,
+		Parents:  []string{parentID},
+		MimeType: GOOGLE_FOLDER_MIME_TYPE,
+		AppProperties: map[string]string{
+			SCRIPTOR_OUTPUT_PROPERTY: "true",
+		},
+	}, nil)
+	if err != nil {
+		return "", fmt.Errorf("unable to create folder %s: %w", name, err)
+	}
+
+	slog.Info("Created folder", "name", name, "parentID", parentID, "id", folder.Id)
+
+	return folder.Id, nil
+}
+
+// Drive query for a folder with the name in the parent
+func folderQuery(parentID, name string) string {
+	return fmt.Sprintf(
+		"name = '%s' and '%s' in parents and mimeType = '%s' and trashed = false",
+		queryEscaper.Replace(name),
+		queryEscaper.Replace(parentID),
+		GOOGLE_FOLDER_MIME_TYPE,
+	)
+}
@@ -0,0 +1,147 @@
+package google
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/KyleBrandon/scriptor/pkg/types"
+)
+
+func TestValidateFolderLocations(t *testing.T) {
+	lookupErr := errors.New("not found")
+
+	// root
+	// ├── watch
+	// │   └── processed
+	// │       └── notes
+	// └── archive
+	parents := map[string][]string{
+		"watch":     {"root"},
+		"processed": {"watch"},
+		"notes":     {"processed"},
+		"archive":   {"root"},
+		"shared":    {"elsewhere", "processed"},
+		"loop-a":    {"loop-b"},
+		"loop-b":    {"loop-a"},
+	}
+
+	tests := []struct {
+		name         string
+		destination  string
+		destinations []string
+		archive      string
+		recursive    bool
+		wantErr      error
+	}{
+		{
+			name:        "separate folders",
+			destination: "archive",
+			archive:     "archive",
+		},
+		{
+			name:        "destination is the watch folder",
+			destination: "watch",
+			archive:     "archive",
+			wantErr:     ErrFolderLoop,
+		},
+		{
+			name:        "archive is the watch folder",
+			destination: "archive",
+			archive:     "watch",
+			wantErr:     ErrFolderLoop,
+		},
+		{
+			name:        "nested destination without recursion",
+			destination: "processed",
+			archive:     "archive",
+		},
+		{
+			name:        "nested destination with recursion",
+			destination: "processed",
+			archive:     "archive",
+			recursive:   true,
+			wantErr:     ErrFolderLoop,
+		},
+		{
+			name:        "deeply nested archive with recursion",
+			destination: "archive",
+			archive:     "notes",
+			recursive:   true,
+			wantErr:     ErrFolderLoop,
+		},
+		{
+			name:        "second parent is nested with recursion",
+			destination: "shared",
+			archive:     "archive",
+			recursive:   true,
+			wantErr:     ErrFolderLoop,
+		},
+		{
+			name:        "sibling folder with recursion",
+			destination: "archive",
+			archive:     "archive",
+			recursive:   true,
+		},
+		{
+			name:        "parent cycle with recursion",
+			destination: "loop-a",
+			archive:     "archive",
+			recursive:   true,
+		},
+		{
+			name:        "unknown folder with recursion",
+			destination: "missing",
+			archive:     "archive",
+			recursive:   true,
+			wantErr:     lookupErr,
+		},
+		{
+			name:      "unset folders",
+			recursive: true,
+		},
+		{
+			name:         "second destination is the watch folder",
+			destination:  "archive",
+			destinations: []string{"archive", "watch"},
+			archive:      "archive",
+			wantErr:      ErrFolderLoop,
+		},
+		{
+			name:         "list replaces the single destination",
+			destination:  "watch",
+			destinations: []string{"archive"},
+			archive:      "archive",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			wc := &types.WatchChannel{
+				FolderID:             "watch",
+				DestinationFolderID:  tc.destination,
+				DestinationFolderIDs: tc.destinations,
+				ArchiveFolderID:      tc.archive,
+			}
+
+			err := validateFolderLocations(
+				wc,
+				tc.recursive,
+				func(id string) ([]string, error) {
+					if id == "root" || id == "elsewhere" {
+						return nil, nil
+					}
+
+					p, ok := parents[id]
+					if !ok {
+						return nil, lookupErr
+					}
+					return p, nil
+				},
+			)
+
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("unexpected error: got %v want %v", err, tc.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,169 @@
+package google
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+
+	"google.golang.org/api/drive/v3"
+)
+
+const (
+	// How long the folders below a watch folder are cached before they
+	// are walked again
+	FOLDER_TREE_TTL = 10 * time.Minute
+
+	// Number of folders that are searched in one query, which keeps the
+	// query well below the length Drive accepts
+	folderQueryBatchSize = 20
+)
+
+// The folders below a watch folder, and when they were walked
+type folderTree struct {
+	folders    map[string]bool
+	resolvedAt time.Time
+}
+
+// ResolveFolderTree returns the IDs of the folder and of every folder nested
+// below it. The tree is cached for FOLDER_TREE_TTL, or until
+// ForgetFolderTree is called for the folder.
+func (gd *GoogleDriveContext) ResolveFolderTree(
+	ctx context.Context,
+	rootID string,
+) (map[string]bool, error) {
+	gd.treeMu.Lock()
+	defer gd.treeMu.Unlock()
+
+	if tree, ok := gd.folderTrees[rootID]; ok && time.Since(tree.resolvedAt) < FOLDER_TREE_TTL {
+		return maps.Clone(tree.folders), nil
+	}
+
+	folders, err := resolveFolderTree(rootID, func(parentIDs []string) ([]string, error) {
+		return gd.listSubfolders(ctx, parentIDs)
+	})
+	if err != nil {
+		slog.Error("Failed to resolve the folders below the folder", "folderID", rootID, "error", err)
+		return nil, err
+	}
+
+	slog.Info("Resolved the folders below the folder", "folderID", rootID, "folders", len(folders))
+
+	if gd.folderTrees == nil {
+		gd.folderTrees = make(map[string]*folderTree)
+	}
+
+	gd.folderTrees[rootID] = &folderTree{folders: folders, resolvedAt: time.Now()}
+
+	return maps.Clone(folders), nil
+}
+
+// ForgetFolderTree drops the cached tree of the folder so it is walked again
+// the next time it is resolved.
+func (gd *GoogleDriveContext) ForgetFolderTree(rootID string) {
+	gd.treeMu.Lock()
+	defer gd.treeMu.Unlock()
+
+	delete(gd.folderTrees, rootID)
+}
+
+// The IDs of the folders directly in any of the parents
+func (gd *GoogleDriveContext) listSubfolders(
+	ctx context.Context,
+	parentIDs []string,
+) ([]string, error) {
+	query := fmt.Sprintf(
+		"%s and mimeType = '%s' and trashed = false",
+		inParentsQuery(parentIDs),
+		GOOGLE_FOLDER_MIME_TYPE,
+	)
+
+	ids := make([]string, 0)
+	req := FileListRequest{Query: query, Fields: "nextPageToken, files(id)"}
+	err := gd.listFiles(ctx, "ListSubfolders", req, func(files *drive.FileList) error {
+		for _, file := range files.Files {
+			ids = append(ids, file.Id)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to list the subfolders: %w", err)
+	}
+
+	return ids, nil
+}
+
+// Walk the tree below the root one level at a time, listing the subfolders
+// of a batch of folders at once. The walk stops at maxFolderDepth.
+func resolveFolderTree(
+	rootID string,
+	subfoldersOf func(parentIDs []string) ([]string, error),
+) (map[string]bool, error) {
+	folders := map[string]bool{rootID: true}
+	current := []string{rootID}
+
+	for depth := 0; depth < maxFolderDepth && len(current) != 0; depth++ {
+		next := make([]string, 0)
+
+		for batch := range slices.Chunk(current, folderQueryBatchSize) {
+			children, err := subfoldersOf(batch)
+			if err != nil {
+				return nil, err
+			}
+
+			for _, id := range children {
+				if !folders[id] {
+					folders[id] = true
+					next = append(next, id)
+				}
+			}
+		}
+
+		current = next
+	}
+
+	return folders, nil
+}
+
+// A query term matching the files in any of the folders
+func inParentsQuery(folderIDs []string) string {
+	terms := make([]string, 0, len(folderIDs))
+	for _, id := range folderIDs {
+		terms = append(terms, fmt.Sprintf("'%s' in parents", queryEscaper.Replace(id)))
+	}
+
+	if len(terms) == 1 {
+		return terms[0]
+	}
+
+	return "(" + strings.Join(terms, " or ") + ")"
+}
+
+// Whether a change moves the tree: a folder in it changed or was removed, or
+// a folder was added to one of its folders
+func changesFolderTree(folders map[string]bool, changes []*drive.Change) bool {
+	for _, change := range changes {
+		if change.Removed {
+			if folders[change.FileId] {
+				return true
+			}
+			continue
+		}
+
+		if change.File == nil || change.File.MimeType != GOOGLE_FOLDER_MIME_TYPE {
+			continue
+		}
+
+		if folders[change.File.Id] || slices.ContainsFunc(change.File.Parents, func(id string) bool {
+			return folders[id]
+		}) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,135 @@
+package google
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"testing"
+
+	"github.com/KyleBrandon/scriptor/pkg/types"
+	"google.golang.org/api/drive/v3"
+)
+
+func TestResolveFolderTree(t *testing.T) {
+	// 25 month folders below the watch folder need two batches
+	children := map[string][]string{
+		"watch":   {},
+		"2026-01": {"week-1", "week-2"},
+		"week-2":  {"day-1"},
+		"other":   {"other-1"},
+	}
+	for i := range 25 {
+		children["watch"] = append(children["watch"], fmt.Sprintf("month-%d", i))
+	}
+	children["watch"] = append(children["watch"], "2026-01")
+
+	t.Run("every nested folder", func(t *testing.T) {
+		var batches [][]string
+		folders, err := resolveFolderTree("watch", func(parentIDs []string) ([]string, error) {
+			batches = append(batches, parentIDs)
+
+			found := make([]string, 0)
+			for _, id := range parentIDs {
+				found = append(found, children[id]...)
+			}
+			return found, nil
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if len(folders) != 30 || !folders["watch"] || !folders["day-1"] || folders["other"] || folders["other-1"] {
+			t.Fatalf("unexpected folders: %v", slices.Sorted(maps.Keys(folders)))
+		}
+
+		// the watch folder, two batches of month folders, then the weeks
+		// and the day
+		sizes := make([]int, 0, len(batches))
+		for _, batch := range batches {
+			sizes = append(sizes, len(batch))
+		}
+		if !slices.Equal(sizes, []int{1, 20, 6, 2, 1}) {
+			t.Fatalf("unexpected batches: %v", sizes)
+		}
+	})
+
+	t.Run("a folder listed twice is walked once", func(t *testing.T) {
+		walked := make(map[string]int)
+		folders, err := resolveFolderTree("a", func(parentIDs []string) ([]string, error) {
+			for _, id := range parentIDs {
+				walked[id]++
+			}
+			return []string{"a", "b"}, nil
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if len(folders) != 2 || walked["a"] != 1 || walked["b"] != 1 {
+			t.Fatalf("unexpected walk: %v %v", folders, walked)
+		}
+	})
+
+	t.Run("a failed listing fails the walk", func(t *testing.T) {
+		_, err := resolveFolderTree("watch", func(parentIDs []string) ([]string, error) {
+			return nil, errors.New("drive unavailable")
+		})
+		if err == nil {
+			t.Fatal("expected an error")
+		}
+	})
+}
+
+func TestInParentsQuery(t *testing.T) {
+	tests := []struct {
+		folders []string
+		want    string
+	}{
+		{[]string{"watch"}, "'watch' in parents"},
+		{[]string{"a", "b"}, "('a' in parents or 'b' in parents)"},
+		{[]string{"it's"}, `'it\'s' in parents`},
+	}
+
+	for _, tc := range tests {
+		if got := inParentsQuery(tc.folders); got != tc.want {
+			t.Errorf("inParentsQuery(%v) = %q, want %q", tc.folders, got, tc.want)
+		}
+	}
+}
+
+func TestChangesFolderTree(t *testing.T) {
+	folders := map[string]bool{"watch": true, "2026-01": true}
+
+	folder := func(id string, parents ...string) *drive.Change {
+		return &drive.Change{
+			FileId: id,
+			File:   &drive.File{Id: id, MimeType: GOOGLE_FOLDER_MIME_TYPE, Parents: parents},
+		}
+	}
+
+	tests := []struct {
+		name   string
+		change *drive.Change
+		want   bool
+	}{
+		{"folder added", folder("2026-02", "watch"), true},
+		{"folder in the tree renamed or moved out", folder("2026-01", "elsewhere"), true},
+		{"folder removed", &drive.Change{FileId: "2026-01", Removed: true}, true},
+		{"folder elsewhere", folder("other", "elsewhere"), false},
+		{"file removed", &drive.Change{FileId: "file-1", Removed: true}, false},
+		{
+			"file added",
+			&drive.Change{FileId: "file-1", File: &drive.File{Id: "file-1", MimeType: types.CONTENT_TYPE_PDF, Parents: []string{"watch"}}},
+			false,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := changesFolderTree(folders, []*drive.Change{tc.change}); got != tc.want {
+				t.Fatalf("changesFolderTree() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
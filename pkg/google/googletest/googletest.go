@@ -0,0 +1,456 @@
+// Package googletest has an in-memory fake of the Drive calls that
+// google.GoogleDriveContext makes, so the code that uses Drive can be tested
+// without a Drive service.
+package googletest
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/KyleBrandon/scriptor/pkg/google"
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/googleapi"
+)
+
+// Drive is a fake Drive holding files, the pages of changes, the channels
+// watching folders and the comments on files. Every call is recorded in
+// Calls, and the errors queued with Fail are returned before the call is
+// made. It is safe to use from more than one goroutine.
+type Drive struct {
+	mu sync.Mutex
+
+	// the files by ID, with the content of the ones that have any
+	files   map[string]*drive.File
+	content map[string][]byte
+
+	// StartPageToken is returned for every drive. ChangePages are the
+	// pages of changes by the page token that lists them.
+	StartPageToken string
+	ChangePages    map[string]*drive.ChangeList
+
+	// the channels watching a folder by the channel ID
+	Channels map[string]*drive.Channel
+
+	// the comments added to each file
+	Comments map[string][]string
+
+	// the MIME type each file was last exported as
+	Exports map[string]string
+
+	// PageSize is the most files on a page of a List call that doesn't
+	// set its own, every file when it isn't set
+	PageSize int64
+
+	// Calls has the name of every call made, like Files.Get, with the
+	// ID it was made for
+	Calls []string
+
+	errs   map[string][]error
+	nextID int
+}
+
+// NewDrive returns an empty fake Drive.
+func NewDrive() *Drive {
+	return &Drive{
+		files:       make(map[string]*drive.File),
+		content:     make(map[string][]byte),
+		ChangePages: make(map[string]*drive.ChangeList),
+		Channels:    make(map[string]*drive.Channel),
+		Comments:    make(map[string][]string),
+		Exports:     make(map[string]string),
+		errs:        make(map[string][]error),
+	}
+}
+
+// API returns the Drive calls made on the fake.
+func (d *Drive) API() google.DriveAPI {
+	return google.DriveAPI{
+		Files:    files{d},
+		Changes:  changes{d},
+		Channels: channels{d},
+		Comments: comments{d},
+	}
+}
+
+// AddFile adds the file with the content to the fake. A file without an ID
+// gets one.
+func (d *Drive) AddFile(file *drive.File, content []byte) *drive.File {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.addFile(file, content)
+}
+
+// File returns a copy of the file with the ID, nil when there is none.
+func (d *Drive) File(id string) *drive.File {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	file, ok := d.files[id]
+	if !ok {
+		return nil
+	}
+
+	return copyFile(file)
+}
+
+// Content returns the content of the file with the ID.
+func (d *Drive) Content(id string) []byte {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.content[id]
+}
+
+// Fail queues the errors to be returned by the next calls with the name,
+// like Files.Get, one error for each call.
+func (d *Drive) Fail(call string, errs ...error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.errs[call] = append(d.errs[call], errs...)
+}
+
+// NotFound is the error Drive answers with for a file or channel it doesn't
+// have.
+func NotFound(id string) error {
+	return &googleapi.Error{Code: http.StatusNotFound, Message: "File not found: " + id}
+}
+
+// Record the call and return the error queued for it
+func (d *Drive) call(name, id string) error {
+	d.Calls = append(d.Calls, name+" "+id)
+
+	errs := d.errs[name]
+	if len(errs) == 0 {
+		return nil
+	}
+
+	d.errs[name] = errs[1:]
+	return errs[0]
+}
+
+func (d *Drive) addFile(file *drive.File, content []byte) *drive.File {
+	file = copyFile(file)
+	if file.Id == "" {
+		d.nextID++
+		file.Id = "file-" + strconv.Itoa(d.nextID)
+	}
+
+	d.files[file.Id] = file
+	if content != nil {
+		d.content[file.Id] = content
+	}
+
+	return copyFile(file)
+}
+
+func copyFile(file *drive.File) *drive.File {
+	copied := *file
+	copied.Parents = slices.Clone(file.Parents)
+	copied.AppProperties = maps.Clone(file.AppProperties)
+
+	return &copied
+}
+
+type files struct{ d *Drive }
+
+func (f files) Get(ctx context.Context, id, fields string) (*drive.File, error) {
+	f.d.mu.Lock()
+	defer f.d.mu.Unlock()
+
+	if err := f.d.call("Files.Get", id); err != nil {
+		return nil, err
+	}
+
+	file, ok := f.d.files[id]
+	if !ok {
+		return nil, NotFound(id)
+	}
+
+	return copyFile(file), nil
+}
+
+func (f files) Download(ctx context.Context, id string) (*http.Response, error) {
+	return f.download("Files.Download", id)
+}
+
+// The export is the content of the file as it is, the MIME type asked for
+// is recorded
+func (f files) Export(ctx context.Context, id, mimeType string) (*http.Response, error) {
+	f.d.mu.Lock()
+	f.d.Exports[id] = mimeType
+	f.d.mu.Unlock()
+
+	return f.download("Files.Export", id)
+}
+
+func (f files) download(call, id string) (*http.Response, error) {
+	f.d.mu.Lock()
+	defer f.d.mu.Unlock()
+
+	if err := f.d.call(call, id); err != nil {
+		return nil, err
+	}
+
+	if _, ok := f.d.files[id]; !ok {
+		return nil, NotFound(id)
+	}
+
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Body:       io.NopCloser(bytes.NewReader(f.d.content[id])),
+	}, nil
+}
+
+// The files matching the query, by the order asked for and then by ID. The
+// page token is the index of the first file of the page.
+func (f files) List(ctx context.Context, req google.FileListRequest) (*drive.FileList, error) {
+	f.d.mu.Lock()
+	defer f.d.mu.Unlock()
+
+	if err := f.d.call("Files.List", req.Query); err != nil {
+		return nil, err
+	}
+
+	match, err := parseQuery(req.Query)
+	if err != nil {
+		return nil, &googleapi.Error{Code: http.StatusBadRequest, Message: err.Error()}
+	}
+
+	found := make([]*drive.File, 0)
+	for _, file := range f.d.files {
+		if match(file) {
+			found = append(found, copyFile(file))
+		}
+	}
+
+	slices.SortFunc(found, func(a, b *drive.File) int {
+		if req.OrderBy == "createdTime" && a.CreatedTime != b.CreatedTime {
+			return strings.Compare(a.CreatedTime, b.CreatedTime)
+		}
+		return strings.Compare(a.Id, b.Id)
+	})
+
+	start := 0
+	if req.PageToken != "" {
+		start, err = strconv.Atoi(req.PageToken)
+		if err != nil || start > len(found) {
+			return nil, &googleapi.Error{Code: http.StatusBadRequest, Message: "invalid page token"}
+		}
+	}
+
+	pageSize := req.PageSize
+	if pageSize == 0 {
+		pageSize = f.d.PageSize
+	}
+
+	list := &drive.FileList{Files: found[start:]}
+	if pageSize > 0 && int64(len(list.Files)) > pageSize {
+		list.Files = list.Files[:pageSize]
+		list.NextPageToken = strconv.Itoa(start + int(pageSize))
+	}
+
+	return list, nil
+}
+
+func (f files) Create(
+	ctx context.Context,
+	file *drive.File,
+	media io.Reader,
+	options ...googleapi.MediaOption,
+) (*drive.File, error) {
+	f.d.mu.Lock()
+	defer f.d.mu.Unlock()
+
+	if err := f.d.call("Files.Create", file.Name); err != nil {
+		return nil, err
+	}
+
+	var content []byte
+	if media != nil {
+		var err error
+		content, err = io.ReadAll(media)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return f.d.addFile(file, content), nil
+}
+
+func (f files) Copy(ctx context.Context, id string, file *drive.File) (*drive.File, error) {
+	f.d.mu.Lock()
+	defer f.d.mu.Unlock()
+
+	if err := f.d.call("Files.Copy", id); err != nil {
+		return nil, err
+	}
+
+	source, ok := f.d.files[id]
+	if !ok {
+		return nil, NotFound(id)
+	}
+
+	copied := copyFile(source)
+	copied.Id = ""
+	if file.Name != "" {
+		copied.Name = file.Name
+	}
+	if file.Parents != nil {
+		copied.Parents = slices.Clone(file.Parents)
+	}
+	if file.AppProperties != nil {
+		copied.AppProperties = maps.Clone(file.AppProperties)
+	}
+
+	return f.d.addFile(copied, slices.Clone(f.d.content[id])), nil
+}
+
+// The name, app properties and trashed flag set on the file are changed,
+// the app properties are merged like Drive merges them
+func (f files) Update(
+	ctx context.Context,
+	id string,
+	file *drive.File,
+	addParents, removeParents string,
+) error {
+	f.d.mu.Lock()
+	defer f.d.mu.Unlock()
+
+	if err := f.d.call("Files.Update", id); err != nil {
+		return err
+	}
+
+	existing, ok := f.d.files[id]
+	if !ok {
+		return NotFound(id)
+	}
+
+	if file != nil {
+		if file.Name != "" {
+			existing.Name = file.Name
+		}
+		if file.Trashed {
+			existing.Trashed = true
+		}
+		for key, value := range file.AppProperties {
+			if existing.AppProperties == nil {
+				existing.AppProperties = make(map[string]string)
+			}
+			existing.AppProperties[key] = value
+		}
+	}
+
+	if removeParents != "" {
+		removed := strings.Split(removeParents, ",")
+		existing.Parents = slices.DeleteFunc(existing.Parents, func(parent string) bool {
+			return slices.Contains(removed, parent)
+		})
+	}
+	if addParents != "" {
+		existing.Parents = append(existing.Parents, strings.Split(addParents, ",")...)
+	}
+
+	return nil
+}
+
+type changes struct{ d *Drive }
+
+func (c changes) GetStartPageToken(ctx context.Context, driveID string) (string, error) {
+	c.d.mu.Lock()
+	defer c.d.mu.Unlock()
+
+	if err := c.d.call("Changes.GetStartPageToken", driveID); err != nil {
+		return "", err
+	}
+
+	return c.d.StartPageToken, nil
+}
+
+func (c changes) List(
+	ctx context.Context,
+	pageToken, driveID, fields string,
+) (*drive.ChangeList, error) {
+	c.d.mu.Lock()
+	defer c.d.mu.Unlock()
+
+	if err := c.d.call("Changes.List", pageToken); err != nil {
+		return nil, err
+	}
+
+	page, ok := c.d.ChangePages[pageToken]
+	if !ok {
+		return nil, &googleapi.Error{
+			Code:    http.StatusNotFound,
+			Message: fmt.Sprintf("Page token %s not found", pageToken),
+		}
+	}
+
+	return page, nil
+}
+
+type channels struct{ d *Drive }
+
+// The resource ID of the channel is made from the folder ID
+func (c channels) Watch(
+	ctx context.Context,
+	folderID string,
+	channel *drive.Channel,
+) (*drive.Channel, error) {
+	c.d.mu.Lock()
+	defer c.d.mu.Unlock()
+
+	if err := c.d.call("Channels.Watch", folderID); err != nil {
+		return nil, err
+	}
+
+	watched := *channel
+	watched.ResourceId = "resource-" + folderID
+	c.d.Channels[channel.Id] = &watched
+
+	return &watched, nil
+}
+
+func (c channels) Stop(ctx context.Context, channel *drive.Channel) error {
+	c.d.mu.Lock()
+	defer c.d.mu.Unlock()
+
+	if err := c.d.call("Channels.Stop", channel.Id); err != nil {
+		return err
+	}
+
+	watched, ok := c.d.Channels[channel.Id]
+	if !ok || watched.ResourceId != channel.ResourceId {
+		return NotFound(channel.Id)
+	}
+
+	delete(c.d.Channels, channel.Id)
+	return nil
+}
+
+type comments struct{ d *Drive }
+
+func (c comments) Create(ctx context.Context, fileID string, comment *drive.Comment) error {
+	c.d.mu.Lock()
+	defer c.d.mu.Unlock()
+
+	if err := c.d.call("Comments.Create", fileID); err != nil {
+		return err
+	}
+
+	if _, ok := c.d.files[fileID]; !ok {
+		return NotFound(fileID)
+	}
+
+	c.d.Comments[fileID] = append(c.d.Comments[fileID], comment.Content)
+	return nil
+}
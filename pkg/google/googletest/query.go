@@ -0,0 +1,286 @@
+package googletest
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"google.golang.org/api/drive/v3"
+)
+
+// The part of the Drive query language the Scriptor queries use: the
+// parents, name, mimeType and trashed terms, app properties, and and, or,
+// not and parentheses. Anything else fails the query so a test doesn't pass
+// by matching files it shouldn't.
+type matcher func(file *drive.File) bool
+
+func parseQuery(query string) (matcher, error) {
+	tokens, err := tokenize(query)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(tokens) == 0 {
+		return func(*drive.File) bool { return true }, nil
+	}
+
+	p := &parser{tokens: tokens}
+	match, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+
+	if !p.done() {
+		return nil, fmt.Errorf("unexpected %q in query %q", p.peek().text, query)
+	}
+
+	return match, nil
+}
+
+type token struct {
+	text string
+
+	// strings are quoted in the query, the text has them unescaped
+	quoted bool
+}
+
+func tokenize(query string) ([]token, error) {
+	tokens := make([]token, 0)
+
+	for i := 0; i < len(query); {
+		c := query[i]
+		switch {
+		case c == ' ':
+			i++
+
+		case strings.ContainsRune("(){}=", rune(c)):
+			tokens = append(tokens, token{text: string(c)})
+			i++
+
+		case c == '!' && i+1 < len(query) && query[i+1] == '=':
+			tokens = append(tokens, token{text: "!="})
+			i += 2
+
+		case c == '\'':
+			var text strings.Builder
+			i++
+			for ; i < len(query) && query[i] != '\''; i++ {
+				if query[i] == '\\' && i+1 < len(query) {
+					i++
+				}
+				text.WriteByte(query[i])
+			}
+			if i == len(query) {
+				return nil, fmt.Errorf("unterminated string in query %q", query)
+			}
+			tokens = append(tokens, token{text: text.String(), quoted: true})
+			i++
+
+		default:
+			start := i
+			for i < len(query) && !strings.ContainsRune(" (){}=!'", rune(query[i])) {
+				i++
+			}
+			if start == i {
+				return nil, fmt.Errorf("unexpected %q in query %q", c, query)
+			}
+			tokens = append(tokens, token{text: query[start:i]})
+		}
+	}
+
+	return tokens, nil
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *parser) done() bool {
+	return p.pos >= len(p.tokens)
+}
+
+func (p *parser) peek() token {
+	if p.done() {
+		return token{}
+	}
+
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.peek()
+	p.pos++
+
+	return t
+}
+
+// Take the next token when it's the word
+func (p *parser) accept(word string) bool {
+	if t := p.peek(); !t.quoted && t.text == word {
+		p.pos++
+		return true
+	}
+
+	return false
+}
+
+func (p *parser) expect(word string) error {
+	if !p.accept(word) {
+		return fmt.Errorf("expected %q, got %q", word, p.peek().text)
+	}
+
+	return nil
+}
+
+func (p *parser) str() (string, error) {
+	t := p.next()
+	if !t.quoted {
+		return "", fmt.Errorf("expected a string, got %q", t.text)
+	}
+
+	return t.text, nil
+}
+
+func (p *parser) or() (matcher, error) {
+	terms := make([]matcher, 0)
+	for {
+		term, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		terms = append(terms, term)
+
+		if !p.accept("or") {
+			break
+		}
+	}
+
+	return func(file *drive.File) bool {
+		return slices.ContainsFunc(terms, func(term matcher) bool { return term(file) })
+	}, nil
+}
+
+func (p *parser) and() (matcher, error) {
+	terms := make([]matcher, 0)
+	for {
+		term, err := p.term()
+		if err != nil {
+			return nil, err
+		}
+		terms = append(terms, term)
+
+		if !p.accept("and") {
+			break
+		}
+	}
+
+	return func(file *drive.File) bool {
+		return !slices.ContainsFunc(terms, func(term matcher) bool { return !term(file) })
+	}, nil
+}
+
+func (p *parser) term() (matcher, error) {
+	switch {
+	case p.accept("("):
+		match, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		return match, p.expect(")")
+
+	case p.accept("not"):
+		match, err := p.term()
+		if err != nil {
+			return nil, err
+		}
+		return func(file *drive.File) bool { return !match(file) }, nil
+
+	case p.peek().quoted:
+		parent, _ := p.str()
+		if err := p.expect("in"); err != nil {
+			return nil, err
+		}
+		if err := p.expect("parents"); err != nil {
+			return nil, err
+		}
+		return func(file *drive.File) bool { return slices.Contains(file.Parents, parent) }, nil
+
+	case p.accept("appProperties"):
+		return p.appProperty()
+	}
+
+	field := p.next().text
+
+	negate := p.accept("!=")
+	if !negate {
+		if err := p.expect("="); err != nil {
+			return nil, err
+		}
+	}
+
+	var match matcher
+	switch field {
+	case "name", "mimeType":
+		value, err := p.str()
+		if err != nil {
+			return nil, err
+		}
+		match = func(file *drive.File) bool {
+			if field == "name" {
+				return file.Name == value
+			}
+			return file.MimeType == value
+		}
+
+	case "trashed":
+		value := p.next().text
+		if value != "true" && value != "false" {
+			return nil, fmt.Errorf("expected true or false, got %q", value)
+		}
+		match = func(file *drive.File) bool { return file.Trashed == (value == "true") }
+
+	default:
+		return nil, fmt.Errorf("unsupported query term %q", field)
+	}
+
+	if negate {
+		return func(file *drive.File) bool { return !match(file) }, nil
+	}
+
+	return match, nil
+}
+
+// appProperties has { key='<key>' and value='<value>' }
+func (p *parser) appProperty() (matcher, error) {
+	for _, word := range []string{"has", "{", "key", "="} {
+		if err := p.expect(word); err != nil {
+			return nil, err
+		}
+	}
+
+	key, err := p.str()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, word := range []string{"and", "value", "="} {
+		if err := p.expect(word); err != nil {
+			return nil, err
+		}
+	}
+
+	value, err := p.str()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := p.expect("}"); err != nil {
+		return nil, err
+	}
+
+	return func(file *drive.File) bool {
+		actual, ok := file.AppProperties[key]
+		return ok && actual == value
+	}, nil
+}
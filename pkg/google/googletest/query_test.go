@@ -0,0 +1,52 @@
+package googletest
+
+import (
+	"testing"
+
+	"google.golang.org/api/drive/v3"
+)
+
+func TestParseQuery(t *testing.T) {
+	file := &drive.File{
+		Id:            "file-1",
+		Name:          "Tom's notes.md",
+		MimeType:      "text/markdown",
+		Parents:       []string{"dest"},
+		AppProperties: map[string]string{"scriptor_document_id": "doc-1"},
+	}
+
+	tests := []struct {
+		query   string
+		want    bool
+		wantErr bool
+	}{
+		{query: "", want: true},
+		{query: "'dest' in parents", want: true},
+		{query: "'watch' in parents", want: false},
+		{query: `name = 'Tom\'s notes.md' and trashed = false`, want: true},
+		{query: "name != 'scan.pdf'", want: true},
+		{query: "mimeType = 'application/vnd.google-apps.folder'", want: false},
+		{query: "('watch' in parents or 'dest' in parents) and trashed = false", want: true},
+		{query: "'watch' in parents or 'dest' in parents and trashed = true", want: false},
+		{query: "not trashed = true", want: true},
+		{query: "appProperties has { key='scriptor_document_id' and value='doc-1' }", want: true},
+		{query: "appProperties has { key='scriptor_document_id' and value='doc-2' }", want: false},
+		{query: "modifiedTime > '2026-01-01'", wantErr: true},
+		{query: "name contains 'notes'", wantErr: true},
+		{query: "('dest' in parents", wantErr: true},
+		{query: "name = 'unterminated", wantErr: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.query, func(t *testing.T) {
+			match, err := parseQuery(tc.query)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if err == nil && match(file) != tc.want {
+				t.Fatalf("match = %v, want %v", !tc.want, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,46 @@
+package google
+
+import (
+	"context"
+	"time"
+
+	"github.com/KyleBrandon/scriptor/pkg/retry"
+)
+
+// RetryPolicy bounds how often a Drive call that failed with a transient
+// error is tried again.
+type RetryPolicy struct {
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
+// DefaultRetryPolicy is the policy NewGoogleDrive starts with.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:    4,
+	InitialBackoff: 500 * time.Millisecond,
+	MaxBackoff:     8 * time.Second,
+}
+
+// SetRetryPolicy changes how the Drive calls are retried. A policy of one
+// attempt turns the retries off.
+func (gd *GoogleDriveContext) SetRetryPolicy(policy RetryPolicy) {
+	gd.retryPolicy = policy
+}
+
+// Run the call until it succeeds, fails with an error IsRetryableError
+// doesn't retry, or runs out of attempts.
+func (gd *GoogleDriveContext) retry(
+	ctx context.Context,
+	call string,
+	operation func() error,
+) error {
+	policy := retry.Policy{
+		MaxAttempts:    gd.retryPolicy.MaxAttempts,
+		InitialBackoff: gd.retryPolicy.InitialBackoff,
+		MaxBackoff:     gd.retryPolicy.MaxBackoff,
+		Retryable:      IsRetryableError,
+	}
+
+	return retry.Do(ctx, policy, call, operation)
+}
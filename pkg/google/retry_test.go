@@ -0,0 +1,216 @@
+package google
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/KyleBrandon/scriptor/pkg/types"
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+)
+
+var testRetryPolicy = RetryPolicy{
+	MaxAttempts:    3,
+	InitialBackoff: time.Millisecond,
+	MaxBackoff:     4 * time.Millisecond,
+}
+
+func TestRetry(t *testing.T) {
+	rateLimited := &googleapi.Error{
+		Code:   http.StatusForbidden,
+		Errors: []googleapi.ErrorItem{{Reason: "userRateLimitExceeded"}},
+	}
+
+	tests := []struct {
+		name         string
+		codes        []int
+		apiErr       *googleapi.Error
+		wantAttempts int
+		wantErr      bool
+	}{
+		{name: "success", codes: []int{http.StatusOK}, wantAttempts: 1},
+		{
+			name:         "server error then success",
+			codes:        []int{http.StatusInternalServerError, http.StatusOK},
+			wantAttempts: 2,
+		},
+		{
+			name:         "unavailable then success",
+			codes:        []int{http.StatusServiceUnavailable, http.StatusServiceUnavailable, http.StatusOK},
+			wantAttempts: 3,
+		},
+		{
+			name:         "too many requests until out of attempts",
+			codes:        []int{http.StatusTooManyRequests, http.StatusTooManyRequests, http.StatusTooManyRequests, http.StatusOK},
+			wantAttempts: 3,
+			wantErr:      true,
+		},
+		{
+			name:         "rate limited with a 403",
+			apiErr:       rateLimited,
+			codes:        []int{http.StatusForbidden, http.StatusOK},
+			wantAttempts: 2,
+		},
+		{
+			name:         "unauthorized",
+			codes:        []int{http.StatusUnauthorized, http.StatusOK},
+			wantAttempts: 1,
+			wantErr:      true,
+		},
+		{
+			name:         "forbidden",
+			codes:        []int{http.StatusForbidden, http.StatusOK},
+			wantAttempts: 1,
+			wantErr:      true,
+		},
+		{
+			name:         "not found",
+			codes:        []int{http.StatusNotFound, http.StatusOK},
+			wantAttempts: 1,
+			wantErr:      true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			gd := &GoogleDriveContext{retryPolicy: testRetryPolicy}
+
+			attempts := 0
+			err := gd.retry(context.Background(), "test", func() error {
+				code := tc.codes[attempts]
+				attempts++
+
+				switch {
+				case code == http.StatusOK:
+					return nil
+				case tc.apiErr != nil:
+					return tc.apiErr
+				default:
+					return &googleapi.Error{Code: code}
+				}
+			})
+
+			if attempts != tc.wantAttempts || (err != nil) != tc.wantErr {
+				t.Fatalf("unexpected result: %d attempts, error %v", attempts, err)
+			}
+		})
+	}
+}
+
+func TestRetryStopsAtDeadline(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	gd := &GoogleDriveContext{
+		retryPolicy: RetryPolicy{MaxAttempts: 5, InitialBackoff: time.Second, MaxBackoff: time.Second},
+	}
+
+	attempts := 0
+	err := gd.retry(ctx, "test", func() error {
+		attempts++
+		return &googleapi.Error{Code: http.StatusServiceUnavailable}
+	})
+
+	if err == nil || attempts != 1 {
+		t.Fatalf("unexpected result: %d attempts, error %v", attempts, err)
+	}
+}
+
+// The Drive calls that are retried fail once with a server error, the
+// uploads check that the content is sent whole every time
+func TestDriveCallsRetry(t *testing.T) {
+	requests := make(map[string]int)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+
+		key := r.Method + " " + r.URL.Path + " " + r.URL.Query().Get("alt")
+		requests[key]++
+		if requests[key] == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprint(w, `{"error":{"code":503,"message":"backend error"}}`)
+			return
+		}
+
+		switch {
+		case r.Method == http.MethodPost && strings.Contains(r.URL.Path, "/upload/"):
+			if !strings.Contains(string(body), "the note") {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			json.NewEncoder(w).Encode(&drive.File{Id: "saved"})
+		case strings.HasSuffix(r.URL.Path, "/watch"):
+			json.NewEncoder(w).Encode(&drive.Channel{ResourceId: "resource-1"})
+		case r.URL.Path == "/changes":
+			json.NewEncoder(w).Encode(&drive.ChangeList{NewStartPageToken: "next"})
+		case r.URL.Query().Get("alt") == "media":
+			fmt.Fprint(w, "the scan")
+		default:
+			json.NewEncoder(w).Encode(&drive.File{
+				Id:           "file-1",
+				Name:         "scan.pdf",
+				Parents:      []string{"watch"},
+				CreatedTime:  "2026-03-01T10:00:00Z",
+				ModifiedTime: "2026-03-01T10:00:00Z",
+			})
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	service, err := drive.NewService(
+		context.Background(),
+		option.WithEndpoint(server.URL+"/"),
+		option.WithHTTPClient(server.Client()),
+	)
+	if err != nil {
+		t.Fatalf("failed to create the Drive service: %v", err)
+	}
+
+	gd := &GoogleDriveContext{api: NewDriveAPI(service)}
+	gd.SetRetryPolicy(testRetryPolicy)
+	ctx := context.Background()
+
+	if _, err := gd.GetDocument(ctx, "file-1"); err != nil {
+		t.Fatalf("GetDocument wasn't retried: %v", err)
+	}
+
+	changes, err := gd.QueryChanges(ctx, "watch", "", "start", false)
+	if err != nil || changes.NextStartToken != "next" {
+		t.Fatalf("QueryChanges wasn't retried: %v", err)
+	}
+
+	body, err := gd.GetReader(ctx, &types.Document{GoogleID: "file-1"})
+	if err != nil {
+		t.Fatalf("GetReader wasn't retried: %v", err)
+	}
+	if content, _ := io.ReadAll(body); string(content) != "the scan" {
+		t.Fatalf("unexpected content: %s", content)
+	}
+	body.Close()
+
+	if err := gd.Archive(ctx, "file-1", "archive"); err != nil {
+		t.Fatalf("Archive wasn't retried: %v", err)
+	}
+
+	if err := gd.SaveFile(ctx, "doc-1", "scan.md", "dest", types.CONTENT_TYPE_MARKDOWN, strings.NewReader("the note")); err != nil {
+		t.Fatalf("SaveFile wasn't retried: %v", err)
+	}
+
+	if _, err := gd.CreateWatchChannel(ctx, &types.WatchChannel{FolderID: "watch"}); err != nil {
+		t.Fatalf("CreateWatchChannel wasn't retried: %v", err)
+	}
+
+	// a reader that can't go back to its start is only sent once
+	reader := struct{ io.Reader }{strings.NewReader("the note")}
+	requests = make(map[string]int)
+	if err := gd.SaveFile(ctx, "doc-1", "scan.md", "dest", types.CONTENT_TYPE_MARKDOWN, reader); err == nil {
+		t.Fatalf("expected the upload to fail")
+	}
+}
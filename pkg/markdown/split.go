@@ -0,0 +1,364 @@
+package markdown
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Added to the title of a part that continues the section of the part
+// before it
+const CONTINUED_SUFFIX = " (continued)"
+
+type (
+	// SplitOptions decide when a note is too large to publish as a single
+	// note. Zero turns a limit off.
+	SplitOptions struct {
+		// Largest size of a part in bytes
+		MaxBytes int
+
+		// Largest number of headings in a part
+		MaxHeadings int
+	}
+
+	// Part is one of the notes a large note was split into.
+	Part struct {
+		Title   string
+		Content string
+	}
+
+	// Lines that are kept together in a part. A unit starts at a heading,
+	// titled after it, or at a paragraph of the section it belongs to.
+	splitUnit struct {
+		lines    []string
+		title    string
+		headings int
+
+		// The top level section the unit is in
+		section      string
+		sectionLevel int
+	}
+)
+
+// Validate checks the limits make sense.
+func (o SplitOptions) Validate() error {
+	if o.MaxBytes < 0 || o.MaxHeadings < 0 {
+		return fmt.Errorf("split limits can't be negative")
+	}
+
+	return nil
+}
+
+// NeedsSplit reports whether the Markdown is over either of the limits.
+func (o SplitOptions) NeedsSplit(content string) bool {
+	if o.MaxBytes > 0 && len(content) > o.MaxBytes {
+		return true
+	}
+
+	if o.MaxHeadings > 0 {
+		lines := strings.Split(content, "\n")
+		return countHeadings(lines, blockStates(lines)) > o.MaxHeadings
+	}
+
+	return false
+}
+
+// Split breaks the Markdown into parts that are within the limits. The parts
+// start at the top level headings when they can, then at the headings below
+// them, and only then between paragraphs. A part that starts in the middle
+// of a section gets the title of the section with CONTINUED_SUFFIX, as a
+// heading at the top of the part. Fenced code and math blocks are never
+// split, so a block larger than the limit ends up in a part of its own.
+// Markdown within the limits is returned as a single part.
+func Split(content string, options SplitOptions) []Part {
+	lines := strings.Split(content, "\n")
+	if !options.NeedsSplit(content) {
+		return []Part{{Title: firstHeading(lines), Content: content}}
+	}
+
+	open := blockStates(lines)
+	units := refine(sectionUnits(lines, open), options)
+
+	parts := make([]Part, 0)
+	var current []splitUnit
+	size, headings := 0, 0
+
+	flush := func() {
+		if len(current) > 0 {
+			parts = append(parts, buildPart(current))
+		}
+		current, size, headings = nil, 0, 0
+	}
+
+	for _, unit := range units {
+		unitSize := linesSize(unit.lines)
+		if len(current) > 0 &&
+			((options.MaxBytes > 0 && size+1+unitSize > options.MaxBytes) ||
+				(options.MaxHeadings > 0 && headings+unit.headings > options.MaxHeadings)) {
+			flush()
+		}
+
+		current = append(current, unit)
+		size += unitSize + 1
+		headings += unit.headings
+	}
+	flush()
+
+	return parts
+}
+
+// Build the part from its units, titled after its first heading or as the
+// continuation of the section it starts in
+func buildPart(units []splitUnit) Part {
+	lines := make([]string, 0)
+	for _, unit := range units {
+		lines = append(lines, unit.lines...)
+	}
+
+	first := units[0]
+	title := first.title
+	if title == "" && first.section != "" {
+		title = first.section + CONTINUED_SUFFIX
+		lines = append(
+			[]string{strings.Repeat("#", first.sectionLevel) + " " + title, ""},
+			lines...,
+		)
+	}
+
+	return Part{
+		Title:   title,
+		Content: strings.Trim(strings.Join(lines, "\n"), "\n"),
+	}
+}
+
+// Break the Markdown into sections at the top level headings. The lines
+// before the first heading are a unit without a section.
+func sectionUnits(lines []string, open []bool) []splitUnit {
+	top := topLevel(lines, open, 0)
+
+	units := breakAt(lines, open, top)
+	for i := range units {
+		if units[i].title != "" {
+			units[i].section = units[i].title
+			units[i].sectionLevel = top
+		}
+	}
+
+	return units
+}
+
+// Break the lines at the headings of the level
+func breakAt(lines []string, open []bool, level int) []splitUnit {
+	units := make([]splitUnit, 0)
+
+	start := 0
+	add := func(end int) {
+		if end <= start {
+			return
+		}
+
+		unit := splitUnit{
+			lines:    lines[start:end],
+			headings: countHeadings(lines[start:end], open[start:end]),
+		}
+		if !open[start] && headingLevel(lines[start]) == level {
+			unit.title = headingText(lines[start])
+		}
+
+		units = append(units, unit)
+	}
+
+	for i := range lines {
+		if i > start && !open[i] && headingLevel(lines[i]) == level {
+			add(i)
+			start = i
+		}
+	}
+	add(len(lines))
+
+	return units
+}
+
+// Break the units that are too large at the headings below them, and the
+// ones that have none at the paragraphs
+func refine(units []splitUnit, options SplitOptions) []splitUnit {
+	if options.MaxBytes <= 0 {
+		return units
+	}
+
+	refined := make([]splitUnit, 0, len(units))
+	for _, unit := range units {
+		if linesSize(unit.lines) <= options.MaxBytes {
+			refined = append(refined, unit)
+			continue
+		}
+
+		open := blockStates(unit.lines)
+
+		// the heading the unit starts with doesn't start a smaller unit
+		if below := topLevel(unit.lines, open, 1); below > 0 {
+			smaller := breakAt(unit.lines, open, below)
+			if len(smaller) > 1 {
+				smaller[0].title = unit.title
+				for i := range smaller {
+					smaller[i].section = unit.section
+					smaller[i].sectionLevel = unit.sectionLevel
+				}
+
+				refined = append(refined, refine(smaller, options)...)
+				continue
+			}
+		}
+
+		refined = append(refined, paragraphUnits(unit, open, options.MaxBytes)...)
+	}
+
+	return refined
+}
+
+// Break the unit between paragraphs, keeping each piece within the size
+// when the blocks allow it
+func paragraphUnits(unit splitUnit, open []bool, maxBytes int) []splitUnit {
+	units := make([]splitUnit, 0)
+
+	start, size := 0, 0
+	for i, line := range unit.lines {
+		// a new piece can start at a line after a blank line, outside of
+		// any block
+		canBreak := i > start && !open[i] && strings.TrimSpace(unit.lines[i-1]) == "" &&
+			strings.TrimSpace(line) != ""
+		if canBreak && size+len(line) > maxBytes {
+			units = append(units, pieceOf(unit, open, start, i))
+			start, size = i, 0
+		}
+
+		size += len(line) + 1
+	}
+	units = append(units, pieceOf(unit, open, start, len(unit.lines)))
+
+	return units
+}
+
+func pieceOf(unit splitUnit, open []bool, start, end int) splitUnit {
+	piece := splitUnit{
+		lines:        unit.lines[start:end],
+		headings:     countHeadings(unit.lines[start:end], open[start:end]),
+		section:      unit.section,
+		sectionLevel: unit.sectionLevel,
+	}
+
+	if start == 0 {
+		piece.title = unit.title
+	}
+
+	return piece
+}
+
+// For each line, whether it starts inside a fenced code block or a display
+// math block
+func blockStates(lines []string) []bool {
+	open := make([]bool, len(lines))
+
+	closing := ""
+	for i, line := range lines {
+		open[i] = closing != ""
+
+		switch closing {
+		case "":
+			if marker := fenceMarker(line); marker != "" {
+				closing = marker
+			} else if strings.Count(line, "$$")%2 == 1 {
+				closing = "$$"
+			} else if at := strings.LastIndex(line, `\[`); at >= 0 &&
+				!strings.Contains(line[at:], `\]`) {
+				closing = `\]`
+			}
+		case "$$":
+			if strings.Count(line, "$$")%2 == 1 {
+				closing = ""
+			}
+		case `\]`:
+			if strings.Contains(line, `\]`) {
+				closing = ""
+			}
+		default:
+			if marker := fenceMarker(line); marker != "" &&
+				strings.HasPrefix(marker, closing) {
+				closing = ""
+			}
+		}
+	}
+
+	return open
+}
+
+// The level of the highest headings from the start, zero when there are none
+func topLevel(lines []string, open []bool, start int) int {
+	top := 0
+	for i := start; i < len(lines); i++ {
+		if open[i] {
+			continue
+		}
+
+		if level := headingLevel(lines[i]); level > 0 && (top == 0 || level < top) {
+			top = level
+		}
+	}
+
+	return top
+}
+
+func countHeadings(lines []string, open []bool) int {
+	count := 0
+	for i, line := range lines {
+		if !open[i] && headingLevel(line) > 0 {
+			count++
+		}
+	}
+
+	return count
+}
+
+func firstHeading(lines []string) string {
+	open := blockStates(lines)
+	for i, line := range lines {
+		if !open[i] && headingLevel(line) > 0 {
+			return headingText(line)
+		}
+	}
+
+	return ""
+}
+
+// The level of an ATX heading, zero when the line isn't one
+func headingLevel(line string) int {
+	trimmed := strings.TrimLeft(line, " ")
+	if len(line)-len(trimmed) > 3 {
+		return 0
+	}
+
+	level := len(trimmed) - len(strings.TrimLeft(trimmed, "#"))
+	if level < 1 || level > 6 {
+		return 0
+	}
+
+	if len(trimmed) > level && trimmed[level] != ' ' && trimmed[level] != '\t' {
+		return 0
+	}
+
+	return level
+}
+
+func headingText(line string) string {
+	text := strings.TrimSpace(strings.TrimLeft(strings.TrimSpace(line), "#"))
+	return strings.TrimSpace(strings.TrimRight(text, "#"))
+}
+
+// The size of the lines joined by newlines
+func linesSize(lines []string) int {
+	size := max(len(lines)-1, 0)
+	for _, line := range lines {
+		size += len(line)
+	}
+
+	return size
+}
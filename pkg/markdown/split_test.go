@@ -0,0 +1,215 @@
+package markdown
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// A notebook of sections with the given number of paragraphs, each section
+// with a subsection halfway through
+func syntheticNotebook(sections, paragraphs int) string {
+	var b strings.Builder
+	for s := 1; s <= sections; s++ {
+		fmt.Fprintf(&b, "# Lecture %d\n\n", s)
+		for p := 1; p <= paragraphs; p++ {
+			if p == paragraphs/2+1 {
+				fmt.Fprintf(&b, "## Lecture %d examples\n\n", s)
+			}
+			fmt.Fprintf(&b, "Paragraph %d of lecture %d. %s\n\n", p, s, strings.Repeat("word ", 40))
+		}
+	}
+
+	return b.String()
+}
+
+// The lines of the parts without the blank lines and the headings added
+// for continued sections
+func reassemble(parts []Part) []string {
+	lines := make([]string, 0)
+	for _, part := range parts {
+		for _, line := range strings.Split(part.Content, "\n") {
+			if strings.TrimSpace(line) == "" ||
+				(headingLevel(line) > 0 && strings.HasSuffix(line, CONTINUED_SUFFIX)) {
+				continue
+			}
+			lines = append(lines, line)
+		}
+	}
+
+	return lines
+}
+
+func nonBlankLines(content string) []string {
+	lines := make([]string, 0)
+	for _, line := range strings.Split(content, "\n") {
+		if strings.TrimSpace(line) != "" {
+			lines = append(lines, line)
+		}
+	}
+
+	return lines
+}
+
+func TestSplitWithinLimits(t *testing.T) {
+	content := "# Notes\n\nA short note.\n"
+
+	parts := Split(content, SplitOptions{MaxBytes: 1024, MaxHeadings: 5})
+	if len(parts) != 1 || parts[0].Content != content || parts[0].Title != "Notes" {
+		t.Fatalf("unexpected parts: %+v", parts)
+	}
+}
+
+func TestSplitAtTopLevelHeadings(t *testing.T) {
+	content := syntheticNotebook(200, 6)
+	options := SplitOptions{MaxBytes: 20 * 1024}
+
+	parts := Split(content, options)
+	if len(parts) < 2 {
+		t.Fatalf("expected the notebook to be split, got %d parts", len(parts))
+	}
+
+	for i, part := range parts {
+		if len(part.Content) > options.MaxBytes {
+			t.Fatalf("part %d is %d bytes", i+1, len(part.Content))
+		}
+
+		// every section fits in a part, so they all start at a lecture
+		if !strings.HasPrefix(part.Content, "# Lecture ") ||
+			!strings.HasPrefix(part.Title, "Lecture ") {
+			t.Fatalf("part %d doesn't start at a lecture: %q", i+1, part.Title)
+		}
+	}
+
+	if !slices.Equal(reassemble(parts), nonBlankLines(content)) {
+		t.Fatalf("the parts don't add up to the notebook")
+	}
+}
+
+func TestSplitByHeadingCount(t *testing.T) {
+	content := syntheticNotebook(5, 2)
+
+	parts := Split(content, SplitOptions{MaxHeadings: 4})
+
+	titles := make([]string, 0, len(parts))
+	for _, part := range parts {
+		titles = append(titles, part.Title)
+	}
+
+	want := []string{"Lecture 1", "Lecture 3", "Lecture 5"}
+	if !slices.Equal(titles, want) {
+		t.Fatalf("unexpected titles: got %v want %v", titles, want)
+	}
+}
+
+func TestSplitLargeSectionAtSubheadings(t *testing.T) {
+	content := syntheticNotebook(1, 40)
+	options := SplitOptions{MaxBytes: 4 * 1024}
+
+	parts := Split(content, options)
+	if len(parts) < 3 {
+		t.Fatalf("expected the lecture to be split, got %d parts", len(parts))
+	}
+
+	if parts[0].Title != "Lecture 1" {
+		t.Fatalf("unexpected first title: %q", parts[0].Title)
+	}
+
+	// the subsection is kept at the top of a part
+	found := false
+	for _, part := range parts[1:] {
+		if part.Title == "Lecture 1 examples" {
+			found = strings.HasPrefix(part.Content, "## Lecture 1 examples")
+		}
+	}
+	if !found {
+		t.Fatalf("no part starts at the subsection")
+	}
+
+	for i, part := range parts {
+		if len(part.Content) > options.MaxBytes {
+			t.Fatalf("part %d is %d bytes", i+1, len(part.Content))
+		}
+	}
+
+	if !slices.Equal(reassemble(parts), nonBlankLines(content)) {
+		t.Fatalf("the parts don't add up to the lecture")
+	}
+}
+
+func TestSplitContinuesSectionsBetweenParagraphs(t *testing.T) {
+	var b strings.Builder
+	b.WriteString("# Introduction\n\n")
+	for p := 1; p <= 30; p++ {
+		fmt.Fprintf(&b, "Paragraph %d. %s\n\n", p, strings.Repeat("text ", 50))
+	}
+	content := b.String()
+
+	parts := Split(content, SplitOptions{MaxBytes: 2048})
+	if len(parts) < 2 {
+		t.Fatalf("expected the section to be split, got %d parts", len(parts))
+	}
+
+	for i, part := range parts[1:] {
+		if part.Title != "Introduction"+CONTINUED_SUFFIX ||
+			!strings.HasPrefix(part.Content, "# Introduction"+CONTINUED_SUFFIX+"\n\nParagraph ") {
+			t.Fatalf("part %d isn't a continuation: %q", i+2, part.Content[:40])
+		}
+	}
+
+	if !slices.Equal(reassemble(parts), nonBlankLines(content)) {
+		t.Fatalf("the parts don't add up to the section")
+	}
+}
+
+func TestSplitNeverBreaksBlocks(t *testing.T) {
+	var b strings.Builder
+	b.WriteString("# Proofs\n\n")
+	for block := 1; block <= 20; block++ {
+		fmt.Fprintf(&b, "Proof %d follows.\n\n", block)
+
+		// blank lines and headings inside the blocks are not places to split
+		b.WriteString("```python\n")
+		for line := 1; line <= 10; line++ {
+			fmt.Fprintf(&b, "# comment %d\n\nx = %d\n", line, line)
+		}
+		b.WriteString("```\n\n")
+
+		b.WriteString("$$\n")
+		for line := 1; line <= 10; line++ {
+			fmt.Fprintf(&b, "x_{%d} = %d\n\n", line, line)
+		}
+		b.WriteString("$$\n\n")
+
+		b.WriteString("\\[\n\n# not a heading\n\n\\]\n\n")
+	}
+	content := b.String()
+
+	parts := Split(content, SplitOptions{MaxBytes: 512})
+	if len(parts) < 2 {
+		t.Fatalf("expected the proofs to be split, got %d parts", len(parts))
+	}
+
+	for i, part := range parts {
+		if strings.Count(part.Content, "```")%2 != 0 ||
+			strings.Count(part.Content, "$$")%2 != 0 ||
+			strings.Count(part.Content, `\[`) != strings.Count(part.Content, `\]`) {
+			t.Fatalf("part %d splits a block:\n%s", i+1, part.Content)
+		}
+	}
+
+	if !slices.Equal(reassemble(parts), nonBlankLines(content)) {
+		t.Fatalf("the parts don't add up to the proofs")
+	}
+}
+
+func TestSplitOptionsValidate(t *testing.T) {
+	if err := (SplitOptions{MaxBytes: -1}).Validate(); err == nil {
+		t.Fatalf("expected negative limits to be rejected")
+	}
+
+	if err := (SplitOptions{}).Validate(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
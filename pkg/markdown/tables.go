@@ -0,0 +1,528 @@
+package markdown
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	// Leave wide tables as they are
+	TABLE_POLICY_NONE = "none"
+
+	// Swap the rows and columns of tables with a few rows. Tables with more
+	// rows than TableOptions.TransposeMaxRows are split instead.
+	TABLE_POLICY_TRANSPOSE = "transpose"
+
+	// Split the columns into stacked tables that each repeat the first column
+	TABLE_POLICY_SPLIT = "split"
+
+	// Turn each row into a section listing its values by column name
+	TABLE_POLICY_DEFINITION_LIST = "definition-list"
+
+	// Tables with 10 or more columns are too wide to read in a narrow pane
+	DEFAULT_TABLE_MAX_COLUMNS = 9
+
+	DEFAULT_TABLE_CHUNK_SIZE         = 4
+	DEFAULT_TABLE_TRANSPOSE_MAX_ROWS = 3
+)
+
+type (
+	// TableOptions control which tables are too wide and what is done with
+	// them.
+	TableOptions struct {
+		Policy string
+
+		// Tables with more columns than MaxColumns, or with a row longer than
+		// MaxWidth characters, are transformed. Zero turns the check off.
+		MaxColumns int
+		MaxWidth   int
+
+		// Number of columns besides the key column in each split table
+		ChunkSize int
+
+		// Largest number of rows a table can have to be transposed
+		TransposeMaxRows int
+	}
+
+	// TableChange records a table that was transformed.
+	TableChange struct {
+		// Line of the table header in the original Markdown, starting at 1
+		Line           int    `json:"line"`
+		Columns        int    `json:"columns"`
+		Rows           int    `json:"rows"`
+		Transformation string `json:"transformation"`
+	}
+
+	table struct {
+		header []string
+		align  []string
+		rows   [][]string
+	}
+)
+
+// DefaultTableOptions returns the options used when nothing is configured.
+func DefaultTableOptions() TableOptions {
+	return TableOptions{
+		Policy:           TABLE_POLICY_SPLIT,
+		MaxColumns:       DEFAULT_TABLE_MAX_COLUMNS,
+		ChunkSize:        DEFAULT_TABLE_CHUNK_SIZE,
+		TransposeMaxRows: DEFAULT_TABLE_TRANSPOSE_MAX_ROWS,
+	}
+}
+
+// Validate checks the policy is known and the limits make sense.
+func (o TableOptions) Validate() error {
+	switch o.Policy {
+	case TABLE_POLICY_NONE,
+		TABLE_POLICY_TRANSPOSE,
+		TABLE_POLICY_SPLIT,
+		TABLE_POLICY_DEFINITION_LIST:
+	default:
+		return fmt.Errorf("unknown table policy: %q", o.Policy)
+	}
+
+	if o.MaxColumns < 0 || o.MaxWidth < 0 || o.TransposeMaxRows < 0 {
+		return fmt.Errorf("table limits can't be negative")
+	}
+
+	if o.ChunkSize < 1 {
+		return fmt.Errorf("table chunk size must be positive: %d", o.ChunkSize)
+	}
+
+	return nil
+}
+
+// FormatTables rewrites the pipe tables in the Markdown that are wider than
+// the options allow. Tables inside fenced code blocks are left alone. Each
+// transformed table is preceded by an Obsidian comment saying what was done
+// to it, and is returned in the list of changes.
+func FormatTables(content string, options TableOptions) (string, []TableChange) {
+	changes := make([]TableChange, 0)
+	if options.Policy == TABLE_POLICY_NONE {
+		return content, changes
+	}
+
+	lines := strings.Split(content, "\n")
+	output := make([]string, 0, len(lines))
+
+	fence := ""
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+
+		if marker := fenceMarker(line); marker != "" {
+			switch {
+			case fence == "":
+				fence = marker
+			case strings.HasPrefix(marker, fence):
+				fence = ""
+			}
+		}
+
+		if fence != "" || !isTableStart(lines, i) {
+			output = append(output, line)
+			continue
+		}
+
+		end := i + 2
+		for end < len(lines) && isTableRow(lines[end]) {
+			end++
+		}
+
+		t := parseTable(lines[i:end])
+		transformation, formatted := t.format(options)
+		if transformation == "" {
+			output = append(output, lines[i:end]...)
+		} else {
+			changes = append(changes, TableChange{
+				Line:           i + 1,
+				Columns:        len(t.header),
+				Rows:           len(t.rows),
+				Transformation: transformation,
+			})
+
+			output = append(
+				output,
+				fmt.Sprintf(
+					"%%%% table with %d columns: %s %%%%",
+					len(t.header),
+					transformation,
+				),
+			)
+			output = append(output, formatted...)
+		}
+
+		i = end - 1
+	}
+
+	return strings.Join(output, "\n"), changes
+}
+
+// The fence characters if the line opens or closes a fenced code block
+func fenceMarker(line string) string {
+	trimmed := strings.TrimLeft(line, " ")
+	if len(line)-len(trimmed) > 3 {
+		return ""
+	}
+
+	for _, c := range []string{"`", "~"} {
+		n := len(trimmed) - len(strings.TrimLeft(trimmed, c))
+		if n >= 3 {
+			return strings.Repeat(c, n)
+		}
+	}
+
+	return ""
+}
+
+// A table is a row with a pipe followed by a delimiter row
+func isTableStart(lines []string, i int) bool {
+	if i+1 >= len(lines) || !isTableRow(lines[i]) {
+		return false
+	}
+
+	return isDelimiterRow(lines[i+1])
+}
+
+func isTableRow(line string) bool {
+	if strings.TrimSpace(line) == "" {
+		return false
+	}
+
+	return len(splitCells(line)) > 1 || strings.HasPrefix(strings.TrimSpace(line), "|")
+}
+
+func isDelimiterRow(line string) bool {
+	if !strings.Contains(line, "|") {
+		return false
+	}
+
+	for _, cell := range splitCells(line) {
+		cell = strings.TrimPrefix(strings.TrimSuffix(cell, ":"), ":")
+		if cell == "" || strings.Trim(cell, "-") != "" {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Mark the bytes of the line that are inside inline code. A run of backticks
+// without a matching run is not code.
+func codeMask(line string) []bool {
+	mask := make([]bool, len(line))
+
+	for i := 0; i < len(line); {
+		if line[i] == '\\' {
+			i += 2
+			continue
+		}
+
+		if line[i] != '`' {
+			i++
+			continue
+		}
+
+		open := i
+		for i < len(line) && line[i] == '`' {
+			i++
+		}
+		run := i - open
+
+		end := -1
+		for j := i; j < len(line); {
+			if line[j] != '`' {
+				j++
+				continue
+			}
+
+			start := j
+			for j < len(line) && line[j] == '`' {
+				j++
+			}
+
+			if j-start == run {
+				end = j
+				break
+			}
+		}
+
+		if end < 0 {
+			continue
+		}
+
+		for k := open; k < end; k++ {
+			mask[k] = true
+		}
+		i = end
+	}
+
+	return mask
+}
+
+// Split a row into its cells. Escaped pipes and pipes inside inline code are
+// part of the cell, and the leading and trailing pipes are optional.
+func splitCells(line string) []string {
+	line = strings.TrimSpace(line)
+	mask := codeMask(line)
+
+	cells := make([]string, 0)
+	start := 0
+	for i := 0; i < len(line); i++ {
+		if line[i] == '\\' {
+			i++
+			continue
+		}
+
+		if line[i] == '|' && !mask[i] {
+			cells = append(cells, line[start:i])
+			start = i + 1
+		}
+	}
+	cells = append(cells, line[start:])
+
+	if strings.HasPrefix(line, "|") {
+		cells = cells[1:]
+	}
+
+	if len(cells) > 1 && cells[len(cells)-1] == "" && strings.HasSuffix(line, "|") {
+		cells = cells[:len(cells)-1]
+	}
+
+	for i := range cells {
+		cells[i] = strings.TrimSpace(cells[i])
+	}
+
+	return cells
+}
+
+// Parse the table and pad the header and rows so every row has the same
+// number of columns.
+func parseTable(lines []string) *table {
+	t := &table{
+		header: splitCells(lines[0]),
+		align:  splitCells(lines[1]),
+	}
+
+	columns := max(len(t.header), len(t.align))
+	for _, line := range lines[2:] {
+		row := splitCells(line)
+		t.rows = append(t.rows, row)
+		columns = max(columns, len(row))
+	}
+
+	t.header = pad(t.header, columns, "")
+	t.align = pad(t.align, columns, "---")
+	for i := range t.rows {
+		t.rows[i] = pad(t.rows[i], columns, "")
+	}
+
+	return t
+}
+
+func pad(cells []string, columns int, value string) []string {
+	for len(cells) < columns {
+		cells = append(cells, value)
+	}
+
+	return cells
+}
+
+// The number of characters in the widest row
+func (t *table) width() int {
+	width := utf8.RuneCountInString(renderRow(t.header))
+	for _, row := range t.rows {
+		width = max(width, utf8.RuneCountInString(renderRow(row)))
+	}
+
+	return width
+}
+
+func (t *table) tooWide(options TableOptions) bool {
+	if options.MaxColumns > 0 && len(t.header) > options.MaxColumns {
+		return true
+	}
+
+	return options.MaxWidth > 0 && t.width() > options.MaxWidth
+}
+
+// Apply the policy to the table if it is too wide. Returns the
+// transformation that was applied, or nothing if the table was left alone.
+func (t *table) format(options TableOptions) (string, []string) {
+	if !t.tooWide(options) {
+		return "", nil
+	}
+
+	switch options.Policy {
+	case TABLE_POLICY_TRANSPOSE:
+		if len(t.rows) <= options.TransposeMaxRows {
+			return TABLE_POLICY_TRANSPOSE, t.transpose().render()
+		}
+
+		fallthrough
+
+	case TABLE_POLICY_SPLIT:
+		tables := t.split(options.ChunkSize)
+		if len(tables) < 2 {
+			return "", nil
+		}
+
+		lines := make([]string, 0)
+		for i, chunk := range tables {
+			if i > 0 {
+				lines = append(lines, "")
+			}
+			lines = append(lines, chunk.render()...)
+		}
+
+		return TABLE_POLICY_SPLIT, lines
+
+	case TABLE_POLICY_DEFINITION_LIST:
+		return TABLE_POLICY_DEFINITION_LIST, t.definitionList()
+	}
+
+	return "", nil
+}
+
+// Each column becomes a row, with the header in the first column
+func (t *table) transpose() *table {
+	transposed := &table{
+		header: []string{t.header[0]},
+		align:  []string{"---"},
+	}
+
+	for _, row := range t.rows {
+		transposed.header = append(transposed.header, row[0])
+		transposed.align = append(transposed.align, "---")
+	}
+
+	for column := 1; column < len(t.header); column++ {
+		row := []string{t.header[column]}
+		for _, r := range t.rows {
+			row = append(row, r[column])
+		}
+		transposed.rows = append(transposed.rows, row)
+	}
+
+	return transposed
+}
+
+// Split the columns after the first into tables of chunkSize columns, each
+// starting with the first column so the rows can still be told apart.
+func (t *table) split(chunkSize int) []*table {
+	tables := make([]*table, 0)
+
+	for start := 1; start < len(t.header); start += chunkSize {
+		end := min(start+chunkSize, len(t.header))
+
+		chunk := &table{
+			header: append([]string{t.header[0]}, t.header[start:end]...),
+			align:  append([]string{t.align[0]}, t.align[start:end]...),
+		}
+
+		for _, row := range t.rows {
+			chunk.rows = append(
+				chunk.rows,
+				append([]string{row[0]}, row[start:end]...),
+			)
+		}
+
+		tables = append(tables, chunk)
+	}
+
+	return tables
+}
+
+// Each row becomes a bold heading from its first cell followed by a list of
+// the other cells named by their column. Empty cells are left out.
+func (t *table) definitionList() []string {
+	lines := make([]string, 0)
+
+	for i, row := range t.rows {
+		if i > 0 {
+			lines = append(lines, "")
+		}
+
+		title := row[0]
+		if title == "" {
+			title = fmt.Sprintf("Row %d", i+1)
+		}
+		lines = append(lines, fmt.Sprintf("**%s**", unescapeCell(title)))
+
+		for column := 1; column < len(row); column++ {
+			if row[column] == "" {
+				continue
+			}
+
+			name := t.header[column]
+			if name == "" {
+				name = fmt.Sprintf("Column %d", column+1)
+			}
+
+			lines = append(
+				lines,
+				fmt.Sprintf("- %s: %s", unescapeCell(name), unescapeCell(row[column])),
+			)
+		}
+	}
+
+	return lines
+}
+
+func (t *table) render() []string {
+	lines := []string{renderRow(t.header), renderRow(t.align)}
+	for _, row := range t.rows {
+		lines = append(lines, renderRow(row))
+	}
+
+	return lines
+}
+
+func renderRow(cells []string) string {
+	escaped := make([]string, len(cells))
+	for i, cell := range cells {
+		escaped[i] = escapeCell(cell)
+	}
+
+	return "| " + strings.Join(escaped, " | ") + " |"
+}
+
+// Escape the pipes left bare inside inline code so they don't split the cell
+// when the table is written back out.
+func escapeCell(cell string) string {
+	var b strings.Builder
+
+	for i := 0; i < len(cell); i++ {
+		if cell[i] == '\\' && i+1 < len(cell) {
+			b.WriteString(cell[i : i+2])
+			i++
+			continue
+		}
+
+		if cell[i] == '|' {
+			b.WriteString(`\|`)
+			continue
+		}
+
+		b.WriteByte(cell[i])
+	}
+
+	return b.String()
+}
+
+// Outside a table an escaped pipe inside inline code is shown with the
+// backslash, so drop the escape when a cell is moved out of its table.
+func unescapeCell(cell string) string {
+	mask := codeMask(cell)
+
+	var b strings.Builder
+	for i := 0; i < len(cell); i++ {
+		if cell[i] == '\\' && i+1 < len(cell) && cell[i+1] == '|' && mask[i] {
+			continue
+		}
+
+		b.WriteByte(cell[i])
+	}
+
+	return b.String()
+}
@@ -0,0 +1,353 @@
+package markdown
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+// A table with a key column and 10 more, as Mathpix writes them
+const wideTable = `Quarterly results
+
+| Region | Jan | Feb | Mar | Apr | May | Jun | Jul | Aug | Sep | Oct |
+|:--|--:|--:|--:|--:|--:|--:|--:|--:|--:|--:|
+| North | 1 | 2 | 3 | 4 | 5 | 6 | 7 | 8 | 9 | 10 |
+| South | 11 | 12 | 13 | 14 | 15 | 16 | 17 | 18 | 19 | 20 |
+
+Totals are in thousands.`
+
+func testTableOptions(policy string) TableOptions {
+	options := DefaultTableOptions()
+	options.Policy = policy
+
+	return options
+}
+
+func TestSplitCells(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+		want []string
+	}{
+		{
+			name: "leading and trailing pipes",
+			line: "| a | b |",
+			want: []string{"a", "b"},
+		},
+		{
+			name: "missing trailing pipe",
+			line: "| a | b",
+			want: []string{"a", "b"},
+		},
+		{
+			name: "no outer pipes",
+			line: "a | b",
+			want: []string{"a", "b"},
+		},
+		{
+			name: "empty cells",
+			line: "| a |  | c |",
+			want: []string{"a", "", "c"},
+		},
+		{
+			name: "escaped pipe",
+			line: `| a \| b | c |`,
+			want: []string{`a \| b`, "c"},
+		},
+		{
+			name: "pipe inside inline code",
+			line: "| `a | b` | c |",
+			want: []string{"`a | b`", "c"},
+		},
+		{
+			name: "pipe inside double backtick code",
+			line: "| ``a ` | b`` | c |",
+			want: []string{"``a ` | b``", "c"},
+		},
+		{
+			name: "unmatched backtick is not code",
+			line: "| `a | b |",
+			want: []string{"`a", "b"},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got := splitCells(tc.line)
+			if !slices.Equal(got, tc.want) {
+				t.Fatalf("unexpected cells: got %q want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestFormatTables(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		options TableOptions
+		want    string
+		changes []TableChange
+	}{
+		{
+			name:    "narrow table is left alone",
+			content: "| a | b\n|---|---\n| 1 | 2",
+			options: testTableOptions(TABLE_POLICY_SPLIT),
+			want:    "| a | b\n|---|---\n| 1 | 2",
+		},
+		{
+			name:    "policy none",
+			content: wideTable,
+			options: testTableOptions(TABLE_POLICY_NONE),
+			want:    wideTable,
+		},
+		{
+			name:    "split",
+			content: wideTable,
+			options: testTableOptions(TABLE_POLICY_SPLIT),
+			want: `Quarterly results
+
+%% table with 11 columns: split %%
+| Region | Jan | Feb | Mar | Apr |
+| :-- | --: | --: | --: | --: |
+| North | 1 | 2 | 3 | 4 |
+| South | 11 | 12 | 13 | 14 |
+
+| Region | May | Jun | Jul | Aug |
+| :-- | --: | --: | --: | --: |
+| North | 5 | 6 | 7 | 8 |
+| South | 15 | 16 | 17 | 18 |
+
+| Region | Sep | Oct |
+| :-- | --: | --: |
+| North | 9 | 10 |
+| South | 19 | 20 |
+
+Totals are in thousands.`,
+			changes: []TableChange{
+				{Line: 3, Columns: 11, Rows: 2, Transformation: TABLE_POLICY_SPLIT},
+			},
+		},
+		{
+			name:    "transpose",
+			content: wideTable,
+			options: testTableOptions(TABLE_POLICY_TRANSPOSE),
+			want: `Quarterly results
+
+%% table with 11 columns: transpose %%
+| Region | North | South |
+| --- | --- | --- |
+| Jan | 1 | 11 |
+| Feb | 2 | 12 |
+| Mar | 3 | 13 |
+| Apr | 4 | 14 |
+| May | 5 | 15 |
+| Jun | 6 | 16 |
+| Jul | 7 | 17 |
+| Aug | 8 | 18 |
+| Sep | 9 | 19 |
+| Oct | 10 | 20 |
+
+Totals are in thousands.`,
+			changes: []TableChange{
+				{Line: 3, Columns: 11, Rows: 2, Transformation: TABLE_POLICY_TRANSPOSE},
+			},
+		},
+		{
+			name:    "transpose falls back to split with too many rows",
+			content: wideTable,
+			options: TableOptions{
+				Policy:           TABLE_POLICY_TRANSPOSE,
+				MaxColumns:       9,
+				ChunkSize:        5,
+				TransposeMaxRows: 1,
+			},
+			want: `Quarterly results
+
+%% table with 11 columns: split %%
+| Region | Jan | Feb | Mar | Apr | May |
+| :-- | --: | --: | --: | --: | --: |
+| North | 1 | 2 | 3 | 4 | 5 |
+| South | 11 | 12 | 13 | 14 | 15 |
+
+| Region | Jun | Jul | Aug | Sep | Oct |
+| :-- | --: | --: | --: | --: | --: |
+| North | 6 | 7 | 8 | 9 | 10 |
+| South | 16 | 17 | 18 | 19 | 20 |
+
+Totals are in thousands.`,
+			changes: []TableChange{
+				{Line: 3, Columns: 11, Rows: 2, Transformation: TABLE_POLICY_SPLIT},
+			},
+		},
+		{
+			name:    "definition list",
+			content: "| Item | Qty | Note |\n|---|---|---|\n| Tile | 40 | |\n| Grout | 2 | `mix | 1:3` |",
+			options: TableOptions{
+				Policy:     TABLE_POLICY_DEFINITION_LIST,
+				MaxColumns: 2,
+				ChunkSize:  1,
+			},
+			want: "%% table with 3 columns: definition-list %%\n" +
+				"**Tile**\n- Qty: 40\n\n**Grout**\n- Qty: 2\n- Note: `mix | 1:3`",
+			changes: []TableChange{
+				{Line: 1, Columns: 3, Rows: 2, Transformation: TABLE_POLICY_DEFINITION_LIST},
+			},
+		},
+		{
+			name:    "single row transposed",
+			content: "| k | a | b | c | d |\n| - | - | - | - | - |\n| v | 1 | 2 | 3 | 4 |",
+			options: TableOptions{
+				Policy:           TABLE_POLICY_TRANSPOSE,
+				MaxColumns:       3,
+				ChunkSize:        2,
+				TransposeMaxRows: 3,
+			},
+			want: "%% table with 5 columns: transpose %%\n" +
+				"| k | v |\n| --- | --- |\n| a | 1 |\n| b | 2 |\n| c | 3 |\n| d | 4 |",
+			changes: []TableChange{
+				{Line: 1, Columns: 5, Rows: 1, Transformation: TABLE_POLICY_TRANSPOSE},
+			},
+		},
+		{
+			name:    "single row split",
+			content: "| k | a | b | c | d |\n| - | - | - | - | - |\n| v | 1 | 2 | 3 | 4 |",
+			options: TableOptions{
+				Policy:     TABLE_POLICY_SPLIT,
+				MaxColumns: 3,
+				ChunkSize:  2,
+			},
+			want: "%% table with 5 columns: split %%\n" +
+				"| k | a | b |\n| - | - | - |\n| v | 1 | 2 |\n\n" +
+				"| k | c | d |\n| - | - | - |\n| v | 3 | 4 |",
+			changes: []TableChange{
+				{Line: 1, Columns: 5, Rows: 1, Transformation: TABLE_POLICY_SPLIT},
+			},
+		},
+		{
+			name:    "malformed rows are padded",
+			content: "k | a | b | c\n--- | ---\nv | 1\nw | 1 | 2 | 3 | 4",
+			options: TableOptions{
+				Policy:     TABLE_POLICY_SPLIT,
+				MaxColumns: 3,
+				ChunkSize:  2,
+			},
+			want: "%% table with 5 columns: split %%\n" +
+				"| k | a | b |\n| --- | --- | --- |\n| v | 1 |  |\n| w | 1 | 2 |\n\n" +
+				"| k | c |  |\n| --- | --- | --- |\n| v |  |  |\n| w | 3 | 4 |",
+			changes: []TableChange{
+				{Line: 1, Columns: 5, Rows: 2, Transformation: TABLE_POLICY_SPLIT},
+			},
+		},
+		{
+			name:    "pipes inside inline code stay in their cell",
+			content: "| k | a | b | c |\n|---|---|---|---|\n| v | `x | y` | `a \\| b` | 3 |",
+			options: TableOptions{
+				Policy:     TABLE_POLICY_SPLIT,
+				MaxColumns: 3,
+				ChunkSize:  2,
+			},
+			want: "%% table with 4 columns: split %%\n" +
+				"| k | a | b |\n| --- | --- | --- |\n| v | `x \\| y` | `a \\| b` |\n\n" +
+				"| k | c |\n| --- | --- |\n| v | 3 |",
+			changes: []TableChange{
+				{Line: 1, Columns: 4, Rows: 1, Transformation: TABLE_POLICY_SPLIT},
+			},
+		},
+		{
+			name:    "wide by width",
+			content: "| a | b |\n|---|---|\n| " + strings.Repeat("x", 30) + " | y |",
+			options: TableOptions{
+				Policy:    TABLE_POLICY_DEFINITION_LIST,
+				MaxWidth:  20,
+				ChunkSize: 1,
+			},
+			want: "%% table with 2 columns: definition-list %%\n" +
+				"**" + strings.Repeat("x", 30) + "**\n- b: y",
+			changes: []TableChange{
+				{Line: 1, Columns: 2, Rows: 1, Transformation: TABLE_POLICY_DEFINITION_LIST},
+			},
+		},
+		{
+			name:    "tables in code blocks are left alone",
+			content: "```\n" + wideTable + "\n```",
+			options: testTableOptions(TABLE_POLICY_SPLIT),
+			want:    "```\n" + wideTable + "\n```",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, changes := FormatTables(tc.content, tc.options)
+			if got != tc.want {
+				t.Fatalf("unexpected Markdown:\ngot\n%s\nwant\n%s", got, tc.want)
+			}
+
+			if tc.changes == nil {
+				tc.changes = []TableChange{}
+			}
+
+			if !slices.Equal(changes, tc.changes) {
+				t.Fatalf("unexpected changes: got %+v want %+v", changes, tc.changes)
+			}
+		})
+	}
+}
+
+func TestFormatTablesPreservesCells(t *testing.T) {
+	cells := func(content string) []string {
+		found := make([]string, 0)
+		for _, line := range strings.Split(content, "\n") {
+			if !strings.HasPrefix(line, "|") || isDelimiterRow(line) {
+				continue
+			}
+
+			for _, cell := range splitCells(line) {
+				if cell != "" {
+					found = append(found, cell)
+				}
+			}
+		}
+
+		slices.Sort(found)
+		return slices.Compact(found)
+	}
+
+	want := cells(wideTable)
+	for _, policy := range []string{TABLE_POLICY_SPLIT, TABLE_POLICY_TRANSPOSE} {
+		got, _ := FormatTables(wideTable, testTableOptions(policy))
+		if !slices.Equal(cells(got), want) {
+			t.Fatalf("%s changed the cells: got %q want %q", policy, cells(got), want)
+		}
+	}
+}
+
+func TestTableOptionsValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		options TableOptions
+		wantErr bool
+	}{
+		{name: "defaults", options: DefaultTableOptions()},
+		{name: "unknown policy", options: testTableOptions("shrink"), wantErr: true},
+		{
+			name:    "zero chunk size",
+			options: TableOptions{Policy: TABLE_POLICY_SPLIT},
+			wantErr: true,
+		},
+		{
+			name:    "negative limit",
+			options: TableOptions{Policy: TABLE_POLICY_SPLIT, ChunkSize: 1, MaxColumns: -1},
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.options.Validate()
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+}
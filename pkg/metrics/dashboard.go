@@ -0,0 +1,139 @@
+package metrics
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+const (
+	// CloudWatch dashboards are 24 units wide
+	DASHBOARD_WIDTH = 24
+
+	// Each subsystem starts with a header and lays its metrics out in rows
+	// of WIDGETS_PER_ROW graphs
+	HEADER_HEIGHT   = 1
+	WIDGETS_PER_ROW = 3
+	WIDGET_WIDTH    = DASHBOARD_WIDTH / WIDGETS_PER_ROW
+	WIDGET_HEIGHT   = 6
+
+	// Seconds each data point of the graphs covers
+	WIDGET_PERIOD = 300
+)
+
+// Widget is a widget of a CloudWatch dashboard body.
+type Widget struct {
+	Type       string         `json:"type"`
+	X          int            `json:"x"`
+	Y          int            `json:"y"`
+	Width      int            `json:"width"`
+	Height     int            `json:"height"`
+	Properties map[string]any `json:"properties"`
+}
+
+// DashboardBody renders the CloudWatch dashboard of every registered metric
+// as JSON. The region is where the graphs read the metrics from.
+func DashboardBody(region string) (string, error) {
+	body := struct {
+		Widgets []Widget `json:"widgets"`
+	}{
+		Widgets: Layout(registry, region),
+	}
+
+	data, err := json.Marshal(body)
+	if err != nil {
+		return "", err
+	}
+
+	return string(data), nil
+}
+
+// Layout places a header for each subsystem that has metrics, in the order of
+// Subsystems, followed by a graph for each of its metrics. Subsystems
+// without metrics are left off.
+func Layout(metrics []Metric, region string) []Widget {
+	widgets := make([]Widget, 0)
+
+	y := 0
+	for _, subsystem := range Subsystems {
+		group := make([]Metric, 0)
+		for _, metric := range metrics {
+			if metric.Subsystem == subsystem {
+				group = append(group, metric)
+			}
+		}
+
+		if len(group) == 0 {
+			continue
+		}
+
+		widgets = append(widgets, Widget{
+			Type:   "text",
+			X:      0,
+			Y:      y,
+			Width:  DASHBOARD_WIDTH,
+			Height: HEADER_HEIGHT,
+			Properties: map[string]any{
+				"markdown": "## " + strings.ToUpper(subsystem[:1]) + subsystem[1:],
+			},
+		})
+		y += HEADER_HEIGHT
+
+		for i, metric := range group {
+			widgets = append(widgets, Widget{
+				Type:       "metric",
+				X:          (i % WIDGETS_PER_ROW) * WIDGET_WIDTH,
+				Y:          y + (i/WIDGETS_PER_ROW)*WIDGET_HEIGHT,
+				Width:      WIDGET_WIDTH,
+				Height:     WIDGET_HEIGHT,
+				Properties: graphProperties(metric, region),
+			})
+		}
+
+		rows := (len(group) + WIDGETS_PER_ROW - 1) / WIDGETS_PER_ROW
+		y += rows * WIDGET_HEIGHT
+	}
+
+	return widgets
+}
+
+func graphProperties(metric Metric, region string) map[string]any {
+	properties := map[string]any{
+		"title":   string(metric.Name),
+		"view":    "timeSeries",
+		"region":  region,
+		"stat":    metric.Statistic,
+		"period":  WIDGET_PERIOD,
+		"metrics": []any{graphMetric(metric)},
+	}
+
+	if metric.AlarmThreshold > 0 {
+		properties["annotations"] = map[string]any{
+			"horizontal": []map[string]any{
+				{"label": "Alarm", "value": metric.AlarmThreshold},
+			},
+		}
+	}
+
+	return properties
+}
+
+// A metric without dimensions is graphed directly. One with dimensions is
+// searched for, so each value of the dimension gets its own line without
+// listing them here.
+func graphMetric(metric Metric) []any {
+	if len(metric.Dimensions) == 0 {
+		return []any{NAMESPACE, string(metric.Name)}
+	}
+
+	schema := append([]string{NAMESPACE}, metric.Dimensions...)
+	expression := fmt.Sprintf(
+		"SEARCH('{%s} MetricName=\"%s\"', '%s', %d)",
+		strings.Join(schema, ","),
+		metric.Name,
+		metric.Statistic,
+		WIDGET_PERIOD,
+	)
+
+	return []any{map[string]any{"expression": expression, "label": ""}}
+}
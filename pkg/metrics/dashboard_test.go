@@ -0,0 +1,123 @@
+package metrics
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLayout(t *testing.T) {
+	count := func(name string) Metric {
+		return Metric{Name: Name(name), Subsystem: SUBSYSTEM_INGEST, Statistic: "Sum"}
+	}
+
+	superseded := Metric{
+		Name:           "Superseded",
+		Subsystem:      SUBSYSTEM_OPERATIONS,
+		Statistic:      "Sum",
+		AlarmThreshold: 5,
+	}
+	duration := Metric{
+		Name:       "Duration",
+		Subsystem:  SUBSYSTEM_INGEST,
+		Dimensions: []string{DIMENSION_STAGE},
+		Statistic:  "Average",
+	}
+
+	// operations is listed first but laid out last, and the subsystems
+	// without metrics are left off
+	widgets := Layout(
+		[]Metric{superseded, count("A"), count("B"), count("C"), duration},
+		"us-east-1",
+	)
+
+	type placement struct {
+		Type          string
+		X, Y, W, H    int
+		Title, Header string
+	}
+	got := make([]placement, 0, len(widgets))
+	for _, widget := range widgets {
+		title, _ := widget.Properties["title"].(string)
+		header, _ := widget.Properties["markdown"].(string)
+		got = append(got, placement{
+			widget.Type, widget.X, widget.Y, widget.Width, widget.Height, title, header,
+		})
+	}
+
+	want := []placement{
+		{Type: "text", X: 0, Y: 0, W: 24, H: 1, Header: "## Ingest"},
+		{Type: "metric", X: 0, Y: 1, W: 8, H: 6, Title: "A"},
+		{Type: "metric", X: 8, Y: 1, W: 8, H: 6, Title: "B"},
+		{Type: "metric", X: 16, Y: 1, W: 8, H: 6, Title: "C"},
+		{Type: "metric", X: 0, Y: 7, W: 8, H: 6, Title: "Duration"},
+		{Type: "text", X: 0, Y: 13, W: 24, H: 1, Header: "## Operations"},
+		{Type: "metric", X: 0, Y: 14, W: 8, H: 6, Title: "Superseded"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("unexpected layout:\ngot  %+v\nwant %+v", got, want)
+	}
+
+	if !reflect.DeepEqual(widgets[1].Properties["metrics"], []any{[]any{NAMESPACE, "A"}}) {
+		t.Fatalf("unexpected metrics: %v", widgets[1].Properties["metrics"])
+	}
+	if _, ok := widgets[1].Properties["annotations"]; ok {
+		t.Fatal("metric without an alarm threshold is annotated")
+	}
+
+	search := widgets[4].Properties["metrics"].([]any)[0].([]any)[0].(map[string]any)
+	wantSearch := `SEARCH('{Scriptor,Stage} MetricName="Duration"', 'Average', 300)`
+	if search["expression"] != wantSearch {
+		t.Fatalf("unexpected expression: %v", search["expression"])
+	}
+
+	annotations := widgets[6].Properties["annotations"].(map[string]any)
+	alarm := annotations["horizontal"].([]map[string]any)[0]
+	if alarm["value"] != 5.0 {
+		t.Fatalf("unexpected annotation: %v", alarm)
+	}
+}
+
+func TestDashboardBody(t *testing.T) {
+	body, err := DashboardBody("us-east-1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var dashboard struct {
+		Widgets []Widget `json:"widgets"`
+	}
+	if err := json.Unmarshal([]byte(body), &dashboard); err != nil {
+		t.Fatalf("body is not JSON: %v", err)
+	}
+
+	// every registered metric has a graph that doesn't overlap another
+	titles := make(map[string]bool)
+	for i, widget := range dashboard.Widgets {
+		if widget.X+widget.Width > DASHBOARD_WIDTH {
+			t.Errorf("widget %d is wider than the dashboard", i)
+		}
+
+		for _, other := range dashboard.Widgets[:i] {
+			if widget.X < other.X+other.Width && other.X < widget.X+widget.Width &&
+				widget.Y < other.Y+other.Height && other.Y < widget.Y+widget.Height {
+				t.Errorf("widget %d overlaps another", i)
+			}
+		}
+
+		if widget.Type == "metric" {
+			titles[widget.Properties["title"].(string)] = true
+		}
+	}
+
+	for _, metric := range Registered() {
+		if !titles[string(metric.Name)] {
+			t.Errorf("%s has no widget", metric.Name)
+		}
+	}
+
+	if !strings.Contains(body, `"region":"us-east-1"`) {
+		t.Fatal("the widgets don't read from the region")
+	}
+}
@@ -0,0 +1,265 @@
+package metrics
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"slices"
+	"time"
+)
+
+const (
+	// CloudWatch namespace of every metric Scriptor emits
+	NAMESPACE = "Scriptor"
+
+	//
+	// Subsystems the metrics are grouped by on the dashboard
+	//
+
+	SUBSYSTEM_INGEST     = "ingest"
+	SUBSYSTEM_CONVERSION = "conversion"
+	SUBSYSTEM_PUBLISHING = "publishing"
+	SUBSYSTEM_BUDGETS    = "budgets"
+	SUBSYSTEM_OPERATIONS = "operations"
+
+	//
+	// Units
+	//
+
+	UNIT_COUNT        = "Count"
+	UNIT_MILLISECONDS = "Milliseconds"
+
+	//
+	// Dimensions
+	//
+
+	DIMENSION_STAGE  = "Stage"
+	DIMENSION_REASON = "Reason"
+
+	// Reasons a file in the watch folder was skipped
+	REASON_MIME_TYPE       = "mime_type"
+	REASON_SCRIPTOR_OUTPUT = "scriptor_output"
+)
+
+// Name is the name of a registered metric. Only the constants below are
+// emitted, so every metric shows up on the dashboard.
+type Name string
+
+const (
+	WORKFLOWS_STARTED       Name = "WorkflowsStarted"
+	FILES_SKIPPED           Name = "FilesSkipped"
+	FAILED_MESSAGES         Name = "FailedMessages"
+	STAGE_DURATION          Name = "StageDuration"
+	EXTERNAL_CALL_DURATION  Name = "ExternalCallDuration"
+	PIPELINE_DURATION       Name = "PipelineDuration"
+	STAGES_FAILED           Name = "StagesFailed"
+	DUPLICATE_DOCUMENTS     Name = "DuplicateDocuments"
+	NOTES_PUBLISHED         Name = "NotesPublished"
+	DOCUMENTS_SUPERSEDED    Name = "DocumentsSuperseded"
+	FEEDBACK_LOOPS_DETECTED Name = "FeedbackLoopsDetected"
+	ORPHANED_WATCH_CHANNELS Name = "OrphanedWatchChannels"
+)
+
+// Metric describes a metric Scriptor emits and how the dashboard shows it.
+type Metric struct {
+	Name        Name
+	Subsystem   string
+	Unit        string
+	Dimensions  []string
+	Statistic   string
+	Description string
+
+	// Marked on the widget of the metric when set, values above it need
+	// looking at
+	AlarmThreshold float64
+}
+
+// Subsystems in the order they are laid out on the dashboard
+var Subsystems = []string{
+	SUBSYSTEM_INGEST,
+	SUBSYSTEM_CONVERSION,
+	SUBSYSTEM_PUBLISHING,
+	SUBSYSTEM_BUDGETS,
+	SUBSYSTEM_OPERATIONS,
+}
+
+var registry = []Metric{
+	{
+		Name:        WORKFLOWS_STARTED,
+		Subsystem:   SUBSYSTEM_INGEST,
+		Unit:        UNIT_COUNT,
+		Statistic:   "Sum",
+		Description: "Workflows started for new documents and revisions",
+	},
+	{
+		Name:        FILES_SKIPPED,
+		Subsystem:   SUBSYSTEM_INGEST,
+		Unit:        UNIT_COUNT,
+		Dimensions:  []string{DIMENSION_REASON},
+		Statistic:   "Sum",
+		Description: "Files in the watch folder that were not processed",
+	},
+	{
+		Name:           FAILED_MESSAGES,
+		Subsystem:      SUBSYSTEM_INGEST,
+		Unit:           UNIT_COUNT,
+		Statistic:      "Sum",
+		Description:    "Notifications the SQS handler failed and returned to the queue",
+		AlarmThreshold: 1,
+	},
+	{
+		Name:           STAGE_DURATION,
+		Subsystem:      SUBSYSTEM_CONVERSION,
+		Unit:           UNIT_MILLISECONDS,
+		Dimensions:     []string{DIMENSION_STAGE},
+		Statistic:      "Average",
+		Description:    "Time each stage of the workflow took",
+		AlarmThreshold: 180000,
+	},
+	{
+		Name:        EXTERNAL_CALL_DURATION,
+		Subsystem:   SUBSYSTEM_CONVERSION,
+		Unit:        UNIT_MILLISECONDS,
+		Dimensions:  []string{DIMENSION_STAGE},
+		Statistic:   "Average",
+		Description: "Time each stage spent waiting on Mathpix or OpenAI",
+	},
+	{
+		Name:        PIPELINE_DURATION,
+		Subsystem:   SUBSYSTEM_CONVERSION,
+		Unit:        UNIT_MILLISECONDS,
+		Statistic:   "Average",
+		Description: "Time from the start of the download until the note was uploaded",
+	},
+	{
+		Name:           STAGES_FAILED,
+		Subsystem:      SUBSYSTEM_CONVERSION,
+		Unit:           UNIT_COUNT,
+		Dimensions:     []string{DIMENSION_STAGE},
+		Statistic:      "Sum",
+		Description:    "Stages that ended with an error or a missing source",
+		AlarmThreshold: 1,
+	},
+	{
+		Name:        DUPLICATE_DOCUMENTS,
+		Subsystem:   SUBSYSTEM_CONVERSION,
+		Unit:        UNIT_COUNT,
+		Statistic:   "Sum",
+		Description: "Documents whose content was already converted",
+	},
+	{
+		Name:        NOTES_PUBLISHED,
+		Subsystem:   SUBSYSTEM_PUBLISHING,
+		Unit:        UNIT_COUNT,
+		Statistic:   "Sum",
+		Description: "Documents published to every destination",
+	},
+	{
+		Name:        DOCUMENTS_SUPERSEDED,
+		Subsystem:   SUBSYSTEM_OPERATIONS,
+		Unit:        UNIT_COUNT,
+		Statistic:   "Sum",
+		Description: "Documents replaced by a newer revision while in flight",
+	},
+	{
+		Name:           FEEDBACK_LOOPS_DETECTED,
+		Subsystem:      SUBSYSTEM_OPERATIONS,
+		Unit:           UNIT_COUNT,
+		Statistic:      "Sum",
+		Description:    "Notifications that found Scriptor's own files in a watch folder",
+		AlarmThreshold: 1,
+	},
+	{
+		Name:           ORPHANED_WATCH_CHANNELS,
+		Subsystem:      SUBSYSTEM_OPERATIONS,
+		Unit:           UNIT_COUNT,
+		Statistic:      "Maximum",
+		Description:    "Replaced watch channels that couldn't be stopped and still send notifications",
+		AlarmThreshold: 1,
+	},
+}
+
+// Lambda sends what is written to stdout to CloudWatch Logs, which extracts
+// the metrics from the embedded metric format records
+var output io.Writer = os.Stdout
+
+// Registered returns every metric Scriptor emits.
+func Registered() []Metric {
+	return slices.Clone(registry)
+}
+
+// Lookup returns the registered metric with the name.
+func Lookup(name Name) (Metric, bool) {
+	for _, metric := range registry {
+		if metric.Name == name {
+			return metric, true
+		}
+	}
+
+	return Metric{}, false
+}
+
+// Emit writes the value of the metric as a CloudWatch embedded metric format
+// record. The metric must be registered and given exactly the dimensions it
+// was registered with.
+func Emit(name Name, value float64, dimensions map[string]string) error {
+	metric, ok := Lookup(name)
+	if !ok {
+		return fmt.Errorf("metric %q is not registered", name)
+	}
+
+	if len(dimensions) != len(metric.Dimensions) {
+		return fmt.Errorf(
+			"metric %q takes the dimensions %v, got %v",
+			name,
+			metric.Dimensions,
+			dimensions,
+		)
+	}
+
+	// a metric without dimensions is still given an empty set of them
+	dimensionSet := make([]string, 0, len(metric.Dimensions))
+	dimensionSet = append(dimensionSet, metric.Dimensions...)
+
+	record := map[string]any{
+		"_aws": map[string]any{
+			"Timestamp": time.Now().UnixMilli(),
+			"CloudWatchMetrics": []map[string]any{
+				{
+					"Namespace":  NAMESPACE,
+					"Dimensions": [][]string{dimensionSet},
+					"Metrics": []map[string]string{
+						{"Name": string(metric.Name), "Unit": metric.Unit},
+					},
+				},
+			},
+		},
+		string(metric.Name): value,
+	}
+
+	for _, dimension := range metric.Dimensions {
+		dimensionValue, ok := dimensions[dimension]
+		if !ok {
+			return fmt.Errorf("metric %q is missing the dimension %q", name, dimension)
+		}
+		record[dimension] = dimensionValue
+	}
+
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintln(output, string(line))
+	return err
+}
+
+// Record emits the metric, only logging a failure since a missing data
+// point should never fail the work it measures.
+func Record(name Name, value float64, dimensions map[string]string) {
+	if err := Emit(name, value, dimensions); err != nil {
+		slog.Error("Failed to emit the metric", "metric", name, "error", err)
+	}
+}
@@ -0,0 +1,237 @@
+package metrics
+
+import (
+	"bytes"
+	"encoding/json"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestEmit(t *testing.T) {
+	tests := []struct {
+		name       string
+		metric     Name
+		dimensions map[string]string
+
+		wantErr        bool
+		wantDimensions []string
+	}{
+		{
+			name:           "no dimensions",
+			metric:         WORKFLOWS_STARTED,
+			wantDimensions: []string{},
+		},
+		{
+			name:           "dimensions",
+			metric:         STAGE_DURATION,
+			dimensions:     map[string]string{DIMENSION_STAGE: "mathpix"},
+			wantDimensions: []string{DIMENSION_STAGE},
+		},
+		{
+			name:    "not registered",
+			metric:  Name("Unregistered"),
+			wantErr: true,
+		},
+		{
+			name:       "wrong dimension",
+			metric:     STAGE_DURATION,
+			dimensions: map[string]string{DIMENSION_REASON: "mathpix"},
+			wantErr:    true,
+		},
+		{
+			name:    "missing dimension",
+			metric:  STAGE_DURATION,
+			wantErr: true,
+		},
+	}
+
+	t.Cleanup(func() { output = os.Stdout })
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			output = &buf
+
+			err := Emit(tc.metric, 42, tc.dimensions)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if tc.wantErr {
+				if buf.Len() != 0 {
+					t.Fatalf("unexpected record: %s", buf.String())
+				}
+				return
+			}
+
+			var record struct {
+				AWS struct {
+					CloudWatchMetrics []struct {
+						Namespace  string
+						Dimensions [][]string
+						Metrics    []struct{ Name, Unit string }
+					}
+				} `json:"_aws"`
+			}
+			if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+				t.Fatalf("record is not JSON: %v", err)
+			}
+
+			directive := record.AWS.CloudWatchMetrics[0]
+			if directive.Namespace != NAMESPACE || directive.Metrics[0].Name != string(tc.metric) {
+				t.Fatalf("unexpected record: %s", buf.String())
+			}
+
+			if !reflect.DeepEqual(directive.Dimensions, [][]string{tc.wantDimensions}) {
+				t.Fatalf("unexpected dimensions: %v", directive.Dimensions)
+			}
+
+			var values map[string]any
+			json.Unmarshal(buf.Bytes(), &values)
+			if values[string(tc.metric)] != 42.0 {
+				t.Fatalf("unexpected value: %v", values[string(tc.metric)])
+			}
+			for key, value := range tc.dimensions {
+				if values[key] != value {
+					t.Fatalf("unexpected %s: %v", key, values[key])
+				}
+			}
+		})
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	seen := make(map[Name]bool)
+
+	for _, metric := range registry {
+		if seen[metric.Name] {
+			t.Fatalf("duplicate entry for %q", metric.Name)
+		}
+		seen[metric.Name] = true
+
+		if !slices.Contains(Subsystems, metric.Subsystem) {
+			t.Errorf("%s has an unknown subsystem %q", metric.Name, metric.Subsystem)
+		}
+
+		if metric.Unit == "" || metric.Statistic == "" || metric.Description == "" {
+			t.Errorf("%s is missing its unit, statistic or description", metric.Name)
+		}
+	}
+
+	for ident, name := range declaredMetrics(t) {
+		if !seen[name] {
+			t.Errorf("%s is declared but not registered", ident)
+		}
+	}
+}
+
+// Every metric emitted anywhere in the module must be one of the registered
+// names, so emitting a metric the dashboard doesn't show fails here.
+func TestEveryEmittedMetricIsRegistered(t *testing.T) {
+	declared := declaredMetrics(t)
+
+	count := 0
+	err := filepath.WalkDir("../..", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if d.IsDir() {
+			switch d.Name() {
+			case ".git", "node_modules", "cdk.out":
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if !strings.HasSuffix(path, ".go") {
+			return nil
+		}
+
+		file, err := parser.ParseFile(token.NewFileSet(), path, nil, 0)
+		if err != nil {
+			return err
+		}
+
+		ast.Inspect(file, func(node ast.Node) bool {
+			call, ok := node.(*ast.CallExpr)
+			if !ok {
+				return true
+			}
+
+			fn, ok := call.Fun.(*ast.SelectorExpr)
+			if !ok || !isPackage(fn.X, "metrics") ||
+				(fn.Sel.Name != "Emit" && fn.Sel.Name != "Record") {
+				return true
+			}
+
+			count++
+
+			arg, ok := call.Args[0].(*ast.SelectorExpr)
+			if !ok || !isPackage(arg.X, "metrics") || declared[arg.Sel.Name] == "" {
+				t.Errorf("%s emits a metric that isn't one of the registered names", path)
+				return true
+			}
+
+			return true
+		})
+
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if count == 0 {
+		t.Fatal("no metrics are emitted")
+	}
+}
+
+func isPackage(expr ast.Expr, name string) bool {
+	ident, ok := expr.(*ast.Ident)
+	return ok && ident.Name == name
+}
+
+// Collect the constants of type Name declared in metrics.go, by identifier.
+func declaredMetrics(t *testing.T) map[string]Name {
+	t.Helper()
+
+	file, err := parser.ParseFile(token.NewFileSet(), "metrics.go", nil, 0)
+	if err != nil {
+		t.Fatalf("failed to parse metrics.go: %v", err)
+	}
+
+	declared := make(map[string]Name)
+	for _, decl := range file.Decls {
+		gen, ok := decl.(*ast.GenDecl)
+		if !ok || gen.Tok != token.CONST {
+			continue
+		}
+
+		for _, spec := range gen.Specs {
+			value := spec.(*ast.ValueSpec)
+			if ident, ok := value.Type.(*ast.Ident); !ok || ident.Name != "Name" {
+				continue
+			}
+
+			for i, ident := range value.Names {
+				lit := value.Values[i].(*ast.BasicLit)
+				declared[ident.Name] = Name(strings.Trim(lit.Value, `"`))
+			}
+		}
+	}
+
+	if len(declared) == 0 {
+		t.Fatal("no metric names found in metrics.go")
+	}
+
+	return declared
+}
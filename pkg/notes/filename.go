@@ -0,0 +1,129 @@
+package notes
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+	"text/template"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	// Output files are named after the original file unless configured
+	DEFAULT_FILENAME_TEMPLATE = "{{.OriginalName}}"
+
+	// Date format of the {{.Date}} placeholder
+	FILENAME_DATE_FORMAT = "2006-01-02"
+
+	// Longest file name rendered, leaving room for the extension
+	MAX_FILENAME_LENGTH = 200
+)
+
+var (
+	headingPattern = regexp.MustCompile(`^#{1,6}[ \t]+(.+?)[ \t]*#*[ \t]*$`)
+
+	// Characters Drive or Obsidian won't accept in a file name, or that
+	// break Obsidian links
+	unsafeFilenameCharacters = strings.NewReplacer(
+		"/", " ", "\\", " ", ":", " ", "*", " ", "?", " ", `"`, " ",
+		"<", " ", ">", " ", "|", " ", "#", " ", "^", " ", "[", " ", "]", " ",
+	)
+
+	// Values used to check a template renders a usable name
+	sampleFilenameFields = FilenameFields{
+		Date:         "2025-01-31",
+		OriginalName: "scan",
+		Title:        "Title",
+		Stage:        "upload",
+	}
+)
+
+// FilenameFields are the document values available to the filename template.
+// Title is the first heading of the note, or the original name when the note
+// has no heading.
+type FilenameFields struct {
+	Date         string
+	OriginalName string
+	Title        string
+	Stage        string
+}
+
+// RenderFilename executes the filename template for the fields and returns
+// the sanitized name without an extension.
+func RenderFilename(text string, fields FilenameFields) (string, error) {
+	tmpl, err := parseFilename(text)
+	if err != nil {
+		return "", err
+	}
+
+	var buffer bytes.Buffer
+	err = tmpl.Execute(&buffer, fields)
+	if err != nil {
+		return "", fmt.Errorf("failed to render the filename template: %w", err)
+	}
+
+	name := SanitizeFilename(buffer.String())
+	if name == "" {
+		return "", fmt.Errorf("filename template %q renders an empty name", text)
+	}
+
+	return name, nil
+}
+
+// ValidateFilename checks the filename template parses, only uses known
+// fields and renders a name.
+func ValidateFilename(text string) error {
+	_, err := RenderFilename(text, sampleFilenameFields)
+	return err
+}
+
+func parseFilename(text string) (*template.Template, error) {
+	tmpl, err := template.New("filename").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid filename template: %w", err)
+	}
+
+	unknown := unknownFields(tmpl, reflect.TypeOf(FilenameFields{}))
+	if len(unknown) > 0 {
+		return nil, fmt.Errorf(
+			"unknown placeholder {{.%s}} in the filename template",
+			unknown[0],
+		)
+	}
+
+	return tmpl, nil
+}
+
+// SanitizeFilename replaces the characters Drive or Obsidian dislike with
+// spaces, collapses whitespace, trims leading and trailing dots and limits
+// the length of the name.
+func SanitizeFilename(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return ' '
+		}
+		return r
+	}, unsafeFilenameCharacters.Replace(name))
+
+	name = strings.Join(strings.Fields(name), " ")
+	if utf8.RuneCountInString(name) > MAX_FILENAME_LENGTH {
+		name = string([]rune(name)[:MAX_FILENAME_LENGTH])
+	}
+
+	return strings.Trim(name, ". ")
+}
+
+// Title returns the text of the first heading of the note, ignoring the
+// front matter, or an empty string when it has none.
+func Title(note string) string {
+	for _, line := range strings.Split(StripFrontMatter(note), "\n") {
+		if match := headingPattern.FindStringSubmatch(line); match != nil {
+			return strings.TrimSpace(match[1])
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,138 @@
+package notes
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRenderFilename(t *testing.T) {
+	fields := FilenameFields{
+		Date:         "2025-03-01",
+		OriginalName: "scan 12",
+		Title:        "Hardware Store",
+		Stage:        "openai",
+	}
+
+	tests := []struct {
+		name     string
+		template string
+		fields   FilenameFields
+		want     string
+		wantErr  bool
+	}{
+		{name: "default", template: DEFAULT_FILENAME_TEMPLATE, fields: fields, want: "scan 12"},
+		{
+			name:     "date and title",
+			template: "{{.Date}} {{.Title}}",
+			fields:   fields,
+			want:     "2025-03-01 Hardware Store",
+		},
+		{
+			name:     "stage",
+			template: "{{.OriginalName}}-{{.Stage}}",
+			fields:   fields,
+			want:     "scan 12-openai",
+		},
+		{
+			name:     "conditional title",
+			template: "{{if .Title}}{{.Title}}{{else}}{{.OriginalName}}{{end}}",
+			fields:   FilenameFields{OriginalName: "scan 12"},
+			want:     "scan 12",
+		},
+		{
+			name:     "unsafe characters",
+			template: "{{.Title}}",
+			fields:   FilenameFields{Title: "Invoice #12: A/B [draft]?\t"},
+			want:     "Invoice 12 A B draft",
+		},
+		{
+			name:     "leading dots",
+			template: "{{.Title}}",
+			fields:   FilenameFields{Title: "..hidden."},
+			want:     "hidden",
+		},
+		{
+			name:     "empty name",
+			template: "{{.Title}}",
+			fields:   FilenameFields{Title: " / "},
+			wantErr:  true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := RenderFilename(tc.template, tc.fields)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %q", got)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if got != tc.want {
+				t.Fatalf("unexpected name: got %q want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestValidateFilename(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		wantErr  string
+	}{
+		{name: "default", template: DEFAULT_FILENAME_TEMPLATE},
+		{name: "all fields", template: "{{.Date}} {{.Title}} ({{.OriginalName}}, {{.Stage}})"},
+		{name: "syntax error", template: "{{.Date", wantErr: "invalid filename template"},
+		{name: "unknown field", template: "{{.Channel}}", wantErr: "{{.Channel}}"},
+		{name: "no name", template: "///", wantErr: "empty name"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := ValidateFilename(tc.template)
+			if tc.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Fatalf("expected an error containing %q, got %v", tc.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestSanitizeFilenameLength(t *testing.T) {
+	got := SanitizeFilename(strings.Repeat("é", MAX_FILENAME_LENGTH+10))
+	if len([]rune(got)) != MAX_FILENAME_LENGTH {
+		t.Fatalf("unexpected length: %d", len([]rune(got)))
+	}
+}
+
+func TestTitle(t *testing.T) {
+	tests := []struct {
+		name string
+		note string
+		want string
+	}{
+		{name: "heading", note: "intro\n## Hardware Store ##\nTile", want: "Hardware Store"},
+		{name: "front matter", note: "---\nid: x\n---\n\n# Receipt\n", want: "Receipt"},
+		{name: "no heading", note: "#hashtag\nTile 40", want: ""},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := Title(tc.note); got != tc.want {
+				t.Fatalf("unexpected title: got %q want %q", got, tc.want)
+			}
+		})
+	}
+}
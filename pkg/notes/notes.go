@@ -0,0 +1,372 @@
+package notes
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+	"text/template"
+	"text/template/parse"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// Header placed at the top of every note. The front matter between the
+	// '---' lines must be valid YAML.
+	DEFAULT_HEADER_TEMPLATE = `---
+id: "{{.Name}}"
+aliases: []
+tags:
+  - reMarkable
+---
+
+People:
+Projects:
+Zettel:
+
+`
+
+	// Footer linking the note to the original scanned document
+	DEFAULT_FOOTER_TEMPLATE = "{{.AttachmentLink}}"
+
+	// Rendered for {{.AttachmentLink}} and replaced by the upload stage once
+	// it knows where the original is kept
+	ATTACHMENT_PLACEHOLDER = "<!-- scriptor:attachment -->"
+
+	// Link to the original in Drive, or embed the copy saved next to the note
+	// in the vault
+	ATTACHMENT_LINK_DRIVE    = "drive"
+	ATTACHMENT_LINK_OBSIDIAN = "obsidian"
+
+	DRIVE_FILE_URL = "https://drive.google.com/file/d/%s"
+
+	frontMatterDelimiter = "---"
+)
+
+type (
+	// Templates used to build a note around the cleaned up Markdown.
+	Templates struct {
+		Header string `json:"header_template"`
+		Footer string `json:"footer_template"`
+	}
+
+	// Fields are the document values available to the templates.
+	Fields struct {
+		DocumentID       string
+		Name             string
+		OriginalFileName string
+		AttachmentLink   string
+	}
+
+	// AttachmentOptions decide how a note links to its original. The prefix
+	// is the folder of the attachments in the vault for Obsidian links.
+	AttachmentOptions struct {
+		Style  string
+		Prefix string
+	}
+
+	// Note is the rendered result of the templates.
+	Note struct {
+		Header string
+		Footer string
+	}
+)
+
+// DefaultTemplates returns the templates used when nothing is configured.
+func DefaultTemplates() Templates {
+	return Templates{
+		Header: DEFAULT_HEADER_TEMPLATE,
+		Footer: DEFAULT_FOOTER_TEMPLATE,
+	}
+}
+
+// NewFields builds the template fields for a document from its ID, its
+// safe base name and the name of the original file.
+func NewFields(documentID, name, originalFileName string) Fields {
+	return Fields{
+		DocumentID:       documentID,
+		Name:             name,
+		OriginalFileName: originalFileName,
+		AttachmentLink:   ATTACHMENT_PLACEHOLDER,
+	}
+}
+
+// ParseAttachmentStyle checks the style of the attachment links, the default
+// is a link to the original in Drive.
+func ParseAttachmentStyle(style string) (string, error) {
+	switch style {
+	case "":
+		return ATTACHMENT_LINK_DRIVE, nil
+	case ATTACHMENT_LINK_DRIVE, ATTACHMENT_LINK_OBSIDIAN:
+		return style, nil
+	default:
+		return "", fmt.Errorf("unknown attachment link style %q", style)
+	}
+}
+
+// Link to the original file. Originals that aren't in Drive, such as Kindle
+// exports, are always embedded.
+func (o AttachmentOptions) Link(fileName, driveFileID string) string {
+	if o.Style == ATTACHMENT_LINK_DRIVE && driveFileID != "" {
+		return fmt.Sprintf("[%s](%s)", fileName, fmt.Sprintf(DRIVE_FILE_URL, driveFileID))
+	}
+
+	return fmt.Sprintf("![[%s%s]]", o.Prefix, fileName)
+}
+
+// ResolveAttachment replaces the attachment placeholder in a note with the
+// link to the original.
+func ResolveAttachment(note []byte, link string) []byte {
+	return bytes.ReplaceAll(note, []byte(ATTACHMENT_PLACEHOLDER), []byte(link))
+}
+
+// Render executes the header and footer templates for the fields.
+func Render(templates Templates, fields Fields) (*Note, error) {
+	header, err := renderTemplate("header", templates.Header, fields)
+	if err != nil {
+		return nil, err
+	}
+
+	footer, err := renderTemplate("footer", templates.Footer, fields)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Note{
+		Header: header,
+		Footer: footer,
+	}, nil
+}
+
+// Compose builds the final note with the Markdown between the header and
+// footer.
+func (n *Note) Compose(markdown string) string {
+	return fmt.Sprintf("%s\n\n%s\n\n%s", n.Header, markdown, n.Footer)
+}
+
+func renderTemplate(name, text string, fields Fields) (string, error) {
+	tmpl, err := template.New(name).Parse(text)
+	if err != nil {
+		return "", fmt.Errorf("invalid %s template: %w", name, err)
+	}
+
+	var buffer bytes.Buffer
+	err = tmpl.Execute(&buffer, fields)
+	if err != nil {
+		return "", fmt.Errorf("failed to render the %s template: %w", name, err)
+	}
+
+	return buffer.String(), nil
+}
+
+// Validate checks the templates without rendering them for a document. It
+// reports syntax errors and placeholders that don't match a known field.
+func Validate(templates Templates) []error {
+	errs := make([]error, 0)
+
+	for _, t := range []struct{ name, text string }{
+		{"header", templates.Header},
+		{"footer", templates.Footer},
+	} {
+		tmpl, err := template.New(t.name).Parse(t.text)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid %s template: %w", t.name, err))
+			continue
+		}
+
+		for _, field := range unknownFields(tmpl, reflect.TypeOf(Fields{})) {
+			errs = append(
+				errs,
+				fmt.Errorf("unknown placeholder {{.%s}} in the %s template", field, t.name),
+			)
+		}
+	}
+
+	return errs
+}
+
+// ValidateFrontMatter checks that the front matter of a rendered header, if
+// it has any, is valid YAML.
+func ValidateFrontMatter(header string) error {
+	content := strings.TrimLeft(header, "\n")
+	if !strings.HasPrefix(content, frontMatterDelimiter+"\n") {
+		return nil
+	}
+
+	content = strings.TrimPrefix(content, frontMatterDelimiter+"\n")
+	end := strings.Index(content, "\n"+frontMatterDelimiter)
+	if end < 0 {
+		return fmt.Errorf("front matter is not terminated with %s", frontMatterDelimiter)
+	}
+
+	var frontMatter map[string]any
+	err := yaml.Unmarshal([]byte(content[:end]), &frontMatter)
+	if err != nil {
+		return fmt.Errorf("front matter is not valid YAML: %w", err)
+	}
+
+	return nil
+}
+
+// StripFrontMatter removes the front matter from the top of a note, if it
+// has any, along with the blank lines that follow it.
+func StripFrontMatter(note string) string {
+	content := strings.TrimLeft(note, "\n")
+	if !strings.HasPrefix(content, frontMatterDelimiter+"\n") {
+		return note
+	}
+
+	rest := strings.TrimPrefix(content, frontMatterDelimiter+"\n")
+	end := strings.Index(rest, "\n"+frontMatterDelimiter)
+	if end < 0 {
+		return note
+	}
+
+	rest = rest[end+len(frontMatterDelimiter)+1:]
+	if newline := strings.IndexByte(rest, '\n'); newline >= 0 {
+		rest = rest[newline+1:]
+	} else {
+		rest = ""
+	}
+
+	return strings.TrimLeft(rest, "\n")
+}
+
+// AddTags adds the tags to the tags of the front matter of the note, adding
+// front matter when the note has none. Tags the note already has aren't
+// repeated. The rest of the front matter is kept, though it's written back
+// out so its formatting can change.
+func AddTags(note string, tags []string) (string, error) {
+	frontMatter, body := SplitFrontMatter(note)
+
+	mapping := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+	if frontMatter != "" {
+		content := strings.TrimPrefix(frontMatter, frontMatterDelimiter+"\n")
+		content = strings.TrimSuffix(content, frontMatterDelimiter)
+
+		var document yaml.Node
+		err := yaml.Unmarshal([]byte(content), &document)
+		if err != nil {
+			return "", fmt.Errorf("front matter is not valid YAML: %w", err)
+		}
+
+		if len(document.Content) > 0 {
+			mapping = document.Content[0]
+		}
+		if mapping.Kind != yaml.MappingNode {
+			return "", fmt.Errorf("front matter is not a mapping")
+		}
+	}
+
+	var list *yaml.Node
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == "tags" {
+			list = mapping.Content[i+1]
+		}
+	}
+
+	if list == nil {
+		list = &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+		mapping.Content = append(
+			mapping.Content,
+			&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: "tags"},
+			list,
+		)
+	}
+
+	switch list.Kind {
+	case yaml.SequenceNode:
+	case yaml.ScalarNode:
+		// a single tag, or none
+		existing := list.Value
+		*list = yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+		if existing != "" {
+			list.Content = append(
+				list.Content,
+				&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: existing},
+			)
+		}
+	default:
+		return "", fmt.Errorf("tags in the front matter are not a list")
+	}
+
+	for _, tag := range tags {
+		if !slices.ContainsFunc(list.Content, func(node *yaml.Node) bool {
+			return node.Value == tag
+		}) {
+			list.Content = append(
+				list.Content,
+				&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: tag},
+			)
+		}
+	}
+
+	var buffer bytes.Buffer
+	encoder := yaml.NewEncoder(&buffer)
+	encoder.SetIndent(2)
+	err := encoder.Encode(mapping)
+	if err != nil {
+		return "", fmt.Errorf("failed to write the front matter: %w", err)
+	}
+
+	return fmt.Sprintf(
+		"%s\n%s%s\n\n%s",
+		frontMatterDelimiter,
+		buffer.String(),
+		frontMatterDelimiter,
+		body,
+	), nil
+}
+
+// The placeholders of the template that aren't fields of the known type
+func unknownFields(tmpl *template.Template, known reflect.Type) []string {
+	unknown := make([]string, 0)
+
+	var walk func(node parse.Node)
+	walk = func(node parse.Node) {
+		switch n := node.(type) {
+		case *parse.ListNode:
+			if n == nil {
+				return
+			}
+			for _, child := range n.Nodes {
+				walk(child)
+			}
+		case *parse.ActionNode:
+			walk(n.Pipe)
+		case *parse.PipeNode:
+			if n == nil {
+				return
+			}
+			for _, cmd := range n.Cmds {
+				walk(cmd)
+			}
+		case *parse.CommandNode:
+			for _, arg := range n.Args {
+				walk(arg)
+			}
+		case *parse.IfNode:
+			walk(n.Pipe)
+			walk(n.List)
+			walk(n.ElseList)
+		case *parse.RangeNode:
+			walk(n.Pipe)
+			walk(n.List)
+			walk(n.ElseList)
+		case *parse.WithNode:
+			walk(n.Pipe)
+			walk(n.List)
+			walk(n.ElseList)
+		case *parse.FieldNode:
+			if _, ok := known.FieldByName(n.Ident[0]); !ok {
+				unknown = append(unknown, n.Ident[0])
+			}
+		}
+	}
+
+	walk(tmpl.Root)
+
+	return unknown
+}
@@ -0,0 +1,245 @@
+package notes
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRenderDefaultTemplates(t *testing.T) {
+	note, err := Render(DefaultTemplates(), NewFields("doc-1", "journal", "journal.pdf"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if !strings.Contains(note.Header, `id: "journal"`) {
+		t.Fatalf("unexpected header: %q", note.Header)
+	}
+
+	if note.Footer != ATTACHMENT_PLACEHOLDER {
+		t.Fatalf("unexpected footer: got %q", note.Footer)
+	}
+
+	if err := ValidateFrontMatter(note.Header); err != nil {
+		t.Fatalf("default front matter is invalid: %v", err)
+	}
+
+	want := note.Header + "\n\nbody\n\n" + note.Footer
+	if got := note.Compose("body"); got != want {
+		t.Fatalf("unexpected note: got %q want %q", got, want)
+	}
+}
+
+func TestAttachmentLink(t *testing.T) {
+	tests := []struct {
+		name        string
+		options     AttachmentOptions
+		driveFileID string
+		want        string
+	}{
+		{
+			name:        "drive",
+			options:     AttachmentOptions{Style: ATTACHMENT_LINK_DRIVE},
+			driveFileID: "file-1",
+			want:        "[journal.pdf](https://drive.google.com/file/d/file-1)",
+		},
+		{
+			name:    "not in drive",
+			options: AttachmentOptions{Style: ATTACHMENT_LINK_DRIVE, Prefix: "attachments/"},
+			want:    "![[attachments/journal.pdf]]",
+		},
+		{
+			name:        "obsidian",
+			options:     AttachmentOptions{Style: ATTACHMENT_LINK_OBSIDIAN},
+			driveFileID: "file-1",
+			want:        "![[journal.pdf]]",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tc.options.Link("journal.pdf", tc.driveFileID); got != tc.want {
+				t.Fatalf("unexpected link: got %q want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestResolveAttachment(t *testing.T) {
+	note, err := Render(DefaultTemplates(), NewFields("doc-1", "journal", "journal.pdf"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	got := string(ResolveAttachment([]byte(note.Compose("body")), "![[journal.pdf]]"))
+	if !strings.HasSuffix(got, "body\n\n![[journal.pdf]]") {
+		t.Fatalf("unexpected note: %q", got)
+	}
+
+	// notes rendered before the placeholder existed are left alone
+	old := "body\n\n![[attachments/journal.pdf]]"
+	if got := string(ResolveAttachment([]byte(old), "![[journal.pdf]]")); got != old {
+		t.Fatalf("unexpected note: %q", got)
+	}
+}
+
+func TestParseAttachmentStyle(t *testing.T) {
+	for style, want := range map[string]string{
+		"":         ATTACHMENT_LINK_DRIVE,
+		"drive":    ATTACHMENT_LINK_DRIVE,
+		"obsidian": ATTACHMENT_LINK_OBSIDIAN,
+	} {
+		got, err := ParseAttachmentStyle(style)
+		if err != nil || got != want {
+			t.Fatalf("unexpected style for %q: got %q %v", style, got, err)
+		}
+	}
+
+	if _, err := ParseAttachmentStyle("dropbox"); err == nil {
+		t.Fatalf("expected an error for an unknown style")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name      string
+		templates Templates
+		want      int
+	}{
+		{name: "defaults", templates: DefaultTemplates()},
+		{
+			name: "known fields in conditionals",
+			templates: Templates{
+				Header: "{{if .Name}}{{.Name}}{{else}}{{.DocumentID}}{{end}}",
+			},
+		},
+		{
+			name:      "unknown fields in both templates",
+			templates: Templates{Header: "{{.Title}}", Footer: "{{.Author}}"},
+			want:      2,
+		},
+		{
+			name:      "unterminated action",
+			templates: Templates{Header: "{{.Name"},
+			want:      1,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := Validate(tc.templates); len(got) != tc.want {
+				t.Fatalf("unexpected errors: got %v want %d", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestValidateFrontMatter(t *testing.T) {
+	tests := []struct {
+		name    string
+		header  string
+		wantErr bool
+	}{
+		{name: "no front matter", header: "# Title\n"},
+		{name: "valid", header: "---\ntitle: x\ntags:\n  - a\n---\n"},
+		{name: "invalid yaml", header: "---\ntitle: [x\n---\n", wantErr: true},
+		{name: "unterminated", header: "---\ntitle: x\n", wantErr: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := ValidateFrontMatter(tc.header)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("unexpected error: got %v want error %v", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestStripFrontMatter(t *testing.T) {
+	tests := []struct {
+		name string
+		note string
+		want string
+	}{
+		{name: "no front matter", note: "# Title\n\nbody", want: "# Title\n\nbody"},
+		{
+			name: "front matter",
+			note: "---\ntitle: x\nscriptor_hash: abc\n---\n\n# Title\nbody",
+			want: "# Title\nbody",
+		},
+		{name: "only front matter", note: "---\ntitle: x\n---", want: ""},
+		{
+			name: "unterminated",
+			note: "---\ntitle: x\n# Title",
+			want: "---\ntitle: x\n# Title",
+		},
+		{
+			name: "rule later in the note",
+			note: "# Title\n---\nbody",
+			want: "# Title\n---\nbody",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got := StripFrontMatter(tc.note)
+			if got != tc.want {
+				t.Fatalf("unexpected note: got %q want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestAddTags(t *testing.T) {
+	tests := []struct {
+		name    string
+		note    string
+		tags    []string
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "default header",
+			note: "---\nid: \"scan\"\naliases: []\ntags:\n  - reMarkable\n---\n\nPeople:\n\n# Notes\n",
+			tags: []string{"receipts", "reMarkable"},
+			want: "---\nid: \"scan\"\naliases: []\ntags:\n  - reMarkable\n  - receipts\n---\n\nPeople:\n\n# Notes\n",
+		},
+		{
+			name: "single tag",
+			note: "---\ntags: travel\n---\n\n# Notes\n",
+			tags: []string{"receipts"},
+			want: "---\ntags:\n  - travel\n  - receipts\n---\n\n# Notes\n",
+		},
+		{
+			name: "no tags field",
+			note: "---\nid: scan\n---\n\n# Notes\n",
+			tags: []string{"receipts"},
+			want: "---\nid: scan\ntags:\n  - receipts\n---\n\n# Notes\n",
+		},
+		{
+			name: "no front matter",
+			note: "# Notes\n",
+			tags: []string{"receipts"},
+			want: "---\ntags:\n  - receipts\n---\n\n# Notes\n",
+		},
+		{
+			name:    "tags that aren't a list",
+			note:    "---\ntags:\n  a: b\n---\n\n# Notes\n",
+			tags:    []string{"receipts"},
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := AddTags(tc.note, tc.tags)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if err == nil && got != tc.want {
+				t.Fatalf("unexpected note:\ngot  %q\nwant %q", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,86 @@
+package notes
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Removed from the titles used as the text of wiki links, they would end
+// the link early
+var wikiLinkEscaper = strings.NewReplacer("[", "", "]", "", "|", "-")
+
+// PartLink is a note of a note set that other notes of the set link to.
+type PartLink struct {
+	FileName string
+	Title    string
+}
+
+// PartFileName names a part of a note that was split into several. The part
+// numbers are padded so the parts sort in order.
+func PartFileName(fileName string, part, parts int) string {
+	ext := filepath.Ext(fileName)
+	width := len(strconv.Itoa(parts))
+
+	return fmt.Sprintf("%s - Part %0*d%s", strings.TrimSuffix(fileName, ext), width, part, ext)
+}
+
+// WikiLink links to the note by its file name, showing the title when it has
+// one.
+func WikiLink(link PartLink) string {
+	target := strings.TrimSuffix(link.FileName, filepath.Ext(link.FileName))
+
+	title := strings.TrimSpace(wikiLinkEscaper.Replace(link.Title))
+	if title == "" || title == target {
+		return "[[" + target + "]]"
+	}
+
+	return "[[" + target + "|" + title + "]]"
+}
+
+// RenderIndex renders the Markdown of the index note that links to the
+// parts in order.
+func RenderIndex(title string, parts []PartLink) string {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "# %s\n\n", title)
+	fmt.Fprintf(&b, "This note was split into %d parts.\n\n", len(parts))
+	for i, part := range parts {
+		fmt.Fprintf(&b, "%d. %s\n", i+1, WikiLink(part))
+	}
+
+	return b.String()
+}
+
+// AddNavigation adds links to the index and to the parts before and after
+// at the top and bottom of a part. The first and last parts only link in
+// one direction.
+func AddNavigation(content string, index PartLink, parts []PartLink, part int) string {
+	links := make([]string, 0, 3)
+	if part > 0 {
+		links = append(links, "← "+WikiLink(parts[part-1]))
+	}
+	links = append(links, WikiLink(PartLink{FileName: index.FileName, Title: "Contents"}))
+	if part < len(parts)-1 {
+		links = append(links, WikiLink(parts[part+1])+" →")
+	}
+
+	navigation := strings.Join(links, " · ")
+
+	return fmt.Sprintf("%s\n\n%s\n\n%s\n", navigation, strings.Trim(content, "\n"), navigation)
+}
+
+// SplitFrontMatter separates the front matter at the top of a note, with its
+// delimiters, from the rest of the note. The front matter is empty when the
+// note has none.
+func SplitFrontMatter(note string) (string, string) {
+	body := StripFrontMatter(note)
+	if len(body) == len(note) {
+		return "", note
+	}
+
+	frontMatter := strings.TrimRight(note[:len(note)-len(body)], "\n")
+
+	return strings.TrimLeft(frontMatter, "\n"), body
+}
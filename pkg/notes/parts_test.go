@@ -0,0 +1,124 @@
+package notes
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestPartFileName(t *testing.T) {
+	tests := []struct {
+		fileName string
+		part     int
+		parts    int
+		want     string
+	}{
+		{fileName: "scan.md", part: 1, parts: 3, want: "scan - Part 1.md"},
+		{fileName: "scan.md", part: 2, parts: 12, want: "scan - Part 02.md"},
+		{fileName: "2026-03-14 Lectures.md", part: 100, parts: 120, want: "2026-03-14 Lectures - Part 100.md"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.want, func(t *testing.T) {
+			if got := PartFileName(tc.fileName, tc.part, tc.parts); got != tc.want {
+				t.Fatalf("unexpected name: got %q want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestWikiLink(t *testing.T) {
+	tests := []struct {
+		name string
+		link PartLink
+		want string
+	}{
+		{name: "no title", link: PartLink{FileName: "scan - Part 1.md"}, want: "[[scan - Part 1]]"},
+		{name: "title", link: PartLink{FileName: "scan - Part 1.md", Title: "Lecture 1"}, want: "[[scan - Part 1|Lecture 1]]"},
+		{name: "escaped title", link: PartLink{FileName: "scan.md", Title: "[Draft] a|b"}, want: "[[scan|Draft a-b]]"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := WikiLink(tc.link); got != tc.want {
+				t.Fatalf("unexpected link: got %q want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestRenderIndex(t *testing.T) {
+	parts := []PartLink{
+		{FileName: "scan - Part 1.md", Title: "Lecture 1"},
+		{FileName: "scan - Part 2.md", Title: "Lecture 2"},
+	}
+
+	want := "# Lectures\n\n" +
+		"This note was split into 2 parts.\n\n" +
+		"1. [[scan - Part 1|Lecture 1]]\n" +
+		"2. [[scan - Part 2|Lecture 2]]\n"
+	if got := RenderIndex("Lectures", parts); got != want {
+		t.Fatalf("unexpected index: got %q want %q", got, want)
+	}
+}
+
+func TestAddNavigation(t *testing.T) {
+	index := PartLink{FileName: "scan.md"}
+	parts := make([]PartLink, 0, 3)
+	for i := 1; i <= 3; i++ {
+		parts = append(parts, PartLink{
+			FileName: PartFileName("scan.md", i, 3),
+			Title:    fmt.Sprintf("Lecture %d", i),
+		})
+	}
+
+	tests := []struct {
+		name       string
+		part       int
+		navigation string
+	}{
+		{name: "first", part: 0, navigation: "[[scan|Contents]] · [[scan - Part 2|Lecture 2]] →"},
+		{name: "middle", part: 1, navigation: "← [[scan - Part 1|Lecture 1]] · [[scan|Contents]] · [[scan - Part 3|Lecture 3]] →"},
+		{name: "last", part: 2, navigation: "← [[scan - Part 2|Lecture 2]] · [[scan|Contents]]"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got := AddNavigation("\n# Lecture\n\nbody\n", index, parts, tc.part)
+
+			want := tc.navigation + "\n\n# Lecture\n\nbody\n\n" + tc.navigation + "\n"
+			if got != want {
+				t.Fatalf("unexpected part: got %q want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestSplitFrontMatter(t *testing.T) {
+	tests := []struct {
+		name            string
+		note            string
+		wantFrontMatter string
+		wantBody        string
+	}{
+		{
+			name:            "front matter",
+			note:            "---\nid: scan\n---\n\nPeople:\n\n# Notes\n",
+			wantFrontMatter: "---\nid: scan\n---",
+			wantBody:        "People:\n\n# Notes\n",
+		},
+		{
+			name:     "no front matter",
+			note:     "# Notes\n",
+			wantBody: "# Notes\n",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			frontMatter, body := SplitFrontMatter(tc.note)
+			if frontMatter != tc.wantFrontMatter || body != tc.wantBody {
+				t.Fatalf("unexpected split: got %q %q", frontMatter, body)
+			}
+		})
+	}
+}
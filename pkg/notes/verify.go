@@ -0,0 +1,109 @@
+package notes
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"unicode/utf8"
+)
+
+// Bytes of each side shown around the first difference of a mismatch
+const MISMATCH_CONTEXT = 32
+
+var ErrInvalidUTF8 = errors.New("content is not valid UTF-8")
+
+// Canonicalize prepares a note for comparison. The content must be valid
+// UTF-8 and its line endings are normalized to \n. Nothing else is changed,
+// so a missing trailing newline or mangled characters still differ.
+func Canonicalize(content []byte) ([]byte, error) {
+	if !utf8.Valid(content) {
+		offset := 0
+		for offset < len(content) {
+			r, size := utf8.DecodeRune(content[offset:])
+			if r == utf8.RuneError && size <= 1 {
+				break
+			}
+			offset += size
+		}
+
+		return nil, fmt.Errorf("%w at offset %d", ErrInvalidUTF8, offset)
+	}
+
+	content = bytes.ReplaceAll(content, []byte("\r\n"), []byte("\n"))
+	return bytes.ReplaceAll(content, []byte("\r"), []byte("\n")), nil
+}
+
+// Mismatch describes where a published note first differs from the note it
+// was published from.
+type Mismatch struct {
+	// Offset in the canonical content of the first byte that differs
+	Offset int
+
+	WantLength int
+	GotLength  int
+
+	// The content of each side around the offset
+	WantContext string
+	GotContext  string
+}
+
+// Summary is a single line description of the mismatch, recorded as the
+// reason the stage failed.
+func (m *Mismatch) Summary() string {
+	return fmt.Sprintf(
+		"published note differs at offset %d (want %d bytes, got %d): want %s got %s",
+		m.Offset,
+		m.WantLength,
+		m.GotLength,
+		strconv.Quote(m.WantContext),
+		strconv.Quote(m.GotContext),
+	)
+}
+
+// Compare returns where the canonical forms of the notes first differ, nil
+// when they are the same. Content that isn't valid UTF-8 is reported as an
+// error.
+func Compare(want, got []byte) (*Mismatch, error) {
+	want, err := Canonicalize(want)
+	if err != nil {
+		return nil, fmt.Errorf("note to publish: %w", err)
+	}
+
+	got, err = Canonicalize(got)
+	if err != nil {
+		return nil, fmt.Errorf("published note: %w", err)
+	}
+
+	if bytes.Equal(want, got) {
+		return nil, nil
+	}
+
+	offset := 0
+	for offset < len(want) && offset < len(got) && want[offset] == got[offset] {
+		offset++
+	}
+
+	return &Mismatch{
+		Offset:      offset,
+		WantLength:  len(want),
+		GotLength:   len(got),
+		WantContext: mismatchContext(want, offset),
+		GotContext:  mismatchContext(got, offset),
+	}, nil
+}
+
+// The content around the offset, widened so it doesn't split a character
+func mismatchContext(content []byte, offset int) string {
+	start := max(offset-MISMATCH_CONTEXT, 0)
+	for start > 0 && !utf8.RuneStart(content[start]) {
+		start--
+	}
+
+	end := min(offset+MISMATCH_CONTEXT, len(content))
+	for end < len(content) && !utf8.RuneStart(content[end]) {
+		end++
+	}
+
+	return string(content[start:end])
+}
@@ -0,0 +1,107 @@
+package notes
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestCanonicalize(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    string
+		wantErr bool
+	}{
+		{name: "unchanged", content: "# Notes\n\nbody\n", want: "# Notes\n\nbody\n"},
+		{name: "crlf", content: "# Notes\r\n\r\nbody\r\n", want: "# Notes\n\nbody\n"},
+		{name: "lone cr", content: "# Notes\rbody", want: "# Notes\nbody"},
+		{name: "no trailing newline kept", content: "body", want: "body"},
+		{name: "invalid utf-8", content: "caf\xe9", wantErr: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := Canonicalize([]byte(tc.content))
+			if tc.wantErr {
+				if !errors.Is(err, ErrInvalidUTF8) {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if string(got) != tc.want {
+				t.Fatalf("unexpected content: got %q want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestCompare(t *testing.T) {
+	note := "# Café\n\nNotes taken in the café.\n"
+
+	tests := []struct {
+		name    string
+		got     string
+		want    *Mismatch
+		wantErr bool
+	}{
+		{name: "same", got: note},
+		{name: "crlf translation", got: "# Café\r\n\r\nNotes taken in the café.\r\n"},
+		{
+			// the first byte of the é is kept, the difference is inside it
+			name: "charset mangling",
+			got:  "# CafÃ©\n\nNotes taken in the cafÃ©.\n",
+			want: &Mismatch{
+				Offset:      6,
+				WantLength:  35,
+				GotLength:   39,
+				WantContext: note,
+				GotContext:  "# CafÃ©\n\nNotes taken in the cafÃ©.",
+			},
+		},
+		{
+			name: "truncated",
+			got:  note[:34],
+			want: &Mismatch{
+				Offset:      34,
+				WantLength:  35,
+				GotLength:   34,
+				WantContext: note[2:],
+				GotContext:  note[2:34],
+			},
+		},
+		{name: "invalid utf-8", got: "# Caf\xe9\n", wantErr: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := Compare([]byte(note), []byte(tc.got))
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("unexpected mismatch:\ngot  %+v\nwant %+v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestMismatchSummary(t *testing.T) {
+	mismatch := &Mismatch{
+		Offset:      7,
+		WantLength:  10,
+		GotLength:   9,
+		WantContext: "body\n",
+		GotContext:  "body",
+	}
+
+	want := `published note differs at offset 7 (want 10 bytes, got 9): want "body\n" got "body"`
+	if got := mismatch.Summary(); got != want {
+		t.Fatalf("unexpected summary: got %q want %q", got, want)
+	}
+}
@@ -0,0 +1,233 @@
+package pages
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	// Pages with no more than this many characters, ignoring whitespace, are
+	// blank. Scanners pick up a few specks from an empty sheet.
+	DEFAULT_BLANK_MAX_CHARS = 3
+
+	// A page with only three or more '#', which Mathpix may escape
+	DEFAULT_MARKER_PATTERN = `^(\\?#\s*){3,}$`
+
+	// Longest title taken from a heading to name a section
+	MAX_TITLE_LENGTH = 60
+)
+
+var (
+	headingPattern = regexp.MustCompile(`(?m)^#{1,6}[ \t]+(.+?)[ \t]*#*[ \t]*$`)
+
+	// characters that can't be used in a file name on every platform
+	unsafeNameCharacters = strings.NewReplacer(
+		"/", " ", "\\", " ", ":", " ", "*", " ", "?", " ",
+		`"`, " ", "<", " ", ">", " ", "|", " ",
+	)
+)
+
+type (
+	// Page is the text of a single page of a document, one entry per line
+	Page struct {
+		Number int
+		Lines  []string
+	}
+
+	// SeparatorRules decide which pages separate the documents that were
+	// scanned together. A nil Marker only detects blank pages.
+	SeparatorRules struct {
+		BlankPages    bool
+		BlankMaxChars int
+		Marker        *regexp.Regexp
+	}
+
+	// Section is the Markdown of one of the documents in a scan along with
+	// the pages it came from.
+	Section struct {
+		Markdown  string
+		FirstPage int
+		LastPage  int
+	}
+)
+
+// DefaultSeparatorRules detects blank pages and pages with a '###' marker.
+func DefaultSeparatorRules() SeparatorRules {
+	return SeparatorRules{
+		BlankPages:    true,
+		BlankMaxChars: DEFAULT_BLANK_MAX_CHARS,
+		Marker:        regexp.MustCompile(DEFAULT_MARKER_PATTERN),
+	}
+}
+
+// IsSeparator reports whether the page separates two documents.
+func (r SeparatorRules) IsSeparator(page Page) bool {
+	if r.isBlank(page) {
+		return true
+	}
+
+	text := strings.TrimSpace(strings.Join(page.Lines, "\n"))
+
+	return r.Marker != nil && text != "" && r.Marker.MatchString(text)
+}
+
+func (r SeparatorRules) isBlank(page Page) bool {
+	text := strings.Join(page.Lines, "\n")
+
+	return r.BlankPages && visibleCharacters(text) <= r.BlankMaxChars
+}
+
+func visibleCharacters(text string) int {
+	count := 0
+	for _, r := range text {
+		if !unicode.IsSpace(r) {
+			count++
+		}
+	}
+
+	return count
+}
+
+// DetectSeparators returns the indexes of the separator pages.
+func DetectSeparators(pages []Page, rules SeparatorRules) []int {
+	separators := make([]int, 0)
+	for i, page := range pages {
+		if rules.IsSeparator(page) {
+			separators = append(separators, i)
+		}
+	}
+
+	return separators
+}
+
+// PageOffsets finds where each page starts in the Markdown of the whole
+// document by searching for the lines of the page in order. Pages without a
+// line in the Markdown, such as blank pages, start where the next page does.
+func PageOffsets(markdown string, pages []Page) []int {
+	offsets := make([]int, len(pages))
+	searchFrom := 0
+
+	for i, page := range pages {
+		offsets[i] = -1
+
+		for _, line := range page.Lines {
+			line = strings.TrimSpace(line)
+			if line == "" {
+				continue
+			}
+
+			found := strings.Index(markdown[searchFrom:], line)
+			if found < 0 {
+				continue
+			}
+
+			// the page starts at the beginning of the line it was found on
+			start := searchFrom + found
+			start = strings.LastIndexByte(markdown[:start], '\n') + 1
+
+			offsets[i] = max(start, searchFrom)
+			searchFrom = searchFrom + found + len(line)
+			break
+		}
+	}
+
+	next := len(markdown)
+	for i := len(offsets) - 1; i >= 0; i-- {
+		if offsets[i] < 0 {
+			offsets[i] = next
+		}
+		next = offsets[i]
+	}
+
+	return offsets
+}
+
+// Split the Markdown of a scan into a section per document. The separator
+// pages are dropped along with any section left without content, such as
+// after a trailing separator page. A scan without separators is returned as
+// a single section.
+func Split(markdown string, pages []Page, rules SeparatorRules) []Section {
+	if len(pages) == 0 {
+		return []Section{{Markdown: markdown}}
+	}
+
+	// the specks on a blank page could be found anywhere in the Markdown
+	located := make([]Page, len(pages))
+	for i, page := range pages {
+		if !rules.isBlank(page) {
+			located[i] = page
+		}
+	}
+
+	offsets := PageOffsets(markdown, located)
+	sections := make([]Section, 0)
+
+	add := func(start, end, firstPage, lastPage int) {
+		content := strings.TrimSpace(markdown[start:end])
+		if content == "" || firstPage > lastPage {
+			return
+		}
+
+		sections = append(sections, Section{
+			Markdown:  content + "\n",
+			FirstPage: pages[firstPage].Number,
+			LastPage:  pages[lastPage].Number,
+		})
+	}
+
+	start, firstPage := 0, 0
+	for _, separator := range DetectSeparators(pages, rules) {
+		add(start, offsets[separator], firstPage, separator-1)
+
+		start = len(markdown)
+		if separator+1 < len(pages) {
+			start = offsets[separator+1]
+		}
+		firstPage = separator + 1
+	}
+
+	add(start, len(markdown), firstPage, len(pages)-1)
+
+	return sections
+}
+
+// SectionNames names the document of each section from its first heading,
+// or by its position in the scan when it has none. Names are unique.
+func SectionNames(baseName string, sections []Section) []string {
+	names := make([]string, len(sections))
+	used := make(map[string]bool)
+
+	for i, section := range sections {
+		name := fmt.Sprintf("%s-%d", baseName, i+1)
+		if title := sectionTitle(section.Markdown); title != "" {
+			name = fmt.Sprintf("%s - %s", baseName, title)
+		}
+
+		if used[name] {
+			name = fmt.Sprintf("%s-%d", name, i+1)
+		}
+
+		used[name] = true
+		names[i] = name
+	}
+
+	return names
+}
+
+// The text of the first heading made safe to use in a file name
+func sectionTitle(markdown string) string {
+	match := headingPattern.FindStringSubmatch(markdown)
+	if match == nil {
+		return ""
+	}
+
+	title := strings.Join(strings.Fields(unsafeNameCharacters.Replace(match[1])), " ")
+	if utf8.RuneCountInString(title) > MAX_TITLE_LENGTH {
+		title = strings.TrimSpace(string([]rune(title)[:MAX_TITLE_LENGTH]))
+	}
+
+	return title
+}
@@ -0,0 +1,187 @@
+package pages
+
+import (
+	"regexp"
+	"slices"
+	"testing"
+)
+
+// A scan of two receipts and a letter separated by a blank page and a page
+// with a handwritten marker, as Mathpix returns them
+var (
+	scanPages = []Page{
+		{Number: 1, Lines: []string{"# Hardware Store", "Tile 40"}},
+		{Number: 2, Lines: []string{"Grout 2", "Total 42"}},
+		{Number: 3, Lines: []string{"."}},
+		{Number: 4, Lines: []string{"## Garden Centre", "Soil 3"}},
+		{Number: 5, Lines: []string{`\#\#\#`}},
+		{Number: 6, Lines: []string{"Dear Sam,", "Thanks for the help."}},
+	}
+
+	scanMarkdown = "# Hardware Store\nTile 40\n\nGrout 2\nTotal 42\n\n" +
+		"## Garden Centre\nSoil 3\n\n\\#\\#\\#\n\nDear Sam,\nThanks for the help.\n"
+)
+
+func TestIsSeparator(t *testing.T) {
+	rules := DefaultSeparatorRules()
+
+	tests := []struct {
+		name  string
+		lines []string
+		want  bool
+	}{
+		{name: "empty page", lines: nil, want: true},
+		{name: "specks", lines: []string{". ,", "'"}, want: true},
+		{name: "marker", lines: []string{"###"}, want: true},
+		{name: "spaced marker", lines: []string{"# # # #"}, want: true},
+		{name: "escaped marker", lines: []string{`\#\#\#`}, want: true},
+		{name: "heading", lines: []string{"### Notes"}, want: false},
+		{name: "marker with text", lines: []string{"###", "Notes"}, want: false},
+		{name: "short page", lines: []string{"Yes"}, want: true},
+		{name: "text", lines: []string{"Total 42"}, want: false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got := rules.IsSeparator(Page{Lines: tc.lines})
+			if got != tc.want {
+				t.Fatalf("unexpected separator: got %v want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestIsSeparatorRules(t *testing.T) {
+	marker := Page{Lines: []string{"--- next ---"}}
+	blank := Page{}
+
+	rules := SeparatorRules{Marker: regexp.MustCompile(`^-+ next -+$`)}
+	if !rules.IsSeparator(marker) {
+		t.Fatalf("custom marker was not detected")
+	}
+
+	if rules.IsSeparator(blank) {
+		t.Fatalf("blank page detected with blank pages disabled")
+	}
+}
+
+func TestPageOffsets(t *testing.T) {
+	pages := slices.Clone(scanPages)
+	pages[2] = Page{Number: 3}
+
+	got := PageOffsets(scanMarkdown, pages)
+
+	// the blank page starts where the page after it does
+	want := []int{0, 26, 44, 44, 69, 77}
+	if !slices.Equal(got, want) {
+		t.Fatalf("unexpected offsets: got %v want %v", got, want)
+	}
+}
+
+func TestPageOffsetsRepeatedLines(t *testing.T) {
+	markdown := "Page header\nfirst\nPage header\nsecond\n"
+	pages := []Page{
+		{Number: 1, Lines: []string{"Page header", "first"}},
+		{Number: 2, Lines: []string{"Page header", "second"}},
+	}
+
+	got := PageOffsets(markdown, pages)
+	want := []int{0, 18}
+	if !slices.Equal(got, want) {
+		t.Fatalf("unexpected offsets: got %v want %v", got, want)
+	}
+}
+
+func TestSplit(t *testing.T) {
+	tests := []struct {
+		name     string
+		markdown string
+		pages    []Page
+		want     []Section
+	}{
+		{
+			name:     "no separators",
+			markdown: "# Hardware Store\nTile 40\n\nGrout 2\n",
+			pages:    scanPages[:2],
+			want: []Section{
+				{Markdown: "# Hardware Store\nTile 40\n\nGrout 2\n", FirstPage: 1, LastPage: 2},
+			},
+		},
+		{
+			name:     "one separator",
+			markdown: "# Hardware Store\nTile 40\n\nGrout 2\nTotal 42\n\n## Garden Centre\nSoil 3\n",
+			pages:    scanPages[:4],
+			want: []Section{
+				{Markdown: "# Hardware Store\nTile 40\n\nGrout 2\nTotal 42\n", FirstPage: 1, LastPage: 2},
+				{Markdown: "## Garden Centre\nSoil 3\n", FirstPage: 4, LastPage: 4},
+			},
+		},
+		{
+			name:     "several separators",
+			markdown: scanMarkdown,
+			pages:    scanPages,
+			want: []Section{
+				{Markdown: "# Hardware Store\nTile 40\n\nGrout 2\nTotal 42\n", FirstPage: 1, LastPage: 2},
+				{Markdown: "## Garden Centre\nSoil 3\n", FirstPage: 4, LastPage: 4},
+				{Markdown: "Dear Sam,\nThanks for the help.\n", FirstPage: 6, LastPage: 6},
+			},
+		},
+		{
+			name:     "trailing separator",
+			markdown: "## Garden Centre\nSoil 3\n\n\\#\\#\\#\n",
+			pages:    scanPages[3:5],
+			want: []Section{
+				{Markdown: "## Garden Centre\nSoil 3\n", FirstPage: 4, LastPage: 4},
+			},
+		},
+		{
+			name:     "leading and repeated separators",
+			markdown: "\\#\\#\\#\n\n## Garden Centre\nSoil 3\n",
+			pages: []Page{
+				{Number: 1, Lines: []string{`\#\#\#`}},
+				{Number: 2},
+				{Number: 3, Lines: []string{"## Garden Centre", "Soil 3"}},
+			},
+			want: []Section{
+				{Markdown: "## Garden Centre\nSoil 3\n", FirstPage: 3, LastPage: 3},
+			},
+		},
+		{
+			name:     "no pages",
+			markdown: "Tile 40\n",
+			want:     []Section{{Markdown: "Tile 40\n"}},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got := Split(tc.markdown, tc.pages, DefaultSeparatorRules())
+			if !slices.Equal(got, tc.want) {
+				t.Fatalf("unexpected sections:\ngot  %q\nwant %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestSectionNames(t *testing.T) {
+	sections := []Section{
+		{Markdown: "# Hardware Store\nTile 40\n"},
+		{Markdown: "Soil 3\n"},
+		{Markdown: "intro\n\n## Invoice: 12/03 ##\n"},
+		{Markdown: "# Hardware Store\nGrout 2\n"},
+		{Markdown: "# A very long heading that goes on and on well past the limit for names\n"},
+	}
+
+	got := SectionNames("scan", sections)
+	want := []string{
+		"scan - Hardware Store",
+		"scan-2",
+		"scan - Invoice 12 03",
+		"scan - Hardware Store-4",
+		"scan - A very long heading that goes on and on well past the limit",
+	}
+
+	if !slices.Equal(got, want) {
+		t.Fatalf("unexpected names:\ngot  %q\nwant %q", got, want)
+	}
+}
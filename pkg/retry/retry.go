@@ -0,0 +1,76 @@
+package retry
+
+import (
+	"context"
+	"log/slog"
+	"math/rand/v2"
+	"time"
+)
+
+// Policy bounds how often and how quickly an operation is retried.
+type Policy struct {
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+
+	// Retryable reports whether the error is worth another attempt
+	Retryable func(err error) bool
+}
+
+// Do runs the operation until it succeeds, fails with an error the policy
+// doesn't retry, or runs out of attempts. The backoff doubles after every
+// attempt with up to half of it again added at random, so the lambdas that
+// hit a rate limit together don't retry together. It gives up rather than
+// wait past the context deadline. The last error is returned.
+func Do(
+	ctx context.Context,
+	policy Policy,
+	call string,
+	operation func() error,
+) error {
+	backoff := policy.InitialBackoff
+
+	for attempt := 1; ; attempt++ {
+		err := operation()
+		if err == nil || attempt >= policy.MaxAttempts ||
+			!policy.Retryable(err) {
+			return err
+		}
+
+		wait := backoff + rand.N(backoff/2+1)
+
+		deadline, ok := ctx.Deadline()
+		if ok && time.Now().Add(wait).After(deadline) {
+			slog.Warn(
+				"Not enough time left to retry",
+				"call",
+				call,
+				"attempt",
+				attempt,
+				"error",
+				err,
+			)
+			return err
+		}
+
+		slog.Warn(
+			"Retrying after a transient failure",
+			"call",
+			call,
+			"attempt",
+			attempt,
+			"backoff",
+			wait,
+			"error",
+			err,
+		)
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(wait):
+		}
+
+		backoff = min(backoff*2, policy.MaxBackoff)
+	}
+}
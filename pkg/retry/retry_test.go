@@ -0,0 +1,107 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestDo(t *testing.T) {
+	transient := errors.New("transient")
+	permanent := errors.New("permanent")
+
+	tests := []struct {
+		name         string
+		failures     []error
+		wantErr      error
+		wantAttempts int
+	}{
+		{name: "first attempt succeeds", wantAttempts: 1},
+		{
+			name:         "succeeds after a transient failure",
+			failures:     []error{transient},
+			wantAttempts: 2,
+		},
+		{
+			name:         "permanent failure is not retried",
+			failures:     []error{permanent},
+			wantErr:      permanent,
+			wantAttempts: 1,
+		},
+		{
+			name:         "gives up after the last attempt",
+			failures:     []error{transient, transient, transient, transient},
+			wantErr:      transient,
+			wantAttempts: 3,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			attempts := 0
+			err := Do(
+				context.Background(),
+				Policy{
+					MaxAttempts: 3,
+					MaxBackoff:  time.Millisecond,
+					Retryable: func(err error) bool {
+						return errors.Is(err, transient)
+					},
+				},
+				"test",
+				func() error {
+					attempts++
+					if attempts <= len(tc.failures) {
+						return tc.failures[attempts-1]
+					}
+					return nil
+				},
+			)
+
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("unexpected error: got %v want %v", err, tc.wantErr)
+			}
+
+			if attempts != tc.wantAttempts {
+				t.Fatalf("unexpected attempts: got %d want %d", attempts, tc.wantAttempts)
+			}
+		})
+	}
+}
+
+func TestDoStopsBeforeTheDeadline(t *testing.T) {
+	transient := errors.New("transient")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	attempts := 0
+	start := time.Now()
+	err := Do(
+		ctx,
+		Policy{
+			MaxAttempts:    5,
+			InitialBackoff: time.Minute,
+			MaxBackoff:     time.Minute,
+			Retryable:      func(err error) bool { return true },
+		},
+		"test",
+		func() error {
+			attempts++
+			return transient
+		},
+	)
+
+	if !errors.Is(err, transient) {
+		t.Fatalf("unexpected error: got %v", err)
+	}
+
+	if attempts != 1 {
+		t.Fatalf("unexpected attempts: got %d want 1", attempts)
+	}
+
+	if time.Since(start) > time.Second {
+		t.Fatalf("waited past the deadline")
+	}
+}
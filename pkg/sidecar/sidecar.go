@@ -0,0 +1,174 @@
+package sidecar
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/KyleBrandon/scriptor/pkg/types"
+)
+
+const (
+	// A sidecar is named exactly like the document with one of the suffixes,
+	// "scan.pdf.scriptor.txt" for "scan.pdf"
+	TEXT_SUFFIX = ".scriptor.txt"
+	YAML_SUFFIX = ".scriptor.yaml"
+
+	// Largest sidecar read, the directives only take a few lines
+	MAX_SIZE = 64 * 1024
+)
+
+var (
+	suffixes = []string{TEXT_SUFFIX, YAML_SUFFIX}
+
+	// Values of the pipeline directive
+	pipelines = []string{types.PIPELINE_FULL, types.PIPELINE_NO_CLEANUP}
+)
+
+// IsSidecar reports whether the file name is the name of a sidecar.
+func IsSidecar(name string) bool {
+	return DocumentName(name) != ""
+}
+
+// DocumentName returns the name of the document the sidecar is for, or an
+// empty string when the name isn't a sidecar.
+func DocumentName(name string) string {
+	for _, suffix := range suffixes {
+		if documentName, ok := strings.CutSuffix(name, suffix); ok {
+			return documentName
+		}
+	}
+
+	return ""
+}
+
+// Names returns the names a sidecar for the document can have.
+func Names(documentName string) []string {
+	names := make([]string, 0, len(suffixes))
+	for _, suffix := range suffixes {
+		names = append(names, documentName+suffix)
+	}
+
+	return names
+}
+
+// Parse reads the directives from the content of a sidecar. Each line is a
+// "key: value" directive, blank lines and lines starting with # are
+// ignored. Tags are separated by commas or given as a YAML list below the
+// tags key. Unknown keys and invalid values are skipped with a warning
+// rather than failing the document.
+func Parse(content string) (*types.DocumentDirectives, []string) {
+	directives := &types.DocumentDirectives{}
+	warnings := make([]string, 0)
+
+	inTags := false
+	for i, line := range strings.Split(content, "\n") {
+		number := i + 1
+		line = strings.TrimSpace(line)
+		if line == "" || line == "---" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if item, ok := strings.CutPrefix(line, "- "); ok {
+			if !inTags {
+				warnings = append(warnings, fmt.Sprintf("line %d: list item outside of tags", number))
+				continue
+			}
+
+			directives.Tags = appendTags(directives.Tags, []string{item})
+			continue
+		}
+
+		inTags = false
+
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			warnings = append(warnings, fmt.Sprintf("line %d: expected key: value", number))
+			continue
+		}
+
+		key = strings.ToLower(strings.TrimSpace(key))
+		value = unquote(strings.TrimSpace(value))
+
+		switch key {
+		case "language":
+			directives.Language = value
+
+		case "route":
+			directives.Route = value
+
+		case "title":
+			directives.Title = value
+
+		case "pipeline":
+			pipeline := strings.ToLower(value)
+			if !slices.Contains(pipelines, pipeline) {
+				warnings = append(
+					warnings,
+					fmt.Sprintf("line %d: unknown pipeline %q", number, value),
+				)
+				continue
+			}
+			directives.Pipeline = pipeline
+
+		case "hold":
+			hold, err := parseBool(value)
+			if err != nil {
+				warnings = append(
+					warnings,
+					fmt.Sprintf("line %d: invalid hold %q", number, value),
+				)
+				continue
+			}
+			directives.Hold = hold
+
+		case "tags":
+			inTags = value == ""
+			value = strings.TrimSuffix(strings.TrimPrefix(value, "["), "]")
+			directives.Tags = appendTags(directives.Tags, strings.Split(value, ","))
+
+		default:
+			warnings = append(
+				warnings,
+				fmt.Sprintf("line %d: unknown directive %q", number, key),
+			)
+		}
+	}
+
+	return directives, warnings
+}
+
+// Add the tags without their quotes or leading #, skipping blanks and repeats
+func appendTags(tags []string, values []string) []string {
+	for _, value := range values {
+		tag := strings.TrimPrefix(unquote(strings.TrimSpace(value)), "#")
+		if tag != "" && !slices.Contains(tags, tag) {
+			tags = append(tags, tag)
+		}
+	}
+
+	return tags
+}
+
+func unquote(value string) string {
+	if len(value) >= 2 &&
+		(value[0] == '"' || value[0] == '\'') &&
+		value[len(value)-1] == value[0] {
+		return value[1 : len(value)-1]
+	}
+
+	return value
+}
+
+// Booleans as strconv reads them, along with the YAML yes and no
+func parseBool(value string) (bool, error) {
+	switch strings.ToLower(value) {
+	case "yes", "on":
+		return true, nil
+	case "no", "off":
+		return false, nil
+	}
+
+	return strconv.ParseBool(value)
+}
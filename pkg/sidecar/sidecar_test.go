@@ -0,0 +1,114 @@
+package sidecar
+
+import (
+	"reflect"
+	"slices"
+	"testing"
+
+	"github.com/KyleBrandon/scriptor/pkg/types"
+)
+
+func TestDocumentName(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{name: "scan.pdf.scriptor.txt", want: "scan.pdf"},
+		{name: "scan.pdf.scriptor.yaml", want: "scan.pdf"},
+		{name: "scan.pdf"},
+		{name: "scan.scriptor.txt.pdf"},
+		{name: "notes.txt"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := DocumentName(tc.name); got != tc.want {
+				t.Fatalf("unexpected document name: got %q want %q", got, tc.want)
+			}
+
+			if IsSidecar(tc.name) != (tc.want != "") {
+				t.Fatalf("unexpected sidecar check for %q", tc.name)
+			}
+		})
+	}
+
+	if !slices.Equal(Names("scan.pdf"), []string{"scan.pdf.scriptor.txt", "scan.pdf.scriptor.yaml"}) {
+		t.Fatalf("unexpected names: %v", Names("scan.pdf"))
+	}
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name         string
+		content      string
+		want         types.DocumentDirectives
+		wantWarnings []string
+	}{
+		{
+			name: "every directive",
+			content: "# notes for the scan\n" +
+				"language: Spanish\n" +
+				"route: project-x\n" +
+				"pipeline: no-cleanup\n" +
+				"hold: true\n" +
+				"tags: receipts, #travel, receipts\n" +
+				"title: \"Trip: Madrid\"\n",
+			want: types.DocumentDirectives{
+				Language: "Spanish",
+				Route:    "project-x",
+				Pipeline: types.PIPELINE_NO_CLEANUP,
+				Hold:     true,
+				Tags:     []string{"receipts", "travel"},
+				Title:    "Trip: Madrid",
+			},
+		},
+		{
+			name: "yaml",
+			content: "---\n" +
+				"Hold: no\n" +
+				"tags:\n" +
+				"  - lectures\n" +
+				"  - 'math'\n" +
+				"title: Week 3\n",
+			want: types.DocumentDirectives{
+				Tags:  []string{"lectures", "math"},
+				Title: "Week 3",
+			},
+		},
+		{
+			name:    "flow list of tags",
+			content: "tags: [a, b]\n",
+			want:    types.DocumentDirectives{Tags: []string{"a", "b"}},
+		},
+		{
+			name: "unknown keys and bad values",
+			content: "language: fr\n" +
+				"cleanup: off\n" +
+				"pipeline: fast\n" +
+				"hold: later\n" +
+				"just some text\n" +
+				"- stray\n",
+			want: types.DocumentDirectives{Language: "fr"},
+			wantWarnings: []string{
+				`line 2: unknown directive "cleanup"`,
+				`line 3: unknown pipeline "fast"`,
+				`line 4: invalid hold "later"`,
+				"line 5: expected key: value",
+				"line 6: list item outside of tags",
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			directives, warnings := Parse(tc.content)
+			if !reflect.DeepEqual(*directives, tc.want) {
+				t.Fatalf("unexpected directives: got %+v want %+v", *directives, tc.want)
+			}
+
+			if !slices.Equal(warnings, tc.wantWarnings) {
+				t.Fatalf("unexpected warnings: got %q want %q", warnings, tc.wantWarnings)
+			}
+		})
+	}
+}
@@ -1,6 +1,9 @@
 package types
 
 import (
+	"fmt"
+	"slices"
+	"strings"
 	"time"
 )
 
@@ -24,6 +27,10 @@ const (
 	// S3 bucket to store staging and final converted files
 	S3_BUCKET_NAME = "scriptor-documents"
 
+	// Prefix of the bucket the finished note of each document is kept in,
+	// as final/<documentID>/<name>.md
+	S3_FINAL_PREFIX = "final"
+
 	// S3 bucket to store raw SES emails before parsing.
 	RAW_EMAIL_BUCKET_NAME = "scriptor-incoming-email"
 
@@ -31,20 +38,21 @@ const (
 	// Document stage values
 	//
 
-	// Document downloaded to S3
-	DOCUMENT_STAGE_NEW = "new"
+	// Document recorded and not downloaded yet. Drive documents start the
+	// workflow at this stage, it has no stage record of its own.
+	DOCUMENT_STAGE_NEW Stage = "new"
 
 	// Document downloaded to S3
-	DOCUMENT_STAGE_DOWNLOAD = "downloaded"
+	DOCUMENT_STAGE_DOWNLOAD Stage = "downloaded"
 
 	// Document stage Mathpix
-	DOCUMENT_STAGE_MATHPIX = "mathpix"
+	DOCUMENT_STAGE_MATHPIX Stage = "mathpix"
 
 	// Document stage for the LLM cleanup step.
-	DOCUMENT_STAGE_OPENAI = "openai"
+	DOCUMENT_STAGE_OPENAI Stage = "openai"
 
 	// Document stage uploaded
-	DOCUMENT_STAGE_UPLOAD = "uploaded"
+	DOCUMENT_STAGE_UPLOAD Stage = "uploaded"
 
 	//
 	// Document status values
@@ -55,24 +63,120 @@ const (
 	DOCUMENT_STATUS_COMPLETE   = "complete"
 	DOCUMENT_STATUS_ERROR      = "error"
 
+	// Terminal status for documents removed from the source before they
+	// could be downloaded. There is nothing to retry.
+	DOCUMENT_STATUS_SOURCE_MISSING = "source-missing"
+
+	// Status for documents with the same content as one already processed.
+	// The note of the original is reused instead of processing it again.
+	DOCUMENT_STATUS_DUPLICATE = "duplicate"
+
+	// Step status for a downloaded document whose original is still being
+	// processed. The workflow waits on the original without downloading the
+	// document again.
+	DOCUMENT_STATUS_DUPLICATE_PENDING = "duplicate-pending"
+
+	// Status for documents their sidecar file holds back. The workflow is
+	// started once the sidecar no longer holds them.
+	DOCUMENT_STATUS_HELD = "held"
+
+	// Terminal status for documents a newer revision of the same file
+	// replaced while they were still being processed
+	DOCUMENT_STATUS_SUPERSEDED = "superseded"
+
+	// Terminal status for documents whose file was trashed or removed from
+	// Drive after they were recorded
+	DOCUMENT_STATUS_DELETED = "deleted"
+
 	// Document in error
 	DOCUMENT_ERROR = "document-error"
 
+	// Error type reported to the workflow when a document is over the size limit
+	DOCUMENT_ERROR_TOO_LARGE = "DocumentTooLarge"
+
+	// Error type reported to the workflow when a document with the same
+	// content is still being processed, the check is retried later
+	DOCUMENT_ERROR_DUPLICATE_PENDING = "DuplicatePending"
+
+	// Error type reported to the workflow when a newer revision replaced the
+	// document, the workflow ends without failing
+	DOCUMENT_ERROR_SUPERSEDED = "DocumentSuperseded"
+
+	// Error type reported to the workflow when a stage fails, the name of
+	// util.StageFailedError. Its message carries the stage and attempt.
+	DOCUMENT_ERROR_STAGE_FAILED = "StageFailedError"
+
 	//
 	// Document source values
 	//
 
 	DOCUMENT_SOURCE_GOOGLE_DRIVE = "google_drive"
 	DOCUMENT_SOURCE_KINDLE_EMAIL = "kindle_email"
+
+	//
+	// Content types of the stage files
+	//
+
+	CONTENT_TYPE_PDF      = "application/pdf"
+	CONTENT_TYPE_MARKDOWN = "text/markdown"
+	CONTENT_TYPE_TEXT     = "text/plain"
+	CONTENT_TYPE_PNG      = "image/png"
+	CONTENT_TYPE_JPEG     = "image/jpeg"
+	CONTENT_TYPE_HEIC     = "image/heic"
+	CONTENT_TYPE_TIFF     = "image/tiff"
+
+	// Target MIME type that has Drive convert an upload to a Google Doc
+	CONTENT_TYPE_GOOGLE_DOC = "application/vnd.google-apps.document"
+
+	//
+	// What the upload stage does with the original in the watch folder
+	//
+
+	// Move the original to the archive folder
+	ARCHIVE_MODE_MOVE = "move"
+
+	// Copy the original to the archive folder and leave it in place
+	ARCHIVE_MODE_COPY = "copy"
+
+	// Leave the original in place, the document table and the app
+	// properties keep it from being processed again
+	ARCHIVE_MODE_NONE = "none"
+
+	//
+	// Stages a sidecar file can ask the document to go through
+	//
+
+	// Every stage, the default
+	PIPELINE_FULL = "full"
+
+	// Skip the LLM cleanup and publish the Markdown from Mathpix
+	PIPELINE_NO_CLEANUP = "no-cleanup"
+
+	//
+	// What a channel notification asks the SQS handler to do
+	//
+
+	// Process the changes to the watch folder since the changes token, the
+	// default
+	NOTIFICATION_KIND_CHANGES = "changes"
+
+	// Process every file in the watch folder, sent when the channel is
+	// registered so files added before it was watched are found, and when
+	// the channel is backfilled
+	NOTIFICATION_KIND_BASELINE = "baseline"
 )
 
 type (
 	// Default locations for where to monitor for folders and where to place
 	// converted documents.
 	GoogleFolderDefaultLocations struct {
-		FolderID        string `json:"folder_id"`
-		ArchiveFolderID string `json:"archive_folder_id"`
-		DestFolderID    string `json:"destination_folder_id"`
+		FolderID        string   `json:"folder_id"`
+		ArchiveFolderID string   `json:"archive_folder_id"`
+		DestFolderID    string   `json:"destination_folder_id"`
+		DestFolderIDs   []string `json:"destination_folder_ids,omitempty"`
+
+		// ID of the shared drive the watch folder is in, empty for My Drive
+		DriveID string `json:"drive_id,omitempty"`
 	}
 
 	// Mathpix application ID and Key.
@@ -88,30 +192,125 @@ type (
 
 	// WatchChannel represents a folder location to watch for new files to process.
 	// When a file is detected it is processed then moved to the ArchiveFolderID.
-	// The results of the processing are saved to the DestinationFolderID.
+	// The results of the processing are saved to each of the
+	// DestinationFolderIDs, or the DestinationFolderID of channels saved before
+	// there could be more than one.
 	//
 	// The ChannelID, ExpiresAt, and WebhookUrl are used to track the Google Drive
 	// resource that monitors the folder identified in FolderID.
 	WatchChannel struct {
-		FolderID            string    `dynamodbav:"folder_id"`
-		ArchiveFolderID     string    `dynamodbav:"archive_folder_id"`
-		DestinationFolderID string    `dynamodbav:"destination_folder_id"`
-		CreatedAt           time.Time `dynamodbav:"created_at"`
-		ChannelID           string    `dynamodbav:"channel_id"`
-		ResourceID          string    `dynamodbav:"resource_id"`
-		UpdatedAt           time.Time `dynamodbav:"updated_at"`
+		FolderID             string    `dynamodbav:"folder_id"`
+		ArchiveFolderID      string    `dynamodbav:"archive_folder_id"`
+		DestinationFolderID  string    `dynamodbav:"destination_folder_id"`
+		DestinationFolderIDs []string  `dynamodbav:"destination_folder_ids,omitempty"`
+		CreatedAt            time.Time `dynamodbav:"created_at"`
+		ChannelID            string    `dynamodbav:"channel_id"`
+		ResourceID           string    `dynamodbav:"resource_id"`
+		UpdatedAt            time.Time `dynamodbav:"updated_at"`
 
 		ExpiresAt  int64  `dynamodbav:"expires_at"`
 		WebhookUrl string `dynamodbav:"webhook_url"`
+
+		// The partition of ExpiryIndex, set by the store each time the
+		// channel is saved. Channels saved before the index existed have
+		// none until they are saved again.
+		ExpiryPartition string `dynamodbav:"expiry_partition,omitempty"`
+
+		// Random token Google echoes back in the X-Goog-Channel-Token header
+		// of the channel's notifications. A new one is made each time the
+		// channel is registered.
+		Token string `dynamodbav:"token,omitempty"`
+
+		// ID of the shared drive the watch folder is in, empty for My Drive.
+		// The changes of a shared drive are only reported when they are
+		// queried for the drive.
+		DriveID string `dynamodbav:"drive_id,omitempty"`
+
+		// Watch the folders nested below the watch folder as well. The
+		// destination and archive folders can't be nested in it then.
+		Recursive bool `dynamodbav:"recursive,omitempty"`
+
+		// Set when files saved by Scriptor show up in the watch folder
+		LoopDetectedAt int64 `dynamodbav:"loop_detected_at,omitempty"`
+
+		// Notifications of a paused channel are dropped without querying
+		// the changes, so its changes token stays where it was and the
+		// files added while it was paused are found when it is resumed
+		Paused bool `dynamodbav:"paused,omitempty"`
+
+		// Publish the note as a Google Doc as well, and optionally skip the
+		// Markdown note. The note is always published in one of the formats.
+		PublishGoogleDoc bool `dynamodbav:"publish_google_doc,omitempty"`
+		SkipMarkdown     bool `dynamodbav:"skip_markdown,omitempty"`
+
+		// Template for the names of the files published for the channel,
+		// FILENAME_TEMPLATE or the original name when empty
+		FilenameTemplate string `dynamodbav:"filename_template,omitempty"`
+
+		// Publish into YYYY/MM folders below the destination folder
+		DateFolders bool `dynamodbav:"date_folders,omitempty"`
+
+		// Comment on the original in Drive when it was processed or failed.
+		// Off by default as the comments are seen by everyone the folder is
+		// shared with.
+		PostComments bool `dynamodbav:"post_comments,omitempty"`
+
+		// What to do with the original once it's processed, one of the
+		// ARCHIVE_MODE values. Empty moves it to the archive folder.
+		ArchiveMode string `dynamodbav:"archive_mode,omitempty"`
+
+		// Destination folders by name that a sidecar file can route a
+		// document to instead of the destinations of the channel
+		Routes map[string]string `dynamodbav:"routes,omitempty"`
+
+		// MIME types of the files processed from the watch folder, a type
+		// can end in /* to allow all its subtypes. The PDFs, images and
+		// Google Docs of defaultAllowedMimeTypes when empty.
+		AllowedMimeTypes []string `dynamodbav:"allowed_mime_types,omitempty"`
+
+		// Executions of the channel's documents that may run at the same
+		// time, documents found past the limit wait until one finishes. No
+		// limit when zero.
+		MaxConcurrentExecutions int `dynamodbav:"max_concurrent_executions,omitempty"`
+
+		// Earlier channels of the folder that failed to stop when it was
+		// registered again. Google keeps sending their notifications until
+		// they are stopped or expire, so each run tries again. Not omitted
+		// when empty so saving the channel clears the list.
+		PendingStops []PendingStop `dynamodbav:"pending_stops"`
+	}
+
+	// A channel that was replaced but couldn't be stopped
+	PendingStop struct {
+		ChannelID  string `dynamodbav:"channel_id"`
+		ResourceID string `dynamodbav:"resource_id"`
+
+		// Unix milliseconds when the channel expires, Google stops it then
+		ExpiresAt int64 `dynamodbav:"expires_at"`
+
+		// The stops that failed and why the last one did
+		Attempts  int    `dynamodbav:"attempts"`
+		LastError string `dynamodbav:"last_error"`
 	}
 
 	// WatchChannelLock is used to lock a watch channel for querying changes
 	WatchChannelLock struct {
 		ChannelID         string `dynamodbav:"channel_id"`
 		ChangesStartToken string `dynamodbav:"changes_start_token"`
-		Locked            bool   `dynmodbav:"locked"`
+		Locked            bool   `dynamodbav:"locked"`
 		LockExpires       int64  `dynamodbav:"lock_expires"`
 		UpdatedAt         string `dynamodbav:"updated_at"`
+
+		// Unix seconds when DynamoDB removes the lock of a channel that
+		// was replaced and never cleaned up
+		ExpiresAt int64 `dynamodbav:"expires_at,omitempty"`
+
+		// Executions counted against the channel's MaxConcurrentExecutions
+		ActiveExecutions int `dynamodbav:"active_executions,omitempty"`
+
+		// Unix milliseconds until which a queued notification is pending
+		// for the channel, the webhook doesn't queue another until then
+		NotificationPendingUntil int64 `dynamodbav:"notification_pending_until,omitempty"`
 	}
 
 	// Used to send an SQS notification that there are changes on a channel
@@ -119,6 +318,94 @@ type (
 		NotificationID string `json:"notification_id"`
 		ChannelID      string `json:"channel_id"`
 		FolderID       string `json:"folder_id"`
+
+		// The shared drive of the folder, empty for My Drive
+		DriveID string `json:"drive_id,omitempty"`
+
+		// Set when the channel watches the folders below the folder as well
+		Recursive bool `json:"recursive,omitempty"`
+
+		// One of the NOTIFICATION_KIND values, the changes when empty
+		Kind string `json:"kind,omitempty"`
+
+		// The X-Goog-Resource-State of the webhook request, like add or
+		// trash. Drive reports what changed in the changes themselves, so
+		// it is only logged.
+		ResourceState string `json:"resource_state,omitempty"`
+
+		// Set when the notification only starts a document that was held
+		// back by the channel's execution limit
+		DocumentID string `json:"document_id,omitempty"`
+	}
+
+	// The audit trail of a notification, from the webhook that received it
+	// to the workflows it started. The webhook records when it arrived and
+	// the SQS handler adds what it found each time it processes it.
+	NotificationHistory struct {
+		// NotificationID is the partition key for the notification history
+		// table
+		NotificationID string    `dynamodbav:"notification_id" json:"notification_id"`
+		ChannelID      string    `dynamodbav:"channel_id" json:"channel_id"`
+		FolderID       string    `dynamodbav:"folder_id" json:"folder_id"`
+		ReceivedAt     time.Time `dynamodbav:"received_at" json:"received_at"`
+
+		// Set by the SQS handler, Attempts counts the deliveries it
+		// processed and LastError is why the last one failed
+		ProcessedAt       time.Time `dynamodbav:"processed_at" json:"processed_at"`
+		Attempts          int       `dynamodbav:"attempts,omitempty" json:"attempts,omitempty"`
+		DocumentsFound    []string  `dynamodbav:"documents_found,stringset,omitempty" json:"documents_found,omitempty"`
+		ExecutionsStarted []string  `dynamodbav:"executions_started,stringset,omitempty" json:"executions_started,omitempty"`
+		LastError         string    `dynamodbav:"last_error,omitempty" json:"last_error,omitempty"`
+	}
+
+	// A channel notification that used up its deliveries and was moved to
+	// the dead-letter queue. The body is kept as it was queued so it can be
+	// sent back to the main queue.
+	FailedNotification struct {
+		// MessageID is the partition key for the failed notifications table
+		MessageID      string `dynamodbav:"message_id" json:"message_id"`
+		NotificationID string `dynamodbav:"notification_id,omitempty" json:"notification_id,omitempty"`
+		ChannelID      string `dynamodbav:"channel_id,omitempty" json:"channel_id,omitempty"`
+		FolderID       string `dynamodbav:"folder_id,omitempty" json:"folder_id,omitempty"`
+		DocumentID     string `dynamodbav:"document_id,omitempty" json:"document_id,omitempty"`
+		Body           string `dynamodbav:"body" json:"body"`
+
+		// Why the body couldn't be read as a channel notification
+		ParseError string `dynamodbav:"parse_error,omitempty" json:"parse_error,omitempty"`
+
+		// What SQS reported about the deliveries of the message
+		SentAt          time.Time         `dynamodbav:"sent_at" json:"sent_at"`
+		FirstReceivedAt time.Time         `dynamodbav:"first_received_at" json:"first_received_at"`
+		ReceiveCount    int               `dynamodbav:"receive_count" json:"receive_count"`
+		SourceQueueARN  string            `dynamodbav:"source_queue_arn,omitempty" json:"source_queue_arn,omitempty"`
+		Attributes      map[string]string `dynamodbav:"attributes,omitempty" json:"attributes,omitempty"`
+
+		FailedAt     time.Time `dynamodbav:"failed_at" json:"failed_at"`
+		AlertedAt    time.Time `dynamodbav:"alerted_at" json:"alerted_at"`
+		RedrivenAt   time.Time `dynamodbav:"redriven_at" json:"redriven_at"`
+		RedriveCount int       `dynamodbav:"redrive_count,omitempty" json:"redrive_count,omitempty"`
+	}
+
+	// A redacted record of a request the webhook received. Only the X-Goog-*
+	// headers that identify the notification are kept, never the body or
+	// the channel token. Records are removed by TTL once ExpiresAt passes.
+	WebhookCapture struct {
+		ChannelID         string `dynamodbav:"channel_id" json:"channel_id"`
+		CapturedAt        string `dynamodbav:"captured_at" json:"captured_at"`
+		ExpiresAt         int64  `dynamodbav:"expires_at" json:"expires_at"`
+		ResourceState     string `dynamodbav:"resource_state,omitempty" json:"resource_state,omitempty"`
+		ResourceID        string `dynamodbav:"resource_id,omitempty" json:"resource_id,omitempty"`
+		ResourceURI       string `dynamodbav:"resource_uri,omitempty" json:"resource_uri,omitempty"`
+		MessageNumber     string `dynamodbav:"message_number,omitempty" json:"message_number,omitempty"`
+		ChannelExpiration string `dynamodbav:"channel_expiration,omitempty" json:"channel_expiration,omitempty"`
+		Changed           string `dynamodbav:"changed,omitempty" json:"changed,omitempty"`
+
+		// Folder of the watch channel the request resolved to
+		FolderID string `dynamodbav:"folder_id,omitempty" json:"folder_id,omitempty"`
+
+		// Result of validating the request and what was done with it
+		Outcome  string `dynamodbav:"outcome" json:"outcome"`
+		Decision string `dynamodbav:"decision" json:"decision"`
 	}
 
 	// Document state as it is being converted.
@@ -130,6 +417,7 @@ type (
 		GoogleID             string    `dynamodbav:"google_id,omitempty"`
 		GoogleFolderID       string    `dynamodbav:"folder_id"`
 		Name                 string    `dynamodbav:"name"`
+		MimeType             string    `dynamodbav:"mime_type,omitempty"`
 		Size                 int64     `dynamodbav:"size"`
 		CreatedTime          time.Time `dynamodbav:"created_time"`
 		ModifiedTime         time.Time `dynamodbav:"modified_time"`
@@ -138,29 +426,414 @@ type (
 		RawEmailS3Key        string    `dynamodbav:"raw_email_s3key"`
 		Sender               string    `dynamodbav:"sender"`
 		Recipient            string    `dynamodbav:"recipient"`
+		Status               string    `dynamodbav:"status,omitempty"`
+
+		// Stage the document is at, its status is the overall status of
+		// the document in the workflow
+		CurrentStage Stage `dynamodbav:"current_stage,omitempty"`
+
+		// Watch channel the document was found on. The output of the document
+		// goes to the folders configured on the channel for GoogleFolderID.
+		ChannelID string `dynamodbav:"channel_id,omitempty"`
+
+		// Every folder the file was in when it was found, a file can be in
+		// more than one. Empty when the service account can't see any.
+		GoogleParentIDs []string `dynamodbav:"parent_ids,omitempty"`
+
+		// Drive revision of the file when the document was created. A new
+		// revision of an already processed file is processed as a new version.
+		HeadRevisionID    string `dynamodbav:"head_revision_id,omitempty"`
+		Version           int    `dynamodbav:"version,omitempty"`
+		PreviousVersionID string `dynamodbav:"previous_version_id,omitempty"`
+
+		// The version that replaced the document while it was still being
+		// processed. The stages check it and end the workflow early.
+		SupersededBy string `dynamodbav:"superseded_by,omitempty"`
+
+		// SHA-256 of the downloaded content, and the document with the same
+		// content whose note was reused
+		ContentHash string `dynamodbav:"content_hash,omitempty"`
+		DuplicateOf string `dynamodbav:"duplicate_of,omitempty"`
+
+		// Hash chain of the stage artifacts recorded when the note was published
+		Attestation []AttestationLink `dynamodbav:"attestation,omitempty"`
+
+		// Copy of the published note kept in the final prefix of the bucket,
+		// and when the document was published
+		FinalS3Key  string    `dynamodbav:"final_s3_key,omitempty"`
+		CompletedAt time.Time `dynamodbav:"completed_at"`
+
+		// The Drive file and name of the note published to the first
+		// destination folder, and the Drive file of the archived original.
+		// Empty when there is none, like an original left where it was.
+		FinalDriveFileID    string `dynamodbav:"final_drive_file_id,omitempty"`
+		FinalFileName       string `dynamodbav:"final_file_name,omitempty"`
+		ArchivedDriveFileID string `dynamodbav:"archived_drive_file_id,omitempty"`
+
+		// Milliseconds from the start of the download until the upload
+		// completed, set when the upload stage completes
+		PipelineDurationMillis int64 `dynamodbav:"pipeline_duration_millis,omitempty"`
+
+		// Names of the notes the note was split into when it was too large
+		// to publish as one, in order. The note itself is the index.
+		NoteParts []string `dynamodbav:"note_parts"`
+
+		// Read from the app properties of the Drive file, the document and
+		// revision it was tagged with when it was processed. Not stored.
+		TaggedDocumentID string `dynamodbav:"-"`
+		TaggedRevisionID string `dynamodbav:"-"`
+
+		// A scan of several documents is split into a child document for each
+		// at the separator pages. The parent records its children and the
+		// children that have been published, each child records the pages of
+		// the scan it came from.
+		ParentID          string   `dynamodbav:"parent_id,omitempty"`
+		ChildIDs          []string `dynamodbav:"child_ids,omitempty"`
+		ChildrenCompleted []string `dynamodbav:"children_completed,stringset,omitempty"`
+		FirstPage         int      `dynamodbav:"first_page,omitempty"`
+		LastPage          int      `dynamodbav:"last_page,omitempty"`
+
+		// Directives read from the sidecar file dropped next to the original,
+		// and the sidecar so it's archived along with the original. The
+		// directives take precedence over the settings of the watch channel.
+		Directives *DocumentDirectives `dynamodbav:"directives,omitempty"`
+		Sidecar    *SidecarFile        `dynamodbav:"sidecar,omitempty"`
+	}
+
+	// DocumentUpdate is a partial update of a document. Only the fields that
+	// aren't nil are saved, the other attributes are left as they are.
+	DocumentUpdate struct {
+		Status              *string             `dynamodbav:"status,omitempty"`
+		CompletedAt         *time.Time          `dynamodbav:"completed_at,omitempty"`
+		FinalS3Key          *string             `dynamodbav:"final_s3_key,omitempty"`
+		FinalDriveFileID    *string             `dynamodbav:"final_drive_file_id,omitempty"`
+		FinalFileName       *string             `dynamodbav:"final_file_name,omitempty"`
+		ArchivedDriveFileID *string             `dynamodbav:"archived_drive_file_id,omitempty"`
+		NoteParts           *[]string           `dynamodbav:"note_parts,omitempty"`
+		Attestation         *[]AttestationLink  `dynamodbav:"attestation,omitempty"`
+		Directives          *DocumentDirectives `dynamodbav:"directives,omitempty"`
+		Sidecar             *SidecarFile        `dynamodbav:"sidecar,omitempty"`
+	}
+
+	// DocumentDirectives are what a sidecar file tells the stages about a
+	// document. Empty values leave the settings of the channel alone.
+	DocumentDirectives struct {
+		// Language the document is written in, passed on to the cleanup
+		Language string `dynamodbav:"language,omitempty"`
+
+		// Name of one of the Routes of the watch channel to publish to
+		Route string `dynamodbav:"route,omitempty"`
+
+		// One of the PIPELINE values
+		Pipeline string `dynamodbav:"pipeline,omitempty"`
+
+		// Keep the document from being processed until the sidecar no
+		// longer holds it
+		Hold bool `dynamodbav:"hold,omitempty"`
+
+		// Added to the tags in the front matter of the note
+		Tags []string `dynamodbav:"tags,omitempty"`
+
+		// Used in place of the first heading of the note to name the files
+		Title string `dynamodbav:"title,omitempty"`
+	}
+
+	// SidecarFile is a file in a watch folder with the directives for the
+	// document it's named after.
+	SidecarFile struct {
+		GoogleID string `dynamodbav:"google_id"`
+		Name     string `dynamodbav:"name"`
+		FolderID string `dynamodbav:"folder_id"`
+	}
+
+	// AttestationLink is the hash of the artifact produced by a stage chained
+	// to the links of the stages before it.
+	AttestationLink struct {
+		Stage        Stage  `dynamodbav:"stage" json:"stage"`
+		ArtifactHash string `dynamodbav:"artifact_hash" json:"artifact_hash"`
+		ChainHash    string `dynamodbav:"chain_hash" json:"chain_hash"`
 	}
 
 	DocumentChanges struct {
 		Documents      []*Document
 		NextStartToken string
+
+		// Number of files saved by Scriptor that were found in the folder
+		OutputsSkipped int
+
+		// Sidecar files that changed, they are never documents themselves
+		Sidecars []*SidecarFile
+
+		// Google IDs of the files that were trashed in the folder or
+		// removed from Drive. Removed files can be from any folder, as
+		// Drive no longer says where they were.
+		Removed []string
 	}
 
 	// DocumentProcessingStage tracks the document through each stage of processing.
 	DocumentProcessingStage struct {
 		ID               string    `dynamodbav:"id"`
-		Stage            string    `dynamodbav:"stage"`
+		Stage            Stage     `dynamodbav:"stage"`
 		StageStatus      string    `dynamodbav:"stage_status"`
 		StartedAt        time.Time `dynamodbav:"started_at"`
 		CompletedAt      time.Time `dynamodbav:"completed_at"`
 		OriginalFileName string    `dynamodbav:"original_file_name"`
 		StageFileName    string    `dynamodbav:"file_name"`
 		S3Key            string    `dynamodbav:"s3key"`
+		ContentType      string    `dynamodbav:"content_type,omitempty"`
+		ErrorCode        string    `dynamodbav:"error_code,omitempty"`
+		ErrorReason      string    `dynamodbav:"error_reason,omitempty"`
+
+		// Set by the audit when the object at S3Key no longer exists
+		ArtifactMissing bool `dynamodbav:"artifact_missing,omitempty"`
+
+		// Destination folders the upload stage finished publishing to, so a
+		// retry only publishes to the ones that failed
+		CompletedDestinations []string `dynamodbav:"completed_destinations,stringset,omitempty"`
+
+		// The run of the stage this is, from 1. Stages recorded before the
+		// runs were counted have none. LastError is the reason the latest
+		// earlier run failed, and Attempts are the earlier runs, oldest
+		// first.
+		Attempt   int            `dynamodbav:"attempt,omitempty"`
+		LastError string         `dynamodbav:"last_error,omitempty"`
+		Attempts  []StageAttempt `dynamodbav:"attempts,omitempty"`
+
+		// Milliseconds the stage took, set when it completes, and the part
+		// of them spent waiting on Mathpix or OpenAI
+		DurationMillis int64 `dynamodbav:"duration_millis,omitempty"`
+		ExternalMillis int64 `dynamodbav:"external_millis,omitempty"`
 	}
 
-	// TODO: Rethink this
+	// An earlier run of a processing stage
+	StageAttempt struct {
+		Attempt     int       `dynamodbav:"attempt"`
+		StageStatus string    `dynamodbav:"stage_status"`
+		StartedAt   time.Time `dynamodbav:"started_at"`
+		CompletedAt time.Time `dynamodbav:"completed_at"`
+		ErrorCode   string    `dynamodbav:"error_code,omitempty"`
+		ErrorReason string    `dynamodbav:"error_reason,omitempty"`
+	}
+
+	// StageDurationStats are the milliseconds the completed runs of a stage
+	// took, and the average part of them spent on external calls
+	StageDurationStats struct {
+		Stage                 Stage
+		Count                 int
+		AverageMillis         int64
+		P50Millis             int64
+		P90Millis             int64
+		P99Millis             int64
+		AverageExternalMillis int64
+	}
+
+	// The input and output of each stage of the workflow. DocumentID is the
+	// ID of the document record, never the ID of the file in Google Drive,
+	// and Stage is the last stage that finished. ChannelID is the watch
+	// channel the document was found on, empty for Kindle documents.
 	DocumentStep struct {
 		NotificationID string `json:"notification_id"`
+		ChannelID      string `json:"channel_id,omitempty"`
 		DocumentID     string `json:"id"`
-		Stage          string `json:"stage"`
+		Stage          Stage  `json:"stage"`
+		Status         string `json:"status"`
+
+		// The API Gateway request ID of the webhook request that found the
+		// document
+		RequestID string `json:"request_id,omitempty"`
+
+		// Steps of the child documents a scan was split into
+		Children []DocumentStep `json:"children,omitempty"`
+
+		// The earlier document with the same content a downloaded document
+		// waits on
+		DuplicateOf string `json:"duplicate_of,omitempty"`
+
+		// The error a Catch of the workflow caught, and the stage that
+		// failed with the attempt it was on. Only the states that handle
+		// errors get them.
+		Error      *StepError `json:"error,omitempty"`
+		ErrorStage Stage      `json:"error_stage,omitempty"`
+		Attempt    int        `json:"attempt,omitempty"`
+	}
+
+	// StepError is the error a Catch of the workflow adds to the step. The
+	// cause of an error a lambda returned is the JSON of that error.
+	StepError struct {
+		Error string `json:"Error"`
+		Cause string `json:"Cause"`
 	}
 )
+
+// The files processed from a watch folder by default, scans and the Google
+// Docs that are exported as PDF
+var defaultAllowedMimeTypes = []string{
+	CONTENT_TYPE_PDF,
+	CONTENT_TYPE_PNG,
+	CONTENT_TYPE_JPEG,
+	CONTENT_TYPE_HEIC,
+	CONTENT_TYPE_TIFF,
+	CONTENT_TYPE_GOOGLE_DOC,
+}
+
+// AllowsMimeType reports whether files of the MIME type in the watch folder
+// are processed.
+func (wc *WatchChannel) AllowsMimeType(mimeType string) bool {
+	allowed := wc.AllowedMimeTypes
+	if len(allowed) == 0 {
+		allowed = defaultAllowedMimeTypes
+	}
+
+	mimeType = strings.ToLower(strings.TrimSpace(mimeType))
+	for _, entry := range allowed {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+
+		if prefix, ok := strings.CutSuffix(entry, "/*"); ok {
+			if strings.HasPrefix(mimeType, prefix+"/") {
+				return true
+			}
+			continue
+		}
+
+		if entry == mimeType {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Destinations returns the destination folders of the channel, falling back
+// to the single folder of channels saved before the list.
+func (wc *WatchChannel) Destinations() []string {
+	return folderList(wc.DestinationFolderIDs, wc.DestinationFolderID)
+}
+
+// Destinations returns the default destination folders, falling back to the
+// single folder when the list isn't set.
+func (l *GoogleFolderDefaultLocations) Destinations() []string {
+	return folderList(l.DestFolderIDs, l.DestFolderID)
+}
+
+// Stage is a stage of the workflow. It is stored as its string value, so
+// the records saved before the type are read the same.
+type Stage string
+
+// Stages of the workflow in the order they run
+var documentStages = []Stage{
+	DOCUMENT_STAGE_NEW,
+	DOCUMENT_STAGE_DOWNLOAD,
+	DOCUMENT_STAGE_MATHPIX,
+	DOCUMENT_STAGE_OPENAI,
+	DOCUMENT_STAGE_UPLOAD,
+}
+
+// ParseStage returns the stage with the value, failing when it isn't one of
+// the stages of the workflow.
+func ParseStage(value string) (Stage, error) {
+	stage := Stage(value)
+	if !stage.Valid() {
+		return "", fmt.Errorf("unknown document stage %q", value)
+	}
+
+	return stage, nil
+}
+
+// WorkflowStages returns the stages that run on a document, in the order
+// they do. A new document has no record of its own, so it isn't one of them.
+func WorkflowStages() []Stage {
+	return slices.Clone(documentStages[1:])
+}
+
+// Valid reports whether the stage is one of the stages of the workflow.
+func (s Stage) Valid() bool {
+	return slices.Contains(documentStages, s)
+}
+
+// Next returns the stage that runs after this one. There is none after the
+// upload, or after a stage that isn't in the workflow.
+func (s Stage) Next() (Stage, bool) {
+	i := slices.Index(documentStages, s)
+	if i < 0 || i == len(documentStages)-1 {
+		return "", false
+	}
+
+	return documentStages[i+1], true
+}
+
+// Prev returns the stage that runs before this one. There is none before a
+// new document, or before a stage that isn't in the workflow.
+func (s Stage) Prev() (Stage, bool) {
+	i := slices.Index(documentStages, s)
+	if i <= 0 {
+		return "", false
+	}
+
+	return documentStages[i-1], true
+}
+
+// StagesElapsed returns the time from the start of the first stage to the end
+// of the last one, up to now when a stage hasn't ended. The stages are in the
+// order they started.
+func StagesElapsed(stages []*DocumentProcessingStage, now time.Time) time.Duration {
+	if len(stages) == 0 {
+		return 0
+	}
+
+	var end time.Time
+	for _, stage := range stages {
+		if stage.CompletedAt.IsZero() {
+			end = now
+			break
+		}
+
+		if stage.CompletedAt.After(end) {
+			end = stage.CompletedAt
+		}
+	}
+
+	return end.Sub(stages[0].StartedAt)
+}
+
+// FirstFailedStage returns the first of the stages that failed, nil when none
+// did. The stages are in the order they started.
+func FirstFailedStage(stages []*DocumentProcessingStage) *DocumentProcessingStage {
+	for _, stage := range stages {
+		if stage.StageStatus == DOCUMENT_STATUS_ERROR ||
+			stage.StageStatus == DOCUMENT_STATUS_SOURCE_MISSING {
+			return stage
+		}
+	}
+
+	return nil
+}
+
+// ParseArchiveMode returns the archive mode of the setting, moving the
+// original when it's empty.
+func ParseArchiveMode(mode string) (string, error) {
+	switch mode {
+	case "":
+		return ARCHIVE_MODE_MOVE, nil
+	case ARCHIVE_MODE_MOVE, ARCHIVE_MODE_COPY, ARCHIVE_MODE_NONE:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("invalid archive mode %q", mode)
+	}
+}
+
+// The folders of the list without blanks or repeats, or the single folder
+// when the list has none
+func folderList(ids []string, legacyID string) []string {
+	folders := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if id != "" && !slices.Contains(folders, id) {
+			folders = append(folders, id)
+		}
+	}
+
+	if len(folders) == 0 && legacyID != "" {
+		folders = append(folders, legacyID)
+	}
+
+	return folders
+}
@@ -1,6 +1,8 @@
 package types
 
 import (
+	"encoding/json"
+	"slices"
 	"testing"
 	"time"
 
@@ -49,3 +51,337 @@ func TestDocumentMarshalIncludesGoogleIDWhenPresent(t *testing.T) {
 		t.Fatalf("expected google_id to be present for Google Drive documents")
 	}
 }
+
+func TestWatchChannelDestinations(t *testing.T) {
+	tests := []struct {
+		name string
+		wc   WatchChannel
+		want []string
+	}{
+		{
+			name: "legacy single folder",
+			wc:   WatchChannel{DestinationFolderID: "notes"},
+			want: []string{"notes"},
+		},
+		{
+			name: "list of folders",
+			wc: WatchChannel{
+				DestinationFolderID:  "notes",
+				DestinationFolderIDs: []string{"shared", "personal"},
+			},
+			want: []string{"shared", "personal"},
+		},
+		{
+			name: "blanks and repeats dropped",
+			wc:   WatchChannel{DestinationFolderIDs: []string{"shared", "", "shared"}},
+			want: []string{"shared"},
+		},
+		{
+			name: "list of blanks uses the single folder",
+			wc: WatchChannel{
+				DestinationFolderID:  "notes",
+				DestinationFolderIDs: []string{""},
+			},
+			want: []string{"notes"},
+		},
+		{
+			name: "no folders",
+			want: []string{},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got := tc.wc.Destinations()
+			if !slices.Equal(got, tc.want) {
+				t.Fatalf("unexpected destinations: got %v want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestWatchChannelReadsLegacyRecords(t *testing.T) {
+	item, err := attributevalue.MarshalMap(map[string]any{
+		"folder_id":             "watch",
+		"destination_folder_id": "notes",
+	})
+	if err != nil {
+		t.Fatalf("MarshalMap returned error: %v", err)
+	}
+
+	var wc WatchChannel
+	if err := attributevalue.UnmarshalMap(item, &wc); err != nil {
+		t.Fatalf("UnmarshalMap returned error: %v", err)
+	}
+
+	if got := wc.Destinations(); !slices.Equal(got, []string{"notes"}) {
+		t.Fatalf("unexpected destinations: %v", got)
+	}
+}
+
+func TestParseArchiveMode(t *testing.T) {
+	tests := []struct {
+		mode    string
+		want    string
+		wantErr bool
+	}{
+		{mode: "", want: ARCHIVE_MODE_MOVE},
+		{mode: "move", want: ARCHIVE_MODE_MOVE},
+		{mode: "copy", want: ARCHIVE_MODE_COPY},
+		{mode: "none", want: ARCHIVE_MODE_NONE},
+		{mode: "delete", wantErr: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.mode, func(t *testing.T) {
+			got, err := ParseArchiveMode(tc.mode)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if got != tc.want {
+				t.Fatalf("unexpected mode: got %q want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestParseStage(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    Stage
+		wantErr bool
+	}{
+		{value: "new", want: DOCUMENT_STAGE_NEW},
+		{value: "downloaded", want: DOCUMENT_STAGE_DOWNLOAD},
+		{value: "mathpix", want: DOCUMENT_STAGE_MATHPIX},
+		{value: "openai", want: DOCUMENT_STAGE_OPENAI},
+		{value: "uploaded", want: DOCUMENT_STAGE_UPLOAD},
+		{value: "", wantErr: true},
+		{value: "download", wantErr: true},
+		{value: "Mathpix", wantErr: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.value, func(t *testing.T) {
+			got, err := ParseStage(tc.value)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if got != tc.want {
+				t.Fatalf("unexpected stage: got %q want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestStageOrder(t *testing.T) {
+	tests := []struct {
+		stage    Stage
+		wantNext Stage
+		wantPrev Stage
+	}{
+		{stage: DOCUMENT_STAGE_NEW, wantNext: DOCUMENT_STAGE_DOWNLOAD},
+		{stage: DOCUMENT_STAGE_DOWNLOAD, wantNext: DOCUMENT_STAGE_MATHPIX, wantPrev: DOCUMENT_STAGE_NEW},
+		{stage: DOCUMENT_STAGE_MATHPIX, wantNext: DOCUMENT_STAGE_OPENAI, wantPrev: DOCUMENT_STAGE_DOWNLOAD},
+		{stage: DOCUMENT_STAGE_OPENAI, wantNext: DOCUMENT_STAGE_UPLOAD, wantPrev: DOCUMENT_STAGE_MATHPIX},
+		{stage: DOCUMENT_STAGE_UPLOAD, wantPrev: DOCUMENT_STAGE_OPENAI},
+		// a stage that isn't in the workflow has neither
+		{stage: "unknown"},
+	}
+
+	for _, tc := range tests {
+		t.Run(string(tc.stage), func(t *testing.T) {
+			next, ok := tc.stage.Next()
+			if next != tc.wantNext || ok != (tc.wantNext != "") {
+				t.Fatalf("unexpected next stage: got %q %v want %q", next, ok, tc.wantNext)
+			}
+
+			prev, ok := tc.stage.Prev()
+			if prev != tc.wantPrev || ok != (tc.wantPrev != "") {
+				t.Fatalf("unexpected previous stage: got %q %v want %q", prev, ok, tc.wantPrev)
+			}
+		})
+	}
+
+	want := []Stage{
+		DOCUMENT_STAGE_DOWNLOAD,
+		DOCUMENT_STAGE_MATHPIX,
+		DOCUMENT_STAGE_OPENAI,
+		DOCUMENT_STAGE_UPLOAD,
+	}
+	if got := WorkflowStages(); !slices.Equal(got, want) {
+		t.Fatalf("unexpected workflow stages: got %v want %v", got, want)
+	}
+}
+
+func TestWatchChannelAllowsMimeType(t *testing.T) {
+	tests := []struct {
+		name     string
+		allowed  []string
+		mimeType string
+		want     bool
+	}{
+		{name: "pdf by default", mimeType: "application/pdf", want: true},
+		{name: "photo by default", mimeType: "image/jpeg", want: true},
+		{name: "google doc by default", mimeType: CONTENT_TYPE_GOOGLE_DOC, want: true},
+		{name: "sheet not by default", mimeType: "application/vnd.google-apps.spreadsheet"},
+		{name: "text not by default", mimeType: "text/plain"},
+		{name: "channel list", allowed: []string{"application/pdf"}, mimeType: "image/png"},
+		{name: "channel list match", allowed: []string{" Application/PDF "}, mimeType: "application/pdf", want: true},
+		{name: "wildcard", allowed: []string{"image/*"}, mimeType: "image/webp", want: true},
+		{name: "wildcard of another type", allowed: []string{"image/*"}, mimeType: "application/pdf"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			wc := &WatchChannel{AllowedMimeTypes: tc.allowed}
+			if got := wc.AllowsMimeType(tc.mimeType); got != tc.want {
+				t.Fatalf("unexpected result: got %v want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestWatchChannelLockRoundTrip(t *testing.T) {
+	lock := WatchChannelLock{
+		ChannelID:         "channel-1",
+		ChangesStartToken: "start-1",
+		Locked:            true,
+		LockExpires:       1700000000000,
+		UpdatedAt:         "2024-01-01T00:00:00Z",
+		ExpiresAt:         1700000000,
+	}
+
+	item, err := attributevalue.MarshalMap(lock)
+	if err != nil {
+		t.Fatalf("MarshalMap returned error: %v", err)
+	}
+
+	// the store reads and writes the flag by its attribute name
+	if _, ok := item["locked"]; !ok {
+		t.Fatalf("expected locked in %v", item)
+	}
+
+	var got WatchChannelLock
+	if err := attributevalue.UnmarshalMap(item, &got); err != nil {
+		t.Fatalf("UnmarshalMap returned error: %v", err)
+	}
+	if got != lock {
+		t.Fatalf("unexpected lock: got %+v want %+v", got, lock)
+	}
+}
+
+func TestChannelNotificationRoundTrip(t *testing.T) {
+	notifications := []ChannelNotification{
+		{
+			NotificationID: "notification-1",
+			ChannelID:      "channel-1",
+			FolderID:       "folder-1",
+			Kind:           NOTIFICATION_KIND_CHANGES,
+			ResourceState:  "add",
+		},
+		{
+			NotificationID: "notification-2",
+			ChannelID:      "channel-1",
+			FolderID:       "folder-1",
+			Kind:           NOTIFICATION_KIND_BASELINE,
+		},
+		{
+			NotificationID: "notification-3",
+			ChannelID:      "channel-1",
+			FolderID:       "folder-1",
+			DocumentID:     "doc-1",
+		},
+	}
+
+	for _, notification := range notifications {
+		body, err := json.Marshal(&notification)
+		if err != nil {
+			t.Fatalf("Marshal returned error: %v", err)
+		}
+
+		// the SQS handler reads the ID by its JSON name
+		var fields map[string]any
+		if err := json.Unmarshal(body, &fields); err != nil {
+			t.Fatalf("Unmarshal returned error: %v", err)
+		}
+		if fields["notification_id"] != notification.NotificationID {
+			t.Fatalf("expected notification_id in %s", body)
+		}
+
+		var got ChannelNotification
+		if err := json.Unmarshal(body, &got); err != nil {
+			t.Fatalf("Unmarshal returned error: %v", err)
+		}
+		if got != notification {
+			t.Fatalf("unexpected notification: got %+v want %+v", got, notification)
+		}
+	}
+}
+
+func TestStageHistory(t *testing.T) {
+	start := time.Date(2025, 1, 1, 10, 0, 0, 0, time.UTC)
+	now := start.Add(time.Hour)
+	at := func(minutes int) time.Time { return start.Add(time.Duration(minutes) * time.Minute) }
+
+	tests := []struct {
+		name   string
+		stages []*DocumentProcessingStage
+
+		wantElapsed time.Duration
+		wantFailed  Stage
+	}{
+		{name: "no stages"},
+		{
+			name: "still in progress",
+			stages: []*DocumentProcessingStage{
+				{Stage: DOCUMENT_STAGE_DOWNLOAD, StageStatus: DOCUMENT_STATUS_COMPLETE, StartedAt: at(0), CompletedAt: at(1)},
+				{Stage: DOCUMENT_STAGE_MATHPIX, StageStatus: DOCUMENT_STATUS_INPROGRESS, StartedAt: at(1)},
+			},
+			wantElapsed: time.Hour,
+		},
+		{
+			name: "complete",
+			stages: []*DocumentProcessingStage{
+				{Stage: DOCUMENT_STAGE_DOWNLOAD, StageStatus: DOCUMENT_STATUS_COMPLETE, StartedAt: at(0), CompletedAt: at(1)},
+				{Stage: DOCUMENT_STAGE_MATHPIX, StageStatus: DOCUMENT_STATUS_COMPLETE, StartedAt: at(1), CompletedAt: at(4)},
+				{Stage: DOCUMENT_STAGE_OPENAI, StageStatus: DOCUMENT_STATUS_COMPLETE, StartedAt: at(4), CompletedAt: at(5)},
+				{Stage: DOCUMENT_STAGE_UPLOAD, StageStatus: DOCUMENT_STATUS_COMPLETE, StartedAt: at(5), CompletedAt: at(6)},
+			},
+			wantElapsed: 6 * time.Minute,
+		},
+		{
+			name: "failed",
+			stages: []*DocumentProcessingStage{
+				{Stage: DOCUMENT_STAGE_DOWNLOAD, StageStatus: DOCUMENT_STATUS_COMPLETE, StartedAt: at(0), CompletedAt: at(1)},
+				{Stage: DOCUMENT_STAGE_MATHPIX, StageStatus: DOCUMENT_STATUS_ERROR, StartedAt: at(1), CompletedAt: at(2)},
+				{Stage: DOCUMENT_STAGE_OPENAI, StageStatus: DOCUMENT_STATUS_ERROR, StartedAt: at(2), CompletedAt: at(3)},
+			},
+			wantElapsed: 3 * time.Minute,
+			wantFailed:  DOCUMENT_STAGE_MATHPIX,
+		},
+		{
+			name: "source missing",
+			stages: []*DocumentProcessingStage{
+				{Stage: DOCUMENT_STAGE_DOWNLOAD, StageStatus: DOCUMENT_STATUS_SOURCE_MISSING, StartedAt: at(0), CompletedAt: at(2)},
+			},
+			wantElapsed: 2 * time.Minute,
+			wantFailed:  DOCUMENT_STAGE_DOWNLOAD,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := StagesElapsed(tc.stages, now); got != tc.wantElapsed {
+				t.Fatalf("unexpected elapsed time: got %v want %v", got, tc.wantElapsed)
+			}
+
+			failed := FirstFailedStage(tc.stages)
+			if (failed == nil) != (tc.wantFailed == "") || (failed != nil && failed.Stage != tc.wantFailed) {
+				t.Fatalf("unexpected failed stage: got %+v want %q", failed, tc.wantFailed)
+			}
+		})
+	}
+}